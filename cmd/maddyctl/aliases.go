@@ -0,0 +1,129 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/table"
+	"github.com/urfave/cli"
+)
+
+// AliasTable is implemented by table modules that store aliases with
+// expiry time and usage limits.
+type AliasTable interface {
+	Aliases() ([]table.AliasInfo, error)
+	SetAlias(ai table.AliasInfo) error
+	RemoveKey(k string) error
+	PurgeExpired(before time.Time) (int, error)
+}
+
+func openAliasTable(ctx *cli.Context) (AliasTable, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tbl, ok := mod.Instance.(AliasTable)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s is not an aliases table (table.sql_aliases)", ctx.String("cfg-block"))
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return tbl, nil
+}
+
+func aliasesList(tbl AliasTable, ctx *cli.Context) error {
+	list, err := tbl.Aliases()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No aliases.")
+	}
+
+	now := time.Now()
+	for _, ai := range list {
+		expires := "never"
+		if !ai.ExpiresAt.IsZero() {
+			expires = ai.ExpiresAt.Format(time.RFC3339)
+		}
+		uses := strconv.Itoa(ai.Uses)
+		if ai.MaxUses != 0 {
+			uses += "/" + strconv.Itoa(ai.MaxUses)
+		}
+		status := "active"
+		if ai.Expired(now) {
+			status = "expired"
+		}
+		fmt.Printf("%s\t%s\texpires: %s\tuses: %s\t%s\n", ai.Alias, ai.Target, expires, uses, status)
+	}
+	return nil
+}
+
+func aliasesCreate(tbl AliasTable, ctx *cli.Context) error {
+	alias := ctx.Args().Get(0)
+	target := ctx.Args().Get(1)
+	if alias == "" || target == "" {
+		return errors.New("Error: ALIAS and TARGET are required")
+	}
+
+	ai := table.AliasInfo{
+		Alias:   alias,
+		Target:  target,
+		MaxUses: ctx.Int("max-uses"),
+	}
+	if ai.MaxUses < 0 {
+		return errors.New("Error: max-uses should not be negative")
+	}
+	if lifetime := ctx.Duration("lifetime"); lifetime != 0 {
+		ai.ExpiresAt = time.Now().Add(lifetime)
+	}
+
+	return tbl.SetAlias(ai)
+}
+
+func aliasesRemove(tbl AliasTable, ctx *cli.Context) error {
+	alias := ctx.Args().First()
+	if alias == "" {
+		return errors.New("Error: ALIAS is required")
+	}
+
+	return tbl.RemoveKey(alias)
+}
+
+func aliasesPurge(tbl AliasTable, ctx *cli.Context) error {
+	purged, err := tbl.PurgeExpired(time.Now())
+	if err != nil {
+		return err
+	}
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "Removed", purged, "expired aliases.")
+	}
+	return nil
+}
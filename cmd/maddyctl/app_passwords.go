@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli"
+)
+
+func appPasswordsList(be module.AppPasswordDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	list, err := be.ListAppPasswords(username)
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No app passwords.")
+	}
+
+	for _, ap := range list {
+		fmt.Printf("%s\t%s\tprotocols: %s\tcreated: %s\n", ap.ID, ap.Name,
+			strings.Join(ap.Scopes, ","), ap.Created.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func appPasswordsCreate(be module.AppPasswordDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	scopes := ctx.StringSlice("protocol")
+	if len(scopes) == 0 {
+		return errors.New("Error: at least one --protocol is required")
+	}
+
+	info, password, err := be.CreateAppPassword(username, ctx.String("name"), scopes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("ID:", info.ID)
+	fmt.Println("Password:", password)
+	if !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "The password can't be shown again.")
+	}
+	return nil
+}
+
+func appPasswordsRemove(be module.AppPasswordDB, ctx *cli.Context) error {
+	username := ctx.Args().Get(0)
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	id := ctx.Args().Get(1)
+	if id == "" {
+		return errors.New("Error: ID is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("Clients using this password will no longer be able to log in. Continue?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return be.RemoveAppPassword(username, id)
+}
@@ -0,0 +1,148 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/internal/tls/acme"
+	"github.com/urfave/cli"
+)
+
+// openACME initializes the tls.loader.acme block selected using --cfg-block
+// and the DNS provider if --publish is used.
+func openACME(ctx *cli.Context) (*acme.Loader, dnsPublisher, error) {
+	globals, _, mods, err := readConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+
+	cfgBlock := ctx.String("cfg-block")
+	for _, mod := range mods {
+		if mod.Instance.InstanceName() != cfgBlock {
+			continue
+		}
+		l, ok := mod.Instance.(*acme.Loader)
+		if !ok {
+			return nil, nil, fmt.Errorf("Error: configuration block %s is not tls.loader.acme", cfgBlock)
+		}
+		if err := l.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+			return nil, nil, fmt.Errorf("Error: module initialization failed: %w", err)
+		}
+		p, err := dnsProvider(ctx, globals, mods)
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, p, nil
+	}
+	return nil, nil, fmt.Errorf("Error: unknown configuration block: %s", cfgBlock)
+}
+
+func daneRecords(ctx *cli.Context) error {
+	l, p, err := openACME(ctx)
+	if err != nil {
+		return err
+	}
+	current, next, err := l.TLSARecords()
+	if err != nil {
+		return err
+	}
+
+	name := "_25._tcp." + l.Hostname()
+	if p != nil {
+		zone, err := publishZone(ctx, l.Hostname())
+		if err != nil {
+			return err
+		}
+		// Records for keys that are no longer used are removed.
+		return publishRecords(p, zone, name, "TLSA", []string{current, next}, true)
+	}
+
+	fmt.Println("; key of the served certificate")
+	fmt.Printf("%s. TLSA %s\n", name, current)
+	fmt.Println("; next key, used when the certificate is replaced")
+	fmt.Printf("%s. TLSA %s\n", name, next)
+	return nil
+}
+
+func daneCheck(ctx *cli.Context) error {
+	l, _, err := openACME(ctx)
+	if err != nil {
+		return err
+	}
+
+	checkCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	status, err := l.CheckTLSA(checkCtx)
+	if err != nil {
+		return err
+	}
+
+	if !status.Authenticated {
+		fmt.Println("TLSA records are missing or not DNSSEC-signed")
+	}
+	if status.Current {
+		fmt.Println("Served certificate: OK")
+	} else {
+		fmt.Println("Served certificate: no matching TLSA record")
+	}
+	if status.Next {
+		fmt.Println("Next key: OK")
+	} else {
+		fmt.Println("Next key: no matching TLSA record")
+	}
+	if !status.Current || !status.Authenticated {
+		return errors.New("Error: DANE-enabled senders will not be able to deliver mail")
+	}
+	return nil
+}
+
+func daneRollover(ctx *cli.Context) error {
+	l, _, err := openACME(ctx)
+	if err != nil {
+		return err
+	}
+
+	rollCtx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	if !ctx.Bool("force") {
+		status, err := l.CheckTLSA(rollCtx)
+		if err != nil {
+			return err
+		}
+		if status.Authenticated && !status.Next {
+			return errors.New("Error: TLSA record for the next key is not published, run 'maddyctl dane records' first")
+		}
+	}
+
+	if err := l.RolloverKey(rollCtx); err != nil {
+		return fmt.Errorf("Error: failed to obtain the certificate: %w", err)
+	}
+	fmt.Fprintln(os.Stderr, "Certificate for the next key obtained, restart the server to use it.")
+	fmt.Fprintln(os.Stderr, "Then run 'maddyctl dane records' again to replace the record for the old key.")
+	return nil
+}
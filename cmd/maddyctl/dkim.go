@@ -0,0 +1,309 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/urfave/cli"
+)
+
+// DKIM keys are stored the same way modify.dkim does that. Relative key paths
+// are interpreted relative to the state directory.
+
+func dkimKeyPath(ctx *cli.Context, domain, selector string) string {
+	keyValues := strings.NewReplacer("{domain}", domain, "{selector}", selector)
+	return keyValues.Replace(ctx.String("key-path"))
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
+func dkimArgs(ctx *cli.Context) (string, error) {
+	if ctx.NArg() != 1 {
+		return "", errors.New("Error: DOMAIN is required")
+	}
+	domain, err := dns.ForLookup(ctx.Args().First())
+	if err != nil {
+		return "", fmt.Errorf("Error: invalid domain: %w", err)
+	}
+	return domain, nil
+}
+
+func printDKIMRecord(domain, selector string, pkey crypto.Signer) error {
+	record, err := dkim.DNSRecord(pkey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s._domainkey.%s. TXT \"%s\"\n", selector, domain, record)
+	return nil
+}
+
+func publishDKIMRecord(ctx *cli.Context, p dnsPublisher, domain, selector string, pkey crypto.Signer) error {
+	zone, err := publishZone(ctx, domain)
+	if err != nil {
+		return err
+	}
+	record, err := dkim.DNSRecord(pkey)
+	if err != nil {
+		return err
+	}
+	// Selectors are not reused since keys are never overwritten, so existing
+	// records for other keys do not need to be removed.
+	return publishRecord(p, zone, selector+"._domainkey."+domain, record, false)
+}
+
+func dkimGenerate(ctx *cli.Context) error {
+	domain, err := dkimArgs(ctx)
+	if err != nil {
+		return err
+	}
+	selector := ctx.String("selector")
+	if selector == "" {
+		return errors.New("Error: selector is required")
+	}
+
+	p, err := initStateDirPublish(ctx)
+	if err != nil {
+		return err
+	}
+
+	keyPath := dkimKeyPath(ctx, domain, selector)
+	pkey, err := dkim.GenerateKey(keyPath, ctx.String("algo"), log.Logger{Out: log.NopOutput{}})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Key written to", absPath(keyPath))
+	if p != nil {
+		return publishDKIMRecord(ctx, p, domain, selector, pkey)
+	}
+	fmt.Fprintln(os.Stderr, "Publish the following DNS record:")
+	return printDKIMRecord(domain, selector, pkey)
+}
+
+func dkimShowDNS(ctx *cli.Context) error {
+	domain, err := dkimArgs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := initStateDir(ctx); err != nil {
+		return err
+	}
+
+	pkey, err := dkim.LoadKey(dkimKeyPath(ctx, domain, ctx.String("selector")))
+	if err != nil {
+		return err
+	}
+	return printDKIMRecord(domain, ctx.String("selector"), pkey)
+}
+
+// dkimRotate implements staged key rotation.
+//
+// The first step generates the key for the new selector and prints the record
+// to publish (or publishes it using --publish). Signing is not changed since
+// the record may be not visible to other servers yet.
+//
+// The second step (--activate) checks that the new record is published and
+// switches signing to the new key by updating the keys table file used by
+// sign_dkim. The record for the old selector should be kept published until
+// signatures created using it expire.
+func dkimRotate(ctx *cli.Context) error {
+	domain, err := dkimArgs(ctx)
+	if err != nil {
+		return err
+	}
+	selector := ctx.String("selector")
+	if selector == "" {
+		selector = time.Now().Format("20060102")
+	}
+
+	keysFile := ctx.String("keys-file")
+	if keysFile != "" {
+		// initStateDir changes the working directory.
+		keysFile, err = filepath.Abs(keysFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var p dnsPublisher
+	if ctx.Bool("activate") {
+		err = initStateDir(ctx)
+	} else {
+		p, err = initStateDirPublish(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	keyPath := dkimKeyPath(ctx, domain, selector)
+
+	if !ctx.Bool("activate") {
+		pkey, err := dkim.GenerateKey(keyPath, ctx.String("algo"), log.Logger{Out: log.NopOutput{}})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(os.Stderr, "New key written to", absPath(keyPath))
+		if p != nil {
+			err = publishDKIMRecord(ctx, p, domain, selector, pkey)
+		} else {
+			fmt.Fprintln(os.Stderr, "Publish the following DNS record:")
+			err = printDKIMRecord(domain, selector, pkey)
+		}
+		if err != nil {
+			return err
+		}
+		activateCmd := "maddyctl dkim rotate --activate --selector " + selector
+		if keysFile != "" {
+			activateCmd += " --keys-file " + keysFile
+		}
+		fmt.Fprintf(os.Stderr, "Once it is visible in DNS, run '%s %s' to start using the new key\n", activateCmd, domain)
+		return nil
+	}
+
+	pkey, err := dkim.LoadKey(keyPath)
+	if err != nil {
+		return fmt.Errorf("Error: failed to load the new key: %w", err)
+	}
+
+	if !ctx.Bool("no-dns-check") {
+		if err := checkDKIMRecord(domain, selector, pkey); err != nil {
+			return err
+		}
+	}
+
+	if keysFile == "" {
+		fmt.Fprintf(os.Stderr, "Change the selector for %s to %s in the sign_dkim configuration and reload the server\n", domain, selector)
+		return nil
+	}
+
+	oldEntry, err := updateKeysFile(keysFile, domain, selector+"="+keyPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Messages for %s are now signed using selector %s\n", domain, selector)
+	if oldEntry != "" {
+		fmt.Fprintf(os.Stderr, "Keep the records for the previous keys (%s) published until signatures made using them expire (see sig_expiry)\n", oldEntry)
+	}
+	return nil
+}
+
+// checkDKIMRecord makes sure the record for the selector is published and
+// matches the key.
+func checkDKIMRecord(domain, selector string, pkey crypto.Signer) error {
+	expected, err := dkim.DNSRecord(pkey)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	name := selector + "._domainkey." + domain
+	txts, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("Error: failed to lookup %s, is the record published? (use --no-dns-check to skip the check): %w", name, err)
+	}
+
+	normalize := func(s string) string {
+		return strings.Join(strings.Fields(s), "")
+	}
+	for _, txt := range txts {
+		if normalize(txt) == normalize(expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Error: %s does not contain the record for the new key (use --no-dns-check to skip the check)", name)
+}
+
+// updateKeysFile sets the value for the domain in the keys table file
+// (table.file format), preserving other lines. Old value is returned.
+func updateKeysFile(path, domain, value string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		out      strings.Builder
+		oldValue string
+		found    bool
+	)
+	scnr := bufio.NewScanner(strings.NewReader(string(blob)))
+	for scnr.Scan() {
+		line := scnr.Text()
+		parts := strings.SplitN(line, ":", 2)
+		if !found && len(parts) == 2 && !strings.HasPrefix(strings.TrimSpace(line), "#") &&
+			dns.Equal(strings.TrimSpace(parts[0]), domain) {
+			found = true
+			oldValue = strings.TrimSpace(parts[1])
+			line = domain + ": " + value
+		}
+		out.WriteString(line)
+		out.WriteString("\n")
+	}
+	if err := scnr.Err(); err != nil {
+		return "", err
+	}
+	if !found {
+		out.WriteString(domain + ": " + value + "\n")
+	}
+
+	// Replace the file atomically so the server never reads a partially
+	// written table.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(out.String()); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return "", err
+	}
+	return oldValue, os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,133 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/libdns/libdns"
+	"github.com/urfave/cli"
+)
+
+// Records are published using libdns.* modules defined as top-level
+// configuration blocks, the same ones that can be used for ACME DNS-01
+// challenges.
+
+const publishTTL = time.Hour
+
+type dnsPublisher interface {
+	libdns.RecordAppender
+	libdns.RecordSetter
+}
+
+// dnsProvider initializes the provider selected using --publish. nil is
+// returned if the flag is not used.
+func dnsProvider(ctx *cli.Context, globals map[string]interface{}, mods []maddy.ModInfo) (dnsPublisher, error) {
+	cfgBlock := ctx.String("publish")
+	if cfgBlock == "" {
+		return nil, nil
+	}
+
+	for _, mod := range mods {
+		if mod.Instance.InstanceName() != cfgBlock {
+			continue
+		}
+		p, ok := mod.Instance.(dnsPublisher)
+		if !ok {
+			return nil, fmt.Errorf("Error: configuration block %s is not a DNS provider", cfgBlock)
+		}
+		if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+			return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("Error: unknown configuration block: %s", cfgBlock)
+}
+
+// initStateDirPublish is initStateDir that also initializes the DNS provider
+// if --publish is used.
+func initStateDirPublish(ctx *cli.Context) (dnsPublisher, error) {
+	if ctx.String("publish") == "" {
+		return nil, initStateDir(ctx)
+	}
+
+	globals, _, mods, err := readConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return dnsProvider(ctx, globals, mods)
+}
+
+// publishZone returns the zone to use for records of the domain.
+func publishZone(ctx *cli.Context, domain string) (string, error) {
+	zone := ctx.String("zone")
+	if zone == "" {
+		return domain + ".", nil
+	}
+	zone, err := dns.ForLookup(zone)
+	if err != nil {
+		return "", fmt.Errorf("Error: invalid zone: %w", err)
+	}
+	if !dns.Equal(zone, domain) && !strings.HasSuffix(domain, "."+zone) {
+		return "", fmt.Errorf("Error: %s is not in zone %s", domain, zone)
+	}
+	return zone + ".", nil
+}
+
+// publishRecord adds the TXT record for name (FQDN without the trailing dot)
+// to the zone. If replace is true, existing TXT records for name are
+// removed.
+func publishRecord(p dnsPublisher, zone, name, value string, replace bool) error {
+	return publishRecords(p, zone, name, "TXT", []string{value}, replace)
+}
+
+// publishRecords is publishRecord for several records of any type.
+func publishRecords(p dnsPublisher, zone, name, typ string, values []string, replace bool) error {
+	recs := make([]libdns.Record, 0, len(values))
+	for _, value := range values {
+		recs = append(recs, libdns.Record{
+			Type:  typ,
+			Name:  libdns.RelativeName(name+".", zone),
+			Value: value,
+			TTL:   publishTTL,
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var err error
+	if replace {
+		_, err = p.SetRecords(ctx, zone, recs)
+	} else {
+		_, err = p.AppendRecords(ctx, zone, recs)
+	}
+	if err != nil {
+		return fmt.Errorf("Error: failed to publish the record for %s: %w", name, err)
+	}
+	fmt.Fprintln(os.Stderr, "Published the record for", name)
+	return nil
+}
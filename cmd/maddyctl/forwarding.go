@@ -0,0 +1,115 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli"
+)
+
+// ForwardingStorage is implemented by storage modules that support per-user
+// forwarding rules.
+type ForwardingStorage interface {
+	SetForwardRule(username string, rule imapsql.ForwardRule) error
+	RemoveForwardRule(username, addr string) error
+	ForwardRules(username string) ([]imapsql.ForwardRule, error)
+}
+
+func forwardingStorage(be module.Storage) (ForwardingStorage, error) {
+	fs, ok := be.(ForwardingStorage)
+	if !ok {
+		return nil, errors.New("Error: storage backend does not support forwarding")
+	}
+	return fs, nil
+}
+
+func imapAcctForwardList(be module.Storage, ctx *cli.Context) error {
+	fs, err := forwardingStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	rules, err := fs.ForwardRules(username)
+	if err != nil {
+		return err
+	}
+
+	if len(rules) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No forwarding rules.")
+	}
+
+	for _, rule := range rules {
+		match := rule.Match
+		if match == "" {
+			match = "all"
+		}
+		fmt.Printf("%s\tmatch: %s\tkeep copy: %v\n", rule.Address, match, rule.KeepCopy)
+	}
+	return nil
+}
+
+func imapAcctForwardAdd(be module.Storage, ctx *cli.Context) error {
+	fs, err := forwardingStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	addr := ctx.Args().Get(1)
+	if addr == "" {
+		return errors.New("Error: ADDRESS is required")
+	}
+
+	return fs.SetForwardRule(username, imapsql.ForwardRule{
+		Address:  addr,
+		Match:    ctx.String("match"),
+		KeepCopy: ctx.Bool("keep-copy"),
+	})
+}
+
+func imapAcctForwardRemove(be module.Storage, ctx *cli.Context) error {
+	fs, err := forwardingStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+	addr := ctx.Args().Get(1)
+	if addr == "" {
+		return errors.New("Error: ADDRESS is required")
+	}
+
+	return fs.RemoveForwardRule(username, addr)
+}
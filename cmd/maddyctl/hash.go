@@ -51,6 +51,8 @@ func hashCommand(ctx *cli.Context) error {
 		Argon2Memory:  1024,
 		Argon2Time:    2,
 		Argon2Threads: 1,
+
+		SCRAMIterations: pass_table.SCRAMIterations,
 	}
 	if ctx.IsSet("bcrypt-cost") {
 		if ctx.Int("bcrypt-cost") > bcrypt.MaxCost {
@@ -70,6 +72,12 @@ func hashCommand(ctx *cli.Context) error {
 	if ctx.IsSet("argon2-threads") {
 		opts.Argon2Threads = uint8(ctx.Int("argon2-threads"))
 	}
+	if ctx.IsSet("scram-iterations") {
+		if ctx.Int("scram-iterations") < pass_table.SCRAMIterations {
+			return errors.New("Error: too small SCRAM iteration count")
+		}
+		opts.SCRAMIterations = ctx.Int("scram-iterations")
+	}
 
 	var pass string
 	if ctx.IsSet("password") {
@@ -28,9 +28,9 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
-	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
 	"github.com/foxcpp/maddy/framework/module"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
 	"github.com/urfave/cli"
 )
 
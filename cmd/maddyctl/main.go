@@ -24,12 +24,14 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/foxcpp/maddy"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth/pass_table"
 	"github.com/foxcpp/maddy/internal/updatepipe"
 	"github.com/urfave/cli"
 	"golang.org/x/crypto/bcrypt"
@@ -46,6 +48,7 @@ func main() {
 	app.Name = "maddyctl"
 	app.Usage = "maddy mail server administration utility"
 	app.Version = maddy.BuildInfo()
+	app.EnableBashCompletion = true
 
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
@@ -54,6 +57,10 @@ func main() {
 			EnvVar: "MADDY_CONFIG",
 			Value:  filepath.Join(maddy.ConfigDirectory, "maddy.conf"),
 		},
+		cli.BoolFlag{
+			Name:  "direct",
+			Usage: "Access databases directly instead of using the running server for accounts and mailboxes management",
+		},
 	}
 
 	app.Commands = []cli.Command{
@@ -73,7 +80,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openUserDB(ctx)
+						be, err := connectUserDB(ctx)
 						if err != nil {
 							return err
 						}
@@ -113,7 +120,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openUserDB(ctx)
+						be, err := connectUserDB(ctx)
 						if err != nil {
 							return err
 						}
@@ -138,7 +145,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openUserDB(ctx)
+						be, err := connectUserDB(ctx)
 						if err != nil {
 							return err
 						}
@@ -164,7 +171,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openUserDB(ctx)
+						be, err := connectUserDB(ctx)
 						if err != nil {
 							return err
 						}
@@ -174,6 +181,168 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "app-passwords",
+			Usage: "Application-specific passwords management",
+			Subcommands: []cli.Command{
+				{
+					Name:      "list",
+					Usage:     "List app passwords of the account",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_app_passwords",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := connectAppPasswordDB(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return appPasswordsList(be, ctx)
+					},
+				},
+				{
+					Name:      "create",
+					Usage:     "Generate app password restricted to specified protocols",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_app_passwords",
+						},
+						cli.StringSliceFlag{
+							Name:  "protocol,p",
+							Usage: "Protocol the password can be used for (e.g. imap, submission). Can be specified multiple times",
+						},
+						cli.StringFlag{
+							Name:  "name,n",
+							Usage: "Description of the password (e.g. name of the device)",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := connectAppPasswordDB(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return appPasswordsCreate(be, ctx)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Revoke app password",
+					ArgsUsage: "USERNAME ID",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_app_passwords",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := connectAppPasswordDB(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return appPasswordsRemove(be, ctx)
+					},
+				},
+			},
+		},
+		{
+			Name:  "totp",
+			Usage: "TOTP second factor management",
+			Subcommands: []cli.Command{
+				{
+					Name:      "enable",
+					Usage:     "Generate TOTP secret and require the code for the account",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_totp",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+						cli.BoolFlag{
+							Name:  "no-qr",
+							Usage: "Don't print the QR code",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := connectTOTPDB(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return totpEnable(be, ctx)
+					},
+				},
+				{
+					Name:      "disable",
+					Usage:     "Remove TOTP secret",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_totp",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := connectTOTPDB(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return totpDisable(be, ctx)
+					},
+				},
+				{
+					Name:      "status",
+					Usage:     "Check whether TOTP code is required for the account",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_totp",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := connectTOTPDB(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return totpStatus(be, ctx)
+					},
+				},
+			},
+		},
 		{
 			Name:  "imap-acct",
 			Usage: "IMAP storage accounts management",
@@ -190,7 +359,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
+						be, err := connectStorage(ctx)
 						if err != nil {
 							return err
 						}
@@ -236,7 +405,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
+						be, err := connectStorage(ctx)
 						if err != nil {
 							return err
 						}
@@ -261,7 +430,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
+						be, err := connectStorage(ctx)
 						if err != nil {
 							return err
 						}
@@ -269,6 +438,343 @@ func main() {
 						return imapAcctRemove(be, ctx)
 					},
 				},
+				{
+					Name:      "deactivate",
+					Usage:     "Block logins and delivery for IMAP storage account and schedule its deletion",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+						cli.DurationFlag{
+							Name:  "retention",
+							Usage: "Delete the account after the specified time, use 0 to keep it forever",
+							Value: 30 * 24 * time.Hour,
+						},
+						cli.StringFlag{
+							Name:  "message",
+							Usage: "Message returned to senders instead of the default rejection text",
+						},
+						cli.BoolFlag{
+							Name:  "yes,y",
+							Usage: "Don't ask for confirmation",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctDeactivate(be, ctx)
+					},
+				},
+				{
+					Name:      "reactivate",
+					Usage:     "Undo IMAP storage account deactivation",
+					ArgsUsage: "USERNAME",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctReactivate(be, ctx)
+					},
+				},
+				{
+					Name:  "deactivated",
+					Usage: "List deactivated IMAP storage accounts",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctDeactivated(be, ctx)
+					},
+				},
+				{
+					Name:  "purge",
+					Usage: "Delete deactivated IMAP storage accounts with expired retention period",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_mailboxes",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						be, err := openStorage(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(be)
+						return imapAcctPurge(be, ctx)
+					},
+				},
+				{
+					Name:  "forward",
+					Usage: "Manage per-user forwarding rules",
+					Subcommands: []cli.Command{
+						{
+							Name:      "list",
+							Usage:     "List forwarding rules of the account",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctForwardList(be, ctx)
+							},
+						},
+						{
+							Name:      "add",
+							Usage:     "Add or replace the forwarding rule",
+							ArgsUsage: "USERNAME ADDRESS",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+								cli.StringFlag{
+									Name:  "match,m",
+									Usage: "Forward only messages matching the condition (from:ADDR, subject:TEXT, header:NAME:TEXT)",
+								},
+								cli.BoolFlag{
+									Name:  "keep-copy,k",
+									Usage: "Also store the message in the account",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctForwardAdd(be, ctx)
+							},
+						},
+						{
+							Name:      "remove",
+							Usage:     "Remove the forwarding rule",
+							ArgsUsage: "USERNAME ADDRESS",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctForwardRemove(be, ctx)
+							},
+						},
+					},
+				},
+				{
+					Name:  "sieve",
+					Usage: "Manage per-user Sieve scripts",
+					Subcommands: []cli.Command{
+						{
+							Name:      "get",
+							Usage:     "Print the Sieve script of the account",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctSieveGet(be, ctx)
+							},
+						},
+						{
+							Name:        "set",
+							Usage:       "Replace the Sieve script of the account",
+							ArgsUsage:   "USERNAME [FILE]",
+							Description: "Reads the script from FILE or stdin if FILE is not specified",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctSieveSet(be, ctx)
+							},
+						},
+						{
+							Name:      "remove",
+							Usage:     "Remove the Sieve script of the account",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctSieveRemove(be, ctx)
+							},
+						},
+					},
+				},
+				{
+					Name:  "vacation",
+					Usage: "Manage per-user out-of-office responses",
+					Subcommands: []cli.Command{
+						{
+							Name:      "get",
+							Usage:     "Print out-of-office settings of the account",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctVacationGet(be, ctx)
+							},
+						},
+						{
+							Name:        "set",
+							Usage:       "Replace out-of-office settings of the account",
+							ArgsUsage:   "USERNAME [FILE]",
+							Description: "Settings are replaced completely, omitted flags are reset to their defaults",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+								cli.StringFlag{
+									Name:  "message,m",
+									Usage: "Response text, read from FILE or stdin if not specified",
+								},
+								cli.StringFlag{
+									Name:  "subject,s",
+									Usage: "Response subject, \"Auto: \" followed by the original subject is used if not specified",
+								},
+								cli.IntFlag{
+									Name:  "days,d",
+									Usage: "Minimal interval between responses to the same sender",
+									Value: 7,
+								},
+								cli.StringFlag{
+									Name:  "start",
+									Usage: "Do not send responses before the specified date (YYYY-MM-DD or RFC 3339)",
+								},
+								cli.StringFlag{
+									Name:  "end",
+									Usage: "Do not send responses after the specified date (YYYY-MM-DD or RFC 3339)",
+								},
+								cli.BoolFlag{
+									Name:  "disable",
+									Usage: "Store the settings without enabling responses",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctVacationSet(be, ctx)
+							},
+						},
+						{
+							Name:      "remove",
+							Usage:     "Remove out-of-office settings of the account",
+							ArgsUsage: "USERNAME",
+							Flags: []cli.Flag{
+								cli.StringFlag{
+									Name:   "cfg-block",
+									Usage:  "Module configuration block to use",
+									EnvVar: "MADDY_CFGBLOCK",
+									Value:  "local_mailboxes",
+								},
+							},
+							Action: func(ctx *cli.Context) error {
+								be, err := openStorage(ctx)
+								if err != nil {
+									return err
+								}
+								defer closeIfNeeded(be)
+								return imapAcctVacationRemove(be, ctx)
+							},
+						},
+					},
+				},
 				{
 					Name:      "appendlimit",
 					Usage:     "Query or set accounts's APPENDLIMIT value",
@@ -296,6 +802,102 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "aliases",
+			Usage: "Aliases management (table.sql_aliases)",
+			Subcommands: []cli.Command{
+				{
+					Name:  "list",
+					Usage: "List aliases",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_aliases",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openAliasTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return aliasesList(tbl, ctx)
+					},
+				},
+				{
+					Name:      "create",
+					Usage:     "Create or replace alias",
+					ArgsUsage: "ALIAS TARGET",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_aliases",
+						},
+						cli.DurationFlag{
+							Name:  "lifetime,l",
+							Usage: "Reject messages to the alias after the specified time passes",
+						},
+						cli.IntFlag{
+							Name:  "max-uses,m",
+							Usage: "Reject messages to the alias after it is used the specified amount of times",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openAliasTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return aliasesCreate(tbl, ctx)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "Remove alias",
+					ArgsUsage: "ALIAS",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_aliases",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openAliasTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return aliasesRemove(tbl, ctx)
+					},
+				},
+				{
+					Name:  "purge",
+					Usage: "Remove expired aliases",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_aliases",
+						},
+					},
+					Action: func(ctx *cli.Context) error {
+						tbl, err := openAliasTable(ctx)
+						if err != nil {
+							return err
+						}
+						defer closeIfNeeded(tbl)
+						return aliasesPurge(tbl, ctx)
+					},
+				},
+			},
+		},
 		{
 			Name:  "imap-mboxes",
 			Usage: "IMAP mailboxes (folders) management",
@@ -317,7 +919,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
+						be, err := connectStorage(ctx)
 						if err != nil {
 							return err
 						}
@@ -342,7 +944,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
+						be, err := connectStorage(ctx)
 						if err != nil {
 							return err
 						}
@@ -368,7 +970,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
+						be, err := connectStorage(ctx)
 						if err != nil {
 							return err
 						}
@@ -390,7 +992,7 @@ func main() {
 						},
 					},
 					Action: func(ctx *cli.Context) error {
-						be, err := openStorage(ctx)
+						be, err := connectStorage(ctx)
 						if err != nil {
 							return err
 						}
@@ -689,6 +1291,354 @@ func main() {
 					Usage: "Threads to use for Argon2id",
 					Value: 1,
 				},
+				cli.IntFlag{
+					Name:  "scram-iterations",
+					Usage: "PBKDF2 iteration count for SCRAM-SHA-256",
+					Value: pass_table.SCRAMIterations,
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Configuration tools",
+			Subcommands: []cli.Command{
+				{
+					Name:        "schema",
+					Usage:       "Dump directives of all modules as JSON",
+					Description: "Output does not depend on the configuration file and is stable for the same build.",
+					Action:      schemaCommand,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "compact",
+							Usage: "Do not indent the output",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:        "completion",
+			Usage:       "Print shell completion script",
+			Description: "E.g. add 'source <(maddyctl completion bash)' to ~/.bashrc.",
+			Subcommands: []cli.Command{
+				{
+					Name:   "bash",
+					Usage:  "Print bash completion script",
+					Action: completionCommand(bashCompletion),
+				},
+				{
+					Name:   "zsh",
+					Usage:  "Print zsh completion script",
+					Action: completionCommand(zshCompletion),
+				},
+			},
+		},
+		{
+			Name:        "maintenance",
+			Usage:       "Read-only maintenance mode management",
+			Description: "In maintenance mode IMAP mailboxes are read-only and all incoming mail is deferred.",
+			Subcommands: []cli.Command{
+				{
+					Name:  "on",
+					Usage: "Enable maintenance mode",
+					Action: func(ctx *cli.Context) error {
+						return maintenanceSet(ctx, true)
+					},
+				},
+				{
+					Name:  "off",
+					Usage: "Disable maintenance mode",
+					Action: func(ctx *cli.Context) error {
+						return maintenanceSet(ctx, false)
+					},
+				},
+				{
+					Name:   "status",
+					Usage:  "Show whether maintenance mode is enabled",
+					Action: maintenanceStatus,
+				},
+			},
+		},
+		{
+			Name:        "dkim",
+			Usage:       "DKIM keys management",
+			Description: "Relative key paths are interpreted relative to the state directory, like for sign_dkim.",
+			Subcommands: []cli.Command{
+				{
+					Name:      "generate",
+					Usage:     "Generate a new key and print the DNS record to publish",
+					ArgsUsage: "DOMAIN",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "selector,s",
+							Usage: "DKIM selector",
+							Value: "default",
+						},
+						cli.StringFlag{
+							Name:  "key-path",
+							Usage: "Key path template, same as key_path in sign_dkim",
+							Value: "dkim_keys/{domain}_{selector}.key",
+						},
+						cli.StringFlag{
+							Name:  "algo",
+							Usage: "Key algorithm to use: rsa2048, rsa4096, ed25519",
+							Value: "rsa2048",
+						},
+						cli.StringFlag{
+							Name:  "publish",
+							Usage: "Publish the record using the DNS provider (libdns.* module) defined in the specified configuration block",
+						},
+						cli.StringFlag{
+							Name:  "zone",
+							Usage: "DNS zone to publish the record to, the domain itself is used by default",
+						},
+					},
+					Action: dkimGenerate,
+				},
+				{
+					Name:      "show-dns",
+					Usage:     "Print the DNS record for the existing key",
+					ArgsUsage: "DOMAIN",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "selector,s",
+							Usage: "DKIM selector",
+							Value: "default",
+						},
+						cli.StringFlag{
+							Name:  "key-path",
+							Usage: "Key path template, same as key_path in sign_dkim",
+							Value: "dkim_keys/{domain}_{selector}.key",
+						},
+					},
+					Action: dkimShowDNS,
+				},
+				{
+					Name:        "rotate",
+					Usage:       "Generate the key for a new selector or start using it",
+					Description: "First run generates the key and prints the record to publish (or publishes it using --publish).\nOnce the record is published, run with --activate to switch signing to the new key.",
+					ArgsUsage:   "DOMAIN",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "selector,s",
+							Usage: "New DKIM selector, current date (YYYYMMDD) is used by default",
+						},
+						cli.StringFlag{
+							Name:  "key-path",
+							Usage: "Key path template, same as key_path in sign_dkim",
+							Value: "dkim_keys/{domain}_{selector}.key",
+						},
+						cli.StringFlag{
+							Name:  "algo",
+							Usage: "Key algorithm to use: rsa2048, rsa4096, ed25519",
+							Value: "rsa2048",
+						},
+						cli.BoolFlag{
+							Name:  "activate",
+							Usage: "Switch signing to the new key",
+						},
+						cli.StringFlag{
+							Name:  "keys-file",
+							Usage: "Keys table file (table.file) used by sign_dkim to update on --activate",
+						},
+						cli.BoolFlag{
+							Name:  "no-dns-check",
+							Usage: "Do not check that the new record is published before --activate",
+						},
+						cli.StringFlag{
+							Name:  "publish",
+							Usage: "Publish the record using the DNS provider (libdns.* module) defined in the specified configuration block",
+						},
+						cli.StringFlag{
+							Name:  "zone",
+							Usage: "DNS zone to publish the record to, the domain itself is used by default",
+						},
+					},
+					Action: dkimRotate,
+				},
+			},
+		},
+		{
+			Name:        "dane",
+			Usage:       "TLSA records for the certificate managed by tls.loader.acme",
+			Description: "dane directive should be enabled in the tls.loader.acme configuration.",
+			Subcommands: []cli.Command{
+				{
+					Name:  "records",
+					Usage: "Print TLSA records for the current and next keys",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_tls",
+						},
+						cli.StringFlag{
+							Name:  "publish",
+							Usage: "Publish records using the DNS provider (libdns.* module) defined in the specified configuration block",
+						},
+						cli.StringFlag{
+							Name:  "zone",
+							Usage: "DNS zone to publish records to, the hostname itself is used by default",
+						},
+					},
+					Action: daneRecords,
+				},
+				{
+					Name:  "check",
+					Usage: "Compare published TLSA records with the served certificate and the next key",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_tls",
+						},
+					},
+					Action: daneCheck,
+				},
+				{
+					Name:        "rollover",
+					Usage:       "Obtain a new certificate using the next key",
+					Description: "TLSA record for the next key should be published beforehand.",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "local_tls",
+						},
+						cli.BoolFlag{
+							Name:  "force",
+							Usage: "Do not check whether the TLSA record for the next key is published",
+						},
+					},
+					Action: daneRollover,
+				},
+			},
+		},
+		{
+			Name:        "mta-sts",
+			Usage:       "MTA-STS policy hosting",
+			Description: "Policies are read from the mta_sts endpoint configuration.",
+			Subcommands: []cli.Command{
+				{
+					Name:      "dns",
+					Usage:     "Print DNS records to publish for served policies",
+					ArgsUsage: "[DOMAIN...]",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "publish",
+							Usage: "Publish records using the DNS provider (libdns.* module) defined in the specified configuration block",
+						},
+						cli.StringFlag{
+							Name:  "zone",
+							Usage: "DNS zone to publish records to, domains themselves are used by default",
+						},
+					},
+					Action: mtaSTSDNS,
+				},
+				{
+					Name:   "policy",
+					Usage:  "Print the policy file, e.g. to serve it using another web server",
+					Action: mtaSTSPolicy,
+				},
+			},
+		},
+		{
+			Name:   "tail",
+			Usage:  "Show live log messages from the running server",
+			Action: tailCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "endpoint",
+					Usage:  "Address of the openmetrics endpoint with log_stream enabled",
+					EnvVar: "MADDY_STREAM_ENDPOINT",
+					Value:  "http://127.0.0.1:9749",
+				},
+				cli.StringFlag{
+					Name:  "module",
+					Usage: "Show only messages from the specified module",
+				},
+				cli.StringFlag{
+					Name:  "check",
+					Usage: "Show only messages from or related to the specified check",
+				},
+				cli.StringFlag{
+					Name:  "msg-id",
+					Usage: "Show only messages related to the specified message",
+				},
+				cli.BoolFlag{
+					Name:  "debug",
+					Usage: "Include debug messages",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print events as JSON objects",
+				},
+			},
+		},
+		{
+			Name:  "queue",
+			Usage: "Inspect the queue of the running server",
+			Subcommands: []cli.Command{
+				{
+					Name:  "domains",
+					Usage: "Show queued messages aggregated by destination domain",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+						cli.DurationFlag{
+							Name:  "stuck",
+							Usage: "Show only domains with messages queued for longer than the specified duration",
+						},
+						cli.BoolFlag{
+							Name:  "json",
+							Usage: "Print JSON-encoded list",
+						},
+					},
+					Action: queueDomains,
+				},
+				{
+					Name:        "transcript",
+					Usage:       "Show SMTP transcripts of failed delivery attempts for the message",
+					Description: "Transcripts are recorded only if record_transcripts is enabled for the queue.",
+					ArgsUsage:   "MSG_ID",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:   "cfg-block",
+							Usage:  "Module configuration block to use",
+							EnvVar: "MADDY_CFGBLOCK",
+							Value:  "remote_queue",
+						},
+					},
+					Action: queueTranscript,
+				},
+			},
+		},
+		{
+			Name:   "rejections",
+			Usage:  "Show aggregated statistics about rejected messages",
+			Action: rejectionsCommand,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "endpoint",
+					Usage:  "Address of the openmetrics endpoint with rejection_stats enabled",
+					EnvVar: "MADDY_STREAM_ENDPOINT",
+					Value:  "http://127.0.0.1:9749",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "Also show reports for previous periods",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print raw JSON response",
+				},
 			},
 		},
 	}
@@ -698,32 +1648,42 @@ func main() {
 	}
 }
 
-func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
+// readConfig parses the configuration file and registers all modules
+// without initializing them.
+func readConfig(ctx *cli.Context) (globals map[string]interface{}, endpoints, mods []maddy.ModInfo, err error) {
 	cfgPath := ctx.GlobalString("config")
 	if cfgPath == "" {
-		return nil, nil, errors.New("Error: config is required")
+		return nil, nil, nil, errors.New("Error: config is required")
 	}
 	cfgFile, err := os.Open(cfgPath)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error: failed to open config: %w", err)
+		return nil, nil, nil, fmt.Errorf("Error: failed to open config: %w", err)
 	}
 	defer cfgFile.Close()
 	cfgNodes, err := parser.Read(cfgFile, cfgFile.Name())
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error: failed to parse config: %w", err)
+		return nil, nil, nil, fmt.Errorf("Error: failed to parse config: %w", err)
 	}
 
-	globals, cfgNodes, err := maddy.ReadGlobals(cfgNodes)
+	globals, cfgNodes, err = maddy.ReadGlobals(cfgNodes)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	if err := maddy.InitDirs(); err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	module.NoRun = true
-	_, mods, err := maddy.RegisterModules(globals, cfgNodes)
+	endpoints, mods, err = maddy.RegisterModules(globals, cfgNodes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return globals, endpoints, mods, nil
+}
+
+func getCfgBlockModule(ctx *cli.Context) (map[string]interface{}, *maddy.ModInfo, error) {
+	globals, _, mods, err := readConfig(ctx)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -773,6 +1733,42 @@ func openStorage(ctx *cli.Context) (module.Storage, error) {
 	return storage, nil
 }
 
+func openAppPasswordDB(ctx *cli.Context) (module.AppPasswordDB, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db, ok := mod.Instance.(module.AppPasswordDB)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s does not support app passwords", ctx.String("cfg-block"))
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return db, nil
+}
+
+func openTOTPDB(ctx *cli.Context) (module.TOTPUserDB, error) {
+	globals, mod, err := getCfgBlockModule(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db, ok := mod.Instance.(module.TOTPUserDB)
+	if !ok {
+		return nil, fmt.Errorf("Error: configuration block %s does not support TOTP", ctx.String("cfg-block"))
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return db, nil
+}
+
 func openUserDB(ctx *cli.Context) (module.PlainUserDB, error) {
 	globals, mod, err := getCfgBlockModule(ctx)
 	if err != nil {
@@ -0,0 +1,81 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxcpp/maddy"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/internal/maintenance"
+	"github.com/urfave/cli"
+)
+
+// initStateDir reads global directives from the configuration file to
+// locate the state directory used by the server.
+func initStateDir(ctx *cli.Context) error {
+	cfgPath := ctx.GlobalString("config")
+	if cfgPath == "" {
+		return errors.New("Error: config is required")
+	}
+	cfgFile, err := os.Open(cfgPath)
+	if err != nil {
+		return fmt.Errorf("Error: failed to open config: %w", err)
+	}
+	defer cfgFile.Close()
+	cfgNodes, err := parser.Read(cfgFile, cfgFile.Name())
+	if err != nil {
+		return fmt.Errorf("Error: failed to parse config: %w", err)
+	}
+
+	if _, _, err := maddy.ReadGlobals(cfgNodes); err != nil {
+		return err
+	}
+	return maddy.InitDirs()
+}
+
+func maintenanceSet(ctx *cli.Context, on bool) error {
+	if err := initStateDir(ctx); err != nil {
+		return err
+	}
+	if err := maintenance.Set(on); err != nil {
+		return err
+	}
+
+	fmt.Println("Reload the server (send SIGUSR2, e.g. 'systemctl reload maddy') to apply the change")
+	return nil
+}
+
+func maintenanceStatus(ctx *cli.Context) error {
+	if err := initStateDir(ctx); err != nil {
+		return err
+	}
+	if err := maintenance.Load(); err != nil {
+		return err
+	}
+
+	if maintenance.Enabled() {
+		fmt.Println("Maintenance mode is enabled")
+	} else {
+		fmt.Println("Maintenance mode is disabled")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/internal/endpoint/mtasts"
+	"github.com/urfave/cli"
+)
+
+// openMTASTS initializes the mta_sts endpoint and the DNS provider if
+// --publish is used.
+func openMTASTS(ctx *cli.Context) (*mtasts.Endpoint, dnsPublisher, error) {
+	globals, endpoints, mods, err := readConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hooks.RunHooks(hooks.EventShutdown)
+
+	for _, endp := range endpoints {
+		mtaSTS, ok := endp.Instance.(*mtasts.Endpoint)
+		if !ok {
+			continue
+		}
+		if err := mtaSTS.Init(config.NewMap(globals, endp.Cfg)); err != nil {
+			return nil, nil, err
+		}
+		p, err := dnsProvider(ctx, globals, mods)
+		if err != nil {
+			return nil, nil, err
+		}
+		return mtaSTS, p, nil
+	}
+	return nil, nil, errors.New("Error: mta_sts endpoint is not configured")
+}
+
+// mtaSTSDomains returns domains from arguments or all domains served by the
+// endpoint.
+func mtaSTSDomains(ctx *cli.Context, endp *mtasts.Endpoint) ([]string, error) {
+	if ctx.NArg() == 0 {
+		return endp.Domains(), nil
+	}
+
+	served := make(map[string]struct{})
+	for _, domain := range endp.Domains() {
+		served[domain] = struct{}{}
+	}
+	domains := make([]string, 0, ctx.NArg())
+	for _, arg := range ctx.Args() {
+		domain, err := dns.ForLookup(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Error: invalid domain: %w", err)
+		}
+		if _, ok := served[domain]; !ok {
+			return nil, fmt.Errorf("Error: policy is not served for %s", domain)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+func mtaSTSDNS(ctx *cli.Context) error {
+	endp, p, err := openMTASTS(ctx)
+	if err != nil {
+		return err
+	}
+	domains, err := mtaSTSDomains(ctx, endp)
+	if err != nil {
+		return err
+	}
+
+	record := endp.Policy().DNSRecord()
+	if p != nil {
+		for _, domain := range domains {
+			zone, err := publishZone(ctx, domain)
+			if err != nil {
+				return err
+			}
+			// Only one record is allowed, the old one has to go.
+			if err := publishRecord(p, zone, "_mta-sts."+domain, record, true); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(os.Stderr, "The mta-sts.DOMAIN names should still point to this server and be covered by its TLS certificate")
+		return nil
+	}
+	for _, domain := range domains {
+		fmt.Printf("; mta-sts.%s should point to this server and be covered by its TLS certificate\n", domain)
+		fmt.Printf("_mta-sts.%s. TXT \"%s\"\n", domain, record)
+	}
+	return nil
+}
+
+func mtaSTSPolicy(ctx *cli.Context) error {
+	endp, _, err := openMTASTS(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The policy is the same for all domains.
+	fmt.Print(endp.Policy().Text())
+	return nil
+}
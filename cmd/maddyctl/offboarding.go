@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli"
+)
+
+// OffboardingStorage is implemented by storage modules that support account
+// deactivation.
+type OffboardingStorage interface {
+	DeactivateIMAPAcct(username string, retention time.Duration, message string) error
+	ReactivateIMAPAcct(username string) error
+	ListDeactivatedIMAPAccts() ([]imapsql.DeactivatedAcct, error)
+	PurgeDeactivatedIMAPAccts(now time.Time) ([]string, error)
+}
+
+func offboardingStorage(be module.Storage) (OffboardingStorage, error) {
+	obs, ok := be.(OffboardingStorage)
+	if !ok {
+		return nil, errors.New("Error: storage backend does not support account deactivation")
+	}
+	return obs, nil
+}
+
+func imapAcctDeactivate(be module.Storage, ctx *cli.Context) error {
+	obs, err := offboardingStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	retention := ctx.Duration("retention")
+	if !ctx.Bool("yes") {
+		prompt := "Are you sure you want to deactivate this user account?"
+		if retention != 0 {
+			prompt = fmt.Sprintf("Are you sure you want to deactivate this user account? It will be deleted on %s.",
+				time.Now().Add(retention).Format(time.RFC1123))
+		}
+		if !clitools.Confirmation(prompt, false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return obs.DeactivateIMAPAcct(username, retention, ctx.String("message"))
+}
+
+func imapAcctReactivate(be module.Storage, ctx *cli.Context) error {
+	obs, err := offboardingStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	return obs.ReactivateIMAPAcct(username)
+}
+
+func imapAcctDeactivated(be module.Storage, ctx *cli.Context) error {
+	obs, err := offboardingStorage(be)
+	if err != nil {
+		return err
+	}
+
+	list, err := obs.ListDeactivatedIMAPAccts()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 && !ctx.GlobalBool("quiet") {
+		fmt.Fprintln(os.Stderr, "No deactivated users.")
+	}
+
+	for _, acct := range list {
+		purge := "never"
+		if !acct.PurgeAt.IsZero() {
+			purge = acct.PurgeAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%s\tdeactivated: %s\tpurge: %s", acct.Username, acct.DeactivatedAt.Format(time.RFC3339), purge)
+		if acct.Message != "" {
+			fmt.Printf("\tmessage: %s", acct.Message)
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func imapAcctPurge(be module.Storage, ctx *cli.Context) error {
+	obs, err := offboardingStorage(be)
+	if err != nil {
+		return err
+	}
+
+	purged, err := obs.PurgeDeactivatedIMAPAccts(time.Now())
+	for _, username := range purged {
+		fmt.Println(username)
+	}
+	return err
+}
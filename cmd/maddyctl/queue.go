@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/urfave/cli"
+)
+
+// Queue contents are read through the control socket only, opening the queue
+// directly would start deliveries.
+
+func queueDomains(ctx *cli.Context) error {
+	c := dialServer(ctx)
+	if c == nil {
+		return errors.New("Error: server is not running or does not use the configuration block")
+	}
+
+	var domains []queue.DomainStatus
+	if err := c.Call(ctx.String("cfg-block"), control.MethodQueueDomains, control.Params{}, &domains); err != nil {
+		return err
+	}
+
+	if stuck := ctx.Duration("stuck"); stuck != 0 {
+		filtered := domains[:0]
+		for _, d := range domains {
+			if time.Since(d.Oldest) > stuck {
+				filtered = append(filtered, d)
+			}
+		}
+		domains = filtered
+	}
+
+	if ctx.Bool("json") {
+		return json.NewEncoder(os.Stdout).Encode(domains)
+	}
+
+	if len(domains) == 0 {
+		fmt.Println("No queued messages")
+		return nil
+	}
+	for _, d := range domains {
+		domain := d.Domain
+		if domain == "" {
+			domain = "(no domain)"
+		}
+		fmt.Printf("%s: %d messages, %d recipients, oldest %s ago\n",
+			domain, d.Messages, d.Recipients, time.Since(d.Oldest).Truncate(time.Second))
+		if !d.LastAttempt.IsZero() {
+			fmt.Printf("  last attempt: %s\n", d.LastAttempt.Local().Format(time.RFC3339))
+		}
+		if d.LastError != "" {
+			fmt.Printf("  last error: %s\n", d.LastError)
+		}
+	}
+	return nil
+}
+
+func queueTranscript(ctx *cli.Context) error {
+	id := ctx.Args().First()
+	if id == "" {
+		return errors.New("Error: MSG_ID is required")
+	}
+
+	c := dialServer(ctx)
+	if c == nil {
+		return errors.New("Error: server is not running or does not use the configuration block")
+	}
+
+	var transcript string
+	if err := c.Call(ctx.String("cfg-block"), control.MethodQueueTranscript, control.Params{ID: id}, &transcript); err != nil {
+		return err
+	}
+	fmt.Print(transcript)
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/endpoint/openmetrics"
+	"github.com/foxcpp/maddy/internal/rejectstats"
+	"github.com/urfave/cli"
+)
+
+func rejectionsCommand(ctx *cli.Context) error {
+	endpoint := strings.TrimSuffix(ctx.String("endpoint"), "/")
+
+	resp, err := http.Get(endpoint + "/rejections")
+	if err != nil {
+		return fmt.Errorf("Error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error: unexpected server response: %s (is rejection_stats enabled?)", resp.Status)
+	}
+
+	if ctx.Bool("json") {
+		_, err := io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	var data openmetrics.RejectionsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fmt.Errorf("Error: malformed response: %w", err)
+	}
+
+	printRejectReport(data.Current)
+	if ctx.Bool("all") {
+		for _, r := range data.Reports {
+			fmt.Println()
+			printRejectReport(r)
+		}
+	}
+	return nil
+}
+
+func printRejectReport(r rejectstats.Report) {
+	fmt.Printf("%s - %s: %d rejections\n",
+		r.Start.Local().Format(time.RFC3339), r.End.Local().Format(time.RFC3339), r.Total)
+
+	for _, list := range []struct {
+		title   string
+		entries []rejectstats.Entry
+	}{
+		{"Checks", r.Checks},
+		{"Reasons", r.Reasons},
+		{"Sender domains", r.SenderDomains},
+		{"Client ASNs", r.ASNs},
+	} {
+		if len(list.entries) == 0 {
+			continue
+		}
+		fmt.Printf("  %s:\n", list.title)
+		for _, e := range list.entries {
+			fmt.Printf("    %8d %s\n", e.Count, e.Key)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/urfave/cli"
+)
+
+// Accounts and mailboxes management commands are performed through the
+// control socket of the running server if it is available. Otherwise,
+// the database is opened directly.
+
+var errRemoteUnsupported = errors.New("Error: operation is not supported through the server control socket, use --direct")
+
+// dialServer returns the control socket client if the server is running and
+// uses the configuration block. nil is returned otherwise.
+func dialServer(ctx *cli.Context) *control.Client {
+	if ctx.GlobalBool("direct") {
+		return nil
+	}
+	if err := initStateDir(ctx); err != nil {
+		// Will be reported by the direct access code.
+		return nil
+	}
+
+	c, err := control.Dial(control.SocketPath(), ctx.String("cfg-block"))
+	if err != nil {
+		if !errors.Is(err, control.ErrUnavailable) {
+			fmt.Fprintf(os.Stderr, "Failed to connect to the server, accessing the database directly: %v\n", err)
+		}
+		return nil
+	}
+	return c
+}
+
+func connectUserDB(ctx *cli.Context) (module.PlainUserDB, error) {
+	if c := dialServer(ctx); c != nil {
+		return remoteUserDB{c: c, block: ctx.String("cfg-block")}, nil
+	}
+	return openUserDB(ctx)
+}
+
+func connectTOTPDB(ctx *cli.Context) (module.TOTPUserDB, error) {
+	if c := dialServer(ctx); c != nil {
+		return remoteTOTPDB{c: c, block: ctx.String("cfg-block")}, nil
+	}
+	return openTOTPDB(ctx)
+}
+
+func connectAppPasswordDB(ctx *cli.Context) (module.AppPasswordDB, error) {
+	if c := dialServer(ctx); c != nil {
+		return remoteAppPasswordDB{c: c, block: ctx.String("cfg-block")}, nil
+	}
+	return openAppPasswordDB(ctx)
+}
+
+func connectStorage(ctx *cli.Context) (module.Storage, error) {
+	if c := dialServer(ctx); c != nil {
+		return remoteStorage{c: c, block: ctx.String("cfg-block")}, nil
+	}
+	return openStorage(ctx)
+}
+
+type remoteUserDB struct {
+	c     *control.Client
+	block string
+}
+
+func (db remoteUserDB) AuthPlain(username, password string) error {
+	return errRemoteUnsupported
+}
+
+func (db remoteUserDB) ListUsers() ([]string, error) {
+	var users []string
+	err := db.c.Call(db.block, control.MethodUsersList, control.Params{}, &users)
+	return users, err
+}
+
+func (db remoteUserDB) CreateUser(username, password string) error {
+	return db.c.Call(db.block, control.MethodUsersCreate, control.Params{
+		Username: username,
+		Password: password,
+	}, nil)
+}
+
+func (db remoteUserDB) SetUserPassword(username, password string) error {
+	return db.c.Call(db.block, control.MethodUsersPassword, control.Params{
+		Username: username,
+		Password: password,
+	}, nil)
+}
+
+func (db remoteUserDB) DeleteUser(username string) error {
+	return db.c.Call(db.block, control.MethodUsersRemove, control.Params{
+		Username: username,
+	}, nil)
+}
+
+type remoteTOTPDB struct {
+	c     *control.Client
+	block string
+}
+
+func (db remoteTOTPDB) EnableTOTP(username string) (string, error) {
+	var keyURI string
+	err := db.c.Call(db.block, control.MethodTOTPEnable, control.Params{
+		Username: username,
+	}, &keyURI)
+	return keyURI, err
+}
+
+func (db remoteTOTPDB) DisableTOTP(username string) error {
+	return db.c.Call(db.block, control.MethodTOTPDisable, control.Params{
+		Username: username,
+	}, nil)
+}
+
+func (db remoteTOTPDB) TOTPEnabled(username string) (bool, error) {
+	var enabled bool
+	err := db.c.Call(db.block, control.MethodTOTPStatus, control.Params{
+		Username: username,
+	}, &enabled)
+	return enabled, err
+}
+
+type remoteAppPasswordDB struct {
+	c     *control.Client
+	block string
+}
+
+func (db remoteAppPasswordDB) ListAppPasswords(username string) ([]module.AppPassword, error) {
+	var list []module.AppPassword
+	err := db.c.Call(db.block, control.MethodAppPasswordsList, control.Params{
+		Username: username,
+	}, &list)
+	return list, err
+}
+
+func (db remoteAppPasswordDB) CreateAppPassword(username, name string, scopes []string) (module.AppPassword, string, error) {
+	var res control.AppPasswordCreated
+	err := db.c.Call(db.block, control.MethodAppPasswordsCreate, control.Params{
+		Username: username,
+		Name:     name,
+		Scopes:   scopes,
+	}, &res)
+	return res.AppPassword, res.Password, err
+}
+
+func (db remoteAppPasswordDB) RemoveAppPassword(username, id string) error {
+	return db.c.Call(db.block, control.MethodAppPasswordsRemove, control.Params{
+		Username: username,
+		ID:       id,
+	}, nil)
+}
+
+type remoteStorage struct {
+	c     *control.Client
+	block string
+}
+
+func (s remoteStorage) GetOrCreateIMAPAcct(username string) (imapbackend.User, error) {
+	return nil, errRemoteUnsupported
+}
+
+func (s remoteStorage) GetIMAPAcct(username string) (imapbackend.User, error) {
+	return remoteUser{s: s, username: username}, nil
+}
+
+func (s remoteStorage) IMAPExtensions() []string {
+	return nil
+}
+
+func (s remoteStorage) ListIMAPAccts() ([]string, error) {
+	var accts []string
+	err := s.c.Call(s.block, control.MethodAccountsList, control.Params{}, &accts)
+	return accts, err
+}
+
+func (s remoteStorage) CreateIMAPAcct(username string) error {
+	return s.c.Call(s.block, control.MethodAccountsCreate, control.Params{
+		Username: username,
+	}, nil)
+}
+
+func (s remoteStorage) DeleteIMAPAcct(username string) error {
+	return s.c.Call(s.block, control.MethodAccountsRemove, control.Params{
+		Username: username,
+	}, nil)
+}
+
+type remoteUser struct {
+	s        remoteStorage
+	username string
+}
+
+func (u remoteUser) call(method string, p control.Params, result interface{}) error {
+	p.Username = u.username
+	return u.s.c.Call(u.s.block, method, p, result)
+}
+
+func (u remoteUser) Username() string {
+	return u.username
+}
+
+func (u remoteUser) ListMailboxes(subscribed bool) ([]imapbackend.Mailbox, error) {
+	var infos []control.MailboxInfo
+	if err := u.call(control.MethodMailboxesList, control.Params{Subscribed: subscribed}, &infos); err != nil {
+		return nil, err
+	}
+
+	mboxes := make([]imapbackend.Mailbox, 0, len(infos))
+	for _, info := range infos {
+		mboxes = append(mboxes, remoteMailbox{
+			u:    u,
+			name: info.Name,
+			info: &imap.MailboxInfo{
+				Attributes: info.Attributes,
+				Delimiter:  info.Delimiter,
+				Name:       info.Name,
+			},
+		})
+	}
+	return mboxes, nil
+}
+
+func (u remoteUser) GetMailbox(name string) (imapbackend.Mailbox, error) {
+	return remoteMailbox{u: u, name: name}, nil
+}
+
+func (u remoteUser) CreateMailbox(name string) error {
+	return u.call(control.MethodMailboxesCreate, control.Params{Mailbox: name}, nil)
+}
+
+func (u remoteUser) CreateMailboxSpecial(name, specialUseAttr string) error {
+	return u.call(control.MethodMailboxesCreate, control.Params{
+		Mailbox:    name,
+		SpecialUse: specialUseAttr,
+	}, nil)
+}
+
+func (u remoteUser) DeleteMailbox(name string) error {
+	return u.call(control.MethodMailboxesRemove, control.Params{Mailbox: name}, nil)
+}
+
+func (u remoteUser) RenameMailbox(existingName, newName string) error {
+	return u.call(control.MethodMailboxesRename, control.Params{
+		Mailbox: existingName,
+		NewName: newName,
+	}, nil)
+}
+
+func (u remoteUser) Logout() error {
+	return nil
+}
+
+// remoteMailbox supports only operations needed by mailboxes management
+// commands.
+type remoteMailbox struct {
+	u    remoteUser
+	name string
+	info *imap.MailboxInfo
+}
+
+func (m remoteMailbox) Name() string {
+	return m.name
+}
+
+func (m remoteMailbox) Info() (*imap.MailboxInfo, error) {
+	if m.info == nil {
+		return nil, errRemoteUnsupported
+	}
+	return m.info, nil
+}
+
+func (m remoteMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	var res control.MailboxStatus
+	if err := m.u.call(control.MethodMailboxesStatus, control.Params{Mailbox: m.name}, &res); err != nil {
+		return nil, err
+	}
+	status := imap.NewMailboxStatus(m.name, []imap.StatusItem{imap.StatusMessages})
+	status.Messages = res.Messages
+	return status, nil
+}
+
+func (m remoteMailbox) SetSubscribed(subscribed bool) error {
+	return errRemoteUnsupported
+}
+
+func (m remoteMailbox) Check() error {
+	return nil
+}
+
+func (m remoteMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	close(ch)
+	return errRemoteUnsupported
+}
+
+func (m remoteMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	return nil, errRemoteUnsupported
+}
+
+func (m remoteMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errRemoteUnsupported
+}
+
+func (m remoteMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	return errRemoteUnsupported
+}
+
+func (m remoteMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	return errRemoteUnsupported
+}
+
+func (m remoteMailbox) Expunge() error {
+	return errRemoteUnsupported
+}
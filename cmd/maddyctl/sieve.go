@@ -0,0 +1,108 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/urfave/cli"
+)
+
+// SieveStorage is implemented by storage modules that support per-user Sieve
+// scripts.
+type SieveStorage interface {
+	SetSieveScript(username, script string) error
+	RemoveSieveScript(username string) error
+	SieveScript(username string) (string, error)
+}
+
+func sieveStorage(be module.Storage) (SieveStorage, error) {
+	ss, ok := be.(SieveStorage)
+	if !ok {
+		return nil, errors.New("Error: storage backend does not support Sieve scripts")
+	}
+	return ss, nil
+}
+
+func imapAcctSieveGet(be module.Storage, ctx *cli.Context) error {
+	ss, err := sieveStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	script, err := ss.SieveScript(username)
+	if err != nil {
+		return err
+	}
+	if script == "" {
+		if !ctx.GlobalBool("quiet") {
+			fmt.Fprintln(os.Stderr, "No Sieve script.")
+		}
+		return nil
+	}
+	fmt.Print(script)
+	return nil
+}
+
+func imapAcctSieveSet(be module.Storage, ctx *cli.Context) error {
+	ss, err := sieveStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	var script []byte
+	if path := ctx.Args().Get(1); path != "" && path != "-" {
+		script, err = ioutil.ReadFile(path)
+	} else {
+		script, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+
+	return ss.SetSieveScript(username, string(script))
+}
+
+func imapAcctSieveRemove(be module.Storage, ctx *cli.Context) error {
+	ss, err := sieveStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	return ss.RemoveSieveScript(username)
+}
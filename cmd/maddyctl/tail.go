@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/urfave/cli"
+)
+
+func tailCommand(ctx *cli.Context) error {
+	endpoint := strings.TrimSuffix(ctx.String("endpoint"), "/")
+
+	q := url.Values{}
+	if ctx.IsSet("module") {
+		q.Set("module", ctx.String("module"))
+	}
+	if ctx.IsSet("check") {
+		q.Set("check", ctx.String("check"))
+	}
+	if ctx.IsSet("msg-id") {
+		q.Set("msg_id", ctx.String("msg-id"))
+	}
+	if ctx.Bool("debug") {
+		q.Set("level", "debug")
+	}
+
+	resp, err := http.Get(endpoint + "/events?" + q.Encode())
+	if err != nil {
+		return fmt.Errorf("Error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Error: unexpected server response: %s (is log_stream enabled?)", resp.Status)
+	}
+
+	rawJSON := ctx.Bool("json")
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	eventType := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			eventType = ""
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			if eventType == "dropped" {
+				fmt.Fprintln(os.Stderr, "Warning:", data, "events dropped")
+				continue
+			}
+			if rawJSON {
+				fmt.Println(data)
+				continue
+			}
+			printEvent(data)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error: %w", err)
+	}
+	return nil
+}
+
+func printEvent(data string) {
+	var ev log.Event
+	if err := json.Unmarshal([]byte(data), &ev); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: malformed event:", err)
+		return
+	}
+
+	msg := ev.Message
+	if ev.Module != "" {
+		msg = ev.Module + ": " + msg
+	}
+	if ev.Debug {
+		msg = "[debug] " + msg
+	}
+	if len(ev.Fields) != 0 {
+		fieldsBlob, err := json.Marshal(ev.Fields)
+		if err == nil {
+			msg += "\t" + string(fieldsBlob)
+		}
+	}
+	fmt.Println(ev.Stamp.Local().Format(time.RFC3339), msg)
+}
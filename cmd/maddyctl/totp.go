@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/foxcpp/maddy/cmd/maddyctl/clitools"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/skip2/go-qrcode"
+	"github.com/urfave/cli"
+)
+
+func totpEnable(be module.TOTPUserDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("After enrollment, the user will need to append the TOTP code to the password on each login. Continue?", true) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	keyURI, err := be.EnableTOTP(username)
+	if err != nil {
+		return err
+	}
+
+	if !ctx.Bool("no-qr") {
+		qr, err := qrcode.New(keyURI, qrcode.Medium)
+		if err != nil {
+			return err
+		}
+		fmt.Print(qr.ToSmallString(false))
+	}
+
+	if u, err := url.Parse(keyURI); err == nil {
+		fmt.Println("Secret:", u.Query().Get("secret"))
+	}
+	fmt.Println("Key URI:", keyURI)
+	return nil
+}
+
+func totpDisable(be module.TOTPUserDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	if !ctx.Bool("yes") {
+		if !clitools.Confirmation("Are you sure you want to disable TOTP for this account?", false) {
+			return errors.New("Cancelled")
+		}
+	}
+
+	return be.DisableTOTP(username)
+}
+
+func totpStatus(be module.TOTPUserDB, ctx *cli.Context) error {
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	enabled, err := be.TOTPEnabled(username)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		fmt.Println("enabled")
+	} else {
+		fmt.Println("disabled")
+	}
+	return nil
+}
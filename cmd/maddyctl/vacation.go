@@ -0,0 +1,165 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/storage/imapsql"
+	"github.com/urfave/cli"
+)
+
+// VacationStorage is implemented by storage modules that support per-user
+// out-of-office responses.
+type VacationStorage interface {
+	SetVacation(username string, vs imapsql.VacationSettings) error
+	RemoveVacation(username string) error
+	Vacation(username string) (*imapsql.VacationSettings, error)
+}
+
+func vacationStorage(be module.Storage) (VacationStorage, error) {
+	vs, ok := be.(VacationStorage)
+	if !ok {
+		return nil, errors.New("Error: storage backend does not support out-of-office responses")
+	}
+	return vs, nil
+}
+
+// parseVacationTime parses the date or date-time specified for --start and
+// --end flags. Dates are interpreted in the local time zone, end dates are
+// inclusive.
+func parseVacationTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error: invalid date, use YYYY-MM-DD or RFC 3339 format: %s", value)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func imapAcctVacationGet(be module.Storage, ctx *cli.Context) error {
+	vs, err := vacationStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	settings, err := vs.Vacation(username)
+	if err != nil {
+		return err
+	}
+	if settings == nil {
+		if !ctx.GlobalBool("quiet") {
+			fmt.Fprintln(os.Stderr, "No out-of-office settings.")
+		}
+		return nil
+	}
+
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return "not set"
+		}
+		return t.Format(time.RFC3339)
+	}
+	fmt.Println("Enabled:", settings.Enabled)
+	fmt.Println("Active now:", settings.Active(time.Now()))
+	fmt.Println("Start:", formatTime(settings.Start))
+	fmt.Println("End:", formatTime(settings.End))
+	fmt.Println("Interval (days):", settings.Days)
+	fmt.Println("Subject:", settings.Subject)
+	fmt.Println()
+	fmt.Println(settings.Message)
+	return nil
+}
+
+func imapAcctVacationSet(be module.Storage, ctx *cli.Context) error {
+	vs, err := vacationStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	msg := ctx.String("message")
+	if msg == "" {
+		var msgBytes []byte
+		if path := ctx.Args().Get(1); path != "" && path != "-" {
+			msgBytes, err = ioutil.ReadFile(path)
+		} else {
+			msgBytes, err = ioutil.ReadAll(os.Stdin)
+		}
+		if err != nil {
+			return err
+		}
+		msg = strings.TrimSpace(string(msgBytes))
+	}
+
+	start, err := parseVacationTime(ctx.String("start"), false)
+	if err != nil {
+		return err
+	}
+	end, err := parseVacationTime(ctx.String("end"), true)
+	if err != nil {
+		return err
+	}
+
+	return vs.SetVacation(username, imapsql.VacationSettings{
+		Enabled: !ctx.Bool("disable"),
+		Subject: ctx.String("subject"),
+		Message: msg,
+		Days:    ctx.Int("days"),
+		Start:   start,
+		End:     end,
+	})
+}
+
+func imapAcctVacationRemove(be module.Storage, ctx *cli.Context) error {
+	vs, err := vacationStorage(be)
+	if err != nil {
+		return err
+	}
+
+	username := ctx.Args().First()
+	if username == "" {
+		return errors.New("Error: USERNAME is required")
+	}
+
+	return vs.RemoveVacation(username)
+}
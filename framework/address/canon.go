@@ -0,0 +1,141 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/dns"
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// DomainForm selects the representation of internationalized domain names.
+type DomainForm int
+
+const (
+	// FormUnicode is the form with U-labels normalized to NFC and
+	// case-folded. It is used by maddy for routing and lookups.
+	FormUnicode DomainForm = iota
+	// FormASCII is the form with A-labels (Punycode) in lower case. It can
+	// be used without SMTPUTF8.
+	FormASCII
+)
+
+func (f DomainForm) String() string {
+	switch f {
+	case FormUnicode:
+		return "unicode"
+	case FormASCII:
+		return "ascii"
+	}
+	return fmt.Sprintf("DomainForm(%d)", int(f))
+}
+
+// ParseDomainForm parses the DomainForm name as returned by String.
+func ParseDomainForm(s string) (DomainForm, error) {
+	switch strings.ToLower(s) {
+	case "unicode":
+		return FormUnicode, nil
+	case "ascii":
+		return FormASCII, nil
+	}
+	return 0, fmt.Errorf("address: unknown domain form: %s", s)
+}
+
+// CanonicalDomain converts the domain into the canonical representation of
+// the specified form. The trailing dot is removed. Address literals are
+// returned as is.
+//
+// Original value is returned on error.
+func CanonicalDomain(domain string, form DomainForm) (string, error) {
+	if strings.HasPrefix(domain, "[") {
+		return domain, nil
+	}
+
+	uDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return domain, err
+	}
+	if form == FormUnicode {
+		return uDomain, nil
+	}
+
+	aDomain, err := idna.ToASCII(uDomain)
+	if err != nil {
+		return domain, err
+	}
+	return aDomain, nil
+}
+
+// Canonical returns the address with the domain in the canonical
+// representation of the specified form.
+//
+// Unnecessary quoting is removed from the local-part and it is normalized to
+// NFC, its case is preserved.
+//
+// Original value is returned on error.
+func Canonical(addr string, form DomainForm) (string, error) {
+	mbox, domain, err := Split(addr)
+	if err != nil {
+		return addr, err
+	}
+
+	if strings.HasPrefix(mbox, `"`) {
+		raw, err := UnquoteMbox(mbox)
+		if err != nil {
+			return addr, err
+		}
+		mbox = Quote(raw)
+	}
+	mbox = norm.NFC.String(mbox)
+
+	if domain == "" {
+		return mbox, nil
+	}
+
+	domain, err = CanonicalDomain(domain, form)
+	if err != nil {
+		return addr, err
+	}
+	return mbox + "@" + domain, nil
+}
+
+// LookupKeys returns the keys to use for table lookups of the address.
+//
+// The first key is the ForLookup result. If the domain is internationalized,
+// the same key with the domain in the A-label form follows so tables can
+// list addresses in any form.
+func LookupKeys(addr string) ([]string, error) {
+	key, err := ForLookup(addr)
+	if err != nil {
+		return []string{key}, err
+	}
+
+	mbox, domain, err := Split(key)
+	if err != nil || domain == "" || IsASCII(domain) || strings.HasPrefix(domain, "[") {
+		return []string{key}, nil
+	}
+	aDomain, err := idna.ToASCII(domain)
+	if err != nil {
+		return []string{key}, nil
+	}
+	return []string{key, mbox + "@" + aDomain}, nil
+}
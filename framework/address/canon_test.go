@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	test := func(addr string, form DomainForm, canonical string, fail bool) {
+		t.Helper()
+
+		actual, err := Canonical(addr, form)
+		if err != nil && !fail {
+			t.Errorf("%s (%v): unexpected error: %v", addr, form, err)
+			return
+		}
+		if err == nil && fail {
+			t.Errorf("%s (%v): expected error, got %s", addr, form, actual)
+			return
+		}
+		if actual != canonical {
+			t.Errorf("%s (%v): want %s, got %s", addr, form, canonical, actual)
+		}
+	}
+
+	test("Test@Example.ORG.", FormUnicode, "Test@example.org", false)
+	test("Test@Example.ORG.", FormASCII, "Test@example.org", false)
+	test("test@XN--E1AFMKFD.xn--p1ai", FormUnicode, "test@пример.рф", false)
+	test("test@ПРИМЕР.рф", FormUnicode, "test@пример.рф", false)
+	test("test@ПРИМЕР.рф", FormASCII, "test@xn--e1afmkfd.xn--p1ai", false)
+	test("тест@пример.рф", FormASCII, "тест@xn--e1afmkfd.xn--p1ai", false)
+	test(`"test"@пример.рф`, FormASCII, "test@xn--e1afmkfd.xn--p1ai", false)
+	test("test@[IPv6:BEEF::1]", FormASCII, "test@[IPv6:BEEF::1]", false)
+	test("postmaster", FormASCII, "postmaster", false)
+}
+
+func TestParseDomainForm(t *testing.T) {
+	for _, form := range []DomainForm{FormUnicode, FormASCII} {
+		parsed, err := ParseDomainForm(form.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != form {
+			t.Errorf("%v: got %v", form, parsed)
+		}
+	}
+	if _, err := ParseDomainForm("punycode"); err == nil {
+		t.Error("Expected an error for unknown form")
+	}
+}
+
+func TestLookupKeys(t *testing.T) {
+	test := func(addr string, keys ...string) {
+		t.Helper()
+
+		actual, err := LookupKeys(addr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", addr, err)
+			return
+		}
+		if !reflect.DeepEqual(actual, keys) {
+			t.Errorf("%s: want %v, got %v", addr, keys, actual)
+		}
+	}
+
+	test("Test@Example.org", "test@example.org")
+	test("Test@xn--e1afmkfd.xn--p1ai", "test@пример.рф", "test@xn--e1afmkfd.xn--p1ai")
+	test("Test@пример.рф.", "test@пример.рф", "test@xn--e1afmkfd.xn--p1ai")
+	test("postmaster", "postmaster")
+}
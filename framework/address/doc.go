@@ -17,5 +17,16 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 */
 
 // Package address provides utilities for parsing
-// and validation of RFC 2821 addresses.
+// and validation of RFC 5321 addresses.
+//
+// Validate checks addresses against RFC 5321 (and RFC 6531 for UTF-8
+// addresses) at the configurable strictness level. Normalize converts the
+// address into the canonical form used by maddy internally, Canonical allows
+// to select the domain form (U-labels or A-labels) for storage or the wire.
+//
+// Case folding rules: domains are always compared case-insensitively
+// (after IDNA conversion). Local-parts are case-sensitive according to RFC
+// 5321 but maddy compares them case-insensitively after NFC normalization
+// (ForLookup, Equal). PRECISFold is a stricter variant used for account
+// names.
 package address
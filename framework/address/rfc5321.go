@@ -0,0 +1,309 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Length limits from RFC 5321 Section 4.5.3.1. For UTF-8 addresses (RFC 6531)
+// they are counted in octets.
+const (
+	MaxLocalPartLen = 64
+	MaxDomainLen    = 255
+	// Path is limited to 256 octets including angle brackets.
+	MaxAddressLen = 254
+	MaxLabelLen   = 63
+)
+
+// Strictness controls which addresses are accepted by Validate.
+type Strictness int
+
+const (
+	// Lax accepts addresses that pass Valid. Some syntactically invalid but
+	// deployed addresses (e.g. local-parts with consecutive dots) are
+	// accepted.
+	Lax Strictness = iota
+	// RFC accepts addresses matching the Mailbox syntax of RFC 5321 (extended
+	// by RFC 6531 if UTF-8 is allowed) within the length limits.
+	RFC
+	// Strict is RFC but also rejects quoted local-parts, address literals
+	// and local-parts not in NFC.
+	Strict
+)
+
+func (s Strictness) String() string {
+	switch s {
+	case Lax:
+		return "lax"
+	case RFC:
+		return "rfc"
+	case Strict:
+		return "strict"
+	}
+	return fmt.Sprintf("Strictness(%d)", int(s))
+}
+
+// ParseStrictness converts the configuration value ("lax", "rfc" or "strict")
+// into Strictness.
+func ParseStrictness(s string) (Strictness, error) {
+	switch s {
+	case "lax":
+		return Lax, nil
+	case "rfc":
+		return RFC, nil
+	case "strict":
+		return Strict, nil
+	}
+	return Lax, fmt.Errorf("address: unknown strictness: %s", s)
+}
+
+// Validate checks whether addr is a valid forward-path or reverse-path
+// (without angle brackets) at the specified strictness level. The special
+// "postmaster" address is always valid.
+//
+// If allowUTF8 is false, only ASCII addresses are accepted as required by RFC
+// 5321 for sessions not using SMTPUTF8.
+func Validate(addr string, allowUTF8 bool, s Strictness) error {
+	if !allowUTF8 && !IsASCII(addr) {
+		return errors.New("address: non-ASCII address")
+	}
+	if s == Lax {
+		if !Valid(addr) {
+			return errors.New("address: malformed address")
+		}
+		return nil
+	}
+
+	if len(addr) > MaxAddressLen {
+		return errors.New("address: address is too long")
+	}
+	mbox, domain, err := Split(addr)
+	if err != nil {
+		return err
+	}
+	if domain == "" {
+		return nil
+	}
+	if err := ValidateMailbox(mbox, allowUTF8, s); err != nil {
+		return err
+	}
+	return ValidateDomain(domain, allowUTF8, s)
+}
+
+func isAtext(ch rune, allowUTF8 bool) bool {
+	switch {
+	case ch >= '0' && ch <= '9', ch >= 'A' && ch <= 'Z', ch >= 'a' && ch <= 'z':
+		return true
+	case ch == '.':
+		return false
+	case validGraphic[ch]:
+		return true
+	case ch >= utf8.RuneSelf:
+		return allowUTF8
+	}
+	return false
+}
+
+// isDotString checks whether mbox matches the Dot-string production of RFC
+// 5321.
+func isDotString(mbox string, allowUTF8 bool) bool {
+	for _, atom := range strings.Split(mbox, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, ch := range atom {
+			if !isAtext(ch, allowUTF8) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ValidateMailbox checks the local-part of the address, see Validate.
+func ValidateMailbox(mbox string, allowUTF8 bool, s Strictness) error {
+	if s == Lax {
+		if !ValidMailboxName(mbox) {
+			return errors.New("address: malformed local-part")
+		}
+		return nil
+	}
+
+	if len(mbox) > MaxLocalPartLen {
+		return errors.New("address: local-part is too long")
+	}
+	if !utf8.ValidString(mbox) {
+		return errors.New("address: local-part is not valid UTF-8")
+	}
+	if !allowUTF8 && !IsASCII(mbox) {
+		return errors.New("address: non-ASCII local-part")
+	}
+	if s == Strict && !norm.NFC.IsNormalString(mbox) {
+		return errors.New("address: local-part is not in NFC")
+	}
+
+	if !strings.HasPrefix(mbox, `"`) {
+		if !isDotString(mbox, allowUTF8) {
+			return errors.New("address: malformed local-part")
+		}
+		return nil
+	}
+
+	if s == Strict {
+		return errors.New("address: quoted local-part")
+	}
+	if len(mbox) < 2 || !strings.HasSuffix(mbox, `"`) {
+		return errors.New("address: unterminated quoted local-part")
+	}
+	escaped := false
+	for _, ch := range mbox[1 : len(mbox)-1] {
+		if escaped {
+			// quoted-pairSMTP
+			if ch < ' ' || ch > '~' {
+				return errors.New("address: invalid quoted-pair in local-part")
+			}
+			escaped = false
+			continue
+		}
+		switch {
+		case ch == '\\':
+			escaped = true
+		case ch == '"':
+			return errors.New("address: unescaped quote in local-part")
+		case ch >= ' ' && ch <= '~':
+		case ch >= utf8.RuneSelf && allowUTF8:
+		default:
+			return errors.New("address: invalid character in quoted local-part")
+		}
+	}
+	if escaped {
+		return errors.New("address: unterminated quoted-pair in local-part")
+	}
+	return nil
+}
+
+func validateAddrLiteral(lit string) error {
+	lit = lit[1 : len(lit)-1]
+	if strings.HasPrefix(lit, "IPv6:") {
+		lit = lit[len("IPv6:"):]
+		if net.ParseIP(lit) == nil || !strings.Contains(lit, ":") {
+			return errors.New("address: malformed IPv6 address literal")
+		}
+		return nil
+	}
+	// General-address-literal is not supported.
+	if net.ParseIP(lit) == nil || strings.Contains(lit, ":") {
+		return errors.New("address: malformed address literal")
+	}
+	return nil
+}
+
+// ValidateDomain checks the domain part of the address, see Validate.
+//
+// U-labels are accepted only if allowUTF8 is true. They should be valid
+// according to IDNA2008 and the A-label form should fit the length limits.
+func ValidateDomain(domain string, allowUTF8 bool, s Strictness) error {
+	if s == Lax {
+		if !ValidDomain(domain) {
+			return errors.New("address: malformed domain")
+		}
+		return nil
+	}
+
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		if s == Strict {
+			return errors.New("address: address literal")
+		}
+		return validateAddrLiteral(domain)
+	}
+
+	if !IsASCII(domain) {
+		if !allowUTF8 {
+			return errors.New("address: non-ASCII domain")
+		}
+		var err error
+		domain, err = idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return fmt.Errorf("address: malformed domain: %w", err)
+		}
+	}
+
+	if len(domain) > MaxDomainLen {
+		return errors.New("address: domain is too long")
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" {
+			return errors.New("address: empty domain label")
+		}
+		if len(label) > MaxLabelLen {
+			return errors.New("address: domain label is too long")
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("address: domain label starts or ends with a hyphen")
+		}
+		for _, ch := range label {
+			if !(ch >= '0' && ch <= '9' || ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch == '-') {
+				return errors.New("address: invalid character in domain")
+			}
+		}
+	}
+	return nil
+}
+
+// Quote converts the raw local-part (e.g. returned by UnquoteMbox) into the
+// Local-part syntax. It is quoted only if necessary.
+func Quote(mbox string) string {
+	if mbox != "" && isDotString(mbox, true) {
+		return mbox
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, ch := range mbox {
+		if ch == '"' || ch == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(ch)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Normalize returns the address in its canonical form that is equivalent to
+// the original one.
+//
+// Unnecessary quoting is removed from the local-part and it is normalized to
+// NFC. The domain is converted to U-labels, normalized to NFC and
+// case-folded. Local-part case is preserved, use ForLookup to compare
+// addresses.
+//
+// It is the same as Canonical(addr, FormUnicode).
+//
+// Original value is returned on error.
+func Normalize(addr string) (string, error) {
+	return Canonical(addr, FormUnicode)
+}
@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package address
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	test := func(addr string, allowUTF8 bool, s Strictness, valid bool) {
+		t.Helper()
+
+		err := Validate(addr, allowUTF8, s)
+		if err != nil && valid {
+			t.Errorf("%s (%v, utf8=%v): unexpected error: %v", addr, s, allowUTF8, err)
+		}
+		if err == nil && !valid {
+			t.Errorf("%s (%v, utf8=%v): expected error", addr, s, allowUTF8)
+		}
+	}
+
+	for _, s := range []Strictness{Lax, RFC, Strict} {
+		test("simple@example.org", false, s, true)
+		test("with+subaddr@example.org", false, s, true)
+		test("postmaster", false, s, true)
+		test("no-at-sign", false, s, false)
+		test("тест@example.org", false, s, false)
+		test("тест@пример.рф", true, s, true)
+	}
+
+	test("a..b@example.org", false, Lax, true)
+	test("a..b@example.org", false, RFC, false)
+	test(".a@example.org", false, RFC, false)
+	test("a.@example.org", false, RFC, false)
+	test("a b@example.org", false, RFC, false)
+	test(`"a b"@example.org`, false, RFC, true)
+	test(`"a b"@example.org`, false, Strict, false)
+	test(`"a\"b"@example.org`, false, RFC, true)
+	test(`"a"b"@example.org`, false, RFC, false)
+	test(`"a\"@example.org`, false, RFC, false)
+	test(`"тест"@example.org`, true, RFC, true)
+	test(`"тест"@example.org`, false, RFC, false)
+	test(strings.Repeat("a", 64)+"@example.org", false, RFC, true)
+	test(strings.Repeat("a", 65)+"@example.org", false, RFC, false)
+	test("a@"+strings.Repeat("b", 63)+".org", false, RFC, true)
+	test("a@"+strings.Repeat("b", 64)+".org", false, RFC, false)
+	test("a@"+strings.Repeat(strings.Repeat("b", 60)+".", 5)+"org", false, RFC, false)
+	test("a@-example.org", false, RFC, false)
+	test("a@example-.org", false, RFC, false)
+	test("a@exa_mple.org", false, RFC, false)
+	test("a@example..org", false, RFC, false)
+	test("a@[1.2.3.4]", false, RFC, true)
+	test("a@[1.2.3.4]", false, Strict, false)
+	test("a@[IPv6:beef::1]", false, RFC, true)
+	test("a@[IPv6:1.2.3.4]", false, RFC, false)
+	test("a@[beef::1]", false, RFC, false)
+	test("a@[foo]", false, RFC, false)
+	// NFD form of "é".
+	test("é@example.org", true, RFC, true)
+	test("é@example.org", true, Strict, false)
+	test("\xff@example.org", true, RFC, false)
+}
+
+func TestQuote(t *testing.T) {
+	test := func(raw, quoted string) {
+		t.Helper()
+
+		actual := Quote(raw)
+		if actual != quoted {
+			t.Errorf("%s: want %s, got %s", raw, quoted, actual)
+		}
+		unquoted, err := UnquoteMbox(actual)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", raw, err)
+		}
+		if unquoted != raw {
+			t.Errorf("%s: round-trip failed, got %s", raw, unquoted)
+		}
+	}
+
+	test("simple", "simple")
+	test("a.b", "a.b")
+	test("a..b", `"a..b"`)
+	test("a b", `"a b"`)
+	test(`a"b`, `"a\"b"`)
+	test(`a\b`, `"a\\b"`)
+	test("a@b", `"a@b"`)
+}
+
+func TestNormalize(t *testing.T) {
+	test := func(addr, normalized string, fail bool) {
+		t.Helper()
+
+		actual, err := Normalize(addr)
+		if err != nil && !fail {
+			t.Errorf("%s: unexpected error: %v", addr, err)
+			return
+		}
+		if err == nil && fail {
+			t.Errorf("%s: expected error, got %s", addr, actual)
+			return
+		}
+		if actual != normalized {
+			t.Errorf("%s: want %s, got %s", addr, normalized, actual)
+		}
+	}
+
+	test("Test@Example.ORG", "Test@example.org", false)
+	test(`"test"@example.org`, "test@example.org", false)
+	test(`"te st"@example.org`, `"te st"@example.org`, false)
+	test(`"te\st"@example.org`, "test@example.org", false)
+	test("test@xn--e1afmkfd.xn--p1ai", "test@пример.рф", false)
+	test("é@example.org", "é@example.org", false)
+	test("test@[IPv6:BEEF::1]", "test@[IPv6:BEEF::1]", false)
+	test("postmaster", "postmaster", false)
+	test("test@Example.org.", "test@example.org", false)
+	test(`"te"st"@example.org`, `"te"st"@example.org`, true)
+}
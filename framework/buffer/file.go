@@ -75,10 +75,13 @@ func BufferInFile(r io.Reader, dir string) (Buffer, error) {
 		return nil, fmt.Errorf("buffer: failed to create file: %v", err)
 	}
 	if _, err = io.Copy(f, r); err != nil {
-		return nil, fmt.Errorf("buffer: failed to write file: %v", err)
+		f.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("buffer: failed to write file: %w", err)
 	}
 	if err := f.Close(); err != nil {
-		return nil, fmt.Errorf("buffer: failed to close file: %v", err)
+		os.Remove(path)
+		return nil, fmt.Errorf("buffer: failed to close file: %w", err)
 	}
 
 	return FileBuffer{Path: path}, nil
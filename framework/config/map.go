@@ -35,6 +35,10 @@ type matcher struct {
 	mapper        func(*Map, Node) (interface{}, error)
 	store         *reflect.Value
 
+	// Used only for schema export.
+	typ     string
+	allowed []string
+
 	customCallback func(*Map, Node) error
 }
 
@@ -62,6 +66,11 @@ type Map struct {
 	Globals map[string]interface{}
 	// Config block used by Process.
 	Block Node
+
+	// Set by NewSchemaMap.
+	schemaOnly bool
+	schema     []DirectiveSchema
+	schemaDone bool
 }
 
 func NewMap(globals map[string]interface{}, block Node) *Map {
@@ -105,6 +114,7 @@ func (m *Map) EnumList(name string, inheritGlobal, required bool, allowed, defau
 
 		return node.Args, nil
 	}, store)
+	m.describe(name, "enum_list", allowed)
 }
 
 // Enum maps a configuration directive to a string variable.
@@ -132,6 +142,7 @@ func (m *Map) Enum(name string, inheritGlobal, required bool, allowed []string,
 
 		return nil, NodeErr(node, "invalid argument, valid values are: %v", allowed)
 	}, store)
+	m.describe(name, "enum", allowed)
 }
 
 // Duration maps configuration directive to a time.Duration variable.
@@ -168,6 +179,7 @@ func (m *Map) Duration(name string, inheritGlobal, required bool, defaultVal tim
 
 		return dur, nil
 	}, store)
+	m.describe(name, "duration", nil)
 }
 
 func ParseDataSize(s string) (int, error) {
@@ -250,6 +262,7 @@ func (m *Map) DataSize(name string, inheritGlobal, required bool, defaultVal int
 
 		return dur, nil
 	}, store)
+	m.describe(name, "data_size", nil)
 }
 
 // Bool maps presence of some configuration directive to a boolean variable.
@@ -282,6 +295,7 @@ func (m *Map) Bool(name string, inheritGlobal, defaultVal bool, store *bool) {
 		}
 		return nil, NodeErr(node, "bool argument should be 'yes' or 'no'")
 	}, store)
+	m.describe(name, "bool", nil)
 }
 
 // StringList maps configuration directive with the specified name to variable
@@ -305,6 +319,7 @@ func (m *Map) StringList(name string, inheritGlobal, required bool, defaultVal [
 
 		return node.Args, nil
 	}, store)
+	m.describe(name, "string_list", nil)
 }
 
 // String maps configuration directive with the specified name to variable
@@ -327,6 +342,7 @@ func (m *Map) String(name string, inheritGlobal, required bool, defaultVal strin
 
 		return node.Args[0], nil
 	}, store)
+	m.describe(name, "string", nil)
 }
 
 // Int maps configuration directive with the specified name to variable
@@ -353,6 +369,7 @@ func (m *Map) Int(name string, inheritGlobal, required bool, defaultVal int, sto
 		}
 		return i, nil
 	}, store)
+	m.describe(name, "int", nil)
 }
 
 // UInt maps configuration directive with the specified name to variable
@@ -379,6 +396,7 @@ func (m *Map) UInt(name string, inheritGlobal, required bool, defaultVal uint, s
 		}
 		return uint(i), nil
 	}, store)
+	m.describe(name, "uint", nil)
 }
 
 // Int32 maps configuration directive with the specified name to variable
@@ -405,6 +423,7 @@ func (m *Map) Int32(name string, inheritGlobal, required bool, defaultVal int32,
 		}
 		return int32(i), nil
 	}, store)
+	m.describe(name, "int", nil)
 }
 
 // UInt32 maps configuration directive with the specified name to variable
@@ -431,6 +450,7 @@ func (m *Map) UInt32(name string, inheritGlobal, required bool, defaultVal uint3
 		}
 		return uint32(i), nil
 	}, store)
+	m.describe(name, "uint", nil)
 }
 
 // Int64 maps configuration directive with the specified name to variable
@@ -457,6 +477,7 @@ func (m *Map) Int64(name string, inheritGlobal, required bool, defaultVal int64,
 		}
 		return i, nil
 	}, store)
+	m.describe(name, "int", nil)
 }
 
 // UInt64 maps configuration directive with the specified name to variable
@@ -483,6 +504,7 @@ func (m *Map) UInt64(name string, inheritGlobal, required bool, defaultVal uint6
 		}
 		return i, nil
 	}, store)
+	m.describe(name, "uint", nil)
 }
 
 // Float maps configuration directive with the specified name to variable
@@ -506,6 +528,7 @@ func (m *Map) Float(name string, inheritGlobal, required bool, defaultVal float6
 		}
 		return f, nil
 	}, store)
+	m.describe(name, "float", nil)
 }
 
 // Custom maps configuration directive with the specified name to variable
@@ -555,9 +578,18 @@ func (m *Map) Custom(name string, inheritGlobal, required bool, defaultVal func(
 		defaultVal:    defaultVal,
 		mapper:        mapper,
 		store:         target,
+		typ:           "custom",
 	}
 }
 
+// describe sets the directive type used for schema export.
+func (m *Map) describe(name, typ string, allowed []string) {
+	matcher := m.entries[name]
+	matcher.typ = typ
+	matcher.allowed = allowed
+	m.entries[name] = matcher
+}
+
 // Callback creates mapping that will call mapper() function for each
 // directive with the specified name. No further processing is done.
 //
@@ -577,6 +609,7 @@ func (m *Map) Callback(name string, mapper func(*Map, Node) error) {
 	m.entries[name] = matcher{
 		name:           name,
 		customCallback: mapper,
+		typ:            "callback",
 	}
 }
 
@@ -589,6 +622,11 @@ func (m *Map) Process() (unknown []Node, err error) {
 
 // Process maps variables from global configuration and block passed in arguments.
 func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown []Node, err error) {
+	if m.schemaOnly {
+		m.collectSchema()
+		return nil, ErrSchemaOnly
+	}
+
 	unknown = make([]Node, 0, len(block.Children))
 	matched := make(map[string]bool)
 	m.Values = make(map[string]interface{})
@@ -19,7 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package config
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 )
 
 func TestMapProcess(t *testing.T) {
@@ -493,3 +495,61 @@ func TestMap_Callback(t *testing.T) {
 		t.Error("Wrong directive returned in unmatched slice:", others[0].Name)
 	}
 }
+
+func TestMapSchema(t *testing.T) {
+	m := NewSchemaMap(nil)
+
+	var (
+		str   string
+		b     bool
+		dur   time.Duration
+		list  []string
+		enum  string
+		size  int
+		other interface{}
+	)
+	m.String("string", true, false, "default", &str)
+	m.Bool("bool", false, true, &b)
+	m.Duration("duration", false, true, 0, &dur)
+	m.StringList("list", false, false, nil, &list)
+	m.Enum("enum", false, false, []string{"a", "b"}, "a", &enum)
+	m.DataSize("size", false, false, 1024, &size)
+	m.Custom("custom", false, false, func() (interface{}, error) {
+		return func() {}, nil
+	}, func(*Map, Node) (interface{}, error) {
+		return nil, nil
+	}, &other)
+	m.Callback("callback", func(*Map, Node) error {
+		return nil
+	})
+
+	if _, ok := m.Schema(); ok {
+		t.Fatal("schema is available before Process")
+	}
+	if _, err := m.Process(); err != ErrSchemaOnly {
+		t.Fatal("unexpected error:", err)
+	}
+	if str != "" || b {
+		t.Fatal("values are assigned")
+	}
+
+	schema, ok := m.Schema()
+	if !ok {
+		t.Fatal("schema is not available after Process")
+	}
+	got, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"name":"bool","type":"bool","default":true},` +
+		`{"name":"callback","type":"callback"},` +
+		`{"name":"custom","type":"custom"},` +
+		`{"name":"duration","type":"duration","required":true,"default":"0s"},` +
+		`{"name":"enum","type":"enum","allowed":["a","b"],"default":"a"},` +
+		`{"name":"list","type":"string_list"},` +
+		`{"name":"size","type":"data_size","default":1024},` +
+		`{"name":"string","type":"string","inherit_global":true,"default":"default"}]`
+	if string(got) != want {
+		t.Errorf("wrong schema:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -23,7 +23,9 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
@@ -53,9 +55,32 @@ type FailAction struct {
 	Quarantine bool
 	Reject     bool
 
+	// Score is added to the message spam score instead of taking any
+	// immediate action.
+	Score float64
+
+	// Redirect is the list of addresses the message should be delivered to
+	// instead of its original recipients.
+	Redirect []string
+
+	// Annotate requests the failure to be recorded in the message header
+	// and metadata with the specified weight. It does not affect the
+	// message delivery.
+	Annotate       bool
+	AnnotateWeight float64
+
+	// Delay is the time to wait before replying to the client, used to
+	// tarpit senders. It is combined with another action (or no action).
+	Delay time.Duration
+
 	ReasonOverride *exterrors.SMTPError
 }
 
+// MaxActionDelay is the maximum value for the 'delay' action. Clients are
+// not required to wait for most replies longer than 5 minutes (RFC 5321,
+// Section 4.5.3.2).
+const MaxActionDelay = 4 * time.Minute
+
 func FailActionDirective(_ *config.Map, node config.Node) (interface{}, error) {
 	if len(node.Children) != 0 {
 		return nil, config.NodeErr(node, "can't declare block here")
@@ -76,6 +101,63 @@ func ParseActionDirective(args []string) (FailAction, error) {
 	res := FailAction{}
 
 	switch args[0] {
+	case "delay":
+		if len(args) < 2 {
+			return FailAction{}, errors.New("delay: duration is required")
+		}
+		delay, err := time.ParseDuration(args[1])
+		if err != nil {
+			return FailAction{}, fmt.Errorf("delay: %v", err)
+		}
+		if delay <= 0 || delay > MaxActionDelay {
+			return FailAction{}, fmt.Errorf("delay: duration should be positive and not larger than %v", MaxActionDelay)
+		}
+		if len(args) > 2 {
+			if args[2] == "delay" {
+				return FailAction{}, errors.New("delay: can't be nested")
+			}
+			res, err = ParseActionDirective(args[2:])
+			if err != nil {
+				return FailAction{}, err
+			}
+		}
+		res.Delay = delay
+		return res, nil
+	case "score":
+		if len(args) != 2 {
+			return FailAction{}, errors.New("score: exactly one argument is required")
+		}
+		score, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return FailAction{}, fmt.Errorf("score: invalid value: %v", err)
+		}
+		res.Score = score
+		return res, nil
+	case "redirect":
+		if len(args) < 2 {
+			return FailAction{}, errors.New("redirect: at least one address is required")
+		}
+		for _, addr := range args[1:] {
+			if err := address.Validate(addr, true, address.RFC); err != nil {
+				return FailAction{}, fmt.Errorf("redirect: invalid address: %s: %w", addr, err)
+			}
+		}
+		res.Redirect = args[1:]
+		return res, nil
+	case "annotate":
+		if len(args) > 2 {
+			return FailAction{}, errors.New("annotate: at most one argument is allowed")
+		}
+		res.Annotate = true
+		res.AnnotateWeight = 1
+		if len(args) == 2 {
+			weight, err := strconv.ParseFloat(args[1], 64)
+			if err != nil {
+				return FailAction{}, fmt.Errorf("annotate: invalid weight: %v", err)
+			}
+			res.AnnotateWeight = weight
+		}
+		return res, nil
 	case "reject", "quarantine":
 		if len(args) > 1 {
 			var err error
@@ -113,22 +195,40 @@ func (cfa FailAction) Apply(originalRes module.CheckResult) module.CheckResult {
 
 	originalRes.Quarantine = cfa.Quarantine || originalRes.Quarantine
 	originalRes.Reject = cfa.Reject || originalRes.Reject
+	originalRes.Score += cfa.Score
+	if len(cfa.Redirect) != 0 {
+		originalRes.Redirect = cfa.Redirect
+	}
+	if cfa.Annotate {
+		originalRes.Annotate = true
+		originalRes.AnnotateWeight += cfa.AnnotateWeight
+	}
+	if cfa.Delay > originalRes.Delay {
+		originalRes.Delay = cfa.Delay
+	}
 	return originalRes
 }
 
+// ParseRejectDirective parses the arguments of the reject action:
+//
+//     [code [enhanced-code [message-lines...]]]
+//
+// If multiple message lines are specified, they are sent to the client as
+// a multi-line reply. Messages may contain placeholders such as {client_ip}
+// that are expanded by the endpoint sending the reply.
 func ParseRejectDirective(args []string) (*exterrors.SMTPError, error) {
 	code := 554
 	enchCode := exterrors.EnhancedCode{0, 7, 0}
 	msg := "Message rejected due to a local policy"
 	var err error
-	switch len(args) {
-	case 3:
-		msg = args[2]
-		if msg == "" {
-			return nil, fmt.Errorf("message can't be empty")
+	switch {
+	case len(args) >= 3:
+		msg, err = JoinReplyLines(args[2:])
+		if err != nil {
+			return nil, err
 		}
 		fallthrough
-	case 2:
+	case len(args) == 2:
 		enchCode, err = parseEnhancedCode(args[1])
 		if err != nil {
 			return nil, err
@@ -137,7 +237,7 @@ func ParseRejectDirective(args []string) (*exterrors.SMTPError, error) {
 			return nil, fmt.Errorf("enhanced code should use either 4 or 5 as a first number")
 		}
 		fallthrough
-	case 1:
+	case len(args) == 1:
 		code, err = strconv.Atoi(args[0])
 		if err != nil {
 			return nil, fmt.Errorf("invalid error code integer: %v", err)
@@ -149,11 +249,9 @@ func ParseRejectDirective(args []string) (*exterrors.SMTPError, error) {
 		if enchCode[0] == 0 {
 			enchCode[0] = code / 100
 		}
-	case 0:
+	default:
 		// If no codes provided at all - use 5.7.0 and 554.
 		enchCode[0] = 5
-	default:
-		return nil, fmt.Errorf("invalid count of arguments")
 	}
 	return &exterrors.SMTPError{
 		Code:         code,
@@ -163,6 +261,20 @@ func ParseRejectDirective(args []string) (*exterrors.SMTPError, error) {
 	}, nil
 }
 
+// JoinReplyLines joins lines of a multi-line reply message as expected by the
+// SMTP endpoint.
+func JoinReplyLines(lines []string) (string, error) {
+	for _, l := range lines {
+		if l == "" {
+			return "", fmt.Errorf("message can't be empty")
+		}
+		if strings.ContainsAny(l, "\r\n") {
+			return "", fmt.Errorf("message lines can't contain line breaks")
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
 func parseEnhancedCode(s string) (exterrors.EnhancedCode, error) {
 	parts := strings.Split(s, ".")
 	if len(parts) != 3 {
@@ -0,0 +1,102 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// DirectiveSchema describes the configuration directive registered using
+// Map.
+type DirectiveSchema struct {
+	Name string `json:"name"`
+	// Type is the name of Map method used to register the directive in
+	// snake_case, e.g. "string_list" or "data_size". Directives with
+	// module-specific syntax have the "custom" type. Directives registered
+	// using Map.Callback have the "callback" type and can be repeated.
+	Type          string   `json:"type"`
+	Required      bool     `json:"required,omitempty"`
+	InheritGlobal bool     `json:"inherit_global,omitempty"`
+	Allowed       []string `json:"allowed,omitempty"`
+	// Default is the default value of the directive. Durations are
+	// represented using strings, data sizes as the amount of bytes. Not set
+	// for custom directives.
+	Default interface{} `json:"default,omitempty"`
+}
+
+// ErrSchemaOnly is returned by Process of the Map created using
+// NewSchemaMap.
+var ErrSchemaOnly = errors.New("config: schema collection only")
+
+// NewSchemaMap creates the Map that does not process the configuration.
+// Instead, Process records the registered directives and returns
+// ErrSchemaOnly. Directives can be then obtained using Schema.
+func NewSchemaMap(globals map[string]interface{}) *Map {
+	return &Map{Globals: globals, schemaOnly: true}
+}
+
+// Schema returns directives recorded by Process, sorted by name. False is
+// returned if Process was not called yet.
+func (m *Map) Schema() ([]DirectiveSchema, bool) {
+	return m.schema, m.schemaDone
+}
+
+func (m *Map) collectSchema() {
+	if m.schemaDone {
+		return
+	}
+	m.schemaDone = true
+
+	m.schema = make([]DirectiveSchema, 0, len(m.entries))
+	for _, matcher := range m.entries {
+		d := DirectiveSchema{
+			Name:          matcher.name,
+			Type:          matcher.typ,
+			Required:      matcher.required,
+			InheritGlobal: matcher.inheritGlobal,
+			Allowed:       matcher.allowed,
+		}
+		if matcher.typ != "custom" && matcher.defaultVal != nil {
+			d.Default = schemaDefault(matcher.defaultVal)
+		}
+		m.schema = append(m.schema, d)
+	}
+	sort.Slice(m.schema, func(i, j int) bool {
+		return m.schema[i].Name < m.schema[j].Name
+	})
+}
+
+func schemaDefault(defaultVal func() (interface{}, error)) interface{} {
+	val, err := defaultVal()
+	if err != nil {
+		return nil
+	}
+	switch val := val.(type) {
+	case time.Duration:
+		return val.String()
+	case []string:
+		if val == nil {
+			return nil
+		}
+		return val
+	}
+	return val
+}
@@ -0,0 +1,228 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	cacheHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "dns_cache",
+			Name:      "hits",
+			Help:      "Amount of DNS lookups answered from the cache",
+		},
+	)
+	cacheMisses = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "dns_cache",
+			Name:      "misses",
+			Help:      "Amount of DNS lookups sent to the server",
+		},
+	)
+	cacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "dns_cache",
+			Name:      "evictions",
+			Help:      "Amount of unexpired entries removed due to the cache size limit",
+		},
+	)
+	cacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "dns_cache",
+			Name:      "entries",
+			Help:      "Amount of entries in the cache",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheHits)
+	prometheus.MustRegister(cacheMisses)
+	prometheus.MustRegister(cacheEvictions)
+	prometheus.MustRegister(cacheEntries)
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	resp    *dns.Msg
+	expires time.Time
+}
+
+// Cache is the size-bounded in-memory cache of DNS responses used by
+// ExtResolver.
+//
+// Responses are kept for the smallest TTL of answer records. Negative
+// responses (NXDOMAIN and empty answers) are kept for the TTL derived from the
+// SOA record in the authority section (RFC 2308 Section 5) and are not cached
+// if there is no SOA record. Least recently used entries are removed once
+// the size limit is reached.
+type Cache struct {
+	maxEntries int
+	maxTTL     time.Duration
+
+	lock    sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	now func() time.Time
+}
+
+func NewCache(maxEntries int, maxTTL time.Duration) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		maxTTL:     maxTTL,
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+func keyFor(q dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype}
+}
+
+// responseTTL returns the time the response can be cached for. Zero is
+// returned if the response should not be cached.
+func responseTTL(resp *dns.Msg) time.Duration {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0
+	}
+
+	if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) != 0 {
+		ttl := resp.Answer[0].Header().Ttl
+		for _, rr := range resp.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+		return time.Duration(ttl) * time.Second
+	}
+
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		return time.Duration(ttl) * time.Second
+	}
+	return 0
+}
+
+// get returns the copy of the cached response for the question.
+func (c *Cache) get(q dns.Question) (*dns.Msg, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[keyFor(q)]
+	if !ok {
+		cacheMisses.Inc()
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, entry.key)
+		cacheEntries.Dec()
+		cacheMisses.Inc()
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	cacheHits.Inc()
+	return entry.resp.Copy(), true
+}
+
+func (c *Cache) put(q dns.Question, resp *dns.Msg) {
+	ttl := responseTTL(resp)
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := keyFor(q)
+	entry := &cacheEntry{key: key, resp: resp.Copy(), expires: c.now().Add(ttl)}
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	cacheEntries.Inc()
+
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		oldestEntry := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, oldestEntry.key)
+		cacheEntries.Dec()
+		if c.now().Before(oldestEntry.expires) {
+			cacheEvictions.Inc()
+		}
+	}
+}
+
+var (
+	sharedResolver     *ExtResolver
+	sharedResolverLock sync.Mutex
+)
+
+// EnableCache makes DefaultResolver return ExtResolver that caches
+// responses. The same resolver and cache are shared by all callers.
+//
+// It should be called before any modules are initialized to have full
+// effect.
+func EnableCache(maxEntries int, maxTTL time.Duration) error {
+	r, err := NewExtResolver()
+	if err != nil {
+		return err
+	}
+	r.Cache = NewCache(maxEntries, maxTTL)
+
+	sharedResolverLock.Lock()
+	defer sharedResolverLock.Unlock()
+	sharedResolver = r
+	return nil
+}
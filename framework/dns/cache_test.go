@@ -0,0 +1,118 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/miekg/dns"
+)
+
+func TestResponseTTL(t *testing.T) {
+	a := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}}
+	}
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600}, Minttl: 300}
+
+	for _, c := range []struct {
+		resp *dns.Msg
+		ttl  time.Duration
+	}{
+		{&dns.Msg{Answer: []dns.RR{a(60), a(30)}}, 30 * time.Second},
+		{&dns.Msg{Ns: []dns.RR{soa}}, 300 * time.Second},
+		{&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}, Ns: []dns.RR{soa}}, 300 * time.Second},
+		{&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}, 0},
+		{&dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}, Ns: []dns.RR{soa}}, 0},
+	} {
+		if ttl := responseTTL(c.resp); ttl != c.ttl {
+			t.Errorf("want %v, got %v for %v", c.ttl, ttl, c.resp)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(2, time.Hour)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	resp := func(name string) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		msg.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(1, 2, 3, 4),
+		}}
+		return msg
+	}
+
+	for _, name := range []string{"a.example.", "b.example."} {
+		c.put(resp(name).Question[0], resp(name))
+	}
+	if _, ok := c.get(dns.Question{Name: "A.example.", Qtype: dns.TypeA}); !ok {
+		t.Fatal("cached response is not returned")
+	}
+	if _, ok := c.get(dns.Question{Name: "a.example.", Qtype: dns.TypeMX}); ok {
+		t.Fatal("response for other type is returned")
+	}
+
+	// b.example is the least recently used one.
+	c.put(resp("c.example.").Question[0], resp("c.example."))
+	if _, ok := c.get(dns.Question{Name: "b.example.", Qtype: dns.TypeA}); ok {
+		t.Fatal("least recently used entry is not evicted")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get(dns.Question{Name: "a.example.", Qtype: dns.TypeA}); ok {
+		t.Fatal("expired entry is returned")
+	}
+}
+
+func TestExtResolver_Cache(t *testing.T) {
+	srv, err := mockdns.NewServer(map[string]mockdns.Zone{
+		"example.org.": {
+			A: []string{"1.2.3.4"},
+		},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(srv.LocalAddr().String())
+
+	r := ExtResolver{
+		cl:    &dns.Client{Timeout: 100 * time.Millisecond},
+		Cfg:   &dns.ClientConfig{Servers: []string{host}, Port: port},
+		Cache: NewCache(10, time.Hour),
+	}
+	if _, err := r.LookupHost(context.Background(), "example.org"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal("lookup is not cached:", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "1.2.3.4" {
+		t.Fatal("wrong cached result:", addrs)
+	}
+}
@@ -37,6 +37,9 @@ type TLSA = dns.TLSA
 type ExtResolver struct {
 	cl  *dns.Client
 	Cfg *dns.ClientConfig
+
+	// If not nil, responses are cached there.
+	Cache *Cache
 }
 
 // RCodeError is returned by ExtResolver when the RCODE in response is not
@@ -85,6 +88,15 @@ func isLoopback(addr string) bool {
 }
 
 func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if e.Cache != nil {
+		if resp, ok := e.Cache.get(msg.Question[0]); ok {
+			if resp.Rcode != dns.RcodeSuccess {
+				return resp, RCodeError{msg.Question[0].Name, resp.Rcode}
+			}
+			return resp, nil
+		}
+	}
+
 	var resp *dns.Msg
 	var lastErr error
 	for _, srv := range e.Cfg.Servers {
@@ -107,6 +119,10 @@ func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, erro
 
 		break
 	}
+
+	if e.Cache != nil && resp != nil && (lastErr == nil || resp.Rcode == dns.RcodeNameError) {
+		e.Cache.put(msg.Question[0], resp)
+	}
 	return resp, lastErr
 }
 
@@ -373,6 +389,47 @@ func (e ExtResolver) AuthLookupTLSA(ctx context.Context, service, network, domai
 	return
 }
 
+// Resolver interface implementation. AD flag is discarded and errors are
+// converted to *net.DNSError, the same way as net.Resolver reports them.
+
+func netError(err error) error {
+	rcodeErr, ok := err.(RCodeError)
+	if !ok {
+		return err
+	}
+	return &net.DNSError{
+		Err:         rcodeErr.Error(),
+		Name:        rcodeErr.Name,
+		IsNotFound:  rcodeErr.Code == dns.RcodeNameError,
+		IsTemporary: rcodeErr.Temporary(),
+	}
+}
+
+func (e ExtResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	_, names, err := e.AuthLookupAddr(ctx, addr)
+	return names, netError(err)
+}
+
+func (e ExtResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	_, addrs, err := e.AuthLookupHost(ctx, host)
+	return addrs, netError(err)
+}
+
+func (e ExtResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	_, mxs, err := e.AuthLookupMX(ctx, name)
+	return mxs, netError(err)
+}
+
+func (e ExtResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	_, recs, err := e.AuthLookupTXT(ctx, name)
+	return recs, netError(err)
+}
+
+func (e ExtResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	_, addrs, err := e.AuthLookupIPAddr(ctx, host)
+	return addrs, netError(err)
+}
+
 func NewExtResolver() (*ExtResolver, error) {
 	cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
 	if err != nil {
@@ -39,7 +39,8 @@ func FQDN(domain string) string {
 // domains are simply converted to local-case using strings.ToLower, but the
 // error is also returned.
 func ForLookup(domain string) (string, error) {
-	uDomain, err := idna.ToUnicode(domain)
+	// A-labels are decoded only if the "xn--" prefix is in lower case.
+	uDomain, err := idna.ToUnicode(strings.ToLower(domain))
 	if err != nil {
 		return strings.ToLower(domain), err
 	}
@@ -19,14 +19,15 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 // Package dns defines interfaces used by maddy modules to perform DNS
 // lookups.
 //
-// Currently, there is only Resolver interface which is implemented
-// by dns.DefaultResolver(). In the future, DNSSEC-enabled stub resolver
-// implementation will be added here.
+// Resolver interface is implemented by dns.DefaultResolver(). ExtResolver
+// additionally implements AuthResolver that reports whether answers were
+// authenticated using DNSSEC.
 package dns
 
 import (
 	"context"
 	"net"
+	"strconv"
 	"strings"
 )
 
@@ -41,6 +42,53 @@ type Resolver interface {
 	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
 }
 
+// AuthResolver is implemented by resolvers that can tell whether the answer
+// was authenticated using DNSSEC (AD flag set by the validating resolver).
+type AuthResolver interface {
+	AuthLookupAddr(ctx context.Context, addr string) (ad bool, names []string, err error)
+	AuthLookupMX(ctx context.Context, name string) (ad bool, mxs []*net.MX, err error)
+	AuthLookupIPAddr(ctx context.Context, host string) (ad bool, addrs []net.IPAddr, err error)
+}
+
+// AuthLookupAddr is similar to LookupAddr but also returns whether the
+// answer was authenticated using DNSSEC.
+//
+// If r does not implement AuthResolver, the answer is considered to be not
+// authenticated.
+func AuthLookupAddr(ctx context.Context, r Resolver, ip net.IP) (bool, string, error) {
+	authR, ok := r.(AuthResolver)
+	if !ok {
+		name, err := LookupAddr(ctx, r, ip)
+		return false, name, err
+	}
+
+	ad, names, err := authR.AuthLookupAddr(ctx, ip.String())
+	if err != nil || len(names) == 0 {
+		return false, "", err
+	}
+	return ad, strings.TrimRight(names[0], "."), nil
+}
+
+// AuthLookupMX uses AuthResolver.AuthLookupMX if r implements it. Otherwise
+// the answer is considered to be not authenticated.
+func AuthLookupMX(ctx context.Context, r Resolver, name string) (bool, []*net.MX, error) {
+	if authR, ok := r.(AuthResolver); ok {
+		return authR.AuthLookupMX(ctx, name)
+	}
+	mxs, err := r.LookupMX(ctx, name)
+	return false, mxs, err
+}
+
+// AuthLookupIPAddr uses AuthResolver.AuthLookupIPAddr if r implements it.
+// Otherwise the answer is considered to be not authenticated.
+func AuthLookupIPAddr(ctx context.Context, r Resolver, host string) (bool, []net.IPAddr, error) {
+	if authR, ok := r.(AuthResolver); ok {
+		return authR.AuthLookupIPAddr(ctx, host)
+	}
+	addrs, err := r.LookupIPAddr(ctx, host)
+	return false, addrs, err
+}
+
 // LookupAddr is a convenience wrapper for Resolver.LookupAddr.
 //
 // It returns the first name with trailing dot stripped.
@@ -52,7 +100,50 @@ func LookupAddr(ctx context.Context, r Resolver, ip net.IP) (string, error) {
 	return strings.TrimRight(names[0], "."), nil
 }
 
+// ReverseIP returns the IP address in the form used for reverse DNS and DNSBL
+// queries: octets (IPv4) or nibbles (IPv6) in reverse order separated with dots.
+// The zone name is not included.
+func ReverseIP(ip net.IP) string {
+	ipv6 := true
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+		ipv6 = false
+	}
+
+	res := strings.Builder{}
+	if ipv6 {
+		res.Grow(63) // 0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0
+	} else {
+		res.Grow(15) // 000.000.000.000
+	}
+
+	for i := len(ip) - 1; i >= 0; i-- {
+		octet := ip[i]
+
+		if ipv6 {
+			// X.X
+			res.WriteString(strconv.FormatInt(int64(octet&0xf), 16))
+			res.WriteRune('.')
+			res.WriteString(strconv.FormatInt(int64((octet&0xf0)>>4), 16))
+		} else {
+			// X
+			res.WriteString(strconv.Itoa(int(octet)))
+		}
+
+		if i != 0 {
+			res.WriteRune('.')
+		}
+	}
+	return res.String()
+}
+
 func DefaultResolver() Resolver {
+	sharedResolverLock.Lock()
+	defer sharedResolverLock.Unlock()
+	if sharedResolver != nil {
+		return sharedResolver
+	}
+
 	if overrideServ != "" && overrideServ != "system-default" {
 		override(overrideServ)
 	}
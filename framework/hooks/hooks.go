@@ -78,3 +78,14 @@ func AddHook(eventName Event, f func()) {
 
 	hooks[eventName] = append(hooks[eventName], f)
 }
+
+// Clear removes all installed hooks.
+//
+// It is used once the server is stopped so a new server instance can be
+// started in the same process without running hooks of the previous one.
+func Clear() {
+	hooksLck.Lock()
+	defer hooksLck.Unlock()
+
+	hooks = make(map[Event][]func())
+}
@@ -206,16 +206,19 @@ func (l Logger) DebugWriter() io.Writer {
 }
 
 func (l Logger) log(debug bool, s string) {
+	now := time.Now()
+	publish(now, debug, l.Name, s)
+
 	if l.Name != "" {
 		s = l.Name + ": " + s
 	}
 
 	if l.Out != nil {
-		l.Out.Write(time.Now(), debug, s)
+		l.Out.Write(now, debug, s)
 		return
 	}
 	if DefaultLogger.Out != nil {
-		DefaultLogger.Out.Write(time.Now(), debug, s)
+		DefaultLogger.Out.Write(now, debug, s)
 		return
 	}
 
@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a log message as seen by the log stream subscribers.
+type Event struct {
+	Stamp   time.Time              `json:"time"`
+	Debug   bool                   `json:"debug,omitempty"`
+	Module  string                 `json:"module,omitempty"`
+	Message string                 `json:"msg"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Subscription represents a log stream subscriber created by Subscribe.
+type Subscription struct {
+	C <-chan Event
+
+	c       chan Event
+	dropped uint64
+}
+
+// Dropped returns the amount of events that were not delivered to the
+// subscriber because it was not reading them fast enough.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+var (
+	subsLock sync.RWMutex
+	subs     = map[*Subscription]struct{}{}
+	subsCnt  int32
+)
+
+// Subscribe creates a new log stream subscription. All messages written
+// by any Logger after the call will be sent to the returned channel until
+// Unsubscribe is called.
+//
+// Messages are never blocked waiting for the subscriber, if the channel
+// buffer (of bufSize) is full, messages are dropped.
+func Subscribe(bufSize int) *Subscription {
+	c := make(chan Event, bufSize)
+	s := &Subscription{C: c, c: c}
+
+	subsLock.Lock()
+	defer subsLock.Unlock()
+	subs[s] = struct{}{}
+	atomic.AddInt32(&subsCnt, 1)
+	return s
+}
+
+// Unsubscribe stops delivery of messages to the subscription and closes its
+// channel.
+func Unsubscribe(s *Subscription) {
+	subsLock.Lock()
+	defer subsLock.Unlock()
+	if _, ok := subs[s]; !ok {
+		return
+	}
+	delete(subs, s)
+	atomic.AddInt32(&subsCnt, -1)
+	close(s.c)
+}
+
+func publish(stamp time.Time, debug bool, name, s string) {
+	if atomic.LoadInt32(&subsCnt) == 0 {
+		return
+	}
+
+	ev := Event{
+		Stamp:   stamp,
+		Debug:   debug,
+		Module:  name,
+		Message: s,
+	}
+	// Messages written by Msg and Error have structured fields
+	// appended after the tab character.
+	if idx := strings.LastIndexByte(s, '\t'); idx != -1 {
+		fields := map[string]interface{}{}
+		if idx == len(s)-1 {
+			ev.Message = s[:idx]
+		} else if err := json.Unmarshal([]byte(s[idx+1:]), &fields); err == nil {
+			ev.Message = s[:idx]
+			ev.Fields = fields
+		}
+	}
+
+	subsLock.RLock()
+	defer subsLock.RUnlock()
+	for sub := range subs {
+		select {
+		case sub.c <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
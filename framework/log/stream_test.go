@@ -0,0 +1,127 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case ev := <-sub.C:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event received")
+		return Event{}
+	}
+}
+
+func TestStream_Publish(t *testing.T) {
+	sub := Subscribe(10)
+	defer Unsubscribe(sub)
+
+	l := Logger{Name: "test/module", Out: NopOutput{}}
+
+	l.Msg("structured", "key", "value", "number", 1)
+	ev := receive(t, sub)
+	if ev.Module != "test/module" || ev.Message != "structured" || ev.Debug {
+		t.Errorf("Wrong event: %+v", ev)
+	}
+	if ev.Fields["key"] != "value" || ev.Fields["number"] != 1.0 {
+		t.Errorf("Wrong fields: %v", ev.Fields)
+	}
+
+	l.Println("plain message")
+	ev = receive(t, sub)
+	if ev.Message != "plain message" || ev.Fields != nil {
+		t.Errorf("Wrong plain event: %+v", ev)
+	}
+
+	// Msg without fields appends an empty fields suffix that should not
+	// appear in the message.
+	l.Msg("no fields")
+	ev = receive(t, sub)
+	if ev.Message != "no fields" {
+		t.Errorf("Wrong message: %q", ev.Message)
+	}
+
+	l.Error("failed", errors.New("boom"))
+	ev = receive(t, sub)
+	if ev.Message != "failed" || ev.Fields["reason"] != "boom" {
+		t.Errorf("Wrong error event: %+v", ev)
+	}
+
+	// Message with a tab that is not followed by JSON is kept as is.
+	l.Println("tab\tseparated")
+	ev = receive(t, sub)
+	if ev.Message != "tab\tseparated" || ev.Fields != nil {
+		t.Errorf("Wrong event: %+v", ev)
+	}
+
+	l.Debug = true
+	l.DebugMsg("debug message")
+	ev = receive(t, sub)
+	if !ev.Debug || ev.Message != "debug message" {
+		t.Errorf("Wrong debug event: %+v", ev)
+	}
+}
+
+func TestStream_SlowSubscriber(t *testing.T) {
+	slow := Subscribe(2)
+	defer Unsubscribe(slow)
+	fast := Subscribe(10)
+	defer Unsubscribe(fast)
+
+	l := Logger{Name: "test", Out: NopOutput{}}
+	for i := 0; i < 5; i++ {
+		l.Println("message", i)
+	}
+
+	if dropped := slow.Dropped(); dropped != 3 {
+		t.Error("Wrong dropped count for slow subscriber:", dropped)
+	}
+	if dropped := fast.Dropped(); dropped != 0 {
+		t.Error("Events dropped for fast subscriber:", dropped)
+	}
+	if ev := receive(t, slow); ev.Message != "message 0" {
+		t.Errorf("Wrong first event: %+v", ev)
+	}
+	if ev := receive(t, slow); ev.Message != "message 1" {
+		t.Errorf("Wrong second event: %+v", ev)
+	}
+	if len(fast.C) != 5 {
+		t.Error("Wrong amount of queued events for fast subscriber:", len(fast.C))
+	}
+}
+
+func TestStream_Unsubscribe(t *testing.T) {
+	sub := Subscribe(10)
+	Unsubscribe(sub)
+	// Second call is a no-op.
+	Unsubscribe(sub)
+
+	Logger{Name: "test", Out: NopOutput{}}.Println("message")
+
+	if _, ok := <-sub.C; ok {
+		t.Error("Event delivered after Unsubscribe")
+	}
+}
@@ -18,7 +18,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package module
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 // ErrUnknownCredentials should be returned by auth. provider if supplied
 // credentials are valid for it but are not recognized (e.g. not found in
@@ -42,3 +45,93 @@ type PlainUserDB interface {
 	SetUserPassword(username, password string) error
 	DeleteUser(username string) error
 }
+
+// TOTPUserDB is implemented by auth. providers that can require the TOTP
+// code (RFC 6238) in addition to the password. It can be managed using
+// maddyctl utility.
+type TOTPUserDB interface {
+	// EnableTOTP generates a new secret for the account and returns the
+	// otpauth:// key URI to be loaded into the authenticator application.
+	EnableTOTP(username string) (keyURI string, err error)
+	DisableTOTP(username string) error
+	TOTPEnabled(username string) (bool, error)
+}
+
+// ProtocolPlainAuth is implemented by auth. providers that accept some
+// credentials only for specific protocols.
+//
+// Callers that know the protocol used for authentication should prefer
+// AuthPlainProtocol over AuthPlain.
+type ProtocolPlainAuth interface {
+	PlainAuth
+
+	// AuthPlainProtocol is similar to AuthPlain, but also takes the name of
+	// the protocol the credentials are used for (e.g. "imap",
+	// "submission").
+	AuthPlainProtocol(username, password, protocol string) error
+}
+
+// AccountStatus is implemented by modules that can disable accounts without
+// removing their credentials (e.g. storage backends supporting account
+// deactivation). Authentication as a disabled account is rejected even if
+// the credentials are valid.
+type AccountStatus interface {
+	AccountDisabled(username string) (bool, error)
+}
+
+// AppPassword describes the application-specific password. The password
+// itself is not stored in plain text and can't be obtained after
+// creation.
+type AppPassword struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name,omitempty"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+}
+
+// AppPasswordDB is implemented by auth. providers that allow users to have
+// randomly generated passwords restricted to specific protocols. It can be
+// managed using maddyctl utility.
+type AppPasswordDB interface {
+	ListAppPasswords(username string) ([]AppPassword, error)
+	// CreateAppPassword generates a new password that is accepted only for
+	// the listed protocols and returns it along with its ID.
+	CreateAppPassword(username, name string, scopes []string) (AppPassword, string, error)
+	RemoveAppPassword(username, id string) error
+}
+
+// BearerAuth is the interface implemented by modules providing authentication
+// using OAuth 2.0 bearer tokens (RFC 6750).
+//
+// Modules implementing this interface should be registered with "auth." prefix in name.
+type BearerAuth interface {
+	// AuthBearer validates the token and returns the name of the account it
+	// was issued for.
+	AuthBearer(token string) (username string, err error)
+}
+
+// SCRAMCredentials is the salted password verifier used by SCRAM SASL
+// mechanisms (RFC 5802).
+type SCRAMCredentials struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// SCRAMAuth is the interface implemented by modules that store SCRAM
+// verifiers and so can be used with SCRAM SASL mechanisms.
+//
+// Modules implementing this interface should be registered with "auth." prefix in name.
+type SCRAMAuth interface {
+	// SCRAMMechanisms returns the list of supported SCRAM mechanisms (without
+	// the -PLUS suffix, e.g. "SCRAM-SHA-256"). Empty list means SCRAM is not
+	// supported in the current configuration.
+	SCRAMMechanisms() []string
+
+	// SCRAMCredentials returns the verifier for the user.
+	//
+	// ErrUnknownCredentials should be returned if there is no verifier for
+	// the user and mechanism.
+	SCRAMCredentials(mech, username string) (SCRAMCredentials, error)
+}
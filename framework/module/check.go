@@ -20,6 +20,8 @@ package module
 
 import (
 	"context"
+	"net"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
@@ -56,6 +58,16 @@ type EarlyCheck interface {
 	CheckConnection(ctx context.Context, state *smtp.ConnectionState) error
 }
 
+// ConnectCheck is an optional module interface that can be implemented
+// by module implementing Check.
+//
+// It is similar to EarlyCheck but is executed right after the connection is
+// accepted, before the greeting is sent. Only the client address is known at
+// this point. The connection is closed if the check returns an error.
+type ConnectCheck interface {
+	CheckConnect(ctx context.Context, remoteAddr net.Addr) error
+}
+
 type CheckState interface {
 	// CheckConnection is executed once when client sends a new message.
 	//
@@ -99,6 +111,22 @@ type CheckResult struct {
 	// This value is copied into MsgMetadata by the msgpipeline.
 	Quarantine bool
 
+	// Redirect is the list of addresses the message should be delivered
+	// to instead of its original recipients (e.g. a review mailbox).
+	//
+	// Rejection by any check takes precedence over the redirection.
+	Redirect []string
+
+	// Annotate is the flag that specifies that the failure should be
+	// recorded in the message header and Facts with AnnotateWeight
+	// without any other action.
+	Annotate       bool
+	AnnotateWeight float64
+
+	// Delay is the time msgpipeline should wait before replying to the
+	// client. If multiple checks request a delay, the largest one is used.
+	Delay time.Duration
+
 	// AuthResult is the information that is supposed to
 	// be included in Authentication-Results header.
 	AuthResult []authres.Result
@@ -106,4 +134,13 @@ type CheckResult struct {
 	// Header is the header fields that should be
 	// added to the header after all checks.
 	Header textproto.Header
+
+	// Score is the contribution of the check to the message spam score.
+	// Positive values indicate the message is more likely to be spam.
+	//
+	// Scores from all checks are summed by msgpipeline and compared against
+	// configured thresholds to decide on the action. Check may set Score
+	// without setting Reject or Quarantine, in this case Reason is used only
+	// for logging.
+	Score float64
 }
@@ -0,0 +1,206 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// Well-known keys for values stored in Facts.
+//
+// Modules are free to use their own keys, the convention is to
+// prefix them with the module name followed by a dot (e.g. "dnsbl.score").
+const (
+	FactGeoCountry      = "geo.country"
+	FactClientASN       = "client.asn"
+	FactReputationScore = "reputation.score"
+	FactTLSVersion      = "tls.version"
+	FactTLSCipher       = "tls.cipher"
+	FactTLSJA3          = "tls.ja3"
+	FactTLSJA4          = "tls.ja4"
+	FactSPFResult       = "spf.result"
+	FactSpamScore       = "spam.score"
+	FactARCResult       = "arc.cv"
+	FactARCSealer       = "arc.sealer"
+
+	// FactSessionScore is the score assigned by the message source (e.g. for
+	// SMTP protocol violations). It is added to the message spam score.
+	FactSessionScore = "session.score"
+
+	// FactCalendarMethod is set for messages containing calendar objects
+	// (e.g. meeting invitations) to the iTIP method (REQUEST, CANCEL, etc).
+	FactCalendarMethod = "msg.calendar_method"
+
+	// FactMailingList is set for messages detected as mailing list traffic.
+	// The value is the list identifier if it is known. Automatic responses
+	// should not be sent for such messages (RFC 3834, Section 2).
+	FactMailingList = "msg.mailing_list"
+
+	// FactAnnotationWeight is the sum of weights of check failures recorded
+	// using the 'annotate' action. Weights for individual checks are stored
+	// under FactAnnotationPrefix followed by the check name.
+	FactAnnotationWeight = "annotation.weight"
+	FactAnnotationPrefix = "annotation.check."
+)
+
+// Facts is a key-value store attached to the message that is used by checks
+// and other pipeline components to publish information about the message
+// (e.g. the result of a DNSBL lookup or the client country) so it can be
+// consumed by modifiers, routing rules and logging in a uniform way.
+//
+// Values should be of types that survive a JSON round-trip (strings, numbers,
+// booleans) since Facts are serialized by the queue module. Typed accessors
+// take care of converting numbers back to the requested type.
+//
+// All methods are safe for concurrent use. Methods can be called on a nil
+// *Facts: read methods return zero values and Set does nothing.
+type Facts struct {
+	lock sync.RWMutex
+	m    map[string]interface{}
+}
+
+func NewFacts() *Facts {
+	return &Facts{m: make(map[string]interface{})}
+}
+
+// Set stores the value under the specified key, replacing the existing one.
+func (f *Facts) Set(key string, value interface{}) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.m == nil {
+		f.m = make(map[string]interface{})
+	}
+	f.m[key] = value
+}
+
+// Get returns the value stored under the specified key.
+func (f *Facts) Get(key string) (interface{}, bool) {
+	if f == nil {
+		return nil, false
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	val, ok := f.m[key]
+	return val, ok
+}
+
+// String returns the value stored under the specified key if it is a string.
+func (f *Facts) String(key string) (string, bool) {
+	val, ok := f.Get(key)
+	if !ok {
+		return "", false
+	}
+	s, ok := val.(string)
+	return s, ok
+}
+
+// Bool returns the value stored under the specified key if it is a boolean.
+func (f *Facts) Bool(key string) (bool, bool) {
+	val, ok := f.Get(key)
+	if !ok {
+		return false, false
+	}
+	b, ok := val.(bool)
+	return b, ok
+}
+
+// Float returns the value stored under the specified key if it is a number.
+func (f *Facts) Float(key string) (float64, bool) {
+	val, ok := f.Get(key)
+	if !ok {
+		return 0, false
+	}
+	switch val := val.(type) {
+	case float64:
+		return val, true
+	case float32:
+		return float64(val), true
+	case int:
+		return float64(val), true
+	case int64:
+		return float64(val), true
+	case int32:
+		return float64(val), true
+	}
+	return 0, false
+}
+
+// Int returns the value stored under the specified key if it is a number.
+// Fractional part is discarded.
+func (f *Facts) Int(key string) (int, bool) {
+	val, ok := f.Float(key)
+	return int(val), ok
+}
+
+// Keys returns the sorted list of keys stored.
+func (f *Facts) Keys() []string {
+	if f == nil {
+		return nil
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	keys := make([]string, 0, len(f.m))
+	for k := range f.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Map returns the copy of all stored values.
+func (f *Facts) Map() map[string]interface{} {
+	if f == nil {
+		return nil
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	cpy := make(map[string]interface{}, len(f.m))
+	for k, v := range f.m {
+		cpy[k] = v
+	}
+	return cpy
+}
+
+// Copy returns the independent copy of the Facts object.
+func (f *Facts) Copy() *Facts {
+	if f == nil {
+		return nil
+	}
+	return &Facts{m: f.Map()}
+}
+
+func (f *Facts) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.Map())
+}
+
+func (f *Facts) UnmarshalJSON(b []byte) error {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.m = m
+	return nil
+}
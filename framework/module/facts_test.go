@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFacts_SetGet(t *testing.T) {
+	f := NewFacts()
+	f.Set("a", "value")
+	f.Set("b", 1)
+	f.Set("c", true)
+
+	if v, ok := f.String("a"); !ok || v != "value" {
+		t.Error("Wrong string value:", v, ok)
+	}
+	if v, ok := f.Int("b"); !ok || v != 1 {
+		t.Error("Wrong int value:", v, ok)
+	}
+	if v, ok := f.Float("b"); !ok || v != 1 {
+		t.Error("Wrong float value:", v, ok)
+	}
+	if v, ok := f.Bool("c"); !ok || !v {
+		t.Error("Wrong bool value:", v, ok)
+	}
+	if _, ok := f.String("b"); ok {
+		t.Error("Number returned as string")
+	}
+	if _, ok := f.Get("missing"); ok {
+		t.Error("Missing key reported as present")
+	}
+
+	f.Set("a", "replaced")
+	if v, _ := f.String("a"); v != "replaced" {
+		t.Error("Value is not replaced:", v)
+	}
+	if keys := f.Keys(); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Error("Wrong keys:", keys)
+	}
+}
+
+func TestFacts_Nil(t *testing.T) {
+	var f *Facts
+	f.Set("a", "value")
+	if _, ok := f.Get("a"); ok {
+		t.Error("Value stored in nil Facts")
+	}
+	if f.Keys() != nil || f.Map() != nil || f.Copy() != nil {
+		t.Error("Non-nil result for nil Facts")
+	}
+
+	// Zero value is usable as well.
+	var zero Facts
+	zero.Set("a", "value")
+	if v, _ := zero.String("a"); v != "value" {
+		t.Error("Value is not stored in zero Facts:", v)
+	}
+}
+
+func TestFacts_Copy(t *testing.T) {
+	f := NewFacts()
+	f.Set("a", "value")
+
+	cpy := f.Copy()
+	cpy.Set("a", "changed")
+	cpy.Set("b", "new")
+
+	if v, _ := f.String("a"); v != "value" {
+		t.Error("Copy modification affected the original:", v)
+	}
+	if _, ok := f.Get("b"); ok {
+		t.Error("Key added to copy is present in the original")
+	}
+}
+
+func TestFacts_JSON(t *testing.T) {
+	f := NewFacts()
+	f.Set("str", "value")
+	f.Set("int", 42)
+	f.Set("float", 1.5)
+
+	b, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := NewFacts()
+	decoded.Set("stale", "value")
+	if err := json.Unmarshal(b, decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := decoded.Get("stale"); ok {
+		t.Error("Unmarshal does not replace existing values")
+	}
+	if v, ok := decoded.Int("int"); !ok || v != 42 {
+		t.Error("Wrong int value after round-trip:", v, ok)
+	}
+	if v, ok := decoded.Float("float"); !ok || v != 1.5 {
+		t.Error("Wrong float value after round-trip:", v, ok)
+	}
+	if v, ok := decoded.String("str"); !ok || v != "value" {
+		t.Error("Wrong string value after round-trip:", v, ok)
+	}
+}
@@ -41,3 +41,39 @@ type IMAPFilter interface {
 	// to fail.
 	IMAPFilter(accountName string, meta *MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error)
 }
+
+// IMAPFilterState is the per-message state of the IMAP filter created by
+// IMAPFilterStateForMsg.
+type IMAPFilterState interface {
+	// IMAPFilter is the same as IMAPFilter.IMAPFilter for the message the
+	// state was created for.
+	IMAPFilter(accountName string) (folder string, flags []string, err error)
+}
+
+// MsgIMAPFilter is an optional interface that can be implemented by
+// IMAPFilter to do the work that does not depend on the recipient (e.g. body
+// parsing) only once per message.
+type MsgIMAPFilter interface {
+	IMAPFilterStateForMsg(meta *MsgMetadata, hdr textproto.Header, body buffer.Buffer) (IMAPFilterState, error)
+}
+
+type plainFilterState struct {
+	f    IMAPFilter
+	meta *MsgMetadata
+	hdr  textproto.Header
+	body buffer.Buffer
+}
+
+func (s plainFilterState) IMAPFilter(accountName string) (string, []string, error) {
+	return s.f.IMAPFilter(accountName, s.meta, s.hdr, s.body)
+}
+
+// IMAPFilterStateForMsg runs IMAPFilterStateForMsg (if implemented) for the
+// passed filter. Otherwise, it returns the state that calls IMAPFilter for
+// each recipient.
+func IMAPFilterStateForMsg(f IMAPFilter, meta *MsgMetadata, hdr textproto.Header, body buffer.Buffer) (IMAPFilterState, error) {
+	if msgFilter, ok := f.(MsgIMAPFilter); ok {
+		return msgFilter.IMAPFilterStateForMsg(meta, hdr, body)
+	}
+	return plainFilterState{f: f, meta: meta, hdr: hdr, body: body}, nil
+}
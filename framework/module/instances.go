@@ -21,6 +21,7 @@ package module
 import (
 	"fmt"
 	"io"
+	"sort"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/hooks"
@@ -66,6 +67,22 @@ func HasInstance(name string) bool {
 	return ok
 }
 
+// GetInitializedInstance is similar to GetInstance but never initializes the
+// module. False is returned if the instance does not exist or is not used by
+// the server.
+func GetInitializedInstance(name string) (Module, bool) {
+	aliasedName := aliases[name]
+	if aliasedName != "" {
+		name = aliasedName
+	}
+
+	mod, ok := instances[name]
+	if !ok || !Initialized[name] {
+		return nil, false
+	}
+	return mod.mod, true
+}
+
 // GetInstance returns module instance from global registry, initializing it if
 // necessary.
 //
@@ -103,3 +120,30 @@ func GetInstance(name string) (Module, error) {
 
 	return mod.mod, nil
 }
+
+// ResetInstances removes all module instances and aliases from the global
+// registry.
+//
+// Instances are not closed, EventShutdown hooks should be run before calling
+// this function.
+func ResetInstances() {
+	instances = make(map[string]struct {
+		mod Module
+		cfg *config.Map
+	})
+	aliases = make(map[string]string)
+	Initialized = make(map[string]bool)
+}
+
+// InstanceNames returns sorted names of all instances in the global registry
+// that are used by the server.
+func InstanceNames() []string {
+	names := make([]string, 0, len(Initialized))
+	for name, ok := range Initialized {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
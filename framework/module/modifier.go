@@ -28,14 +28,14 @@ import (
 // Modifier is the module interface for modules that can mutate the
 // processed message or its meta-data.
 //
-// Currently, the message body can't be mutated for efficiency and
-// correctness reasons: It would require "rebuffering" (see buffer.Buffer doc),
+// Generally, the message body should not be mutated for efficiency and
+// correctness reasons: It requires "rebuffering" (see buffer.Buffer doc),
 // can invalidate assertions made on the body contents before modification and
-// will break DKIM signatures.
+// will break DKIM signatures. Modifiers that really need to do so should
+// implement BodyReplacer.
 //
-// Only message header can be modified. Furthermore, it is highly discouraged for
-// modifiers to remove or change existing fields to prevent issues outlined
-// above.
+// It is highly discouraged for modifiers to remove or change existing header
+// fields to prevent issues outlined above.
 //
 // Calls on ModifierState are always strictly ordered.
 // RewriteRcpt is newer called before RewriteSender and RewriteBody is never called
@@ -73,7 +73,7 @@ type ModifierState interface {
 	// RewriteBody modifies passed Header argument and may optionally
 	// inspect the passed body buffer to make a decision on new header field values.
 	//
-	// There is no way to modify the body and RewriteBody should avoid
+	// RewriteBody can't modify the body (see BodyReplacer) and should avoid
 	// removing existing header fields and changing their values.
 	RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error
 
@@ -81,3 +81,26 @@ type ModifierState interface {
 	// Rewrite* functions return an error.
 	Close() error
 }
+
+// BodyReplacer is an optional interface that can be implemented by
+// ModifierState to replace the message body.
+//
+// If ModifierState implements it, ReplaceBody is called instead of
+// RewriteBody. It returns the buffer that should be used for the rest of the
+// processing or nil if the body is not changed.
+//
+// The returned buffer is owned by the caller which is responsible for removing
+// it once it is no longer needed. Passed body should not be removed by the
+// modifier.
+type BodyReplacer interface {
+	ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error)
+}
+
+// ReplaceBody runs ReplaceBody (if implemented) or RewriteBody for the passed
+// state. It returns the new body buffer or nil if the body is not changed.
+func ReplaceBody(ctx context.Context, state ModifierState, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	if replacer, ok := state.(BodyReplacer); ok {
+		return replacer.ReplaceBody(ctx, h, body)
+	}
+	return nil, state.RewriteBody(ctx, h, body)
+}
@@ -0,0 +1,158 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package moduletest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Auth is an in-memory module.PlainUserDB.
+//
+// It is also usable as a table that contains all known usernames and as a
+// module.BearerAuth provider with tokens added using AddToken.
+type Auth struct {
+	InstName string
+
+	lock      sync.RWMutex
+	passwords map[string][]byte
+	tokens    map[string]string
+}
+
+var (
+	_ module.PlainUserDB = &Auth{}
+	_ module.BearerAuth  = &Auth{}
+	_ module.Table       = &Auth{}
+)
+
+func (a *Auth) Init(*config.Map) error {
+	return nil
+}
+
+func (a *Auth) InstanceName() string {
+	if a.InstName != "" {
+		return a.InstName
+	}
+	return "test_auth"
+}
+
+func (a *Auth) Name() string {
+	return "test_auth"
+}
+
+func (a *Auth) AuthPlain(username, password string) error {
+	a.lock.RLock()
+	hash, ok := a.passwords[username]
+	a.lock.RUnlock()
+	if !ok {
+		return module.ErrUnknownCredentials
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password))
+}
+
+func (a *Auth) Lookup(_ context.Context, username string) (string, bool, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	_, ok := a.passwords[username]
+	return "", ok, nil
+}
+
+func (a *Auth) ListUsers() ([]string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	users := make([]string, 0, len(a.passwords))
+	for name := range a.passwords {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (a *Auth) CreateUser(username, password string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.passwords[username]; ok {
+		return errors.New("moduletest: user already exists")
+	}
+	return a.setPassword(username, password)
+}
+
+func (a *Auth) SetUserPassword(username, password string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.passwords[username]; !ok {
+		return errors.New("moduletest: no such user")
+	}
+	return a.setPassword(username, password)
+}
+
+func (a *Auth) setPassword(username, password string) error {
+	// The minimal cost is used since the data is not persisted anyway.
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		return err
+	}
+	if a.passwords == nil {
+		a.passwords = make(map[string][]byte)
+	}
+	a.passwords[username] = hash
+	return nil
+}
+
+func (a *Auth) DeleteUser(username string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.passwords[username]; !ok {
+		return errors.New("moduletest: no such user")
+	}
+	delete(a.passwords, username)
+	for token, owner := range a.tokens {
+		if owner == username {
+			delete(a.tokens, token)
+		}
+	}
+	return nil
+}
+
+// AddToken adds the bearer token that will be accepted by AuthBearer for the
+// user. The user does not have to exist.
+func (a *Auth) AddToken(username, token string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.tokens == nil {
+		a.tokens = make(map[string]string)
+	}
+	a.tokens[token] = username
+}
+
+func (a *Auth) AuthBearer(token string) (string, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	username, ok := a.tokens[token]
+	if !ok {
+		return "", module.ErrUnknownCredentials
+	}
+	return username, nil
+}
@@ -0,0 +1,224 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package moduletest
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+func deliver(t *testing.T, tgt module.DeliveryTarget, rcpts ...string) error {
+	t.Helper()
+
+	ctx := context.Background()
+	delivery, err := tgt.Start(ctx, &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range rcpts {
+		if err := delivery.AddRcpt(ctx, rcpt); err != nil {
+			delivery.Abort(ctx)
+			return err
+		}
+	}
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	if err := delivery.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		delivery.Abort(ctx)
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func TestTarget(t *testing.T) {
+	tgt := &Target{}
+	if err := deliver(t, tgt, "rcpt1@example.org", "rcpt2@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := tgt.Snapshot()
+	if len(msgs) != 1 {
+		t.Fatal("Wrong amount of messages:", len(msgs))
+	}
+	if len(msgs[0].RcptTo) != 2 || string(msgs[0].Body) != "foobar\r\n" || msgs[0].Header.Get("Subject") != "Hello" {
+		t.Errorf("Wrong message recorded: %+v", msgs[0])
+	}
+
+	if err := deliver(t, NullTarget{}, "rcpt1@example.org"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorage_Delivery(t *testing.T) {
+	s := &Storage{}
+	if err := s.CreateIMAPAcct("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := deliver(t, s, "user@example.org", "nobody@example.org")
+	if smtpErr, ok := err.(*exterrors.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Fatal("Expected 550 error for non-existent account, got:", err)
+	}
+	if err := deliver(t, s, "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := s.GetIMAPAcct("user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	section := &imap.BodySectionName{}
+	ch := make(chan *imap.Message, 10)
+	seqset, _ := imap.ParseSeqSet("1:*")
+	if err := mbox.ListMessages(true, seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, ch); err != nil {
+		t.Fatal(err)
+	}
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) != 1 {
+		t.Fatal("Wrong amount of messages in INBOX:", len(msgs))
+	}
+	if msgs[0].Uid != 1 {
+		t.Error("Wrong UID:", msgs[0].Uid)
+	}
+	body, err := ioutil.ReadAll(msgs[0].GetBody(section))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "Subject: Hello\r\n\r\nfoobar\r\n" {
+		t.Errorf("Wrong message body: %q", body)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Add("Subject", "Hello")
+	ids, err := mbox.SearchMessages(false, criteria)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Error("Wrong search results:", ids)
+	}
+
+	s.AutoCreate = true
+	if err := deliver(t, s, "new@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	accts, _ := s.ListIMAPAccts()
+	if len(accts) != 2 || accts[0] != "new@example.org" {
+		t.Error("Account is not created on delivery:", accts)
+	}
+}
+
+func TestStorage_Mailboxes(t *testing.T) {
+	s := &Storage{}
+	u, err := s.GetOrCreateIMAPAcct("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	inbox, _ := u.GetMailbox(imap.InboxName)
+	for i := 0; i < 3; i++ {
+		if err := inbox.CreateMessage(nil, time.Time{}, bytes.NewReader([]byte("Subject: test\r\n\r\ntest\r\n"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seqset, _ := imap.ParseSeqSet("1:2")
+	if err := inbox.CopyMessages(false, seqset, "Archive"); err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.UpdateMessagesFlags(false, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, count := range map[string]uint32{imap.InboxName: 1, "Archive": 2} {
+		mbox, err := u.GetMailbox(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages, imap.StatusUidNext})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Messages != count {
+			t.Errorf("%s: wrong messages count: %d, want %d", name, status.Messages, count)
+		}
+	}
+
+	if err := u.RenameMailbox("Archive", "Old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := u.GetMailbox("Archive"); err == nil {
+		t.Error("Mailbox is not renamed")
+	}
+	if err := u.DeleteMailbox(imap.InboxName); err == nil {
+		t.Error("INBOX deleted")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	a := &Auth{}
+	if err := a.CreateUser("user", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlain("user", "password"); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := a.AuthPlain("user", "wrong"); err == nil {
+		t.Error("Wrong password accepted")
+	}
+	if err := a.AuthPlain("user2", "password"); err != module.ErrUnknownCredentials {
+		t.Error("Expected ErrUnknownCredentials, got:", err)
+	}
+	if _, ok, _ := a.Lookup(context.Background(), "user"); !ok {
+		t.Error("User is not found in table")
+	}
+
+	a.AddToken("user", "token")
+	if username, err := a.AuthBearer("token"); err != nil || username != "user" {
+		t.Error("Token is not accepted:", username, err)
+	}
+
+	if err := a.DeleteUser("user"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AuthBearer("token"); err == nil {
+		t.Error("Token is accepted after user deletion")
+	}
+}
@@ -0,0 +1,571 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package moduletest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Storage is an in-memory module.ManageableStorage.
+//
+// It also implements module.DeliveryTarget, messages are added to the INBOX
+// of the recipient account. Delivery to non-existent accounts fails unless
+// AutoCreate is set.
+type Storage struct {
+	InstName   string
+	AutoCreate bool
+
+	lock  sync.Mutex
+	users map[string]*memUser
+}
+
+var (
+	_ module.ManageableStorage = &Storage{}
+	_ module.DeliveryTarget    = &Storage{}
+)
+
+func (s *Storage) Init(*config.Map) error {
+	return nil
+}
+
+func (s *Storage) InstanceName() string {
+	if s.InstName != "" {
+		return s.InstName
+	}
+	return "test_storage"
+}
+
+func (s *Storage) Name() string {
+	return "test_storage"
+}
+
+func (s *Storage) IMAPExtensions() []string {
+	return nil
+}
+
+func (s *Storage) getUser(username string, create bool) (*memUser, error) {
+	if u, ok := s.users[username]; ok {
+		return u, nil
+	}
+	if !create {
+		return nil, errors.New("moduletest: no such user")
+	}
+
+	u := &memUser{
+		s:         s,
+		name:      username,
+		mailboxes: map[string]*memMailbox{},
+	}
+	u.mailboxes[imap.InboxName] = &memMailbox{user: u, name: imap.InboxName, subscribed: true, uidNext: 1}
+	if s.users == nil {
+		s.users = make(map[string]*memUser)
+	}
+	s.users[username] = u
+	return u, nil
+}
+
+func (s *Storage) GetOrCreateIMAPAcct(username string) (imapbackend.User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.getUser(username, true)
+}
+
+func (s *Storage) GetIMAPAcct(username string) (imapbackend.User, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.getUser(username, false)
+}
+
+func (s *Storage) ListIMAPAccts() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	names := make([]string, 0, len(s.users))
+	for name := range s.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s *Storage) CreateIMAPAcct(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.users[username]; ok {
+		return errors.New("moduletest: user already exists")
+	}
+	_, err := s.getUser(username, true)
+	return err
+}
+
+func (s *Storage) DeleteIMAPAcct(username string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.users[username]; !ok {
+		return errors.New("moduletest: no such user")
+	}
+	delete(s.users, username)
+	return nil
+}
+
+type storageDelivery struct {
+	s     *Storage
+	rcpts []string
+	body  []byte
+}
+
+func (s *Storage) Start(context.Context, *module.MsgMetadata, string) (module.Delivery, error) {
+	return &storageDelivery{s: s}, nil
+}
+
+func (sd *storageDelivery) AddRcpt(_ context.Context, rcptTo string) error {
+	sd.s.lock.Lock()
+	defer sd.s.lock.Unlock()
+	if _, err := sd.s.getUser(rcptTo, sd.s.AutoCreate); err != nil {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "User does not exist",
+			TargetName:   "moduletest",
+			Err:          err,
+		}
+	}
+	sd.rcpts = append(sd.rcpts, rcptTo)
+	return nil
+}
+
+func (sd *storageDelivery) Body(_ context.Context, header textproto.Header, body buffer.Buffer) error {
+	var blob bytes.Buffer
+	if err := textproto.WriteHeader(&blob, header); err != nil {
+		return err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := blob.ReadFrom(r); err != nil {
+		return err
+	}
+	sd.body = blob.Bytes()
+	return nil
+}
+
+func (sd *storageDelivery) Abort(context.Context) error {
+	return nil
+}
+
+func (sd *storageDelivery) Commit(context.Context) error {
+	if sd.body == nil {
+		return errors.New("moduletest: Commit without Body")
+	}
+
+	sd.s.lock.Lock()
+	defer sd.s.lock.Unlock()
+	for _, rcpt := range sd.rcpts {
+		u, err := sd.s.getUser(rcpt, true)
+		if err != nil {
+			return err
+		}
+		u.mailboxes[imap.InboxName].add(nil, time.Now(), sd.body)
+	}
+	return nil
+}
+
+type memUser struct {
+	s         *Storage
+	name      string
+	mailboxes map[string]*memMailbox
+}
+
+func (u *memUser) Username() string {
+	return u.name
+}
+
+func (u *memUser) ListMailboxes(subscribed bool) ([]imapbackend.Mailbox, error) {
+	u.s.lock.Lock()
+	defer u.s.lock.Unlock()
+
+	names := make([]string, 0, len(u.mailboxes))
+	for name, mbox := range u.mailboxes {
+		if subscribed && !mbox.subscribed {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mboxes := make([]imapbackend.Mailbox, 0, len(names))
+	for _, name := range names {
+		mboxes = append(mboxes, u.mailboxes[name])
+	}
+	return mboxes, nil
+}
+
+func (u *memUser) GetMailbox(name string) (imapbackend.Mailbox, error) {
+	u.s.lock.Lock()
+	defer u.s.lock.Unlock()
+	mbox, ok := u.mailboxes[name]
+	if !ok {
+		return nil, imapbackend.ErrNoSuchMailbox
+	}
+	return mbox, nil
+}
+
+func (u *memUser) CreateMailbox(name string) error {
+	u.s.lock.Lock()
+	defer u.s.lock.Unlock()
+	if _, ok := u.mailboxes[name]; ok {
+		return imapbackend.ErrMailboxAlreadyExists
+	}
+	u.mailboxes[name] = &memMailbox{user: u, name: name, uidNext: 1}
+	return nil
+}
+
+func (u *memUser) DeleteMailbox(name string) error {
+	u.s.lock.Lock()
+	defer u.s.lock.Unlock()
+	if name == imap.InboxName {
+		return errors.New("moduletest: cannot delete INBOX")
+	}
+	if _, ok := u.mailboxes[name]; !ok {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	delete(u.mailboxes, name)
+	return nil
+}
+
+func (u *memUser) RenameMailbox(existingName, newName string) error {
+	u.s.lock.Lock()
+	defer u.s.lock.Unlock()
+	mbox, ok := u.mailboxes[existingName]
+	if !ok {
+		return imapbackend.ErrNoSuchMailbox
+	}
+	if _, ok := u.mailboxes[newName]; ok {
+		return imapbackend.ErrMailboxAlreadyExists
+	}
+
+	u.mailboxes[newName] = &memMailbox{
+		user:       u,
+		name:       newName,
+		subscribed: mbox.subscribed,
+		msgs:       mbox.msgs,
+		uidNext:    mbox.uidNext,
+	}
+	// Renaming INBOX moves messages to the new mailbox and leaves INBOX
+	// empty (RFC 3501 Section 6.3.5).
+	if existingName == imap.InboxName {
+		mbox.msgs = nil
+	} else {
+		delete(u.mailboxes, existingName)
+	}
+	return nil
+}
+
+func (u *memUser) Logout() error {
+	return nil
+}
+
+type memMessage struct {
+	uid   uint32
+	date  time.Time
+	flags []string
+	body  []byte
+}
+
+func (m *memMessage) fetch(seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(m.body)))
+			if err != nil {
+				return nil, err
+			}
+			fetched.Envelope, err = backendutil.FetchEnvelope(hdr)
+			if err != nil {
+				return nil, err
+			}
+		case imap.FetchBody, imap.FetchBodyStructure:
+			body := bufio.NewReader(bytes.NewReader(m.body))
+			hdr, err := textproto.ReadHeader(body)
+			if err != nil {
+				return nil, err
+			}
+			fetched.BodyStructure, err = backendutil.FetchBodyStructure(hdr, body, item == imap.FetchBodyStructure)
+			if err != nil {
+				return nil, err
+			}
+		case imap.FetchFlags:
+			fetched.Flags = append([]string(nil), m.flags...)
+		case imap.FetchInternalDate:
+			fetched.InternalDate = m.date
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(m.body))
+		case imap.FetchUid:
+			fetched.Uid = m.uid
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				return nil, err
+			}
+
+			body := bufio.NewReader(bytes.NewReader(m.body))
+			hdr, err := textproto.ReadHeader(body)
+			if err != nil {
+				return nil, err
+			}
+			l, err := backendutil.FetchBodySection(hdr, body, section)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Body[section] = l
+		}
+	}
+	return fetched, nil
+}
+
+type memMailbox struct {
+	user       *memUser
+	name       string
+	subscribed bool
+	msgs       []*memMessage
+	uidNext    uint32
+}
+
+func (mbox *memMailbox) add(flags []string, date time.Time, body []byte) uint32 {
+	uid := mbox.uidNext
+	mbox.uidNext++
+	mbox.msgs = append(mbox.msgs, &memMessage{
+		uid:   uid,
+		date:  date,
+		flags: append([]string(nil), flags...),
+		body:  body,
+	})
+	return uid
+}
+
+// forEach calls f for each message matching the sequence set.
+func (mbox *memMailbox) forEach(uid bool, seqset *imap.SeqSet, f func(seqNum uint32, msg *memMessage)) {
+	for i, msg := range mbox.msgs {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = msg.uid
+		}
+		if seqset.Contains(id) {
+			f(seqNum, msg)
+		}
+	}
+}
+
+func (mbox *memMailbox) Name() string {
+	return mbox.name
+}
+
+func (mbox *memMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{
+		Delimiter: "/",
+		Name:      mbox.name,
+	}, nil
+}
+
+func (mbox *memMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	mbox.user.s.lock.Lock()
+	defer mbox.user.s.lock.Unlock()
+
+	status := imap.NewMailboxStatus(mbox.name, items)
+	status.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	status.PermanentFlags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag, "\\*"}
+
+	var unseen uint32
+	for i, msg := range mbox.msgs {
+		if !hasFlag(msg.flags, imap.SeenFlag) {
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+			unseen++
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(mbox.msgs))
+		case imap.StatusUidNext:
+			status.UidNext = mbox.uidNext
+		case imap.StatusUidValidity:
+			status.UidValidity = 1
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+	return status, nil
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (mbox *memMailbox) SetSubscribed(subscribed bool) error {
+	mbox.user.s.lock.Lock()
+	defer mbox.user.s.lock.Unlock()
+	mbox.subscribed = subscribed
+	return nil
+}
+
+func (mbox *memMailbox) Check() error {
+	return nil
+}
+
+func (mbox *memMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	// Fetch everything first to not hold the lock while the channel is
+	// being consumed.
+	var (
+		fetched []*imap.Message
+		err     error
+	)
+	mbox.user.s.lock.Lock()
+	mbox.forEach(uid, seqset, func(seqNum uint32, msg *memMessage) {
+		if err != nil {
+			return
+		}
+		var m *imap.Message
+		m, err = msg.fetch(seqNum, items)
+		fetched = append(fetched, m)
+	})
+	mbox.user.s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range fetched {
+		ch <- m
+	}
+	return nil
+}
+
+func (mbox *memMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	mbox.user.s.lock.Lock()
+	defer mbox.user.s.lock.Unlock()
+
+	var ids []uint32
+	for i, msg := range mbox.msgs {
+		seqNum := uint32(i + 1)
+		e, err := message.Read(bytes.NewReader(msg.body))
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return nil, err
+		}
+		ok, err := backendutil.Match(e, seqNum, msg.uid, msg.date, msg.flags, criteria)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if uid {
+			ids = append(ids, msg.uid)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+	return ids, nil
+}
+
+func (mbox *memMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	mbox.user.s.lock.Lock()
+	defer mbox.user.s.lock.Unlock()
+	mbox.add(flags, date, b)
+	return nil
+}
+
+func (mbox *memMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	mbox.user.s.lock.Lock()
+	defer mbox.user.s.lock.Unlock()
+	mbox.forEach(uid, seqset, func(_ uint32, msg *memMessage) {
+		msg.flags = backendutil.UpdateFlags(msg.flags, op, flags)
+	})
+	return nil
+}
+
+func (mbox *memMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	mbox.user.s.lock.Lock()
+	defer mbox.user.s.lock.Unlock()
+	dest, ok := mbox.user.mailboxes[destName]
+	if !ok {
+		return imapbackend.ErrNoSuchMailbox
+	}
+
+	// Collect messages first in case dest is the same mailbox.
+	var msgs []*memMessage
+	mbox.forEach(uid, seqset, func(_ uint32, msg *memMessage) {
+		msgs = append(msgs, msg)
+	})
+	for _, msg := range msgs {
+		dest.add(msg.flags, msg.date, msg.body)
+	}
+	return nil
+}
+
+func (mbox *memMailbox) Expunge() error {
+	mbox.user.s.lock.Lock()
+	defer mbox.user.s.lock.Unlock()
+
+	kept := mbox.msgs[:0]
+	for _, msg := range mbox.msgs {
+		if !hasFlag(msg.flags, imap.DeletedFlag) {
+			kept = append(kept, msg)
+		}
+	}
+	mbox.msgs = kept
+	return nil
+}
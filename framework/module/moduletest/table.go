@@ -0,0 +1,53 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package moduletest
+
+import "context"
+
+// Table is a module.Table and module.MultiTable backed by maps.
+//
+// Lookup returns the value from M or the first value from Multi. LookupMulti
+// returns values from Multi or the value from M. Err, if set, is returned
+// from all lookups.
+//
+// Table should not be modified while lookups are in progress.
+type Table struct {
+	M     map[string]string
+	Multi map[string][]string
+	Err   error
+}
+
+func (m Table) Lookup(_ context.Context, a string) (string, bool, error) {
+	if b, ok := m.M[a]; ok {
+		return b, ok, m.Err
+	}
+	if vals := m.Multi[a]; len(vals) != 0 {
+		return vals[0], true, m.Err
+	}
+	return "", false, m.Err
+}
+
+func (m Table) LookupMulti(_ context.Context, a string) ([]string, error) {
+	if vals, ok := m.Multi[a]; ok {
+		return vals, m.Err
+	}
+	if b, ok := m.M[a]; ok {
+		return []string{b}, m.Err
+	}
+	return nil, m.Err
+}
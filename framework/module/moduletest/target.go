@@ -0,0 +1,243 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package moduletest provides in-memory implementations of module interfaces
+// for use in tests.
+//
+// It is intended for code that embeds maddy or implements out-of-tree
+// modules and needs to test them without setting up databases or network
+// services. All types are usable as zero values unless noted otherwise and
+// are safe for concurrent use.
+package moduletest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Msg is a message delivered to Target.
+type Msg struct {
+	MsgMeta  *module.MsgMetadata
+	MailFrom string
+	RcptTo   []string
+	Body     []byte
+	Header   textproto.Header
+}
+
+// Target is a module.DeliveryTarget that records committed messages in the
+// Messages slice.
+//
+// Errors can be injected for each step of the delivery. If PartialBodyErr is
+// set, deliveries implement module.PartialDelivery and report these errors
+// from BodyNonAtomic.
+type Target struct {
+	Messages        []Msg
+	DiscardMessages bool
+
+	StartErr       error
+	RcptErr        map[string]error
+	BodyErr        error
+	PartialBodyErr map[string]error
+	AbortErr       error
+	CommitErr      error
+
+	InstName string
+
+	lock sync.Mutex
+}
+
+/*
+module.Module is implemented with dummy functions for logging done by MsgPipeline code.
+*/
+
+func (dt *Target) Init(*config.Map) error {
+	return nil
+}
+
+func (dt *Target) InstanceName() string {
+	if dt.InstName != "" {
+		return dt.InstName
+	}
+	return "test_instance"
+}
+
+func (dt *Target) Name() string {
+	return "test_target"
+}
+
+// Snapshot returns a copy of the Messages slice. It should be used instead
+// of direct access if deliveries may be in progress.
+func (dt *Target) Snapshot() []Msg {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+	return append([]Msg(nil), dt.Messages...)
+}
+
+type testTargetDelivery struct {
+	msg Msg
+	tgt *Target
+}
+
+type testTargetDeliveryPartial struct {
+	testTargetDelivery
+}
+
+func (dt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	if dt.PartialBodyErr != nil {
+		return &testTargetDeliveryPartial{
+			testTargetDelivery: testTargetDelivery{
+				tgt: dt,
+				msg: Msg{MsgMeta: msgMeta, MailFrom: mailFrom},
+			},
+		}, dt.StartErr
+	}
+	return &testTargetDelivery{
+		tgt: dt,
+		msg: Msg{MsgMeta: msgMeta, MailFrom: mailFrom},
+	}, dt.StartErr
+}
+func (dtd *testTargetDelivery) AddRcpt(ctx context.Context, to string) error {
+	if dtd.tgt.RcptErr != nil {
+		if err := dtd.tgt.RcptErr[to]; err != nil {
+			return err
+		}
+	}
+
+	dtd.msg.RcptTo = append(dtd.msg.RcptTo, to)
+	return nil
+}
+
+func (dtd *testTargetDeliveryPartial) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, buf buffer.Buffer) {
+	if dtd.tgt.PartialBodyErr != nil {
+		for rcpt, err := range dtd.tgt.PartialBodyErr {
+			c.SetStatus(rcpt, err)
+		}
+		return
+	}
+
+	dtd.msg.Header = header
+
+	body, err := buf.Open()
+	if err != nil {
+		for rcpt, err := range dtd.tgt.PartialBodyErr {
+			c.SetStatus(rcpt, err)
+		}
+		return
+	}
+	defer body.Close()
+
+	dtd.msg.Body, err = ioutil.ReadAll(body)
+	if err != nil {
+		for rcpt, err := range dtd.tgt.PartialBodyErr {
+			c.SetStatus(rcpt, err)
+		}
+	}
+}
+
+func (dtd *testTargetDelivery) Body(ctx context.Context, header textproto.Header, buf buffer.Buffer) error {
+	if dtd.tgt.PartialBodyErr != nil {
+		return errors.New("partial failure occurred, no additional information available")
+	}
+	if dtd.tgt.BodyErr != nil {
+		return dtd.tgt.BodyErr
+	}
+
+	dtd.msg.Header = header
+
+	body, err := buf.Open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if dtd.tgt.DiscardMessages {
+		// Don't bother.
+		_, err = io.Copy(ioutil.Discard, body)
+		return err
+	}
+
+	dtd.msg.Body, err = ioutil.ReadAll(body)
+	return err
+}
+
+func (dtd *testTargetDelivery) Abort(ctx context.Context) error {
+	return dtd.tgt.AbortErr
+}
+
+func (dtd *testTargetDelivery) Commit(ctx context.Context) error {
+	if dtd.tgt.CommitErr != nil {
+		return dtd.tgt.CommitErr
+	}
+	if dtd.tgt.DiscardMessages {
+		return nil
+	}
+	dtd.tgt.lock.Lock()
+	defer dtd.tgt.lock.Unlock()
+	dtd.tgt.Messages = append(dtd.tgt.Messages, dtd.msg)
+	return nil
+}
+
+// NullTarget is a module.DeliveryTarget that accepts and discards all
+// messages.
+type NullTarget struct {
+	InstName string
+}
+
+func (nt NullTarget) Init(*config.Map) error {
+	return nil
+}
+
+func (nt NullTarget) InstanceName() string {
+	if nt.InstName != "" {
+		return nt.InstName
+	}
+	return "null"
+}
+
+func (nt NullTarget) Name() string {
+	return "null_target"
+}
+
+func (nt NullTarget) Start(context.Context, *module.MsgMetadata, string) (module.Delivery, error) {
+	return nullDelivery{}, nil
+}
+
+type nullDelivery struct{}
+
+func (nullDelivery) AddRcpt(context.Context, string) error {
+	return nil
+}
+
+func (nullDelivery) Body(context.Context, textproto.Header, buffer.Buffer) error {
+	return nil
+}
+
+func (nullDelivery) Abort(context.Context) error {
+	return nil
+}
+
+func (nullDelivery) Commit(context.Context) error {
+	return nil
+}
@@ -54,6 +54,10 @@ type ConnState struct {
 	//   Consumers should assume that the PTR record doesn't exist.
 	RDNSName *future.Future
 
+	// Whether the PTR record in RDNSName was authenticated using DNSSEC.
+	// Valid only after RDNSName.Get returns.
+	RDNSAuthenticated bool
+
 	// If the client successfully authenticated using a username/password pair.
 	// This field contains the username.
 	AuthUser string
@@ -79,6 +83,14 @@ type MsgMetadata struct {
 	// message source module.
 	ID string
 
+	// Identifier of the message this one is derived from (queue delivery
+	// attempts, forwarded copies, DSNs). It is preserved as-is when messages
+	// are derived further so all related log entries can be found using the
+	// ID assigned at acceptance. Empty for messages that are not derived.
+	//
+	// Use Trace method to get the value to assign to this field.
+	TraceID string `json:",omitempty"`
+
 	// Original message sender address as it was received by the message source.
 	//
 	// Note that this field is meant for use for tracing purposes.
@@ -129,6 +141,12 @@ type MsgMetadata struct {
 	// header. It is only meaningful if server has seen the body at least once
 	// (e.g. the message was passed via queue).
 	TLSRequireOverride bool
+
+	// Facts contains the information published about the message by checks
+	// and other pipeline components. See Facts documentation for details.
+	//
+	// MsgPipeline will initialize that field if it is nil.
+	Facts *Facts
 }
 
 // DeepCopy creates a copy of the MsgMetadata structure, also
@@ -140,9 +158,19 @@ func (msgMeta *MsgMetadata) DeepCopy() *MsgMetadata {
 	cpy := *msgMeta
 	// There is no good way to copy net.Addr, but it should not be
 	// modified by anything anyway so we are safe.
+	cpy.Facts = msgMeta.Facts.Copy()
 	return &cpy
 }
 
+// Trace returns the identifier of the original message to be used as TraceID
+// for messages derived from this one.
+func (msgMeta *MsgMetadata) Trace() string {
+	if msgMeta.TraceID != "" {
+		return msgMeta.TraceID
+	}
+	return msgMeta.ID
+}
+
 // GenerateMsgID generates a string usable as MsgID field in module.MsgMeta.
 func GenerateMsgID() (string, error) {
 	rawID := make([]byte, 4)
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"sort"
 	"sync"
 
 	"github.com/foxcpp/maddy/framework/log"
@@ -101,3 +102,31 @@ func RegisterEndpoint(name string, factory FuncNewEndpoint) {
 
 	endpoints[name] = factory
 }
+
+// RegisteredModules returns sorted names of all modules in the global
+// registry, not including endpoint-type modules.
+func RegisteredModules() []string {
+	modulesLock.RLock()
+	defer modulesLock.RUnlock()
+
+	names := make([]string, 0, len(modules))
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RegisteredEndpoints returns sorted names of all endpoint-type modules in
+// the global registry.
+func RegisteredEndpoints() []string {
+	modulesLock.RLock()
+	defer modulesLock.RUnlock()
+
+	names := make([]string, 0, len(endpoints))
+	for name := range endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
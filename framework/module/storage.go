@@ -19,6 +19,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package module
 
 import (
+	"time"
+
+	"github.com/emersion/go-imap"
 	imapbackend "github.com/emersion/go-imap/backend"
 )
 
@@ -48,3 +51,64 @@ type ManageableStorage interface {
 	CreateIMAPAcct(username string) error
 	DeleteIMAPAcct(username string) error
 }
+
+// IMAPAppendMessage is a single message passed to
+// MultiAppendMailbox.CreateMessages.
+type IMAPAppendMessage struct {
+	Flags []string
+	Date  time.Time
+	Body  imap.Literal
+}
+
+// MultiAppendMailbox is an optional interface for mailbox objects
+// returned by Storage.
+//
+// Storage modules that implement it for all mailboxes may
+// include "MULTIAPPEND" in the IMAPExtensions list.
+type MultiAppendMailbox interface {
+	// CreateMessages adds all specified messages to the mailbox using a
+	// single transaction. Either all messages should be added or none of
+	// them.
+	CreateMessages(msgs []IMAPAppendMessage) error
+}
+
+// UIDMapping describes UIDs assigned to messages copied or moved to
+// another mailbox.
+type UIDMapping struct {
+	// UIDVALIDITY of the destination mailbox.
+	UIDValidity uint32
+
+	// Source messages UIDs in ascending order.
+	Src []uint32
+
+	// UIDs assigned to the copies in the destination mailbox, Dest[i]
+	// corresponds to Src[i].
+	Dest []uint32
+}
+
+// UIDPlusMailbox is an optional interface for mailbox objects returned by
+// Storage. It provides information about assigned UIDs required to
+// implement the UIDPLUS extension (RFC 4315).
+//
+// Storage modules that implement it for all mailboxes may include "UIDPLUS"
+// in the IMAPExtensions list.
+type UIDPlusMailbox interface {
+	// CreateMessageUID is the same as CreateMessage, but also returns
+	// UIDVALIDITY of the mailbox and UID assigned to the message.
+	CreateMessageUID(flags []string, date time.Time, body imap.Literal) (uidValidity, uid uint32, err error)
+
+	// CopyMessagesUID is the same as CopyMessages, but also returns the
+	// assigned UIDs.
+	CopyMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (UIDMapping, error)
+
+	// MoveMessagesUID is the same as MoveMessages, but also returns the
+	// assigned UIDs.
+	//
+	// The operation should be atomic and should not require copying message
+	// bodies.
+	MoveMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (UIDMapping, error)
+
+	// ExpungeUIDs is the same as Expunge, but removes only messages with UIDs
+	// in the specified set.
+	ExpungeUIDs(uids *imap.SeqSet) error
+}
@@ -0,0 +1,838 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package adminui implements the minimal web interface for server
+// administration.
+//
+// It is served by the openmetrics endpoint and provides the overview of
+// queued messages, recent rejections, per-domain statistics and certificates
+// status. Optionally, it allows to manage accounts and aliases.
+//
+// If self-service is enabled, non-admin users can log in to manage their own
+// sender block and allow lists and application-specific passwords.
+package adminui
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/check/sender_lists"
+	"github.com/foxcpp/maddy/internal/table"
+	"github.com/foxcpp/maddy/internal/target/queue"
+)
+
+// Prefix is the path prefix the UI is served under.
+const Prefix = "/admin/"
+
+type UI struct {
+	log      log.Logger
+	saslAuth auth.SASLAuth
+	admins   map[string]struct{}
+
+	userDB    module.PlainUserDB
+	aliases   module.MutableTable
+	queues    []*queue.Queue
+	tlsConfig *tls.Config
+
+	senderLists  module.MutableTable
+	appPasswords module.AppPasswordDB
+	selfService  bool
+
+	stats *tracker
+	mux   *http.ServeMux
+	tmpl  *template.Template
+}
+
+// New creates the UI object using the configuration from the admin_ui block.
+func New(globals map[string]interface{}, node config.Node, logger log.Logger) (*UI, error) {
+	ui := &UI{
+		log: log.Logger{Name: logger.Name + "/admin_ui", Debug: logger.Debug},
+		saslAuth: auth.SASLAuth{
+			Log: log.Logger{Name: logger.Name + "/admin_ui/auth", Debug: logger.Debug},
+		},
+		admins: map[string]struct{}{},
+	}
+
+	var (
+		admins      []string
+		aliases     module.Table
+		senderLists module.Table
+	)
+	cfg := config.NewMap(globals, node)
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		return ui.saslAuth.AddProvider(m, node)
+	})
+	cfg.StringList("admins", false, true, nil, &admins)
+	cfg.Custom("user_db", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var db module.PlainUserDB
+		if err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &db); err != nil {
+			return nil, err
+		}
+		return db, nil
+	}, &ui.userDB)
+	cfg.Custom("aliases", false, false, nil, modconfig.TableDirective, &aliases)
+	cfg.Custom("sender_lists", false, false, nil, modconfig.TableDirective, &senderLists)
+	cfg.Custom("app_passwords", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var db module.AppPasswordDB
+		if err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &db); err != nil {
+			return nil, err
+		}
+		return db, nil
+	}, &ui.appPasswords)
+	cfg.Bool("self_service", false, false, &ui.selfService)
+	cfg.Callback("queue", func(m *config.Map, node config.Node) error {
+		var tgt module.DeliveryTarget
+		if err := modconfig.ModuleFromNode("target", node.Args, node, m.Globals, &tgt); err != nil {
+			return err
+		}
+		q, ok := tgt.(*queue.Queue)
+		if !ok {
+			return config.NodeErr(node, "admin_ui: module is not a queue")
+		}
+		ui.queues = append(ui.queues, q)
+		return nil
+	})
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &ui.tlsConfig)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if len(ui.saslAuth.Plain) == 0 {
+		return nil, config.NodeErr(node, "admin_ui: at least one auth provider is required")
+	}
+	for _, admin := range admins {
+		ui.admins[admin] = struct{}{}
+	}
+	if aliases != nil {
+		mutable, ok := aliases.(module.MutableTable)
+		if !ok {
+			return nil, config.NodeErr(node, "admin_ui: aliases table is not mutable")
+		}
+		ui.aliases = mutable
+	}
+	if senderLists != nil {
+		mutable, ok := senderLists.(module.MutableTable)
+		if !ok {
+			return nil, config.NodeErr(node, "admin_ui: sender_lists table is not mutable")
+		}
+		ui.senderLists = mutable
+	}
+	if ui.selfService && ui.senderLists == nil && ui.appPasswords == nil {
+		return nil, config.NodeErr(node, "admin_ui: self_service requires sender_lists or app_passwords")
+	}
+
+	if err := ui.setup(); err != nil {
+		return nil, err
+	}
+	return ui, nil
+}
+
+// setup prepares templates and handlers after the configuration is
+// processed.
+func (ui *UI) setup() error {
+	tmpl, err := template.New("").Funcs(template.FuncMap{
+		"fmtTime": func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return t.Local().Format("2006-01-02 15:04:05")
+		},
+		"join": strings.Join,
+	}).Parse(templates)
+	if err != nil {
+		return err
+	}
+	ui.tmpl = tmpl
+
+	ui.mux = http.NewServeMux()
+	ui.mux.HandleFunc(Prefix, ui.serveIndex)
+	ui.mux.HandleFunc(Prefix+"queue", ui.serveQueue)
+	ui.mux.HandleFunc(Prefix+"rejections", ui.serveRejections)
+	ui.mux.HandleFunc(Prefix+"domains", ui.serveDomains)
+	ui.mux.HandleFunc(Prefix+"certs", ui.serveCerts)
+	ui.mux.HandleFunc(Prefix+"accounts", ui.serveAccounts)
+	ui.mux.HandleFunc(Prefix+"aliases", ui.serveAliases)
+	ui.mux.HandleFunc(Prefix+"senders", ui.serveSenders)
+	ui.mux.HandleFunc(Prefix+"app-passwords", ui.serveAppPasswords)
+
+	ui.stats = newTracker()
+	return nil
+}
+
+func (ui *UI) Close() error {
+	ui.stats.Close()
+	return nil
+}
+
+func (ui *UI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		ui.requestAuth(w)
+		return
+	}
+	_, isAdmin := ui.admins[username]
+	if !isAdmin && !(ui.selfService && isSelfServicePath(r.URL.Path)) {
+		ui.log.Msg("authentication failed", "reason", "not an admin", "username", username, "src_ip", r.RemoteAddr)
+		ui.requestAuth(w)
+		return
+	}
+	if err := ui.saslAuth.AuthPlain(username, password); err != nil {
+		ui.log.Error("authentication failed", err, "username", username, "src_ip", r.RemoteAddr)
+		ui.requestAuth(w)
+		return
+	}
+	r = r.WithContext(context.WithValue(r.Context(), userKey{}, userInfo{
+		Username: username,
+		Admin:    isAdmin,
+	}))
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Browsers send cached credentials with cross-site requests, make
+		// sure state-changing requests come from the UI itself.
+		if !sameOrigin(r) {
+			http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+	}
+
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'unsafe-inline'")
+	ui.mux.ServeHTTP(w, r)
+}
+
+// isSelfServicePath reports whether the page is accessible to non-admin
+// users if self-service is enabled.
+func isSelfServicePath(path string) bool {
+	return path == Prefix+"senders" || path == Prefix+"app-passwords"
+}
+
+func (ui *UI) requestAuth(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="maddy admin", charset="UTF-8"`)
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+}
+
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
+type userKey struct{}
+
+type userInfo struct {
+	Username string
+	Admin    bool
+}
+
+type page struct {
+	Title    string
+	Error    string
+	Accounts bool
+	Aliases  bool
+	Senders  bool
+	// AppPasswords is set if application-specific passwords can be managed.
+	AppPasswords bool
+	// SelfService is set for pages shown to non-admin users, links to admin
+	// pages are hidden.
+	SelfService bool
+	Data        interface{}
+}
+
+func (ui *UI) render(w http.ResponseWriter, name string, p page) {
+	p.Accounts = ui.userDB != nil
+	p.Aliases = ui.aliases != nil
+	p.Senders = ui.senderLists != nil
+	p.AppPasswords = ui.appPasswords != nil
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := ui.tmpl.ExecuteTemplate(w, name, p); err != nil {
+		ui.log.Error("template execution failed", err, "template", name)
+	}
+}
+
+func (ui *UI) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != Prefix {
+		http.NotFound(w, r)
+		return
+	}
+
+	queued := 0
+	for _, q := range ui.queues {
+		entries, err := q.Entries()
+		if err != nil {
+			ui.log.Error("failed to read queue", err)
+			continue
+		}
+		queued += len(entries)
+	}
+
+	ui.render(w, "index", page{
+		Title: "Overview",
+		Data: struct {
+			Queued     int
+			Rejections []rejection
+			Domains    []domainStats
+		}{
+			Queued:     queued,
+			Rejections: limitRejections(ui.stats.Rejections(), 10),
+			Domains:    limitDomains(ui.stats.Domains(), 10),
+		},
+	})
+}
+
+func limitRejections(l []rejection, n int) []rejection {
+	if len(l) > n {
+		return l[:n]
+	}
+	return l
+}
+
+func limitDomains(l []domainStats, n int) []domainStats {
+	if len(l) > n {
+		return l[:n]
+	}
+	return l
+}
+
+type queueEntry struct {
+	ID           string
+	From         string
+	To           []string
+	Tries        int
+	FirstAttempt time.Time
+	LastAttempt  time.Time
+	Errors       []string
+}
+
+func (ui *UI) serveQueue(w http.ResponseWriter, r *http.Request) {
+	var (
+		entries []queueEntry
+		errMsg  string
+	)
+	for _, q := range ui.queues {
+		qEntries, err := q.Entries()
+		if err != nil {
+			ui.log.Error("failed to read queue", err)
+			errMsg = "Failed to read some queue entries: " + err.Error()
+			continue
+		}
+		for _, e := range qEntries {
+			entry := queueEntry{
+				ID:           e.ID,
+				From:         e.Meta.From,
+				To:           e.Meta.To,
+				FirstAttempt: e.Meta.FirstAttempt,
+				LastAttempt:  e.Meta.LastAttempt,
+			}
+			for _, tries := range e.Meta.TriesCount {
+				if tries > entry.Tries {
+					entry.Tries = tries
+				}
+			}
+			for rcpt, rcptErr := range e.Meta.RcptErrs {
+				entry.Errors = append(entry.Errors, rcpt+": "+rcptErr.Error())
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	ui.render(w, "queue", page{
+		Title: "Queue",
+		Error: errMsg,
+		Data:  entries,
+	})
+}
+
+func (ui *UI) serveRejections(w http.ResponseWriter, r *http.Request) {
+	ui.render(w, "rejections", page{
+		Title: "Recent rejections",
+		Data:  ui.stats.Rejections(),
+	})
+}
+
+func (ui *UI) serveDomains(w http.ResponseWriter, r *http.Request) {
+	ui.render(w, "domains", page{
+		Title: "Per-domain statistics",
+		Data:  ui.stats.Domains(),
+	})
+}
+
+type certInfo struct {
+	Names     []string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+	Status    string
+}
+
+func (ui *UI) certificates() ([]certInfo, error) {
+	if ui.tlsConfig == nil {
+		return nil, errors.New("TLS is not configured")
+	}
+
+	cfg := ui.tlsConfig
+	if cfg.GetConfigForClient != nil {
+		var err error
+		cfg, err = cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Certificates) == 0 && cfg.GetCertificate != nil {
+		return nil, errors.New("certificates are obtained dynamically and cannot be listed")
+	}
+
+	var res []certInfo
+	for _, cert := range cfg.Certificates {
+		leaf := cert.Leaf
+		if leaf == nil {
+			if len(cert.Certificate) == 0 {
+				continue
+			}
+			var err error
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		info := certInfo{
+			Names:     leaf.DNSNames,
+			Issuer:    leaf.Issuer.String(),
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+			Status:    "valid",
+		}
+		if len(info.Names) == 0 {
+			info.Names = []string{leaf.Subject.CommonName}
+		}
+		switch now := time.Now(); {
+		case now.After(leaf.NotAfter):
+			info.Status = "expired"
+		case now.Before(leaf.NotBefore):
+			info.Status = "not yet valid"
+		case leaf.NotAfter.Sub(now) < 14*24*time.Hour:
+			info.Status = "expires soon"
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+func (ui *UI) serveCerts(w http.ResponseWriter, r *http.Request) {
+	p := page{Title: "Certificates"}
+	certs, err := ui.certificates()
+	if err != nil {
+		p.Error = err.Error()
+	}
+	p.Data = certs
+	ui.render(w, "certs", p)
+}
+
+func (ui *UI) serveAccounts(w http.ResponseWriter, r *http.Request) {
+	if ui.userDB == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	p := page{Title: "Accounts"}
+	if r.Method == http.MethodPost {
+		if err := ui.updateAccount(r); err != nil {
+			p.Error = err.Error()
+		} else {
+			http.Redirect(w, r, Prefix+"accounts", http.StatusSeeOther)
+			return
+		}
+	}
+
+	users, err := ui.userDB.ListUsers()
+	if err != nil {
+		p.Error = err.Error()
+	}
+	p.Data = users
+	ui.render(w, "accounts", p)
+}
+
+func (ui *UI) updateAccount(r *http.Request) error {
+	username := r.PostFormValue("username")
+	password := r.PostFormValue("password")
+	if username == "" {
+		return errors.New("username is required")
+	}
+
+	var err error
+	switch action := r.PostFormValue("action"); action {
+	case "create":
+		if password == "" {
+			return errors.New("password is required")
+		}
+		err = ui.userDB.CreateUser(username, password)
+	case "password":
+		if password == "" {
+			return errors.New("password is required")
+		}
+		err = ui.userDB.SetUserPassword(username, password)
+	case "delete":
+		err = ui.userDB.DeleteUser(username)
+	default:
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	if err != nil {
+		return err
+	}
+	ui.log.Msg("account updated", "action", r.PostFormValue("action"), "username", username)
+	return nil
+}
+
+type alias struct {
+	Key   string
+	Value string
+
+	// Set only for tables implementing lifecycleAliases.
+	Expires string
+	Uses    string
+}
+
+type aliasesData struct {
+	Lifecycle bool
+	Aliases   []alias
+}
+
+// lifecycleAliases is implemented by tables that support expiring aliases
+// (table.sql_aliases).
+type lifecycleAliases interface {
+	Aliases() ([]table.AliasInfo, error)
+	SetAlias(ai table.AliasInfo) error
+}
+
+func (ui *UI) listAliases(r *http.Request) ([]alias, error) {
+	if lc, ok := ui.aliases.(lifecycleAliases); ok {
+		// Lookup can't be used since it counts as the alias use.
+		infos, err := lc.Aliases()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		aliases := make([]alias, 0, len(infos))
+		for _, ai := range infos {
+			a := alias{Key: ai.Alias, Value: ai.Target, Expires: "never", Uses: strconv.Itoa(ai.Uses)}
+			if !ai.ExpiresAt.IsZero() {
+				a.Expires = ai.ExpiresAt.Format(time.RFC3339)
+			}
+			if ai.MaxUses != 0 {
+				a.Uses += "/" + strconv.Itoa(ai.MaxUses)
+			}
+			if ai.Expired(now) {
+				a.Expires += " (expired)"
+			}
+			aliases = append(aliases, a)
+		}
+		return aliases, nil
+	}
+
+	keys, err := ui.aliases.Keys()
+	if err != nil {
+		return nil, err
+	}
+	aliases := make([]alias, 0, len(keys))
+	for _, k := range keys {
+		val, _, err := ui.aliases.Lookup(r.Context(), k)
+		if err != nil {
+			return aliases, err
+		}
+		aliases = append(aliases, alias{Key: k, Value: val})
+	}
+	return aliases, nil
+}
+
+func (ui *UI) serveAliases(w http.ResponseWriter, r *http.Request) {
+	if ui.aliases == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	p := page{Title: "Aliases"}
+	if r.Method == http.MethodPost {
+		if err := ui.updateAlias(r); err != nil {
+			p.Error = err.Error()
+		} else {
+			http.Redirect(w, r, Prefix+"aliases", http.StatusSeeOther)
+			return
+		}
+	}
+
+	aliases, err := ui.listAliases(r)
+	if err != nil {
+		p.Error = err.Error()
+	}
+	_, lifecycle := ui.aliases.(lifecycleAliases)
+	p.Data = aliasesData{Lifecycle: lifecycle, Aliases: aliases}
+	ui.render(w, "aliases", p)
+}
+
+func (ui *UI) updateAlias(r *http.Request) error {
+	key := r.PostFormValue("key")
+	if key == "" {
+		return errors.New("alias is required")
+	}
+
+	var err error
+	switch action := r.PostFormValue("action"); action {
+	case "set":
+		value := r.PostFormValue("value")
+		if value == "" {
+			return errors.New("target address is required")
+		}
+		lc, ok := ui.aliases.(lifecycleAliases)
+		if !ok {
+			err = ui.aliases.SetKey(key, value)
+			break
+		}
+		ai := table.AliasInfo{Alias: key, Target: value}
+		if lifetime := r.PostFormValue("lifetime"); lifetime != "" {
+			dur, err := time.ParseDuration(lifetime)
+			if err != nil || dur < 0 {
+				return fmt.Errorf("invalid lifetime: %s", lifetime)
+			}
+			ai.ExpiresAt = time.Now().Add(dur)
+		}
+		if maxUses := r.PostFormValue("max_uses"); maxUses != "" {
+			ai.MaxUses, err = strconv.Atoi(maxUses)
+			if err != nil || ai.MaxUses < 0 {
+				return fmt.Errorf("invalid max uses: %s", maxUses)
+			}
+		}
+		err = lc.SetAlias(ai)
+	case "delete":
+		err = ui.aliases.RemoveKey(key)
+	default:
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	if err != nil {
+		return err
+	}
+	ui.log.Msg("alias updated", "action", r.PostFormValue("action"), "key", key)
+	return nil
+}
+
+type sendersData struct {
+	Admin     bool
+	Rcpt      string
+	Addresses []string
+	Entries   []sender_lists.Entry
+}
+
+// ownAddresses returns the user address along with aliases pointing to it.
+func (ui *UI) ownAddresses(r *http.Request, username string) ([]string, error) {
+	addrs := []string{username}
+	if ui.aliases == nil {
+		return addrs, nil
+	}
+
+	aliases, err := ui.listAliases(r)
+	if err != nil {
+		return addrs, err
+	}
+	for _, a := range aliases {
+		if address.Equal(a.Value, username) {
+			addrs = append(addrs, a.Key)
+		}
+	}
+	return addrs, nil
+}
+
+func (ui *UI) serveSenders(w http.ResponseWriter, r *http.Request) {
+	if ui.senderLists == nil {
+		http.NotFound(w, r)
+		return
+	}
+	user := r.Context().Value(userKey{}).(userInfo)
+
+	p := page{Title: "Sender lists", SelfService: !user.Admin}
+	data := sendersData{Admin: user.Admin}
+
+	rcpt := r.FormValue("rcpt")
+	if rcpt == "" {
+		rcpt = user.Username
+	}
+	if user.Admin {
+		data.Addresses = []string{rcpt}
+	} else {
+		addrs, err := ui.ownAddresses(r, user.Username)
+		if err != nil {
+			ui.log.Error("failed to list aliases", err, "username", user.Username)
+		}
+		data.Addresses = addrs
+
+		owned := false
+		for _, addr := range addrs {
+			if address.Equal(addr, rcpt) {
+				owned = true
+				break
+			}
+		}
+		if !owned {
+			http.Error(w, "address is not owned by the user", http.StatusForbidden)
+			return
+		}
+	}
+	data.Rcpt = rcpt
+
+	if r.Method == http.MethodPost {
+		if err := ui.updateSenders(r, user, rcpt); err != nil {
+			p.Error = err.Error()
+		} else {
+			http.Redirect(w, r, Prefix+"senders?rcpt="+url.QueryEscape(rcpt), http.StatusSeeOther)
+			return
+		}
+	}
+
+	entries, err := sender_lists.Entries(r.Context(), ui.senderLists, rcpt)
+	if err != nil {
+		p.Error = err.Error()
+	}
+	data.Entries = entries
+	p.Data = data
+	ui.render(w, "senders", p)
+}
+
+func (ui *UI) updateSenders(r *http.Request, user userInfo, rcpt string) error {
+	sender := r.PostFormValue("sender")
+	if sender == "" {
+		return errors.New("sender is required")
+	}
+
+	var err error
+	switch action := r.PostFormValue("action"); action {
+	case "set":
+		err = sender_lists.SetEntry(ui.senderLists, rcpt, sender, r.PostFormValue("list"))
+	case "delete":
+		err = sender_lists.RemoveEntry(ui.senderLists, rcpt, sender)
+	default:
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	if err != nil {
+		return err
+	}
+	ui.log.Msg("sender list updated", "action", r.PostFormValue("action"), "username", user.Username,
+		"rcpt", rcpt, "sender", sender, "list", r.PostFormValue("list"))
+	return nil
+}
+
+type appPasswordsData struct {
+	Admin     bool
+	Username  string
+	Passwords []module.AppPassword
+	// NewPassword is set after creation, it is not possible to show it
+	// later.
+	NewPassword string
+}
+
+func (ui *UI) serveAppPasswords(w http.ResponseWriter, r *http.Request) {
+	if ui.appPasswords == nil {
+		http.NotFound(w, r)
+		return
+	}
+	user := r.Context().Value(userKey{}).(userInfo)
+
+	p := page{Title: "App passwords", SelfService: !user.Admin}
+	data := appPasswordsData{Admin: user.Admin, Username: user.Username}
+	if user.Admin {
+		if username := r.FormValue("username"); username != "" {
+			data.Username = username
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		password, err := ui.updateAppPasswords(r, user, data.Username)
+		switch {
+		case err != nil:
+			p.Error = err.Error()
+		case password == "":
+			http.Redirect(w, r, Prefix+"app-passwords?username="+url.QueryEscape(data.Username), http.StatusSeeOther)
+			return
+		default:
+			data.NewPassword = password
+		}
+	}
+
+	passwords, err := ui.appPasswords.ListAppPasswords(data.Username)
+	if err != nil {
+		p.Error = err.Error()
+	}
+	data.Passwords = passwords
+	p.Data = data
+	ui.render(w, "appPasswords", p)
+}
+
+// updateAppPasswords performs the requested action and returns the password
+// if it was created.
+func (ui *UI) updateAppPasswords(r *http.Request, user userInfo, username string) (string, error) {
+	var (
+		password string
+		id       string
+		err      error
+	)
+	switch action := r.PostFormValue("action"); action {
+	case "create":
+		scopes := strings.FieldsFunc(r.PostFormValue("protocols"), func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+		var info module.AppPassword
+		info, password, err = ui.appPasswords.CreateAppPassword(username, r.PostFormValue("name"), scopes)
+		id = info.ID
+	case "delete":
+		id = r.PostFormValue("id")
+		if id == "" {
+			return "", errors.New("password ID is required")
+		}
+		err = ui.appPasswords.RemoveAppPassword(username, id)
+	default:
+		return "", fmt.Errorf("unknown action: %s", action)
+	}
+	if err != nil {
+		return "", err
+	}
+	ui.log.Msg("app passwords updated", "action", r.PostFormValue("action"), "username", user.Username,
+		"account", username, "id", id)
+	return password, nil
+}
@@ -0,0 +1,143 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/module/moduletest"
+	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testUI(t *testing.T) (*UI, *moduletest.Auth) {
+	t.Helper()
+
+	db := &moduletest.Auth{}
+	if err := db.CreateUser("admin@example.org", "adminpass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateUser("user@example.org", "userpass"); err != nil {
+		t.Fatal(err)
+	}
+
+	ui := &UI{
+		log: testutils.Logger(t, "admin_ui"),
+		saslAuth: auth.SASLAuth{
+			Log:   testutils.Logger(t, "admin_ui/auth"),
+			Plain: []module.PlainAuth{db},
+		},
+		admins: map[string]struct{}{"admin@example.org": {}},
+		userDB: db,
+	}
+	if err := ui.setup(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ui.Close() })
+	return ui, db
+}
+
+func TestServeHTTP_Auth(t *testing.T) {
+	ui, _ := testUI(t)
+
+	check := func(username, password string, setAuth bool, expectedStatus int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, Prefix, nil)
+		if setAuth {
+			req.SetBasicAuth(username, password)
+		}
+		rec := httptest.NewRecorder()
+		ui.ServeHTTP(rec, req)
+		if rec.Code != expectedStatus {
+			t.Errorf("%s:%s: expected status %d, got %d", username, password, expectedStatus, rec.Code)
+		}
+		if expectedStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s:%s: no WWW-Authenticate header", username, password)
+		}
+	}
+
+	check("", "", false, http.StatusUnauthorized)
+	check("admin@example.org", "wrongpass", true, http.StatusUnauthorized)
+	check("unknown@example.org", "adminpass", true, http.StatusUnauthorized)
+	// Valid credentials, but not an admin.
+	check("user@example.org", "userpass", true, http.StatusUnauthorized)
+	check("admin@example.org", "adminpass", true, http.StatusOK)
+}
+
+func TestServeHTTP_SameOrigin(t *testing.T) {
+	ui, db := testUI(t)
+
+	post := func(username string, headers map[string]string) int {
+		t.Helper()
+		form := url.Values{
+			"action":   {"create"},
+			"username": {username},
+			"password": {"newpass"},
+		}
+		req := httptest.NewRequest(http.MethodPost, Prefix+"accounts", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin@example.org", "adminpass")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		ui.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	exists := func(username string) bool {
+		users, err := db.ListUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range users {
+			if u == username {
+				return true
+			}
+		}
+		return false
+	}
+
+	if code := post("evil1@example.org", map[string]string{"Origin": "http://evil.example.com"}); code != http.StatusForbidden {
+		t.Error("Cross-origin request not rejected, status:", code)
+	}
+	if code := post("evil2@example.org", map[string]string{"Referer": "http://evil.example.com/page"}); code != http.StatusForbidden {
+		t.Error("Cross-origin request (Referer) not rejected, status:", code)
+	}
+	if code := post("evil3@example.org", nil); code != http.StatusForbidden {
+		t.Error("Request without Origin not rejected, status:", code)
+	}
+	for _, u := range []string{"evil1@example.org", "evil2@example.org", "evil3@example.org"} {
+		if exists(u) {
+			t.Error("Account created by rejected request:", u)
+		}
+	}
+
+	// httptest.NewRequest uses example.com as the Host.
+	if code := post("new@example.org", map[string]string{"Origin": "http://example.com"}); code != http.StatusSeeOther {
+		t.Error("Same-origin request failed, status:", code)
+	}
+	if !exists("new@example.org") {
+		t.Error("Account is not created by same-origin request")
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminui
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/rejectstats"
+)
+
+const (
+	// maxRejections is the amount of recent rejections kept in memory.
+	maxRejections = 200
+
+	// maxDomains is the upper limit on the amount of sender domains
+	// statistics are kept for. Least active domains are evicted first.
+	maxDomains = 1000
+
+	// maxPending is the upper limit on the amount of in-flight messages
+	// tracked to attribute later events to the sender domain.
+	maxPending = 10000
+)
+
+type rejection struct {
+	Time       time.Time
+	Stage      string
+	Sender     string
+	Rcpt       string
+	MsgID      string
+	Code       string
+	Message    string
+	Check      string
+	Reason     string
+	Quarantine bool
+}
+
+type domainStats struct {
+	Domain   string
+	Incoming int
+	Accepted int
+	Rejected int
+	Aborted  int
+}
+
+// tracker collects rejection and per-domain statistics.
+//
+// Rejections are received from the rejectstats package, message arrival and
+// completion events and quarantines are taken from the log stream.
+//
+// Statistics are kept only in memory and are reset on restart.
+type tracker struct {
+	sub *log.Subscription
+
+	lock       sync.Mutex
+	rejections []rejection
+	domains    map[string]*domainStats
+	// msg_id -> sender domain, used to attribute later events
+	// to the sender domain.
+	pending map[string]string
+}
+
+func newTracker() *tracker {
+	t := &tracker{
+		sub:     log.Subscribe(256),
+		domains: map[string]*domainStats{},
+		pending: map[string]string{},
+	}
+	rejectstats.Register(t)
+	go t.run()
+	return t
+}
+
+func (t *tracker) run() {
+	for ev := range t.sub.C {
+		t.handle(ev)
+	}
+}
+
+func (t *tracker) Close() {
+	rejectstats.Unregister(t)
+	log.Unsubscribe(t.sub)
+}
+
+// domain returns statistics for the sender domain, evicting the least active
+// domain if there are too many. lock should be held.
+func (t *tracker) domain(name string) *domainStats {
+	stats := t.domains[name]
+	if stats != nil {
+		return stats
+	}
+
+	if len(t.domains) >= maxDomains {
+		var evict *domainStats
+		for _, other := range t.domains {
+			if evict == nil || other.Incoming < evict.Incoming ||
+				(other.Incoming == evict.Incoming && other.Rejected < evict.Rejected) {
+				evict = other
+			}
+		}
+		delete(t.domains, evict.Domain)
+	}
+
+	stats = &domainStats{Domain: name}
+	t.domains[name] = stats
+	return stats
+}
+
+func (t *tracker) addRejection(rej rejection) {
+	t.rejections = append(t.rejections, rej)
+	if len(t.rejections) > maxRejections {
+		t.rejections = t.rejections[len(t.rejections)-maxRejections:]
+	}
+}
+
+func senderDomain(sender string) string {
+	if sender == "" {
+		return "<>"
+	}
+	_, domain, err := address.Split(sender)
+	if err != nil || domain == "" {
+		return "<invalid>"
+	}
+	return strings.ToLower(domain)
+}
+
+func (t *tracker) handle(ev log.Event) {
+	msgID, _ := ev.Fields["msg_id"].(string)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	switch ev.Message {
+	case "incoming message":
+		sender, _ := ev.Fields["sender"].(string)
+		domain := senderDomain(sender)
+		t.domain(domain).Incoming++
+		if msgID != "" && len(t.pending) < maxPending {
+			t.pending[msgID] = domain
+		}
+	case "accepted":
+		if domain, ok := t.pending[msgID]; ok {
+			t.domain(domain).Accepted++
+			delete(t.pending, msgID)
+		}
+	case "aborted":
+		if domain, ok := t.pending[msgID]; ok {
+			t.domain(domain).Aborted++
+			delete(t.pending, msgID)
+		}
+	case "MAIL FROM error", "MAIL FROM error (deferred)", "DATA error":
+		// Rejections themselves are counted in Add.
+		delete(t.pending, msgID)
+	case "quarantined":
+		rej := rejection{
+			Time:       ev.Stamp,
+			Stage:      ev.Message,
+			MsgID:      msgID,
+			Quarantine: true,
+		}
+		rej.Check, _ = ev.Fields["check"].(string)
+		rej.Reason, _ = ev.Fields["reason"].(string)
+		t.addRejection(rej)
+	}
+}
+
+// Add implements rejectstats.Collector.
+func (t *tracker) Add(r rejectstats.Rejection) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.domain(senderDomain(r.Sender)).Rejected++
+	t.addRejection(rejection{
+		Time:    r.Time,
+		Stage:   r.Command,
+		Sender:  r.Sender,
+		Rcpt:    r.Rcpt,
+		MsgID:   r.MsgID,
+		Code:    r.Code,
+		Message: r.Message,
+		Check:   r.Check,
+		Reason:  r.Reason,
+	})
+}
+
+// Rejections returns recent rejections, most recent first.
+func (t *tracker) Rejections() []rejection {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	res := make([]rejection, len(t.rejections))
+	for i, rej := range t.rejections {
+		res[len(res)-i-1] = rej
+	}
+	return res
+}
+
+// Domains returns statistics for each sender domain, sorted by the amount
+// of incoming messages.
+func (t *tracker) Domains() []domainStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	res := make([]domainStats, 0, len(t.domains))
+	for _, stats := range t.domains {
+		res = append(res, *stats)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Incoming != res[j].Incoming {
+			return res[i].Incoming > res[j].Incoming
+		}
+		return res[i].Domain < res[j].Domain
+	})
+	return res
+}
@@ -0,0 +1,110 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminui
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/internal/rejectstats"
+)
+
+func TestTracker(t *testing.T) {
+	tr := &tracker{
+		domains: map[string]*domainStats{},
+		pending: map[string]string{},
+	}
+
+	ev := func(msg string, fields map[string]interface{}) {
+		tr.handle(log.Event{Stamp: time.Now(), Module: "smtp", Message: msg, Fields: fields})
+	}
+
+	ev("incoming message", map[string]interface{}{"msg_id": "1", "sender": "a@Example.org"})
+	ev("accepted", map[string]interface{}{"msg_id": "1"})
+
+	ev("incoming message", map[string]interface{}{"msg_id": "2", "sender": "b@example.org"})
+	tr.Add(rejectstats.Rejection{
+		Command: "RCPT",
+		MsgID:   "2",
+		Sender:  "b@example.org",
+		Rcpt:    "c@example.com",
+		Code:    "550 5.7.1",
+		Message: "Client identity is listed",
+		Check:   "dnsbl",
+		Reason:  "listed",
+	})
+	ev("aborted", map[string]interface{}{"msg_id": "2"})
+
+	ev("incoming message", map[string]interface{}{"msg_id": "3", "sender": ""})
+	tr.Add(rejectstats.Rejection{Command: "DATA", MsgID: "3", Code: "554 5.6.0"})
+	ev("DATA error", map[string]interface{}{"msg_id": "3", "smtp_code": float64(554)})
+
+	domains := tr.Domains()
+	expected := []domainStats{
+		{Domain: "example.org", Incoming: 2, Accepted: 1, Rejected: 1, Aborted: 1},
+		{Domain: "<>", Incoming: 1, Rejected: 1},
+	}
+	if !reflect.DeepEqual(domains, expected) {
+		t.Errorf("wrong domain stats:\n%+v\nexpected:\n%+v", domains, expected)
+	}
+
+	rejections := tr.Rejections()
+	if len(rejections) != 2 {
+		t.Fatalf("expected 2 rejections, got %d", len(rejections))
+	}
+	if rejections[0].Stage != "DATA" || rejections[0].Code != "554 5.6.0" {
+		t.Errorf("wrong most recent rejection: %+v", rejections[0])
+	}
+	if rejections[1].Check != "dnsbl" || rejections[1].Rcpt != "c@example.com" || rejections[1].Reason != "listed" ||
+		rejections[1].Message != "Client identity is listed" {
+		t.Errorf("wrong rejection: %+v", rejections[1])
+	}
+	if len(tr.pending) != 0 {
+		t.Errorf("pending messages left: %v", tr.pending)
+	}
+}
+
+func TestTracker_DomainsLimit(t *testing.T) {
+	tr := &tracker{
+		domains: map[string]*domainStats{},
+		pending: map[string]string{},
+	}
+
+	for i := 0; i < 3; i++ {
+		tr.handle(log.Event{Message: "incoming message", Fields: map[string]interface{}{
+			"msg_id": strconv.Itoa(i), "sender": "a@example.org",
+		}})
+	}
+	for i := 0; i < maxDomains+10; i++ {
+		tr.handle(log.Event{Message: "incoming message", Fields: map[string]interface{}{
+			"sender": "a@" + strconv.Itoa(i) + ".example.com",
+		}})
+	}
+
+	domains := tr.Domains()
+	if len(domains) != maxDomains {
+		t.Fatalf("expected %d domains, got %d", maxDomains, len(domains))
+	}
+	if domains[0].Domain != "example.org" || domains[0].Incoming != 3 {
+		t.Errorf("most active domain is evicted: %+v", domains[0])
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminui
+
+const templates = `
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}} - maddy</title>
+<style>
+body { font-family: sans-serif; margin: 0 2em 2em 2em; }
+nav { padding: 1em 0; border-bottom: 1px solid #ccc; margin-bottom: 1em; }
+nav a { margin-right: 1em; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #eee; vertical-align: top; }
+.error { color: #b00; }
+form.inline { display: inline; }
+</style>
+</head>
+<body>
+<nav>
+{{if .SelfService}}
+{{if .Senders}}<a href="/admin/senders">Sender lists</a>{{end}}
+{{if .AppPasswords}}<a href="/admin/app-passwords">App passwords</a>{{end}}
+{{else}}
+<a href="/admin/">Overview</a>
+<a href="/admin/queue">Queue</a>
+<a href="/admin/rejections">Rejections</a>
+<a href="/admin/domains">Domains</a>
+<a href="/admin/certs">Certificates</a>
+{{if .Accounts}}<a href="/admin/accounts">Accounts</a>{{end}}
+{{if .Aliases}}<a href="/admin/aliases">Aliases</a>{{end}}
+{{if .Senders}}<a href="/admin/senders">Sender lists</a>{{end}}
+{{if .AppPasswords}}<a href="/admin/app-passwords">App passwords</a>{{end}}
+{{end}}</nav>
+<h1>{{.Title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{end}}
+
+{{define "footer"}}
+</body>
+</html>
+{{end}}
+
+{{define "rejectionsTable"}}
+<table>
+<tr><th>Time</th><th>Stage</th><th>Code</th><th>Reply</th><th>Check</th><th>Recipient</th><th>Reason</th><th>Message ID</th></tr>
+{{range .}}
+<tr>
+<td>{{fmtTime .Time}}</td>
+<td>{{.Stage}}</td>
+<td>{{if .Code}}{{.Code}}{{end}}</td>
+<td>{{.Message}}</td>
+<td>{{.Check}}</td>
+<td>{{.Rcpt}}</td>
+<td>{{.Reason}}</td>
+<td>{{.MsgID}}</td>
+</tr>
+{{else}}
+<tr><td colspan="8">No rejections since the server start.</td></tr>
+{{end}}
+</table>
+{{end}}
+
+{{define "domainsTable"}}
+<table>
+<tr><th>Sender domain</th><th>Incoming</th><th>Accepted</th><th>Rejected</th><th>Aborted</th></tr>
+{{range .}}
+<tr><td>{{.Domain}}</td><td>{{.Incoming}}</td><td>{{.Accepted}}</td><td>{{.Rejected}}</td><td>{{.Aborted}}</td></tr>
+{{else}}
+<tr><td colspan="5">No messages received since the server start.</td></tr>
+{{end}}
+</table>
+{{end}}
+
+{{define "index"}}{{template "header" .}}
+<p>Messages in queue: <a href="/admin/queue">{{.Data.Queued}}</a></p>
+<h2>Recent rejections</h2>
+{{template "rejectionsTable" .Data.Rejections}}
+<h2>Top sender domains</h2>
+{{template "domainsTable" .Data.Domains}}
+{{template "footer"}}{{end}}
+
+{{define "queue"}}{{template "header" .}}
+<table>
+<tr><th>ID</th><th>From</th><th>To</th><th>Tries</th><th>First attempt</th><th>Last attempt</th><th>Last errors</th></tr>
+{{range .Data}}
+<tr>
+<td>{{.ID}}</td>
+<td>{{.From}}</td>
+<td>{{join .To ", "}}</td>
+<td>{{.Tries}}</td>
+<td>{{fmtTime .FirstAttempt}}</td>
+<td>{{fmtTime .LastAttempt}}</td>
+<td>{{range .Errors}}{{.}}<br>{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan="7">Queue is empty.</td></tr>
+{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "rejections"}}{{template "header" .}}
+{{template "rejectionsTable" .Data}}
+{{template "footer"}}{{end}}
+
+{{define "domains"}}{{template "header" .}}
+{{template "domainsTable" .Data}}
+{{template "footer"}}{{end}}
+
+{{define "certs"}}{{template "header" .}}
+<table>
+<tr><th>Names</th><th>Issuer</th><th>Valid from</th><th>Valid until</th><th>Status</th></tr>
+{{range .Data}}
+<tr>
+<td>{{join .Names ", "}}</td>
+<td>{{.Issuer}}</td>
+<td>{{fmtTime .NotBefore}}</td>
+<td>{{fmtTime .NotAfter}}</td>
+<td>{{.Status}}</td>
+</tr>
+{{end}}
+</table>
+{{template "footer"}}{{end}}
+
+{{define "accounts"}}{{template "header" .}}
+<table>
+<tr><th>Username</th><th>Actions</th></tr>
+{{range .Data}}
+<tr>
+<td>{{.}}</td>
+<td>
+<form class="inline" method="post">
+<input type="hidden" name="action" value="password">
+<input type="hidden" name="username" value="{{.}}">
+<input type="password" name="password" placeholder="New password" required>
+<button type="submit">Change password</button>
+</form>
+<form class="inline" method="post">
+<input type="hidden" name="action" value="delete">
+<input type="hidden" name="username" value="{{.}}">
+<button type="submit">Delete</button>
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+<h2>Create account</h2>
+<form method="post">
+<input type="hidden" name="action" value="create">
+<input type="text" name="username" placeholder="Username" required>
+<input type="password" name="password" placeholder="Password" required>
+<button type="submit">Create</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "aliases"}}{{template "header" .}}
+<table>
+<tr><th>Alias</th><th>Target</th>{{if .Data.Lifecycle}}<th>Expires</th><th>Uses</th>{{end}}<th>Actions</th></tr>
+{{range .Data.Aliases}}
+<tr>
+<td>{{.Key}}</td>
+<td>{{.Value}}</td>
+{{if $.Data.Lifecycle}}<td>{{.Expires}}</td><td>{{.Uses}}</td>{{end}}
+<td>
+<form class="inline" method="post">
+<input type="hidden" name="action" value="delete">
+<input type="hidden" name="key" value="{{.Key}}">
+<button type="submit">Delete</button>
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+<h2>Add or change alias</h2>
+<form method="post">
+<input type="hidden" name="action" value="set">
+<input type="text" name="key" placeholder="Alias" required>
+<input type="text" name="value" placeholder="Target address" required>
+{{if .Data.Lifecycle}}<input type="text" name="lifetime" placeholder="Lifetime (e.g. 72h)">
+<input type="number" name="max_uses" min="0" placeholder="Max uses">{{end}}
+<button type="submit">Save</button>
+</form>
+{{template "footer"}}{{end}}
+{{define "senders"}}{{template "header" .}}
+<form method="get">
+{{if .Data.Admin}}<input type="text" name="rcpt" value="{{.Data.Rcpt}}" placeholder="Address">
+{{else}}<select name="rcpt">
+{{range .Data.Addresses}}<option value="{{.}}"{{if eq . $.Data.Rcpt}} selected{{end}}>{{.}}</option>
+{{end}}</select>
+{{end}}<button type="submit">Show</button>
+</form>
+<table>
+<tr><th>Sender or domain</th><th>List</th><th>Actions</th></tr>
+{{range .Data.Entries}}
+<tr>
+<td>{{.Sender}}</td>
+<td>{{.Action}}</td>
+<td>
+<form class="inline" method="post">
+<input type="hidden" name="rcpt" value="{{$.Data.Rcpt}}">
+<input type="hidden" name="action" value="delete">
+<input type="hidden" name="sender" value="{{.Sender}}">
+<button type="submit">Delete</button>
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+<h2>Add or change entry</h2>
+<form method="post">
+<input type="hidden" name="rcpt" value="{{.Data.Rcpt}}">
+<input type="hidden" name="action" value="set">
+<input type="text" name="sender" placeholder="Address or domain" required>
+<select name="list">
+<option value="block">Block</option>
+<option value="allow">Allow</option>
+</select>
+<button type="submit">Save</button>
+</form>
+{{template "footer"}}{{end}}
+
+{{define "appPasswords"}}{{template "header" .}}
+{{if .Data.Admin}}<form method="get">
+<input type="text" name="username" value="{{.Data.Username}}" placeholder="Username">
+<button type="submit">Show</button>
+</form>
+{{end}}{{if .Data.NewPassword}}<p>New password: <code>{{.Data.NewPassword}}</code><br>
+Enter it in the mail client now, it will not be shown again.</p>
+{{end}}<table>
+<tr><th>ID</th><th>Name</th><th>Protocols</th><th>Created</th><th>Actions</th></tr>
+{{range .Data.Passwords}}
+<tr>
+<td>{{.ID}}</td>
+<td>{{.Name}}</td>
+<td>{{join .Scopes ", "}}</td>
+<td>{{fmtTime .Created}}</td>
+<td>
+<form class="inline" method="post">
+<input type="hidden" name="username" value="{{$.Data.Username}}">
+<input type="hidden" name="action" value="delete">
+<input type="hidden" name="id" value="{{.ID}}">
+<button type="submit">Revoke</button>
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+<h2>Create password</h2>
+<form method="post">
+<input type="hidden" name="username" value="{{.Data.Username}}">
+<input type="hidden" name="action" value="create">
+<input type="text" name="name" placeholder="Name (e.g. phone)">
+<input type="text" name="protocols" value="imap submission" placeholder="Protocols" required>
+<button type="submit">Create</button>
+</form>
+{{template "footer"}}{{end}}
+`
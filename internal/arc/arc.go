@@ -0,0 +1,576 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package arc implements validation of the Authenticated Received Chain
+// (RFC 8617).
+//
+// ARC sets are made of ARC-Authentication-Results, ARC-Message-Signature and
+// ARC-Seal header fields with the same instance number. Intermediaries that
+// modify messages (mailing lists, forwarders) add a new set so the receiver
+// can see authentication results the message had before it was modified.
+package arc
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+const (
+	FieldAAR  = "ARC-Authentication-Results"
+	FieldAMS  = "ARC-Message-Signature"
+	FieldSeal = "ARC-Seal"
+
+	// MaxInstances is the maximum amount of ARC sets in the message
+	// (RFC 8617 Section 4.2.1).
+	MaxInstances = 50
+)
+
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Result is the result of the chain validation.
+type Result struct {
+	// Chain validation status (cv= value): none, pass or fail.
+	CV authres.ResultValue
+
+	// Domains of sealers (d= value of ARC-Seal) ordered by instance number.
+	// Set only if the chain is valid.
+	Sealers []string
+
+	// The reason of the failure. Not set for none and pass.
+	Err error
+}
+
+// LatestSealer returns the domain of the sealer that added the last ARC
+// set. Empty string is returned if the chain is not valid.
+func (r Result) LatestSealer() string {
+	if len(r.Sealers) == 0 {
+		return ""
+	}
+	return r.Sealers[len(r.Sealers)-1]
+}
+
+// Set is the set of ARC header fields with the same instance number.
+type Set struct {
+	Instance int
+
+	// Raw header fields, including field names and trailing CRLF.
+	AAR, AMS, Seal string
+
+	amsTags, sealTags map[string]string
+}
+
+func fail(format string, args ...interface{}) Result {
+	return Result{CV: authres.ResultFail, Err: fmt.Errorf(format, args...)}
+}
+
+// parseTags parses the DKIM tag-value list (RFC 6376 Section 3.2).
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed tag: %s", part)
+		}
+		key := strings.TrimSpace(kv[0])
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("duplicate tag: %s", key)
+		}
+		tags[key] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+func removeWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func fieldValue(raw string) string {
+	return raw[strings.IndexByte(raw, ':')+1:]
+}
+
+// aarInstance returns the instance number from the ARC-Authentication-Results
+// value, it is not a tag-list but starts with the i= tag.
+func aarInstance(raw string) (int, error) {
+	val := strings.TrimSpace(fieldValue(raw))
+	if semicolon := strings.IndexByte(val, ';'); semicolon != -1 {
+		val = val[:semicolon]
+	}
+	kv := strings.SplitN(val, "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) != "i" {
+		return 0, errors.New("missing instance number")
+	}
+	return strconv.Atoi(strings.TrimSpace(kv[1]))
+}
+
+func tagsInstance(tags map[string]string) (int, error) {
+	i, ok := tags["i"]
+	if !ok {
+		return 0, errors.New("missing instance number")
+	}
+	return strconv.Atoi(i)
+}
+
+// ExtractSets returns ARC sets found in the header, ordered by instance
+// number. An error is returned if the sets are incomplete, duplicated or not
+// numbered sequentially.
+func ExtractSets(header textproto.Header) ([]Set, error) {
+	sets := map[int]*Set{}
+	get := func(i int) (*Set, error) {
+		if i < 1 || i > MaxInstances {
+			return nil, fmt.Errorf("invalid instance number: %d", i)
+		}
+		set := sets[i]
+		if set == nil {
+			set = &Set{Instance: i}
+			sets[i] = set
+		}
+		return set, nil
+	}
+
+	fields := header.Fields()
+	for fields.Next() {
+		key := fields.Key()
+		if !strings.EqualFold(key, FieldAAR) && !strings.EqualFold(key, FieldAMS) && !strings.EqualFold(key, FieldSeal) {
+			continue
+		}
+
+		rawBytes, err := fields.Raw()
+		if err != nil {
+			return nil, err
+		}
+		raw := string(rawBytes)
+		if !strings.HasSuffix(raw, "\r\n") {
+			raw += "\r\n"
+		}
+
+		if strings.EqualFold(key, FieldAAR) {
+			i, err := aarInstance(raw)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", FieldAAR, err)
+			}
+			set, err := get(i)
+			if err != nil {
+				return nil, err
+			}
+			if set.AAR != "" {
+				return nil, fmt.Errorf("duplicate %s for instance %d", FieldAAR, i)
+			}
+			set.AAR = raw
+			continue
+		}
+
+		tags, err := parseTags(fieldValue(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		i, err := tagsInstance(tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		set, err := get(i)
+		if err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(key, FieldAMS) {
+			if set.AMS != "" {
+				return nil, fmt.Errorf("duplicate %s for instance %d", FieldAMS, i)
+			}
+			set.AMS, set.amsTags = raw, tags
+		} else {
+			if set.Seal != "" {
+				return nil, fmt.Errorf("duplicate %s for instance %d", FieldSeal, i)
+			}
+			set.Seal, set.sealTags = raw, tags
+		}
+	}
+
+	res := make([]Set, 0, len(sets))
+	for i := 1; i <= len(sets); i++ {
+		set, ok := sets[i]
+		if !ok {
+			return nil, fmt.Errorf("missing ARC set %d", i)
+		}
+		if set.AAR == "" || set.AMS == "" || set.Seal == "" {
+			return nil, fmt.Errorf("incomplete ARC set %d", i)
+		}
+		res = append(res, *set)
+	}
+	return res, nil
+}
+
+// Verify validates the ARC chain in the message as described in RFC 8617
+// Section 5.2.
+//
+// Only the ARC-Message-Signature of the last set is validated, as required by
+// the specification.
+func Verify(ctx context.Context, r Resolver, header textproto.Header, body io.Reader) Result {
+	sets, err := ExtractSets(header)
+	if err != nil {
+		return Result{CV: authres.ResultFail, Err: err}
+	}
+	if len(sets) == 0 {
+		return Result{CV: authres.ResultNone}
+	}
+
+	last := sets[len(sets)-1]
+	if last.sealTags["cv"] == "fail" {
+		return fail("chain is marked as failed by instance %d", last.Instance)
+	}
+
+	if err := verifyAMS(ctx, r, header, last, body); err != nil {
+		return fail("%s %d: %w", FieldAMS, last.Instance, err)
+	}
+
+	sealers := make([]string, len(sets))
+	for i := len(sets) - 1; i >= 0; i-- {
+		set := sets[i]
+
+		cv := set.sealTags["cv"]
+		if (set.Instance == 1 && cv != "none") || (set.Instance != 1 && cv != "pass") {
+			return fail("%s %d: unexpected cv=%s", FieldSeal, set.Instance, cv)
+		}
+		if err := verifySeal(ctx, r, sets[:i+1]); err != nil {
+			return fail("%s %d: %w", FieldSeal, set.Instance, err)
+		}
+		sealers[i] = strings.ToLower(set.sealTags["d"])
+	}
+
+	return Result{CV: authres.ResultPass, Sealers: sealers}
+}
+
+// sealInput returns the data signed by the ARC-Seal of the last set
+// (RFC 8617 Section 5.1.1).
+func sealInput(sets []Set) []byte {
+	var input strings.Builder
+	for i, set := range sets {
+		input.WriteString(canonHeaderRelaxed(set.AAR))
+		input.WriteString(canonHeaderRelaxed(set.AMS))
+		if i == len(sets)-1 {
+			input.WriteString(strings.TrimSuffix(canonHeaderRelaxed(removeSignature(set.Seal)), "\r\n"))
+		} else {
+			input.WriteString(canonHeaderRelaxed(set.Seal))
+		}
+	}
+	return []byte(input.String())
+}
+
+func verifySeal(ctx context.Context, r Resolver, sets []Set) error {
+	tags := sets[len(sets)-1].sealTags
+	if _, ok := tags["h"]; ok {
+		return errors.New("h= tag is not allowed")
+	}
+	return verifySignature(ctx, r, tags, sealInput(sets))
+}
+
+// amsInput returns the data signed by ARC-Message-Signature. headerCanon is
+// the header canonicalization algorithm name.
+func amsInput(header textproto.Header, ams string, headerNames []string, headerCanon string) []byte {
+	canon := canonHeaderSimple
+	if headerCanon == "relaxed" {
+		canon = canonHeaderRelaxed
+	}
+
+	var input strings.Builder
+	used := map[string]int{}
+	for _, name := range headerNames {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		// Fields are selected from the bottom of the header, as in DKIM.
+		raws := rawFields(header, name)
+		n := len(raws) - 1 - used[name]
+		used[name]++
+		if n < 0 {
+			continue
+		}
+		input.WriteString(canon(raws[n]))
+	}
+	input.WriteString(strings.TrimSuffix(canon(removeSignature(ams)), "\r\n"))
+	return []byte(input.String())
+}
+
+func rawFields(header textproto.Header, name string) []string {
+	var res []string
+	fields := header.FieldsByKey(name)
+	for fields.Next() {
+		raw, err := fields.Raw()
+		if err != nil {
+			continue
+		}
+		s := string(raw)
+		if !strings.HasSuffix(s, "\r\n") {
+			s += "\r\n"
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+func parseCanon(c string) (header, body string, err error) {
+	if c == "" {
+		return "simple", "simple", nil
+	}
+	parts := strings.SplitN(c, "/", 2)
+	header, body = parts[0], "simple"
+	if len(parts) == 2 {
+		body = parts[1]
+	}
+	for _, algo := range []string{header, body} {
+		if algo != "simple" && algo != "relaxed" {
+			return "", "", fmt.Errorf("unsupported canonicalization: %s", c)
+		}
+	}
+	return header, body, nil
+}
+
+func verifyAMS(ctx context.Context, r Resolver, header textproto.Header, set Set, body io.Reader) error {
+	tags := set.amsTags
+	headerCanon, bodyCanon, err := parseCanon(tags["c"])
+	if err != nil {
+		return err
+	}
+
+	bodyHash, err := BodyHash(body, bodyCanon == "relaxed")
+	if err != nil {
+		return err
+	}
+	if base64.StdEncoding.EncodeToString(bodyHash) != removeWSP(tags["bh"]) {
+		return errors.New("body hash mismatch")
+	}
+
+	h, ok := tags["h"]
+	if !ok {
+		return errors.New("missing h= tag")
+	}
+	headerNames := strings.Split(h, ":")
+	for _, name := range headerNames {
+		if strings.EqualFold(strings.TrimSpace(name), FieldSeal) {
+			return errors.New("h= includes " + FieldSeal)
+		}
+	}
+
+	return verifySignature(ctx, r, tags, amsInput(header, set.AMS, headerNames, headerCanon))
+}
+
+// verifySignature checks the b= signature in the tags against the data using
+// the public key published by the signer.
+func verifySignature(ctx context.Context, r Resolver, tags map[string]string, data []byte) error {
+	domain, selector := tags["d"], tags["s"]
+	if domain == "" || selector == "" {
+		return errors.New("missing d= or s= tag")
+	}
+	sig, err := base64.StdEncoding.DecodeString(removeWSP(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+
+	key, err := lookupKey(ctx, r, domain, selector)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(data)
+	switch tags["a"] {
+	case "rsa-sha256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, hash[:], sig); err != nil {
+			return errors.New("signature verification failed")
+		}
+	case "ed25519-sha256":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		if !ed25519.Verify(edKey, hash[:], sig) {
+			return errors.New("signature verification failed")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", tags["a"])
+	}
+	return nil
+}
+
+// lookupKey fetches the public key from the DKIM key record.
+func lookupKey(ctx context.Context, r Resolver, domain, selector string) (crypto.PublicKey, error) {
+	txts, err := r.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, fmt.Errorf("key lookup failed: %w", err)
+	}
+	if len(txts) == 0 {
+		return nil, errors.New("no key record")
+	}
+
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed key record: %w", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, errors.New("malformed key record: unknown version")
+	}
+	p := removeWSP(tags["p"])
+	if p == "" {
+		return nil, errors.New("key is revoked")
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("malformed key record: %w", err)
+	}
+
+	switch k := tags["k"]; k {
+	case "", "rsa":
+		key, err := x509.ParsePKIXPublicKey(keyBytes)
+		if err != nil {
+			key, err = x509.ParsePKCS1PublicKey(keyBytes)
+			if err != nil {
+				return nil, fmt.Errorf("malformed key record: %w", err)
+			}
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("malformed key record: not an RSA key")
+		}
+		if rsaKey.Size()*8 < 1024 {
+			return nil, errors.New("RSA key is too short")
+		}
+		return rsaKey, nil
+	case "ed25519":
+		if len(keyBytes) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed key record: wrong Ed25519 key size")
+		}
+		return ed25519.PublicKey(keyBytes), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", k)
+	}
+}
+
+// removeSignature clears the b= tag value in the raw header field.
+func removeSignature(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	parts := strings.Split(raw[colon+1:], ";")
+	for i, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == "b" {
+			parts[i] = kv[0] + "="
+			if strings.HasSuffix(part, "\r\n") {
+				parts[i] += "\r\n"
+			}
+		}
+	}
+	return raw[:colon+1] + strings.Join(parts, ";")
+}
+
+func canonHeaderSimple(raw string) string {
+	return raw
+}
+
+// canonHeaderRelaxed implements the "relaxed" header canonicalization
+// (RFC 6376 Section 3.4.2).
+func canonHeaderRelaxed(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	name := strings.ToLower(strings.TrimRight(raw[:colon], " \t"))
+	value := strings.ReplaceAll(raw[colon+1:], "\r\n", "")
+	return name + ":" + strings.TrimSpace(collapseWSP(value)) + "\r\n"
+}
+
+func collapseWSP(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			b.WriteByte(' ')
+			inWSP = false
+		}
+		b.WriteByte(s[i])
+	}
+	if inWSP {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// BodyHash returns the SHA-256 hash of the canonicalized message body
+// (RFC 6376 Section 3.4.3, 3.4.4).
+func BodyHash(body io.Reader, relaxed bool) ([]byte, error) {
+	h := sha256.New()
+	br := bufio.NewReader(body)
+	emptyLines := 0
+	nonEmpty := false
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) != 0 {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if relaxed {
+				line = strings.TrimRight(collapseWSP(line), " ")
+			}
+			if line == "" {
+				emptyLines++
+			} else {
+				for ; emptyLines > 0; emptyLines-- {
+					io.WriteString(h, "\r\n")
+				}
+				io.WriteString(h, line+"\r\n")
+				nonEmpty = true
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !nonEmpty && !relaxed {
+		io.WriteString(h, "\r\n")
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,175 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+)
+
+const testBody = "Hello!  \r\n\r\n"
+
+// seal adds the ARC set to the header.
+func seal(t *testing.T, hdr *textproto.Header, body, domain string, key ed25519.PrivateKey) {
+	t.Helper()
+
+	sets, err := ExtractSets(*hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := len(sets) + 1
+	cv := "none"
+	if i > 1 {
+		cv = "pass"
+	}
+	sign := func(data []byte) string {
+		hash := sha256.Sum256(data)
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(key, hash[:]))
+	}
+
+	aar := fmt.Sprintf("%s: i=%d; %s; spf=pass smtp.mailfrom=example.org\r\n", FieldAAR, i, domain)
+
+	bh, err := BodyHash(strings.NewReader(body), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ams := fmt.Sprintf("%s: i=%d; a=ed25519-sha256; c=relaxed/relaxed; d=%s; s=sel;\r\n"+
+		" h=From:Subject; bh=%s; b=\r\n", FieldAMS, i, domain, base64.StdEncoding.EncodeToString(bh))
+	ams = strings.TrimSuffix(ams, "\r\n") + sign(amsInput(*hdr, ams, []string{"From", "Subject"}, "relaxed")) + "\r\n"
+
+	as := fmt.Sprintf("%s: i=%d; a=ed25519-sha256; cv=%s; d=%s; s=sel; b=\r\n", FieldSeal, i, cv, domain)
+	as = strings.TrimSuffix(as, "\r\n") + sign(sealInput(append(sets, Set{AAR: aar, AMS: ams, Seal: as}))) + "\r\n"
+
+	hdr.AddRaw([]byte(aar))
+	hdr.AddRaw([]byte(ams))
+	hdr.AddRaw([]byte(as))
+}
+
+func testKey(t *testing.T) (ed25519.PrivateKey, string) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+func testHeader() textproto.Header {
+	hdr := textproto.Header{}
+	hdr.AddRaw([]byte("Subject: Test\r\n"))
+	hdr.AddRaw([]byte("From: <foo@example.org>\r\n"))
+	return hdr
+}
+
+func TestVerify(t *testing.T) {
+	listKey, listRecord := testKey(t)
+	fwdKey, fwdRecord := testKey(t)
+	r := &mockdns.Resolver{
+		Zones: map[string]mockdns.Zone{
+			"sel._domainkey.lists.example.com.": {TXT: []string{listRecord}},
+			"sel._domainkey.forwarder.example.": {TXT: []string{fwdRecord}},
+		},
+	}
+
+	verify := func(hdr textproto.Header, body string) Result {
+		return Verify(context.Background(), r, hdr, strings.NewReader(body))
+	}
+
+	hdr := testHeader()
+	if res := verify(hdr, testBody); res.CV != authres.ResultNone {
+		t.Fatal("unexpected result for message without ARC:", res.CV, res.Err)
+	}
+
+	seal(t, &hdr, testBody, "lists.example.com", listKey)
+	res := verify(hdr, "Hello!\r\n")
+	if res.CV != authres.ResultPass {
+		t.Fatal("valid chain is not accepted:", res.Err)
+	}
+	if res.LatestSealer() != "lists.example.com" {
+		t.Fatal("wrong sealer:", res.Sealers)
+	}
+
+	if res := verify(hdr, "Modified\r\n"); res.CV != authres.ResultFail {
+		t.Fatal("modified body is accepted")
+	}
+
+	seal(t, &hdr, testBody, "forwarder.example", fwdKey)
+	res = verify(hdr, testBody)
+	if res.CV != authres.ResultPass {
+		t.Fatal("valid chain is not accepted:", res.Err)
+	}
+	if len(res.Sealers) != 2 || res.Sealers[0] != "lists.example.com" || res.Sealers[1] != "forwarder.example" {
+		t.Fatal("wrong sealers:", res.Sealers)
+	}
+
+	// Header fields covered by the last AMS.
+	modified := hdr.Copy()
+	modified.Set("Subject", "Modified")
+	if res := verify(modified, testBody); res.CV != authres.ResultFail {
+		t.Fatal("modified header is accepted")
+	}
+
+	// Seal signed using the wrong key.
+	forged := testHeader()
+	seal(t, &forged, testBody, "lists.example.com", fwdKey)
+	if res := verify(forged, testBody); res.CV != authres.ResultFail {
+		t.Fatal("forged seal is accepted")
+	}
+}
+
+func TestExtractSets(t *testing.T) {
+	hdr := textproto.Header{}
+	hdr.AddRaw([]byte(FieldAAR + ": i=2; example.org; none\r\n"))
+	hdr.AddRaw([]byte(FieldAMS + ": i=2; a=rsa-sha256; b=\r\n"))
+	hdr.AddRaw([]byte(FieldSeal + ": i=2; a=rsa-sha256; cv=pass; b=\r\n"))
+	if _, err := ExtractSets(hdr); err == nil {
+		t.Fatal("chain without instance 1 is accepted")
+	}
+
+	hdr = textproto.Header{}
+	hdr.AddRaw([]byte(FieldAAR + ": i=1; example.org; none\r\n"))
+	hdr.AddRaw([]byte(FieldSeal + ": i=1; a=rsa-sha256; cv=none; b=\r\n"))
+	if _, err := ExtractSets(hdr); err == nil {
+		t.Fatal("incomplete set is accepted")
+	}
+}
+
+func TestBodyHash(t *testing.T) {
+	// Examples from RFC 6376 Section 3.4.5.
+	simple, _ := BodyHash(strings.NewReader(" C \r\nD \t E\r\n\r\n\r\n"), false)
+	if want := sha256.Sum256([]byte(" C \r\nD \t E\r\n")); string(simple) != string(want[:]) {
+		t.Error("wrong simple body hash")
+	}
+	relaxed, _ := BodyHash(strings.NewReader(" C \r\nD \t E\r\n\r\n\r\n"), true)
+	if want := sha256.Sum256([]byte(" C\r\nD E\r\n")); string(relaxed) != string(want[:]) {
+		t.Error("wrong relaxed body hash")
+	}
+	empty, _ := BodyHash(strings.NewReader(""), false)
+	if want := sha256.Sum256([]byte("\r\n")); string(empty) != string(want[:]) {
+		t.Error("wrong simple hash for empty body")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+)
+
+// ErrChainFailed is returned by Seal if the chain was already marked as
+// failed. No new sets should be added in this case (RFC 8617 Section 5.1.2).
+var ErrChainFailed = errors.New("arc: chain is marked as failed")
+
+// SealOptions contains parameters for Seal.
+type SealOptions struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+
+	// AuthServID is the authentication service identifier used in the
+	// ARC-Authentication-Results field.
+	AuthServID string
+
+	// AuthResults is the list of authentication results (the part of the
+	// Authentication-Results field after authserv-id) recorded in the
+	// ARC-Authentication-Results field. "none" is used if empty.
+	AuthResults string
+
+	// HeaderKeys are names of header fields signed by ARC-Message-Signature.
+	HeaderKeys []string
+
+	// CV is the validation status of the existing chain. Ignored if the
+	// message has no ARC sets.
+	CV authres.ResultValue
+
+	// Timestamp is the signature timestamp, current time is used if zero.
+	Timestamp time.Time
+}
+
+func signatureAlgo(signer crypto.Signer) (string, crypto.Hash, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", crypto.SHA256, nil
+	case ed25519.PublicKey:
+		// Ed25519 signs the hash itself (RFC 8463).
+		return "ed25519-sha256", crypto.Hash(0), nil
+	default:
+		return "", 0, fmt.Errorf("arc: unsupported key type: %T", signer.Public())
+	}
+}
+
+func sign(signer crypto.Signer, opts crypto.Hash, data []byte) (string, error) {
+	hash := sha256.Sum256(data)
+	sig, err := signer.Sign(rand.Reader, hash[:], opts)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// Seal adds the new ARC set to the message header as described in RFC 8617
+// Section 5.1.
+//
+// The body is canonicalized using the relaxed algorithm.
+func Seal(header *textproto.Header, body io.Reader, opts SealOptions) error {
+	sets, err := ExtractSets(*header)
+	if err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+	if len(sets) >= MaxInstances {
+		return errors.New("arc: too many ARC sets")
+	}
+	if len(sets) != 0 && sets[len(sets)-1].sealTags["cv"] == "fail" {
+		return ErrChainFailed
+	}
+
+	algo, hashOpt, err := signatureAlgo(opts.Signer)
+	if err != nil {
+		return err
+	}
+
+	instance := len(sets) + 1
+	cv := "none"
+	if instance != 1 {
+		cv = "fail"
+		if opts.CV == authres.ResultPass {
+			cv = "pass"
+		}
+	}
+	ts := opts.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	t := strconv.FormatInt(ts.Unix(), 10)
+
+	authResults := strings.TrimSpace(opts.AuthResults)
+	if authResults == "" {
+		authResults = "none"
+	}
+	aar := fmt.Sprintf("%s: i=%d; %s; %s\r\n", FieldAAR, instance, opts.AuthServID, authResults)
+
+	bodyHash, err := BodyHash(body, true)
+	if err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+	ams := fmt.Sprintf("%s: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%s;\r\n"+
+		" h=%s;\r\n"+
+		" bh=%s;\r\n"+
+		" b=\r\n",
+		FieldAMS, instance, algo, opts.Domain, opts.Selector, t,
+		strings.Join(opts.HeaderKeys, ":"), base64.StdEncoding.EncodeToString(bodyHash))
+	sig, err := sign(opts.Signer, hashOpt, amsInput(*header, ams, opts.HeaderKeys, "relaxed"))
+	if err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+	ams = strings.TrimSuffix(ams, "\r\n") + sig + "\r\n"
+
+	seal := fmt.Sprintf("%s: i=%d; a=%s; t=%s; cv=%s; d=%s; s=%s;\r\n b=\r\n",
+		FieldSeal, instance, algo, t, cv, opts.Domain, opts.Selector)
+	sig, err = sign(opts.Signer, hashOpt, sealInput(append(sets, Set{AAR: aar, AMS: ams, Seal: seal})))
+	if err != nil {
+		return fmt.Errorf("arc: %w", err)
+	}
+	seal = strings.TrimSuffix(seal, "\r\n") + sig + "\r\n"
+
+	header.AddRaw([]byte(aar))
+	header.AddRaw([]byte(ams))
+	header.AddRaw([]byte(seal))
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+)
+
+func TestSeal(t *testing.T) {
+	edKey, edRecord := testKey(t)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &mockdns.Resolver{
+		Zones: map[string]mockdns.Zone{
+			"sel._domainkey.lists.example.com.": {TXT: []string{edRecord}},
+			"sel._domainkey.forwarder.example.": {TXT: []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)}},
+		},
+	}
+
+	hdr := testHeader()
+	err = Seal(&hdr, strings.NewReader(testBody), SealOptions{
+		Domain:      "lists.example.com",
+		Selector:    "sel",
+		Signer:      edKey,
+		AuthServID:  "lists.example.com",
+		AuthResults: "spf=pass smtp.mailfrom=example.org",
+		HeaderKeys:  []string{"From", "Subject"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := Verify(context.Background(), r, hdr, strings.NewReader(testBody))
+	if res.CV != authres.ResultPass {
+		t.Fatal("sealed message is not accepted:", res.Err)
+	}
+	if aar := hdr.Get(FieldAAR); aar != "i=1; lists.example.com; spf=pass smtp.mailfrom=example.org" {
+		t.Fatal("wrong", FieldAAR, aar)
+	}
+
+	err = Seal(&hdr, strings.NewReader(testBody), SealOptions{
+		Domain:     "forwarder.example",
+		Selector:   "sel",
+		Signer:     rsaKey,
+		AuthServID: "forwarder.example",
+		HeaderKeys: []string{"From", "Subject"},
+		CV:         res.CV,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = Verify(context.Background(), r, hdr, strings.NewReader(testBody))
+	if res.CV != authres.ResultPass {
+		t.Fatal("sealed message is not accepted:", res.Err)
+	}
+	if len(res.Sealers) != 2 || res.LatestSealer() != "forwarder.example" {
+		t.Fatal("wrong sealers:", res.Sealers)
+	}
+
+	// Chain that failed validation is sealed with cv=fail and can't be
+	// extended after that.
+	err = Seal(&hdr, strings.NewReader(testBody), SealOptions{
+		Domain:     "lists.example.com",
+		Selector:   "sel",
+		Signer:     edKey,
+		AuthServID: "lists.example.com",
+		HeaderKeys: []string{"From"},
+		CV:         authres.ResultFail,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := Verify(context.Background(), r, hdr, strings.NewReader(testBody)); res.CV != authres.ResultFail {
+		t.Fatal("chain with cv=fail is accepted")
+	}
+	err = Seal(&hdr, strings.NewReader(testBody), SealOptions{
+		Domain:     "lists.example.com",
+		Selector:   "sel",
+		Signer:     edKey,
+		AuthServID: "lists.example.com",
+		HeaderKeys: []string{"From"},
+		CV:         authres.ResultFail,
+	})
+	if !errors.Is(err, ErrChainFailed) {
+		t.Fatal("failed chain is extended:", err)
+	}
+}
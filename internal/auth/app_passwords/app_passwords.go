@@ -0,0 +1,291 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package app_passwords implements the auth.app_passwords module that
+// allows users to have randomly generated passwords restricted to specific
+// protocols, so the primary password does not have to be stored in mail
+// clients.
+//
+// Passwords are stored in the table as a JSON-encoded list per user.
+// Only the salted hash of each password is stored.
+package app_passwords
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/text/secure/precis"
+)
+
+const modName = "auth.app_passwords"
+
+var scopeRe = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+type entry struct {
+	module.AppPassword
+	Salt []byte `json:"salt"`
+	Hash []byte `json:"hash"`
+}
+
+func (e entry) allowed(protocol string) bool {
+	for _, scope := range e.Scopes {
+		if scope == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+type Auth struct {
+	instName string
+
+	auth      module.PlainAuth
+	passwords module.Table
+
+	// updateLock serializes read-modify-write updates of per-user lists.
+	updateLock sync.Mutex
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Auth{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		return modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &a.auth)
+	})
+	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.passwords)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *Auth) entries(username string) (string, []entry, error) {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return "", nil, err
+	}
+
+	val, ok, err := a.passwords.Lookup(context.TODO(), key)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: lookup: %w", modName, err)
+	}
+	if !ok {
+		return key, nil, nil
+	}
+
+	var entries []entry
+	if err := json.Unmarshal([]byte(val), &entries); err != nil {
+		return "", nil, fmt.Errorf("%s: malformed entry for %s: %w", modName, key, err)
+	}
+	return key, entries, nil
+}
+
+// AuthPlain checks the password using the underlying auth. provider.
+// Application-specific passwords are not accepted since the protocol is
+// not known.
+func (a *Auth) AuthPlain(username, password string) error {
+	if a.auth == nil {
+		return module.ErrUnknownCredentials
+	}
+	return a.auth.AuthPlain(username, password)
+}
+
+// AuthPlainProtocol accepts application-specific passwords that are
+// allowed for the protocol. Other passwords are checked using the
+// underlying auth. provider.
+func (a *Auth) AuthPlainProtocol(username, password, protocol string) error {
+	_, entries, err := a.entries(username)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !checkPassword(e.Salt, e.Hash, password) {
+			continue
+		}
+		if !e.allowed(protocol) {
+			a.log.DebugMsg("app password used for a disallowed protocol",
+				"username", username, "id", e.ID, "protocol", protocol)
+			return fmt.Errorf("%s: password %s is not allowed for %s", modName, e.ID, protocol)
+		}
+		return nil
+	}
+
+	if a.auth == nil {
+		return module.ErrUnknownCredentials
+	}
+	if pp, ok := a.auth.(module.ProtocolPlainAuth); ok {
+		return pp.AuthPlainProtocol(username, password, protocol)
+	}
+	return a.auth.AuthPlain(username, password)
+}
+
+// Lookup checks whether the account is known to the underlying auth.
+// provider, so the module can be used as a table in the same way.
+func (a *Auth) Lookup(ctx context.Context, username string) (string, bool, error) {
+	tbl, ok := a.auth.(module.Table)
+	if !ok {
+		return "", false, errors.New("app_passwords: underlying auth. provider does not support lookups")
+	}
+	return tbl.Lookup(ctx, username)
+}
+
+func (a *Auth) ListAppPasswords(username string) ([]module.AppPassword, error) {
+	_, entries, err := a.entries(username)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]module.AppPassword, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, e.AppPassword)
+	}
+	return res, nil
+}
+
+func (a *Auth) mutablePasswords() (module.MutableTable, error) {
+	tbl, ok := a.passwords.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("%s: table is not mutable, no management functionality available", modName)
+	}
+	return tbl, nil
+}
+
+func (a *Auth) store(tbl module.MutableTable, key string, entries []entry) error {
+	if len(entries) == 0 {
+		if err := tbl.RemoveKey(key); err != nil {
+			return fmt.Errorf("%s: update %s: %w", modName, key, err)
+		}
+		return nil
+	}
+
+	val, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := tbl.SetKey(key, string(val)); err != nil {
+		return fmt.Errorf("%s: update %s: %w", modName, key, err)
+	}
+	return nil
+}
+
+func (a *Auth) CreateAppPassword(username, name string, scopes []string) (module.AppPassword, string, error) {
+	tbl, err := a.mutablePasswords()
+	if err != nil {
+		return module.AppPassword{}, "", err
+	}
+	if len(scopes) == 0 {
+		return module.AppPassword{}, "", fmt.Errorf("%s: at least one protocol is required", modName)
+	}
+	normScopes := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !scopeRe.MatchString(scope) {
+			return module.AppPassword{}, "", fmt.Errorf("%s: invalid protocol name: %q", modName, scope)
+		}
+		normScopes = append(normScopes, scope)
+	}
+
+	a.updateLock.Lock()
+	defer a.updateLock.Unlock()
+
+	key, entries, err := a.entries(username)
+	if err != nil {
+		return module.AppPassword{}, "", err
+	}
+
+	password, err := GeneratePassword()
+	if err != nil {
+		return module.AppPassword{}, "", err
+	}
+	id, err := generateID()
+	if err != nil {
+		return module.AppPassword{}, "", err
+	}
+	salt, err := randomBytes(SaltSize)
+	if err != nil {
+		return module.AppPassword{}, "", err
+	}
+	e := entry{
+		AppPassword: module.AppPassword{
+			ID:      id,
+			Name:    name,
+			Scopes:  normScopes,
+			Created: time.Now().UTC().Truncate(time.Second),
+		},
+		Salt: salt,
+		Hash: hashPassword(salt, password),
+	}
+
+	if err := a.store(tbl, key, append(entries, e)); err != nil {
+		return module.AppPassword{}, "", err
+	}
+	return e.AppPassword, password, nil
+}
+
+func (a *Auth) RemoveAppPassword(username, id string) error {
+	tbl, err := a.mutablePasswords()
+	if err != nil {
+		return err
+	}
+
+	a.updateLock.Lock()
+	defer a.updateLock.Unlock()
+
+	key, entries, err := a.entries(username)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if e.ID == id {
+			return a.store(tbl, key, append(entries[:i], entries[i+1:]...))
+		}
+	}
+	return fmt.Errorf("%s: no password with ID %s for %s", modName, id, key)
+}
+
+func init() {
+	module.Register(modName, New)
+}
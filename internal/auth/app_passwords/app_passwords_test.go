@@ -0,0 +1,174 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package app_passwords
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module/moduletest"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	password, err := GeneratePassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(password) != 39 || strings.Count(password, "-") != 7 {
+		t.Error("Wrong password format:", password)
+	}
+	if password != strings.ToLower(password) {
+		t.Error("Password is not lower-case:", password)
+	}
+
+	salt := []byte("salt")
+	hash := hashPassword(salt, password)
+	for _, variant := range []string{
+		password,
+		strings.ReplaceAll(password, "-", ""),
+		strings.ToUpper(strings.ReplaceAll(password, "-", " ")),
+	} {
+		if !checkPassword(salt, hash, variant) {
+			t.Error("Password not accepted:", variant)
+		}
+	}
+	if checkPassword(salt, hash, password[1:]) {
+		t.Error("Truncated password accepted")
+	}
+}
+
+type mutableTable struct {
+	moduletest.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.M))
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func TestAuth(t *testing.T) {
+	passwords := mutableTable{moduletest.Table{M: map[string]string{}}}
+	underlying := &moduletest.Auth{}
+	if err := underlying.CreateUser("user1", "password1"); err != nil {
+		t.Fatal(err)
+	}
+	a := &Auth{
+		auth:      underlying,
+		passwords: passwords,
+	}
+
+	info, imapPass, err := a.CreateAppPassword("User1", "phone", []string{"IMAP"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ID == "" || info.Name != "phone" || len(info.Scopes) != 1 || info.Scopes[0] != "imap" {
+		t.Error("Wrong password info:", info)
+	}
+	_, bothPass, err := a.CreateAppPassword("user1", "", []string{"imap", "submission"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.CreateAppPassword("user1", "", nil); err == nil {
+		t.Error("Password without protocols created")
+	}
+	if _, _, err := a.CreateAppPassword("user1", "", []string{"imap smtp"}); err == nil {
+		t.Error("Password with malformed protocol name created")
+	}
+	if strings.Contains(passwords.M["user1"], imapPass) {
+		t.Error("Password is stored in plain text")
+	}
+
+	check := func(password, protocol string, ok bool) {
+		t.Helper()
+		var err error
+		if protocol == "" {
+			err = a.AuthPlain("user1", password)
+		} else {
+			err = a.AuthPlainProtocol("user1", password, protocol)
+		}
+		if (err == nil) != ok {
+			t.Errorf("%s %s: ok=%v, err: %v", password, protocol, ok, err)
+		}
+	}
+
+	check(imapPass, "imap", true)
+	check(imapPass, "submission", false)
+	check(imapPass, "", false)
+	check(bothPass, "imap", true)
+	check(bothPass, "submission", true)
+	check(bothPass, "smtp", false)
+	check("password1", "submission", true)
+	check("password1", "", true)
+	check("password2", "imap", false)
+
+	list, err := a.ListAppPasswords("user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != info.ID {
+		t.Fatal("Wrong passwords list:", list)
+	}
+
+	if err := a.RemoveAppPassword("user1", info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RemoveAppPassword("user1", info.ID); err == nil {
+		t.Error("Password removed twice")
+	}
+	check(imapPass, "imap", false)
+	check(bothPass, "imap", true)
+
+	if err := a.RemoveAppPassword("user1", list[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := passwords.M["user1"]; ok {
+		t.Error("Empty list is not removed from the table")
+	}
+}
+
+func TestAuth_NoFallback(t *testing.T) {
+	a := &Auth{passwords: mutableTable{moduletest.Table{M: map[string]string{}}}}
+
+	_, password, err := a.CreateAppPassword("user1", "", []string{"imap"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthPlainProtocol("user1", password, "imap"); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := a.AuthPlainProtocol("user1", "password1", "imap"); err == nil {
+		t.Error("No error for unknown password")
+	}
+	if err := a.AuthPlain("user1", password); err == nil {
+		t.Error("No error for password without protocol")
+	}
+}
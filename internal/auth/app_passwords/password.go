@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package app_passwords
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// PasswordSize is the amount of random bytes in the generated password.
+	PasswordSize = 20
+	// SaltSize is the size of the salt used to hash passwords.
+	SaltSize = 16
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, fmt.Errorf("%s: failed to read random data: %w", modName, err)
+	}
+	return b, nil
+}
+
+// GeneratePassword returns a new random password. It is encoded using
+// lower-case base32 alphabet and split into groups of 4 characters to make
+// it easier to type in.
+func GeneratePassword() (string, error) {
+	b, err := randomBytes(PasswordSize)
+	if err != nil {
+		return "", err
+	}
+	encoded := strings.ToLower(b32.EncodeToString(b))
+
+	var sb strings.Builder
+	for i := 0; i < len(encoded); i += 4 {
+		if i != 0 {
+			sb.WriteByte('-')
+		}
+		end := i + 4
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		sb.WriteString(encoded[i:end])
+	}
+	return sb.String(), nil
+}
+
+func generateID() (string, error) {
+	b, err := randomBytes(6)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// normalizePassword removes group separators and whitespace and folds the
+// case so the password can be typed in as is or without dashes.
+func normalizePassword(password string) string {
+	return strings.ToLower(strings.Map(func(r rune) rune {
+		switch r {
+		case '-', ' ':
+			return -1
+		}
+		return r
+	}, password))
+}
+
+// hashPassword computes the salted SHA-256 hash of the password.
+//
+// Generated passwords have enough entropy to make a slow KDF unnecessary.
+func hashPassword(salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(normalizePassword(password)))
+	return h.Sum(nil)
+}
+
+func checkPassword(salt, hash []byte, password string) bool {
+	return subtle.ConstantTimeCompare(hashPassword(salt, password), hash) == 1
+}
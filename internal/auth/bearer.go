@@ -0,0 +1,203 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// XOAuth2 is the name of the Google XOAUTH2 SASL mechanism.
+// https://developers.google.com/gmail/imap/xoauth2-protocol
+const XOAuth2 = "XOAUTH2"
+
+var errMalformedBearer = errors.New("auth: malformed bearer token response")
+
+// bearerServer implements server side of the OAUTHBEARER (RFC 7628) and
+// XOAUTH2 mechanisms.
+//
+// go-sasl provides an OAUTHBEARER server, but it requires the authorization
+// identity to be present and does not handle empty responses sent by the
+// client after the error challenge.
+type bearerServer struct {
+	mech         string
+	authenticate func(username, token string) error
+
+	done    bool
+	failErr error
+}
+
+func newBearerServer(mech string, authenticate func(username, token string) error) sasl.Server {
+	return &bearerServer{mech: mech, authenticate: authenticate}
+}
+
+func (s *bearerServer) Next(response []byte) ([]byte, bool, error) {
+	// After the error challenge, the client is expected to send a dummy
+	// response (0x01 for OAUTHBEARER, empty string for XOAUTH2) and then the
+	// exchange fails.
+	if s.failErr != nil {
+		return nil, true, s.failErr
+	}
+	if s.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	s.done = true
+
+	var (
+		username, token string
+		err             error
+	)
+	if s.mech == XOAuth2 {
+		username, token, err = parseXOAuth2(response)
+	} else {
+		username, token, err = parseOAuthBearer(response)
+	}
+	if err != nil {
+		return nil, true, err
+	}
+
+	if err := s.authenticate(username, token); err != nil {
+		s.failErr = err
+
+		status := "invalid_token"
+		if s.mech == XOAuth2 {
+			status = "401"
+		}
+		challenge, err := json.Marshal(sasl.OAuthBearerError{
+			Status:  status,
+			Schemes: "bearer",
+		})
+		if err != nil {
+			panic(err)
+		}
+		return challenge, false, nil
+	}
+
+	return nil, true, nil
+}
+
+// parseOAuthBearer parses the OAUTHBEARER client response:
+//
+//	gs2-header kvsep *kvpair kvsep
+//
+// Only the authorization identity and the 'auth' pair are used.
+func parseOAuthBearer(response []byte) (username, token string, err error) {
+	parts := bytes.SplitN(response, []byte{','}, 3)
+	if len(parts) != 3 {
+		return "", "", errMalformedBearer
+	}
+	switch string(parts[0]) {
+	case "n", "y":
+	default:
+		// Channel binding is not supported.
+		return "", "", errMalformedBearer
+	}
+	if len(parts[1]) != 0 {
+		if !bytes.HasPrefix(parts[1], []byte("a=")) {
+			return "", "", errMalformedBearer
+		}
+		username, err = decodeSASLName(string(parts[1][2:]))
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	token, err = parseBearerPairs(parts[2])
+	return username, token, err
+}
+
+// parseXOAuth2 parses the XOAUTH2 client response:
+//
+//	"user=" username 0x01 "auth=Bearer " token 0x01 0x01
+func parseXOAuth2(response []byte) (username, token string, err error) {
+	if !bytes.HasPrefix(response, []byte("user=")) {
+		return "", "", errMalformedBearer
+	}
+	end := bytes.IndexByte(response, 0x01)
+	if end == -1 {
+		return "", "", errMalformedBearer
+	}
+	username = string(response[len("user="):end])
+	if username == "" {
+		return "", "", errMalformedBearer
+	}
+
+	token, err = parseBearerPairs(response[end:])
+	return username, token, err
+}
+
+// parseBearerPairs extracts the bearer token from the list of key-value pairs
+// separated by 0x01 and terminated by two 0x01 bytes.
+func parseBearerPairs(pairs []byte) (string, error) {
+	if !bytes.HasPrefix(pairs, []byte{0x01}) || !bytes.HasSuffix(pairs, []byte{0x01, 0x01}) {
+		return "", errMalformedBearer
+	}
+
+	var token string
+	for _, pair := range bytes.Split(pairs[1:len(pairs)-2], []byte{0x01}) {
+		kv := strings.SplitN(string(pair), "=", 2)
+		if len(kv) != 2 {
+			return "", errMalformedBearer
+		}
+		if kv[0] != "auth" {
+			// host, port and unknown keys are ignored.
+			continue
+		}
+
+		// Auth scheme is case-insensitive (RFC 7235).
+		scheme := strings.SplitN(kv[1], " ", 2)
+		if len(scheme) != 2 || !strings.EqualFold(scheme[0], "Bearer") {
+			return "", errMalformedBearer
+		}
+		token = strings.TrimSpace(scheme[1])
+	}
+	if token == "" {
+		return "", errMalformedBearer
+	}
+	return token, nil
+}
+
+// decodeSASLName decodes the saslname production from RFC 5801.
+func decodeSASLName(name string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			sb.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			sb.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			sb.WriteByte('=')
+		default:
+			return "", errMalformedBearer
+		}
+		i += 2
+	}
+	return sb.String(), nil
+}
@@ -7,18 +7,22 @@ import (
 	"net"
 	"net/url"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/foxcpp/maddy/framework/config"
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/smtpconn/pool"
 	"github.com/go-ldap/ldap/v3"
 )
 
 const modName = "auth.ldap"
 
+// poolKey is the key used for all connections in the pool, all of them
+// use the same servers and credentials.
+const poolKey = "ldap"
+
 type Auth struct {
 	instName string
 
@@ -34,12 +38,32 @@ type Auth struct {
 	baseDN         string
 	filterTemplate string
 
-	conn     *ldap.Conn
-	connLock sync.Mutex
+	// Attribute returned by table lookups, DN is returned if empty.
+	lookupAttr string
+
+	// If set, only users matched by the group search are allowed.
+	groupBaseDN string
+	groupFilter string
+
+	pool *pool.P
 
 	log log.Logger
 }
 
+// conn wraps ldap.Conn to implement pool.Conn.
+type conn struct {
+	*ldap.Conn
+}
+
+func (c conn) Usable() bool {
+	return !c.IsClosing()
+}
+
+func (c conn) Close() error {
+	c.Conn.Close()
+	return nil
+}
+
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
 	return &Auth{
 		instName: instName,
@@ -51,6 +75,10 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 func (a *Auth) Init(cfg *config.Map) error {
 	a.dialer = &net.Dialer{}
 
+	poolCfg := pool.Config{
+		MaxKeys: 1,
+	}
+
 	cfg.Bool("debug", true, false, &a.log.Debug)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return tls.Config{}, nil
@@ -70,6 +98,11 @@ func (a *Auth) Init(cfg *config.Map) error {
 	cfg.String("dn_template", false, false, "", &a.dnTemplate)
 	cfg.String("base_dn", false, false, "", &a.baseDN)
 	cfg.String("filter", false, false, "", &a.filterTemplate)
+	cfg.String("lookup_attr", false, false, "", &a.lookupAttr)
+	cfg.String("group_base_dn", false, false, "", &a.groupBaseDN)
+	cfg.String("group_filter", false, false, "", &a.groupFilter)
+	cfg.Int("conn_max_idle_count", false, false, 4, &poolCfg.MaxConnsPerKey)
+	cfg.Int64("conn_max_idle_time", false, false, 150, &poolCfg.MaxConnLifetimeSec)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -86,16 +119,32 @@ func (a *Auth) Init(cfg *config.Map) error {
 			return fmt.Errorf("auth.ldap: search directives set when dn_template is used")
 		}
 	}
+	if a.groupFilter != "" && a.groupBaseDN == "" {
+		if a.baseDN == "" {
+			return fmt.Errorf("auth.ldap: group_base_dn not set")
+		}
+		a.groupBaseDN = a.baseDN
+	}
+
+	poolCfg.New = func(context.Context, string) (pool.Conn, error) {
+		c, err := a.newConn()
+		if err != nil {
+			return nil, err
+		}
+		return conn{c}, nil
+	}
+	a.pool = pool.New(poolCfg)
 
 	if module.NoRun {
 		return nil
 	}
 
-	var err error
-	a.conn, err = a.newConn()
+	// Check the configuration early.
+	c, err := a.getConn()
 	if err != nil {
-		return fmt.Errorf("auth.ldap: %w", err)
+		return err
 	}
+	a.returnConn(c)
 	return nil
 }
 
@@ -129,6 +178,13 @@ func (a *Auth) InstanceName() string {
 	return a.instName
 }
 
+func (a *Auth) Close() error {
+	if a.pool != nil {
+		a.pool.Close()
+	}
+	return nil
+}
+
 func (a *Auth) newConn() (*ldap.Conn, error) {
 	var (
 		conn   *ldap.Conn
@@ -139,13 +195,14 @@ func (a *Auth) newConn() (*ldap.Conn, error) {
 		if err != nil {
 			return nil, fmt.Errorf("auth.ldap: invalid server URL: %w", err)
 		}
-		hostname := parsedURL.Host
 		tlsCfg = a.tlsCfg.Clone()
-		a.tlsCfg.ServerName = hostname
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = parsedURL.Hostname()
+		}
 
 		conn, err = ldap.DialURL(u, ldap.DialWithDialer(a.dialer), ldap.DialWithTLSConfig(tlsCfg))
 		if err != nil {
-			a.log.Msg("cannot contact directory server", err, "url", u)
+			a.log.Error("cannot contact directory server", err, "url", u)
 			continue
 		}
 		break
@@ -160,11 +217,13 @@ func (a *Auth) newConn() (*ldap.Conn, error) {
 
 	if a.startls {
 		if err := conn.StartTLS(tlsCfg); err != nil {
+			conn.Close()
 			return nil, fmt.Errorf("auth.ldap: %w", err)
 		}
 	}
 
 	if err := a.readBind(conn); err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("auth.ldap: %w", err)
 	}
 
@@ -172,100 +231,206 @@ func (a *Auth) newConn() (*ldap.Conn, error) {
 }
 
 func (a *Auth) getConn() (*ldap.Conn, error) {
-	a.connLock.Lock()
-	if a.conn == nil {
-		conn, err := a.newConn()
-		if err != nil {
-			return nil, err
+	c, err := a.pool.Get(context.TODO(), poolKey)
+	if err != nil {
+		return nil, err
+	}
+	return c.(conn).Conn, nil
+}
+
+// returnConn puts the connection that was used only for searches back to the
+// pool.
+func (a *Auth) returnConn(c *ldap.Conn) {
+	a.pool.Return(poolKey, conn{c})
+}
+
+// returnUserConn restores the read bind for the connection that was used
+// to verify user credentials and puts it back to the pool.
+func (a *Auth) returnUserConn(c *ldap.Conn) {
+	if err := a.readBind(c); err != nil {
+		a.log.Error("failed to rebind for reading", err)
+		c.Close()
+		return
+	}
+	a.returnConn(c)
+}
+
+// expandTemplate replaces placeholders in the search filter with escaped
+// values.
+func expandTemplate(template string, values map[string]string) string {
+	replacements := make([]string, 0, len(values)*2)
+	for k, v := range values {
+		replacements = append(replacements, "{"+k+"}", ldap.EscapeFilter(v))
+	}
+	return strings.NewReplacer(replacements...).Replace(template)
+}
+
+// escapeDNValue escapes the value for use as an attribute value in the DN
+// (RFC 4514).
+func escapeDNValue(value string) string {
+	var sb strings.Builder
+	for i, ch := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, ch) || ch == 0:
+			fmt.Fprintf(&sb, "\\%02x", ch)
+			continue
+		case i == 0 && (ch == ' ' || ch == '#'):
+			sb.WriteByte('\\')
+		case i == len(value)-1 && ch == ' ':
+			sb.WriteByte('\\')
 		}
-		a.conn = conn
+		sb.WriteRune(ch)
 	}
-	if a.conn.IsClosing() {
-		a.conn.Close()
-		conn, err := a.newConn()
-		if err != nil {
-			return nil, err
+	return sb.String()
+}
+
+// findUser returns the entry for the user found using the search filter.
+// nil entry is returned if the user is not found.
+func (a *Auth) findUser(conn *ldap.Conn, username string, attrs []string) (*ldap.Entry, error) {
+	if attrs == nil {
+		attrs = []string{"dn"}
+	}
+	req := ldap.NewSearchRequest(
+		a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, 0, false,
+		expandTemplate(a.filterTemplate, map[string]string{"username": username}),
+		attrs, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, fmt.Errorf("auth.ldap: search: %w", err)
+	}
+	if len(res.Entries) > 1 {
+		return nil, fmt.Errorf("auth.ldap: too many entries returned (%d)", len(res.Entries))
+	}
+	if len(res.Entries) == 0 {
+		return nil, nil
+	}
+	return res.Entries[0], nil
+}
+
+// inGroup checks whether the user is matched by the group search.
+func (a *Auth) inGroup(conn *ldap.Conn, username, userDN string) (bool, error) {
+	if a.groupFilter == "" {
+		return true, nil
+	}
+
+	req := ldap.NewSearchRequest(
+		a.groupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		1, 0, false,
+		expandTemplate(a.groupFilter, map[string]string{
+			"username": username,
+			"dn":       userDN,
+		}),
+		[]string{"dn"}, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+			return true, nil
 		}
-		a.conn = conn
+		return false, fmt.Errorf("auth.ldap: group search: %w", err)
 	}
-	return a.conn, nil
+	return len(res.Entries) != 0, nil
 }
 
-func (a *Auth) returnConn(conn *ldap.Conn) {
-	defer a.connLock.Unlock()
-	if err := a.readBind(conn); err != nil {
-		a.log.Error("failed to rebind for reading", err)
+// lookup returns the values of lookup_attr (or DN) for the user.
+func (a *Auth) lookup(username string) ([]string, error) {
+	if a.dnTemplate != "" {
+		return nil, fmt.Errorf("auth.ldap: lookups require search config but dn_template is used")
+	}
+
+	conn, err := a.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs []string
+	if a.lookupAttr != "" {
+		attrs = []string{a.lookupAttr}
+	}
+	entry, err := a.findUser(conn, username, attrs)
+	if err != nil {
 		conn.Close()
-		a.conn = nil
+		return nil, err
+	}
+	if entry == nil {
+		a.returnConn(conn)
+		return nil, nil
 	}
-	if a.conn != conn {
-		a.conn.Close()
+
+	ok, err := a.inGroup(conn, username, entry.DN)
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	a.conn = conn
+	a.returnConn(conn)
+	if !ok {
+		a.log.DebugMsg("user is not a member of the group", "username", username, "dn", entry.DN)
+		return nil, nil
+	}
+
+	if a.lookupAttr == "" {
+		return []string{entry.DN}, nil
+	}
+	return entry.GetAttributeValues(a.lookupAttr), nil
 }
 
 func (a *Auth) Lookup(_ context.Context, username string) (string, bool, error) {
-	conn, err := a.getConn()
+	values, err := a.lookup(username)
 	if err != nil {
 		return "", false, err
 	}
-	defer a.returnConn(conn)
-
-	var userDN string
-	if a.dnTemplate != "" {
-		return "", false, fmt.Errorf("auth.ldap: lookups require search config but dn_template is used")
-	} else {
-		req := ldap.NewSearchRequest(
-			a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
-			2, 0, false,
-			strings.ReplaceAll(a.filterTemplate, "{username}", username),
-			[]string{"dn"}, nil)
-		res, err := conn.Search(req)
-		if err != nil {
-			return "", false, fmt.Errorf("auth.ldap: search: %w", err)
-		}
-		if len(res.Entries) > 1 {
-			return "", false, fmt.Errorf("auth.ldap: too manu entries returned (%d)", len(res.Entries))
-		}
-		if len(res.Entries) == 0 {
-			return "", false, nil
-		}
-		userDN = res.Entries[0].DN
+	if len(values) == 0 {
+		return "", false, nil
 	}
+	return values[0], true, nil
+}
 
-	return userDN, true, nil
+func (a *Auth) LookupMulti(_ context.Context, username string) ([]string, error) {
+	return a.lookup(username)
 }
 
 func (a *Auth) AuthPlain(username, password string) error {
+	// Empty password is an unauthenticated bind (RFC 4513 Section 5.1.2)
+	// that succeeds on many servers.
+	if password == "" {
+		return module.ErrUnknownCredentials
+	}
+
 	conn, err := a.getConn()
 	if err != nil {
 		return err
 	}
-	defer a.returnConn(conn)
 
 	var userDN string
 	if a.dnTemplate != "" {
-		userDN = strings.ReplaceAll(a.dnTemplate, "{username}", username)
+		userDN = strings.ReplaceAll(a.dnTemplate, "{username}", escapeDNValue(username))
 	} else {
-		req := ldap.NewSearchRequest(
-			a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
-			2, 0, false,
-			strings.ReplaceAll(a.filterTemplate, "{username}", username),
-			[]string{"dn"}, nil)
-		res, err := conn.Search(req)
+		entry, err := a.findUser(conn, username, nil)
 		if err != nil {
-			return fmt.Errorf("auth.ldap: search: %w", err)
-		}
-		if len(res.Entries) > 1 {
-			return fmt.Errorf("auth.ldap: too manu entries returned (%d)", len(res.Entries))
+			conn.Close()
+			return err
 		}
-		if len(res.Entries) == 0 {
+		if entry == nil {
+			a.returnConn(conn)
 			return module.ErrUnknownCredentials
 		}
-		userDN = res.Entries[0].DN
+		userDN = entry.DN
 	}
 
 	if err := conn.Bind(userDN, password); err != nil {
+		a.returnUserConn(conn)
+		return module.ErrUnknownCredentials
+	}
+
+	// Group search is done using user credentials so it works with
+	// dn_template and 'bind off'.
+	ok, err := a.inGroup(conn, username, userDN)
+	a.returnUserConn(conn)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		a.log.Msg("user is not a member of the group", "username", username, "dn", userDN)
 		return module.ErrUnknownCredentials
 	}
 
@@ -275,6 +440,7 @@ func (a *Auth) AuthPlain(username, password string) error {
 func init() {
 	var _ module.PlainAuth = &Auth{}
 	var _ module.Table = &Auth{}
+	var _ module.MultiTable = &Auth{}
 	module.Register(modName, New)
 	module.Register("table.ldap", New)
 }
@@ -0,0 +1,37 @@
+package ldap
+
+import "testing"
+
+func TestExpandTemplate(t *testing.T) {
+	for _, c := range []struct {
+		template string
+		values   map[string]string
+		want     string
+	}{
+		{"(uid={username})", map[string]string{"username": "user"}, "(uid=user)"},
+		{"(uid={username})", map[string]string{"username": "*)(uid=*"}, `(uid=\2a\29\28uid=\2a)`},
+		{"(&(member={dn})(cn={username}))", map[string]string{
+			"username": "a{dn}",
+			"dn":       "cn=a,dc=example",
+		}, "(&(member=cn=a,dc=example)(cn=a{dn}))"},
+	} {
+		if got := expandTemplate(c.template, c.values); got != c.want {
+			t.Errorf("expandTemplate(%q, %v) = %q, want %q", c.template, c.values, got, c.want)
+		}
+	}
+}
+
+func TestEscapeDNValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"user":         "user",
+		"a,cn=admin":   `a\2ccn\3dadmin`,
+		" #user ":      `\ #user\ `,
+		"#user":        `\#user`,
+		`q"<>;+\`:      `q\22\3c\3e\3b\2b\5c`,
+		"пользователь": "пользователь",
+	} {
+		if got := escapeDNValue(value); got != want {
+			t.Errorf("escapeDNValue(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Audience  stringList      `json:"aud"`
+	Expiry    *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Scope     string          `json:"scope"`
+	Scp       stringList      `json:"scp"`
+	Raw       json.RawMessage `json:"-"`
+}
+
+// stringList is a JSON value that can be either a string or an array of
+// strings.
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*l = []string{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+func (c *jwtClaims) scopes() []string {
+	scopes := strings.Fields(c.Scope)
+	// Azure AD and some other providers use 'scp'.
+	for _, s := range c.Scp {
+		scopes = append(scopes, strings.Fields(s)...)
+	}
+	return scopes
+}
+
+// claim returns the string value of the named claim.
+func (c *jwtClaims) claim(name string) (string, error) {
+	var all map[string]interface{}
+	if err := json.Unmarshal(c.Raw, &all); err != nil {
+		return "", err
+	}
+	val, ok := all[name].(string)
+	if !ok || val == "" {
+		return "", fmt.Errorf("missing or non-string %s claim", name)
+	}
+	return val, nil
+}
+
+// parseJWT splits the compact JWS serialization and decodes the header and
+// claims. The signature is not checked.
+func parseJWT(token string) (hdr jwtHeader, claims jwtClaims, signed, sig []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return hdr, claims, nil, nil, errors.New("malformed token")
+	}
+
+	hdrBlob, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return hdr, claims, nil, nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	if err := json.Unmarshal(hdrBlob, &hdr); err != nil {
+		return hdr, claims, nil, nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	claimsBlob, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return hdr, claims, nil, nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	if err := json.Unmarshal(claimsBlob, &claims); err != nil {
+		return hdr, claims, nil, nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	claims.Raw = claimsBlob
+
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return hdr, claims, nil, nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	return hdr, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+// verifySignature checks the JWS signature using the algorithm from the
+// token header. "none" and HMAC algorithms are never accepted.
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+		edKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		if !ed25519.Verify(edKey, signed, sig) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[0] {
+	case 'R', 'P':
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(rsaKey, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(rsaKey, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+		if err != nil {
+			return errors.New("invalid signature")
+		}
+	case 'E':
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key type does not match the algorithm")
+		}
+		size := (ecKey.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(ecKey, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
+
+func (c *jwtClaims) checkTime(now time.Time, skew time.Duration) error {
+	if c.Expiry == nil {
+		return errors.New("missing exp claim")
+	}
+	if now.Add(-skew).After(time.Unix(int64(*c.Expiry), 0)) {
+		return errors.New("token is expired")
+	}
+	if c.NotBefore != nil && now.Add(skew).Before(time.Unix(int64(*c.NotBefore), 0)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// minRefetchInterval limits how often the key set is re-fetched when a token
+// signed with an unknown key is presented.
+const minRefetchInterval = 30 * time.Second
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type verificationKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// keySet is the cached JWKS of the issuer.
+type keySet struct {
+	client  *http.Client
+	issuer  string
+	url     string
+	refresh time.Duration
+	log     log.Logger
+
+	lock      sync.Mutex
+	keys      map[string][]verificationKey
+	fetchedAt time.Time
+	fetchErr  error
+}
+
+// get returns the keys with the specified ID. If kid is empty, all keys
+// are returned.
+func (ks *keySet) get(kid string) ([]verificationKey, error) {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(ks.fetchedAt) < ks.refresh {
+		if keys := ks.lookup(kid); len(keys) != 0 {
+			return keys, nil
+		}
+		if now.Sub(ks.fetchedAt) < minRefetchInterval {
+			if ks.fetchErr != nil {
+				return nil, ks.fetchErr
+			}
+			return nil, fmt.Errorf("unknown key ID: %s", kid)
+		}
+	}
+
+	keys, err := ks.fetch()
+	ks.fetchedAt = now
+	ks.fetchErr = err
+	if err != nil {
+		if ks.keys == nil {
+			return nil, err
+		}
+		// Continue using the old keys in case the issuer is temporarily
+		// unavailable.
+		ks.log.Error("failed to refresh JWKS", err, "issuer", ks.issuer)
+	} else {
+		ks.keys = keys
+	}
+
+	if keys := ks.lookup(kid); len(keys) != 0 {
+		return keys, nil
+	}
+	return nil, fmt.Errorf("unknown key ID: %s", kid)
+}
+
+func (ks *keySet) lookup(kid string) []verificationKey {
+	if kid != "" {
+		return ks.keys[kid]
+	}
+	var all []verificationKey
+	for _, keys := range ks.keys {
+		all = append(all, keys...)
+	}
+	return all
+}
+
+func (ks *keySet) getJSON(url string, v interface{}) error {
+	resp, err := ks.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: HTTP %s", url, resp.Status)
+	}
+
+	// Key sets are small, 1 MiB is more than enough.
+	blob, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, v)
+}
+
+// discover obtains the JWKS URL from the OpenID Connect discovery document.
+func (ks *keySet) discover() (string, error) {
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	err := ks.getJSON(strings.TrimSuffix(ks.issuer, "/")+"/.well-known/openid-configuration", &doc)
+	if err != nil {
+		return "", fmt.Errorf("discovery failed: %w", err)
+	}
+	if doc.Issuer != ks.issuer {
+		return "", fmt.Errorf("discovery failed: issuer mismatch: %s", doc.Issuer)
+	}
+	if doc.JWKSURI == "" {
+		return "", errors.New("discovery failed: no jwks_uri")
+	}
+	return doc.JWKSURI, nil
+}
+
+func (ks *keySet) fetch() (map[string][]verificationKey, error) {
+	if ks.url == "" {
+		url, err := ks.discover()
+		if err != nil {
+			return nil, err
+		}
+		ks.url = url
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := ks.getJSON(ks.url, &set); err != nil {
+		return nil, fmt.Errorf("JWKS fetch failed: %w", err)
+	}
+
+	keys := make(map[string][]verificationKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			ks.log.Msg("skipping JWKS key", "kid", jwk.Kid, "reason", err)
+			continue
+		}
+		keys[jwk.Kid] = append(keys[jwk.Kid], verificationKey{alg: jwk.Alg, key: key})
+	}
+	ks.log.DebugMsg("fetched JWKS", "url", ks.url, "keys", len(keys))
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("malformed n: %w", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, fmt.Errorf("malformed e: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("malformed e")
+		}
+		if n.BitLen() < 2048 {
+			return nil, errors.New("RSA key is too small")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("malformed x: %w", err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("malformed y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve: %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed x")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", jwk.Kty)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package oidc implements the auth.oidc module that validates OAuth 2.0
+// bearer tokens (JWT access tokens) issued by an OpenID Connect provider.
+//
+// The module is used via the OAUTHBEARER and XOAUTH2 SASL mechanisms.
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "auth.oidc"
+
+type Auth struct {
+	instName string
+
+	issuer         string
+	audience       []string
+	requiredScopes []string
+	userClaim      string
+	userTable      module.Table
+	clockSkew      time.Duration
+
+	keys *keySet
+	log  log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	a := &Auth{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		a.issuer = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("%s: expected at most one inline argument", modName)
+	}
+
+	return a, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	var (
+		jwksURL        string
+		refresh        time.Duration
+		requestTimeout time.Duration
+	)
+
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.String("issuer", false, a.issuer == "", a.issuer, &a.issuer)
+	cfg.String("jwks_url", false, false, "", &jwksURL)
+	cfg.StringList("audience", false, true, nil, &a.audience)
+	cfg.StringList("required_scopes", false, false, nil, &a.requiredScopes)
+	cfg.String("user_claim", false, false, "sub", &a.userClaim)
+	cfg.Custom("user_table", false, false, nil, modconfig.TableDirective, &a.userTable)
+	cfg.Duration("jwks_refresh", false, false, time.Hour, &refresh)
+	cfg.Duration("clock_skew", false, false, time.Minute, &a.clockSkew)
+	cfg.Duration("request_timeout", false, false, 10*time.Second, &requestTimeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	a.keys = &keySet{
+		client:  &http.Client{Timeout: requestTimeout},
+		issuer:  a.issuer,
+		url:     jwksURL,
+		refresh: refresh,
+		log:     a.log,
+	}
+
+	// Fetch keys early so configuration errors are visible on start-up,
+	// but do not fail if the issuer is unavailable at the moment.
+	if _, err := a.keys.get(""); err != nil {
+		a.log.Error("failed to fetch issuer keys", err, "issuer", a.issuer)
+	}
+
+	return nil
+}
+
+// validate checks the token signature and claims and returns the verified
+// claims.
+func (a *Auth) validate(token string) (*jwtClaims, error) {
+	hdr, claims, signed, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := a.keys.get(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = errors.New("no matching key")
+	for _, k := range keys {
+		if k.alg != "" && k.alg != hdr.Alg {
+			continue
+		}
+		err = verifySignature(hdr.Alg, k.key, signed, sig)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s", claims.Issuer)
+	}
+	if err := claims.checkTime(time.Now(), a.clockSkew); err != nil {
+		return nil, err
+	}
+	if !containsAny(claims.Audience, a.audience) {
+		return nil, fmt.Errorf("audience mismatch: %v", []string(claims.Audience))
+	}
+	scopes := claims.scopes()
+	for _, s := range a.requiredScopes {
+		if !containsAny(scopes, []string{s}) {
+			return nil, fmt.Errorf("missing required scope: %s", s)
+		}
+	}
+
+	return &claims, nil
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Auth) AuthBearer(token string) (string, error) {
+	claims, err := a.validate(token)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", modName, err)
+	}
+
+	subject, err := claims.claim(a.userClaim)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", modName, err)
+	}
+	if a.userTable == nil {
+		return subject, nil
+	}
+
+	username, ok, err := a.userTable.Lookup(context.TODO(), subject)
+	if err != nil {
+		return "", fmt.Errorf("%s: user_table lookup failed: %w", modName, err)
+	}
+	if !ok {
+		a.log.Msg("no account for the token subject", "subject", subject)
+		return "", module.ErrUnknownCredentials
+	}
+	return username, nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
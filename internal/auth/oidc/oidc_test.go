@@ -0,0 +1,281 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type testIssuer struct {
+	srv *httptest.Server
+
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+	edKey  ed25519.PrivateKey
+
+	jwksFetches int
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	ti := &testIssuer{}
+	var err error
+	ti.rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti.ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ti.edKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   ti.srv.URL,
+			"jwks_uri": ti.srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		ti.jwksFetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "RSA",
+					"kid": "rsa",
+					"use": "sig",
+					"alg": "RS256",
+					"n":   b64(ti.rsaKey.N.Bytes()),
+					"e":   b64(big.NewInt(int64(ti.rsaKey.E)).Bytes()),
+				},
+				{
+					"kty": "EC",
+					"kid": "ec",
+					"crv": "P-256",
+					"x":   b64(ti.ecKey.X.FillBytes(make([]byte, 32))),
+					"y":   b64(ti.ecKey.Y.FillBytes(make([]byte, 32))),
+				},
+				{
+					"kty": "OKP",
+					"kid": "ed",
+					"crv": "Ed25519",
+					"x":   b64(ti.edKey.Public().(ed25519.PublicKey)),
+				},
+				{
+					"kty": "RSA",
+					"kid": "enc",
+					"use": "enc",
+					"n":   b64(ti.rsaKey.N.Bytes()),
+					"e":   b64(big.NewInt(int64(ti.rsaKey.E)).Bytes()),
+				},
+			},
+		})
+	})
+	ti.srv = httptest.NewServer(mux)
+	t.Cleanup(ti.srv.Close)
+
+	return ti
+}
+
+func (ti *testIssuer) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := b64(hdr) + "." + b64(body)
+	digest := sha256.Sum256([]byte(signed))
+
+	var (
+		sig []byte
+		err error
+	)
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, ti.rsaKey, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, ti.rsaKey, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, ti.ecKey, digest[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "EdDSA":
+		sig = ed25519.Sign(ti.edKey, []byte(signed))
+	case "none":
+	default:
+		t.Fatal("unknown alg:", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + b64(sig)
+}
+
+func (ti *testIssuer) claims(override map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":   ti.srv.URL,
+		"sub":   "user@example.org",
+		"aud":   []string{"maddy", "other"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"scope": "openid email",
+	}
+	for k, v := range override {
+		if v == nil {
+			delete(claims, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return claims
+}
+
+func testAuth(t *testing.T, ti *testIssuer) *Auth {
+	return &Auth{
+		issuer:         ti.srv.URL,
+		audience:       []string{"maddy"},
+		requiredScopes: []string{"email"},
+		userClaim:      "sub",
+		clockSkew:      time.Minute,
+		keys: &keySet{
+			client:  ti.srv.Client(),
+			issuer:  ti.srv.URL,
+			refresh: time.Hour,
+			log:     testutils.Logger(t, modName),
+		},
+		log: testutils.Logger(t, modName),
+	}
+}
+
+func TestAuthBearer(t *testing.T) {
+	ti := newTestIssuer(t)
+	a := testAuth(t, ti)
+
+	test := func(name, token string, ok bool) {
+		t.Helper()
+		username, err := a.AuthBearer(token)
+		if ok {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", name, err)
+			} else if username != "user@example.org" {
+				t.Errorf("%s: wrong username: %s", name, username)
+			}
+			return
+		}
+		if err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	test("RS256", ti.sign(t, "RS256", "rsa", ti.claims(nil)), true)
+	test("PS256 with RS256 key", ti.sign(t, "PS256", "rsa", ti.claims(nil)), false)
+	test("ES256", ti.sign(t, "ES256", "ec", ti.claims(nil)), true)
+	test("EdDSA", ti.sign(t, "EdDSA", "ed", ti.claims(nil)), true)
+	test("string aud", ti.sign(t, "ES256", "ec", ti.claims(map[string]interface{}{"aud": "maddy"})), true)
+	test("scp claim", ti.sign(t, "ES256", "ec", ti.claims(map[string]interface{}{
+		"scope": nil,
+		"scp":   []string{"email"},
+	})), true)
+
+	test("alg none", ti.sign(t, "none", "rsa", ti.claims(nil)), false)
+	test("wrong key type", ti.sign(t, "ES256", "rsa", ti.claims(nil)), false)
+	test("encryption key", ti.sign(t, "RS256", "enc", ti.claims(nil)), false)
+	test("unknown kid", ti.sign(t, "RS256", "unknown", ti.claims(nil)), false)
+	test("expired", ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{
+		"exp": time.Now().Add(-2 * time.Minute).Unix(),
+	})), false)
+	test("expired within skew", ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{
+		"exp": time.Now().Add(-30 * time.Second).Unix(),
+	})), true)
+	test("no exp", ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{"exp": nil})), false)
+	test("not yet valid", ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{
+		"nbf": time.Now().Add(time.Hour).Unix(),
+	})), false)
+	test("wrong issuer", ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{
+		"iss": "https://evil.example.org",
+	})), false)
+	test("wrong audience", ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{"aud": "other"})), false)
+	test("missing scope", ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{"scope": "openid"})), false)
+	test("no subject", ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{"sub": nil})), false)
+	test("malformed", "aaa.bbb", false)
+
+	tampered := ti.sign(t, "RS256", "rsa", ti.claims(nil))
+	parts := strings.Split(tampered, ".")
+	body, _ := json.Marshal(ti.claims(map[string]interface{}{"sub": "admin@example.org"}))
+	test("tampered", parts[0]+"."+b64(body)+"."+parts[2], false)
+
+	// Unknown key IDs should not cause a JWKS fetch for each attempt.
+	if ti.jwksFetches != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", ti.jwksFetches)
+	}
+}
+
+func TestAuthBearer_UserTable(t *testing.T) {
+	ti := newTestIssuer(t)
+	a := testAuth(t, ti)
+	a.userClaim = "preferred_username"
+	a.userTable = testutils.Table{
+		M: map[string]string{
+			"user": "user@example.org",
+		},
+	}
+
+	username, err := a.AuthBearer(ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{
+		"preferred_username": "user",
+	})))
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if username != "user@example.org" {
+		t.Fatal("Wrong username:", username)
+	}
+
+	_, err = a.AuthBearer(ti.sign(t, "RS256", "rsa", ti.claims(map[string]interface{}{
+		"preferred_username": "user2",
+	})))
+	if err != module.ErrUnknownCredentials {
+		t.Fatal("Expected ErrUnknownCredentials, got:", err)
+	}
+}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
@@ -30,17 +31,25 @@ import (
 
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/secure/precis"
 )
 
 const (
 	HashSHA256 = "sha256"
 	HashBcrypt = "bcrypt"
 	HashArgon2 = "argon2"
+	HashSCRAM  = "scram-sha-256"
 
 	DefaultHash = HashBcrypt
 
 	Argon2Salt = 16
 	Argon2Size = 64
+
+	SCRAMSalt = 16
+	// SCRAMIterations is the default iteration count for new SCRAM
+	// verifiers. It is the minimum recommended by RFC 7677.
+	SCRAMIterations = 4096
 )
 
 type (
@@ -56,6 +65,10 @@ type (
 		Argon2Time    uint32
 		Argon2Memory  uint32
 		Argon2Threads uint8
+
+		// PBKDF2 iteration count for SCRAM-SHA-256 verifiers. Default is
+		// used if zero.
+		SCRAMIterations int
 	}
 
 	FuncHashCompute func(opts HashOpts, pass string) (string, error)
@@ -66,13 +79,15 @@ var (
 	HashCompute = map[string]FuncHashCompute{
 		HashBcrypt: computeBcrypt,
 		HashArgon2: computeArgon2,
+		HashSCRAM:  computeSCRAM,
 	}
 	HashVerify = map[string]FuncHashVerify{
 		HashBcrypt: verifyBcrypt,
 		HashArgon2: verifyArgon2,
+		HashSCRAM:  verifySCRAM,
 	}
 
-	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2}
+	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2, HashSCRAM}
 )
 
 func computeArgon2(opts HashOpts, pass string) (string, error) {
@@ -174,6 +189,100 @@ func verifyBcrypt(pass, hashSalt string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashSalt), []byte(pass))
 }
 
+// SCRAMVerifier is the decoded form of the scram-sha-256 hash string.
+//
+// The string has the format ITERATIONS:SALT:STOREDKEY:SERVERKEY with all
+// binary values encoded using base64. It is the same information the
+// server needs to run SCRAM-SHA-256 exchange (RFC 5802, RFC 7677) so
+// the password is not stored in any plaintext-equivalent form.
+type SCRAMVerifier struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+func scramHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func scramKeys(pass string, salt []byte, iterations int) (storedKey, serverKey []byte, err error) {
+	// RFC 5802 requires SASLprep, OpaqueString is its PRECIS replacement.
+	pass, err = precis.OpaqueString.String(pass)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pass_table: %w", err)
+	}
+
+	saltedPass := pbkdf2.Key([]byte(pass), salt, iterations, sha256.Size, sha256.New)
+	clientKey := scramHMAC(saltedPass, "Client Key")
+	stored := sha256.Sum256(clientKey)
+	return stored[:], scramHMAC(saltedPass, "Server Key"), nil
+}
+
+// ParseSCRAM decodes the scram-sha-256 hash string (without the tag).
+func ParseSCRAM(hashSalt string) (SCRAMVerifier, error) {
+	parts := strings.Split(hashSalt, ":")
+	if len(parts) != 4 {
+		return SCRAMVerifier{}, fmt.Errorf("pass_table: malformed hash string")
+	}
+
+	var (
+		v   SCRAMVerifier
+		err error
+	)
+	v.Iterations, err = strconv.Atoi(parts[0])
+	if err != nil || v.Iterations <= 0 {
+		return SCRAMVerifier{}, fmt.Errorf("pass_table: malformed hash string, invalid iteration count")
+	}
+	for i, dst := range []*[]byte{&v.Salt, &v.StoredKey, &v.ServerKey} {
+		*dst, err = base64.StdEncoding.DecodeString(parts[i+1])
+		if err != nil {
+			return SCRAMVerifier{}, fmt.Errorf("pass_table: malformed hash string: %w", err)
+		}
+	}
+	return v, nil
+}
+
+func computeSCRAM(opts HashOpts, pass string) (string, error) {
+	iterations := opts.SCRAMIterations
+	if iterations == 0 {
+		iterations = SCRAMIterations
+	}
+
+	salt := make([]byte, SCRAMSalt)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", fmt.Errorf("pass_table: failed to generate salt: %w", err)
+	}
+
+	storedKey, serverKey, err := scramKeys(pass, salt, iterations)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.Itoa(iterations) + ":" +
+		base64.StdEncoding.EncodeToString(salt) + ":" +
+		base64.StdEncoding.EncodeToString(storedKey) + ":" +
+		base64.StdEncoding.EncodeToString(serverKey), nil
+}
+
+func verifySCRAM(pass, hashSalt string) error {
+	v, err := ParseSCRAM(hashSalt)
+	if err != nil {
+		return err
+	}
+
+	storedKey, _, err := scramKeys(pass, v.Salt, v.Iterations)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(storedKey, v.StoredKey) != 1 {
+		return fmt.Errorf("pass_table: hash mismatch")
+	}
+	return nil
+}
+
 func addSHA256() {
 	HashCompute[HashSHA256] = computeSHA256
 	HashVerify[HashSHA256] = verifySHA256
@@ -36,6 +36,8 @@ type Auth struct {
 	inlineArgs []string
 
 	table module.Table
+	// hash is the hash function used for new passwords.
+	hash string
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -43,6 +45,7 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 		modName:    modName,
 		instName:   instName,
 		inlineArgs: inlineArgs,
+		hash:       DefaultHash,
 	}, nil
 }
 
@@ -52,6 +55,7 @@ func (a *Auth) Init(cfg *config.Map) error {
 	}
 
 	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
+	cfg.Enum("hash", false, false, []string{HashBcrypt, HashArgon2, HashSCRAM}, DefaultHash, &a.hash)
 	_, err := cfg.Process()
 	return err
 }
@@ -98,6 +102,71 @@ func (a *Auth) AuthPlain(username, password string) error {
 	return hashVerify(password, parts[1])
 }
 
+// SCRAMMechanisms returns SCRAM-SHA-256 if new passwords are stored using
+// SCRAM verifiers.
+//
+// Users with passwords set using other hash functions can still log in
+// using PLAIN and LOGIN.
+func (a *Auth) SCRAMMechanisms() []string {
+	if a.hash != HashSCRAM {
+		return nil
+	}
+	return []string{"SCRAM-SHA-256"}
+}
+
+func (a *Auth) SCRAMCredentials(mech, username string) (module.SCRAMCredentials, error) {
+	if mech != "SCRAM-SHA-256" {
+		return module.SCRAMCredentials{}, fmt.Errorf("%s: unsupported mechanism: %s", a.modName, mech)
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+
+	hash, ok, err := a.table.Lookup(context.TODO(), key)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	if !ok {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+
+	parts := strings.SplitN(hash, ":", 2)
+	if len(parts) != 2 {
+		return module.SCRAMCredentials{}, fmt.Errorf("%s: scram credentials %s: no hash tag", a.modName, key)
+	}
+	if parts[0] != HashSCRAM {
+		// Password was set before SCRAM was enabled, it needs to be reset.
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+	v, err := ParseSCRAM(parts[1])
+	if err != nil {
+		return module.SCRAMCredentials{}, fmt.Errorf("%s: scram credentials %s: %w", a.modName, key, err)
+	}
+
+	return module.SCRAMCredentials{
+		Iterations: v.Iterations,
+		Salt:       v.Salt,
+		StoredKey:  v.StoredKey,
+		ServerKey:  v.ServerKey,
+	}, nil
+}
+
+func (a *Auth) computeHash(password string) (string, error) {
+	hash, err := HashCompute[a.hash](HashOpts{
+		BcryptCost:      bcrypt.DefaultCost,
+		Argon2Memory:    1024,
+		Argon2Time:      3,
+		Argon2Threads:   1,
+		SCRAMIterations: SCRAMIterations,
+	}, password)
+	if err != nil {
+		return "", err
+	}
+	return a.hash + ":" + hash, nil
+}
+
 func (a *Auth) ListUsers() ([]string, error) {
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
@@ -130,15 +199,12 @@ func (a *Auth) CreateUser(username, password string) error {
 		return fmt.Errorf("%s: credentials for %s already exist", a.modName, key)
 	}
 
-	// TODO: Allow to customize hash function.
-	hash, err := HashCompute[HashBcrypt](HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	}, password)
+	hash, err := a.computeHash(password)
 	if err != nil {
 		return fmt.Errorf("%s: create user %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, hash); err != nil {
 		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
 	}
 	return nil
@@ -155,15 +221,12 @@ func (a *Auth) SetUserPassword(username, password string) error {
 		return fmt.Errorf("%s: set password %s (raw): %w", a.modName, username, err)
 	}
 
-	// TODO: Allow to customize hash function.
-	hash, err := HashCompute[HashBcrypt](HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	}, password)
+	hash, err := a.computeHash(password)
 	if err != nil {
 		return fmt.Errorf("%s: set password %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, hash); err != nil {
 		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
 	}
 	return nil
@@ -19,9 +19,12 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -62,3 +65,75 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
 }
+
+func TestAuth_SCRAM(t *testing.T) {
+	mod, err := New("pass_table", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	tbl := &mutableTable{Table: testutils.Table{M: map[string]string{}}}
+	a.table = tbl
+	a.hash = HashSCRAM
+
+	if err := a.CreateUser("foxcpp", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tbl.M["foxcpp"], "scram-sha-256:4096:") {
+		t.Fatalf("Wrong hash string: %s", tbl.M["foxcpp"])
+	}
+	tbl.M["not-foxcpp"] = "bcrypt:$2y$10$4tEJtJ6dApmhETg8tJ4WHOeMtmYXQwmHDKIyfg09Bw1F/smhLjlaa"
+
+	if err := a.AuthPlain("foxcpp", "password"); err != nil {
+		t.Error("AuthPlain with SCRAM verifier failed:", err)
+	}
+	if err := a.AuthPlain("foxcpp", "different-password"); err == nil {
+		t.Error("AuthPlain with SCRAM verifier accepted wrong password")
+	}
+
+	if mechs := a.SCRAMMechanisms(); len(mechs) != 1 || mechs[0] != "SCRAM-SHA-256" {
+		t.Fatalf("Wrong SCRAM mechanisms: %v", mechs)
+	}
+
+	creds, err := a.SCRAMCredentials("SCRAM-SHA-256", "FoxCpp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := ParseSCRAM(strings.TrimPrefix(tbl.M["foxcpp"], "scram-sha-256:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Iterations != 4096 || !bytes.Equal(creds.Salt, v.Salt) ||
+		!bytes.Equal(creds.StoredKey, v.StoredKey) || !bytes.Equal(creds.ServerKey, v.ServerKey) {
+		t.Errorf("Wrong credentials: %+v", creds)
+	}
+
+	if _, err := a.SCRAMCredentials("SCRAM-SHA-256", "not-foxcpp"); err != module.ErrUnknownCredentials {
+		t.Error("Expected ErrUnknownCredentials for non-SCRAM hash, got", err)
+	}
+	if _, err := a.SCRAMCredentials("SCRAM-SHA-256", "nobody"); err != module.ErrUnknownCredentials {
+		t.Error("Expected ErrUnknownCredentials for unknown user, got", err)
+	}
+}
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m *mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.M))
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m *mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m *mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
@@ -19,20 +19,26 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package auth
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/emersion/go-sasl"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/text/secure/precis"
 )
 
 var (
 	ErrUnsupportedMech = errors.New("Unsupported SASL mechanism")
 	ErrInvalidAuthCred = errors.New("auth: invalid credentials")
+	ErrAuthzDenied     = errors.New("auth: not permitted to act as the requested identity")
+	ErrAcctDisabled    = errors.New("auth: account is disabled")
 )
 
 // SASLAuth is a wrapper that initializes sasl.Server using authenticators that
@@ -40,11 +46,30 @@ var (
 //
 // It supports reporting of multiple authorization identities so multiple
 // accounts can be associated with a single set of credentials.
+//
+// Authorization identity different from the authentication identity
+// (username) is accepted only for users listed in Impersonators. Such
+// logins are always logged.
 type SASLAuth struct {
 	Log         log.Logger
 	OnlyFirstID bool
 
-	Plain []module.PlainAuth
+	Plain  []module.PlainAuth
+	Bearer []module.BearerAuth
+	SCRAM  []module.SCRAMAuth
+
+	// Impersonators is the list of usernames that are allowed to act as any
+	// other user.
+	Impersonators []string
+
+	// Protocol is the name of the protocol passed to providers implementing
+	// module.ProtocolPlainAuth (e.g. "imap", "submission"). If it is empty,
+	// credentials restricted to specific protocols are not accepted.
+	Protocol string
+
+	// Accounts is the list of modules that are asked whether the account
+	// is disabled after successful authentication.
+	Accounts []module.AccountStatus
 }
 
 func (s *SASLAuth) SASLMechanisms() []string {
@@ -53,6 +78,14 @@ func (s *SASLAuth) SASLMechanisms() []string {
 	if len(s.Plain) != 0 {
 		mechs = append(mechs, sasl.Plain, sasl.Login)
 	}
+	if len(s.Bearer) != 0 {
+		mechs = append(mechs, sasl.OAuthBearer, XOAuth2)
+	}
+	for _, mech := range []string{SCRAMSHA256, SCRAMSHA256Plus} {
+		if s.scramProvider(mech) != nil {
+			mechs = append(mechs, mech)
+		}
+	}
 
 	return mechs
 }
@@ -64,17 +97,110 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 
 	var lastErr error
 	for _, p := range s.Plain {
-		lastErr = p.AuthPlain(username, password)
+		if pp, ok := p.(module.ProtocolPlainAuth); ok && s.Protocol != "" {
+			lastErr = pp.AuthPlainProtocol(username, password, s.Protocol)
+		} else {
+			lastErr = p.AuthPlain(username, password)
+		}
 		if lastErr == nil {
-			return nil
+			return s.checkAccount(username)
 		}
 	}
 
 	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
 }
 
+// AuthBearer validates the OAuth 2.0 bearer token and returns the name of the
+// account it was issued for.
+func (s *SASLAuth) AuthBearer(token string) (string, error) {
+	if len(s.Bearer) == 0 {
+		return "", ErrUnsupportedMech
+	}
+
+	var lastErr error
+	for _, b := range s.Bearer {
+		var username string
+		username, lastErr = b.AuthBearer(token)
+		if lastErr == nil {
+			return username, s.checkAccount(username)
+		}
+	}
+
+	return "", fmt.Errorf("no auth. provider accepted token, last err: %w", lastErr)
+}
+
+// checkAccount returns ErrAcctDisabled if any of Accounts reports the
+// account as disabled.
+func (s *SASLAuth) checkAccount(username string) error {
+	for _, a := range s.Accounts {
+		disabled, err := a.AccountDisabled(username)
+		if err != nil {
+			return exterrors.WithTemporary(err, true)
+		}
+		if disabled {
+			return ErrAcctDisabled
+		}
+	}
+	return nil
+}
+
+// scramProvider returns the first provider that has verifiers for the
+// specified SCRAM mechanism. -PLUS variants use the same verifiers as the
+// base mechanism.
+func (s *SASLAuth) scramProvider(mech string) module.SCRAMAuth {
+	mech = strings.TrimSuffix(mech, "-PLUS")
+	for _, p := range s.SCRAM {
+		for _, m := range p.SCRAMMechanisms() {
+			if m == mech {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// NormalizeUsername returns the form of the username used to compare it
+// with other usernames. Usernames that cannot be normalized are returned
+// as is.
+func NormalizeUsername(username string) string {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return username
+	}
+	return key
+}
+
+// Authorize checks whether the user authenticated as username is allowed to
+// act as identity.
+func (s *SASLAuth) Authorize(username, identity string, remoteAddr net.Addr) error {
+	normUsername := NormalizeUsername(username)
+	if NormalizeUsername(identity) == normUsername {
+		return nil
+	}
+
+	for _, imp := range s.Impersonators {
+		if NormalizeUsername(imp) != normUsername {
+			continue
+		}
+		// Deactivated accounts should not be accessible using
+		// impersonation either.
+		if err := s.checkAccount(identity); err != nil {
+			s.Log.Error("impersonated login failed", err, "username", username, "authz_id", identity, "src_ip", remoteAddr)
+			return err
+		}
+		s.Log.Msg("impersonated login", "username", username, "authz_id", identity, "src_ip", remoteAddr)
+		return nil
+	}
+
+	s.Log.Msg("authorization denied", "username", username, "authz_id", identity, "src_ip", remoteAddr)
+	return ErrAuthzDenied
+}
+
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
-func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(identity string) error) sasl.Server {
+//
+// tlsState should be nil if the connection is not protected by TLS. It is
+// used for SCRAM channel binding.
+func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, tlsState *tls.ConnectionState, successCb func(identity string) error) sasl.Server {
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
@@ -88,6 +214,10 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return ErrInvalidAuthCred
 			}
 
+			if err := s.Authorize(username, identity, remoteAddr); err != nil {
+				return err
+			}
+
 			return successCb(identity)
 		})
 	case sasl.Login:
@@ -100,6 +230,51 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 
 			return successCb(username)
 		})
+	case sasl.OAuthBearer, XOAuth2:
+		return newBearerServer(mech, func(identity, token string) error {
+			username, err := s.AuthBearer(token)
+			if err != nil {
+				s.Log.Error("authentication failed", err, "mech", mech, "src_ip", remoteAddr)
+				return ErrInvalidAuthCred
+			}
+
+			if identity == "" {
+				identity = username
+			}
+			if err := s.Authorize(username, identity, remoteAddr); err != nil {
+				return err
+			}
+
+			return successCb(identity)
+		})
+	case SCRAMSHA256, SCRAMSHA256Plus:
+		p := s.scramProvider(mech)
+		if p == nil {
+			break
+		}
+		if mech == SCRAMSHA256Plus && tlsState == nil {
+			return FailingSASLServ{Err: ErrUnsupportedMech}
+		}
+		// SCRAM verifiers are computed for SCRAM-SHA-256 and are reused
+		// for the -PLUS variant.
+		return newSCRAMServer(mech, tlsState, func(username string) (module.SCRAMCredentials, error) {
+			if err := s.checkAccount(username); err != nil {
+				s.Log.Error("authentication failed", err, "username", username, "mech", mech, "src_ip", remoteAddr)
+				return module.SCRAMCredentials{}, ErrInvalidAuthCred
+			}
+			creds, err := p.SCRAMCredentials(SCRAMSHA256, username)
+			if err != nil {
+				s.Log.Error("authentication failed", err, "username", username, "mech", mech, "src_ip", remoteAddr)
+				return module.SCRAMCredentials{}, ErrInvalidAuthCred
+			}
+			return creds, nil
+		}, func(username, identity string) error {
+			if err := s.Authorize(username, identity, remoteAddr); err != nil {
+				return err
+			}
+
+			return successCb(identity)
+		})
 	}
 	return FailingSASLServ{Err: ErrUnsupportedMech}
 }
@@ -117,6 +292,14 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 		s.Plain = append(s.Plain, plainAuth)
 		hasAny = true
 	}
+	if bearerAuth, ok := any.(module.BearerAuth); ok {
+		s.Bearer = append(s.Bearer, bearerAuth)
+		hasAny = true
+	}
+	if scramAuth, ok := any.(module.SCRAMAuth); ok && len(scramAuth.SCRAMMechanisms()) != 0 {
+		s.SCRAM = append(s.SCRAM, scramAuth)
+		hasAny = true
+	}
 
 	if !hasAny {
 		return config.NodeErr(node, "auth: specified module does not provide any SASL mechanism")
@@ -124,6 +307,22 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 	return nil
 }
 
+// AddAccountStatus adds the module that is used to check whether the account
+// is disabled by parsing the 'account_status' configuration directive.
+func (s *SASLAuth) AddAccountStatus(m *config.Map, node config.Node) error {
+	var any interface{}
+	if err := modconfig.ModuleFromNode("storage", node.Args, node, m.Globals, &any); err != nil {
+		return err
+	}
+
+	status, ok := any.(module.AccountStatus)
+	if !ok {
+		return config.NodeErr(node, "auth: specified module does not support account status checks")
+	}
+	s.Accounts = append(s.Accounts, status)
+	return nil
+}
+
 type FailingSASLServ struct{ Err error }
 
 func (s FailingSASLServ) Next([]byte) ([]byte, bool, error) {
@@ -46,13 +46,15 @@ func TestCreateSASL(t *testing.T) {
 			&mockAuth{
 				db: map[string]bool{
 					"user1": true,
+					"user2": true,
 				},
 			},
 		},
+		Impersonators: []string{"user1"},
 	}
 
 	t.Run("XWHATEVER", func(t *testing.T) {
-		srv := a.CreateSASL("XWHATEVER", &net.TCPAddr{}, func(string) error { return nil })
+		srv := a.CreateSASL("XWHATEVER", &net.TCPAddr{}, nil, func(string) error { return nil })
 		_, _, err := srv.Next([]byte(""))
 		if err == nil {
 			t.Error("No error for XWHATEVER use")
@@ -60,7 +62,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(id string) error {
 			if id != "user1" {
 				t.Fatal("Wrong auth. identities passed to callback:", id)
 			}
@@ -74,7 +76,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN with authorization identity", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string) error {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(id string) error {
 			if id != "user1a" {
 				t.Fatal("Wrong authorization identity passed:", id)
 			}
@@ -86,4 +88,269 @@ func TestCreateSASL(t *testing.T) {
 			t.Error("Unexpected error:", err)
 		}
 	})
+
+	t.Run("PLAIN with same authorization identity", func(t *testing.T) {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(id string) error {
+			if id != "user2" {
+				t.Fatal("Wrong authorization identity passed:", id)
+			}
+			return nil
+		})
+
+		_, _, err := srv.Next([]byte("user2\x00user2\x00aa"))
+		if err != nil {
+			t.Error("Unexpected error:", err)
+		}
+	})
+
+	t.Run("PLAIN with not permitted authorization identity", func(t *testing.T) {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(id string) error {
+			t.Fatal("Callback called for not permitted identity:", id)
+			return nil
+		})
+
+		_, _, err := srv.Next([]byte("user1\x00user2\x00aa"))
+		if !errors.Is(err, ErrAuthzDenied) {
+			t.Error("Expected ErrAuthzDenied, got:", err)
+		}
+	})
+}
+
+func TestSASLAuth_Authorize(t *testing.T) {
+	a := SASLAuth{
+		Log:           testutils.Logger(t, "saslauth"),
+		Impersonators: []string{"Admin@Example.org"},
+		Accounts: []module.AccountStatus{
+			mockAccountStatus{disabled: map[string]bool{"disabled@example.org": true}},
+		},
+	}
+
+	test := func(username, identity string, expectErr error) {
+		t.Helper()
+		err := a.Authorize(username, identity, &net.TCPAddr{})
+		if !errors.Is(err, expectErr) {
+			t.Errorf("%s as %s: expected %v, got %v", username, identity, expectErr, err)
+		}
+	}
+
+	test("user@example.org", "User@Example.org", nil)
+	test("admin@example.org", "user@example.org", nil)
+	test("ADMIN@example.org", "user@example.org", nil)
+	test("user@example.org", "admin@example.org", ErrAuthzDenied)
+	// Impersonation does not allow to access deactivated accounts.
+	test("admin@example.org", "disabled@example.org", ErrAcctDisabled)
+}
+
+type mockBearer struct {
+	tokens map[string]string
+}
+
+func (m mockBearer) AuthBearer(token string) (string, error) {
+	username, ok := m.tokens[token]
+	if !ok {
+		return "", errors.New("invalid token")
+	}
+	return username, nil
+}
+
+type mockProtocolAuth struct {
+	mockAuth
+	protocols map[string]bool
+}
+
+func (m mockProtocolAuth) AuthPlainProtocol(username, password, protocol string) error {
+	if !m.protocols[protocol] {
+		return errors.New("protocol not allowed")
+	}
+	return m.AuthPlain(username, password)
+}
+
+func TestSASLAuth_Protocol(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			mockProtocolAuth{
+				mockAuth:  mockAuth{db: map[string]bool{"user1": true}},
+				protocols: map[string]bool{"imap": true},
+			},
+		},
+	}
+
+	if err := a.AuthPlain("user1", "aa"); err != nil {
+		t.Error("Unexpected error without protocol:", err)
+	}
+
+	a.Protocol = "imap"
+	if err := a.AuthPlain("user1", "aa"); err != nil {
+		t.Error("Unexpected error for allowed protocol:", err)
+	}
+
+	a.Protocol = "submission"
+	srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(string) error { return nil })
+	if _, _, err := srv.Next([]byte("\x00user1\x00aa")); err == nil {
+		t.Error("No error for disallowed protocol")
+	}
+}
+
+type mockAccountStatus struct {
+	disabled map[string]bool
+}
+
+func (m mockAccountStatus) AccountDisabled(username string) (bool, error) {
+	return m.disabled[username], nil
+}
+
+func TestSASLAuth_DisabledAccount(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			mockProtocolAuth{
+				mockAuth:  mockAuth{db: map[string]bool{"user1": true, "user2": true}},
+				protocols: map[string]bool{"submission": true},
+			},
+		},
+		Bearer: []module.BearerAuth{
+			mockBearer{tokens: map[string]string{"token1": "user1", "token2": "user2"}},
+		},
+		SCRAM: []module.SCRAMAuth{
+			mockSCRAM{creds: map[string]module.SCRAMCredentials{
+				"user1": scramTestCreds("pencil"),
+				"user2": scramTestCreds("pencil"),
+			}},
+		},
+		Protocol: "submission",
+		Accounts: []module.AccountStatus{
+			mockAccountStatus{disabled: map[string]bool{"user2": true}},
+		},
+	}
+
+	if err := a.AuthPlain("user1", "aa"); err != nil {
+		t.Error("Unexpected error for enabled account:", err)
+	}
+	if err := a.AuthPlain("user2", "aa"); !errors.Is(err, ErrAcctDisabled) {
+		t.Error("Disabled account is accepted:", err)
+	}
+
+	srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(string) error { return nil })
+	if _, _, err := srv.Next([]byte("\x00user2\x00aa")); err == nil {
+		t.Error("Disabled account is accepted by PLAIN")
+	}
+
+	if _, err := a.AuthBearer("token1"); err != nil {
+		t.Error("Unexpected error for enabled account:", err)
+	}
+	if _, err := a.AuthBearer("token2"); !errors.Is(err, ErrAcctDisabled) {
+		t.Error("Disabled account is accepted by bearer auth:", err)
+	}
+
+	for _, user := range []string{"user1", "user2"} {
+		called := false
+		srv := a.CreateSASL(SCRAMSHA256, &net.TCPAddr{}, nil, func(string) error {
+			called = true
+			return nil
+		})
+		err := scramExchange(t, srv, "n,,", user, "pencil", nil)
+		if user == "user1" && (err != nil || !called) {
+			t.Error("Unexpected SCRAM error for enabled account:", err)
+		}
+		if user == "user2" && (err == nil || called) {
+			t.Error("Disabled account is accepted by SCRAM")
+		}
+	}
+}
+
+func TestCreateSASL_Bearer(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Bearer: []module.BearerAuth{
+			mockBearer{tokens: map[string]string{
+				"token1": "user1",
+				"token2": "user2",
+			}},
+		},
+		Impersonators: []string{"user1"},
+	}
+
+	test := func(mech, response, expectedID string) {
+		t.Helper()
+
+		var gotID string
+		srv := a.CreateSASL(mech, &net.TCPAddr{}, nil, func(id string) error {
+			gotID = id
+			return nil
+		})
+
+		challenge, done, err := srv.Next(nil)
+		if err != nil || done || len(challenge) != 0 {
+			t.Fatalf("%s: unexpected initial challenge: %q %v %v", mech, challenge, done, err)
+		}
+
+		challenge, done, err = srv.Next([]byte(response))
+		if expectedID == "" {
+			if err == nil && done {
+				t.Errorf("%s %q: no error", mech, response)
+				return
+			}
+			if err == nil {
+				// JSON error challenge, the client should send a dummy response.
+				if challenge[0] != '{' {
+					t.Errorf("%s %q: unexpected challenge: %q", mech, response, challenge)
+				}
+				_, done, err = srv.Next([]byte{})
+				if err == nil || !done {
+					t.Errorf("%s %q: no error after error challenge", mech, response)
+				}
+			}
+			if gotID != "" {
+				t.Errorf("%s %q: callback called", mech, response)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s %q: unexpected error: %v", mech, response, err)
+			return
+		}
+		if !done {
+			t.Errorf("%s %q: exchange not completed", mech, response)
+		}
+		if gotID != expectedID {
+			t.Errorf("%s %q: wrong identity: %s", mech, response, gotID)
+		}
+	}
+
+	test("OAUTHBEARER", "n,a=user2,\x01host=example.org\x01port=993\x01auth=Bearer token2\x01\x01", "user2")
+	test("OAUTHBEARER", "n,,\x01auth=bearer token2\x01\x01", "user2")
+	test("OAUTHBEARER", "n,a=user3,\x01auth=Bearer token1\x01\x01", "user3")
+	test("OAUTHBEARER", "n,a=user1,\x01auth=Bearer token2\x01\x01", "")
+	test("OAUTHBEARER", "n,,\x01auth=Bearer token3\x01\x01", "")
+	test("OAUTHBEARER", "p=tls-unique,,\x01auth=Bearer token2\x01\x01", "")
+	test("OAUTHBEARER", "n,,\x01auth=Basic token2\x01\x01", "")
+	test("OAUTHBEARER", "n,,\x01auth=Bearer token2", "")
+	test("OAUTHBEARER", "", "")
+
+	test("XOAUTH2", "user=user2\x01auth=Bearer token2\x01\x01", "user2")
+	test("XOAUTH2", "user=user2\x01auth=Bearer token1\x01\x01", "user2")
+	test("XOAUTH2", "user=user1\x01auth=Bearer token2\x01\x01", "")
+	test("XOAUTH2", "user=\x01auth=Bearer token2\x01\x01", "")
+	test("XOAUTH2", "auth=Bearer token2\x01\x01", "")
+}
+
+func TestDecodeSASLName(t *testing.T) {
+	for in, out := range map[string]string{
+		"user":         "user",
+		"a=2Cb=3Dc":    "a,b=c",
+		"user@example": "user@example",
+	} {
+		got, err := decodeSASLName(in)
+		if err != nil {
+			t.Errorf("decodeSASLName(%q): unexpected error: %v", in, err)
+		} else if got != out {
+			t.Errorf("decodeSASLName(%q) = %q, want %q", in, got, out)
+		}
+	}
+	for _, in := range []string{"a=", "a=2", "a=41"} {
+		if _, err := decodeSASLName(in); err == nil {
+			t.Errorf("decodeSASLName(%q): no error", in)
+		}
+	}
 }
@@ -0,0 +1,283 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const (
+	SCRAMSHA256     = "SCRAM-SHA-256"
+	SCRAMSHA256Plus = "SCRAM-SHA-256-PLUS"
+)
+
+var errMalformedSCRAM = errors.New("auth: malformed SCRAM message")
+
+// channelBinding returns the channel binding data of the specified type
+// (RFC 5929, RFC 9266).
+//
+// tls-server-end-point is not supported since the server certificate is not
+// available in the connection state.
+func channelBinding(state *tls.ConnectionState, cbType string) ([]byte, error) {
+	if state == nil {
+		return nil, errors.New("auth: channel binding requires TLS")
+	}
+	switch cbType {
+	case "tls-exporter":
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case "tls-unique":
+		if len(state.TLSUnique) == 0 {
+			return nil, errors.New("auth: tls-unique is not available for the connection")
+		}
+		return state.TLSUnique, nil
+	default:
+		return nil, fmt.Errorf("auth: unsupported channel binding type: %s", cbType)
+	}
+}
+
+// scramServer implements the server side of SCRAM-SHA-256 and
+// SCRAM-SHA-256-PLUS mechanisms (RFC 5802, RFC 7677).
+type scramServer struct {
+	plus     bool
+	tlsState *tls.ConnectionState
+
+	// credentials looks up the verifier for the authentication identity.
+	credentials func(username string) (module.SCRAMCredentials, error)
+	// authenticate is called after the client proof is verified.
+	authenticate func(username, identity string) error
+
+	step int
+
+	gs2Header       string
+	cbData          []byte
+	username, authz string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	creds           module.SCRAMCredentials
+}
+
+func newSCRAMServer(mech string, tlsState *tls.ConnectionState,
+	credentials func(username string) (module.SCRAMCredentials, error),
+	authenticate func(username, identity string) error) sasl.Server {
+	return &scramServer{
+		plus:         mech == SCRAMSHA256Plus,
+		tlsState:     tlsState,
+		credentials:  credentials,
+		authenticate: authenticate,
+	}
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		s.step++
+		challenge, err := s.clientFirst(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		return challenge, false, nil
+	case 1:
+		s.step++
+		challenge, err := s.clientFinal(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		// Server signature is sent as an additional challenge and the client
+		// responds with an empty message. Protocols used by maddy cannot
+		// send it together with the success response.
+		return challenge, false, nil
+	case 2:
+		s.step++
+		if len(response) != 0 {
+			return nil, true, sasl.ErrUnexpectedClientResponse
+		}
+		return nil, true, nil
+	default:
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+}
+
+// parseAttrs parses comma-separated list of attribute=value pairs and checks
+// that attribute names match the expected ones. Remaining attributes are
+// returned as extensions.
+func parseAttrs(msg string, expected ...byte) (values []string, extensions []string, err error) {
+	attrs := strings.Split(msg, ",")
+	if len(attrs) < len(expected) {
+		return nil, nil, errMalformedSCRAM
+	}
+	for i, name := range expected {
+		if len(attrs[i]) < 2 || attrs[i][0] != name || attrs[i][1] != '=' {
+			return nil, nil, errMalformedSCRAM
+		}
+		values = append(values, attrs[i][2:])
+	}
+	return values, attrs[len(expected):], nil
+}
+
+func (s *scramServer) clientFirst(msg string) ([]byte, error) {
+	// gs2-cbind-flag "," [ authzid ] "," client-first-message-bare
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, errMalformedSCRAM
+	}
+
+	cbFlag := parts[0]
+	switch {
+	case cbFlag == "n":
+		if s.plus {
+			return nil, errors.New("auth: channel binding is required for -PLUS mechanism")
+		}
+	case cbFlag == "y":
+		// The client supports channel binding but thinks the server does
+		// not. This is a downgrade attack if the server in fact supports it
+		// for this connection.
+		if s.plus || s.tlsState != nil {
+			return nil, errors.New("auth: channel binding downgrade detected")
+		}
+	case strings.HasPrefix(cbFlag, "p="):
+		if !s.plus {
+			return nil, errors.New("auth: channel binding is used with non-PLUS mechanism")
+		}
+		var err error
+		s.cbData, err = channelBinding(s.tlsState, cbFlag[2:])
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errMalformedSCRAM
+	}
+
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, errMalformedSCRAM
+		}
+		var err error
+		s.authz, err = decodeSASLName(parts[1][2:])
+		if err != nil {
+			return nil, errMalformedSCRAM
+		}
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	values, exts, err := parseAttrs(parts[2], 'n', 'r')
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range exts {
+		if strings.HasPrefix(ext, "m=") {
+			return nil, errors.New("auth: unsupported mandatory SCRAM extension")
+		}
+	}
+	s.username, err = decodeSASLName(values[0])
+	if err != nil {
+		return nil, err
+	}
+	if s.username == "" || values[1] == "" {
+		return nil, errMalformedSCRAM
+	}
+
+	s.creds, err = s.credentials(s.username)
+	if err != nil {
+		return nil, err
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	s.nonce = values[1] + base64.StdEncoding.EncodeToString(serverNonce)
+
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(s.creds.Salt) +
+		",i=" + strconv.Itoa(s.creds.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+func scramHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (s *scramServer) clientFinal(msg string) ([]byte, error) {
+	proofIndx := strings.LastIndex(msg, ",p=")
+	if proofIndx == -1 {
+		return nil, errMalformedSCRAM
+	}
+	withoutProof := msg[:proofIndx]
+	proof, err := base64.StdEncoding.DecodeString(msg[proofIndx+3:])
+	if err != nil {
+		return nil, errMalformedSCRAM
+	}
+
+	values, _, err := parseAttrs(withoutProof, 'c', 'r')
+	if err != nil {
+		return nil, err
+	}
+
+	expectedCB := base64.StdEncoding.EncodeToString(append([]byte(s.gs2Header), s.cbData...))
+	if subtle.ConstantTimeCompare([]byte(values[0]), []byte(expectedCB)) != 1 {
+		return nil, errors.New("auth: channel binding mismatch")
+	}
+	if values[1] != s.nonce {
+		return nil, errors.New("auth: nonce mismatch")
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + withoutProof
+	clientSignature := scramHMAC(s.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, ErrInvalidAuthCred
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.creds.StoredKey) != 1 {
+		return nil, ErrInvalidAuthCred
+	}
+
+	identity := s.authz
+	if identity == "" {
+		identity = s.username
+	}
+	if err := s.authenticate(s.username, identity); err != nil {
+		return nil, err
+	}
+
+	serverSignature := scramHMAC(s.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
@@ -0,0 +1,215 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+type mockSCRAM struct {
+	creds map[string]module.SCRAMCredentials
+}
+
+func (m mockSCRAM) SCRAMMechanisms() []string {
+	return []string{SCRAMSHA256}
+}
+
+func (m mockSCRAM) SCRAMCredentials(_, username string) (module.SCRAMCredentials, error) {
+	creds, ok := m.creds[username]
+	if !ok {
+		return module.SCRAMCredentials{}, errors.New("unknown user")
+	}
+	return creds, nil
+}
+
+func scramSaltedPassword(pass string, salt []byte, iter int) []byte {
+	return pbkdf2.Key([]byte(pass), salt, iter, sha256.Size, sha256.New)
+}
+
+func scramTestCreds(pass string) module.SCRAMCredentials {
+	salt := []byte("saltsaltsaltsalt")
+	salted := scramSaltedPassword(pass, salt, 4096)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return module.SCRAMCredentials{
+		Iterations: 4096,
+		Salt:       salt,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}
+}
+
+// scramExchange runs the client side of SCRAM-SHA-256 against the server.
+func scramExchange(t *testing.T, srv sasl.Server, gs2Header, username, pass string, cbData []byte) error {
+	t.Helper()
+
+	if _, _, err := srv.Next(nil); err != nil {
+		return err
+	}
+
+	clientNonce := "rOprNGfwEbeRWgbNEkqO"
+	clientFirstBare := "n=" + username + ",r=" + clientNonce
+	serverFirst, done, err := srv.Next([]byte(gs2Header + clientFirstBare))
+	if err != nil {
+		return err
+	}
+	if done {
+		t.Fatal("Exchange completed after client-first message")
+	}
+
+	var (
+		nonce string
+		salt  []byte
+		iter  int
+	)
+	for _, attr := range strings.Split(string(serverFirst), ",") {
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt, _ = base64.StdEncoding.DecodeString(attr[2:])
+		case 'i':
+			iter, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, clientNonce) || len(nonce) == len(clientNonce) {
+		t.Fatalf("Malformed server nonce: %s", nonce)
+	}
+	if iter == 0 || salt == nil {
+		t.Fatalf("Malformed server-first message: %s", serverFirst)
+	}
+
+	cb := base64.StdEncoding.EncodeToString(append([]byte(gs2Header), cbData...))
+	withoutProof := "c=" + cb + ",r=" + nonce
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+
+	salted := scramSaltedPassword(pass, salt, iter)
+	clientKey := scramHMAC(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	serverFinal, done, err := srv.Next([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	if done {
+		t.Fatal("Exchange completed without server-final message")
+	}
+	serverSignature := scramHMAC(scramHMAC(salted, "Server Key"), authMessage)
+	if !hmac.Equal(serverFinal, []byte("v="+base64.StdEncoding.EncodeToString(serverSignature))) {
+		t.Fatalf("Wrong server signature: %s", serverFinal)
+	}
+
+	_, done, err = srv.Next([]byte{})
+	if err != nil {
+		return err
+	}
+	if !done {
+		t.Fatal("Exchange not completed")
+	}
+	return nil
+}
+
+func TestCreateSASL_SCRAM(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		SCRAM: []module.SCRAMAuth{
+			mockSCRAM{creds: map[string]module.SCRAMCredentials{
+				"user1": scramTestCreds("pencil"),
+				"user2": scramTestCreds("pencil2"),
+			}},
+		},
+		Impersonators: []string{"user1"},
+	}
+
+	mechs := a.SASLMechanisms()
+	if len(mechs) != 2 || mechs[0] != SCRAMSHA256 || mechs[1] != SCRAMSHA256Plus {
+		t.Fatalf("Wrong mechanisms list: %v", mechs)
+	}
+
+	tlsState := &tls.ConnectionState{
+		HandshakeComplete: true,
+		TLSUnique:         []byte("0123456789ab"),
+	}
+
+	test := func(mech string, tlsState *tls.ConnectionState, gs2Header, username, pass string, cbData []byte, expectedID string) {
+		t.Helper()
+
+		var gotID string
+		srv := a.CreateSASL(mech, &net.TCPAddr{}, tlsState, func(id string) error {
+			gotID = id
+			return nil
+		})
+
+		err := scramExchange(t, srv, gs2Header, username, pass, cbData)
+		if expectedID == "" {
+			if err == nil {
+				t.Errorf("%s %s %s: no error", mech, gs2Header, username)
+			}
+			if gotID != "" {
+				t.Errorf("%s %s %s: callback called", mech, gs2Header, username)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s %s %s: unexpected error: %v", mech, gs2Header, username, err)
+			return
+		}
+		if gotID != expectedID {
+			t.Errorf("%s %s %s: wrong identity: %s", mech, gs2Header, username, gotID)
+		}
+	}
+
+	test(SCRAMSHA256, nil, "n,,", "user1", "pencil", nil, "user1")
+	test(SCRAMSHA256, nil, "y,,", "user1", "pencil", nil, "user1")
+	test(SCRAMSHA256, tlsState, "n,,", "user2", "pencil2", nil, "user2")
+	test(SCRAMSHA256, nil, "n,a=user2,", "user1", "pencil", nil, "user2")
+	test(SCRAMSHA256, nil, "n,a=user1,", "user2", "pencil2", nil, "")
+	test(SCRAMSHA256, nil, "n,,", "user1", "pencil2", nil, "")
+	test(SCRAMSHA256, nil, "n,,", "user3", "pencil", nil, "")
+
+	// Client supports channel binding but the server did not advertise it
+	// for a TLS connection.
+	test(SCRAMSHA256, tlsState, "y,,", "user1", "pencil", nil, "")
+	// Channel binding with non-PLUS mechanism.
+	test(SCRAMSHA256, tlsState, "p=tls-unique,,", "user1", "pencil", tlsState.TLSUnique, "")
+
+	test(SCRAMSHA256Plus, tlsState, "p=tls-unique,,", "user1", "pencil", tlsState.TLSUnique, "user1")
+	test(SCRAMSHA256Plus, tlsState, "p=tls-unique,,", "user1", "pencil", []byte("wrong"), "")
+	test(SCRAMSHA256Plus, tlsState, "p=tls-server-end-point,,", "user1", "pencil", nil, "")
+	test(SCRAMSHA256Plus, tlsState, "n,,", "user1", "pencil", nil, "")
+	test(SCRAMSHA256Plus, nil, "p=tls-unique,,", "user1", "pencil", nil, "")
+}
@@ -0,0 +1,123 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Parameters are fixed to the values supported by all authenticator
+// applications.
+const (
+	Digits     = 6
+	Period     = 30 * time.Second
+	SecretSize = 20
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random base32-encoded secret.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return "", fmt.Errorf("totp: failed to generate secret: %w", err)
+	}
+	return b32.EncodeToString(secret), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	return b32.DecodeString(secret)
+}
+
+// hotp computes the HOTP value (RFC 4226) for the counter.
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1000000)
+}
+
+// Code returns the TOTP code (RFC 6238) for the specified time.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", fmt.Errorf("totp: malformed secret: %w", err)
+	}
+	return hotp(key, uint64(t.Unix())/uint64(Period/time.Second)), nil
+}
+
+// Validate checks whether the code is valid at the specified time, allowing
+// skew periods of clock difference in both directions.
+func Validate(secret, code string, now time.Time, skew int) (bool, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return false, fmt.Errorf("totp: malformed secret: %w", err)
+	}
+	if len(code) != Digits {
+		return false, nil
+	}
+
+	counter := int64(now.Unix()) / int64(Period/time.Second)
+	ok := 0
+	for i := -skew; i <= skew; i++ {
+		if counter+int64(i) < 0 {
+			continue
+		}
+		expected := hotp(key, uint64(counter+int64(i)))
+		ok |= subtle.ConstantTimeCompare([]byte(expected), []byte(code))
+	}
+	return ok == 1, nil
+}
+
+// KeyURI returns the otpauth:// URI used to load the secret into
+// authenticator applications (usually via a QR code).
+func KeyURI(issuer, account, secret string) string {
+	label := url.PathEscape(account)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	if issuer != "" {
+		params.Set("issuer", issuer)
+	}
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(Digits))
+	params.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
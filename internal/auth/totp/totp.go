@@ -0,0 +1,213 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package totp implements the auth.totp module that requires the TOTP code
+// (RFC 6238) in addition to the password for selected accounts.
+//
+// The code is appended to the password by the client, so the module works
+// with any protocol and SASL mechanism that transfers the password.
+package totp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"golang.org/x/text/secure/precis"
+)
+
+const modName = "auth.totp"
+
+type Auth struct {
+	instName string
+
+	auth    module.PlainAuth
+	secrets module.Table
+	issuer  string
+	skew    int
+
+	log log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Auth{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	var hostname string
+
+	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		return modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &a.auth)
+	})
+	cfg.Custom("secrets", false, true, nil, modconfig.TableDirective, &a.secrets)
+	cfg.String("issuer", false, false, "", &a.issuer)
+	cfg.Int("skew", false, false, 1, &a.skew)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if a.auth == nil {
+		return fmt.Errorf("%s: auth directive is required", modName)
+	}
+	if a.skew < 0 {
+		return fmt.Errorf("%s: skew should not be negative", modName)
+	}
+	if a.issuer == "" {
+		a.issuer = hostname
+	}
+
+	return nil
+}
+
+func (a *Auth) secret(username string) (key, secret string, enabled bool, err error) {
+	key, err = precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	secret, ok, err := a.secrets.Lookup(context.TODO(), key)
+	if err != nil {
+		return "", "", false, fmt.Errorf("%s: secret lookup: %w", modName, err)
+	}
+	return key, secret, ok, nil
+}
+
+// AuthPlain checks the password using the underlying auth. provider.
+//
+// For accounts that have the TOTP secret, the last Digits characters of the
+// password should be the current TOTP code.
+func (a *Auth) AuthPlain(username, password string) error {
+	_, secret, enabled, err := a.secret(username)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return a.auth.AuthPlain(username, password)
+	}
+
+	if len(password) < Digits {
+		return fmt.Errorf("%s: missing TOTP code", modName)
+	}
+	code := password[len(password)-Digits:]
+	password = password[:len(password)-Digits]
+
+	// Password is always checked first so the response time does not
+	// reveal whether the TOTP code is correct.
+	if err := a.auth.AuthPlain(username, password); err != nil {
+		return err
+	}
+
+	ok, err := Validate(secret, code, time.Now(), a.skew)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if !ok {
+		a.log.DebugMsg("invalid TOTP code", "username", username)
+		return fmt.Errorf("%s: invalid TOTP code", modName)
+	}
+	return nil
+}
+
+// Lookup checks whether the account is known to the underlying auth.
+// provider, so the module can be used as a table in the same way.
+func (a *Auth) Lookup(ctx context.Context, username string) (string, bool, error) {
+	tbl, ok := a.auth.(module.Table)
+	if !ok {
+		return "", false, errors.New("totp: underlying auth. provider does not support lookups")
+	}
+	return tbl.Lookup(ctx, username)
+}
+
+func (a *Auth) mutableSecrets() (module.MutableTable, error) {
+	tbl, ok := a.secrets.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("%s: secrets table is not mutable, no management functionality available", modName)
+	}
+	return tbl, nil
+}
+
+func (a *Auth) EnableTOTP(username string) (string, error) {
+	tbl, err := a.mutableSecrets()
+	if err != nil {
+		return "", err
+	}
+	key, _, enabled, err := a.secret(username)
+	if err != nil {
+		return "", err
+	}
+	if enabled {
+		return "", fmt.Errorf("%s: TOTP is already enabled for %s", modName, key)
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	if err := tbl.SetKey(key, secret); err != nil {
+		return "", fmt.Errorf("%s: enable %s: %w", modName, key, err)
+	}
+	return KeyURI(a.issuer, key, secret), nil
+}
+
+func (a *Auth) DisableTOTP(username string) error {
+	tbl, err := a.mutableSecrets()
+	if err != nil {
+		return err
+	}
+	key, _, enabled, err := a.secret(username)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return fmt.Errorf("%s: TOTP is not enabled for %s", modName, key)
+	}
+	if err := tbl.RemoveKey(key); err != nil {
+		return fmt.Errorf("%s: disable %s: %w", modName, key, err)
+	}
+	return nil
+}
+
+func (a *Auth) TOTPEnabled(username string) (bool, error) {
+	_, _, enabled, err := a.secret(username)
+	return enabled, err
+}
+
+func init() {
+	module.Register(modName, New)
+}
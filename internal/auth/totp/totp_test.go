@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package totp
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module/moduletest"
+)
+
+// Base32 encoding of the RFC 6238 SHA1 test key "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// RFC 6238, Appendix B, truncated to 6 digits.
+	for _, c := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		code, err := Code(rfcSecret, time.Unix(c.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != c.code {
+			t.Errorf("%d: expected %s, got %s", c.unix, c.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	check := func(code string, skew int, expected bool) {
+		t.Helper()
+		ok, err := Validate(rfcSecret, code, now, skew)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Errorf("%s (skew %d): expected %v, got %v", code, skew, expected, ok)
+		}
+	}
+
+	prev, _ := Code(rfcSecret, now.Add(-Period))
+	next, _ := Code(rfcSecret, now.Add(Period))
+	far, _ := Code(rfcSecret, now.Add(-2*Period))
+
+	check("050471", 0, true)
+	check(prev, 0, false)
+	check(prev, 1, true)
+	check(next, 1, true)
+	check(far, 1, false)
+	check("50471", 1, false)
+	check("", 1, false)
+
+	if _, err := Validate("!!!", "050471", now, 1); err == nil {
+		t.Error("No error for malformed secret")
+	}
+}
+
+func TestKeyURI(t *testing.T) {
+	u, err := url.Parse(KeyURI("mx.example.org", "user@example.org", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/mx.example.org:user@example.org" {
+		t.Error("Wrong URI:", u)
+	}
+	if u.Query().Get("secret") != rfcSecret || u.Query().Get("issuer") != "mx.example.org" {
+		t.Error("Wrong URI parameters:", u.Query())
+	}
+}
+
+type mutableTable struct {
+	moduletest.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m.M))
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func TestAuth(t *testing.T) {
+	secrets := mutableTable{moduletest.Table{M: map[string]string{}}}
+	underlying := &moduletest.Auth{}
+	if err := underlying.CreateUser("user1", "password1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := underlying.CreateUser("user2", "password2"); err != nil {
+		t.Fatal(err)
+	}
+	a := &Auth{
+		auth:    underlying,
+		secrets: secrets,
+		issuer:  "mx.example.org",
+		skew:    1,
+	}
+
+	keyURI, err := a.EnableTOTP("User1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(keyURI, "mx.example.org:user1") {
+		t.Error("Wrong key URI:", keyURI)
+	}
+	if _, err := a.EnableTOTP("user1"); err == nil {
+		t.Error("TOTP enabled twice")
+	}
+	if enabled, err := a.TOTPEnabled("user1"); err != nil || !enabled {
+		t.Error("TOTP is not enabled:", err)
+	}
+
+	code, err := Code(secrets.M["user1"], time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongCode := "000000"
+	if code == wrongCode {
+		wrongCode = "111111"
+	}
+
+	check := func(username, password string, ok bool) {
+		t.Helper()
+		err := a.AuthPlain(username, password)
+		if (err == nil) != ok {
+			t.Errorf("%s %s: ok=%v, err: %v", username, password, ok, err)
+		}
+	}
+
+	check("user1", "password1"+code, true)
+	check("user1", "password1", false)
+	check("user1", "password1"+wrongCode, false)
+	check("user1", "password2"+code, false)
+	check("user1", code, false)
+	check("user2", "password2", true)
+	check("user2", "password1", false)
+
+	if _, ok, err := a.Lookup(context.Background(), "user1"); err != nil || !ok {
+		t.Error("Lookup failed:", err)
+	}
+
+	if err := a.DisableTOTP("user1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.DisableTOTP("user1"); err == nil {
+		t.Error("TOTP disabled twice")
+	}
+	check("user1", "password1", true)
+}
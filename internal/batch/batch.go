@@ -0,0 +1,313 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package batch implements the archive format used to transfer messages in
+// batches over intermittent links (rsync, ssh, removable media).
+//
+// The archive is a tar file with a pair of entries per message: ID.json with
+// the message envelope and ID.eml with the message itself. The archive is
+// accompanied by the detached Ed25519 signature stored in the file with the
+// same name and the ".sig" extension. The signature file is written before
+// the archive is put into place, so archives without signature are either
+// incomplete or forged.
+package batch
+
+import (
+	"archive/tar"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ArchiveExt   = ".tar"
+	SignatureExt = ".sig"
+)
+
+var ErrBadSignature = errors.New("batch: signature verification failed")
+
+// Envelope is the message envelope stored in the archive.
+type Envelope struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	Rcpts    []string  `json:"rcpts"`
+	UTF8     bool      `json:"smtputf8,omitempty"`
+	Received time.Time `json:"received"`
+}
+
+// Entry is the message to put into the archive.
+type Entry struct {
+	Envelope Envelope
+	// Path is the file containing the message.
+	Path string
+}
+
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// WriteArchive writes the signed archive with the specified entries into
+// the directory. The name of the created archive is returned.
+func WriteArchive(dir string, key ed25519.PrivateKey, entries []Entry) (string, error) {
+	name := fmt.Sprintf("batch-%d%s", time.Now().UnixNano(), ArchiveExt)
+	tmpPath := filepath.Join(dir, "."+name+".tmp")
+	finalPath := filepath.Join(dir, name)
+
+	if err := writeTar(tmpPath, entries); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	hash, err := fileHash(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, hash))
+	if err := ioutil.WriteFile(finalPath+SignatureExt, []byte(sig+"\n"), 0o644); err != nil {
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		os.Remove(tmpPath)
+		os.Remove(finalPath + SignatureExt)
+		return "", err
+	}
+	return name, nil
+}
+
+func writeTar(path string, entries []Entry) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := tar.NewWriter(f)
+	for _, e := range entries {
+		envBlob, err := json.Marshal(e.Envelope)
+		if err != nil {
+			return err
+		}
+		if err := w.WriteHeader(&tar.Header{
+			Name:    e.Envelope.ID + ".json",
+			Mode:    0o644,
+			Size:    int64(len(envBlob)),
+			ModTime: e.Envelope.Received,
+		}); err != nil {
+			return err
+		}
+		if _, err := w.Write(envBlob); err != nil {
+			return err
+		}
+
+		if err := writeFileEntry(w, e.Envelope.ID+".eml", e.Path, e.Envelope.Received); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func writeFileEntry(w *tar.Writer, name, path string, modTime time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := w.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    info.Size(),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// VerifyArchive checks the archive signature against the list of trusted
+// keys.
+func VerifyArchive(path string, keys []ed25519.PublicKey) error {
+	sigBlob, err := ioutil.ReadFile(path + SignatureExt)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigBlob)))
+	if err != nil {
+		return ErrBadSignature
+	}
+	hash, err := fileHash(path)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if ed25519.Verify(key, hash, sig) {
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
+
+// ReadArchive calls fn for each message in the archive. The signature is not
+// checked, VerifyArchive should be called first.
+//
+// If fn returns an error, iteration is stopped and the error is returned.
+func ReadArchive(path string, fn func(env Envelope, msg io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := tar.NewReader(f)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(hdr.Name, ".json") {
+			return fmt.Errorf("batch: unexpected entry: %s", hdr.Name)
+		}
+
+		var env Envelope
+		if err := json.NewDecoder(r).Decode(&env); err != nil {
+			return fmt.Errorf("batch: malformed envelope %s: %w", hdr.Name, err)
+		}
+		if env.ID+".json" != hdr.Name {
+			return fmt.Errorf("batch: envelope ID mismatch: %s", hdr.Name)
+		}
+
+		hdr, err = r.Next()
+		if err != nil {
+			return fmt.Errorf("batch: missing message for %s: %w", env.ID, err)
+		}
+		if hdr.Name != env.ID+".eml" {
+			return fmt.Errorf("batch: unexpected entry: %s", hdr.Name)
+		}
+		if err := fn(env, r); err != nil {
+			return err
+		}
+	}
+}
+
+// LoadPrivateKey reads the PEM-encoded Ed25519 private key from the file.
+//
+// If the file does not exist, the new key is generated and written to it,
+// the public key is written to the file with the ".pub" extension.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	pemBlob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return generateKey(path)
+		}
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBlob)
+	if block == nil {
+		return nil, fmt.Errorf("batch: %s: invalid PEM block", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("batch: %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("batch: %s: not an Ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+func generateKey(path string) (ed25519.PrivateKey, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyBlob, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: keyBlob,
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := ioutil.WriteFile(path+".pub", []byte(FormatPublicKey(pub)+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// FormatPublicKey returns the base64-encoded public key, as accepted by
+// ParsePublicKey.
+func FormatPublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	blob, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(blob) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("batch: malformed public key: %s", s)
+	}
+	return ed25519.PublicKey(blob), nil
+}
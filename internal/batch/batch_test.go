@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package batch
+
+import (
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-batch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := LoadPrivateKey(filepath.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Generated key is loaded back.
+	loaded, err := LoadPrivateKey(filepath.Join(dir, "key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(loaded) {
+		t.Fatal("generated key is not saved")
+	}
+	pubBlob, err := ioutil.ReadFile(filepath.Join(dir, "key.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParsePublicKey(string(pubBlob[:len(pubBlob)-1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := map[string]string{
+		"msg1": "Subject: 1\r\n\r\nfoo\r\n",
+		"msg2": "Subject: 2\r\n\r\nbar\r\n",
+	}
+	var entries []Entry
+	for _, id := range []string{"msg1", "msg2"} {
+		path := filepath.Join(dir, id+".eml")
+		if err := ioutil.WriteFile(path, []byte(msgs[id]), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, Entry{
+			Envelope: Envelope{
+				ID:       id,
+				From:     "from@example.org",
+				Rcpts:    []string{"rcpt@example.com"},
+				Received: time.Now(),
+			},
+			Path: path,
+		})
+	}
+
+	name, err := WriteArchive(dir, key, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+
+	if err := VerifyArchive(path, []ed25519.PublicKey{pub}); err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if err := VerifyArchive(path, []ed25519.PublicKey{otherPub}); err != ErrBadSignature {
+		t.Fatal("archive is accepted with a wrong key:", err)
+	}
+
+	read := map[string]string{}
+	err = ReadArchive(path, func(env Envelope, r io.Reader) error {
+		blob, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if env.From != "from@example.org" || len(env.Rcpts) != 1 {
+			t.Error("wrong envelope:", env)
+		}
+		read[env.ID] = string(blob)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, msg := range msgs {
+		if read[id] != msg {
+			t.Errorf("%s: want %q, got %q", id, msg, read[id])
+		}
+	}
+
+	// Modified archive is rejected.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("x"))
+	f.Close()
+	if err := VerifyArchive(path, []ed25519.PublicKey{pub}); err != ErrBadSignature {
+		t.Fatal("modified archive is accepted:", err)
+	}
+}
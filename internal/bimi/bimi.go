@@ -0,0 +1,232 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package bimi implements receiver-side processing of Brand Indicators for
+// Message Identification (BIMI) as described in
+// draft-brand-indicators-for-message-identification.
+//
+// Evaluation is performed only for messages that passed DMARC with an
+// enforcement policy. Verified Mark Certificates (a= tag) are not validated.
+package bimi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+const DefaultSelector = "default"
+
+type Resolver interface {
+	LookupTXT(context.Context, string) ([]string, error)
+}
+
+// Record is the parsed BIMI assertion record.
+type Record struct {
+	// Location is the URL of the SVG indicator (l= tag). Empty if the domain
+	// declined to participate in BIMI.
+	Location string
+	// Authority is the URL of the authority evidence document (a= tag).
+	Authority string
+}
+
+var ErrNoRecord = errors.New("bimi: no record")
+
+// ParseRecord parses the BIMI assertion record.
+func ParseRecord(txt string) (*Record, error) {
+	parts := strings.Split(txt, ";")
+	if strings.TrimSpace(parts[0]) != "v=BIMI1" {
+		return nil, errors.New("bimi: v=BIMI1 tag is missing")
+	}
+
+	rec := &Record{}
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("bimi: malformed tag: %s", part)
+		}
+		key := strings.TrimSpace(part[:eq])
+		val := strings.TrimSpace(part[eq+1:])
+
+		switch key {
+		case "l":
+			rec.Location = val
+		case "a":
+			rec.Authority = val
+		default:
+			// Unknown tags must be ignored.
+			continue
+		}
+		if val != "" {
+			if err := checkURL(val); err != nil {
+				return nil, fmt.Errorf("bimi: %s tag: %w", key, err)
+			}
+		}
+	}
+	return rec, nil
+}
+
+func checkURL(val string) error {
+	u, err := url.Parse(val)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" {
+		return errors.New("only https URLs are allowed")
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
+
+func lookupRecord(ctx context.Context, r Resolver, name string) (*Record, error) {
+	txts, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	var found []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=BIMI1") {
+			found = append(found, txt)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, ErrNoRecord
+	case 1:
+		return ParseRecord(found[0])
+	default:
+		return nil, errors.New("bimi: multiple records found")
+	}
+}
+
+// LookupRecord fetches the BIMI record for the specified domain using the
+// specified selector, falling back to the organizational domain if there is
+// no record for the domain itself.
+//
+// It returns the domain the record was found at.
+func LookupRecord(ctx context.Context, r Resolver, selector, domain string) (string, *Record, error) {
+	domain = strings.TrimSuffix(domain, ".")
+
+	rec, err := lookupRecord(ctx, r, selector+"._bimi."+domain)
+	if err != ErrNoRecord {
+		return domain, rec, err
+	}
+
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil || dns.Equal(orgDomain, domain) {
+		return "", nil, ErrNoRecord
+	}
+	rec, err = lookupRecord(ctx, r, selector+"._bimi."+orgDomain)
+	return orgDomain, rec, err
+}
+
+// Eligible checks whether the message with the specified DMARC evaluation
+// result can have a brand indicator displayed.
+//
+// The message should pass DMARC and the policy for the domain should be
+// enforced for all messages (p=quarantine or p=reject, no pct= sampling).
+func Eligible(res dmarc.EvalResult) error {
+	if res.Authres.Value != authres.ResultPass {
+		return errors.New("DMARC check not passed")
+	}
+	rec := res.Record
+	if rec == nil {
+		return errors.New("no DMARC policy")
+	}
+	if rec.Percent != nil && *rec.Percent != 100 {
+		return errors.New("DMARC policy is not applied to all messages")
+	}
+
+	policy := rec.Policy
+	if !dns.Equal(res.PolicyDomain, res.Authres.From) && rec.SubdomainPolicy != "" {
+		policy = rec.SubdomainPolicy
+	}
+	if policy != dmarc.PolicyQuarantine && policy != dmarc.PolicyReject {
+		return errors.New("DMARC policy is not enforced")
+	}
+	return nil
+}
+
+// Selector returns the selector specified in the BIMI-Selector field or
+// DefaultSelector if it is missing or malformed.
+func Selector(hdr textproto.Header) string {
+	val := hdr.Get("BIMI-Selector")
+	if val == "" {
+		return DefaultSelector
+	}
+
+	parts := strings.Split(val, ";")
+	if strings.TrimSpace(parts[0]) != "v=BIMI1" {
+		return DefaultSelector
+	}
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "s=") {
+			continue
+		}
+		sel := strings.TrimSpace(strings.TrimPrefix(part, "s="))
+		if !validSelector(sel) {
+			return DefaultSelector
+		}
+		return strings.ToLower(sel)
+	}
+	return DefaultSelector
+}
+
+func validSelector(sel string) bool {
+	if sel == "" || len(sel) > 63 {
+		return false
+	}
+	for _, ch := range sel {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-' || ch == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// StripHeaders removes header fields that should be only added by the
+// receiving MTA. Senders could otherwise supply them to display an arbitrary
+// indicator.
+func StripHeaders(hdr *textproto.Header) {
+	hdr.Del("BIMI-Location")
+	hdr.Del("BIMI-Indicator")
+}
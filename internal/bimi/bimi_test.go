@@ -0,0 +1,257 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bimi
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/dmarc"
+)
+
+const testSVG = `<?xml version="1.0" encoding="UTF-8"?>
+<svg xmlns="http://www.w3.org/2000/svg" version="1.2" baseProfile="tiny-ps" viewBox="0 0 10 10">
+<title>Example</title>
+<rect width="10" height="10" fill="#f00"/>
+</svg>`
+
+func TestParseRecord(t *testing.T) {
+	test := func(txt string, loc, authority string, fail bool) {
+		t.Helper()
+		rec, err := ParseRecord(txt)
+		if fail {
+			if err == nil {
+				t.Errorf("expected %q to be rejected", txt)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", txt, err)
+			return
+		}
+		if rec.Location != loc || rec.Authority != authority {
+			t.Errorf("wrong record for %q: %+v", txt, rec)
+		}
+	}
+
+	test("v=BIMI1; l=https://example.org/logo.svg", "https://example.org/logo.svg", "", false)
+	test("v=BIMI1;l=https://example.org/logo.svg;a=https://example.org/vmc.pem;", "https://example.org/logo.svg", "https://example.org/vmc.pem", false)
+	test("v=BIMI1; l=; a=;", "", "", false)
+	test("v=BIMI1; l=https://example.org/logo.svg; x=unknown", "https://example.org/logo.svg", "", false)
+	test("l=https://example.org/logo.svg; v=BIMI1", "", "", true)
+	test("v=BIMI1; l=http://example.org/logo.svg", "", "", true)
+	test("v=BIMI1; l", "", "", true)
+}
+
+func TestSelector(t *testing.T) {
+	test := func(field, sel string) {
+		t.Helper()
+		hdr := textproto.Header{}
+		if field != "" {
+			hdr.Add("BIMI-Selector", field)
+		}
+		if got := Selector(hdr); got != sel {
+			t.Errorf("Selector(%q) = %q, want %q", field, got, sel)
+		}
+	}
+
+	test("", "default")
+	test("v=BIMI1; s=brand", "brand")
+	test("v=BIMI1; s=Brand2;", "brand2")
+	test("s=brand", "default")
+	test("v=BIMI1; s=../../x", "default")
+}
+
+func TestValidateIndicator(t *testing.T) {
+	test := func(svg string, ok bool) {
+		t.Helper()
+		err := ValidateIndicator([]byte(svg))
+		if ok && err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if !ok && err == nil {
+			t.Errorf("expected %q to be rejected", svg)
+		}
+	}
+
+	test(testSVG, true)
+	test(`<svg baseProfile="tiny"></svg>`, false)
+	test(`<html><svg baseProfile="tiny-ps"></svg></html>`, false)
+	test(`<svg baseProfile="tiny-ps"><script>alert(1)</script></svg>`, false)
+	test(`<svg baseProfile="tiny-ps"><use href="https://example.org/x.svg#a"/></svg>`, false)
+	test(`<svg baseProfile="tiny-ps"><use href="#a"/></svg>`, true)
+	test(`<svg baseProfile="tiny-ps" onload="x()"></svg>`, false)
+	test(`<!DOCTYPE svg [<!ENTITY x SYSTEM "file:///etc/passwd">]><svg baseProfile="tiny-ps"></svg>`, false)
+	test(`<svg baseProfile="tiny-ps">`, false)
+	test(``, false)
+}
+
+func passingResult(domain, policyDomain, policy string) dmarc.EvalResult {
+	rec := &dmarc.Record{Policy: dmarc.Policy(policy)}
+	return dmarc.EvalResult{
+		Authres:      authres.DMARCResult{Value: authres.ResultPass, From: domain},
+		DKIMResult:   authres.DKIMResult{Value: authres.ResultPass, Domain: domain},
+		DKIMAligned:  true,
+		PolicyDomain: policyDomain,
+		Record:       rec,
+	}
+}
+
+func TestEligible(t *testing.T) {
+	if err := Eligible(passingResult("example.org", "example.org", "reject")); err != nil {
+		t.Error("p=reject:", err)
+	}
+	if err := Eligible(passingResult("example.org", "example.org", "quarantine")); err != nil {
+		t.Error("p=quarantine:", err)
+	}
+	if err := Eligible(passingResult("example.org", "example.org", "none")); err == nil {
+		t.Error("p=none is accepted")
+	}
+
+	res := passingResult("example.org", "example.org", "reject")
+	res.Authres.Value = authres.ResultFail
+	if err := Eligible(res); err == nil {
+		t.Error("DMARC fail is accepted")
+	}
+
+	res = passingResult("example.org", "example.org", "reject")
+	pct := 50
+	res.Record.Percent = &pct
+	if err := Eligible(res); err == nil {
+		t.Error("pct=50 is accepted")
+	}
+
+	res = passingResult("mail.example.org", "example.org", "reject")
+	res.Record.SubdomainPolicy = dmarc.PolicyNone
+	if err := Eligible(res); err == nil {
+		t.Error("sp=none is accepted for subdomain")
+	}
+
+	res = passingResult("example.org", "example.org", "reject")
+	res.Record = nil
+	if err := Eligible(res); err == nil {
+		t.Error("missing policy is accepted")
+	}
+}
+
+func readHeader(t *testing.T, s string) textproto.Header {
+	t.Helper()
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr
+}
+
+func TestEvaluate(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/logo.svg":
+			_, _ = w.Write([]byte(testSVG))
+		case "/bad.svg":
+			_, _ = w.Write([]byte(`<svg baseProfile="tiny"></svg>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	fetcher := NewFetcher()
+	fetcher.Client = srv.Client()
+
+	zones := map[string]mockdns.Zone{
+		"default._bimi.example.org.": {
+			TXT: []string{"v=BIMI1; l=" + srv.URL + "/logo.svg"},
+		},
+		"brand._bimi.example.org.": {
+			TXT: []string{"v=BIMI1; l=" + srv.URL + "/bad.svg"},
+		},
+		"default._bimi.example.com.": {
+			TXT: []string{"v=BIMI1; l=;"},
+		},
+	}
+	r := &mockdns.Resolver{Zones: zones}
+	hdr := readHeader(t, "From: test@example.org\r\n\r\n")
+
+	res := Evaluate(context.Background(), r, fetcher, hdr, passingResult("example.org", "example.org", "reject"))
+	if res.Authres.Value != authres.ResultPass {
+		t.Fatalf("unexpected result: %v (%s)", res.Authres.Value, res.Reason)
+	}
+	if string(res.Indicator) != testSVG {
+		t.Error("wrong indicator")
+	}
+
+	out := readHeader(t, "BIMI-Location: v=BIMI1; l=https://evil.example/logo.svg\r\nBIMI-Indicator: AAAA\r\nFrom: test@example.org\r\n\r\n")
+	StripHeaders(&out)
+	res.AddHeaders(&out)
+	if got := out.Get("BIMI-Location"); got != "v=BIMI1; l="+srv.URL+"/logo.svg" {
+		t.Error("wrong BIMI-Location:", got)
+	}
+	if got := out.Get("BIMI-Indicator"); got != base64.StdEncoding.EncodeToString([]byte(testSVG)) {
+		t.Error("wrong BIMI-Indicator:", got)
+	}
+	if n := len(out.Values("BIMI-Location")); n != 1 {
+		t.Error("client-supplied BIMI-Location is not removed")
+	}
+
+	// Subdomain without own record uses organizational domain record.
+	res = Evaluate(context.Background(), r, nil, readHeader(t, "From: test@mail.example.org\r\n\r\n"),
+		passingResult("mail.example.org", "example.org", "reject"))
+	if res.Authres.Value != authres.ResultPass || res.Domain != "example.org" || res.Indicator != nil {
+		t.Errorf("unexpected result for subdomain: %+v", res)
+	}
+
+	// Selector from BIMI-Selector, indicator is invalid.
+	res = Evaluate(context.Background(), r, fetcher, readHeader(t, "BIMI-Selector: v=BIMI1; s=brand\r\nFrom: test@example.org\r\n\r\n"),
+		passingResult("example.org", "example.org", "reject"))
+	if res.Authres.Value != authres.ResultFail || res.Selector != "brand" {
+		t.Errorf("unexpected result for invalid indicator: %v %s (%s)", res.Authres.Value, res.Selector, res.Reason)
+	}
+
+	// BIMI-Selector is ignored without aligned DKIM signature.
+	dmarcRes := passingResult("example.org", "example.org", "reject")
+	dmarcRes.DKIMAligned = false
+	res = Evaluate(context.Background(), r, fetcher, readHeader(t, "BIMI-Selector: v=BIMI1; s=brand\r\nFrom: test@example.org\r\n\r\n"), dmarcRes)
+	if res.Authres.Value != authres.ResultPass || res.Selector != "default" {
+		t.Errorf("unexpected result for unsigned selector: %v %s (%s)", res.Authres.Value, res.Selector, res.Reason)
+	}
+
+	res = Evaluate(context.Background(), r, fetcher, hdr, passingResult("example.com", "example.com", "reject"))
+	if res.Authres.Value != ResultDeclined {
+		t.Errorf("unexpected result for declined: %v (%s)", res.Authres.Value, res.Reason)
+	}
+
+	res = Evaluate(context.Background(), r, fetcher, hdr, passingResult("example.net", "example.net", "reject"))
+	if res.Authres.Value != authres.ResultNone {
+		t.Errorf("unexpected result for missing record: %v (%s)", res.Authres.Value, res.Reason)
+	}
+
+	res = Evaluate(context.Background(), r, fetcher, hdr, passingResult("example.org", "example.org", "none"))
+	if res.Authres.Value != ResultSkipped {
+		t.Errorf("unexpected result for p=none: %v (%s)", res.Authres.Value, res.Reason)
+	}
+}
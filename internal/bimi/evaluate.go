@@ -0,0 +1,126 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bimi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/internal/dmarc"
+)
+
+const (
+	ResultDeclined authres.ResultValue = "declined"
+	ResultSkipped  authres.ResultValue = "skipped"
+)
+
+// Result contains the outcome of the BIMI evaluation for a message.
+type Result struct {
+	// The Authentication-Results field for the BIMI check.
+	Authres authres.GenericResult
+	// Human-readable explanation for non-pass results, used for logging.
+	Reason string
+
+	Domain    string
+	Selector  string
+	Location  string
+	Indicator []byte
+}
+
+// Evaluate looks up the BIMI record for the RFC5322.From domain of the
+// message and fetches the indicator if the message is eligible for BIMI
+// processing.
+//
+// If fetcher is nil, indicator is not fetched and only BIMI-Location is
+// reported.
+func Evaluate(ctx context.Context, r Resolver, fetcher *Fetcher, hdr textproto.Header, dmarcRes dmarc.EvalResult) Result {
+	res := Result{
+		Authres: authres.GenericResult{
+			Method: "bimi",
+			Params: map[string]string{},
+		},
+	}
+	if err := Eligible(dmarcRes); err != nil {
+		res.Authres.Value = ResultSkipped
+		res.Reason = err.Error()
+		return res
+	}
+
+	// BIMI-Selector is under sender control and so is trusted only if it is
+	// covered by the aligned DKIM signature.
+	res.Selector = DefaultSelector
+	if dmarcRes.DKIMAligned && dmarcRes.DKIMResult.Value == authres.ResultPass {
+		res.Selector = Selector(hdr)
+	}
+	res.Authres.Params["header.selector"] = res.Selector
+
+	domain, rec, err := LookupRecord(ctx, r, res.Selector, dmarcRes.Authres.From)
+	if err != nil {
+		res.Reason = err.Error()
+		var dnsErr *net.DNSError
+		switch {
+		case errors.Is(err, ErrNoRecord):
+			res.Authres.Value = authres.ResultNone
+		case errors.As(err, &dnsErr) && dnsErr.Temporary():
+			res.Authres.Value = authres.ResultTempError
+		default:
+			res.Authres.Value = authres.ResultFail
+		}
+		return res
+	}
+	res.Domain = domain
+	res.Authres.Params["header.d"] = domain
+
+	if rec.Location == "" {
+		res.Authres.Value = ResultDeclined
+		res.Reason = "domain declined to publish an indicator"
+		return res
+	}
+	res.Location = rec.Location
+
+	if fetcher != nil {
+		svg, err := fetcher.Fetch(ctx, rec.Location)
+		if err != nil {
+			res.Authres.Value = authres.ResultFail
+			res.Reason = err.Error()
+			res.Location = ""
+			return res
+		}
+		res.Indicator = svg
+	}
+
+	res.Authres.Value = authres.ResultPass
+	return res
+}
+
+// AddHeaders adds BIMI-Location and BIMI-Indicator fields for the passed
+// evaluation result.
+func (res Result) AddHeaders(hdr *textproto.Header) {
+	if res.Authres.Value != authres.ResultPass {
+		return
+	}
+	if res.Indicator != nil {
+		hdr.Add("BIMI-Indicator", base64.StdEncoding.EncodeToString(res.Indicator))
+	}
+	hdr.Add("BIMI-Location", "v=BIMI1; l="+res.Location)
+}
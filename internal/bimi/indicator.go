@@ -0,0 +1,201 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package bimi
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxIndicatorSize is the maximum size of the SVG indicator document.
+	MaxIndicatorSize = 32 * 1024
+
+	indicatorCacheTTL  = 1 * time.Hour
+	indicatorCacheSize = 1000
+)
+
+type cachedIndicator struct {
+	svg     []byte
+	err     error
+	expires time.Time
+}
+
+// Fetcher downloads and validates SVG indicators. Results are cached
+// in-memory for a short time since the same indicator is usually referenced
+// by many messages.
+//
+// Fetcher is safe for concurrent use.
+type Fetcher struct {
+	Client *http.Client
+
+	cacheLck sync.Mutex
+	cache    map[string]cachedIndicator
+}
+
+func NewFetcher() *Fetcher {
+	return &Fetcher{
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 5 {
+					return errors.New("too many redirects")
+				}
+				if req.URL.Scheme != "https" {
+					return errors.New("redirect to non-https URL")
+				}
+				return nil
+			},
+		},
+		cache: make(map[string]cachedIndicator),
+	}
+}
+
+// Fetch returns the validated SVG document located at the specified URL.
+func (f *Fetcher) Fetch(ctx context.Context, url string) ([]byte, error) {
+	f.cacheLck.Lock()
+	entry, ok := f.cache[url]
+	f.cacheLck.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.svg, entry.err
+	}
+
+	svg, err := f.fetch(ctx, url)
+
+	f.cacheLck.Lock()
+	defer f.cacheLck.Unlock()
+	if len(f.cache) >= indicatorCacheSize {
+		now := time.Now()
+		for k, v := range f.cache {
+			if now.After(v.expires) {
+				delete(f.cache, k)
+			}
+		}
+		if len(f.cache) >= indicatorCacheSize {
+			f.cache = make(map[string]cachedIndicator)
+		}
+	}
+	f.cache[url] = cachedIndicator{svg: svg, err: err, expires: time.Now().Add(indicatorCacheTTL)}
+
+	return svg, err
+}
+
+func (f *Fetcher) fetch(ctx context.Context, url string) ([]byte, error) {
+	if err := checkURL(url); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bimi: indicator fetch failed: %s", resp.Status)
+	}
+
+	svg, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxIndicatorSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(svg) > MaxIndicatorSize {
+		return nil, errors.New("bimi: indicator is too big")
+	}
+
+	if err := ValidateIndicator(svg); err != nil {
+		return nil, err
+	}
+	return svg, nil
+}
+
+// ValidateIndicator performs basic checks to make sure the document is an SVG
+// Tiny Portable/Secure image as required by BIMI.
+//
+// The document root should be the svg element with baseProfile="tiny-ps". No
+// scripts, external references or embedded raster images are allowed.
+func ValidateIndicator(svg []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(svg))
+	dec.Strict = true
+
+	rootSeen := false
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("bimi: malformed SVG: %w", err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.Directive:
+			// DOCTYPE may be used to define external entities.
+			if strings.HasPrefix(strings.TrimSpace(string(tok)), "ENTITY") ||
+				strings.Contains(string(tok), "<!ENTITY") {
+				return errors.New("bimi: entity declarations are not allowed")
+			}
+		case xml.StartElement:
+			if !rootSeen {
+				if tok.Name.Local != "svg" {
+					return errors.New("bimi: root element is not svg")
+				}
+				profile := ""
+				for _, attr := range tok.Attr {
+					if attr.Name.Local == "baseProfile" {
+						profile = attr.Value
+					}
+				}
+				if profile != "tiny-ps" {
+					return errors.New("bimi: baseProfile is not tiny-ps")
+				}
+				rootSeen = true
+			}
+
+			switch tok.Name.Local {
+			case "script", "image", "foreignObject", "animate", "set":
+				return fmt.Errorf("bimi: %s element is not allowed", tok.Name.Local)
+			}
+			for _, attr := range tok.Attr {
+				if attr.Name.Local == "href" && !strings.HasPrefix(attr.Value, "#") {
+					return errors.New("bimi: external references are not allowed")
+				}
+				if strings.HasPrefix(attr.Name.Local, "on") {
+					return errors.New("bimi: event handlers are not allowed")
+				}
+			}
+		}
+	}
+	if !rootSeen {
+		return errors.New("bimi: empty document")
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package arc implements the check that validates the Authenticated Received
+// Chain (RFC 8617) of the message.
+//
+// The chain validation status (cv= value) and the domain of the last sealer
+// are saved as message facts so later pipeline stages (e.g. DMARC policy
+// override for trusted forwarders) can use them.
+package arc
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.arc"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	failAction modconfig.FailAction
+
+	resolver dns.Resolver
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.arc/CheckBody").End()
+
+	var res arc.Result
+	if !hdr.Has(arc.FieldSeal) {
+		res = arc.Result{CV: authres.ResultNone}
+	} else {
+		bodyRdr, err := body.Open()
+		if err != nil {
+			return module.CheckResult{
+				Reject: true,
+				Reason: exterrors.WithTemporary(
+					exterrors.WithFields(err, map[string]interface{}{
+						"check":    modName,
+						"smtp_msg": "Internal I/O error",
+					}),
+					true,
+				),
+			}
+		}
+		res = arc.Verify(ctx, s.c.resolver, hdr, bodyRdr)
+		bodyRdr.Close()
+	}
+
+	s.msgMeta.Facts.Set(module.FactARCResult, string(res.CV))
+	authRes := &authres.GenericResult{
+		Method: "arc",
+		Value:  res.CV,
+		Params: map[string]string{},
+	}
+	if sealer := res.LatestSealer(); sealer != "" {
+		s.msgMeta.Facts.Set(module.FactARCSealer, sealer)
+		authRes.Params["header.d"] = sealer
+	}
+
+	checkRes := module.CheckResult{AuthResult: []authres.Result{authRes}}
+	if res.CV != authres.ResultFail {
+		s.log.DebugMsg("ARC chain checked", "cv", res.CV, "arc_sealer", res.LatestSealer())
+		return checkRes
+	}
+
+	s.log.DebugMsg("ARC chain is not valid", "reason", res.Err)
+	checkRes.Reason = &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 29},
+		Message:      "ARC chain validation failed",
+		CheckName:    modName,
+		Err:          res.Err,
+	}
+	return s.c.failAction.Apply(checkRes)
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,91 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// Sealed by lists.example.net using the Ed25519 key with all seed bytes set
+// to 1, body is "foobar".
+const sealedHdr = "ARC-Seal: i=1; a=ed25519-sha256; cv=none; d=lists.example.net; s=sel; b=RpZcti/szzWOo9EYKH8BrPjcmTptknPueLhzhEgW9t7UN+WPkD3L5dBnXKl7DARY8ssOPztLnWDOcPNgDg8JBQ==\r\n" +
+	"ARC-Message-Signature: i=1; a=ed25519-sha256; c=relaxed/relaxed; d=lists.example.net; s=sel;\r\n" +
+	" h=From:Subject; bh=e/D3HyFx1VjJ1nyCC/+peRnWJ5samzUsxgHXVU3wd+k=; b=viI4wm79gQf5YVZHMjzSzWLR1pZEx0o7IFsJ5kZueoRCf0B1XIiInoq6Bc8+m2Dtm7LF3VRmASKvj2t0evtGDQ==\r\n" +
+	"ARC-Authentication-Results: i=1; lists.example.net; spf=pass smtp.mailfrom=example.org\r\n"
+
+func TestCheckBody(t *testing.T) {
+	test := func(hdrRaw, body string, wantCV authres.ResultValue, wantSealer string, wantReject bool) {
+		t.Helper()
+
+		c := &Check{
+			instName:   "test",
+			log:        testutils.Logger(t, modName),
+			failAction: modconfig.FailAction{Reject: true},
+			resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"sel._domainkey.lists.example.net.": {
+					TXT: []string{"v=DKIM1; k=ed25519; p=iojj3XQJ8ZX9UtstPLpdcspnCb8dlBIb83SIAbQPb1w="},
+				},
+			}},
+		}
+
+		hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdrRaw)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgMeta := &module.MsgMetadata{Facts: module.NewFacts()}
+		s, err := c.CheckStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(body)})
+		if res.Reject != wantReject {
+			t.Errorf("want reject=%v, got %v (%v)", wantReject, res.Reject, res.Reason)
+		}
+
+		cv, _ := msgMeta.Facts.String(module.FactARCResult)
+		if cv != string(wantCV) {
+			t.Errorf("want cv=%v, got %v", wantCV, cv)
+		}
+		sealer, _ := msgMeta.Facts.String(module.FactARCSealer)
+		if sealer != wantSealer {
+			t.Errorf("want sealer %q, got %q", wantSealer, sealer)
+		}
+		if len(res.AuthResult) != 1 {
+			t.Fatal("wrong amount of Authentication-Results:", len(res.AuthResult))
+		}
+		if gr, ok := res.AuthResult[0].(*authres.GenericResult); !ok || gr.Method != "arc" || gr.Value != wantCV {
+			t.Errorf("wrong Authentication-Results: %+v", res.AuthResult[0])
+		}
+	}
+
+	test("From: hello@example.com\r\n\r\n", "foobar", authres.ResultNone, "", false)
+	test(sealedHdr+"From: hello@example.com\r\n\r\n", "foobar", authres.ResultPass, "lists.example.net", false)
+	test(sealedHdr+"From: hello@example.com\r\n\r\n", "foobaz", authres.ResultFail, "", true)
+	test(sealedHdr+"From: evil@example.com\r\n\r\n", "foobar", authres.ResultFail, "", true)
+}
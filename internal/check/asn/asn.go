@@ -0,0 +1,338 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package asn implements the check that applies actions to connections from
+// listed autonomous systems and networks.
+//
+// The client IP address is resolved to its ASN using the MaxMind DB file or
+// Team Cymru IP-to-ASN DNS service. The ASN and the networks containing the
+// address are then looked up in the table that maps them to check actions.
+package asn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check/geoip"
+	"github.com/foxcpp/maddy/internal/mmdb"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.asn"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	resolver dns.Resolver
+	db       *mmdb.DB
+	table    module.Table
+	trusted  []net.IPNet
+	skipAuth bool
+
+	// Set by the source directive.
+	lookupASN func(ctx context.Context, ip net.IP) (uint, string, error)
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		source         []string
+		reloadInterval time.Duration
+		trusted        []string
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("source", false, false, []string{"cymru"}, &source)
+	cfg.Duration("reload_interval", false, false, time.Hour, &reloadInterval)
+	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &c.table)
+	cfg.StringList("trusted_networks", false, false, []string{"127.0.0.0/8", "::1/128"}, &trusted)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuth)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	c.trusted, err = geoip.ParseNetworks(trusted)
+	if err != nil {
+		return fmt.Errorf("%s: trusted_networks: %w", modName, err)
+	}
+
+	switch source[0] {
+	case "cymru":
+		if len(source) != 1 {
+			return fmt.Errorf("%s: source: cymru does not take arguments", modName)
+		}
+		c.lookupASN = c.lookupCymru
+	case "mmdb":
+		if len(source) != 2 {
+			return fmt.Errorf("%s: source: mmdb requires the database path", modName)
+		}
+		c.db, err = mmdb.Open(source[1], reloadInterval, c.log)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		c.lookupASN = func(_ context.Context, ip net.IP) (uint, string, error) {
+			return c.db.ASN(ip)
+		}
+	default:
+		return fmt.Errorf("%s: unknown source: %s", modName, source[0])
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+// parseCymru parses the TXT record returned by origin.asn.cymru.com, e.g.
+//
+//	"23028 | 216.90.108.0/24 | US | arin | 1998-09-25"
+//
+// If the prefix is announced by multiple ASes, the first one is returned.
+func parseCymru(txt string) (uint, error) {
+	fields := strings.Split(txt, "|")
+	asns := strings.Fields(fields[0])
+	if len(asns) == 0 {
+		return 0, fmt.Errorf("malformed response: %s", txt)
+	}
+	asn, err := strconv.ParseUint(asns[0], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed response: %s", txt)
+	}
+	return uint(asn), nil
+}
+
+func (c *Check) lookupCymru(ctx context.Context, ip net.IP) (uint, string, error) {
+	zone := "origin.asn.cymru.com"
+	if ip.To4() == nil {
+		zone = "origin6.asn.cymru.com"
+	}
+
+	txts, err := c.resolver.LookupTXT(ctx, dns.ReverseIP(ip)+"."+zone)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return 0, "", nil
+		}
+		return 0, "", err
+	}
+	if len(txts) == 0 {
+		return 0, "", nil
+	}
+
+	asn, err := parseCymru(txts[0])
+	return asn, "", err
+}
+
+// networkKeys returns the table keys for networks containing the IP address,
+// most specific first.
+//
+// For IPv4, all prefixes from /32 to /8 are used. For IPv6, /128 and prefixes
+// from /64 to /16 in 4-bit steps are used to keep the amount of lookups
+// reasonable.
+func networkKeys(ip net.IP) []string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		keys := make([]string, 0, 25)
+		for bits := 32; bits >= 8; bits-- {
+			n := net.IPNet{IP: ipv4.Mask(net.CIDRMask(bits, 32)), Mask: net.CIDRMask(bits, 32)}
+			keys = append(keys, n.String())
+		}
+		return keys
+	}
+
+	keys := make([]string, 0, 13)
+	keys = append(keys, (&net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}).String())
+	for bits := 64; bits >= 16; bits -= 4 {
+		n := net.IPNet{IP: ip.Mask(net.CIDRMask(bits, 128)), Mask: net.CIDRMask(bits, 128)}
+		keys = append(keys, n.String())
+	}
+	return keys
+}
+
+// matchTable returns the table key and value for the first matching ASN or
+// network. Empty key is returned if nothing matches.
+func (c *Check) matchTable(ctx context.Context, ip net.IP, asn uint) (string, string, error) {
+	keys := networkKeys(ip)
+	if asn != 0 {
+		keys = append([]string{"AS" + strconv.FormatUint(uint64(asn), 10)}, keys...)
+	}
+
+	for _, key := range keys {
+		val, ok, err := c.table.Lookup(ctx, key)
+		if err != nil {
+			return "", "", err
+		}
+		if ok {
+			return key, val, nil
+		}
+	}
+	return "", "", nil
+}
+
+func (c *Check) isTrusted(ip net.IP) bool {
+	for _, n := range c.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, "asn/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.skipAuth && s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.DebugMsg("non-TCP/IP source, skipping")
+		return module.CheckResult{}
+	}
+	ip := tcpAddr.IP
+	if s.c.isTrusted(ip) {
+		s.log.DebugMsg("trusted network, skipping", "ip", ip)
+		return module.CheckResult{}
+	}
+
+	asn, org, err := s.c.lookupASN(ctx, ip)
+	if err != nil {
+		// Netblocks can still be matched.
+		s.log.Error("ASN lookup failed", err, "ip", ip)
+	}
+	if asn != 0 {
+		s.msgMeta.Facts.Set(module.FactClientASN, int(asn))
+	}
+
+	key, val, err := s.c.matchTable(ctx, ip, asn)
+	if err != nil {
+		s.log.Error("table lookup failed", err, "ip", ip)
+		return module.CheckResult{}
+	}
+	if key == "" {
+		s.log.DebugMsg("not listed", "ip", ip, "asn", asn)
+		return module.CheckResult{}
+	}
+
+	actionArgs := strings.Fields(val)
+	if len(actionArgs) == 0 {
+		actionArgs = []string{"reject"}
+	}
+	action, err := modconfig.ParseActionDirective(actionArgs)
+	if err != nil {
+		s.log.Error("malformed action in table", err, "key", key, "value", val)
+		return module.CheckResult{}
+	}
+
+	misc := map[string]interface{}{
+		"ip":    ip.String(),
+		"match": key,
+	}
+	if asn != 0 {
+		misc["asn"] = asn
+	}
+	if org != "" {
+		misc["as_org"] = org
+	}
+
+	return action.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Messages from your network are not accepted",
+			CheckName:    modName,
+			Misc:         misc,
+		},
+	})
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,125 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package asn
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestParseCymru(t *testing.T) {
+	for txt, want := range map[string]uint{
+		"23028 | 216.90.108.0/24 | US | arin | 1998-09-25": 23028,
+		"3356 1299 | 4.0.0.0/9 | US | arin | 1992-12-01":   3356,
+		"15169": 15169,
+	} {
+		asn, err := parseCymru(txt)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", txt, err)
+			continue
+		}
+		if asn != want {
+			t.Errorf("%q: want %d, got %d", txt, want, asn)
+		}
+	}
+
+	for _, txt := range []string{"", " | 1.2.3.0/24", "AS123 | 1.2.3.0/24"} {
+		if _, err := parseCymru(txt); err == nil {
+			t.Errorf("%q: no error for malformed response", txt)
+		}
+	}
+}
+
+func TestNetworkKeys(t *testing.T) {
+	keys := networkKeys(net.ParseIP("198.51.100.7"))
+	if len(keys) != 25 {
+		t.Fatal("wrong amount of IPv4 keys:", len(keys))
+	}
+	if keys[0] != "198.51.100.7/32" || keys[8] != "198.51.100.0/24" || keys[24] != "198.0.0.0/8" {
+		t.Error("wrong IPv4 keys:", keys)
+	}
+
+	keys = networkKeys(net.ParseIP("2001:db8:1:2::5"))
+	if keys[0] != "2001:db8:1:2::5/128" || keys[1] != "2001:db8:1:2::/64" || keys[len(keys)-1] != "2001::/16" {
+		t.Error("wrong IPv6 keys:", keys)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	c := &Check{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"1.100.51.198.origin.asn.cymru.com.": {
+					TXT: []string{"64500 | 198.51.100.0/24 | ZZ | test | 2000-01-01"},
+				},
+				"2.100.51.198.origin.asn.cymru.com.": {
+					TXT: []string{"64501 | 198.51.100.0/24 | ZZ | test | 2000-01-01"},
+				},
+				"3.100.51.198.origin.asn.cymru.com.": {
+					TXT: []string{"64502 | 198.51.100.0/24 | ZZ | test | 2000-01-01"},
+				},
+			},
+		},
+		table: testutils.Table{M: map[string]string{
+			"AS64500":        "",
+			"AS64501":        "score 5",
+			"203.0.113.0/24": "quarantine",
+			"192.0.2.0/24":   "reject",
+			"AS64502":        "invalid",
+		}},
+		skipAuth: true,
+	}
+	c.lookupASN = c.lookupCymru
+
+	test := func(ip, authUser string, reject, quarantine bool, score float64) {
+		t.Helper()
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Facts: module.NewFacts(),
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+				},
+				AuthUser: authUser,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckConnection(context.Background())
+		if res.Reject != reject || res.Quarantine != quarantine || res.Score != score {
+			t.Errorf("%s: want reject=%v quarantine=%v score=%v, got %+v", ip, reject, quarantine, score, res)
+		}
+	}
+
+	test("198.51.100.1", "", true, false, 0)
+	test("198.51.100.1", "foxcpp", false, false, 0)
+	test("198.51.100.2", "", false, false, 5)
+	test("198.51.100.3", "", false, false, 0)
+	test("203.0.113.9", "", false, true, 0)
+	test("192.0.2.200", "", true, false, 0)
+	test("233.252.0.1", "", false, false, 0)
+}
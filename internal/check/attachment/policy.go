@@ -0,0 +1,347 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachment
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+var defaultExtensions = []string{
+	"ade", "adp", "app", "application", "bat", "cab", "chm", "cmd", "com",
+	"cpl", "dll", "exe", "hta", "inf", "ins", "isp", "iso", "img", "jar", "js",
+	"jse", "lib", "lnk", "mde", "msc", "msi", "msp", "mst", "pif", "ps1",
+	"reg", "scr", "sct", "shb", "shs", "sys", "vb", "vbe", "vbs", "vhd", "vxd",
+	"wsc", "wsf", "wsh",
+}
+
+var defaultMIMETypes = []string{
+	"application/x-msdownload",
+	"application/x-msdos-program",
+	"application/x-dosexec",
+	"application/x-executable",
+	"application/vnd.microsoft.portable-executable",
+	"application/x-ms-shortcut",
+	"application/hta",
+}
+
+// Policy describes disallowed attachments.
+type Policy struct {
+	// Extensions contains lower-case file extensions without the leading dot.
+	Extensions map[string]struct{}
+	// MIMETypes contains lower-case media types.
+	MIMETypes map[string]struct{}
+	// DetectExecutables enables detection of executable files using magic
+	// bytes, irregardless of the file name.
+	DetectExecutables bool
+	// ScanArchives enables inspection of ZIP, TAR and gzip archives contents.
+	ScanArchives bool
+	// MaxDepth is the maximum nesting level of archives to inspect.
+	MaxDepth int
+	// MaxArchiveSize is the maximum size of the archive (after decompression)
+	// to inspect. Bigger archives are not inspected.
+	MaxArchiveSize int
+}
+
+// Violation describes the attachment that is not allowed by the policy.
+type Violation struct {
+	// File name of the attachment, for archive members it includes the
+	// archive name, e.g. "files.zip/setup.exe".
+	File string
+	// Reason is the short description of the matched rule.
+	Reason string
+}
+
+func stringSetDirective(defaultVal []string, trimDot bool) (func() (interface{}, error), func(*config.Map, config.Node) (interface{}, error)) {
+	toSet := func(vals []string) map[string]struct{} {
+		set := make(map[string]struct{}, len(vals))
+		for _, val := range vals {
+			val = strings.ToLower(val)
+			if trimDot {
+				val = strings.TrimPrefix(val, ".")
+			}
+			set[val] = struct{}{}
+		}
+		return set
+	}
+
+	return func() (interface{}, error) {
+			return toSet(defaultVal), nil
+		}, func(_ *config.Map, node config.Node) (interface{}, error) {
+			if len(node.Children) != 0 {
+				return nil, config.NodeErr(node, "can't declare a block here")
+			}
+			return toSet(node.Args), nil
+		}
+}
+
+// AddDirectives registers configuration directives for the policy fields in
+// cfg.
+func (p *Policy) AddDirectives(cfg *config.Map) {
+	extDefault, extMapper := stringSetDirective(defaultExtensions, true)
+	cfg.Custom("extensions", false, false, extDefault, extMapper, &p.Extensions)
+	typesDefault, typesMapper := stringSetDirective(defaultMIMETypes, false)
+	cfg.Custom("mime_types", false, false, typesDefault, typesMapper, &p.MIMETypes)
+	cfg.Bool("detect_executables", false, true, &p.DetectExecutables)
+	cfg.Bool("scan_archives", false, true, &p.ScanArchives)
+	cfg.Int("max_archive_depth", false, false, 3, &p.MaxDepth)
+	cfg.DataSize("max_archive_size", false, false, 32*1024*1024, &p.MaxArchiveSize)
+}
+
+// PartFileName returns the file name of the message part, if any.
+func PartFileName(h message.Header) string {
+	_, params, err := h.ContentDisposition()
+	name := params["filename"]
+	if err != nil || name == "" {
+		_, params, _ = h.ContentType()
+		name = params["name"]
+	}
+
+	// Some clients use RFC 2047 encoding for file names which is not
+	// handled by mime.ParseMediaType.
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
+
+// CheckPart inspects a single non-multipart message part.
+//
+// body should contain the decoded part contents.
+func (p *Policy) CheckPart(h message.Header, body io.Reader) (*Violation, error) {
+	name := PartFileName(h)
+
+	mediaType, _, err := h.ContentType()
+	if err == nil {
+		if _, ok := p.MIMETypes[strings.ToLower(mediaType)]; ok {
+			return &Violation{File: name, Reason: "disallowed media type " + mediaType}, nil
+		}
+	}
+
+	return p.inspect(name, body, 0)
+}
+
+// CheckMessage walks all parts of the message and returns the first found
+// violation.
+func (p *Policy) CheckMessage(hdr textproto.Header, body io.Reader) (*Violation, error) {
+	entity, err := message.New(message.Header{Header: hdr}, body)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+
+	var violation *Violation
+	err = entity.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return err
+		}
+		if part.MultipartReader() != nil {
+			return nil
+		}
+
+		v, err := p.CheckPart(part.Header, part.Body)
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			violation = v
+			return errStop
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errStop) {
+		return nil, err
+	}
+	return violation, nil
+}
+
+var errStop = errors.New("stop")
+
+func fileExtension(name string) string {
+	// Windows ignores trailing dots and spaces.
+	name = strings.TrimRight(name, ". ")
+	return strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+}
+
+func isExecutable(head []byte) bool {
+	// PE (Windows). "MZ" alone is too likely to appear at the start of
+	// a text so check the PE header signature too.
+	if bytes.HasPrefix(head, []byte("MZ")) && len(head) >= 0x40 {
+		offset := int(binary.LittleEndian.Uint32(head[0x3c:0x40]))
+		if offset >= 0 && offset+4 <= len(head) && bytes.Equal(head[offset:offset+4], []byte("PE\x00\x00")) {
+			return true
+		}
+	}
+
+	for _, magic := range [][]byte{
+		[]byte("\x7fELF"),        // ELF
+		{0xfe, 0xed, 0xfa, 0xce}, // Mach-O 32-bit
+		{0xfe, 0xed, 0xfa, 0xcf}, // Mach-O 64-bit
+		{0xce, 0xfa, 0xed, 0xfe}, // Mach-O 32-bit, reversed
+		{0xcf, 0xfa, 0xed, 0xfe}, // Mach-O 64-bit, reversed
+		{0xca, 0xfe, 0xba, 0xbe}, // Mach-O universal or Java class
+	} {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+func archiveKind(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return "zip"
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar")):
+		return "tar"
+	}
+	return ""
+}
+
+func (p *Policy) inspect(name string, r io.Reader, depth int) (*Violation, error) {
+	if name != "" {
+		ext := fileExtension(name)
+		if _, ok := p.Extensions[ext]; ok && ext != "" {
+			return &Violation{File: name, Reason: "disallowed extension " + ext}, nil
+		}
+	}
+
+	if !p.DetectExecutables && !p.ScanArchives {
+		return nil, nil
+	}
+
+	br := bufio.NewReaderSize(r, 512)
+	head, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+
+	if p.DetectExecutables && isExecutable(head) {
+		return &Violation{File: name, Reason: "executable content"}, nil
+	}
+
+	kind := archiveKind(head)
+	if !p.ScanArchives || kind == "" || depth >= p.MaxDepth {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(br, int64(p.MaxArchiveSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > p.MaxArchiveSize {
+		// Too big to inspect.
+		return nil, nil
+	}
+
+	v, err := p.inspectArchive(kind, name, data, depth)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return v, nil
+}
+
+func (p *Policy) inspectArchive(kind, name string, data []byte, depth int) (*Violation, error) {
+	member := func(memberName string, r io.Reader) (*Violation, error) {
+		v, err := p.inspect(memberName, io.LimitReader(r, int64(p.MaxArchiveSize)), depth+1)
+		if v != nil {
+			v.File = name + "/" + v.File
+		}
+		return v, err
+	}
+
+	switch kind {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if f.Flags&0x1 != 0 {
+				// Encrypted, only the name can be checked.
+				v, err := member(f.Name, bytes.NewReader(nil))
+				if v != nil || err != nil {
+					return v, err
+				}
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			v, err := member(f.Name, rc)
+			rc.Close()
+			if v != nil || err != nil {
+				return v, err
+			}
+		}
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+
+		innerName := gr.Name
+		if innerName == "" {
+			innerName = strings.TrimSuffix(path.Base(name), ".gz")
+			if strings.HasSuffix(innerName, ".tgz") {
+				innerName = strings.TrimSuffix(innerName, ".tgz") + ".tar"
+			}
+		}
+		return member(innerName, gr)
+	case "tar":
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				return nil, err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			v, err := member(hdr.Name, tr)
+			if v != nil || err != nil {
+				return v, err
+			}
+		}
+	}
+	return nil, nil
+}
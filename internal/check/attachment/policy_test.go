@@ -0,0 +1,225 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package attachment
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func testPolicy() *Policy {
+	return &Policy{
+		Extensions:        map[string]struct{}{"exe": {}, "js": {}},
+		MIMETypes:         map[string]struct{}{"application/x-msdownload": {}},
+		DetectExecutables: true,
+		ScanArchives:      true,
+		MaxDepth:          3,
+		MaxArchiveSize:    1024 * 1024,
+	}
+}
+
+func peFile() []byte {
+	data := make([]byte, 256)
+	copy(data, "MZ")
+	data[0x3c] = 0x80
+	copy(data[0x80:], "PE\x00\x00")
+	return data
+}
+
+func zipFile(t *testing.T, name string, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipFile(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	if _, err := gw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func multipartMsg(contentType, disposition string, content []byte) (textproto.Header, string) {
+	msg := "Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+		"\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello!\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Disposition: " + disposition + "\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(content) + "\r\n" +
+		"--BOUNDARY--\r\n"
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(msg)))
+	if err != nil {
+		panic(err)
+	}
+	return hdr, msg[strings.Index(msg, "\r\n\r\n")+4:]
+}
+
+func TestCheckMessage(t *testing.T) {
+	p := testPolicy()
+
+	for _, c := range []struct {
+		name        string
+		contentType string
+		disposition string
+		content     []byte
+		file        string
+	}{
+		{
+			name:        "clean",
+			contentType: "application/pdf",
+			disposition: `attachment; filename="report.pdf"`,
+			content:     []byte("%PDF-1.4"),
+		},
+		{
+			name:        "extension",
+			contentType: "application/octet-stream",
+			disposition: `attachment; filename="invoice.pdf.exe"`,
+			content:     []byte("whatever"),
+			file:        "invoice.pdf.exe",
+		},
+		{
+			name:        "extension trailing dot",
+			contentType: "application/octet-stream",
+			disposition: `attachment; filename="invoice.JS."`,
+			content:     []byte("whatever"),
+			file:        "invoice.JS.",
+		},
+		{
+			name:        "encoded name",
+			contentType: "application/octet-stream",
+			disposition: `attachment; filename="=?utf-8?B?0YHRh9C10YIuZXhl?="`,
+			content:     []byte("whatever"),
+			file:        "счет.exe",
+		},
+		{
+			name:        "media type",
+			contentType: "application/x-msdownload",
+			disposition: `attachment; filename="data.bin"`,
+			content:     []byte("whatever"),
+			file:        "data.bin",
+		},
+		{
+			name:        "magic",
+			contentType: "application/octet-stream",
+			disposition: `attachment; filename="photo.jpg"`,
+			content:     peFile(),
+			file:        "photo.jpg",
+		},
+		{
+			name:        "zip",
+			contentType: "application/zip",
+			disposition: `attachment; filename="docs.zip"`,
+			content:     zipFile(t, "docs/readme.js", []byte("alert(1)")),
+			file:        "docs.zip/docs/readme.js",
+		},
+		{
+			name:        "clean zip",
+			contentType: "application/zip",
+			disposition: `attachment; filename="docs.zip"`,
+			content:     zipFile(t, "readme.txt", []byte("hello")),
+		},
+		{
+			name:        "nested archives",
+			contentType: "application/gzip",
+			disposition: `attachment; filename="docs.zip.gz"`,
+			content:     gzipFile(t, zipFile(t, "data.bin", peFile())),
+			file:        "docs.zip.gz/docs.zip/data.bin",
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			hdr, body := multipartMsg(c.contentType, c.disposition, c.content)
+			v, err := p.CheckMessage(hdr, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.file == "" {
+				if v != nil {
+					t.Fatalf("unexpected violation: %+v", v)
+				}
+				return
+			}
+			if v == nil {
+				t.Fatal("violation is not detected")
+			}
+			if v.File != c.file {
+				t.Errorf("wrong file name: %v", v.File)
+			}
+		})
+	}
+}
+
+func TestCheckMessage_Depth(t *testing.T) {
+	p := testPolicy()
+	p.MaxDepth = 1
+
+	hdr, body := multipartMsg("application/gzip", `attachment; filename="docs.zip.gz"`,
+		gzipFile(t, zipFile(t, "setup.exe", []byte("whatever"))))
+	v, err := p.CheckMessage(hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != nil {
+		t.Fatalf("archive nested deeper than MaxDepth is inspected: %+v", v)
+	}
+}
+
+func TestIsExecutable(t *testing.T) {
+	if !isExecutable(peFile()) {
+		t.Error("PE file is not detected")
+	}
+	if isExecutable([]byte("MZ Corp quarterly report, see the attached figures for details. " +
+		"The numbers are looking good this time")) {
+		t.Error("Text starting with MZ is detected as executable")
+	}
+	if !isExecutable([]byte("\x7fELF\x02\x01\x01")) {
+		t.Error("ELF file is not detected")
+	}
+}
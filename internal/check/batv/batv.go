@@ -0,0 +1,191 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package batv implements the check that rejects bounces sent to local
+// addresses without a valid BATV (Bounce Address Tag Validation) tag.
+//
+// Envelope senders of outgoing messages are tagged by modify.batv, so
+// legitimate bounces are always sent to tagged addresses. Bounces to
+// untagged or incorrectly tagged addresses are backscatter caused by
+// spammers forging local addresses.
+package batv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/trace"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	batvmod "github.com/foxcpp/maddy/internal/modify/batv"
+	"github.com/foxcpp/maddy/internal/prvs"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.batv"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	domains        map[string]struct{}
+	keys           [][]byte
+	maxAge         time.Duration
+	untaggedAction modconfig.FailAction
+	failAction     modconfig.FailAction
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		domains []string
+		keyFile string
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("domains", false, true, nil, &domains)
+	cfg.String("key_file", false, false, "batv_keys", &keyFile)
+	cfg.Duration("max_age", false, false, 7*24*time.Hour, &c.maxAge)
+	cfg.Custom("untagged_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.untaggedAction)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	c.domains, err = batvmod.DomainSet(domains)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	c.keys, err = prvs.LoadKeys(keyFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	bounce bool
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	s.bounce = addr == ""
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, "batv/CheckRcpt").End()
+
+	if !s.bounce || !batvmod.InDomains(s.c.domains, addr) {
+		return module.CheckResult{}
+	}
+
+	_, err := prvs.Verify(s.c.keys, addr, s.c.now(), s.c.maxAge)
+	switch {
+	case err == nil:
+		s.log.DebugMsg("valid tag", "rcpt", addr)
+		return module.CheckResult{}
+	case errors.Is(err, prvs.ErrNotTagged):
+		return s.c.untaggedAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Bounce is not sent in reply to a message from this address",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"rcpt": addr,
+				},
+			},
+		})
+	default:
+		return s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Invalid bounce address tag",
+				CheckName:    modName,
+				Err:          err,
+				Misc: map[string]interface{}{
+					"rcpt": addr,
+				},
+			},
+		})
+	}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,101 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package batv
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	batvmod "github.com/foxcpp/maddy/internal/modify/batv"
+	"github.com/foxcpp/maddy/internal/prvs"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCheck(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "batv_keys")
+
+	mod, err := batvmod.New("", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"example.org"}},
+			{Name: "key_file", Args: []string{keyFile}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modState, err := mod.(module.Modifier).ModStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := modState.RewriteSender(context.Background(), "user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged == "user@example.org" {
+		t.Fatal("sender is not tagged")
+	}
+	if other, _ := modState.RewriteSender(context.Background(), "user@example.com"); other != "user@example.com" {
+		t.Fatal("sender from other domain is tagged:", other)
+	}
+	if stripped, _ := modState.RewriteRcpt(context.Background(), tagged); stripped != "user@example.org" {
+		t.Fatal("tag is not removed from the recipient:", stripped)
+	}
+
+	c := &Check{
+		instName:       "test",
+		log:            testutils.Logger(t, modName),
+		domains:        map[string]struct{}{"example.org": {}},
+		maxAge:         7 * 24 * time.Hour,
+		untaggedAction: modconfig.FailAction{Reject: true},
+		failAction:     modconfig.FailAction{Reject: true},
+		now:            time.Now,
+	}
+	c.keys, err = prvs.LoadKeys(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := func(mailFrom, rcpt string, reject bool) {
+		t.Helper()
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.CheckSender(context.Background(), mailFrom)
+		res := s.CheckRcpt(context.Background(), rcpt)
+		if res.Reject != reject {
+			t.Errorf("%s -> %s: want reject=%v, got %+v", mailFrom, rcpt, reject, res)
+		}
+	}
+
+	test("", tagged, false)
+	test("", "user@example.org", true)
+	test("", "prvs=0000000000=user@example.org", true)
+	test("", "user@example.com", false)
+	test("sender@example.com", "user@example.org", false)
+}
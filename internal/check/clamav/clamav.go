@@ -0,0 +1,371 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package clamav implements the check that scans messages using the ClamAV
+// daemon (clamd).
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check/scancache"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.clamav"
+
+// chunkSize is the size of chunks the message is split into for INSTREAM.
+const chunkSize = 64 * 1024
+
+type familyAction struct {
+	pattern string
+	action  modconfig.FailAction
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	endpointArg    string
+	endpoint       config.Endpoint
+	timeout        time.Duration
+	maxSize        int
+	virusAction    modconfig.FailAction
+	familyActions  []familyAction
+	ioErrAction    modconfig.FailAction
+	oversizeAction modconfig.FailAction
+	cache          *scancache.Cache
+
+	dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		dialer:   (&net.Dialer{}).DialContext,
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		c.endpointArg = inlineArgs[0]
+	case 0:
+		c.endpointArg = "unix:///run/clamav/clamd.ctl"
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var cacheTTL time.Duration
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpointArg, &c.endpointArg)
+	cfg.Duration("timeout", false, false, 30*time.Second, &c.timeout)
+	cfg.DataSize("max_size", false, false, 25*1024*1024, &c.maxSize)
+	cfg.Custom("virus_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.virusAction)
+	cfg.Callback("family_action", func(_ *config.Map, node config.Node) error {
+		if len(node.Children) != 0 {
+			return config.NodeErr(node, "can't declare block here")
+		}
+		if len(node.Args) < 2 {
+			return config.NodeErr(node, "expected at least 2 arguments")
+		}
+		if _, err := path.Match(node.Args[0], ""); err != nil {
+			return config.NodeErr(node, "malformed pattern: %v", err)
+		}
+		action, err := modconfig.ParseActionDirective(node.Args[1:])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		c.familyActions = append(c.familyActions, familyAction{
+			pattern: node.Args[0],
+			action:  action,
+		})
+		return nil
+	})
+	cfg.Custom("io_error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.ioErrAction)
+	cfg.Custom("oversize_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.oversizeAction)
+	cfg.Duration("cache_ttl", false, false, 0, &cacheTTL)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if cacheTTL != 0 {
+		c.cache = scancache.New(cacheTTL)
+	}
+
+	var err error
+	c.endpoint, err = config.ParseEndpoint(c.endpointArg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if c.endpoint.IsTLS() {
+		return fmt.Errorf("%s: TLS is not supported by clamd", modName)
+	}
+
+	return nil
+}
+
+// actionFor returns the action to apply for the detected virus.
+func (c *Check) actionFor(virus string) modconfig.FailAction {
+	for _, fa := range c.familyActions {
+		if ok, _ := path.Match(fa.pattern, virus); ok {
+			return fa.action
+		}
+	}
+	return c.virusAction
+}
+
+// scan sends the message to clamd using the INSTREAM command.
+//
+// It returns the name of the detected virus or an empty string if message
+// is clean.
+func (c *Check) scan(ctx context.Context, r io.Reader) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	conn, err := c.dialer(ctx, c.endpoint.Network(), c.endpoint.Address())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+
+	wr := bufio.NewWriterSize(conn, chunkSize+4)
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			if _, err := wr.Write(size[:]); err != nil {
+				return "", err
+			}
+			if _, err := wr.Write(buf[:n]); err != nil {
+				return "", err
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return "", err
+		}
+	}
+	// Zero-length chunk terminates the stream.
+	if _, err := wr.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	if err := wr.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return parseReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// parseReply parses the clamd reply to INSTREAM command.
+//
+// Possible replies are:
+//
+//	stream: OK
+//	stream: Eicar-Signature FOUND
+//	INSTREAM size limit exceeded. ERROR
+func parseReply(reply string) (string, error) {
+	reply = strings.TrimSpace(reply)
+	switch {
+	case reply == "stream: OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		virus := strings.TrimSuffix(reply, " FOUND")
+		virus = strings.TrimPrefix(virus, "stream: ")
+		return virus, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return "", fmt.Errorf("clamd error: %s", strings.TrimSuffix(reply, " ERROR"))
+	default:
+		return "", fmt.Errorf("unexpected clamd reply: %q", reply)
+	}
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// scanCached scans the message or returns the cached result for the same
+// body if cache_ttl is set.
+func (s *state) scanCached(ctx context.Context, hdrBuf *bytes.Buffer, body buffer.Buffer) (string, error) {
+	var cacheKey string
+	if s.c.cache != nil {
+		var err error
+		cacheKey, err = scancache.BodyKey(body)
+		if err != nil {
+			return "", err
+		}
+		if virus, ok := s.c.cache.Get(cacheKey); ok {
+			s.log.DebugMsg("using cached scan result")
+			return virus.(string), nil
+		}
+	}
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return "", err
+	}
+	defer bodyR.Close()
+
+	virus, err := s.c.scan(ctx, io.MultiReader(hdrBuf, bodyR))
+	if err != nil {
+		return "", err
+	}
+	if cacheKey != "" {
+		s.c.cache.Put(cacheKey, virus)
+	}
+	return virus, nil
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "clamav/CheckBody").End()
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+
+	if s.c.maxSize > 0 && hdrBuf.Len()+body.Len() > s.c.maxSize {
+		s.log.DebugMsg("message is too big, skipping scan", "size", hdrBuf.Len()+body.Len())
+		return s.c.oversizeAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         552,
+				EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+				Message:      "Message is too big to be scanned for viruses",
+				CheckName:    modName,
+			},
+		})
+	}
+
+	virus, err := s.scanCached(ctx, &hdrBuf, body)
+	if err != nil {
+		return s.c.ioErrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during virus scan",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+	if virus == "" {
+		s.log.DebugMsg("message is clean")
+		return module.CheckResult{}
+	}
+
+	return s.c.actionFor(virus).Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message contains a virus",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"virus": virus,
+			},
+		},
+	})
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,188 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check/scancache"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// fakeClamd accepts INSTREAM commands and reports messages containing
+// "EICAR" and "PUA-TEST" as infected.
+func fakeClamd(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				cmd, err := r.ReadString(0)
+				if err != nil || cmd != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+						return
+					}
+				}
+
+				switch {
+				case bytes.Contains(data.Bytes(), []byte("EICAR")):
+					io.WriteString(conn, "stream: Eicar-Signature FOUND\x00")
+				case bytes.Contains(data.Bytes(), []byte("PUA-TEST")):
+					io.WriteString(conn, "stream: PUA.Win.Test FOUND\x00")
+				default:
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestCheckBody(t *testing.T) {
+	l := fakeClamd(t)
+	defer l.Close()
+
+	c := &Check{
+		log: testutils.Logger(t, modName),
+		endpoint: config.Endpoint{
+			Scheme: "tcp",
+			Host:   "127.0.0.1",
+			Port:   strings.Split(l.Addr().String(), ":")[1],
+		},
+		timeout:     5 * time.Second,
+		maxSize:     1024 * 1024,
+		virusAction: modconfig.FailAction{Reject: true},
+		familyActions: []familyAction{
+			{pattern: "PUA.*", action: modconfig.FailAction{Quarantine: true}},
+		},
+		ioErrAction: modconfig.FailAction{Reject: true},
+		dialer:      (&net.Dialer{}).DialContext,
+	}
+
+	check := func(body string) module.CheckResult {
+		t.Helper()
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("Subject", "test")
+		return st.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte(body)})
+	}
+
+	if res := check("Hello!"); res.Reason != nil {
+		t.Errorf("clean message rejected: %v", res.Reason)
+	}
+	if res := check("Hello! EICAR"); !res.Reject {
+		t.Errorf("infected message not rejected: %+v", res)
+	}
+	if res := check("Hello! PUA-TEST"); !res.Quarantine || res.Reject {
+		t.Errorf("family_action is not used: %+v", res)
+	}
+
+	// Larger than a single chunk.
+	if res := check(strings.Repeat("A", chunkSize*2+10) + "EICAR"); !res.Reject {
+		t.Errorf("infected multi-chunk message not rejected: %+v", res)
+	}
+
+	c.maxSize = 10
+	if res := check("Hello! EICAR"); res.Reject || res.Quarantine {
+		t.Errorf("oversized message is not skipped: %+v", res)
+	}
+	c.maxSize = 0
+
+	c.cache = scancache.New(time.Minute)
+	if res := check("Cached"); res.Reason != nil {
+		t.Errorf("clean message rejected: %v", res.Reason)
+	}
+
+	l.Close()
+	if res := check("Cached  \r\n"); res.Reason != nil {
+		t.Errorf("cached result is not used: %v", res.Reason)
+	}
+	if res := check("Hello!"); !res.Reject {
+		t.Errorf("I/O error is not handled using io_error_action: %+v", res)
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	for _, c := range []struct {
+		reply string
+		virus string
+		fail  bool
+	}{
+		{reply: "stream: OK", virus: ""},
+		{reply: "stream: Eicar-Signature FOUND", virus: "Eicar-Signature"},
+		{reply: "stream: Win.Test.EICAR_HDB-1 FOUND\n", virus: "Win.Test.EICAR_HDB-1"},
+		{reply: "INSTREAM size limit exceeded. ERROR", fail: true},
+		{reply: "", fail: true},
+	} {
+		virus, err := parseReply(c.reply)
+		if c.fail {
+			if err == nil {
+				t.Errorf("expected failure for %q", c.reply)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", c.reply, err)
+			continue
+		}
+		if virus != c.virus {
+			t.Errorf("wrong virus name for %q: %q", c.reply, virus)
+		}
+	}
+}
@@ -48,6 +48,7 @@ type Check struct {
 	brokenSigAction modconfig.FailAction
 	noSigAction     modconfig.FailAction
 	failOpen        bool
+	requireAligned  module.Table
 
 	resolver dns.Resolver
 }
@@ -77,6 +78,7 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
 		}, modconfig.FailActionDirective, &c.noSigAction)
+	cfg.Custom("require_aligned", false, false, nil, modconfig.TableDirective, &c.requireAligned)
 	_, err := cfg.Process()
 	if err != nil {
 		return err
@@ -125,7 +127,7 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 		} else {
 			d.log.Debugf("no signatures present")
 		}
-		return d.c.noSigAction.Apply(module.CheckResult{
+		res := d.c.noSigAction.Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
@@ -138,6 +140,7 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 				},
 			},
 		})
+		return d.applyRequirement(ctx, header, nil, res)
 	}
 
 	b := bytes.Buffer{}
@@ -175,6 +178,7 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 	}
 
 	goodSigs := false
+	var goodDomains []string
 
 	res := module.CheckResult{AuthResult: make([]authres.Result, 0, len(verifications))}
 	for _, verif := range verifications {
@@ -228,6 +232,7 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 
 		if val == authres.ResultPass {
 			goodSigs = true
+			goodDomains = append(goodDomains, verif.Domain)
 			d.log.DebugMsg("good signature", "domain", verif.Domain, "identifier", verif.Identifier)
 		}
 
@@ -246,9 +251,9 @@ func (d *dkimCheckState) CheckBody(ctx context.Context, header textproto.Header,
 			Message:      "No passing DKIM signatures",
 			CheckName:    "check.dkim",
 		}
-		return d.c.brokenSigAction.Apply(res)
+		res = d.c.brokenSigAction.Apply(res)
 	}
-	return res
+	return d.applyRequirement(ctx, header, goodDomains, res)
 }
 
 func (d *dkimCheckState) Name() string {
@@ -362,3 +362,47 @@ func TestDkimVerify_FailOpen(t *testing.T) {
 		t.Fatal("Result is not temp. error:", resVal)
 	}
 }
+
+func TestDkimVerify_RequireAligned(t *testing.T) {
+	test := func(table map[string]string, mail string, zones map[string]mockdns.Zone, reject, quarantine bool) {
+		t.Helper()
+
+		check := testCheck(t, zones, nil)
+		check.requireAligned = testutils.Table{M: table}
+
+		ctx := context.Background()
+		s, err := check.CheckStateForMsg(ctx, &module.MsgMetadata{
+			ID: "test_require",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hdr, buf := testutils.BodyFromStr(t, mail)
+		result := s.CheckBody(ctx, hdr, buf)
+
+		if result.Reject != reject {
+			t.Errorf("Reject = %v, want %v (reason: %v)", result.Reject, reject, result.Reason)
+		}
+		if result.Quarantine != quarantine {
+			t.Errorf("Quarantine = %v, want %v (reason: %v)", result.Quarantine, quarantine, result.Reason)
+		}
+		if len(result.AuthResult) == 0 {
+			t.Error("Authentication-Results are lost")
+		}
+	}
+
+	// Domain not listed.
+	test(map[string]string{"example.org": ""}, unsignedMailString, nil, false, false)
+	// Listed domain, no signatures.
+	test(map[string]string{"football.example.com": ""}, unsignedMailString, nil, true, false)
+	// Parent domain listed.
+	test(map[string]string{"example.com": ""}, unsignedMailString, nil, true, false)
+	// Custom action.
+	test(map[string]string{"example.com": "quarantine"}, unsignedMailString, nil, false, true)
+	test(map[string]string{"example.com": "ignore"}, unsignedMailString, nil, false, false)
+	// Valid signature aligned with the From domain (d=example.com).
+	test(map[string]string{"football.example.com": ""}, verifiedMailString, testZones, false, false)
+	// Signature does not verify.
+	test(map[string]string{"football.example.com": ""}, verifiedMailString, nil, true, false)
+}
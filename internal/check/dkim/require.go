@@ -0,0 +1,122 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dmarc"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	maddydmarc "github.com/foxcpp/maddy/internal/dmarc"
+)
+
+// requiredPolicy looks up the sender domain and its parent domains in the
+// require_aligned table.
+//
+// It returns the matched table key and the action to apply if the message
+// does not have a passing DKIM signature aligned with the From domain.
+func (d *dkimCheckState) requiredPolicy(ctx context.Context, fromDomain string) (string, modconfig.FailAction, bool) {
+	labels := strings.Split(fromDomain, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		key := strings.Join(labels[i:], ".")
+		val, ok, err := d.c.requireAligned.Lookup(ctx, key)
+		if err != nil {
+			d.log.Error("require_aligned lookup failed", err, "key", key)
+			return "", modconfig.FailAction{}, false
+		}
+		if !ok {
+			continue
+		}
+
+		val = strings.TrimSpace(val)
+		if val == "" {
+			return key, modconfig.FailAction{Reject: true}, true
+		}
+		action, err := modconfig.ParseActionDirective(strings.Fields(val))
+		if err != nil {
+			d.log.Error("malformed require_aligned action, using reject", err, "key", key, "value", val)
+			return key, modconfig.FailAction{Reject: true}, true
+		}
+		return key, action, true
+	}
+	return "", modconfig.FailAction{}, false
+}
+
+// applyRequirement enforces the require_aligned policy on top of the result
+// already computed for the message.
+//
+// goodDomains contains the d= values of all signatures that verified
+// successfully.
+func (d *dkimCheckState) applyRequirement(ctx context.Context, header textproto.Header, goodDomains []string, res module.CheckResult) module.CheckResult {
+	if d.c.requireAligned == nil || res.Reject {
+		return res
+	}
+
+	fromDomain, err := maddydmarc.ExtractFromDomain(header)
+	if err != nil {
+		// check.dmarc is responsible for rejecting malformed From.
+		d.log.DebugMsg("cannot extract From domain, skipping require_aligned", "reason", err)
+		return res
+	}
+	fromDomain, err = dns.ForLookup(fromDomain)
+	if err != nil {
+		d.log.DebugMsg("malformed From domain, skipping require_aligned", "reason", err)
+		return res
+	}
+
+	policyDomain, action, ok := d.requiredPolicy(ctx, fromDomain)
+	if !ok || (!action.Reject && !action.Quarantine && action.Score == 0 && len(action.Redirect) == 0 && !action.Annotate && action.Delay == 0) {
+		return res
+	}
+
+	for _, domain := range goodDomains {
+		if maddydmarc.IsAligned(fromDomain, domain, dmarc.AlignmentRelaxed) {
+			return res
+		}
+	}
+
+	d.log.Msg("no aligned DKIM signature for the sender domain that requires it",
+		"from_domain", fromDomain, "policy_domain", policyDomain)
+
+	reqRes := action.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 20},
+			Message:      "Valid DKIM signature is required for the sender domain",
+			CheckName:    "check.dkim",
+			Misc: map[string]interface{}{
+				"from_domain":   fromDomain,
+				"policy_domain": policyDomain,
+			},
+		},
+	})
+
+	reqRes.AuthResult = res.AuthResult
+	reqRes.Quarantine = reqRes.Quarantine || res.Quarantine
+	reqRes.Score += res.Score
+	if reqRes.Reason == nil {
+		reqRes.Reason = res.Reason
+	}
+	return reqRes
+}
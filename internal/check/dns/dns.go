@@ -68,6 +68,17 @@ func requireMatchingRDNS(ctx check.StatelessCheckContext) module.CheckResult {
 	}
 	rdnsName := rdnsNameI.(string)
 
+	if ctx.Authenticated && !ctx.MsgMeta.Conn.RDNSAuthenticated {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 25},
+				Message:      "PTR record is not authenticated using DNSSEC",
+				CheckName:    "require_matching_rdns",
+			},
+		}
+	}
+
 	srcDomain := strings.TrimSuffix(ctx.MsgMeta.Conn.Hostname, ".")
 	rdnsName = strings.TrimSuffix(rdnsName, ".")
 
@@ -114,7 +125,7 @@ func requireMXRecord(ctx check.StatelessCheckContext, mailFrom string) module.Ch
 		}
 	}
 
-	srcMx, err := ctx.Resolver.LookupMX(ctx, domain)
+	ad, srcMx, err := dns.AuthLookupMX(ctx, ctx.Resolver, domain)
 	if err != nil {
 		reason, misc := exterrors.UnwrapDNSErr(err)
 		return module.CheckResult{
@@ -130,6 +141,17 @@ func requireMXRecord(ctx check.StatelessCheckContext, mailFrom string) module.Ch
 		}
 	}
 
+	if ctx.Authenticated && !ad {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 27},
+				Message:      "MX records of the MAIL FROM domain are not authenticated using DNSSEC",
+				CheckName:    "require_mx_record",
+			},
+		}
+	}
+
 	if len(srcMx) == 0 {
 		return module.CheckResult{
 			Reason: &exterrors.SMTPError{
@@ -157,6 +179,92 @@ func requireMXRecord(ctx check.StatelessCheckContext, mailFrom string) module.Ch
 	return module.CheckResult{}
 }
 
+// requireRDNS checks that the client IP has a PTR record and the name it
+// points to resolves back to the client IP (forward-confirmed reverse DNS).
+func requireRDNS(ctx check.StatelessCheckContext) module.CheckResult {
+	if ctx.MsgMeta.Conn == nil {
+		ctx.Logger.Msg("locally-generated message, skipping")
+		return module.CheckResult{}
+	}
+	if ctx.MsgMeta.Conn.RDNSName == nil {
+		ctx.Logger.Msg("rDNS lookup is disabled, skipping")
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := ctx.MsgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		ctx.Logger.Msg("non-TCP/IP source, skipping")
+		return module.CheckResult{}
+	}
+
+	rdnsNameI, err := ctx.MsgMeta.Conn.RDNSName.GetContext(ctx)
+	if err != nil {
+		reason, misc := exterrors.UnwrapDNSErr(err)
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         exterrors.SMTPCode(err, 450, 550),
+				EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 7, 25}),
+				Message:      "DNS error during policy check",
+				CheckName:    "require_rdns",
+				Err:          err,
+				Reason:       reason,
+				Misc:         misc,
+			},
+		}
+	}
+	if rdnsNameI == nil {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 25},
+				Message:      "No PTR record found",
+				CheckName:    "require_rdns",
+			},
+		}
+	}
+	if ctx.Authenticated && !ctx.MsgMeta.Conn.RDNSAuthenticated {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 25},
+				Message:      "PTR record is not authenticated using DNSSEC",
+				CheckName:    "require_rdns",
+			},
+		}
+	}
+	rdnsName := rdnsNameI.(string)
+
+	_, ips, err := dns.AuthLookupIPAddr(ctx, ctx.Resolver, dns.FQDN(rdnsName))
+	if err != nil && !dns.IsNotFound(err) {
+		reason, misc := exterrors.UnwrapDNSErr(err)
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         exterrors.SMTPCode(err, 450, 550),
+				EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 7, 25}),
+				Message:      "DNS error during policy check",
+				CheckName:    "require_rdns",
+				Err:          err,
+				Reason:       reason,
+				Misc:         misc,
+			},
+		}
+	}
+	for _, ip := range ips {
+		if tcpAddr.IP.Equal(ip.IP) {
+			ctx.Logger.Debugf("PTR record %s resolves to the client IP, OK", rdnsName)
+			return module.CheckResult{}
+		}
+	}
+
+	return module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 25},
+			Message:      "rDNS name does not resolve to the client IP",
+			CheckName:    "require_rdns",
+		},
+	}
+}
+
 func requireMatchingEHLO(ctx check.StatelessCheckContext) module.CheckResult {
 	ctx.Logger.Printf("require_matching_echo is deprecated and will be removed in the next release")
 
@@ -205,7 +313,7 @@ func requireMatchingEHLO(ctx check.StatelessCheckContext) module.CheckResult {
 		return module.CheckResult{}
 	}
 
-	srcIPs, err := ctx.Resolver.LookupIPAddr(ctx, dns.FQDN(ehlo))
+	ad, srcIPs, err := dns.AuthLookupIPAddr(ctx, ctx.Resolver, dns.FQDN(ehlo))
 	if err != nil {
 		reason, misc := exterrors.UnwrapDNSErr(err)
 		return module.CheckResult{
@@ -221,6 +329,17 @@ func requireMatchingEHLO(ctx check.StatelessCheckContext) module.CheckResult {
 		}
 	}
 
+	if ctx.Authenticated && !ad {
+		return module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+				Message:      "A/AAAA records of the EHLO hostname are not authenticated using DNSSEC",
+				CheckName:    "require_matching_ehlo",
+			},
+		}
+	}
+
 	for _, ip := range srcIPs {
 		if tcpAddr.IP.Equal(ip.IP) {
 			ctx.Logger.Debugf("A/AAA record found for %s for %s domain", tcpAddr.IP, ehlo)
@@ -238,10 +357,12 @@ func requireMatchingEHLO(ctx check.StatelessCheckContext) module.CheckResult {
 }
 
 func init() {
-	check.RegisterStatelessCheck("require_matching_rdns", modconfig.FailAction{Quarantine: true},
-		requireMatchingRDNS, nil, nil, nil)
+	check.RegisterConnCheck("require_matching_rdns", modconfig.FailAction{Quarantine: true},
+		check.StageEHLO, requireMatchingRDNS)
+	check.RegisterConnCheck("require_rdns", modconfig.FailAction{Quarantine: true},
+		check.StageConnect, requireRDNS)
 	check.RegisterStatelessCheck("require_mx_record", modconfig.FailAction{Quarantine: true},
 		nil, requireMXRecord, nil, nil)
-	check.RegisterStatelessCheck("require_matching_ehlo", modconfig.FailAction{Quarantine: true},
-		requireMatchingEHLO, nil, nil, nil)
+	check.RegisterConnCheck("require_matching_ehlo", modconfig.FailAction{Quarantine: true},
+		check.StageEHLO, requireMatchingEHLO)
 }
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package dns
 
 import (
+	"context"
 	"net"
 	"testing"
 
@@ -80,6 +81,51 @@ func TestRequireMatchingRDNS(t *testing.T) {
 	test("example.com.", "example.org.", true)
 }
 
+func TestRequireRDNS(t *testing.T) {
+	test := func(rdns string, a []string, fail bool) {
+		rdnsFut := future.New()
+		if rdns != "" {
+			rdnsFut.Set(rdns, nil)
+		} else {
+			rdnsFut.Set(nil, nil)
+		}
+
+		res := requireRDNS(check.StatelessCheckContext{
+			Context: context.Background(),
+			Resolver: &mockdns.Resolver{
+				Zones: map[string]mockdns.Zone{
+					"mx.example.org.": {
+						A: a,
+					},
+				},
+			},
+			MsgMeta: &module.MsgMetadata{
+				Conn: &module.ConnState{
+					ConnectionState: smtp.ConnectionState{
+						RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
+					},
+					RDNSName: rdnsFut,
+				},
+			},
+			Logger: testutils.Logger(t, "require_rdns"),
+		})
+
+		actualFail := res.Reason != nil
+		if fail && !actualFail {
+			t.Errorf("%v, %v: expected failure but check succeeded", rdns, a)
+		}
+		if !fail && actualFail {
+			t.Errorf("%v, %v: unexpected failure: %v", rdns, a, res.Reason)
+		}
+	}
+
+	test("", nil, true)
+	test("mx.example.org", nil, true)
+	test("mx.example.org", []string{"1.2.3.5"}, true)
+	test("mx.example.org", []string{"1.2.3.5", "1.2.3.4"}, false)
+	test("mx.example.org.", []string{"1.2.3.4"}, false)
+}
+
 func TestRequireMXRecord(t *testing.T) {
 	test := func(mailFrom, mxDomain string, mx []net.MX, fail bool) {
 		res := requireMXRecord(check.StatelessCheckContext{
@@ -183,3 +229,80 @@ func TestMatchingEHLO(t *testing.T) {
 	test("[IPv6:beef::1]", net.ParseIP("beef::1"),
 		nil, nil, false)
 }
+
+// adResolver reports the AD flag using the Zone.AD value.
+type adResolver struct {
+	*mockdns.Resolver
+}
+
+func (r adResolver) AuthLookupAddr(ctx context.Context, addr string) (bool, []string, error) {
+	names, err := r.LookupAddr(ctx, addr)
+	return false, names, err
+}
+
+func (r adResolver) AuthLookupMX(ctx context.Context, name string) (bool, []*net.MX, error) {
+	mxs, err := r.LookupMX(ctx, name)
+	return r.Zones[name+"."].AD, mxs, err
+}
+
+func (r adResolver) AuthLookupIPAddr(ctx context.Context, host string) (bool, []net.IPAddr, error) {
+	addrs, err := r.LookupIPAddr(ctx, host)
+	return r.Zones[host].AD, addrs, err
+}
+
+func TestRequireMXRecord_Authenticated(t *testing.T) {
+	test := func(ad, authenticated, fail bool) {
+		res := requireMXRecord(check.StatelessCheckContext{
+			Resolver: adResolver{&mockdns.Resolver{
+				Zones: map[string]mockdns.Zone{
+					"example.org.": {
+						AD: ad,
+						MX: []net.MX{{Host: "mx.example.org"}},
+					},
+				},
+			}},
+			MsgMeta:       &module.MsgMetadata{},
+			Authenticated: authenticated,
+			Logger:        testutils.Logger(t, "require_mx_record"),
+		}, "foo@example.org")
+
+		if actualFail := res.Reason != nil; actualFail != fail {
+			t.Errorf("ad=%v authenticated=%v: want fail=%v, got %v", ad, authenticated, fail, res.Reason)
+		}
+	}
+
+	test(false, false, false)
+	test(true, false, false)
+	test(false, true, true)
+	test(true, true, false)
+}
+
+func TestRequireMatchingRDNS_Authenticated(t *testing.T) {
+	test := func(ad, authenticated, fail bool) {
+		rdnsFut := future.New()
+		rdnsFut.Set("mx.example.org", nil)
+
+		res := requireMatchingRDNS(check.StatelessCheckContext{
+			MsgMeta: &module.MsgMetadata{
+				Conn: &module.ConnState{
+					ConnectionState: smtp.ConnectionState{
+						RemoteAddr: &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 55555},
+						Hostname:   "mx.example.org",
+					},
+					RDNSName:          rdnsFut,
+					RDNSAuthenticated: ad,
+				},
+			},
+			Authenticated: authenticated,
+			Logger:        testutils.Logger(t, "require_matching_rdns"),
+		})
+
+		if actualFail := res.Reason != nil; actualFail != fail {
+			t.Errorf("ad=%v authenticated=%v: want fail=%v, got %v", ad, authenticated, fail, res.Reason)
+		}
+	}
+
+	test(false, false, false)
+	test(false, true, true)
+	test(true, true, false)
+}
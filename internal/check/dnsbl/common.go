@@ -21,7 +21,6 @@ package dnsbl
 import (
 	"context"
 	"net"
-	"strconv"
 	"strings"
 
 	"github.com/foxcpp/maddy/framework/dns"
@@ -163,35 +162,5 @@ addrsLoop:
 }
 
 func queryString(ip net.IP) string {
-	ipv6 := true
-	if ipv4 := ip.To4(); ipv4 != nil {
-		ip = ipv4
-		ipv6 = false
-	}
-
-	res := strings.Builder{}
-	if ipv6 {
-		res.Grow(63) // 0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0
-	} else {
-		res.Grow(15) // 000.000.000.000
-	}
-
-	for i := len(ip) - 1; i >= 0; i-- {
-		octet := ip[i]
-
-		if ipv6 {
-			// X.X
-			res.WriteString(strconv.FormatInt(int64(octet&0xf), 16))
-			res.WriteRune('.')
-			res.WriteString(strconv.FormatInt(int64((octet&0xf0)>>4), 16))
-		} else {
-			// X
-			res.WriteString(strconv.Itoa(int(octet)))
-		}
-
-		if i != 0 {
-			res.WriteRune('.')
-		}
-	}
-	return res.String()
+	return dns.ReverseIP(ip)
 }
@@ -35,6 +35,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check"
 	"github.com/foxcpp/maddy/internal/target"
 	"golang.org/x/sync/errgroup"
 )
@@ -57,14 +58,19 @@ var defaultBL = List{
 }
 
 type DNSBL struct {
-	instName   string
-	checkEarly bool
-	inlineBls  []string
-	bls        []List
+	instName  string
+	stage     check.ConnStage
+	inlineBls []string
+	bls       []List
 
 	quarantineThres int
 	rejectThres     int
 
+	// Minimal amount of lists client should be listed on (in addition to
+	// the score threshold) for the corresponding action to be taken.
+	quarantineLists int
+	rejectLists     int
+
 	resolver dns.Resolver
 	log      log.Logger
 }
@@ -89,14 +95,23 @@ func (bl *DNSBL) InstanceName() string {
 
 func (bl *DNSBL) Init(cfg *config.Map) error {
 	cfg.Bool("debug", false, false, &bl.log.Debug)
-	cfg.Bool("check_early", false, false, &bl.checkEarly)
+	var checkEarly bool
+	cfg.Bool("check_early", false, false, &checkEarly)
+	cfg.Custom("stage", false, false, func() (interface{}, error) {
+		return check.StageMessage, nil
+	}, check.ConnStageDirective(check.StageConnect), &bl.stage)
 	cfg.Int("quarantine_threshold", false, false, 1, &bl.quarantineThres)
 	cfg.Int("reject_threshold", false, false, 9999, &bl.rejectThres)
+	cfg.Int("quarantine_lists", false, false, 1, &bl.quarantineLists)
+	cfg.Int("reject_lists", false, false, 1, &bl.rejectLists)
 	cfg.AllowUnknown()
 	unknown, err := cfg.Process()
 	if err != nil {
 		return err
 	}
+	if checkEarly && bl.stage == check.StageMessage {
+		bl.stage = check.StageEHLO
+	}
 
 	for _, inlineBl := range bl.inlineBls {
 		cfg := defaultBL
@@ -295,10 +310,11 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 		eg = errgroup.Group{}
 
 		// Protects variables below.
-		lck      sync.Mutex
-		score    int
-		listedOn []string
-		reasons  []string
+		lck         sync.Mutex
+		score       int
+		listedCount int
+		listedOn    []string
+		reasons     []string
 	)
 
 	for _, list := range bl.bls {
@@ -316,6 +332,12 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 				listedOn = append(listedOn, listErr.List)
 				reasons = append(reasons, listErr.Reason)
 				score += list.ScoreAdj
+				// Lists with negative score act as whitelists and lists
+				// with zero score are informational, neither should be
+				// counted.
+				if list.ScoreAdj > 0 {
+					listedCount++
+				}
 			}
 			return nil
 		})
@@ -336,7 +358,12 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 		}
 	}
 
-	if score >= bl.rejectThres {
+	misc := map[string]interface{}{
+		"score":     score,
+		"listed_on": strings.Join(listedOn, ","),
+	}
+
+	if score >= bl.rejectThres && listedCount >= bl.rejectLists {
 		return module.CheckResult{
 			Reject: true,
 			Reason: &exterrors.SMTPError{
@@ -345,10 +372,11 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 				Message:      "Client identity is listed in the used DNSBL",
 				Err:          err,
 				CheckName:    "dnsbl",
+				Misc:         misc,
 			},
 		}
 	}
-	if score >= bl.quarantineThres {
+	if score >= bl.quarantineThres && listedCount >= bl.quarantineLists {
 		return module.CheckResult{
 			Quarantine: true,
 			Reason: &exterrors.SMTPError{
@@ -357,6 +385,7 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 				Message:      "Client identity is listed in the used DNSBL",
 				Err:          err,
 				CheckName:    "dnsbl",
+				Misc:         misc,
 			},
 		}
 	}
@@ -366,7 +395,7 @@ func (bl *DNSBL) checkLists(ctx context.Context, ip net.IP, ehlo, mailFrom strin
 
 // CheckConnection implements module.EarlyCheck.
 func (bl *DNSBL) CheckConnection(ctx context.Context, state *smtp.ConnectionState) error {
-	if !bl.checkEarly {
+	if bl.stage != check.StageEHLO {
 		return nil
 	}
 
@@ -388,6 +417,29 @@ func (bl *DNSBL) CheckConnection(ctx context.Context, state *smtp.ConnectionStat
 	return nil
 }
 
+// CheckConnect implements module.ConnectCheck.
+func (bl *DNSBL) CheckConnect(ctx context.Context, remoteAddr net.Addr) error {
+	if bl.stage != check.StageConnect {
+		return nil
+	}
+
+	defer trace.StartRegion(ctx, "dnsbl/CheckConnect").End()
+
+	ip, ok := remoteAddr.(*net.TCPAddr)
+	if !ok {
+		bl.log.Msg("non-TCP/IP source", "src_addr", remoteAddr)
+		return nil
+	}
+
+	// EHLO hostname is not known yet, only client IP lists are checked.
+	result := bl.checkLists(ctx, ip.IP, "", "")
+	if result.Reject {
+		return result.Reason
+	}
+
+	return nil
+}
+
 type state struct {
 	bl      *DNSBL
 	msgMeta *module.MsgMetadata
@@ -403,7 +455,7 @@ func (bl *DNSBL) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetada
 }
 
 func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
-	if s.bl.checkEarly {
+	if s.bl.stage != check.StageMessage {
 		// Already checked before.
 		return module.CheckResult{}
 	}
@@ -25,6 +25,7 @@ import (
 	"testing"
 
 	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/check"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
 
@@ -211,3 +212,98 @@ func TestCheckLists(t *testing.T) {
 		true, false,
 	)
 }
+
+func TestCheckLists_ListsCount(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+		"4.3.2.1.example.net.": {
+			A: []string{"127.0.0.1"},
+		},
+		"4.3.2.1.whitelist.example.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+	test := func(bls []List, reject, quarantine bool) {
+		t.Helper()
+		mod := &DNSBL{
+			bls:             bls,
+			resolver:        &mockdns.Resolver{Zones: zones},
+			log:             testutils.Logger(t, "dnsbl"),
+			quarantineThres: 1,
+			quarantineLists: 2,
+			rejectThres:     1,
+			rejectLists:     3,
+		}
+		result := mod.checkLists(context.Background(), net.IPv4(1, 2, 3, 4), "mx.example.com", "foo@example.com")
+
+		if result.Reject != reject {
+			t.Errorf("Expected Reject to be %v, got %v", reject, result.Reject)
+		}
+		if result.Quarantine != quarantine {
+			t.Errorf("Expected Quarantine to be %v, got %v", quarantine, result.Quarantine)
+		}
+	}
+
+	// Listed on one list only, score is enough but no action is taken.
+	test([]List{
+		{Zone: "example.org", ClientIPv4: true, ScoreAdj: 5},
+		{Zone: "example.com", ClientIPv4: true, ScoreAdj: 1},
+	}, false, false)
+
+	// Listed on two lists, quarantine.
+	test([]List{
+		{Zone: "example.org", ClientIPv4: true, ScoreAdj: 1},
+		{Zone: "example.net", ClientIPv4: true, ScoreAdj: 1},
+	}, false, true)
+
+	// Whitelists are not counted.
+	test([]List{
+		{Zone: "example.org", ClientIPv4: true, ScoreAdj: 2},
+		{Zone: "whitelist.example", ClientIPv4: true, ScoreAdj: -1},
+	}, false, false)
+
+	// Lists with zero score are not counted either.
+	test([]List{
+		{Zone: "example.org", ClientIPv4: true, ScoreAdj: 1},
+		{Zone: "example.net", ClientIPv4: true, ScoreAdj: 0},
+	}, false, false)
+}
+
+func TestCheckConnect(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"4.3.2.1.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+		"mx.example.com.example.org.": {
+			A: []string{"127.0.0.1"},
+		},
+	}
+	test := func(stage check.ConnStage, bls []List, ip net.IP, reject bool) {
+		t.Helper()
+		mod := &DNSBL{
+			bls:             bls,
+			resolver:        &mockdns.Resolver{Zones: zones},
+			log:             testutils.Logger(t, "dnsbl"),
+			quarantineThres: 1,
+			rejectThres:     1,
+			stage:           stage,
+		}
+		err := mod.CheckConnect(context.Background(), &net.TCPAddr{IP: ip, Port: 25})
+		if err != nil && !reject {
+			t.Errorf("Expected connection to not be rejected, got %v", err)
+		}
+		if err == nil && reject {
+			t.Errorf("Expected connection to be rejected")
+		}
+	}
+
+	test(check.StageConnect, []List{{Zone: "example.org", ClientIPv4: true, ScoreAdj: 1}}, net.IPv4(1, 2, 3, 4), true)
+	test(check.StageConnect, []List{{Zone: "example.org", ClientIPv4: true, ScoreAdj: 1}}, net.IPv4(1, 2, 3, 5), false)
+	// Not configured to run at connect stage.
+	test(check.StageEHLO, []List{{Zone: "example.org", ClientIPv4: true, ScoreAdj: 1}}, net.IPv4(1, 2, 3, 4), false)
+	test(check.StageMessage, []List{{Zone: "example.org", ClientIPv4: true, ScoreAdj: 1}}, net.IPv4(1, 2, 3, 4), false)
+	// EHLO is not known at connect stage.
+	test(check.StageConnect, []List{{Zone: "example.org", EHLO: true, ScoreAdj: 1}}, net.IPv4(1, 2, 3, 4), false)
+}
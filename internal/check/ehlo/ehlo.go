@@ -0,0 +1,264 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package ehlo implements the check that validates the hostname the client
+// presents in the EHLO (HELO, LHLO) command.
+//
+// Unlike require_matching_ehlo, no DNS lookups are done. The check looks for
+// arguments no legitimate MTA should use: bare IP addresses without
+// brackets, unqualified names, names of the server itself and syntactically
+// invalid domains. Each condition has its own action.
+package ehlo
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "check.ehlo"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	ownNames []string
+	skipAuth bool
+
+	bareIPAction      modconfig.FailAction
+	unqualifiedAction modconfig.FailAction
+	ownNameAction     modconfig.FailAction
+	invalidAction     modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		hostname string
+		ownNames []string
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.StringList("own_hostnames", false, false, nil, &ownNames)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuth)
+	cfg.Custom("bare_ip_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.bareIPAction)
+	cfg.Custom("unqualified_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.unqualifiedAction)
+	cfg.Custom("own_hostname_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.ownNameAction)
+	cfg.Custom("invalid_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.invalidAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if hostname != "" {
+		ownNames = append(ownNames, hostname)
+	}
+	for _, name := range ownNames {
+		aName, err := idna.ToASCII(strings.TrimSuffix(name, "."))
+		if err != nil {
+			return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", modName, err)
+		}
+		c.ownNames = append(c.ownNames, aName)
+	}
+	return nil
+}
+
+// validDomain checks the Domain syntax (RFC 5321 Section 4.1.2). U-labels
+// are accepted since they are allowed with SMTPUTF8.
+func validDomain(domain string) bool {
+	domain, err := idna.ToASCII(domain)
+	if err != nil || len(domain) == 0 || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && ch != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseLiteral parses the address literal (RFC 5321 Section 4.1.3).
+// nil is returned if the literal is malformed.
+func parseLiteral(literal string) net.IP {
+	literal = literal[1 : len(literal)-1]
+	if strings.HasPrefix(literal, "IPv6:") {
+		addr := strings.TrimPrefix(literal, "IPv6:")
+		if !strings.Contains(addr, ":") {
+			return nil
+		}
+		return net.ParseIP(addr)
+	}
+	ip := net.ParseIP(literal)
+	if ip == nil || ip.To4() == nil {
+		return nil
+	}
+	return ip
+}
+
+type problem struct {
+	action modconfig.FailAction
+	msg    string
+}
+
+// ehloProblem returns the problem found in the EHLO argument, if any.
+func (c *Check) ehloProblem(ehlo string, localAddr net.Addr) *problem {
+	if strings.HasPrefix(ehlo, "[") && strings.HasSuffix(ehlo, "]") {
+		ip := parseLiteral(ehlo)
+		if ip == nil {
+			return &problem{c.invalidAction, "Malformed address literal in EHLO"}
+		}
+		if tcpAddr, ok := localAddr.(*net.TCPAddr); ok && tcpAddr.IP.Equal(ip) {
+			return &problem{c.ownNameAction, "EHLO uses the server address"}
+		}
+		return nil
+	}
+
+	if net.ParseIP(ehlo) != nil {
+		return &problem{c.bareIPAction, "IP address in EHLO is not enclosed in brackets"}
+	}
+
+	domain := strings.TrimSuffix(ehlo, ".")
+	if !validDomain(domain) {
+		return &problem{c.invalidAction, "Malformed hostname in EHLO"}
+	}
+	if !strings.Contains(domain, ".") {
+		return &problem{c.unqualifiedAction, "Hostname in EHLO is not fully qualified"}
+	}
+	for _, name := range c.ownNames {
+		if dns.Equal(domain, name) {
+			return &problem{c.ownNameAction, "EHLO uses the server hostname"}
+		}
+	}
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, "ehlo/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.skipAuth && s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+
+	ehlo := s.msgMeta.Conn.Hostname
+	p := s.c.ehloProblem(ehlo, s.msgMeta.Conn.LocalAddr)
+	if p == nil {
+		return module.CheckResult{}
+	}
+
+	return p.action.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+			Message:      p.msg,
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"ehlo": ehlo,
+			},
+		},
+	})
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,100 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ehlo
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestValidDomain(t *testing.T) {
+	for domain, valid := range map[string]bool{
+		"mx.example.org":   true,
+		"mx-1.example.org": true,
+		"тест.example":     true,
+		"localhost":        true,
+		"mx_1.example.org": false,
+		"-mx.example.org":  false,
+		"mx..example.org":  false,
+		"":                 false,
+		"mx.example.org/":  false,
+	} {
+		if validDomain(domain) != valid {
+			t.Errorf("%q: want %v", domain, valid)
+		}
+	}
+}
+
+func TestCheckConnection(t *testing.T) {
+	c := &Check{
+		instName:          "test",
+		log:               testutils.Logger(t, modName),
+		ownNames:          []string{"mx.example.org"},
+		skipAuth:          true,
+		bareIPAction:      modconfig.FailAction{Quarantine: true},
+		unqualifiedAction: modconfig.FailAction{Quarantine: true},
+		ownNameAction:     modconfig.FailAction{Reject: true},
+		invalidAction:     modconfig.FailAction{Reject: true},
+	}
+
+	test := func(ehlo, authUser string, reject, quarantine bool) {
+		t.Helper()
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					Hostname:   ehlo,
+					LocalAddr:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 25},
+					RemoteAddr: &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 12345},
+				},
+				AuthUser: authUser,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckConnection(context.Background())
+		if res.Reject != reject || res.Quarantine != quarantine {
+			t.Fatalf("%s: want reject=%v quarantine=%v, got %+v", ehlo, reject, quarantine, res)
+		}
+		if (reject || quarantine) && exterrors.Fields(res.Reason)["ehlo"] != ehlo {
+			t.Fatalf("%s: no ehlo in reason: %v", ehlo, exterrors.Fields(res.Reason))
+		}
+	}
+
+	test("mail.example.com", "", false, false)
+	test("mail.example.com.", "", false, false)
+	test("[198.51.100.1]", "", false, false)
+	test("[IPv6:2001:db8::1]", "", false, false)
+	test("198.51.100.1", "", false, true)
+	test("DESKTOP-1234", "", false, true)
+	test("DESKTOP-1234", "user", false, false)
+	test("MX.example.org", "", true, false)
+	test("[192.0.2.1]", "", true, false)
+	test("[IPv6:192.0.2.1]", "", true, false)
+	test("[2001:db8::1]", "", true, false)
+	test("mail_server.example.com", "", true, false)
+}
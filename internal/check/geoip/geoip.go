@@ -0,0 +1,269 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package geoip implements the check that applies the configured action to
+// connections from the listed countries.
+//
+// Country of the client IP address is looked up in the MaxMind DB file
+// (GeoIP2-Country, GeoLite2-Country or compatible).
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/mmdb"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.geoip"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	db        *mmdb.DB
+	countries map[string]struct{}
+	trusted   []net.IPNet
+	skipAuth  bool
+
+	failAction    modconfig.FailAction
+	unknownAction modconfig.FailAction
+
+	// Overridden in tests.
+	country func(net.IP) (string, error)
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+// ParseNetworks parses the list of IP addresses and CIDR networks.
+func ParseNetworks(values []string) ([]net.IPNet, error) {
+	nets := make([]net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("malformed IP address: %s", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, *ipNet)
+	}
+	return nets, nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		dbPath         string
+		reloadInterval time.Duration
+		countries      []string
+		trusted        []string
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("db", false, true, "", &dbPath)
+	cfg.Duration("reload_interval", false, false, time.Hour, &reloadInterval)
+	cfg.StringList("countries", false, true, nil, &countries)
+	cfg.StringList("trusted_networks", false, false, []string{"127.0.0.0/8", "::1/128"}, &trusted)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuth)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("unknown_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.unknownAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.countries = make(map[string]struct{}, len(countries))
+	for _, cc := range countries {
+		if len(cc) != 2 {
+			return fmt.Errorf("%s: invalid country code: %s", modName, cc)
+		}
+		c.countries[strings.ToUpper(cc)] = struct{}{}
+	}
+
+	var err error
+	c.trusted, err = ParseNetworks(trusted)
+	if err != nil {
+		return fmt.Errorf("%s: trusted_networks: %w", modName, err)
+	}
+
+	c.db, err = mmdb.Open(dbPath, reloadInterval, c.log)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	c.country = c.db.Country
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	if c.db == nil {
+		return nil
+	}
+	return c.db.Close()
+}
+
+func (c *Check) isTrusted(ip net.IP) bool {
+	for _, n := range c.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, "geoip/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.skipAuth && s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.DebugMsg("non-TCP/IP source, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.isTrusted(tcpAddr.IP) {
+		s.log.DebugMsg("trusted network, skipping", "ip", tcpAddr.IP)
+		return module.CheckResult{}
+	}
+
+	country, err := s.c.country(tcpAddr.IP)
+	if err != nil {
+		// Broken database should not stop all incoming mail.
+		s.log.Error("lookup failed", err, "ip", tcpAddr.IP)
+		return module.CheckResult{}
+	}
+
+	if country == "" {
+		s.log.DebugMsg("unknown country", "ip", tcpAddr.IP)
+		return s.c.unknownAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Client location can't be determined",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"ip": tcpAddr.IP.String(),
+				},
+			},
+		})
+	}
+
+	s.msgMeta.Facts.Set(module.FactGeoCountry, country)
+
+	if _, listed := s.c.countries[country]; !listed {
+		s.log.DebugMsg("country not listed", "ip", tcpAddr.IP, "country", country)
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Messages from your location are not accepted",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"ip":      tcpAddr.IP.String(),
+				"country": country,
+			},
+		},
+	})
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,112 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package geoip
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T) *Check {
+	trusted, err := ParseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Check{
+		instName:   "test",
+		log:        testutils.Logger(t, modName),
+		countries:  map[string]struct{}{"XA": {}},
+		trusted:    trusted,
+		skipAuth:   true,
+		failAction: modconfig.FailAction{Reject: true},
+		country: func(ip net.IP) (string, error) {
+			switch ip.String() {
+			case "198.51.100.1", "192.0.2.1", "10.1.1.1":
+				return "XA", nil
+			case "198.51.100.2":
+				return "XB", nil
+			}
+			return "", nil
+		},
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	c := testCheck(t)
+
+	test := func(ip, authUser string, reject bool, country string) {
+		t.Helper()
+		msgMeta := &module.MsgMetadata{
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+				},
+				AuthUser: authUser,
+			},
+			Facts: module.NewFacts(),
+		}
+		s, err := c.CheckStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckConnection(context.Background())
+		if res.Reject != reject {
+			t.Errorf("%s (auth %q): expected reject=%v, got %v (%v)", ip, authUser, reject, res.Reject, res.Reason)
+		}
+		if got, _ := msgMeta.Facts.String(module.FactGeoCountry); got != country {
+			t.Errorf("%s (auth %q): expected country %q, got %q", ip, authUser, country, got)
+		}
+	}
+
+	test("198.51.100.1", "", true, "XA")
+	test("198.51.100.2", "", false, "XB")
+	test("198.51.100.3", "", false, "")
+	test("198.51.100.1", "foxcpp", false, "")
+	test("192.0.2.1", "", false, "")
+	test("10.1.1.1", "", false, "")
+
+	c.unknownAction = modconfig.FailAction{Reject: true}
+	test("198.51.100.3", "", true, "")
+}
+
+func TestParseNetworks(t *testing.T) {
+	nets, err := ParseNetworks([]string{"192.0.2.1", "2001:db8::/32", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nets) != 3 {
+		t.Fatal("wrong amount of networks:", len(nets))
+	}
+	if !nets[0].Contains(net.ParseIP("192.0.2.1")) || nets[0].Contains(net.ParseIP("192.0.2.2")) {
+		t.Error("single IPv4 address parsed incorrectly:", nets[0])
+	}
+	if !nets[1].Contains(net.ParseIP("2001:db8::1")) {
+		t.Error("IPv6 network parsed incorrectly:", nets[1])
+	}
+
+	if _, err := ParseNetworks([]string{"not-an-ip"}); err == nil {
+		t.Error("no error for malformed address")
+	}
+}
@@ -0,0 +1,349 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.greylist"
+
+// Tuple states as stored in the database. Value format is
+// "state:unix_timestamp".
+//
+// For pending tuples timestamp is the time of the first delivery attempt, for
+// passed ones - the time of the last successful attempt.
+const (
+	statePending = "pending"
+	statePassed  = "passed"
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	db          module.MutableTable
+	delay       time.Duration
+	retryWindow time.Duration
+	expire      time.Duration
+	ipv4Prefix  int
+	ipv6Prefix  int
+	skipAuth    bool
+	failAction  modconfig.FailAction
+
+	stopCleanup chan struct{}
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName:    instName,
+		log:         log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		stopCleanup: make(chan struct{}),
+		now:         time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var cleanupInterval time.Duration
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("db", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var tbl module.MutableTable
+		if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl); err != nil {
+			return nil, err
+		}
+		return tbl, nil
+	}, &c.db)
+	cfg.Duration("delay", false, false, 5*time.Minute, &c.delay)
+	cfg.Duration("retry_window", false, false, 24*time.Hour, &c.retryWindow)
+	cfg.Duration("expire", false, false, 36*24*time.Hour, &c.expire)
+	cfg.Duration("cleanup_interval", false, false, time.Hour, &cleanupInterval)
+	cfg.Int("ipv4_prefix", false, false, 24, &c.ipv4Prefix)
+	cfg.Int("ipv6_prefix", false, false, 64, &c.ipv6Prefix)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuth)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.ipv4Prefix < 0 || c.ipv4Prefix > 32 {
+		return fmt.Errorf("%s: invalid ipv4_prefix value: %d", modName, c.ipv4Prefix)
+	}
+	if c.ipv6Prefix < 0 || c.ipv6Prefix > 128 {
+		return fmt.Errorf("%s: invalid ipv6_prefix value: %d", modName, c.ipv6Prefix)
+	}
+
+	if cleanupInterval != 0 {
+		go c.cleanupLoop(cleanupInterval)
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	close(c.stopCleanup)
+	return nil
+}
+
+func (c *Check) cleanupLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.cleanup()
+		case <-c.stopCleanup:
+			return
+		}
+	}
+}
+
+// cleanup removes expired tuples from the database.
+func (c *Check) cleanup() {
+	keys, err := c.db.Keys()
+	if err != nil {
+		c.log.Error("cleanup: failed to list tuples", err)
+		return
+	}
+
+	removed := 0
+	for _, key := range keys {
+		val, ok, err := c.db.Lookup(context.Background(), key)
+		if err != nil {
+			c.log.Error("cleanup: lookup failed", err, "key", key)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		tupleState, stamp, err := parseValue(val)
+		if err == nil && !c.expired(tupleState, stamp) {
+			continue
+		}
+
+		if err := c.db.RemoveKey(key); err != nil {
+			c.log.Error("cleanup: remove failed", err, "key", key)
+			continue
+		}
+		removed++
+	}
+
+	c.log.DebugMsg("cleanup done", "removed", removed, "total", len(keys))
+}
+
+func (c *Check) expired(state string, stamp time.Time) bool {
+	switch state {
+	case statePending:
+		return c.now().Sub(stamp) > c.delay+c.retryWindow
+	case statePassed:
+		return c.now().Sub(stamp) > c.expire
+	}
+	return true
+}
+
+func parseValue(val string) (string, time.Time, error) {
+	parts := strings.SplitN(val, ":", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, fmt.Errorf("malformed value: %s", val)
+	}
+	stamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("malformed value: %s", val)
+	}
+	return parts[0], time.Unix(stamp, 0), nil
+}
+
+func formatValue(state string, stamp time.Time) string {
+	return state + ":" + strconv.FormatInt(stamp.Unix(), 10)
+}
+
+// tupleKey returns the database key for the (client network, sender,
+// recipient) tuple.
+//
+// Client IP is truncated to the configured prefix since large senders often
+// retry from different addresses of the same network.
+func (c *Check) tupleKey(ip net.IP, mailFrom, rcptTo string) string {
+	var ipNet net.IPNet
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ipNet.IP = ipv4
+		ipNet.Mask = net.CIDRMask(c.ipv4Prefix, 32)
+	} else {
+		ipNet.IP = ip
+		ipNet.Mask = net.CIDRMask(c.ipv6Prefix, 128)
+	}
+	ipNet.IP = ipNet.IP.Mask(ipNet.Mask)
+
+	if mailFrom == "" {
+		mailFrom = "<>"
+	}
+
+	return ipNet.String() + " " + strings.ToLower(mailFrom) + " " + strings.ToLower(rcptTo)
+}
+
+// checkTuple updates the tuple state in the database and returns true if the
+// delivery should be allowed.
+func (c *Check) checkTuple(ctx context.Context, key string) (bool, error) {
+	now := c.now()
+
+	val, ok, err := c.db.Lookup(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, c.db.SetKey(key, formatValue(statePending, now))
+	}
+
+	tupleState, stamp, err := parseValue(val)
+	if err != nil || c.expired(tupleState, stamp) {
+		// Start over.
+		return false, c.db.SetKey(key, formatValue(statePending, now))
+	}
+
+	switch tupleState {
+	case statePending:
+		if now.Sub(stamp) < c.delay {
+			// Retried too early.
+			return false, nil
+		}
+		return true, c.db.SetKey(key, formatValue(statePassed, now))
+	case statePassed:
+		return true, c.db.SetKey(key, formatValue(statePassed, now))
+	}
+
+	// Not reached, unknown states are handled by c.expired.
+	return false, nil
+}
+
+type state struct {
+	c        *Check
+	msgMeta  *module.MsgMetadata
+	log      log.Logger
+	mailFrom string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	s.mailFrom = addr
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, "greylist/CheckRcpt").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.skipAuth && s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.DebugMsg("non-TCP/IP source, skipping")
+		return module.CheckResult{}
+	}
+
+	key := s.c.tupleKey(tcpAddr.IP, s.mailFrom, addr)
+	allowed, err := s.c.checkTuple(ctx, key)
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    "greylist",
+				Err:          err,
+			},
+		}
+	}
+	if allowed {
+		s.log.DebugMsg("tuple passed", "key", key)
+		return module.CheckResult{}
+	}
+
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Greylisted, please try again later",
+			CheckName:    "greylist",
+			Misc: map[string]interface{}{
+				"rcpt": addr,
+			},
+		},
+	})
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
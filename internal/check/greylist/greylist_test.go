@@ -0,0 +1,123 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package greylist
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type memTable map[string]string
+
+func (m memTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	val, ok := m[key]
+	return val, ok, nil
+}
+
+func (m memTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m memTable) RemoveKey(k string) error {
+	delete(m, k)
+	return nil
+}
+
+func (m memTable) SetKey(k, v string) error {
+	m[k] = v
+	return nil
+}
+
+func TestGreylist(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	db := memTable{}
+	c := &Check{
+		log:         testutils.Logger(t, modName),
+		db:          db,
+		delay:       5 * time.Minute,
+		retryWindow: time.Hour,
+		expire:      24 * time.Hour,
+		ipv4Prefix:  24,
+		ipv6Prefix:  64,
+		failAction:  modconfig.FailAction{Reject: true},
+		now:         func() time.Time { return now },
+	}
+
+	try := func(ip net.IP, from, to string, shouldPass bool) {
+		t.Helper()
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: ip, Port: 25},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.CheckSender(context.Background(), from)
+		res := st.CheckRcpt(context.Background(), to)
+		if shouldPass && res.Reason != nil {
+			t.Errorf("expected %v %s %s to pass, got %v", ip, from, to, res.Reason)
+		}
+		if !shouldPass && (res.Reason == nil || !res.Reject) {
+			t.Errorf("expected %v %s %s to be rejected", ip, from, to)
+		}
+	}
+
+	ip := net.IPv4(192, 0, 2, 1)
+	try(ip, "a@example.org", "b@example.com", false)
+
+	// Retried too early.
+	now = now.Add(time.Minute)
+	try(ip, "a@example.org", "b@example.com", false)
+
+	// Retried from another IP of the same network after the delay.
+	now = now.Add(5 * time.Minute)
+	try(net.IPv4(192, 0, 2, 200), "A@example.org", "b@example.com", true)
+
+	// Other tuples are still greylisted.
+	try(ip, "a@example.org", "c@example.com", false)
+	try(net.IPv4(198, 51, 100, 1), "a@example.org", "b@example.com", false)
+
+	// Passed tuple is remembered.
+	now = now.Add(12 * time.Hour)
+	try(ip, "a@example.org", "b@example.com", true)
+
+	// ... until it expires.
+	now = now.Add(25 * time.Hour)
+	try(ip, "a@example.org", "b@example.com", false)
+
+	// Only expired tuples are removed.
+	c.cleanup()
+	if len(db) != 1 {
+		t.Errorf("expected 1 tuple left after cleanup, got %v", db)
+	}
+}
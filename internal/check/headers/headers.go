@@ -0,0 +1,252 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package headers implements the check that validates minimal RFC 5322
+// compliance of the message header.
+//
+// Presence of the required fields (From, Date and Message-ID by default) is
+// checked along with syntax of From, Date and Message-ID values. Fields that
+// RFC 5322 allows to appear only once and From fields with multiple addresses
+// are reported separately since they are commonly used to confuse MUAs and
+// the DMARC implementations.
+package headers
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	nettextproto "net/textproto"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.headers"
+
+// singleFields are fields that can appear at most once, as specified by
+// RFC 5322 Section 3.6.
+var singleFields = []string{
+	"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc",
+	"Message-Id", "In-Reply-To", "References", "Subject",
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	requiredFields  []string
+	missingAction   modconfig.FailAction
+	malformedAction modconfig.FailAction
+	duplicateAction modconfig.FailAction
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var requiredFields []string
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.StringList("required_fields", false, false, []string{"From", "Date", "Message-ID"}, &requiredFields)
+	cfg.Custom("missing_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.missingAction)
+	cfg.Custom("malformed_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.malformedAction)
+	cfg.Custom("duplicate_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.duplicateAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	c.requiredFields = make([]string, 0, len(requiredFields))
+	for _, field := range requiredFields {
+		c.requiredFields = append(c.requiredFields, nettextproto.CanonicalMIMEHeaderKey(field))
+	}
+	return nil
+}
+
+// validMsgID checks the msg-id syntax (RFC 5322 Section 3.6.4).
+//
+// Obsolete forms and quoted local parts are not accepted, they are not used
+// by any real MUA.
+func validMsgID(val string) bool {
+	val = strings.TrimSpace(val)
+	if len(val) < 5 || val[0] != '<' || val[len(val)-1] != '>' {
+		return false
+	}
+	val = val[1 : len(val)-1]
+
+	at := strings.IndexByte(val, '@')
+	if at <= 0 || at == len(val)-1 {
+		return false
+	}
+	return !strings.ContainsAny(val, " \t<>\"") && !strings.Contains(val[at+1:], "@")
+}
+
+type problem struct {
+	action modconfig.FailAction
+	reason *exterrors.SMTPError
+}
+
+// headerProblems returns all problems found in the header in the order of
+// importance: duplicate fields, multiple From addresses, malformed
+// fields, missing fields.
+func (c *Check) headerProblems(header textproto.Header) []problem {
+	var problems []problem
+	report := func(action modconfig.FailAction, msg, field string) {
+		problems = append(problems, problem{
+			action: action,
+			reason: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+				Message:      msg,
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"field": field,
+				},
+			},
+		})
+	}
+
+	for _, field := range singleFields {
+		if len(header.Values(field)) > 1 {
+			report(c.duplicateAction, "Duplicate header field", field)
+		}
+	}
+
+	if from := header.Get("From"); from != "" {
+		addrs, err := mail.ParseAddressList(from)
+		switch {
+		case err != nil:
+			report(c.malformedAction, "Malformed From field", "From")
+		case len(addrs) > 1:
+			report(c.duplicateAction, "Multiple addresses in From field", "From")
+		}
+	}
+	if date := header.Get("Date"); date != "" {
+		if _, err := mail.ParseDate(date); err != nil {
+			report(c.malformedAction, "Malformed Date field", "Date")
+		}
+	}
+	if header.Has("Message-Id") && !validMsgID(header.Get("Message-Id")) {
+		report(c.malformedAction, "Malformed Message-ID field", "Message-ID")
+	}
+
+	for _, field := range c.requiredFields {
+		if strings.TrimSpace(header.Get(field)) == "" {
+			report(c.missingAction, "Missing required header field", field)
+		}
+	}
+
+	return problems
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "headers/CheckBody").End()
+
+	// Results for all problems are merged. The reason of the most severe one
+	// is reported to the client.
+	var res module.CheckResult
+	for _, p := range s.c.headerProblems(header) {
+		pRes := p.action.Apply(module.CheckResult{Reason: p.reason})
+		if !pRes.Reject && !pRes.Quarantine && pRes.Score == 0 && len(pRes.Redirect) == 0 && !pRes.Annotate && pRes.Delay == 0 {
+			s.log.DebugMsg(p.reason.Message, "field", p.reason.Misc["field"])
+			continue
+		}
+		s.log.Msg(p.reason.Message, "field", p.reason.Misc["field"])
+
+		if res.Reason == nil || (pRes.Reject && !res.Reject) {
+			res.Reason = pRes.Reason
+		}
+		res.Reject = res.Reject || pRes.Reject
+		res.Quarantine = res.Quarantine || pRes.Quarantine
+		res.Score += pRes.Score
+		if res.Redirect == nil {
+			res.Redirect = pRes.Redirect
+		}
+		res.Annotate = res.Annotate || pRes.Annotate
+		res.AnnotateWeight += pRes.AnnotateWeight
+		if pRes.Delay > res.Delay {
+			res.Delay = pRes.Delay
+		}
+	}
+	return res
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
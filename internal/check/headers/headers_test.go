@@ -0,0 +1,104 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package headers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestValidMsgID(t *testing.T) {
+	for val, valid := range map[string]bool{
+		"<abc@example.org>":    true,
+		" <a.b-c@[127.0.0.1]>": true,
+		"abc@example.org":      false,
+		"<abc>":                false,
+		"<@example.org>":       false,
+		"<abc@>":               false,
+		"<a b@example.org>":    false,
+		"<a@b@example.org>":    false,
+		"<>":                   false,
+	} {
+		if validMsgID(val) != valid {
+			t.Errorf("%q: want %v", val, valid)
+		}
+	}
+}
+
+func TestCheckBody(t *testing.T) {
+	c := &Check{
+		instName:        "test",
+		log:             testutils.Logger(t, modName),
+		requiredFields:  []string{"From", "Date", "Message-Id"},
+		missingAction:   modconfig.FailAction{Quarantine: true},
+		malformedAction: modconfig.FailAction{Quarantine: true},
+		duplicateAction: modconfig.FailAction{Reject: true},
+	}
+
+	test := func(fields [][2]string, reject, quarantine bool, field string) {
+		t.Helper()
+
+		hdr := textproto.Header{}
+		for _, f := range fields {
+			hdr.Add(f[0], f[1])
+		}
+
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckBody(context.Background(), hdr, nil)
+		if res.Reject != reject || res.Quarantine != quarantine {
+			t.Fatalf("want reject=%v quarantine=%v, got %+v", reject, quarantine, res)
+		}
+		if field == "" {
+			if res.Reason != nil {
+				t.Fatal("unexpected reason:", res.Reason)
+			}
+			return
+		}
+		if got := exterrors.Fields(res.Reason)["field"]; got != field {
+			t.Fatalf("want field %s in reason, got %v", field, got)
+		}
+	}
+
+	valid := [][2]string{
+		{"From", "Foo <foo@example.org>"},
+		{"Date", "Mon, 02 Jan 2006 15:04:05 -0700"},
+		{"Message-Id", "<1234@example.org>"},
+	}
+	test(valid, false, false, "")
+
+	test(valid[1:], false, true, "From")
+	test(append([][2]string{{"From", "not an address"}}, valid[1:]...), false, true, "From")
+	test(append([][2]string{{"Date", "yesterday"}}, valid[0], valid[2]), false, true, "Date")
+	test(append([][2]string{{"Message-Id", "1234"}}, valid[:2]...), false, true, "Message-ID")
+	test(append([][2]string{{"From", "a@example.org, b@example.org"}}, valid[1:]...), true, false, "From")
+	test(append([][2]string{{"Subject", "a"}, {"Subject", "b"}}, valid...), true, false, "Subject")
+
+	// Results for all problems are merged.
+	test(append([][2]string{{"Date", "yesterday"}, {"To", "a@example.org"}, {"To", "b@example.org"}}, valid[0], valid[2]),
+		true, true, "To")
+}
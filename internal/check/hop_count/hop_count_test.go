@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package hop_count
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCheckBody(t *testing.T) {
+	c := &Check{
+		instName:   "test",
+		log:        testutils.Logger(t, modName),
+		maxHops:    3,
+		failAction: modconfig.FailAction{Reject: true},
+	}
+
+	test := func(hops int, reject bool) {
+		t.Helper()
+		hdr := textproto.Header{}
+		for i := 0; i < hops; i++ {
+			hdr.Add("Received", "from a.example.org by b.example.org")
+		}
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckBody(context.Background(), hdr, nil)
+		if res.Reject != reject {
+			t.Fatalf("%d hops: want reject=%v, got %+v", hops, reject, res)
+		}
+		if reject && exterrors.Fields(res.Reason)["smtp_code"] != 554 {
+			t.Fatal("wrong error code:", res.Reason)
+		}
+	}
+
+	test(0, false)
+	test(3, false)
+	test(4, true)
+}
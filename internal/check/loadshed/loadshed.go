@@ -0,0 +1,345 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package loadshed implements the check that defers unauthenticated
+// messages when the server is overloaded.
+//
+// System load, queue length and storage latency are sampled periodically.
+// Shedding starts when any of the values exceeds its high threshold and stops
+// only when all of them are below their low thresholds.
+package loadshed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/queue"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+const modName = "check.load_shedding"
+
+// Pinger is implemented by storage modules that can report the database
+// latency.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+type signal struct {
+	name      string
+	high, low float64
+	sample    func() (float64, error)
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	interval time.Duration
+	signals  []signal
+
+	active int32
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+// thresholds parses "high [low]" arguments. Low defaults to 80% of high.
+func thresholds(node config.Node, parse func(string) (float64, error)) (high, low float64, err error) {
+	if len(node.Args) != 1 && len(node.Args) != 2 {
+		return 0, 0, config.NodeErr(node, "expected 1 or 2 arguments")
+	}
+	high, err = parse(node.Args[0])
+	if err != nil {
+		return 0, 0, config.NodeErr(node, "%v", err)
+	}
+	low = high * 0.8
+	if len(node.Args) == 2 {
+		low, err = parse(node.Args[1])
+		if err != nil {
+			return 0, 0, config.NodeErr(node, "%v", err)
+		}
+	}
+	if low > high {
+		return 0, 0, config.NodeErr(node, "low threshold should not be bigger than high")
+	}
+	return high, low, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseDurationSecs(s string) (float64, error) {
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return dur.Seconds(), nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var (
+		queues  []*queue.Queue
+		storage Pinger
+	)
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Duration("interval", false, false, 5*time.Second, &c.interval)
+	cfg.Callback("queue", func(m *config.Map, node config.Node) error {
+		var tgt module.DeliveryTarget
+		if err := modconfig.ModuleFromNode("target", node.Args, node, m.Globals, &tgt); err != nil {
+			return err
+		}
+		q, ok := tgt.(*queue.Queue)
+		if !ok {
+			return config.NodeErr(node, "module is not a queue")
+		}
+		queues = append(queues, q)
+		return nil
+	})
+	cfg.Custom("storage", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var store module.Storage
+		if err := modconfig.ModuleFromNode("storage", node.Args, node, m.Globals, &store); err != nil {
+			return nil, err
+		}
+		pinger, ok := store.(Pinger)
+		if !ok {
+			return nil, config.NodeErr(node, "storage does not support latency measurement")
+		}
+		return pinger, nil
+	}, &storage)
+	cfg.Callback("max_load", func(_ *config.Map, node config.Node) error {
+		high, low, err := thresholds(node, parseFloat)
+		if err != nil {
+			return err
+		}
+		c.signals = append(c.signals, signal{name: "load", high: high, low: low, sample: loadAvg})
+		return nil
+	})
+	cfg.Callback("max_queue", func(_ *config.Map, node config.Node) error {
+		high, low, err := thresholds(node, parseFloat)
+		if err != nil {
+			return err
+		}
+		c.signals = append(c.signals, signal{name: "queue", high: high, low: low, sample: func() (float64, error) {
+			total := 0
+			for _, q := range queues {
+				total += q.Len()
+			}
+			return float64(total), nil
+		}})
+		return nil
+	})
+	cfg.Callback("max_db_latency", func(_ *config.Map, node config.Node) error {
+		high, low, err := thresholds(node, parseDurationSecs)
+		if err != nil {
+			return err
+		}
+		c.signals = append(c.signals, signal{name: "db_latency", high: high, low: low, sample: func() (float64, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+			defer cancel()
+
+			start := time.Now()
+			if err := storage.Ping(ctx); err != nil {
+				return 0, err
+			}
+			return time.Since(start).Seconds(), nil
+		}})
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	for _, s := range c.signals {
+		switch {
+		case s.name == "queue" && len(queues) == 0:
+			return fmt.Errorf("%s: max_queue requires queue directive", modName)
+		case s.name == "db_latency" && storage == nil:
+			return fmt.Errorf("%s: max_db_latency requires storage directive", modName)
+		}
+	}
+	if len(c.signals) == 0 {
+		return fmt.Errorf("%s: at least one threshold should be configured", modName)
+	}
+
+	shedActive.WithLabelValues(c.instName).Set(0)
+	go c.monitor()
+
+	return nil
+}
+
+func loadAvg() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, errors.New("malformed /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+func (c *Check) monitor() {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.update()
+
+		select {
+		case <-ticker.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// update samples all signals and changes the shedding state.
+func (c *Check) update() {
+	active := atomic.LoadInt32(&c.active) == 1
+
+	anyHigh, allLow := false, true
+	var reason string
+	for _, s := range c.signals {
+		val, err := s.sample()
+		if err != nil {
+			c.log.Error("failed to sample", err, "signal", s.name)
+			continue
+		}
+		shedSignal.WithLabelValues(c.instName, s.name).Set(val)
+
+		if val > s.high && !anyHigh {
+			anyHigh = true
+			reason = fmt.Sprintf("%s is %v (threshold %v)", s.name, val, s.high)
+		}
+		if val > s.low {
+			allLow = false
+		}
+	}
+
+	switch {
+	case !active && anyHigh:
+		atomic.StoreInt32(&c.active, 1)
+		shedActive.WithLabelValues(c.instName).Set(1)
+		c.log.Msg("load shedding started", "reason", reason)
+	case active && allLow:
+		atomic.StoreInt32(&c.active, 0)
+		shedActive.WithLabelValues(c.instName).Set(0)
+		c.log.Msg("load shedding stopped")
+	}
+}
+
+func (c *Check) Close() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.stopped
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	if atomic.LoadInt32(&s.c.active) == 0 {
+		return module.CheckResult{}
+	}
+	if s.msgMeta.Conn != nil && s.msgMeta.Conn.AuthUser != "" {
+		return module.CheckResult{}
+	}
+
+	shedDeferred.WithLabelValues(s.c.instName).Inc()
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         421,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
+			Message:      "Server is busy, try again later",
+			CheckName:    modName,
+		},
+	}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,89 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package loadshed
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, val *float64) *Check {
+	return &Check{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		signals: []signal{
+			{name: "test", high: 10, low: 5, sample: func() (float64, error) {
+				return *val, nil
+			}},
+		},
+	}
+}
+
+func checkConn(t *testing.T, c *Check, authUser string) bool {
+	t.Helper()
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+		Conn: &module.ConnState{AuthUser: authUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := s.CheckConnection(context.Background())
+	return res.Reject
+}
+
+func TestHysteresis(t *testing.T) {
+	val := 1.0
+	c := testCheck(t, &val)
+
+	for _, step := range []struct {
+		val      float64
+		shedding bool
+	}{
+		{1, false},
+		{8, false},
+		{11, true},
+		{8, true},
+		{5, false},
+		{8, false},
+		{10.5, true},
+		{2, false},
+	} {
+		val = step.val
+		c.update()
+		if checkConn(t, c, "") != step.shedding {
+			t.Fatalf("value %v: shedding should be %v", step.val, step.shedding)
+		}
+	}
+}
+
+func TestAuthenticatedExempt(t *testing.T) {
+	val := 100.0
+	c := testCheck(t, &val)
+	c.update()
+
+	if !checkConn(t, c, "") {
+		t.Fatal("unauthenticated connection is not deferred")
+	}
+	if checkConn(t, c, "foxcpp") {
+		t.Fatal("authenticated connection is deferred")
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package loadshed
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	shedActive = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "load_shedding",
+			Name:      "active",
+			Help:      "Whether the load shedding is active (1) or not (0)",
+		},
+		[]string{"module"},
+	)
+	shedSignal = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "maddy",
+			Subsystem: "load_shedding",
+			Name:      "signal",
+			Help:      "Last sampled value of the load signal",
+		},
+		[]string{"module", "signal"},
+	)
+	shedDeferred = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "load_shedding",
+			Name:      "deferred",
+			Help:      "Amount of messages deferred due to load shedding",
+		},
+		[]string{"module"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(shedActive)
+	prometheus.MustRegister(shedSignal)
+	prometheus.MustRegister(shedDeferred)
+}
@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rspamd
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"sort"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// The check module also implements module.Modifier to apply header
+// modifications requested by rspamd. The same module instance should be
+// referenced in both check and modify blocks so modifier can see the
+// results of the check.
+
+type modState struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+}
+
+func (c *Check) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return modState{c: c, msgMeta: msgMeta}, nil
+}
+
+func (m modState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (m modState) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func (m modState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	resp := m.c.takePending(m.msgMeta.ID)
+	if resp == nil {
+		return nil
+	}
+	applyModifications(h, resp)
+	return nil
+}
+
+func (m modState) Close() error {
+	return nil
+}
+
+func applyModifications(h *textproto.Header, resp *response) {
+	removeNames := make([]string, 0, len(resp.Milter.RemoveHeaders))
+	for name := range resp.Milter.RemoveHeaders {
+		removeNames = append(removeNames, name)
+	}
+	sort.Strings(removeNames)
+	for _, name := range removeNames {
+		// 0 means all occurrences, positive value is an index of occurrence
+		// (starting from 1), negative value is an index from the end.
+		var idx int
+		if err := json.Unmarshal(resp.Milter.RemoveHeaders[name], &idx); err != nil {
+			idx = 0
+		}
+		removeField(h, name, idx)
+	}
+
+	addNames := make([]string, 0, len(resp.Milter.AddHeaders))
+	for name := range resp.Milter.AddHeaders {
+		addNames = append(addNames, name)
+	}
+	sort.Strings(addNames)
+	for _, name := range addNames {
+		for _, val := range resp.Milter.AddHeaders[name] {
+			h.Add(name, val)
+		}
+	}
+
+	if resp.Action == "rewrite subject" && resp.Subject != "" {
+		h.Set("Subject", mime.QEncoding.Encode("utf-8", resp.Subject))
+	}
+}
+
+func removeField(h *textproto.Header, name string, idx int) {
+	if idx == 0 {
+		h.Del(name)
+		return
+	}
+
+	count := 0
+	for fields := h.FieldsByKey(name); fields.Next(); {
+		count++
+	}
+	if idx < 0 {
+		idx = count + idx + 1
+	}
+	if idx <= 0 || idx > count {
+		return
+	}
+
+	i := 0
+	for fields := h.FieldsByKey(name); fields.Next(); {
+		i++
+		if i == idx {
+			fields.Del()
+			return
+		}
+	}
+}
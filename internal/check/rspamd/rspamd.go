@@ -29,6 +29,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
@@ -38,6 +40,7 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check/scancache"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -55,10 +58,19 @@ type Check struct {
 
 	ioErrAction       modconfig.FailAction
 	errorRespAction   modconfig.FailAction
+	greylistAction    modconfig.FailAction
 	addHdrAction      modconfig.FailAction
 	rewriteSubjAction modconfig.FailAction
+	softRejectAction  modconfig.FailAction
+	rejectAction      modconfig.FailAction
 
 	client *http.Client
+	cache  *scancache.Cache
+
+	// Responses saved by CheckBody for use by the modifier, keyed by
+	// message ID.
+	pending     map[string]*response
+	pendingLock sync.Mutex
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -66,6 +78,7 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 		instName: instName,
 		client:   http.DefaultClient,
 		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		pending:  make(map[string]*response),
 	}
 
 	switch len(inlineArgs) {
@@ -92,6 +105,7 @@ func (c *Check) Init(cfg *config.Map) error {
 	var (
 		tlsConfig tls.Config
 		flags     []string
+		cacheTTL  time.Duration
 	)
 
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
@@ -109,6 +123,10 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
 		}, modconfig.FailActionDirective, &c.errorRespAction)
+	cfg.Custom("greylist_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.greylistAction)
 	cfg.Custom("add_header_action", false, false,
 		func() (interface{}, error) {
 			return modconfig.FailAction{Quarantine: true}, nil
@@ -117,10 +135,22 @@ func (c *Check) Init(cfg *config.Map) error {
 		func() (interface{}, error) {
 			return modconfig.FailAction{Quarantine: true}, nil
 		}, modconfig.FailActionDirective, &c.rewriteSubjAction)
+	cfg.Custom("soft_reject_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.softRejectAction)
+	cfg.Custom("reject_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.rejectAction)
 	cfg.StringList("flags", false, false, []string{"pass_all"}, &flags)
+	cfg.Duration("cache_ttl", false, false, 0, &cacheTTL)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	if cacheTTL != 0 {
+		c.cache = scancache.New(cacheTTL)
+	}
 
 	c.client = &http.Client{
 		Transport: &http.Transport{
@@ -132,6 +162,20 @@ func (c *Check) Init(cfg *config.Map) error {
 	return nil
 }
 
+func (c *Check) setPending(msgID string, resp *response) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	c.pending[msgID] = resp
+}
+
+func (c *Check) takePending(msgID string) *response {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+	resp := c.pending[msgID]
+	delete(c.pending, msgID)
+	return resp
+}
+
 type state struct {
 	c       *Check
 	msgMeta *module.MsgMetadata
@@ -203,6 +247,24 @@ func addConnHeaders(r *http.Request, meta *module.MsgMetadata, mailFrom string,
 }
 
 func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	var cacheKey string
+	if s.c.cache != nil {
+		var err error
+		cacheKey, err = scancache.BodyKey(body)
+		if err != nil {
+			return module.CheckResult{
+				Reject: true,
+				Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+			}
+		}
+		if cached, ok := s.c.cache.Get(cacheKey); ok {
+			s.log.DebugMsg("using cached scan result")
+			respData := cached.(*response)
+			s.c.setPending(s.msgMeta.ID, respData)
+			return s.applyResponse(respData)
+		}
+	}
+
 	bodyR, err := body.Open()
 	if err != nil {
 		return module.CheckResult{
@@ -281,71 +343,110 @@ func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer
 		})
 	}
 
+	if cacheKey != "" {
+		s.c.cache.Put(cacheKey, &respData)
+	}
+	s.c.setPending(s.msgMeta.ID, &respData)
+
+	return s.applyResponse(&respData)
+}
+
+// applyResponse converts the rspamd response to the check result.
+func (s *state) applyResponse(respData *response) module.CheckResult {
+	hdrAdd := textproto.Header{}
+	hdrAdd.Add("X-Spam-Score", strconv.FormatFloat(respData.Score, 'f', 2, 64))
+
+	var (
+		action modconfig.FailAction
+		reason *exterrors.SMTPError
+	)
 	switch respData.Action {
 	case "no action":
 		return module.CheckResult{}
 	case "greylist":
-		// uuh... TODO: Implement greylisting?
-		hdrAdd := textproto.Header{}
-		hdrAdd.Add("X-Spam-Score", strconv.FormatFloat(respData.Score, 'f', 2, 64))
-		return module.CheckResult{
-			Header: hdrAdd,
+		action = s.c.greylistAction
+		reason = &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Greylisted, try again later",
+			CheckName:    modName,
 		}
 	case "add header":
-		hdrAdd := textproto.Header{}
 		hdrAdd.Add("X-Spam-Flag", "Yes")
-		hdrAdd.Add("X-Spam-Score", strconv.FormatFloat(respData.Score, 'f', 2, 64))
-		return s.c.addHdrAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         450,
-				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
-				Message:      "Message rejected due to local policy",
-				CheckName:    modName,
-				Misc:         map[string]interface{}{"action": "add header"},
-			},
-			Header: hdrAdd,
-		})
+		action = s.c.addHdrAction
+		reason = &exterrors.SMTPError{
+			Code:         450,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
+		}
 	case "rewrite subject":
-		hdrAdd := textproto.Header{}
 		hdrAdd.Add("X-Spam-Flag", "Yes")
-		hdrAdd.Add("X-Spam-Score", strconv.FormatFloat(respData.Score, 'f', 2, 64))
-		return s.c.rewriteSubjAction.Apply(module.CheckResult{
-			Reason: &exterrors.SMTPError{
-				Code:         450,
-				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
-				Message:      "Message rejected due to local policy",
-				CheckName:    modName,
-				Misc:         map[string]interface{}{"action": "rewrite subject"},
-			},
-			Header: hdrAdd,
-		})
+		action = s.c.rewriteSubjAction
+		reason = &exterrors.SMTPError{
+			Code:         450,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
+		}
 	case "soft reject":
-		return module.CheckResult{
-			Reject: true,
-			Reason: &exterrors.SMTPError{
-				Code:         450,
-				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
-				Message:      "Message rejected due to local policy",
-				CheckName:    modName,
-				Misc:         map[string]interface{}{"action": "soft reject"},
-			},
+		hdrAdd = textproto.Header{}
+		action = s.c.softRejectAction
+		reason = &exterrors.SMTPError{
+			Code:         450,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
 		}
 	case "reject":
-		return module.CheckResult{
-			Reject: true,
-			Reason: &exterrors.SMTPError{
-				Code:         550,
-				EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
-				Message:      "Message rejected due to local policy",
-				CheckName:    modName,
-				Misc:         map[string]interface{}{"action": "reject"},
-			},
+		hdrAdd = textproto.Header{}
+		action = s.c.rejectAction
+		reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 0},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
 		}
+	default:
+		s.log.Msg("unhandled action", "action", respData.Action)
+		return module.CheckResult{}
 	}
 
-	s.log.Msg("unhandled action", "action", respData.Action)
+	reason.Misc = map[string]interface{}{"action": respData.Action}
+	return action.Apply(module.CheckResult{
+		Reason: reason,
+		Header: hdrAdd,
+	})
+}
 
-	return module.CheckResult{}
+// headerValues decodes value of the add_headers object in the milter
+// section of the rspamd response. Value can be either a string, an object
+// with the value field or an array of such objects.
+type headerValues []string
+
+func (v *headerValues) UnmarshalJSON(b []byte) error {
+	type valueObj struct {
+		Value string `json:"value"`
+	}
+
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*v = []string{str}
+		return nil
+	}
+	var obj valueObj
+	if err := json.Unmarshal(b, &obj); err == nil {
+		*v = []string{obj.Value}
+		return nil
+	}
+	var list []valueObj
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	for _, obj := range list {
+		*v = append(*v, obj.Value)
+	}
+	return nil
 }
 
 type response struct {
@@ -356,9 +457,14 @@ type response struct {
 		Name  string  `json:"name"`
 		Score float64 `json:"score"`
 	}
+	Milter struct {
+		AddHeaders    map[string]headerValues    `json:"add_headers"`
+		RemoveHeaders map[string]json.RawMessage `json:"remove_headers"`
+	} `json:"milter"`
 }
 
 func (s *state) Close() error {
+	s.c.takePending(s.msgMeta.ID)
 	return nil
 }
 
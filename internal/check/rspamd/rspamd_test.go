@@ -0,0 +1,164 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rspamd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testCheck(t *testing.T, resp string) *Check {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &Check{
+		log:               testutils.Logger(t, modName),
+		apiPath:           srv.URL,
+		client:            srv.Client(),
+		greylistAction:    modconfig.FailAction{Reject: true},
+		addHdrAction:      modconfig.FailAction{},
+		rewriteSubjAction: modconfig.FailAction{Quarantine: true},
+		softRejectAction:  modconfig.FailAction{Reject: true},
+		rejectAction:      modconfig.FailAction{Quarantine: true},
+		pending:           make(map[string]*response),
+	}
+}
+
+func runCheck(t *testing.T, c *Check, hdr textproto.Header) (module.CheckResult, textproto.Header) {
+	t.Helper()
+
+	meta := &module.MsgMetadata{ID: "test"}
+	st, err := c.CheckStateForMsg(context.Background(), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	mod, err := c.ModStateForMsg(context.Background(), meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+
+	body := buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")}
+	res := st.CheckBody(context.Background(), hdr, body)
+	hdr = hdr.Copy()
+	if err := mod.RewriteBody(context.Background(), &hdr, body); err != nil {
+		t.Fatal(err)
+	}
+	return res, hdr
+}
+
+func TestActions(t *testing.T) {
+	for _, c := range []struct {
+		action     string
+		reject     bool
+		quarantine bool
+		code       int
+	}{
+		{action: "no action"},
+		{action: "greylist", reject: true, code: 451},
+		{action: "add header"},
+		{action: "rewrite subject", quarantine: true},
+		{action: "soft reject", reject: true, code: 450},
+		{action: "reject", quarantine: true},
+	} {
+		c := c
+		t.Run(c.action, func(t *testing.T) {
+			check := testCheck(t, `{"score": 10, "action": "`+c.action+`"}`)
+			res, _ := runCheck(t, check, textproto.Header{})
+			if res.Reject != c.reject || res.Quarantine != c.quarantine {
+				t.Errorf("wrong result: %+v", res)
+			}
+			if c.code != 0 {
+				if code := res.Reason.(interface{ Fields() map[string]interface{} }).Fields()["smtp_code"]; code != c.code {
+					t.Errorf("wrong SMTP code: %v", code)
+				}
+			}
+		})
+	}
+}
+
+func TestModifications(t *testing.T) {
+	check := testCheck(t, `{
+		"score": 7.5,
+		"action": "rewrite subject",
+		"subject": "*** SPAM *** Hello",
+		"milter": {
+			"add_headers": {
+				"X-Spamd-Result": {"value": "default: False [7.50 / 15.00]", "order": 0},
+				"X-Rspamd-Server": "rspamd.example.org",
+				"X-Multi": [{"value": "1"}, {"value": "2"}]
+			},
+			"remove_headers": {"X-Spam": 0, "X-Old": 1}
+		}
+	}`)
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Hello")
+	hdr.Add("X-Spam", "yes")
+	hdr.Add("X-Spam", "yes")
+	hdr.Add("X-Old", "2")
+	hdr.Add("X-Old", "1")
+
+	res, hdr := runCheck(t, check, hdr)
+	if res.Header.Get("X-Spam-Flag") != "Yes" || res.Header.Get("X-Spam-Score") != "7.50" {
+		t.Errorf("wrong check header: %v", res.Header)
+	}
+
+	if subj := hdr.Get("Subject"); subj != "*** SPAM *** Hello" {
+		t.Errorf("Subject is not rewritten: %v", subj)
+	}
+	if hdr.Has("X-Spam") {
+		t.Errorf("X-Spam is not removed")
+	}
+	if vals := hdr.Values("X-Old"); len(vals) != 1 || vals[0] != "2" {
+		t.Errorf("wrong X-Old removed: %v", vals)
+	}
+	if val := hdr.Get("X-Spamd-Result"); val != "default: False [7.50 / 15.00]" {
+		t.Errorf("wrong X-Spamd-Result: %v", val)
+	}
+	if val := hdr.Get("X-Rspamd-Server"); val != "rspamd.example.org" {
+		t.Errorf("wrong X-Rspamd-Server: %v", val)
+	}
+	if vals := hdr.Values("X-Multi"); len(vals) != 2 {
+		t.Errorf("wrong X-Multi: %v", vals)
+	}
+
+	if len(check.pending) != 0 {
+		t.Errorf("pending response is not removed")
+	}
+}
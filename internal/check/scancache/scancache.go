@@ -0,0 +1,132 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package scancache implements the short-lived cache for results of
+// expensive content scans (antivirus, spam filters) keyed by the message body
+// hash.
+//
+// The same message is often delivered in multiple transactions (e.g. a
+// newsletter sent to many local users), the cache allows to scan it once.
+package scancache
+
+import (
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/internal/arc"
+)
+
+// MaxEntries is the maximum amount of results kept by the Cache.
+const MaxEntries = 4096
+
+type entry struct {
+	val     interface{}
+	expires time.Time
+}
+
+// Cache stores scan results for the limited time. Nil *Cache is valid and
+// does not store anything.
+type Cache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	entries map[string]entry
+
+	now func() time.Time
+}
+
+func New(ttl time.Duration) *Cache {
+	return &Cache{
+		ttl:     ttl,
+		entries: make(map[string]entry),
+		now:     time.Now,
+	}
+}
+
+// BodyKey returns the cache key for the message body. The body is
+// canonicalized using the DKIM relaxed algorithm, so differences in trailing
+// whitespace introduced by relays do not matter.
+func BodyKey(body buffer.Buffer) (string, error) {
+	r, err := body.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	hash, err := arc.BodyHash(r, true)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash), nil
+}
+
+// Get returns the cached value for the key if it is not expired.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.val, true
+}
+
+// Put stores the value for the key.
+func (c *Cache) Put(key string, val interface{}) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	if len(c.entries) >= MaxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = entry{val: val, expires: now.Add(c.ttl)}
+}
+
+// evict removes expired entries. If there are none, the entry closest to
+// expiration is removed.
+func (c *Cache) evict(now time.Time) {
+	var (
+		oldestKey string
+		oldest    time.Time
+	)
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldestKey == "" || e.expires.Before(oldest) {
+			oldestKey, oldest = key, e.expires
+		}
+	}
+	if len(c.entries) >= MaxEntries {
+		delete(c.entries, oldestKey)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package scancache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/buffer"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := New(time.Minute)
+	c.now = func() time.Time { return now }
+
+	key1, err := BodyKey(buffer.MemoryBuffer{Slice: []byte("Hello  world \r\n\r\n\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := BodyKey(buffer.MemoryBuffer{Slice: []byte("Hello world\r\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1 != key2 {
+		t.Fatal("keys for equivalent bodies differ")
+	}
+
+	if _, ok := c.Get(key1); ok {
+		t.Fatal("empty cache returned a value")
+	}
+	c.Put(key1, "Eicar-Signature")
+	if val, ok := c.Get(key1); !ok || val != "Eicar-Signature" {
+		t.Fatal("wrong cached value:", val, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get(key1); ok {
+		t.Fatal("expired value is returned")
+	}
+
+	for i := 0; i < MaxEntries+10; i++ {
+		c.Put(strconv.Itoa(i), i)
+		now = now.Add(time.Millisecond)
+	}
+	if len(c.entries) > MaxEntries {
+		t.Fatal("cache size is not limited:", len(c.entries))
+	}
+	if _, ok := c.Get("0"); ok {
+		t.Fatal("the oldest entry is not evicted")
+	}
+
+	var nilCache *Cache
+	nilCache.Put(key1, 1)
+	if _, ok := nilCache.Get(key1); ok {
+		t.Fatal("nil cache returned a value")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package send_quota
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// notify sends the message about the exceeded quota to notify_rcpt
+// addresses.
+func (c *Check) notify(username, exceeded string) {
+	if c.notifyTarget == nil {
+		return
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		c.log.Error("rand.Rand error", err)
+		return
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Date", c.now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-ID", "<"+msgID+"@"+c.notifyDomain+">")
+	hdr.Add("From", c.notifyFrom)
+	hdr.Add("To", strings.Join(c.notifyRcpts, ", "))
+	hdr.Add("Subject", "Sending quota exceeded for "+username)
+	hdr.Add("Auto-Submitted", "auto-generated")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+
+	body := fmt.Sprintf("User %s exceeded the sending quota (%s).\r\n\r\n"+
+		"Further messages are rejected until the quota resets. If this is not\r\n"+
+		"expected, the account might be compromised.\r\n", username, exceeded)
+
+	msgCtx, msgTask := trace.NewTask(context.Background(), "Quota notification")
+	defer msgTask.End()
+
+	// Null return-path, notifications should not generate bounces.
+	d, err := c.notifyTarget.Start(msgCtx, &module.MsgMetadata{ID: msgID}, "")
+	if err != nil {
+		c.log.Error("failed to send notification", err, "username", username)
+		return
+	}
+	for _, rcpt := range c.notifyRcpts {
+		if err := d.AddRcpt(msgCtx, rcpt); err != nil {
+			c.log.Error("failed to send notification", err, "username", username, "rcpt", rcpt)
+			if err := d.Abort(msgCtx); err != nil {
+				c.log.Error("failed to abort notification", err)
+			}
+			return
+		}
+	}
+	if err := d.Body(msgCtx, hdr, buffer.MemoryBuffer{Slice: []byte(body)}); err != nil {
+		c.log.Error("failed to send notification", err, "username", username)
+		if err := d.Abort(msgCtx); err != nil {
+			c.log.Error("failed to abort notification", err)
+		}
+		return
+	}
+	if err := d.Commit(msgCtx); err != nil {
+		c.log.Error("failed to send notification", err, "username", username)
+		return
+	}
+	c.log.Msg("quota notification sent", "username", username, "notify_id", msgID)
+}
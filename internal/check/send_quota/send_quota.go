@@ -0,0 +1,329 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package send_quota implements the check that limits the amount of messages
+// and recipients authenticated users can send per hour and per day.
+package send_quota
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.send_quota"
+
+// Limits is the set of quotas applied to a single user. Zero value means
+// no limit.
+type Limits struct {
+	MessagesPerHour   int
+	MessagesPerDay    int
+	RecipientsPerHour int
+	RecipientsPerDay  int
+}
+
+// ParseLimits parses the table value, overriding the corresponding fields of
+// defaults.
+//
+// Value is either "unlimited" or a space-separated list of name=value pairs,
+// e.g. "messages_per_hour=10 recipients_per_day=100".
+func ParseLimits(val string, defaults Limits) (Limits, error) {
+	if strings.TrimSpace(val) == "unlimited" {
+		return Limits{}, nil
+	}
+
+	res := defaults
+	for _, field := range strings.Fields(val) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return Limits{}, fmt.Errorf("malformed limit: %s", field)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 0 {
+			return Limits{}, fmt.Errorf("malformed limit value: %s", field)
+		}
+		switch parts[0] {
+		case "messages_per_hour":
+			res.MessagesPerHour = n
+		case "messages_per_day":
+			res.MessagesPerDay = n
+		case "recipients_per_hour":
+			res.RecipientsPerHour = n
+		case "recipients_per_day":
+			res.RecipientsPerDay = n
+		default:
+			return Limits{}, fmt.Errorf("unknown limit: %s", parts[0])
+		}
+	}
+	return res, nil
+}
+
+// usage is the amount of messages and recipients sent by the user in the
+// current hour and day windows.
+type usage struct {
+	hourStart time.Time
+	hourMsgs  int
+	hourRcpts int
+
+	dayStart time.Time
+	dayMsgs  int
+	dayRcpts int
+
+	lastNotify time.Time
+}
+
+func (u *usage) rotate(now time.Time) {
+	if hour := now.Truncate(time.Hour); !hour.Equal(u.hourStart) {
+		u.hourStart = hour
+		u.hourMsgs, u.hourRcpts = 0, 0
+	}
+	if day := now.Truncate(24 * time.Hour); !day.Equal(u.dayStart) {
+		u.dayStart = day
+		u.dayMsgs, u.dayRcpts = 0, 0
+	}
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	table    module.Table
+	defaults Limits
+
+	notifyTarget module.DeliveryTarget
+	notifyRcpts  []string
+	notifyFrom   string
+	notifyDomain string
+
+	usageLck sync.Mutex
+	usage    map[string]*usage
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		usage:    map[string]*usage{},
+		now:      time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var hostname string
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.Custom("table", false, false, nil, modconfig.TableDirective, &c.table)
+	cfg.Int("messages_per_hour", false, false, 0, &c.defaults.MessagesPerHour)
+	cfg.Int("messages_per_day", false, false, 0, &c.defaults.MessagesPerDay)
+	cfg.Int("recipients_per_hour", false, false, 0, &c.defaults.RecipientsPerHour)
+	cfg.Int("recipients_per_day", false, false, 0, &c.defaults.RecipientsPerDay)
+	cfg.Custom("notify_target", false, false, nil, modconfig.DeliveryDirective, &c.notifyTarget)
+	cfg.StringList("notify_rcpt", false, false, nil, &c.notifyRcpts)
+	cfg.String("notify_from", false, false, "", &c.notifyFrom)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.notifyTarget != nil {
+		if hostname == "" {
+			return fmt.Errorf("%s: hostname is required for notifications", modName)
+		}
+		c.notifyDomain = hostname
+		if c.notifyFrom == "" {
+			c.notifyFrom = "MAILER-DAEMON@" + hostname
+		}
+		if len(c.notifyRcpts) == 0 {
+			c.notifyRcpts = []string{"postmaster@" + hostname}
+		}
+	}
+
+	return nil
+}
+
+// limitsFor returns limits for the user.
+func (c *Check) limitsFor(ctx context.Context, username string) (Limits, error) {
+	if c.table == nil {
+		return c.defaults, nil
+	}
+	val, ok, err := c.table.Lookup(ctx, username)
+	if err != nil {
+		return Limits{}, err
+	}
+	if !ok {
+		return c.defaults, nil
+	}
+	return ParseLimits(val, c.defaults)
+}
+
+// account checks whether the user can send msgs more messages to rcpts more
+// recipients and records the usage if so. Non-empty string describing the
+// exceeded quota is returned otherwise.
+func (c *Check) account(username string, lim Limits, msgs, rcpts int) (exceeded string, notify bool) {
+	c.usageLck.Lock()
+	defer c.usageLck.Unlock()
+
+	now := c.now()
+	u := c.usage[username]
+	if u == nil {
+		u = &usage{}
+		c.usage[username] = u
+	}
+	u.rotate(now)
+
+	switch {
+	case lim.MessagesPerHour != 0 && u.hourMsgs+msgs > lim.MessagesPerHour:
+		exceeded = fmt.Sprintf("%d messages per hour", lim.MessagesPerHour)
+	case lim.MessagesPerDay != 0 && u.dayMsgs+msgs > lim.MessagesPerDay:
+		exceeded = fmt.Sprintf("%d messages per day", lim.MessagesPerDay)
+	case lim.RecipientsPerHour != 0 && u.hourRcpts+rcpts > lim.RecipientsPerHour:
+		exceeded = fmt.Sprintf("%d recipients per hour", lim.RecipientsPerHour)
+	case lim.RecipientsPerDay != 0 && u.dayRcpts+rcpts > lim.RecipientsPerDay:
+		exceeded = fmt.Sprintf("%d recipients per day", lim.RecipientsPerDay)
+	}
+	if exceeded != "" {
+		// Notify at most once per hour, otherwise the spam run will result
+		// in a notification for each attempt.
+		if now.Sub(u.lastNotify) >= time.Hour {
+			u.lastNotify = now
+			notify = true
+		}
+		return exceeded, notify
+	}
+
+	u.hourMsgs += msgs
+	u.dayMsgs += msgs
+	u.hourRcpts += rcpts
+	u.dayRcpts += rcpts
+	return "", false
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) check(ctx context.Context, msgs, rcpts int) module.CheckResult {
+	if s.msgMeta.Conn == nil || s.msgMeta.Conn.AuthUser == "" {
+		s.log.DebugMsg("not authenticated, skipping")
+		return module.CheckResult{}
+	}
+	username := s.msgMeta.Conn.AuthUser
+
+	lim, err := s.c.limitsFor(ctx, username)
+	if err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		}
+	}
+
+	exceeded, notify := s.c.account(username, lim, msgs, rcpts)
+	if exceeded == "" {
+		return module.CheckResult{}
+	}
+
+	s.log.Msg("sending quota exceeded", "username", username, "quota", exceeded)
+	if notify {
+		go s.c.notify(username, exceeded)
+	}
+
+	return module.CheckResult{
+		Reject: true,
+		Reason: &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+			Message:      "Sending quota exceeded, try again later",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"username": username,
+				"quota":    exceeded,
+			},
+		},
+	}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, "send_quota/CheckSender").End()
+
+	return s.check(ctx, 1, 0)
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, "send_quota/CheckRcpt").End()
+
+	return s.check(ctx, 0, 1)
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
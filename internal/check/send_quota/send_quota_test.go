@@ -0,0 +1,143 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package send_quota
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestParseLimits(t *testing.T) {
+	defaults := Limits{MessagesPerHour: 10, RecipientsPerDay: 100}
+
+	lim, err := ParseLimits("messages_per_day=50 recipients_per_day=0", defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lim != (Limits{MessagesPerHour: 10, MessagesPerDay: 50}) {
+		t.Fatalf("wrong limits: %+v", lim)
+	}
+
+	lim, err = ParseLimits("unlimited", defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lim != (Limits{}) {
+		t.Fatalf("wrong limits: %+v", lim)
+	}
+
+	for _, invalid := range []string{"messages_per_day", "messages_per_day=-1", "foo=1"} {
+		if _, err := ParseLimits(invalid, defaults); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	c := &Check{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		table: testutils.Table{M: map[string]string{
+			"vip@example.org": "messages_per_hour=5",
+		}},
+		defaults: Limits{MessagesPerHour: 2, RecipientsPerHour: 3},
+		usage:    map[string]*usage{},
+		now:      func() time.Time { return now },
+	}
+
+	send := func(username string, rcpts int) bool {
+		t.Helper()
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{},
+				AuthUser:        username,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := s.CheckSender(context.Background(), username); res.Reject {
+			return false
+		}
+		for i := 0; i < rcpts; i++ {
+			if res := s.CheckRcpt(context.Background(), "rcpt@example.com"); res.Reject {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !send("user@example.org", 1) || !send("user@example.org", 2) {
+		t.Fatal("message within quota is rejected")
+	}
+	if send("user@example.org", 1) {
+		t.Fatal("message over the quota is accepted")
+	}
+	for i := 0; i < 3; i++ {
+		if !send("vip@example.org", 0) {
+			t.Fatal("per-user limit is not used")
+		}
+	}
+
+	now = now.Add(time.Hour)
+	if !send("user@example.org", 1) {
+		t.Fatal("quota is not reset")
+	}
+
+	// Unauthenticated messages are not counted.
+	s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := s.CheckSender(context.Background(), "a@example.com"); res.Reject {
+		t.Fatal("unauthenticated message is rejected")
+	}
+}
+
+func TestNotify(t *testing.T) {
+	tgt := testutils.Target{}
+	c := &Check{
+		instName:     "test",
+		log:          testutils.Logger(t, modName),
+		notifyTarget: &tgt,
+		notifyRcpts:  []string{"postmaster@example.org"},
+		notifyFrom:   "MAILER-DAEMON@example.org",
+		notifyDomain: "example.org",
+		now:          time.Now,
+	}
+	c.notify("user@example.org", "2 messages per hour")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "postmaster@example.org" {
+		t.Fatalf("wrong envelope: %v %v", msg.MailFrom, msg.RcptTo)
+	}
+	if !strings.Contains(msg.Header.Get("Subject"), "user@example.org") {
+		t.Error("wrong subject:", msg.Header.Get("Subject"))
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sender_lists
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+)
+
+// folderStorage is the subset of module.ManageableStorage used to scan
+// users' folders.
+type folderStorage interface {
+	ListIMAPAccts() ([]string, error)
+	GetIMAPAcct(username string) (imapbackend.User, error)
+}
+
+func (c *Check) scanLoop() {
+	t := time.NewTicker(c.scanInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			c.scanFolders()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// scanFolders updates lists of all users using messages placed into the
+// special folders.
+func (c *Check) scanFolders() {
+	users, err := c.storage.ListIMAPAccts()
+	if err != nil {
+		c.log.Error("failed to list accounts", err)
+		return
+	}
+
+	for _, username := range users {
+		if err := c.scanUser(username); err != nil {
+			c.log.Error("folder scan failed", err, "username", username)
+		}
+	}
+}
+
+func (c *Check) scanUser(username string) error {
+	u, err := c.storage.GetIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			c.log.Error("logout failed", err, "username", username)
+		}
+	}()
+
+	if c.blockFolder != "" {
+		if err := c.scanFolder(u, c.blockFolder, ActionBlock); err != nil {
+			return fmt.Errorf("%s: %w", c.blockFolder, err)
+		}
+	}
+	if c.allowFolder != "" {
+		if err := c.scanFolder(u, c.allowFolder, ActionAllow); err != nil {
+			return fmt.Errorf("%s: %w", c.allowFolder, err)
+		}
+	}
+	return nil
+}
+
+// scanFolder adds senders of all messages in the folder to the list with the
+// specified action.
+//
+// Afterwards, messages from the allow folder are copied to INBOX. Messages
+// are then removed from the folder.
+func (c *Check) scanFolder(u imapbackend.User, folder, action string) error {
+	mbox, err := u.GetMailbox(folder)
+	if err != nil {
+		if errors.Is(err, imapbackend.ErrNoSuchMailbox) {
+			// Create the folder so users can see it in their clients.
+			return u.CreateMailbox(folder)
+		}
+		return err
+	}
+
+	seqset := &imap.SeqSet{}
+	seqset.AddRange(1, 0)
+	ch := make(chan *imap.Message, 16)
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- mbox.ListMessages(true, seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope}, ch)
+	}()
+
+	processed := &imap.SeqSet{}
+	for msg := range ch {
+		if msg.Envelope == nil || len(msg.Envelope.From) == 0 {
+			processed.AddNum(msg.Uid)
+			continue
+		}
+		sender := msg.Envelope.From[0].Address()
+		if err := SetEntry(c.table, u.Username(), sender, action); err != nil {
+			c.log.Error("failed to add list entry", err, "username", u.Username(), "sender", sender)
+			continue
+		}
+		c.log.Msg("list entry added from folder", "username", u.Username(), "sender", sender, "action", action)
+		processed.AddNum(msg.Uid)
+	}
+	if err := <-listErr; err != nil {
+		return err
+	}
+	if processed.Empty() {
+		return nil
+	}
+
+	if action == ActionAllow {
+		if err := mbox.CopyMessages(true, processed, imap.InboxName); err != nil {
+			return err
+		}
+	}
+	if err := mbox.UpdateMessagesFlags(true, processed, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		return err
+	}
+	return mbox.Expunge()
+}
@@ -0,0 +1,176 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sender_lists
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// List entries are stored in the table using "<recipient> <sender>" keys,
+// where sender is either a full address or a domain. Value is the entry
+// action.
+const (
+	ActionBlock = "block"
+	ActionAllow = "allow"
+)
+
+// NormalizeSender converts the block list entry (address or domain) to the
+// form used in table keys.
+func NormalizeSender(sender string) (string, error) {
+	if sender == "" {
+		return "", errors.New("empty sender")
+	}
+	if strings.Contains(sender, "@") {
+		return address.ForLookup(sender)
+	}
+	return dns.ForLookup(sender)
+}
+
+// Key returns the table key for the entry. Both values should be normalized.
+func Key(rcpt, sender string) string {
+	return rcpt + " " + sender
+}
+
+// ParseKey splits the table key into recipient and sender parts.
+func ParseKey(key string) (rcpt, sender string, ok bool) {
+	parts := strings.SplitN(key, " ", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// senderKeys returns the list of entries that match the sender address, most
+// specific first: address, domain and parent domains.
+func senderKeys(sender string) []string {
+	_, domain, err := address.Split(sender)
+	if err != nil || domain == "" {
+		return []string{sender}
+	}
+
+	keys := []string{sender}
+	labels := strings.Split(domain, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		keys = append(keys, strings.Join(labels[i:], "."))
+	}
+	return keys
+}
+
+// Lookup returns the action of the most specific list entry matching the
+// sender for the recipient. Empty string is returned if there is no matching
+// entry.
+func Lookup(ctx context.Context, tbl module.Table, rcpt, sender string) (string, error) {
+	rcpt, err := address.ForLookup(rcpt)
+	if err != nil {
+		return "", err
+	}
+	sender, err = address.ForLookup(sender)
+	if err != nil {
+		return "", err
+	}
+
+	for _, s := range senderKeys(sender) {
+		action, ok, err := tbl.Lookup(ctx, Key(rcpt, s))
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		switch action {
+		case ActionBlock, ActionAllow:
+			return action, nil
+		default:
+			return "", fmt.Errorf("unknown action for %s: %s", Key(rcpt, s), action)
+		}
+	}
+	return "", nil
+}
+
+// Entry is a single list entry.
+type Entry struct {
+	Sender string
+	Action string
+}
+
+// Entries returns all entries for the recipient.
+func Entries(ctx context.Context, tbl module.MutableTable, rcpt string) ([]Entry, error) {
+	rcpt, err := address.ForLookup(rcpt)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := tbl.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, key := range keys {
+		keyRcpt, sender, ok := ParseKey(key)
+		if !ok || keyRcpt != rcpt {
+			continue
+		}
+		action, ok, err := tbl.Lookup(ctx, key)
+		if err != nil {
+			return entries, err
+		}
+		if !ok {
+			continue
+		}
+		entries = append(entries, Entry{Sender: sender, Action: action})
+	}
+	return entries, nil
+}
+
+// SetEntry adds or replaces the entry for the recipient.
+func SetEntry(tbl module.MutableTable, rcpt, sender, action string) error {
+	if action != ActionBlock && action != ActionAllow {
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	rcpt, err := address.ForLookup(rcpt)
+	if err != nil {
+		return err
+	}
+	sender, err = NormalizeSender(sender)
+	if err != nil {
+		return err
+	}
+	return tbl.SetKey(Key(rcpt, sender), action)
+}
+
+// RemoveEntry removes the entry for the recipient.
+func RemoveEntry(tbl module.MutableTable, rcpt, sender string) error {
+	rcpt, err := address.ForLookup(rcpt)
+	if err != nil {
+		return err
+	}
+	sender, err = NormalizeSender(sender)
+	if err != nil {
+		return err
+	}
+	return tbl.RemoveKey(Key(rcpt, sender))
+}
@@ -0,0 +1,244 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sender_lists implements the check that consults per-recipient
+// sender block and allow lists maintained by users themselves.
+//
+// Lists are stored in a mutable table and can be changed via the admin UI
+// self-service page or by moving messages into special IMAP folders.
+package sender_lists
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"runtime/trace"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.sender_lists"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	table      module.MutableTable
+	failAction modconfig.FailAction
+	checkBody  bool
+
+	storage      folderStorage
+	blockFolder  string
+	allowFolder  string
+	scanInterval time.Duration
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var tbl module.Table
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &tbl)
+	cfg.Bool("check_header_from", false, true, &c.checkBody)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("storage", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var storage module.Storage
+		if err := modconfig.ModuleFromNode("storage", node.Args, node, m.Globals, &storage); err != nil {
+			return nil, err
+		}
+		fs, ok := storage.(folderStorage)
+		if !ok {
+			return nil, config.NodeErr(node, "storage does not support accounts listing")
+		}
+		return fs, nil
+	}, &c.storage)
+	cfg.String("block_folder", false, false, "Blocked Senders", &c.blockFolder)
+	cfg.String("allow_folder", false, false, "Allowed Senders", &c.allowFolder)
+	cfg.Duration("scan_interval", false, false, 5*time.Minute, &c.scanInterval)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	mutable, ok := tbl.(module.MutableTable)
+	if !ok {
+		return fmt.Errorf("%s: table is not mutable", modName)
+	}
+	c.table = mutable
+
+	if c.storage != nil && c.scanInterval != 0 {
+		go c.scanLoop()
+	}
+
+	return nil
+}
+
+func (c *Check) Close() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	return nil
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	mailFrom string
+	rcpts    []string
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	s.mailFrom = addr
+	return module.CheckResult{}
+}
+
+// lookup returns the action for the sender using lists of the recipient. If
+// the recipient address was rewritten (e.g. it is an alias), the list of the
+// original address is consulted if there is no matching entry in the list of
+// the final one.
+func (s *state) lookup(ctx context.Context, rcpt, sender string) (string, error) {
+	action, err := Lookup(ctx, s.c.table, rcpt, sender)
+	if err != nil || action != "" {
+		return action, err
+	}
+	if original, ok := s.msgMeta.OriginalRcpts[rcpt]; ok && original != rcpt {
+		return Lookup(ctx, s.c.table, original, sender)
+	}
+	return "", nil
+}
+
+func (s *state) blockedErr(sender string) module.CheckResult {
+	return s.c.failAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Recipient does not accept messages from this sender",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"sender": sender,
+			},
+		},
+	})
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, "sender_lists/CheckRcpt").End()
+
+	if s.mailFrom == "" {
+		s.rcpts = append(s.rcpts, addr)
+		return module.CheckResult{}
+	}
+
+	action, err := s.lookup(ctx, addr, s.mailFrom)
+	if err != nil {
+		s.log.Error("list lookup failed", err, "rcpt", addr)
+		s.rcpts = append(s.rcpts, addr)
+		return module.CheckResult{}
+	}
+	if action != ActionBlock {
+		s.rcpts = append(s.rcpts, addr)
+		return module.CheckResult{}
+	}
+
+	s.log.Msg("sender blocked by recipient", "rcpt", addr, "sender", s.mailFrom)
+	return s.blockedErr(s.mailFrom)
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "sender_lists/CheckBody").End()
+
+	if !s.c.checkBody || len(s.rcpts) == 0 {
+		return module.CheckResult{}
+	}
+
+	from, err := mail.ParseAddress(hdr.Get("From"))
+	if err != nil {
+		s.log.DebugMsg("malformed From header, skipping", "err", err)
+		return module.CheckResult{}
+	}
+
+	// The message can be rejected only for all recipients at this point, so
+	// do that only if all of them block the sender.
+	for _, rcpt := range s.rcpts {
+		action, err := s.lookup(ctx, rcpt, from.Address)
+		if err != nil {
+			s.log.Error("list lookup failed", err, "rcpt", rcpt)
+			return module.CheckResult{}
+		}
+		if action != ActionBlock {
+			return module.CheckResult{}
+		}
+	}
+
+	s.log.Msg("header sender blocked by all recipients", "from", from.Address)
+	return s.blockedErr(from.Address)
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,234 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sender_lists
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-message/textproto"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mapTable map[string]string
+
+func (m mapTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	v, ok := m[key]
+	return v, ok, nil
+}
+
+func (m mapTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m mapTable) SetKey(key, value string) error {
+	m[key] = value
+	return nil
+}
+
+func (m mapTable) RemoveKey(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func testCheck(t *testing.T, tbl mapTable) *Check {
+	return &Check{
+		instName:   "test",
+		log:        testutils.Logger(t, modName),
+		table:      tbl,
+		failAction: modconfig.FailAction{Reject: true},
+		checkBody:  true,
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tbl := mapTable{}
+	for _, e := range []Entry{
+		{"spam.example.org", ActionBlock},
+		{"friend@spam.example.org", ActionAllow},
+		{"example.com", ActionBlock},
+		{"foe@Example.NET", ActionBlock},
+	} {
+		if err := SetEntry(tbl, "User@example.org", e.Sender, e.Action); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for sender, want := range map[string]string{
+		"a@spam.example.org":      ActionBlock,
+		"a@sub.spam.example.org":  ActionBlock,
+		"friend@spam.example.org": ActionAllow,
+		"a@example.com":           ActionBlock,
+		"foe@example.net":         ActionBlock,
+		"friend@example.net":      "",
+		"a@example.org":           "",
+	} {
+		action, err := Lookup(context.Background(), tbl, "user@example.org", sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action != want {
+			t.Errorf("%s: want %q, got %q", sender, want, action)
+		}
+	}
+
+	action, err := Lookup(context.Background(), tbl, "other@example.org", "a@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != "" {
+		t.Error("list of other user is used")
+	}
+
+	entries, err := Entries(context.Background(), tbl, "user@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 {
+		t.Fatal("wrong amount of entries:", entries)
+	}
+
+	if err := RemoveEntry(tbl, "user@example.org", "Example.COM"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tbl[Key("user@example.org", "example.com")]; ok {
+		t.Error("entry is not removed")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tbl := mapTable{
+		Key("user@example.org", "example.com"):  ActionBlock,
+		Key("alias@example.org", "foe.example"): ActionBlock,
+	}
+	c := testCheck(t, tbl)
+
+	test := func(mailFrom string, rcpts []string, blocked []bool, from string, bodyReject bool) {
+		t.Helper()
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			OriginalRcpts: map[string]string{
+				"user@example.org": "alias@example.org",
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.CheckSender(context.Background(), mailFrom)
+		for i, rcpt := range rcpts {
+			res := s.CheckRcpt(context.Background(), rcpt)
+			if res.Reject != blocked[i] {
+				t.Errorf("%s -> %s: want reject=%v, got %v", mailFrom, rcpt, blocked[i], res.Reject)
+			}
+		}
+
+		hdr := textproto.Header{}
+		hdr.Add("From", from)
+		res := s.CheckBody(context.Background(), hdr, nil)
+		if res.Reject != bodyReject {
+			t.Errorf("From %s: want reject=%v, got %v", from, bodyReject, res.Reject)
+		}
+	}
+
+	test("a@example.com", []string{"user@example.org", "other@example.org"}, []bool{true, false}, "a@example.com", false)
+	test("a@foe.example", []string{"user@example.org"}, []bool{true}, "a@example.org", false)
+	test("", []string{"user@example.org"}, []bool{false}, "a@example.com", true)
+	test("", []string{"user@example.org", "other@example.org"}, []bool{false, false}, "a@example.com", false)
+}
+
+type namedUser struct {
+	imapbackend.User
+	name string
+}
+
+func (u namedUser) Username() string {
+	return u.name
+}
+
+type memStorage struct {
+	user imapbackend.User
+}
+
+func (s memStorage) ListIMAPAccts() ([]string, error) {
+	return []string{"user@example.org"}, nil
+}
+
+func (s memStorage) GetIMAPAcct(username string) (imapbackend.User, error) {
+	if username != "user@example.org" {
+		return nil, errors.New("no such user")
+	}
+	return namedUser{User: s.user, name: username}, nil
+}
+
+func TestScanFolders(t *testing.T) {
+	be := memory.New()
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tbl := mapTable{}
+	c := testCheck(t, tbl)
+	c.storage = memStorage{user: u}
+	c.blockFolder = "Blocked Senders"
+	c.allowFolder = "Allowed Senders"
+
+	for _, folder := range []string{"Blocked Senders", "Allowed Senders"} {
+		if err := u.CreateMailbox(folder); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqset, _ := imap.ParseSeqSet("1")
+	if err := inbox.CopyMessages(false, seqset, "Blocked Senders"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.scanFolders()
+
+	if tbl[Key("user@example.org", "contact@example.org")] != ActionBlock {
+		t.Fatal("entry is not added:", tbl)
+	}
+	mbox, err := u.GetMailbox("Blocked Senders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 0 {
+		t.Error("messages are not removed from the folder:", status.Messages)
+	}
+}
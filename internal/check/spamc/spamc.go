@@ -0,0 +1,405 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package spamc implements the check that uses SpamAssassin daemon (spamd)
+// via the spamc protocol.
+package spamc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	msgtextproto "github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check/scancache"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.spamc"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	endpointArg     string
+	endpoint        config.Endpoint
+	user            string
+	timeout         time.Duration
+	maxSize         int
+	addHeader       bool
+	quarantineScore float64
+	rejectScore     float64
+	spamAction      modconfig.FailAction
+	ioErrAction     modconfig.FailAction
+	cache           *scancache.Cache
+
+	dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	c := &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		dialer:   (&net.Dialer{}).DialContext,
+	}
+
+	switch len(inlineArgs) {
+	case 1:
+		c.endpointArg = inlineArgs[0]
+	case 0:
+		c.endpointArg = "tcp://127.0.0.1:783"
+	default:
+		return nil, fmt.Errorf("%s: unexpected amount of inline arguments", modName)
+	}
+
+	return c, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var cacheTTL time.Duration
+
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("endpoint", false, false, c.endpointArg, &c.endpointArg)
+	cfg.String("user", false, false, "", &c.user)
+	cfg.Duration("timeout", false, false, 30*time.Second, &c.timeout)
+	cfg.DataSize("max_size", false, false, 500*1024, &c.maxSize)
+	cfg.Bool("add_header", false, true, &c.addHeader)
+	cfg.Float("quarantine_score", false, false, 0, &c.quarantineScore)
+	cfg.Float("reject_score", false, false, 0, &c.rejectScore)
+	cfg.Custom("spam_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.spamAction)
+	cfg.Custom("io_error_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.ioErrAction)
+	cfg.Duration("cache_ttl", false, false, 0, &cacheTTL)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if cacheTTL != 0 {
+		c.cache = scancache.New(cacheTTL)
+	}
+
+	var err error
+	c.endpoint, err = config.ParseEndpoint(c.endpointArg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if c.endpoint.IsTLS() {
+		return fmt.Errorf("%s: TLS is not supported", modName)
+	}
+
+	return nil
+}
+
+type report struct {
+	spam     bool
+	score    float64
+	required float64
+	symbols  []string
+}
+
+// parseSpamHeader parses the value of Spam header in spamd response, e.g.
+// "True ; 15.0 / 5.0".
+func parseSpamHeader(val string) (report, error) {
+	var r report
+
+	parts := strings.SplitN(val, ";", 2)
+	if len(parts) != 2 {
+		return r, fmt.Errorf("malformed Spam header: %q", val)
+	}
+	switch strings.ToLower(strings.TrimSpace(parts[0])) {
+	case "true", "yes":
+		r.spam = true
+	case "false", "no":
+	default:
+		return r, fmt.Errorf("malformed Spam header: %q", val)
+	}
+
+	scores := strings.SplitN(parts[1], "/", 2)
+	if len(scores) != 2 {
+		return r, fmt.Errorf("malformed Spam header: %q", val)
+	}
+	var err error
+	r.score, err = strconv.ParseFloat(strings.TrimSpace(scores[0]), 64)
+	if err != nil {
+		return r, fmt.Errorf("malformed score: %w", err)
+	}
+	r.required, err = strconv.ParseFloat(strings.TrimSpace(scores[1]), 64)
+	if err != nil {
+		return r, fmt.Errorf("malformed required score: %w", err)
+	}
+
+	return r, nil
+}
+
+// readResponse parses spamd response to the SYMBOLS command.
+func readResponse(r *bufio.Reader) (report, error) {
+	tp := textproto.NewReader(r)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return report{}, err
+	}
+	// SPAMD/1.1 0 EX_OK
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return report{}, fmt.Errorf("malformed response: %q", line)
+	}
+	if fields[1] != "0" {
+		return report{}, fmt.Errorf("spamd error: %s", line)
+	}
+
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return report{}, err
+	}
+	rep, err := parseSpamHeader(hdr.Get("Spam"))
+	if err != nil {
+		return report{}, err
+	}
+
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return report{}, err
+	}
+	for _, sym := range strings.Split(string(body), ",") {
+		sym = strings.TrimSpace(sym)
+		if sym != "" {
+			rep.symbols = append(rep.symbols, sym)
+		}
+	}
+
+	return rep, nil
+}
+
+func (c *Check) scan(ctx context.Context, msgLen int, msg io.Reader) (report, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	conn, err := c.dialer(ctx, c.endpoint.Network(), c.endpoint.Address())
+	if err != nil {
+		return report{}, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return report{}, err
+		}
+	}
+
+	wr := bufio.NewWriter(conn)
+	fmt.Fprintf(wr, "SYMBOLS SPAMC/1.5\r\n")
+	fmt.Fprintf(wr, "Content-length: %d\r\n", msgLen)
+	if c.user != "" {
+		fmt.Fprintf(wr, "User: %s\r\n", c.user)
+	}
+	fmt.Fprintf(wr, "\r\n")
+	if _, err := io.Copy(wr, msg); err != nil {
+		return report{}, err
+	}
+	if err := wr.Flush(); err != nil {
+		return report{}, err
+	}
+
+	// Signal the end of the message to older spamd versions.
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return report{}, err
+		}
+	}
+
+	return readResponse(bufio.NewReader(conn))
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+// scanCached scans the message or returns the cached result for the same
+// body if cache_ttl is set.
+func (s *state) scanCached(ctx context.Context, hdrBuf *bytes.Buffer, body buffer.Buffer) (report, error) {
+	var cacheKey string
+	if s.c.cache != nil {
+		var err error
+		cacheKey, err = scancache.BodyKey(body)
+		if err != nil {
+			return report{}, err
+		}
+		if rep, ok := s.c.cache.Get(cacheKey); ok {
+			s.log.DebugMsg("using cached scan result")
+			return rep.(report), nil
+		}
+	}
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return report{}, err
+	}
+	defer bodyR.Close()
+
+	rep, err := s.c.scan(ctx, hdrBuf.Len()+body.Len(), io.MultiReader(hdrBuf, bodyR))
+	if err != nil {
+		return report{}, err
+	}
+	if cacheKey != "" {
+		s.c.cache.Put(cacheKey, rep)
+	}
+	return rep, nil
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr msgtextproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "spamc/CheckBody").End()
+
+	var hdrBuf bytes.Buffer
+	if err := msgtextproto.WriteHeader(&hdrBuf, hdr); err != nil {
+		return module.CheckResult{
+			Reject: true,
+			Reason: exterrors.WithFields(err, map[string]interface{}{"check": modName}),
+		}
+	}
+
+	msgLen := hdrBuf.Len() + body.Len()
+	if s.c.maxSize > 0 && msgLen > s.c.maxSize {
+		s.log.DebugMsg("message is too big, skipping", "size", msgLen)
+		return module.CheckResult{}
+	}
+
+	rep, err := s.scanCached(ctx, &hdrBuf, body)
+	if err != nil {
+		return s.c.ioErrAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+				Message:      "Internal error during policy check",
+				CheckName:    modName,
+				Err:          err,
+			},
+		})
+	}
+
+	s.log.DebugMsg("scan result", "spam", rep.spam, "score", rep.score, "required", rep.required, "symbols", rep.symbols)
+
+	res := module.CheckResult{}
+	if s.c.addHeader {
+		res.Header = msgtextproto.Header{}
+		flag := "NO"
+		status := "No"
+		if rep.spam {
+			flag = "YES"
+			status = "Yes"
+		}
+		res.Header.Add("X-Spam-Flag", flag)
+		res.Header.Add("X-Spam-Score", strconv.FormatFloat(rep.score, 'f', 1, 64))
+		res.Header.Add("X-Spam-Status", fmt.Sprintf("%s, score=%.1f required=%.1f tests=%s",
+			status, rep.score, rep.required, strings.Join(rep.symbols, ",")))
+	}
+
+	misc := map[string]interface{}{
+		"score":   rep.score,
+		"symbols": rep.symbols,
+	}
+	switch {
+	case s.c.rejectScore != 0 && rep.score >= s.c.rejectScore:
+		res.Reject = true
+		res.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
+			Misc:         misc,
+		}
+		return res
+	case s.c.quarantineScore != 0 && rep.score >= s.c.quarantineScore:
+		res.Quarantine = true
+		res.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
+			Misc:         misc,
+		}
+		return res
+	case rep.spam:
+		res.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to local policy",
+			CheckName:    modName,
+			Misc:         misc,
+		}
+		return s.c.spamAction.Apply(res)
+	}
+
+	return res
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
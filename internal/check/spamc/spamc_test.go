@@ -0,0 +1,189 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spamc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	msgtextproto "github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+// fakeSpamd replies to SYMBOLS command with the score taken from the
+// "Score: N" line of the message.
+func fakeSpamd(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewReader(bufio.NewReader(conn))
+				line, err := tp.ReadLine()
+				if err != nil || line != "SYMBOLS SPAMC/1.5" {
+					io.WriteString(conn, "SPAMD/1.1 76 Bad header line\r\n")
+					return
+				}
+				hdr, err := tp.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+				length, err := strconv.Atoi(hdr.Get("Content-Length"))
+				if err != nil {
+					return
+				}
+				msg := make([]byte, length)
+				if _, err := io.ReadFull(tp.R, msg); err != nil {
+					return
+				}
+
+				score := 0.0
+				for _, line := range strings.Split(string(msg), "\r\n") {
+					if strings.HasPrefix(line, "Score: ") {
+						score, _ = strconv.ParseFloat(strings.TrimPrefix(line, "Score: "), 64)
+					}
+				}
+				spam := "False"
+				if score >= 5 {
+					spam = "True"
+				}
+				symbols := "BAYES_00,MISSING_DATE"
+				fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: %s ; %.1f / 5.0\r\n\r\n%s",
+					len(symbols), spam, score, symbols)
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestCheckBody(t *testing.T) {
+	l := fakeSpamd(t)
+	defer l.Close()
+
+	c := &Check{
+		log: testutils.Logger(t, modName),
+		endpoint: config.Endpoint{
+			Scheme: "tcp",
+			Host:   "127.0.0.1",
+			Port:   strings.Split(l.Addr().String(), ":")[1],
+		},
+		timeout:         5 * time.Second,
+		maxSize:         1024 * 1024,
+		addHeader:       true,
+		quarantineScore: 10,
+		rejectScore:     15,
+		spamAction:      modconfig.FailAction{Score: 1},
+		ioErrAction:     modconfig.FailAction{Reject: true},
+		dialer:          (&net.Dialer{}).DialContext,
+	}
+
+	check := func(score string) module.CheckResult {
+		t.Helper()
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := msgtextproto.Header{}
+		hdr.Add("Score", score)
+		return st.CheckBody(context.Background(), hdr, buffer.MemoryBuffer{Slice: []byte("Hello!\r\n")})
+	}
+
+	res := check("1")
+	if res.Reason != nil || res.Reject || res.Quarantine {
+		t.Errorf("ham message is not accepted: %+v", res)
+	}
+	if res.Header.Get("X-Spam-Flag") != "NO" || res.Header.Get("X-Spam-Score") != "1.0" {
+		t.Errorf("wrong headers for ham: %v", res.Header)
+	}
+	if status := res.Header.Get("X-Spam-Status"); status != "No, score=1.0 required=5.0 tests=BAYES_00,MISSING_DATE" {
+		t.Errorf("wrong X-Spam-Status: %v", status)
+	}
+
+	res = check("6")
+	if res.Reject || res.Quarantine || res.Score != 1 {
+		t.Errorf("spam_action is not used: %+v", res)
+	}
+	if res.Header.Get("X-Spam-Flag") != "YES" {
+		t.Errorf("wrong X-Spam-Flag for spam: %v", res.Header.Get("X-Spam-Flag"))
+	}
+
+	if res := check("11"); !res.Quarantine || res.Reject {
+		t.Errorf("quarantine_score is not used: %+v", res)
+	}
+	if res := check("20"); !res.Reject {
+		t.Errorf("reject_score is not used: %+v", res)
+	}
+
+	l.Close()
+	if res := check("1"); !res.Reject {
+		t.Errorf("I/O error is not handled using io_error_action: %+v", res)
+	}
+}
+
+func TestParseSpamHeader(t *testing.T) {
+	for _, c := range []struct {
+		val  string
+		rep  report
+		fail bool
+	}{
+		{val: "True ; 15.0 / 5.0", rep: report{spam: true, score: 15, required: 5}},
+		{val: "False ; -1.2 / 5.0", rep: report{score: -1.2, required: 5}},
+		{val: "Yes; 5/5", rep: report{spam: true, score: 5, required: 5}},
+		{val: "", fail: true},
+		{val: "True ; 15.0", fail: true},
+		{val: "Maybe ; 1 / 5", fail: true},
+	} {
+		rep, err := parseSpamHeader(c.val)
+		if c.fail {
+			if err == nil {
+				t.Errorf("expected failure for %q", c.val)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", c.val, err)
+			continue
+		}
+		if rep.spam != c.rep.spam || rep.score != c.rep.score || rep.required != c.rep.required {
+			t.Errorf("wrong result for %q: %+v", c.val, rep)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package spamtrap implements the check that uses spamtrap addresses to
+// maintain the local reputation of client networks and sender domains.
+//
+// Spamtrap addresses are never used by legitimate correspondents, so any
+// message sent to them is considered spam. Each such message adds penalty
+// points to the client network and the sender domain in the reputation
+// database. Once points reach the threshold, the network or domain is banned
+// for some time.
+package spamtrap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.spamtrap"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	traps        module.Table
+	db           module.MutableTable
+	penalty      int
+	banThreshold int
+	banDuration  time.Duration
+	expire       time.Duration
+	ipv4Prefix   int
+	ipv6Prefix   int
+	skipAuth     bool
+	trapAction   modconfig.FailAction
+	listedAction modconfig.FailAction
+	bannedAction modconfig.FailAction
+	penalizeLock sync.Mutex
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("traps", false, true, nil, modconfig.TableDirective, &c.traps)
+	cfg.Custom("db", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var tbl module.MutableTable
+		if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl); err != nil {
+			return nil, err
+		}
+		return tbl, nil
+	}, &c.db)
+	cfg.Int("penalty", false, false, 10, &c.penalty)
+	cfg.Int("ban_threshold", false, false, 30, &c.banThreshold)
+	cfg.Duration("ban_duration", false, false, 24*time.Hour, &c.banDuration)
+	cfg.Duration("expire", false, false, 7*24*time.Hour, &c.expire)
+	cfg.Int("ipv4_prefix", false, false, 32, &c.ipv4Prefix)
+	cfg.Int("ipv6_prefix", false, false, 64, &c.ipv6Prefix)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuth)
+	cfg.Custom("trap_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.trapAction)
+	cfg.Custom("listed_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.listedAction)
+	cfg.Custom("banned_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.bannedAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if c.ipv4Prefix < 0 || c.ipv4Prefix > 32 {
+		return fmt.Errorf("%s: invalid ipv4_prefix value: %d", modName, c.ipv4Prefix)
+	}
+	if c.ipv6Prefix < 0 || c.ipv6Prefix > 128 {
+		return fmt.Errorf("%s: invalid ipv6_prefix value: %d", modName, c.ipv6Prefix)
+	}
+	if c.penalty <= 0 || c.banThreshold <= 0 {
+		return fmt.Errorf("%s: penalty and ban_threshold should be positive", modName)
+	}
+
+	return nil
+}
+
+// entry is the reputation record as stored in the database. Value format is
+// "points:last_hit_timestamp:banned_until_timestamp".
+type entry struct {
+	points      int
+	lastHit     time.Time
+	bannedUntil time.Time
+}
+
+func parseEntry(val string) (entry, error) {
+	parts := strings.Split(val, ":")
+	if len(parts) != 3 {
+		return entry{}, fmt.Errorf("malformed value: %s", val)
+	}
+	var stamps [3]int64
+	for i, part := range parts {
+		var err error
+		stamps[i], err = strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return entry{}, fmt.Errorf("malformed value: %s", val)
+		}
+	}
+	return entry{
+		points:      int(stamps[0]),
+		lastHit:     time.Unix(stamps[1], 0),
+		bannedUntil: time.Unix(stamps[2], 0),
+	}, nil
+}
+
+func (e entry) format() string {
+	return strconv.Itoa(e.points) + ":" +
+		strconv.FormatInt(e.lastHit.Unix(), 10) + ":" +
+		strconv.FormatInt(e.bannedUntil.Unix(), 10)
+}
+
+func (c *Check) ipKey(ip net.IP) string {
+	var ipNet net.IPNet
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ipNet.IP = ipv4
+		ipNet.Mask = net.CIDRMask(c.ipv4Prefix, 32)
+	} else {
+		ipNet.IP = ip
+		ipNet.Mask = net.CIDRMask(c.ipv6Prefix, 128)
+	}
+	ipNet.IP = ipNet.IP.Mask(ipNet.Mask)
+	return "ip " + ipNet.String()
+}
+
+func domainKey(domain string) string {
+	return "domain " + domain
+}
+
+// lookup returns the current reputation entry for the key. Expired entries
+// are treated as missing.
+func (c *Check) lookup(ctx context.Context, key string) (entry, error) {
+	val, ok, err := c.db.Lookup(ctx, key)
+	if err != nil || !ok {
+		return entry{}, err
+	}
+	e, err := parseEntry(val)
+	if err != nil {
+		c.log.Error("malformed reputation entry, ignoring", err, "key", key)
+		return entry{}, nil
+	}
+	now := c.now()
+	if now.Sub(e.lastHit) > c.expire && now.After(e.bannedUntil) {
+		return entry{}, nil
+	}
+	return e, nil
+}
+
+// penalize adds penalty points to the key and bans it if the threshold is
+// reached.
+func (c *Check) penalize(ctx context.Context, key string) (entry, error) {
+	c.penalizeLock.Lock()
+	defer c.penalizeLock.Unlock()
+
+	e, err := c.lookup(ctx, key)
+	if err != nil {
+		return entry{}, err
+	}
+
+	now := c.now()
+	e.points += c.penalty
+	e.lastHit = now
+	if e.points >= c.banThreshold && now.After(e.bannedUntil) {
+		e.bannedUntil = now.Add(c.banDuration)
+		// Start over once the ban expires.
+		e.points = 0
+	}
+
+	return e, c.db.SetKey(key, e.format())
+}
+
+func (c *Check) isTrap(ctx context.Context, rcpt string) (bool, error) {
+	key, err := address.ForLookup(rcpt)
+	if err != nil {
+		return false, nil
+	}
+	_, ok, err := c.traps.Lookup(ctx, key)
+	return ok, err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+
+	skip      bool
+	ip        net.IP
+	domain    string
+	penalized bool
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+// checkEntry applies the banned_action or listed_action depending on the
+// entry state.
+func (s *state) checkEntry(ctx context.Context, key string) module.CheckResult {
+	e, err := s.c.lookup(ctx, key)
+	if err != nil {
+		s.log.Error("reputation lookup failed", err, "key", key)
+		return module.CheckResult{}
+	}
+	if e.points == 0 && e.bannedUntil.IsZero() {
+		return module.CheckResult{}
+	}
+
+	// The worst of client network and sender domain reputations is published.
+	if score, ok := s.msgMeta.Facts.Int(module.FactReputationScore); !ok || -e.points < score {
+		s.msgMeta.Facts.Set(module.FactReputationScore, -e.points)
+	}
+
+	if s.c.now().Before(e.bannedUntil) {
+		s.log.Msg("banned", "key", key, "until", e.bannedUntil)
+		return s.c.bannedAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Temporarily banned due to spam",
+				CheckName:    modName,
+				Misc: map[string]interface{}{
+					"key": key,
+				},
+			},
+		})
+	}
+	if e.points == 0 {
+		return module.CheckResult{}
+	}
+
+	s.log.DebugMsg("listed", "key", key, "points", e.points)
+	return s.c.listedAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Poor sender reputation",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"key":    key,
+				"points": e.points,
+			},
+		},
+	})
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, "spamtrap/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally generated message, skipping")
+		s.skip = true
+		return module.CheckResult{}
+	}
+	if s.c.skipAuth && s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		s.skip = true
+		return module.CheckResult{}
+	}
+	tcpAddr, ok := s.msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		s.log.DebugMsg("non-TCP/IP source, skipping")
+		return module.CheckResult{}
+	}
+	s.ip = tcpAddr.IP
+
+	return s.checkEntry(ctx, s.c.ipKey(s.ip))
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, "spamtrap/CheckSender").End()
+
+	if s.skip || addr == "" {
+		return module.CheckResult{}
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return module.CheckResult{}
+	}
+	s.domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return module.CheckResult{}
+	}
+
+	return s.checkEntry(ctx, domainKey(s.domain))
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	defer trace.StartRegion(ctx, "spamtrap/CheckRcpt").End()
+
+	if s.skip {
+		return module.CheckResult{}
+	}
+
+	trap, err := s.c.isTrap(ctx, addr)
+	if err != nil {
+		s.log.Error("traps lookup failed", err, "rcpt", addr)
+		return module.CheckResult{}
+	}
+	if !trap {
+		return module.CheckResult{}
+	}
+
+	// Penalize only once per message.
+	if !s.penalized {
+		s.penalized = true
+
+		var keys []string
+		if s.ip != nil {
+			keys = append(keys, s.c.ipKey(s.ip))
+		}
+		if s.domain != "" {
+			keys = append(keys, domainKey(s.domain))
+		}
+		for _, key := range keys {
+			e, err := s.c.penalize(ctx, key)
+			if err != nil {
+				s.log.Error("failed to update reputation", err, "key", key)
+				continue
+			}
+			s.log.Msg("spamtrap hit", "rcpt", addr, "key", key, "points", e.points, "banned_until", e.bannedUntil)
+		}
+	}
+
+	// The trap is not revealed to the client.
+	return s.c.trapAction.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "User does not exist",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"rcpt": addr,
+			},
+		},
+	})
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
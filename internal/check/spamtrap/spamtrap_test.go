@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spamtrap
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type memTable map[string]string
+
+func (m memTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	val, ok := m[key]
+	return val, ok, nil
+}
+
+func (m memTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m memTable) RemoveKey(k string) error {
+	delete(m, k)
+	return nil
+}
+
+func (m memTable) SetKey(k, v string) error {
+	m[k] = v
+	return nil
+}
+
+func TestSpamtrap(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	db := memTable{}
+	c := &Check{
+		log:          testutils.Logger(t, modName),
+		traps:        memTable{"trap@example.org": ""},
+		db:           db,
+		penalty:      10,
+		banThreshold: 20,
+		banDuration:  time.Hour,
+		expire:       24 * time.Hour,
+		ipv4Prefix:   24,
+		ipv6Prefix:   64,
+		trapAction:   modconfig.FailAction{Reject: true},
+		listedAction: modconfig.FailAction{Quarantine: true},
+		bannedAction: modconfig.FailAction{Reject: true},
+		now:          func() time.Time { return now },
+	}
+
+	type result struct {
+		conn, sender, rcpt module.CheckResult
+		facts              *module.Facts
+	}
+	try := func(ip net.IP, from, to string) result {
+		t.Helper()
+		facts := module.NewFacts()
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					RemoteAddr: &net.TCPAddr{IP: ip, Port: 25},
+				},
+			},
+			Facts: facts,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result{
+			conn:   st.CheckConnection(context.Background()),
+			sender: st.CheckSender(context.Background(), from),
+			rcpt:   st.CheckRcpt(context.Background(), to),
+			facts:  facts,
+		}
+	}
+
+	ip := net.IPv4(198, 51, 100, 1)
+	res := try(ip, "spammer@spam.example", "user@example.org")
+	if res.conn.Reason != nil || res.sender.Reason != nil || res.rcpt.Reason != nil {
+		t.Fatal("unexpected rejection:", res)
+	}
+
+	res = try(ip, "spammer@spam.example", "Trap@example.org")
+	if !res.rcpt.Reject {
+		t.Fatal("trap recipient is not rejected")
+	}
+	if db["ip 198.51.100.0/24"] == "" || db["domain spam.example"] == "" {
+		t.Fatal("reputation is not updated:", db)
+	}
+
+	res = try(net.IPv4(198, 51, 100, 2), "other@example.com", "user@example.org")
+	if !res.conn.Quarantine || res.conn.Reject {
+		t.Fatal("listed network is not quarantined:", res.conn)
+	}
+	if score, _ := res.facts.Int(module.FactReputationScore); score != -10 {
+		t.Fatal("wrong reputation score fact:", score)
+	}
+
+	try(ip, "spammer@spam.example", "trap@example.org")
+	res = try(net.IPv4(203, 0, 113, 1), "spammer@spam.example", "user@example.org")
+	if res.conn.Reason != nil || !res.sender.Reject {
+		t.Fatal("banned domain is not rejected:", res)
+	}
+
+	now = now.Add(2 * time.Hour)
+	res = try(ip, "spammer@spam.example", "user@example.org")
+	if res.conn.Reason != nil || res.sender.Reason != nil {
+		t.Fatal("ban is not lifted:", res)
+	}
+
+	now = now.Add(48 * time.Hour)
+	try(ip, "spammer@spam.example", "trap@example.org")
+	if e, _ := parseEntry(db["ip 198.51.100.0/24"]); e.points != 10 {
+		t.Fatal("expired entry is not reset:", e)
+	}
+}
@@ -0,0 +1,619 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// The SPF library used for policy evaluation does not report which term
+// produced the result and ignores the exp= modifier. When the result is
+// negative, the policy is re-evaluated here to collect these details for
+// the rejection message and logs.
+//
+// Only the information that can be obtained reliably is reported. If
+// evaluation reaches a term that is not supported (ptr) or the result does
+// not agree with the library result, the mechanism is not reported.
+
+const (
+	// maxDiagLookups limits the amount of DNS queries made by the diagnostic
+	// evaluation, same as RFC 7208 limit for the policy evaluation itself.
+	maxDiagLookups = 10
+
+	// maxExplanationLen limits the length of explanation string included
+	// in the SMTP reply.
+	maxExplanationLen = 256
+)
+
+var errUnsupportedTerm = errors.New("spf: unsupported term")
+
+// diagnostics contains details of the negative SPF result.
+type diagnostics struct {
+	// Domain the matched term belongs to.
+	Domain string
+	// Record is the SPF record of Domain.
+	Record string
+	// Mechanism is the matched mechanism as written in the record, including
+	// qualifier. Empty if no mechanism matched and the default result was
+	// used.
+	Mechanism string
+	// Expanded is the domain-spec of the matched mechanism after macro
+	// expansion. Set only if it contained macros.
+	Expanded string
+	// Explanation is the explanation string obtained using the exp= modifier
+	// of the top-level record, with macros expanded.
+	Explanation string
+}
+
+func (d diagnostics) misc() map[string]interface{} {
+	m := make(map[string]interface{}, 4)
+	if d.Domain != "" {
+		m["spf_domain"] = d.Domain
+	}
+	if d.Mechanism != "" {
+		m["spf_mechanism"] = d.Mechanism
+	}
+	if d.Expanded != "" {
+		m["spf_expanded"] = d.Expanded
+	}
+	if d.Explanation != "" {
+		m["spf_explanation"] = d.Explanation
+	}
+	return m
+}
+
+// diagnose collects details of the negative SPF result. Errors are only
+// logged since details are not essential for the check.
+func (s *state) diagnose(ctx context.Context, res spf.Result) diagnostics {
+	var wantQualifier byte
+	switch res {
+	case spf.Fail:
+		wantQualifier = '-'
+	case spf.SoftFail:
+		wantQualifier = '~'
+	case spf.Neutral:
+		wantQualifier = '?'
+	default:
+		return diagnostics{}
+	}
+
+	sender := strings.TrimSuffix(s.mailFrom, ".")
+	_, domain, _ := address.Split(sender)
+	e := evaluator{
+		resolver: s.c.resolver,
+		ip:       s.ip,
+		helo:     s.msgMeta.Conn.Hostname,
+		sender:   sender,
+	}
+
+	d, q, err := e.evaluate(ctx, domain)
+	if err != nil {
+		s.log.DebugMsg("failed to collect SPF diagnostics", "reason", err)
+		return diagnostics{}
+	}
+	if q != wantQualifier && !(q == 0 && res == spf.Neutral) {
+		s.log.DebugMsg("SPF diagnostics do not match the result", "result", res,
+			"domain", d.Domain, "mechanism", d.Mechanism)
+		return diagnostics{Domain: domain}
+	}
+
+	if res == spf.Fail && s.c.useExplanation {
+		d.Explanation, err = e.explain(ctx, d)
+		if err != nil {
+			s.log.DebugMsg("failed to fetch SPF explanation", "reason", err, "domain", d.Domain)
+		}
+	}
+	return d
+}
+
+type evaluator struct {
+	resolver dns.Resolver
+	ip       net.IP
+	helo     string
+	sender   string
+	now      func() time.Time
+
+	lookups int
+}
+
+func (e *evaluator) lookup() error {
+	e.lookups++
+	if e.lookups > maxDiagLookups {
+		return errors.New("spf: lookup limit reached")
+	}
+	return nil
+}
+
+func (e *evaluator) fetchRecord(ctx context.Context, domain string) (string, error) {
+	if err := e.lookup(); err != nil {
+		return "", err
+	}
+	txts, err := e.resolver.LookupTXT(ctx, dns.FQDN(domain))
+	if err != nil {
+		return "", err
+	}
+	var record string
+	for _, txt := range txts {
+		if txt != "v=spf1" && !strings.HasPrefix(strings.ToLower(txt), "v=spf1 ") {
+			continue
+		}
+		if record != "" {
+			return "", errors.New("spf: multiple records")
+		}
+		record = txt
+	}
+	if record == "" {
+		return "", errors.New("spf: no record")
+	}
+	return record, nil
+}
+
+// evaluate finds the term that determines the policy result for the domain.
+//
+// qualifier is '+', '-', '~' or '?' for the matched mechanism. Zero
+// qualifier means no mechanism matched.
+func (e *evaluator) evaluate(ctx context.Context, domain string) (d diagnostics, qualifier byte, err error) {
+	record, err := e.fetchRecord(ctx, domain)
+	if err != nil {
+		return diagnostics{}, 0, err
+	}
+	d = diagnostics{Domain: domain, Record: record}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		lterm := strings.ToLower(term)
+		if strings.HasPrefix(lterm, "redirect=") {
+			redirect = term[len("redirect="):]
+			continue
+		}
+		if strings.Contains(lterm, "=") {
+			// exp= and unknown modifiers.
+			continue
+		}
+
+		q := byte('+')
+		switch term[0] {
+		case '+', '-', '~', '?':
+			q = term[0]
+			lterm = lterm[1:]
+		}
+
+		matched, expanded, err := e.matchMechanism(ctx, lterm, domain)
+		if err != nil {
+			return diagnostics{}, 0, err
+		}
+		if matched {
+			d.Mechanism = term
+			d.Expanded = expanded
+			return d, q, nil
+		}
+	}
+
+	if redirect != "" {
+		target, err := expandMacros(redirect, e.macroCtx(domain), false)
+		if err != nil {
+			return diagnostics{}, 0, err
+		}
+		return e.evaluate(ctx, target)
+	}
+
+	return d, 0, nil
+}
+
+// matchMechanism checks whether the mechanism (without qualifier) matches the
+// client IP address.
+func (e *evaluator) matchMechanism(ctx context.Context, mech, domain string) (bool, string, error) {
+	name, arg := mech, ""
+	if i := strings.IndexAny(mech, ":/"); i != -1 {
+		name, arg = mech[:i], mech[i:]
+	}
+
+	switch name {
+	case "all":
+		return true, "", nil
+	case "ip4", "ip6":
+		cidr := strings.TrimPrefix(arg, ":")
+		if !strings.Contains(cidr, "/") {
+			if name == "ip4" {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false, "", fmt.Errorf("spf: malformed %s", mech)
+		}
+		return ipNet.Contains(e.ip), "", nil
+	case "a", "mx":
+		target, v4Bits, v6Bits, err := splitDualCIDR(arg)
+		if err != nil {
+			return false, "", err
+		}
+		expanded := ""
+		if target == "" {
+			target = domain
+		} else {
+			target, expanded, err = e.expandSpec(target, domain)
+			if err != nil {
+				return false, "", err
+			}
+		}
+
+		hosts := []string{target}
+		if name == "mx" {
+			if err := e.lookup(); err != nil {
+				return false, "", err
+			}
+			mxs, err := e.resolver.LookupMX(ctx, dns.FQDN(target))
+			if err != nil && !isNotFound(err) {
+				return false, "", err
+			}
+			hosts = hosts[:0]
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			if name == "a" {
+				if err := e.lookup(); err != nil {
+					return false, "", err
+				}
+			}
+			addrs, err := e.resolver.LookupIPAddr(ctx, dns.FQDN(host))
+			if err != nil {
+				if isNotFound(err) {
+					continue
+				}
+				return false, "", err
+			}
+			for _, addr := range addrs {
+				if ipMatch(e.ip, addr.IP, v4Bits, v6Bits) {
+					return true, expanded, nil
+				}
+			}
+		}
+		return false, expanded, nil
+	case "include":
+		target, expanded, err := e.expandSpec(strings.TrimPrefix(arg, ":"), domain)
+		if err != nil {
+			return false, "", err
+		}
+		_, q, err := e.evaluate(ctx, target)
+		if err != nil {
+			return false, "", err
+		}
+		return q == '+', expanded, nil
+	case "exists":
+		target, expanded, err := e.expandSpec(strings.TrimPrefix(arg, ":"), domain)
+		if err != nil {
+			return false, "", err
+		}
+		if err := e.lookup(); err != nil {
+			return false, "", err
+		}
+		addrs, err := e.resolver.LookupIPAddr(ctx, dns.FQDN(target))
+		if err != nil && !isNotFound(err) {
+			return false, "", err
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				return true, expanded, nil
+			}
+		}
+		return false, expanded, nil
+	default:
+		return false, "", errUnsupportedTerm
+	}
+}
+
+// expandSpec expands macros in the domain-spec. Expanded value is also
+// returned as the second value if spec contains macros.
+func (e *evaluator) expandSpec(spec, domain string) (string, string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, "", nil
+	}
+	target, err := expandMacros(spec, e.macroCtx(domain), false)
+	if err != nil {
+		return "", "", err
+	}
+	return target, target, nil
+}
+
+// explain obtains the explanation string using the exp= modifier of the
+// record.
+func (e *evaluator) explain(ctx context.Context, d diagnostics) (string, error) {
+	var expSpec string
+	for _, term := range strings.Fields(d.Record)[1:] {
+		if strings.HasPrefix(strings.ToLower(term), "exp=") {
+			expSpec = term[len("exp="):]
+		}
+	}
+	if expSpec == "" {
+		return "", nil
+	}
+
+	mctx := e.macroCtx(d.Domain)
+	target, err := expandMacros(expSpec, mctx, false)
+	if err != nil {
+		return "", err
+	}
+	// Does not count towards the lookup limit, see RFC 7208 Section 6.2.
+	txts, err := e.resolver.LookupTXT(ctx, dns.FQDN(target))
+	if err != nil {
+		return "", err
+	}
+	if len(txts) != 1 {
+		return "", fmt.Errorf("spf: %d explanation records", len(txts))
+	}
+
+	expl, err := expandMacros(txts[0], mctx, true)
+	if err != nil {
+		return "", err
+	}
+	return sanitizeExplanation(expl), nil
+}
+
+// sanitizeExplanation strips non-printable characters from the explanation
+// string obtained from DNS and truncates it so it can be safely included in
+// the SMTP reply.
+func sanitizeExplanation(s string) string {
+	b := strings.Builder{}
+	for _, ch := range s {
+		if ch < 0x20 || ch > 0x7e {
+			continue
+		}
+		b.WriteRune(ch)
+		if b.Len() >= maxExplanationLen {
+			break
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func splitDualCIDR(arg string) (target string, v4Bits, v6Bits int, err error) {
+	v4Bits, v6Bits = 32, 128
+	arg = strings.TrimPrefix(arg, ":")
+	parts := strings.SplitN(arg, "/", 2)
+	target = parts[0]
+	if len(parts) == 1 {
+		return target, v4Bits, v6Bits, nil
+	}
+
+	masks := strings.SplitN(parts[1], "/", 2)
+	if masks[0] != "" {
+		v4Bits, err = strconv.Atoi(masks[0])
+		if err != nil || v4Bits < 0 || v4Bits > 32 {
+			return "", 0, 0, fmt.Errorf("spf: malformed mask: %s", arg)
+		}
+	}
+	if len(masks) == 2 {
+		// a:example.org//64 - the second slash separates the IPv6 mask.
+		v6Bits, err = strconv.Atoi(strings.TrimPrefix(masks[1], "/"))
+		if err != nil || v6Bits < 0 || v6Bits > 128 {
+			return "", 0, 0, fmt.Errorf("spf: malformed mask: %s", arg)
+		}
+	}
+	return target, v4Bits, v6Bits, nil
+}
+
+func ipMatch(ip, addr net.IP, v4Bits, v6Bits int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		addr4 := addr.To4()
+		if addr4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(v4Bits, 32)
+		return ip4.Mask(mask).Equal(addr4.Mask(mask))
+	}
+	if addr.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(v6Bits, 128)
+	return ip.Mask(mask).Equal(addr.Mask(mask))
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+type macroCtx struct {
+	ip     net.IP
+	helo   string
+	sender string
+	domain string
+	now    time.Time
+}
+
+func (e *evaluator) macroCtx(domain string) macroCtx {
+	now := time.Now
+	if e.now != nil {
+		now = e.now
+	}
+	return macroCtx{
+		ip:     e.ip,
+		helo:   e.helo,
+		sender: e.sender,
+		domain: domain,
+		now:    now(),
+	}
+}
+
+func (m macroCtx) letter(l byte, exp bool) (string, error) {
+	local, senderDomain := m.sender, ""
+	if i := strings.LastIndexByte(m.sender, '@'); i != -1 {
+		local, senderDomain = m.sender[:i], m.sender[i+1:]
+	}
+	if local == "" {
+		local = "postmaster"
+	}
+
+	switch l {
+	case 's':
+		return local + "@" + senderDomain, nil
+	case 'l':
+		return local, nil
+	case 'o':
+		return senderDomain, nil
+	case 'd':
+		return m.domain, nil
+	case 'i':
+		if m.ip.To4() != nil {
+			return m.ip.To4().String(), nil
+		}
+		nibbles := make([]string, 0, 32)
+		for _, b := range m.ip.To16() {
+			nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+		}
+		return strings.Join(nibbles, "."), nil
+	case 'p':
+		// Validated domain name is not available.
+		return "unknown", nil
+	case 'v':
+		if m.ip.To4() != nil {
+			return "in-addr", nil
+		}
+		return "ip6", nil
+	case 'h':
+		return m.helo, nil
+	}
+
+	if !exp {
+		return "", fmt.Errorf("spf: macro letter %c is allowed only in explanation", l)
+	}
+	switch l {
+	case 'c':
+		return m.ip.String(), nil
+	case 'r':
+		return "unknown", nil
+	case 't':
+		return strconv.FormatInt(m.now.Unix(), 10), nil
+	}
+	return "", fmt.Errorf("spf: unknown macro letter: %c", l)
+}
+
+// expandMacros expands macros as defined in RFC 7208 Section 7. exp enables
+// letters that are allowed only in explanation strings.
+func expandMacros(s string, m macroCtx, exp bool) (string, error) {
+	res := strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			res.WriteByte(s[i])
+			continue
+		}
+		if i+1 == len(s) {
+			return "", errors.New("spf: truncated macro")
+		}
+		i++
+		switch s[i] {
+		case '%':
+			res.WriteByte('%')
+			continue
+		case '_':
+			res.WriteByte(' ')
+			continue
+		case '-':
+			res.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("spf: malformed macro: %%%c", s[i])
+		}
+
+		end := strings.IndexByte(s[i:], '}')
+		if end == -1 {
+			return "", errors.New("spf: unterminated macro")
+		}
+		macro := s[i+1 : i+end]
+		i += end
+		if macro == "" {
+			return "", errors.New("spf: empty macro")
+		}
+
+		letter := macro[0]
+		escape := letter >= 'A' && letter <= 'Z'
+		if escape {
+			letter += 'a' - 'A'
+		}
+		value, err := m.letter(letter, exp)
+		if err != nil {
+			return "", err
+		}
+
+		value, err = transformMacro(value, macro[1:])
+		if err != nil {
+			return "", err
+		}
+		if escape {
+			value = url.QueryEscape(value)
+		}
+		res.WriteString(value)
+	}
+	return res.String(), nil
+}
+
+// transformMacro applies transformers and delimiters to the macro value.
+func transformMacro(value, transformers string) (string, error) {
+	digits := 0
+	for len(transformers) != 0 && transformers[0] >= '0' && transformers[0] <= '9' {
+		digits = digits*10 + int(transformers[0]-'0')
+		transformers = transformers[1:]
+	}
+	reverse := false
+	if len(transformers) != 0 && (transformers[0] == 'r' || transformers[0] == 'R') {
+		reverse = true
+		transformers = transformers[1:]
+	}
+	delims := "."
+	if transformers != "" {
+		if strings.Trim(transformers, ".-+,/_=") != "" {
+			return "", fmt.Errorf("spf: malformed macro delimiters: %s", transformers)
+		}
+		delims = transformers
+	}
+	if digits == 0 && !reverse && transformers == "" {
+		return value, nil
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits != 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	return strings.Join(parts, "."), nil
+}
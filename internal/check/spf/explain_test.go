@@ -0,0 +1,205 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package spf
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestExpandMacros(t *testing.T) {
+	// Examples from RFC 7208 Section 7.4.
+	m := macroCtx{
+		ip:     net.ParseIP("192.0.2.3"),
+		helo:   "mx.example.org",
+		sender: "strong-bad@email.example.com",
+		domain: "email.example.com",
+	}
+	for macro, want := range map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{ir}.%{v}.%{l1r-}.lp.%{d}":        "3.2.0.192.in-addr.strong.lp.email.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"100%%%_%-":                         "100% %20",
+	} {
+		got, err := expandMacros(macro, m, false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", macro, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: want %q, got %q", macro, want, got)
+		}
+	}
+
+	m.ip = net.ParseIP("2001:db8::cb01")
+	got, err := expandMacros("%{ir}.%{v}._spf.%{d2}", m, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if _, err := expandMacros("%{c}", m, false); err == nil {
+		t.Error("explanation-only macro is accepted in domain-spec")
+	}
+	got, err = expandMacros("%{c} is not allowed", m, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2001:db8::cb01 is not allowed"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	for _, malformed := range []string{"%", "%{", "%{}", "%x", "%{d2q}"} {
+		if _, err := expandMacros(malformed, m, false); err == nil {
+			t.Errorf("%s: no error", malformed)
+		}
+	}
+}
+
+func TestCheck_Explanation(t *testing.T) {
+	c := &Check{
+		instName:       "test",
+		enforceEarly:   true,
+		useExplanation: true,
+		failAction:     modconfig.FailAction{Reject: true},
+		softfailAction: modconfig.FailAction{Quarantine: true},
+		log:            testutils.Logger(t, modName),
+		resolver: &mockdns.Resolver{
+			Zones: map[string]mockdns.Zone{
+				"example.org.": {
+					TXT: []string{"v=spf1 ip4:192.0.2.0/24 include:_spf.example.org -all exp=explain._spf.%{d}"},
+				},
+				"_spf.example.org.": {
+					TXT: []string{"v=spf1 exists:%{i}._allow.example.org ~all"},
+				},
+				"198.51.100.1._allow.example.org.": {
+					A: []string{"127.0.0.2"},
+				},
+				"explain._spf.example.org.": {
+					TXT: []string{"%{i} is not one of %{d}'s designated mail servers."},
+				},
+				"example.com.": {
+					TXT: []string{"v=spf1 redirect=_spf.example.com"},
+				},
+				"_spf.example.com.": {
+					TXT: []string{"v=spf1 a:%{l}.example.com ~all"},
+				},
+				"user.example.com.": {
+					A: []string{"203.0.113.1"},
+				},
+			},
+		},
+	}
+
+	test := func(ip, from string, reject, quarantine bool, msg string, misc map[string]interface{}) {
+		t.Helper()
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			OriginalFrom: from,
+			Facts:        module.NewFacts(),
+			Conn: &module.ConnState{
+				ConnectionState: smtp.ConnectionState{
+					Hostname:   "mx.example.net",
+					RemoteAddr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 25},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckConnection(context.Background())
+		if res.Reject != reject || res.Quarantine != quarantine {
+			t.Fatalf("%s %s: want reject=%v quarantine=%v, got %+v", ip, from, reject, quarantine, res)
+		}
+		if res.Reason == nil {
+			return
+		}
+
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(res.Reason, &smtpErr) {
+			t.Fatalf("%s %s: not an SMTPError: %v", ip, from, res.Reason)
+		}
+		if smtpErr.Message != msg {
+			t.Errorf("%s %s: want message %q, got %q", ip, from, msg, smtpErr.Message)
+		}
+		for k, v := range misc {
+			if smtpErr.Misc[k] != v {
+				t.Errorf("%s %s: want %s=%v, got %v", ip, from, k, v, smtpErr.Misc[k])
+			}
+		}
+	}
+
+	test("192.0.2.1", "user@example.org", false, false, "", nil)
+	test("198.51.100.1", "user@example.org", false, false, "", nil)
+	test("198.51.100.2", "user@example.org", true, false,
+		"SPF authentication failed: 198.51.100.2 is not one of example.org's designated mail servers.",
+		map[string]interface{}{
+			"spf_domain":    "example.org",
+			"spf_mechanism": "-all",
+		})
+	test("198.51.100.2", "user@example.com", false, true,
+		"SPF authentication soft-failed",
+		map[string]interface{}{
+			"spf_domain":    "_spf.example.com",
+			"spf_mechanism": "~all",
+		})
+	test("203.0.113.1", "user@example.com", false, false, "", nil)
+
+	c.useExplanation = false
+	test("198.51.100.2", "user@example.org", true, false, "SPF authentication failed",
+		map[string]interface{}{"spf_mechanism": "-all"})
+}
+
+func TestSanitizeExplanation(t *testing.T) {
+	if got := sanitizeExplanation("  bad\r\n\x00senderé "); got != "badsender" {
+		t.Errorf("unexpected result: %q", got)
+	}
+	long := make([]byte, 1000)
+	for i := range long {
+		long[i] = 'a'
+	}
+	if got := sanitizeExplanation(string(long)); len(got) != maxExplanationLen {
+		t.Errorf("not truncated: %d", len(got))
+	}
+}
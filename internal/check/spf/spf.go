@@ -46,8 +46,9 @@ import (
 const modName = "check.spf"
 
 type Check struct {
-	instName     string
-	enforceEarly bool
+	instName       string
+	enforceEarly   bool
+	useExplanation bool
 
 	noneAction     modconfig.FailAction
 	neutralAction  modconfig.FailAction
@@ -79,6 +80,7 @@ func (c *Check) InstanceName() string {
 func (c *Check) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &c.log.Debug)
 	cfg.Bool("enforce_early", true, false, &c.enforceEarly)
+	cfg.Bool("use_explanation", false, true, &c.useExplanation)
 	cfg.Custom("none_action", false, false,
 		func() (interface{}, error) {
 			return modconfig.FailAction{}, nil
@@ -122,6 +124,10 @@ type state struct {
 	spfFetch chan spfRes
 	log      log.Logger
 
+	// Set by CheckConnection, used to collect diagnostics.
+	ip       net.IP
+	mailFrom string
+
 	skip bool
 }
 
@@ -134,7 +140,7 @@ func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadat
 	}, nil
 }
 
-func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
+func (s *state) spfResult(ctx context.Context, res spf.Result, err error) module.CheckResult {
 	_, fromDomain, _ := address.Split(s.msgMeta.OriginalFrom)
 	spfAuth := &authres.SPFResult{
 		Value: authres.ResultNone,
@@ -148,6 +154,14 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		spfAuth.Reason = "no policy"
 	}
 
+	s.msgMeta.Facts.Set(module.FactSPFResult, string(res))
+
+	diag := s.diagnose(ctx, res)
+	if diag.Mechanism != "" {
+		s.log.DebugMsg("SPF result details", "result", res, "domain", diag.Domain,
+			"record", diag.Record, "mechanism", diag.Mechanism, "expanded", diag.Expanded)
+	}
+
 	switch res {
 	case spf.None:
 		spfAuth.Value = authres.ResultNone
@@ -170,6 +184,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 				Message:      "Neutral SPF result is not permitted",
 				CheckName:    modName,
 				Err:          err,
+				Misc:         diag.misc(),
 			},
 			AuthResult: []authres.Result{spfAuth},
 		})
@@ -178,13 +193,18 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 		return module.CheckResult{AuthResult: []authres.Result{spfAuth}}
 	case spf.Fail:
 		spfAuth.Value = authres.ResultFail
+		msg := "SPF authentication failed"
+		if diag.Explanation != "" {
+			msg += ": " + diag.Explanation
+		}
 		return s.c.failAction.Apply(module.CheckResult{
 			Reason: &exterrors.SMTPError{
 				Code:         550,
 				EnhancedCode: exterrors.EnhancedCode{5, 7, 23},
-				Message:      "SPF authentication failed",
+				Message:      msg,
 				CheckName:    modName,
 				Err:          err,
+				Misc:         diag.misc(),
 			},
 			AuthResult: []authres.Result{spfAuth},
 		})
@@ -197,6 +217,7 @@ func (s *state) spfResult(res spf.Result, err error) module.CheckResult {
 				Message:      "SPF authentication soft-failed",
 				CheckName:    modName,
 				Err:          err,
+				Misc:         diag.misc(),
 			},
 			AuthResult: []authres.Result{spfAuth},
 		})
@@ -323,12 +344,15 @@ func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
 		}
 	}
 
+	s.ip = ip.IP
+	s.mailFrom = mailFrom
+
 	if s.c.enforceEarly {
 		res, err := spf.CheckHostWithSender(ip.IP,
 			dns.FQDN(s.msgMeta.Conn.Hostname), mailFrom,
 			spf.WithContext(ctx), spf.WithResolver(s.c.resolver))
 		s.log.Debugf("result: %s (%v)", res, err)
-		return s.spfResult(res, err)
+		return s.spfResult(ctx, res, err)
 	}
 
 	// We start evaluation in parallel to other message processing,
@@ -392,13 +416,13 @@ func (s *state) CheckBody(ctx context.Context, header textproto.Header, body buf
 			s.log.DebugMsg("deferring action due to a DMARC policy", "result", res.res, "err", res.err)
 		}
 
-		checkRes := s.spfResult(res.res, res.err)
+		checkRes := s.spfResult(ctx, res.res, res.err)
 		checkRes.Quarantine = false
 		checkRes.Reject = false
 		return checkRes
 	}
 
-	return s.spfResult(res.res, res.err)
+	return s.spfResult(ctx, res.res, res.err)
 }
 
 func (s *state) Close() error {
@@ -21,13 +21,17 @@ package check
 import (
 	"context"
 	"fmt"
+	"net"
 	"runtime/trace"
+	"strings"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/future"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/target"
@@ -44,6 +48,11 @@ type (
 
 		MsgMeta *module.MsgMetadata
 
+		// Set if only DNS answers authenticated using DNSSEC should be
+		// trusted. Checks doing DNS lookups should treat unauthenticated
+		// answers the same way as missing records.
+		Authenticated bool
+
 		// Logger that should be used by the check for logging, note that it is
 		// already wrapped to append Msg ID to all messages so check code
 		// should not do the same.
@@ -55,6 +64,44 @@ type (
 	FuncBodyCheck   func(checkContext StatelessCheckContext, header textproto.Header, body buffer.Buffer) module.CheckResult
 )
 
+// ConnStage specifies when the connection check is executed.
+type ConnStage int
+
+const (
+	// StageMessage runs the check for each message together with other
+	// checks, fail_action is applied to the result.
+	StageMessage ConnStage = iota
+	// StageEHLO runs the check when the client sends EHLO/HELO. The command
+	// is rejected if the check fails.
+	StageEHLO
+	// StageConnect runs the check after the connection is accepted, before
+	// the greeting is sent. The connection is closed if the check fails.
+	// Only the client address is known at this point.
+	StageConnect
+)
+
+var connStageNames = []string{"message", "ehlo", "connect"}
+
+func (s ConnStage) String() string {
+	return connStageNames[s]
+}
+
+// ConnStageDirective returns the config.Map.Custom callback for the 'stage'
+// directive that accepts stages up to the earliest one.
+func ConnStageDirective(earliest ConnStage) func(*config.Map, config.Node) (interface{}, error) {
+	return func(_ *config.Map, node config.Node) (interface{}, error) {
+		if len(node.Args) != 1 {
+			return nil, config.NodeErr(node, "expected exactly one argument")
+		}
+		for i, name := range connStageNames[:earliest+1] {
+			if strings.EqualFold(node.Args[0], name) {
+				return ConnStage(i), nil
+			}
+		}
+		return nil, config.NodeErr(node, "stage should be one of: %s", strings.Join(connStageNames[:earliest+1], ", "))
+	}
+}
+
 type statelessCheck struct {
 	modName  string
 	instName string
@@ -66,6 +113,13 @@ type statelessCheck struct {
 	// The actual fail action that should be applied.
 	failAction modconfig.FailAction
 
+	authenticated bool
+
+	// earliestStage is the earliest stage the connection check supports.
+	// stage is the configured one.
+	earliestStage ConnStage
+	stage         ConnStage
+
 	connCheck   FuncConnCheck
 	senderCheck FuncSenderCheck
 	rcptCheck   FuncRcptCheck
@@ -82,16 +136,17 @@ func (s *statelessCheckState) String() string {
 }
 
 func (s *statelessCheckState) CheckConnection(ctx context.Context) module.CheckResult {
-	if s.c.connCheck == nil {
+	if s.c.connCheck == nil || s.c.stage != StageMessage {
 		return module.CheckResult{}
 	}
 	defer trace.StartRegion(ctx, s.c.modName+"/CheckConnection").End()
 
 	originalRes := s.c.connCheck(StatelessCheckContext{
-		Context:  ctx,
-		Resolver: s.c.resolver,
-		MsgMeta:  s.msgMeta,
-		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
+		Context:       ctx,
+		Resolver:      s.c.resolver,
+		MsgMeta:       s.msgMeta,
+		Authenticated: s.c.authenticated,
+		Logger:        target.DeliveryLogger(s.c.logger, s.msgMeta),
 	})
 	return s.c.failAction.Apply(originalRes)
 }
@@ -103,10 +158,11 @@ func (s *statelessCheckState) CheckSender(ctx context.Context, mailFrom string)
 	defer trace.StartRegion(ctx, s.c.modName+"/CheckSender").End()
 
 	originalRes := s.c.senderCheck(StatelessCheckContext{
-		Context:  ctx,
-		Resolver: s.c.resolver,
-		MsgMeta:  s.msgMeta,
-		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
+		Context:       ctx,
+		Resolver:      s.c.resolver,
+		MsgMeta:       s.msgMeta,
+		Authenticated: s.c.authenticated,
+		Logger:        target.DeliveryLogger(s.c.logger, s.msgMeta),
 	}, mailFrom)
 	return s.c.failAction.Apply(originalRes)
 }
@@ -118,10 +174,11 @@ func (s *statelessCheckState) CheckRcpt(ctx context.Context, rcptTo string) modu
 	defer trace.StartRegion(ctx, s.c.modName+"/CheckRcpt").End()
 
 	originalRes := s.c.rcptCheck(StatelessCheckContext{
-		Context:  ctx,
-		Resolver: s.c.resolver,
-		MsgMeta:  s.msgMeta,
-		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
+		Context:       ctx,
+		Resolver:      s.c.resolver,
+		MsgMeta:       s.msgMeta,
+		Authenticated: s.c.authenticated,
+		Logger:        target.DeliveryLogger(s.c.logger, s.msgMeta),
 	}, rcptTo)
 	return s.c.failAction.Apply(originalRes)
 }
@@ -133,10 +190,11 @@ func (s *statelessCheckState) CheckBody(ctx context.Context, header textproto.He
 	defer trace.StartRegion(ctx, s.c.modName+"/CheckBody").End()
 
 	originalRes := s.c.bodyCheck(StatelessCheckContext{
-		Context:  ctx,
-		Resolver: s.c.resolver,
-		MsgMeta:  s.msgMeta,
-		Logger:   target.DeliveryLogger(s.c.logger, s.msgMeta),
+		Context:       ctx,
+		Resolver:      s.c.resolver,
+		MsgMeta:       s.msgMeta,
+		Authenticated: s.c.authenticated,
+		Logger:        target.DeliveryLogger(s.c.logger, s.msgMeta),
 	}, header, body)
 	return s.c.failAction.Apply(originalRes)
 }
@@ -152,12 +210,89 @@ func (c *statelessCheck) CheckStateForMsg(ctx context.Context, msgMeta *module.M
 	}, nil
 }
 
+// runEarly executes the connection check outside of the message context.
+// Results of early checks are not subject to fail_action, any failure is
+// reported as an error.
+func (c *statelessCheck) runEarly(ctx context.Context, state smtp.ConnectionState) error {
+	rdnsCtx, cancelRDNS := context.WithCancel(ctx)
+	defer cancelRDNS()
+	connState := &module.ConnState{
+		Proto:           "ESMTP",
+		ConnectionState: state,
+		RDNSName:        future.New(),
+	}
+	go c.fetchRDNSName(rdnsCtx, connState)
+
+	msgMeta := &module.MsgMetadata{Conn: connState}
+	res := c.connCheck(StatelessCheckContext{
+		Context:       ctx,
+		Resolver:      c.resolver,
+		MsgMeta:       msgMeta,
+		Authenticated: c.authenticated,
+		Logger:        c.logger,
+	})
+	if res.Reason == nil {
+		return nil
+	}
+
+	c.logger.Error("connection rejected", res.Reason, "src_ip", state.RemoteAddr, "stage", c.stage.String())
+	return res.Reason
+}
+
+func (c *statelessCheck) fetchRDNSName(ctx context.Context, connState *module.ConnState) {
+	tcpAddr, ok := connState.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		connState.RDNSName.Set(nil, nil)
+		return
+	}
+
+	ad, name, err := dns.AuthLookupAddr(ctx, c.resolver, tcpAddr.IP)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			connState.RDNSName.Set(nil, nil)
+			return
+		}
+		connState.RDNSName.Set(nil, err)
+		return
+	}
+
+	connState.RDNSAuthenticated = ad
+	connState.RDNSName.Set(name, nil)
+}
+
+// CheckConnection implements module.EarlyCheck.
+func (c *statelessCheck) CheckConnection(ctx context.Context, state *smtp.ConnectionState) error {
+	if c.connCheck == nil || c.stage != StageEHLO {
+		return nil
+	}
+	defer trace.StartRegion(ctx, c.modName+"/CheckConnection (Early)").End()
+
+	return c.runEarly(ctx, *state)
+}
+
+// CheckConnect implements module.ConnectCheck.
+func (c *statelessCheck) CheckConnect(ctx context.Context, remoteAddr net.Addr) error {
+	if c.connCheck == nil || c.stage != StageConnect {
+		return nil
+	}
+	defer trace.StartRegion(ctx, c.modName+"/CheckConnect").End()
+
+	return c.runEarly(ctx, smtp.ConnectionState{RemoteAddr: remoteAddr})
+}
+
 func (c *statelessCheck) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &c.logger.Debug)
+	cfg.Bool("authenticated", false, c.authenticated, &c.authenticated)
 	cfg.Custom("fail_action", false, false,
 		func() (interface{}, error) {
 			return c.defaultFailAction, nil
 		}, modconfig.FailActionDirective, &c.failAction)
+	if c.earliestStage != StageMessage {
+		cfg.Custom("stage", false, false,
+			func() (interface{}, error) {
+				return StageMessage, nil
+			}, ConnStageDirective(c.earliestStage), &c.stage)
+	}
 	_, err := cfg.Process()
 	return err
 }
@@ -180,10 +315,32 @@ func (c *statelessCheck) InstanceName() string {
 // StatelessCheck supports different action types based on the user configuration, but the particular check
 // code doesn't need to know about it. It should assume that it is always "Reject" and hence it should
 // populate Reason field of the result object with the relevant error description.
+//
+// The only inline argument accepted by created modules is "authenticated",
+// it sets StatelessCheckContext.Authenticated.
 func RegisterStatelessCheck(name string, defaultFailAction modconfig.FailAction, connCheck FuncConnCheck, senderCheck FuncSenderCheck, rcptCheck FuncRcptCheck, bodyCheck FuncBodyCheck) {
+	registerStatelessCheck(name, defaultFailAction, StageMessage, connCheck, senderCheck, rcptCheck, bodyCheck)
+}
+
+// RegisterConnCheck is a variant of RegisterStatelessCheck for checks that
+// inspect only the connection.
+//
+// Created modules accept the 'stage' directive that allows to execute the
+// check before any envelope is accepted, see ConnStage for details.
+// earliestStage is the earliest stage the check can be executed at, e.g.
+// checks that use the EHLO hostname should pass StageEHLO.
+func RegisterConnCheck(name string, defaultFailAction modconfig.FailAction, earliestStage ConnStage, connCheck FuncConnCheck) {
+	registerStatelessCheck(name, defaultFailAction, earliestStage, connCheck, nil, nil, nil)
+}
+
+func registerStatelessCheck(name string, defaultFailAction modconfig.FailAction, earliestStage ConnStage, connCheck FuncConnCheck, senderCheck FuncSenderCheck, rcptCheck FuncRcptCheck, bodyCheck FuncBodyCheck) {
 	module.Register(name, func(modName, instName string, aliases, inlineArgs []string) (module.Module, error) {
-		if len(inlineArgs) != 0 {
-			return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+		authenticated := false
+		switch {
+		case len(inlineArgs) == 1 && inlineArgs[0] == "authenticated":
+			authenticated = true
+		case len(inlineArgs) != 0:
+			return nil, fmt.Errorf("%s: unexpected inline arguments: %v", modName, inlineArgs)
 		}
 		return &statelessCheck{
 			modName:  modName,
@@ -192,6 +349,8 @@ func RegisterStatelessCheck(name string, defaultFailAction modconfig.FailAction,
 			logger:   log.Logger{Name: modName},
 
 			defaultFailAction: defaultFailAction,
+			authenticated:     authenticated,
+			earliestStage:     earliestStage,
 
 			connCheck:   connCheck,
 			senderCheck: senderCheck,
@@ -0,0 +1,175 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tls_fingerprint implements the check that applies actions to
+// clients using listed TLS stacks.
+//
+// JA3 and JA4 fingerprints are captured by the SMTP endpoint (see the
+// tls_fingerprints directive) and are looked up in the table that maps them
+// to check actions.
+package tls_fingerprint
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "check.tls_fingerprint"
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	table    module.Table
+	skipAuth bool
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &c.table)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuth)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	defer trace.StartRegion(ctx, "tls_fingerprint/CheckConnection").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.skipAuth && s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+
+	ja3, _ := s.msgMeta.Facts.String(module.FactTLSJA3)
+	ja4, _ := s.msgMeta.Facts.String(module.FactTLSJA4)
+	if ja3 == "" && ja4 == "" {
+		s.log.DebugMsg("no TLS fingerprint, skipping")
+		return module.CheckResult{}
+	}
+
+	var key, val string
+	for _, k := range []string{ja4, ja3} {
+		if k == "" {
+			continue
+		}
+		v, ok, err := s.c.table.Lookup(ctx, k)
+		if err != nil {
+			s.log.Error("table lookup failed", err, "key", k)
+			return module.CheckResult{}
+		}
+		if ok {
+			key, val = k, v
+			break
+		}
+	}
+	if key == "" {
+		s.log.DebugMsg("not listed", "ja3", ja3, "ja4", ja4)
+		return module.CheckResult{}
+	}
+
+	actionArgs := strings.Fields(val)
+	if len(actionArgs) == 0 {
+		actionArgs = []string{"reject"}
+	}
+	action, err := modconfig.ParseActionDirective(actionArgs)
+	if err != nil {
+		s.log.Error("malformed action in table", err, "key", key, "value", val)
+		return module.CheckResult{}
+	}
+
+	return action.Apply(module.CheckResult{
+		Reason: &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Your TLS client is not accepted",
+			CheckName:    modName,
+			Misc: map[string]interface{}{
+				"ja3":   ja3,
+				"ja4":   ja4,
+				"match": key,
+			},
+		},
+	})
+}
+
+func (s *state) CheckSender(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
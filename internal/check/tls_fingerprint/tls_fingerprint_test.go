@@ -0,0 +1,67 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls_fingerprint
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestCheck(t *testing.T) {
+	c := &Check{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		table: testutils.Table{M: map[string]string{
+			"e7d705a3286e19ea42f587b344ee6865":     "",
+			"t13d1516h2_8daaf6152771_e5627efa2ab1": "score 5",
+			"t12d1207h1_c7886603b240_7af1ed941c26": "invalid",
+		}},
+		skipAuth: true,
+	}
+
+	test := func(ja3, ja4, authUser string, reject bool, score float64) {
+		t.Helper()
+		facts := module.NewFacts()
+		if ja3 != "" {
+			facts.Set(module.FactTLSJA3, ja3)
+			facts.Set(module.FactTLSJA4, ja4)
+		}
+		s, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Facts: facts,
+			Conn:  &module.ConnState{AuthUser: authUser},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := s.CheckConnection(context.Background())
+		if res.Reject != reject || res.Score != score {
+			t.Errorf("%s/%s: want reject=%v score=%v, got %+v", ja3, ja4, reject, score, res)
+		}
+	}
+
+	test("e7d705a3286e19ea42f587b344ee6865", "t13d1516h2_aaaaaaaaaaaa_bbbbbbbbbbbb", "", true, 0)
+	test("e7d705a3286e19ea42f587b344ee6865", "t13d1516h2_aaaaaaaaaaaa_bbbbbbbbbbbb", "foxcpp", false, 0)
+	test("e7d705a3286e19ea42f587b344ee6865", "t13d1516h2_8daaf6152771_e5627efa2ab1", "", false, 5)
+	test("00000000000000000000000000000000", "t12d1207h1_c7886603b240_7af1ed941c26", "", false, 0)
+	test("00000000000000000000000000000000", "t13d1516h2_aaaaaaaaaaaa_bbbbbbbbbbbb", "", false, 0)
+	test("", "", "", false, 0)
+}
@@ -0,0 +1,344 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package verify_rcpt implements the check that verifies recipient
+// addresses by probing the downstream SMTP or LMTP server.
+//
+// It is intended for relay setups where maddy accepts messages on behalf of
+// another server and should not accept messages for non-existent users to
+// avoid generating backscatter.
+package verify_rcpt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "check.verify_rcpt"
+
+// maxCacheSize is the maximum amount of cache entries. Once it is reached,
+// expired entries are removed and, if that is not enough, the entry that
+// expires first is evicted.
+const maxCacheSize = 10000
+
+type cacheEntry struct {
+	// nil if the address was accepted by the downstream server.
+	err     *exterrors.SMTPError
+	expires time.Time
+}
+
+type Check struct {
+	instName   string
+	targetsArg []string
+	log        log.Logger
+
+	hostname         string
+	lmtp             bool
+	attemptStartTLS  bool
+	tlsConfig        tls.Config
+	endpoints        []config.Endpoint
+	probeSender      string
+	timeout          time.Duration
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	failAction       modconfig.FailAction
+	tempFailAction   modconfig.FailAction
+
+	dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	cacheLock sync.Mutex
+	cache     map[string]cacheEntry
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Check{
+		instName:   instName,
+		targetsArg: inlineArgs,
+		log:        log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		dialer:     (&net.Dialer{}).DialContext,
+		cache:      make(map[string]cacheEntry),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var targetsArg []string
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, true, "", &c.hostname)
+	cfg.StringList("targets", false, false, nil, &targetsArg)
+	cfg.Bool("lmtp", false, false, &c.lmtp)
+	cfg.Bool("attempt_starttls", false, false, &c.attemptStartTLS)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &c.tlsConfig)
+	cfg.String("probe_sender", false, false, "", &c.probeSender)
+	cfg.Duration("timeout", false, false, 30*time.Second, &c.timeout)
+	cfg.Duration("cache_ttl", false, false, 1*time.Hour, &c.cacheTTL)
+	cfg.Duration("negative_cache_ttl", false, false, 10*time.Minute, &c.negativeCacheTTL)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("temperr_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.tempFailAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	c.hostname, err = idna.ToASCII(c.hostname)
+	if err != nil {
+		return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", modName, err)
+	}
+
+	c.targetsArg = append(c.targetsArg, targetsArg...)
+	for _, tgt := range c.targetsArg {
+		endp, err := config.ParseEndpoint(tgt)
+		if err != nil {
+			return err
+		}
+
+		c.endpoints = append(c.endpoints, endp)
+	}
+	if len(c.endpoints) == 0 {
+		return fmt.Errorf("%s: at least one target endpoint is required", modName)
+	}
+
+	return nil
+}
+
+func (c *Check) cacheGet(addr string) (cacheEntry, bool) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	entry, ok := c.cache[addr]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.cache, addr)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *Check) cachePut(addr string, err *exterrors.SMTPError) {
+	ttl := c.cacheTTL
+	if err != nil {
+		ttl = c.negativeCacheTTL
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	now := time.Now()
+	if _, ok := c.cache[addr]; !ok && len(c.cache) >= maxCacheSize {
+		var (
+			oldestKey     string
+			oldestExpires time.Time
+		)
+		for k, entry := range c.cache {
+			if now.After(entry.expires) {
+				delete(c.cache, k)
+				continue
+			}
+			if oldestKey == "" || entry.expires.Before(oldestExpires) {
+				oldestKey, oldestExpires = k, entry.expires
+			}
+		}
+		if len(c.cache) >= maxCacheSize {
+			delete(c.cache, oldestKey)
+		}
+	}
+
+	c.cache[addr] = cacheEntry{err: err, expires: now.Add(ttl)}
+}
+
+func (c *Check) connect(ctx context.Context) (*smtpconn.C, error) {
+	conn := smtpconn.New()
+	conn.Dialer = c.dialer
+	conn.Hostname = c.hostname
+	conn.Log = c.log
+	conn.AddrInSMTPMsg = false
+	conn.ConnectTimeout = c.timeout
+	conn.CommandTimeout = c.timeout
+
+	var lastErr error
+	for _, endp := range c.endpoints {
+		var err error
+		if c.lmtp {
+			_, err = conn.ConnectLMTP(ctx, endp, c.attemptStartTLS, &c.tlsConfig)
+		} else {
+			_, err = conn.Connect(ctx, endp, c.attemptStartTLS, &c.tlsConfig)
+		}
+		if err != nil {
+			if len(c.endpoints) != 1 {
+				c.log.Error("connect error", err, "downstream_server", endp.String())
+			}
+			lastErr = err
+			continue
+		}
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// verify probes the downstream server for the address.
+//
+// Returned error is nil if the address is accepted. For permanent failures
+// the returned SMTPError has 5xx code.
+func (c *Check) verify(ctx context.Context, addr string) *exterrors.SMTPError {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return c.verifyFailed(addr, err)
+	}
+	defer conn.Close()
+
+	// Rejection of the probe sender tells nothing about the recipient, so
+	// it is never considered a permanent failure.
+	if err := conn.Mail(ctx, c.probeSender, smtp.MailOptions{}); err != nil {
+		return c.verifyFailed(addr, err)
+	}
+
+	err = conn.Rcpt(ctx, addr)
+	if err == nil {
+		return nil
+	}
+
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) && smtpErr.Code/100 == 5 {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "No such user here",
+			CheckName:    "verify_rcpt",
+			Err:          err,
+		}
+	}
+	return c.verifyFailed(addr, err)
+}
+
+func (c *Check) verifyFailed(addr string, err error) *exterrors.SMTPError {
+	c.log.Error("recipient verification failed", err, "rcpt", addr)
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 4, 0},
+		Message:      "Unable to verify the recipient address, try again later",
+		CheckName:    "verify_rcpt",
+		Err:          err,
+	}
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	defer trace.StartRegion(ctx, "verify_rcpt/CheckRcpt").End()
+
+	key, err := address.ForLookup(rcptTo)
+	if err != nil {
+		key = rcptTo
+	}
+
+	entry, ok := s.c.cacheGet(key)
+	if ok {
+		s.log.DebugMsg("using cached result", "rcpt", rcptTo, "verified", entry.err == nil)
+	} else {
+		entry.err = s.c.verify(ctx, rcptTo)
+		// Temporary failures are not cached to let the next attempt
+		// retry the verification.
+		if entry.err == nil || entry.err.Code/100 == 5 {
+			s.c.cachePut(key, entry.err)
+		}
+	}
+
+	if entry.err == nil {
+		s.log.DebugMsg("recipient verified", "rcpt", rcptTo)
+		return module.CheckResult{}
+	}
+	if entry.err.Code/100 == 5 {
+		return s.c.failAction.Apply(module.CheckResult{Reason: entry.err})
+	}
+	return s.c.tempFailAction.Apply(module.CheckResult{Reason: entry.err})
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
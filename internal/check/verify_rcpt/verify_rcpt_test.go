@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package verify_rcpt
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+var testPort string
+
+func TestVerifyRcpt(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	be.RcptErr = map[string]error{
+		"nonexistent@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+		"busy@example.invalid": &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Try again later",
+		},
+	}
+
+	c := &Check{
+		log:      testutils.Logger(t, modName),
+		hostname: "mx.example.org",
+		endpoints: []config.Endpoint{
+			{Scheme: "tcp", Host: "127.0.0.1", Port: testPort},
+		},
+		timeout:          5 * time.Second,
+		cacheTTL:         time.Hour,
+		negativeCacheTTL: time.Hour,
+		failAction:       modconfig.FailAction{Reject: true},
+		tempFailAction:   modconfig.FailAction{Quarantine: true},
+		dialer:           (&net.Dialer{}).DialContext,
+		cache:            make(map[string]cacheEntry),
+	}
+
+	check := func(rcptTo string) module.CheckResult {
+		t.Helper()
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.CheckRcpt(context.Background(), rcptTo)
+	}
+
+	if res := check("test@example.invalid"); res.Reason != nil {
+		t.Errorf("valid recipient rejected: %v", res.Reason)
+	}
+	res := check("nonexistent@example.invalid")
+	if !res.Reject {
+		t.Errorf("non-existent recipient not rejected: %+v", res)
+	}
+	if code := res.Reason.(*exterrors.SMTPError).Code; code != 550 {
+		t.Errorf("wrong rejection code: %v", code)
+	}
+	if res := check("busy@example.invalid"); !res.Quarantine || res.Reject {
+		t.Errorf("temporary failure not handled using temperr_action: %+v", res)
+	}
+
+	// Definite results are cached, temporary failures are not.
+	sessions := be.SessionCounter
+	check("test@example.invalid")
+	check("NONEXISTENT@example.invalid")
+	if be.SessionCounter != sessions {
+		t.Errorf("cached results are not used")
+	}
+	check("busy@example.invalid")
+	if be.SessionCounter != sessions+1 {
+		t.Errorf("temporary failure was cached")
+	}
+}
+
+func TestVerifyRcpt_SenderRejected(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	be.MailErr = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender rejected",
+	}
+
+	c := &Check{
+		log:      testutils.Logger(t, modName),
+		hostname: "mx.example.org",
+		endpoints: []config.Endpoint{
+			{Scheme: "tcp", Host: "127.0.0.1", Port: testPort},
+		},
+		timeout:          5 * time.Second,
+		cacheTTL:         time.Hour,
+		negativeCacheTTL: time.Hour,
+		failAction:       modconfig.FailAction{Reject: true},
+		tempFailAction:   modconfig.FailAction{Quarantine: true},
+		dialer:           (&net.Dialer{}).DialContext,
+		cache:            make(map[string]cacheEntry),
+	}
+
+	check := func() module.CheckResult {
+		t.Helper()
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.CheckRcpt(context.Background(), "test@example.invalid")
+	}
+
+	// 5xx reply to MAIL FROM is not a reason to consider the recipient
+	// non-existent.
+	res := check()
+	if res.Reject || !res.Quarantine {
+		t.Errorf("rejected probe sender not handled using temperr_action: %+v", res)
+	}
+	if code := res.Reason.(*exterrors.SMTPError).Code; code != 451 {
+		t.Errorf("wrong error code: %v", code)
+	}
+
+	sessions := be.SessionCounter
+	check()
+	if be.SessionCounter != sessions+1 {
+		t.Errorf("rejected probe sender result was cached")
+	}
+}
+
+func TestVerifyRcpt_CacheEviction(t *testing.T) {
+	c := &Check{
+		cacheTTL: time.Hour,
+		cache:    make(map[string]cacheEntry),
+	}
+
+	for i := 0; i < maxCacheSize; i++ {
+		c.cachePut(strconv.Itoa(i)+"@example.invalid", nil)
+	}
+	c.cache["0@example.invalid"] = cacheEntry{expires: time.Now().Add(time.Minute)}
+	c.cachePut("new@example.invalid", nil)
+
+	if len(c.cache) != maxCacheSize {
+		t.Errorf("cache size is not limited: %d", len(c.cache))
+	}
+	if _, ok := c.cacheGet("new@example.invalid"); !ok {
+		t.Errorf("new entry is not cached")
+	}
+	if _, ok := c.cacheGet("0@example.invalid"); ok {
+		t.Errorf("oldest entry is not evicted")
+	}
+}
+
+func TestVerifyRcpt_Unreachable(t *testing.T) {
+	c := &Check{
+		log:      testutils.Logger(t, modName),
+		hostname: "mx.example.org",
+		endpoints: []config.Endpoint{
+			{Scheme: "tcp", Host: "127.0.0.1", Port: testPort},
+		},
+		timeout:        5 * time.Second,
+		cacheTTL:       time.Hour,
+		failAction:     modconfig.FailAction{Reject: true},
+		tempFailAction: modconfig.FailAction{},
+		dialer:         (&net.Dialer{}).DialContext,
+		cache:          make(map[string]cacheEntry),
+	}
+
+	st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := st.CheckRcpt(context.Background(), "test@example.invalid"); res.Reject || res.Quarantine {
+		t.Errorf("unreachable downstream should not cause rejection by default: %+v", res)
+	}
+}
+
+func TestMain(m *testing.M) {
+	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
+	flag.Parse()
+
+	if *remoteSmtpPort == "random" {
+		rand.Seed(time.Now().UnixNano())
+		*remoteSmtpPort = strconv.Itoa(rand.Intn(65536-10000) + 10000)
+	}
+
+	testPort = *remoteSmtpPort
+	os.Exit(m.Run())
+}
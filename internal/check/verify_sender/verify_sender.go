@@ -0,0 +1,382 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package verify_sender implements the SMTP callout check.
+//
+// The check connects to the MX of the MAIL FROM domain and verifies that
+// the return path is deliverable by issuing RCPT TO for it using the null
+// reverse-path. Results are cached to avoid hammering remote servers.
+package verify_sender
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/target"
+	"golang.org/x/net/idna"
+)
+
+const modName = "check.verify_sender"
+
+// Overridden in tests.
+var smtpPort = "25"
+
+// maxCacheSize is the maximum amount of cache entries. Once it is reached,
+// expired entries are removed and, if that is not enough, the oldest entry
+// is evicted.
+const maxCacheSize = 10000
+
+type cacheEntry struct {
+	// nil if the address was verified successfully.
+	err     *exterrors.SMTPError
+	expires time.Time
+}
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	hostname       string
+	timeout        time.Duration
+	maxMXs         int
+	cacheTTL       time.Duration
+	skipAuth       bool
+	failAction     modconfig.FailAction
+	tempFailAction modconfig.FailAction
+
+	resolver dns.Resolver
+	dialer   func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	cacheLock sync.Mutex
+	cache     map[string]cacheEntry
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver: dns.DefaultResolver(),
+		dialer:   (&net.Dialer{}).DialContext,
+		cache:    make(map[string]cacheEntry),
+	}, nil
+}
+
+func (c *Check) Name() string {
+	return modName
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.String("hostname", true, true, "", &c.hostname)
+	cfg.Duration("timeout", false, false, 30*time.Second, &c.timeout)
+	cfg.Int("max_mx", false, false, 2, &c.maxMXs)
+	cfg.Duration("cache_ttl", false, false, 2*time.Hour, &c.cacheTTL)
+	cfg.Bool("skip_authenticated", false, true, &c.skipAuth)
+	cfg.Custom("fail_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Quarantine: true}, nil
+		}, modconfig.FailActionDirective, &c.failAction)
+	cfg.Custom("temperr_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.tempFailAction)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	c.hostname, err = idna.ToASCII(c.hostname)
+	if err != nil {
+		return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", modName, err)
+	}
+	if c.maxMXs <= 0 {
+		return fmt.Errorf("%s: max_mx should be positive", modName)
+	}
+
+	return nil
+}
+
+func (c *Check) cacheGet(addr string) (cacheEntry, bool) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	entry, ok := c.cache[addr]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.cache, addr)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (c *Check) cachePut(addr string, err *exterrors.SMTPError) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+
+	now := time.Now()
+	if _, ok := c.cache[addr]; !ok && len(c.cache) >= maxCacheSize {
+		var (
+			oldestKey     string
+			oldestExpires time.Time
+		)
+		for k, entry := range c.cache {
+			if now.After(entry.expires) {
+				delete(c.cache, k)
+				continue
+			}
+			if oldestKey == "" || entry.expires.Before(oldestExpires) {
+				oldestKey, oldestExpires = k, entry.expires
+			}
+		}
+		if len(c.cache) >= maxCacheSize {
+			delete(c.cache, oldestKey)
+		}
+	}
+
+	c.cache[addr] = cacheEntry{err: err, expires: now.Add(c.cacheTTL)}
+}
+
+func (c *Check) lookupMX(ctx context.Context, domain string) ([]*net.MX, error) {
+	records, err := c.resolver.LookupMX(ctx, dns.FQDN(domain))
+	if err != nil && !dns.IsNotFound(err) {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		// Implicit MX, see RFC 5321 Section 5.1.
+		return []*net.MX{{Host: domain, Pref: 0}}, nil
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+	return records, nil
+}
+
+// probe connects to the MX and checks whether the address is accepted as a
+// recipient. rcpt is true if the returned error is the reply to the RCPT TO
+// command, only such errors tell anything about the address.
+func (c *Check) probe(ctx context.Context, mx, addr string) (rcpt bool, err error) {
+	conn := smtpconn.New()
+	conn.Dialer = c.dialer
+	conn.Hostname = c.hostname
+	conn.Log = c.log
+	conn.ConnectTimeout = c.timeout
+	conn.CommandTimeout = c.timeout
+
+	endp := config.Endpoint{
+		Scheme: "tcp",
+		Host:   strings.TrimSuffix(mx, "."),
+		Port:   smtpPort,
+	}
+	if _, err := conn.Connect(ctx, endp, false, nil); err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if err := conn.Mail(ctx, "", smtp.MailOptions{}); err != nil {
+		return false, err
+	}
+	return true, conn.Rcpt(ctx, addr)
+}
+
+// verify runs the callout for the address.
+//
+// Returned error is nil if the address is deliverable. For permanent failures
+// the returned SMTPError has 5xx code.
+func (c *Check) verify(ctx context.Context, addr, domain string) *exterrors.SMTPError {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	mxs, err := c.lookupMX(ctx, domain)
+	if err != nil {
+		reason, misc := exterrors.UnwrapDNSErr(err)
+		return &exterrors.SMTPError{
+			Code:         exterrors.SMTPCode(err, 451, 550),
+			EnhancedCode: exterrors.SMTPEnchCode(err, exterrors.EnhancedCode{0, 4, 4}),
+			Message:      "DNS error during sender verification",
+			CheckName:    "verify_sender",
+			Err:          err,
+			Reason:       reason,
+			Misc:         misc,
+		}
+	}
+
+	var lastErr error
+	for i, mx := range mxs {
+		if i == c.maxMXs {
+			break
+		}
+		if mx.Host == "." {
+			return &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 8},
+				Message:      "Sender domain does not accept email (null MX)",
+				CheckName:    "verify_sender",
+			}
+		}
+
+		rcpt, err := c.probe(ctx, mx.Host, addr)
+		if err == nil {
+			return nil
+		}
+
+		// Some servers reject the null reverse-path, this is not a reason
+		// to consider the sender address undeliverable.
+		var smtpErr *exterrors.SMTPError
+		if rcpt && errors.As(err, &smtpErr) && smtpErr.Code/100 == 5 {
+			return &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 8},
+				Message:      "Sender address rejected by its domain MX",
+				CheckName:    "verify_sender",
+				Err:          err,
+				Misc: map[string]interface{}{
+					"remote_server": mx.Host,
+				},
+			}
+		}
+
+		c.log.Error("callout failed", err, "remote_server", mx.Host, "domain", domain)
+		lastErr = err
+	}
+
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 4, 0},
+		Message:      "Unable to verify the sender address, try again later",
+		CheckName:    "verify_sender",
+		Err:          lastErr,
+	}
+}
+
+type state struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &state{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func (s *state) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	defer trace.StartRegion(ctx, "verify_sender/CheckSender").End()
+
+	if s.msgMeta.Conn == nil {
+		s.log.DebugMsg("locally generated message, skipping")
+		return module.CheckResult{}
+	}
+	if s.c.skipAuth && s.msgMeta.Conn.AuthUser != "" {
+		s.log.DebugMsg("authenticated client, skipping")
+		return module.CheckResult{}
+	}
+	if mailFrom == "" {
+		// Permit null reverse-path for bounces.
+		return module.CheckResult{}
+	}
+
+	_, domain, err := address.Split(mailFrom)
+	if err != nil || domain == "" {
+		return s.c.failAction.Apply(module.CheckResult{
+			Reason: &exterrors.SMTPError{
+				Code:         501,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 8},
+				Message:      "Malformed sender address",
+				CheckName:    "verify_sender",
+			},
+		})
+	}
+
+	key, err := address.ForLookup(mailFrom)
+	if err != nil {
+		key = mailFrom
+	}
+
+	entry, ok := s.c.cacheGet(key)
+	if ok {
+		s.log.DebugMsg("using cached result", "sender", mailFrom, "verified", entry.err == nil)
+	} else {
+		entry.err = s.c.verify(ctx, mailFrom, domain)
+		// Temporary failures are not cached to let the next attempt
+		// retry the callout.
+		if entry.err == nil || entry.err.Code/100 == 5 {
+			s.c.cachePut(key, entry.err)
+		}
+	}
+
+	if entry.err == nil {
+		s.log.DebugMsg("sender verified", "sender", mailFrom)
+		return module.CheckResult{}
+	}
+	if entry.err.Code/100 == 5 {
+		return s.c.failAction.Apply(module.CheckResult{Reason: entry.err})
+	}
+	return s.c.tempFailAction.Apply(module.CheckResult{Reason: entry.err})
+}
+
+func (s *state) CheckRcpt(ctx context.Context, addr string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) CheckBody(ctx context.Context, hdr textproto.Header, body buffer.Buffer) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package verify_sender
+
+import (
+	"context"
+	"flag"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/go-mockdns"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestVerifySender(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+smtpPort)
+	defer srv.Close()
+	be.RcptErr = map[string]error{
+		"nonexistent@example.invalid": &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user",
+		},
+		"busy@example.invalid": &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Try again later",
+		},
+	}
+
+	resolver := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"example.invalid.": {
+			MX: []net.MX{{Host: "mx.example.invalid.", Pref: 10}},
+		},
+		"mx.example.invalid.": {
+			A: []string{"127.0.0.1"},
+		},
+		"null.invalid.": {
+			MX: []net.MX{{Host: ".", Pref: 0}},
+		},
+	}}
+
+	c := &Check{
+		log:            testutils.Logger(t, modName),
+		hostname:       "mx.example.org",
+		timeout:        5 * time.Second,
+		maxMXs:         2,
+		cacheTTL:       time.Hour,
+		failAction:     modconfig.FailAction{Reject: true},
+		tempFailAction: modconfig.FailAction{Quarantine: true},
+		resolver:       resolver,
+		dialer:         resolver.DialContext,
+		cache:          make(map[string]cacheEntry),
+	}
+
+	check := func(mailFrom string) module.CheckResult {
+		t.Helper()
+		st, err := c.CheckStateForMsg(context.Background(), &module.MsgMetadata{
+			Conn: &module.ConnState{},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.CheckSender(context.Background(), mailFrom)
+	}
+
+	if res := check("test@example.invalid"); res.Reason != nil {
+		t.Errorf("valid sender rejected: %v", res.Reason)
+	}
+	if res := check("nonexistent@example.invalid"); !res.Reject {
+		t.Errorf("non-existent sender not rejected: %+v", res)
+	}
+	if res := check("busy@example.invalid"); !res.Quarantine || res.Reject {
+		t.Errorf("temporary failure not handled using temperr_action: %+v", res)
+	}
+	if res := check("test@null.invalid"); !res.Reject {
+		t.Errorf("null MX sender not rejected: %+v", res)
+	}
+	if res := check(""); res.Reason != nil {
+		t.Errorf("null sender rejected: %v", res.Reason)
+	}
+
+	// Definite results are cached, temporary failures are not.
+	sessions := be.SessionCounter
+	check("test@example.invalid")
+	check("nonexistent@example.invalid")
+	if be.SessionCounter != sessions {
+		t.Errorf("cached results are not used")
+	}
+	check("busy@example.invalid")
+	if be.SessionCounter != sessions+1 {
+		t.Errorf("temporary failure was cached")
+	}
+
+	// Rejection of the null reverse-path is a temporary failure.
+	be.MailErr = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Null sender rejected",
+	}
+	if res := check("other@example.invalid"); !res.Quarantine || res.Reject {
+		t.Errorf("rejected probe not handled using temperr_action: %+v", res)
+	}
+	check("other@example.invalid")
+	if be.SessionCounter != sessions+3 {
+		t.Errorf("rejected probe result was cached")
+	}
+}
+
+func TestVerifySender_CacheEviction(t *testing.T) {
+	c := &Check{
+		cacheTTL: time.Hour,
+		cache:    make(map[string]cacheEntry),
+	}
+
+	for i := 0; i < maxCacheSize; i++ {
+		c.cachePut(strconv.Itoa(i)+"@example.invalid", nil)
+	}
+	c.cache["0@example.invalid"] = cacheEntry{expires: time.Now().Add(time.Minute)}
+	c.cachePut("new@example.invalid", nil)
+
+	if len(c.cache) != maxCacheSize {
+		t.Errorf("cache size is not limited: %d", len(c.cache))
+	}
+	if _, ok := c.cacheGet("new@example.invalid"); !ok {
+		t.Errorf("new entry is not cached")
+	}
+	if _, ok := c.cacheGet("0@example.invalid"); ok {
+		t.Errorf("oldest entry is not evicted")
+	}
+}
+
+func TestMain(m *testing.M) {
+	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
+	flag.Parse()
+
+	if *remoteSmtpPort == "random" {
+		rand.Seed(time.Now().UnixNano())
+		*remoteSmtpPort = strconv.Itoa(rand.Intn(65536-10000) + 10000)
+	}
+
+	smtpPort = *remoteSmtpPort
+	os.Exit(m.Run())
+}
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Client performs calls to the server using the control socket.
+type Client struct {
+	http *http.Client
+}
+
+// Dial checks whether the server uses the configuration block and returns
+// the client for it.
+//
+// ErrUnavailable is returned if the socket does not exist, nobody listens on
+// it or the server does not use the block.
+func Dial(path, block string) (*Client, error) {
+	c := &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+			Timeout: 5 * time.Minute,
+		},
+	}
+	if err := c.Call(block, MethodPing, Params{}, nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Call performs the call and decodes its result into the value pointed to by
+// result, which can be nil if the result is not needed.
+func (c *Client) Call(block, method string, params Params, result interface{}) error {
+	body, err := json.Marshal(Request{
+		Block:  block,
+		Method: method,
+		Params: params,
+	})
+	if err != nil {
+		return err
+	}
+
+	// The host is ignored, the connection is always made to the socket.
+	httpResp, err := c.http.Post("http://maddy/call", "application/json", bytes.NewReader(body))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return ErrUnavailable
+		}
+		return fmt.Errorf("control: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode == http.StatusNotFound {
+		return ErrUnavailable
+	}
+
+	resp := response{Result: result}
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return fmt.Errorf("control: malformed response: %w", err)
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control: unexpected status: %s", httpResp.Status)
+	}
+	return nil
+}
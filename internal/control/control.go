@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package control implements the control socket used by maddyctl to manage
+// accounts and mailboxes and to inspect queues through the running server.
+//
+// The server listens on the Unix socket in the runtime directory and accepts
+// HTTP requests with JSON-encoded calls. Operations are performed using the
+// module instances of the server, so the database is never written to by
+// two processes at once.
+package control
+
+import (
+	"errors"
+	"path/filepath"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// SocketName is the name of the control socket in the runtime directory.
+const SocketName = "control.sock"
+
+// Supported methods.
+const (
+	// MethodPing checks whether the configuration block is used by the
+	// server.
+	MethodPing = "ping"
+
+	MethodUsersList     = "users.list"
+	MethodUsersCreate   = "users.create"
+	MethodUsersPassword = "users.password"
+	MethodUsersRemove   = "users.remove"
+
+	// MethodTOTPEnable returns the otpauth:// key URI (string).
+	MethodTOTPEnable  = "totp.enable"
+	MethodTOTPDisable = "totp.disable"
+	// MethodTOTPStatus returns whether TOTP is enabled for the account
+	// (bool).
+	MethodTOTPStatus = "totp.status"
+
+	// MethodAppPasswordsList returns []module.AppPassword.
+	MethodAppPasswordsList = "app_passwords.list"
+	// MethodAppPasswordsCreate returns AppPasswordCreated.
+	MethodAppPasswordsCreate = "app_passwords.create"
+	MethodAppPasswordsRemove = "app_passwords.remove"
+
+	MethodAccountsList   = "accounts.list"
+	MethodAccountsCreate = "accounts.create"
+	MethodAccountsRemove = "accounts.remove"
+
+	MethodMailboxesList   = "mailboxes.list"
+	MethodMailboxesStatus = "mailboxes.status"
+	MethodMailboxesCreate = "mailboxes.create"
+	MethodMailboxesRemove = "mailboxes.remove"
+	MethodMailboxesRename = "mailboxes.rename"
+
+	// MethodQueueDomains returns queued messages aggregated by destination
+	// domain ([]queue.DomainStatus).
+	MethodQueueDomains = "queue.domains"
+	// MethodQueueTranscript returns recorded transcripts of failed delivery
+	// attempts for the message with the specified ID (string).
+	MethodQueueTranscript = "queue.transcript"
+)
+
+// ErrUnavailable is returned by the client if the server is not running or
+// does not use the requested configuration block.
+var ErrUnavailable = errors.New("control: server is not running or does not use the configuration block")
+
+// Request is the call sent to the server.
+type Request struct {
+	// Block is the name of the configuration block to use.
+	Block  string `json:"block"`
+	Method string `json:"method"`
+	Params Params `json:"params"`
+}
+
+// Params contains arguments of the call. Set of used fields depends on the
+// method.
+type Params struct {
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	Mailbox    string `json:"mailbox,omitempty"`
+	NewName    string `json:"new_name,omitempty"`
+	SpecialUse string `json:"special_use,omitempty"`
+	Subscribed bool   `json:"subscribed,omitempty"`
+	ID         string `json:"id,omitempty"`
+	// Name and Scopes describe the created application-specific password.
+	Name   string   `json:"name,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// MailboxInfo is the result of mailboxes.list call.
+type MailboxInfo struct {
+	Name       string   `json:"name"`
+	Delimiter  string   `json:"delimiter"`
+	Attributes []string `json:"attributes,omitempty"`
+}
+
+// MailboxStatus is the result of mailboxes.status call.
+type MailboxStatus struct {
+	Messages uint32 `json:"messages"`
+}
+
+// AppPasswordCreated is the result of app_passwords.create call.
+type AppPasswordCreated struct {
+	module.AppPassword
+	Password string `json:"password"`
+}
+
+type response struct {
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// SocketPath returns the path of the control socket in the runtime
+// directory.
+func SocketPath() string {
+	return filepath.Join(config.RuntimeDirectory, SocketName)
+}
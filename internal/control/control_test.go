@@ -0,0 +1,296 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type userDB struct {
+	users map[string]string
+}
+
+func (db userDB) Name() string           { return "test_userdb" }
+func (db userDB) InstanceName() string   { return "test_userdb" }
+func (db userDB) Init(*config.Map) error { return nil }
+
+func (db userDB) AuthPlain(username, password string) error {
+	if db.users[username] != password {
+		return errors.New("invalid credentials")
+	}
+	return nil
+}
+
+func (db userDB) ListUsers() ([]string, error) {
+	users := make([]string, 0, len(db.users))
+	for u := range db.users {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+func (db userDB) CreateUser(username, password string) error {
+	if _, ok := db.users[username]; ok {
+		return errors.New("user already exists")
+	}
+	db.users[username] = password
+	return nil
+}
+
+func (db userDB) SetUserPassword(username, password string) error {
+	db.users[username] = password
+	return nil
+}
+
+func (db userDB) DeleteUser(username string) error {
+	delete(db.users, username)
+	return nil
+}
+
+type storage struct {
+	be *memory.Backend
+}
+
+func (s storage) Name() string           { return "test_storage" }
+func (s storage) InstanceName() string   { return "test_storage" }
+func (s storage) Init(*config.Map) error { return nil }
+
+func (s storage) GetOrCreateIMAPAcct(username string) (imapbackend.User, error) {
+	return s.GetIMAPAcct(username)
+}
+
+func (s storage) GetIMAPAcct(username string) (imapbackend.User, error) {
+	return s.be.Login(nil, username, "password")
+}
+
+func (s storage) IMAPExtensions() []string {
+	return nil
+}
+
+type queueMod struct{}
+
+func (q queueMod) Name() string           { return "target.queue" }
+func (q queueMod) InstanceName() string   { return "remote_queue" }
+func (q queueMod) Init(*config.Map) error { return nil }
+
+func (q queueMod) Domains() ([]queue.DomainStatus, error) {
+	return []queue.DomainStatus{
+		{Domain: "example.org", Messages: 2, Recipients: 3, LastError: "451 4.4.1 Connection refused"},
+	}, nil
+}
+
+func (q queueMod) Transcript(id string) (string, error) {
+	if id != "msg1" {
+		return "", errors.New("no transcripts recorded")
+	}
+	return "S: 451 4.4.1 Try again later\n", nil
+}
+
+func testServer(t *testing.T) string {
+	t.Helper()
+
+	db := userDB{users: map[string]string{}}
+	store := storage{be: memory.New()}
+	path := filepath.Join(testutils.Dir(t), SocketName)
+	srv, err := listen(path, testutils.Logger(t, "control"), func(name string) (module.Module, bool) {
+		switch name {
+		case "local_authdb":
+			return db, true
+		case "local_mailboxes":
+			return store, true
+		case "remote_queue":
+			return queueMod{}, true
+		}
+		return nil, false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		srv.Close()
+	})
+	return path
+}
+
+func TestDial_Unavailable(t *testing.T) {
+	if _, err := Dial(filepath.Join(testutils.Dir(t), SocketName), "local_authdb"); !errors.Is(err, ErrUnavailable) {
+		t.Fatal("unexpected error for missing socket:", err)
+	}
+
+	path := testServer(t)
+	if _, err := Dial(path, "unknown"); !errors.Is(err, ErrUnavailable) {
+		t.Fatal("unexpected error for unknown block:", err)
+	}
+}
+
+func TestListen_InUse(t *testing.T) {
+	path := testServer(t)
+	if _, err := listen(path, testutils.Logger(t, "control"), nil); err == nil {
+		t.Fatal("socket used by another server is replaced")
+	}
+}
+
+func TestListen_Stale(t *testing.T) {
+	path := filepath.Join(testutils.Dir(t), SocketName)
+	if err := ioutil.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := listen(path, testutils.Logger(t, "control"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+}
+
+func TestUsers(t *testing.T) {
+	c, err := Dial(testServer(t), "local_authdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Call("local_authdb", MethodUsersCreate, Params{Username: "user@example.org", Password: "1"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("local_authdb", MethodUsersCreate, Params{Username: "user@example.org", Password: "1"}, nil); err == nil || err.Error() != "user already exists" {
+		t.Fatal("unexpected error for duplicate user:", err)
+	}
+	if err := c.Call("local_authdb", MethodUsersPassword, Params{Username: "user@example.org", Password: "2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var users []string
+	if err := c.Call("local_authdb", MethodUsersList, Params{}, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0] != "user@example.org" {
+		t.Fatal("unexpected users list:", users)
+	}
+
+	if err := c.Call("local_authdb", MethodUsersRemove, Params{Username: "user@example.org"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("local_authdb", MethodUsersList, Params{}, &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Fatal("user is not removed:", users)
+	}
+
+	if err := c.Call("local_authdb", MethodAccountsList, Params{}, nil); err == nil {
+		t.Fatal("accounts management is allowed for the credentials store")
+	}
+}
+
+func TestMailboxes(t *testing.T) {
+	c, err := Dial(testServer(t), "local_mailboxes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Call("local_mailboxes", MethodMailboxesCreate, Params{Username: "username", Mailbox: "Test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("local_mailboxes", MethodMailboxesRename, Params{Username: "username", Mailbox: "Test", NewName: "Test2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var mboxes []MailboxInfo
+	if err := c.Call("local_mailboxes", MethodMailboxesList, Params{Username: "username"}, &mboxes); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(mboxes))
+	for _, mbox := range mboxes {
+		names = append(names, mbox.Name)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "INBOX" || names[1] != "Test2" {
+		t.Fatal("unexpected mailboxes:", names)
+	}
+
+	var status MailboxStatus
+	if err := c.Call("local_mailboxes", MethodMailboxesStatus, Params{Username: "username", Mailbox: "INBOX"}, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Fatal("unexpected messages count:", status.Messages)
+	}
+
+	if err := c.Call("local_mailboxes", MethodMailboxesRemove, Params{Username: "username", Mailbox: "Test2"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Call("local_mailboxes", MethodMailboxesStatus, Params{Username: "username", Mailbox: "Test2"}, &status); err == nil {
+		t.Fatal("mailbox is not removed")
+	}
+
+	if err := c.Call("local_mailboxes", MethodAccountsCreate, Params{Username: "username"}, nil); err == nil {
+		t.Fatal("accounts management is allowed for storage without support for it")
+	}
+}
+
+func TestQueueDomains(t *testing.T) {
+	c, err := Dial(testServer(t), "remote_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var domains []queue.DomainStatus
+	if err := c.Call("remote_queue", MethodQueueDomains, Params{}, &domains); err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Domain != "example.org" || domains[0].Recipients != 3 ||
+		domains[0].LastError != "451 4.4.1 Connection refused" {
+		t.Fatal("unexpected domains:", domains)
+	}
+
+	if err := c.Call("local_mailboxes", MethodQueueDomains, Params{}, &domains); err == nil {
+		t.Fatal("queue call is allowed for storage")
+	}
+}
+
+func TestQueueTranscript(t *testing.T) {
+	c, err := Dial(testServer(t), "remote_queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var transcript string
+	if err := c.Call("remote_queue", MethodQueueTranscript, Params{ID: "msg1"}, &transcript); err != nil {
+		t.Fatal(err)
+	}
+	if transcript != "S: 451 4.4.1 Try again later\n" {
+		t.Fatalf("unexpected transcript: %q", transcript)
+	}
+
+	if err := c.Call("remote_queue", MethodQueueTranscript, Params{ID: "msg2"}, &transcript); err == nil {
+		t.Fatal("no error for unknown message")
+	}
+}
@@ -0,0 +1,309 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/queue"
+)
+
+// SpecialUseUser is implemented by storage accounts that support SPECIAL-USE
+// IMAP extension.
+type SpecialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+// QueueInspector is implemented by queue modules that can report their
+// contents.
+type QueueInspector interface {
+	Domains() ([]queue.DomainStatus, error)
+	Transcript(id string) (string, error)
+}
+
+type Server struct {
+	log log.Logger
+	l   net.Listener
+	srv *http.Server
+
+	getInstance func(name string) (module.Module, bool)
+}
+
+// readOnlyMethods are not logged.
+var readOnlyMethods = map[string]bool{
+	MethodPing:             true,
+	MethodUsersList:        true,
+	MethodTOTPStatus:       true,
+	MethodAppPasswordsList: true,
+	MethodAccountsList:     true,
+	MethodMailboxesList:    true,
+	MethodMailboxesStatus:  true,
+	MethodQueueDomains:     true,
+	MethodQueueTranscript:  true,
+}
+
+// errUnknownBlock is reported using 404 status so the client can fall back
+// to direct access.
+var errUnknownBlock = errors.New("configuration block is not used by the server")
+
+// Listen creates the control socket at the path and starts serving calls.
+//
+// Stale socket left by a crashed server is removed. If another server is
+// listening on the socket, error is returned.
+func Listen(path string, logger log.Logger) (*Server, error) {
+	return listen(path, logger, module.GetInitializedInstance)
+}
+
+func listen(path string, logger log.Logger, getInstance func(string) (module.Module, bool)) (*Server, error) {
+	if _, err := os.Stat(path); err == nil {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control: socket %s is used by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("control: %w", err)
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("control: %w", err)
+	}
+	// Calls are not authenticated, access is controlled using file
+	// permissions.
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("control: %w", err)
+	}
+
+	s := &Server{
+		log:         logger,
+		l:           l,
+		getInstance: getInstance,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/call", s.handleCall)
+	s.srv = &http.Server{
+		Handler:     mux,
+		ReadTimeout: time.Minute,
+	}
+	go func() {
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			s.log.Error("serve failed", err)
+		}
+	}()
+	return s, nil
+}
+
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) handleCall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeResponse(w, http.StatusBadRequest, response{Error: "malformed request: " + err.Error()})
+		return
+	}
+
+	res, err := s.call(req)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errUnknownBlock) {
+			status = http.StatusNotFound
+		}
+		s.log.Msg("call failed", "block", req.Block, "method", req.Method, "reason", err)
+		writeResponse(w, status, response{Error: err.Error()})
+		return
+	}
+	if !readOnlyMethods[req.Method] {
+		s.log.Msg("call", "block", req.Block, "method", req.Method,
+			"username", req.Params.Username, "mailbox", req.Params.Mailbox)
+	}
+	writeResponse(w, http.StatusOK, response{Result: res})
+}
+
+func writeResponse(w http.ResponseWriter, status int, resp response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) call(req Request) (interface{}, error) {
+	mod, ok := s.getInstance(req.Block)
+	if !ok {
+		return nil, errUnknownBlock
+	}
+	p := req.Params
+
+	switch req.Method {
+	case MethodPing:
+		return nil, nil
+	case MethodUsersList, MethodUsersCreate, MethodUsersPassword, MethodUsersRemove:
+		db, ok := mod.(module.PlainUserDB)
+		if !ok {
+			return nil, fmt.Errorf("configuration block %s is not a local credentials store", req.Block)
+		}
+		switch req.Method {
+		case MethodUsersList:
+			return db.ListUsers()
+		case MethodUsersCreate:
+			return nil, db.CreateUser(p.Username, p.Password)
+		case MethodUsersPassword:
+			return nil, db.SetUserPassword(p.Username, p.Password)
+		default:
+			return nil, db.DeleteUser(p.Username)
+		}
+	case MethodTOTPEnable, MethodTOTPDisable, MethodTOTPStatus:
+		db, ok := mod.(module.TOTPUserDB)
+		if !ok {
+			return nil, fmt.Errorf("configuration block %s does not support TOTP", req.Block)
+		}
+		switch req.Method {
+		case MethodTOTPEnable:
+			return db.EnableTOTP(p.Username)
+		case MethodTOTPDisable:
+			return nil, db.DisableTOTP(p.Username)
+		default:
+			return db.TOTPEnabled(p.Username)
+		}
+	case MethodAppPasswordsList, MethodAppPasswordsCreate, MethodAppPasswordsRemove:
+		db, ok := mod.(module.AppPasswordDB)
+		if !ok {
+			return nil, fmt.Errorf("configuration block %s does not support app passwords", req.Block)
+		}
+		switch req.Method {
+		case MethodAppPasswordsList:
+			return db.ListAppPasswords(p.Username)
+		case MethodAppPasswordsCreate:
+			info, password, err := db.CreateAppPassword(p.Username, p.Name, p.Scopes)
+			if err != nil {
+				return nil, err
+			}
+			return AppPasswordCreated{AppPassword: info, Password: password}, nil
+		default:
+			return nil, db.RemoveAppPassword(p.Username, p.ID)
+		}
+	case MethodAccountsList, MethodAccountsCreate, MethodAccountsRemove:
+		store, ok := mod.(module.ManageableStorage)
+		if !ok {
+			return nil, errors.New("storage backend does not support accounts management using maddyctl")
+		}
+		switch req.Method {
+		case MethodAccountsList:
+			return store.ListIMAPAccts()
+		case MethodAccountsCreate:
+			return nil, store.CreateIMAPAcct(p.Username)
+		default:
+			return nil, store.DeleteIMAPAcct(p.Username)
+		}
+	case MethodMailboxesList, MethodMailboxesStatus, MethodMailboxesCreate,
+		MethodMailboxesRemove, MethodMailboxesRename:
+		store, ok := mod.(module.Storage)
+		if !ok {
+			return nil, fmt.Errorf("configuration block %s is not an IMAP storage", req.Block)
+		}
+		return s.mailboxCall(store, req.Method, p)
+	case MethodQueueDomains, MethodQueueTranscript:
+		q, ok := mod.(QueueInspector)
+		if !ok {
+			return nil, fmt.Errorf("configuration block %s is not a queue", req.Block)
+		}
+		if req.Method == MethodQueueDomains {
+			return q.Domains()
+		}
+		return q.Transcript(p.ID)
+	default:
+		return nil, fmt.Errorf("unknown method: %s", req.Method)
+	}
+}
+
+func (s *Server) mailboxCall(store module.Storage, method string, p Params) (interface{}, error) {
+	u, err := store.GetIMAPAcct(p.Username)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			s.log.Error("logout failed", err, "username", p.Username)
+		}
+	}()
+
+	switch method {
+	case MethodMailboxesList:
+		mboxes, err := u.ListMailboxes(p.Subscribed)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]MailboxInfo, 0, len(mboxes))
+		for _, mbox := range mboxes {
+			info, err := mbox.Info()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, MailboxInfo{
+				Name:       info.Name,
+				Delimiter:  info.Delimiter,
+				Attributes: info.Attributes,
+			})
+		}
+		return res, nil
+	case MethodMailboxesStatus:
+		mbox, err := u.GetMailbox(p.Mailbox)
+		if err != nil {
+			return nil, err
+		}
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			return nil, err
+		}
+		return MailboxStatus{Messages: status.Messages}, nil
+	case MethodMailboxesCreate:
+		if p.SpecialUse == "" {
+			return nil, u.CreateMailbox(p.Mailbox)
+		}
+		suu, ok := u.(SpecialUseUser)
+		if !ok {
+			return nil, errors.New("storage backend does not support SPECIAL-USE IMAP extension")
+		}
+		return nil, suu.CreateMailboxSpecial(p.Mailbox, p.SpecialUse)
+	case MethodMailboxesRemove:
+		return nil, u.DeleteMailbox(p.Mailbox)
+	default:
+		return nil, u.RenameMailbox(p.Mailbox, p.NewName)
+	}
+}
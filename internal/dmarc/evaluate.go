@@ -107,6 +107,14 @@ type EvalResult struct {
 	// Whether there is a DKIM signature with the d= field matching the
 	// RFC5322.From domain.
 	DKIMAligned bool
+
+	// The domain the policy record was found at and the record itself. Set
+	// only by Verifier.Apply if the record was found.
+	PolicyDomain string
+	Record       *Record
+
+	// Whether the policy is not applied because of the pct key.
+	SampledOut bool
 }
 
 // EvaluateAlignment checks whether identifiers authenticated by SPF and DKIM are in alignment
@@ -133,7 +141,7 @@ func EvaluateAlignment(fromDomain string, record *Record, results []authres.Resu
 			if dkimResult.Value == "" {
 				dkimResult = *dkimRes
 			}
-			if isAligned(fromDomain, dkimRes.Domain, record.DKIMAlignment) {
+			if IsAligned(fromDomain, dkimRes.Domain, record.DKIMAlignment) {
 				dkimResult = *dkimRes
 				switch dkimRes.Value {
 				case authres.ResultPass:
@@ -147,9 +155,9 @@ func EvaluateAlignment(fromDomain string, record *Record, results []authres.Resu
 			spfResult = *spfRes
 			var aligned bool
 			if spfRes.From == "" {
-				aligned = isAligned(fromDomain, spfRes.Helo, record.SPFAlignment)
+				aligned = IsAligned(fromDomain, spfRes.Helo, record.SPFAlignment)
 			} else {
-				aligned = isAligned(fromDomain, spfRes.From, record.SPFAlignment)
+				aligned = IsAligned(fromDomain, spfRes.From, record.SPFAlignment)
 			}
 			if aligned && spfRes.Value == authres.ResultPass {
 				spfAligned = true
@@ -202,7 +210,9 @@ func EvaluateAlignment(fromDomain string, record *Record, results []authres.Resu
 	return res
 }
 
-func isAligned(fromDomain, authDomain string, mode AlignmentMode) bool {
+// IsAligned reports whether authDomain is aligned with fromDomain according
+// to the specified DMARC alignment mode.
+func IsAligned(fromDomain, authDomain string, mode AlignmentMode) bool {
 	if mode == dmarc.AlignmentStrict {
 		return strings.EqualFold(fromDomain, authDomain)
 	}
@@ -0,0 +1,314 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	msgdmarc "github.com/emersion/go-msgauth/dmarc"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Header fields that contain recipient addresses. Local parts of addresses
+// in them are replaced if failure_redact_rcpts is enabled.
+var rcptFields = []string{"To", "Cc", "Delivered-To", "X-Original-To"}
+
+// maxReportedBody is the maximum amount of the message body included in the
+// failure report with failure_content full.
+const maxReportedBody = 256 * 1024
+
+// failureRequested checks whether the failure report should be generated for
+// the message according to the fo tag of the policy record.
+func failureRequested(res Result) bool {
+	rec := res.Eval.Record
+	if rec == nil || len(rec.ReportURIFailure) == 0 {
+		return false
+	}
+	switch res.Eval.Authres.Value {
+	case authres.ResultPass, authres.ResultFail:
+	default:
+		return false
+	}
+
+	fo := rec.FailureOptions
+	if fo == 0 {
+		fo = msgdmarc.FailureAll
+	}
+	if fo&msgdmarc.FailureAll != 0 && !res.Eval.DKIMAligned && !res.Eval.SPFAligned {
+		return true
+	}
+	if fo&msgdmarc.FailureAny != 0 && (!res.Eval.DKIMAligned || !res.Eval.SPFAligned) {
+		return true
+	}
+	if fo&msgdmarc.FailureDKIM != 0 && res.Eval.DKIMResult.Value == authres.ResultFail {
+		return true
+	}
+	if fo&msgdmarc.FailureSPF != 0 && res.Eval.SPFResult.Value == authres.ResultFail {
+		return true
+	}
+	return false
+}
+
+// allowFailureReport enforces failure_rate_limit for the policy domain.
+func (r *Reporter) allowFailureReport(domain string) bool {
+	if r.failureLimit == 0 {
+		return true
+	}
+
+	r.failureLock.Lock()
+	defer r.failureLock.Unlock()
+
+	now := r.now()
+	if now.Sub(r.failureWindow) >= time.Hour {
+		r.failureWindow = now
+		r.failureCounts = map[string]int{}
+	}
+	if r.failureCounts[domain] >= r.failureLimit {
+		return false
+	}
+	r.failureCounts[domain]++
+	return true
+}
+
+// redactRcpts returns the copy of the header with local parts of recipient
+// addresses replaced.
+func redactRcpts(hdr textproto.Header) textproto.Header {
+	hdr = hdr.Copy()
+	for _, key := range rcptFields {
+		values := hdr.Values(key)
+		if len(values) == 0 {
+			continue
+		}
+		hdr.Del(key)
+		for _, v := range values {
+			hdr.Add(key, redactAddrs(v))
+		}
+	}
+	return hdr
+}
+
+// redactAddrs replaces local parts of all addresses in the field value with
+// "redacted".
+func redactAddrs(value string) string {
+	var b strings.Builder
+	for {
+		at := strings.IndexByte(value, '@')
+		if at == -1 {
+			b.WriteString(value)
+			return b.String()
+		}
+		start := strings.LastIndexAny(value[:at], " \t<,:;\"") + 1
+		b.WriteString(value[:start])
+		b.WriteString("redacted@")
+		value = value[at+1:]
+	}
+}
+
+// ReportFailure generates and sends the failure report (RFC 7489 Section
+// 7.3) for the message if failure reports are enabled and requested by the
+// policy record.
+//
+// Header and body are read before ReportFailure returns, the report itself
+// is sent in background. Errors are logged.
+func (r *Reporter) ReportFailure(ctx context.Context, res Result, msgMeta *module.MsgMetadata, header textproto.Header, body buffer.Buffer) {
+	if !r.failureReports || !failureRequested(res) {
+		return
+	}
+	domain := strings.ToLower(res.Eval.PolicyDomain)
+	if !r.allowFailureReport(domain) {
+		r.log.DebugMsg("failure report rate limit reached", "domain", domain, "msg_id", msgMeta.ID)
+		return
+	}
+
+	report, err := r.buildFailureReport(res, msgMeta, header, body)
+	if err != nil {
+		r.log.Error("failed to generate the failure report", err, "domain", domain, "msg_id", msgMeta.ID)
+		return
+	}
+
+	go func() {
+		if err := r.sendFailureReport(context.Background(), domain, res.Eval.Record.ReportURIFailure, report); err != nil {
+			r.log.Error("failed to send the failure report", err, "domain", domain, "msg_id", msgMeta.ID)
+			return
+		}
+		r.log.Msg("failure report sent", "domain", domain, "msg_id", msgMeta.ID)
+	}()
+}
+
+type failureReport struct {
+	subject     string
+	contentType string
+	body        []byte
+}
+
+func identityAlignment(res Result) string {
+	var aligned []string
+	if res.Eval.DKIMAligned {
+		aligned = append(aligned, "dkim")
+	}
+	if res.Eval.SPFAligned {
+		aligned = append(aligned, "spf")
+	}
+	if len(aligned) == 0 {
+		return "none"
+	}
+	return strings.Join(aligned, ", ")
+}
+
+func deliveryResult(disposition string) string {
+	switch disposition {
+	case "reject":
+		return "reject"
+	case "quarantine":
+		return "spam"
+	default:
+		return "delivered"
+	}
+}
+
+// buildFailureReport renders the report in the Abuse Reporting Format (RFC
+// 5965) with authentication failure extensions (RFC 6591).
+func (r *Reporter) buildFailureReport(res Result, msgMeta *module.MsgMetadata, header textproto.Header, body buffer.Buffer) (failureReport, error) {
+	var buf bytes.Buffer
+	mw := textproto.NewMultipartWriter(&buf)
+
+	arrival := r.now()
+	sourceIP := ""
+	if res.SourceIP != nil {
+		sourceIP = res.SourceIP.String()
+	}
+
+	textHdr := textproto.Header{}
+	textHdr.Add("Content-Type", "text/plain; charset=utf-8")
+	w, err := mw.CreatePart(textHdr)
+	if err != nil {
+		return failureReport{}, err
+	}
+	fmt.Fprintf(w, "This is an authentication failure report for the message received by %s", r.hostname)
+	if sourceIP != "" {
+		fmt.Fprintf(w, " from IP %s", sourceIP)
+	}
+	fmt.Fprintf(w, " on %s.\r\n", arrival.Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+
+	fbHdr := textproto.Header{}
+	fbHdr.Add("Content-Type", "message/feedback-report")
+	w, err = mw.CreatePart(fbHdr)
+	if err != nil {
+		return failureReport{}, err
+	}
+	fields := [][2]string{
+		{"Feedback-Type", "auth-failure"},
+		{"User-Agent", "maddy"},
+		{"Version", "1"},
+		{"Auth-Failure", "dmarc"},
+		{"Authentication-Results", authres.Format(r.hostname, []authres.Result{&res.Eval.Authres})},
+		{"Original-Envelope-Id", msgMeta.ID},
+		{"Original-Mail-From", "<" + res.EnvelopeFrom + ">"},
+		{"Arrival-Date", arrival.Format("Mon, 2 Jan 2006 15:04:05 -0700")},
+		{"Reported-Domain", res.Eval.Authres.From},
+		{"Delivery-Result", deliveryResult(string(res.Disposition))},
+		{"Identity-Alignment", identityAlignment(res)},
+	}
+	if sourceIP != "" {
+		fields = append(fields, [2]string{"Source-IP", sourceIP})
+	}
+	if res.Eval.DKIMResult.Domain != "" {
+		fields = append(fields, [2]string{"DKIM-Domain", res.Eval.DKIMResult.Domain})
+	}
+	for _, f := range fields {
+		if _, err := fmt.Fprintf(w, "%s: %s\r\n", f[0], f[1]); err != nil {
+			return failureReport{}, err
+		}
+	}
+
+	if r.failureRedactRcpts {
+		header = redactRcpts(header)
+	}
+	origHdr := textproto.Header{}
+	if r.failureContent == "full" {
+		origHdr.Add("Content-Type", "message/rfc822")
+	} else {
+		origHdr.Add("Content-Type", "text/rfc822-headers")
+	}
+	w, err = mw.CreatePart(origHdr)
+	if err != nil {
+		return failureReport{}, err
+	}
+	if err := textproto.WriteHeader(w, header); err != nil {
+		return failureReport{}, err
+	}
+	if r.failureContent == "full" && body != nil {
+		bodyR, err := body.Open()
+		if err != nil {
+			return failureReport{}, err
+		}
+		_, err = io.Copy(w, io.LimitReader(bodyR, maxReportedBody))
+		bodyR.Close()
+		if err != nil {
+			return failureReport{}, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return failureReport{}, err
+	}
+
+	return failureReport{
+		subject:     "DMARC failure report for " + res.Eval.Authres.From + " from " + r.orgName,
+		contentType: "multipart/report; report-type=feedback-report; boundary=" + mw.Boundary(),
+		body:        buf.Bytes(),
+	}, nil
+}
+
+func (r *Reporter) sendFailureReport(ctx context.Context, domain string, ruf []string, report failureReport) error {
+	var rcpts []string
+	for _, uri := range ruf {
+		t, err := parseRUA(uri)
+		if err != nil {
+			r.log.Error("skipping report URI", err, "domain", domain)
+			continue
+		}
+		if t.maxSize != 0 && int64(len(report.body)) > t.maxSize {
+			r.log.Msg("report exceeds the size limit, skipping", "domain", domain, "rcpt", t.addr,
+				"size", len(report.body), "max_size", t.maxSize)
+			continue
+		}
+		if err := r.verifyDestination(ctx, domain, t.addr); err != nil {
+			r.log.Error("skipping report URI", err, "domain", domain, "rcpt", t.addr)
+			continue
+		}
+		rcpts = append(rcpts, t.addr)
+	}
+	if len(rcpts) == 0 {
+		return fmt.Errorf("no usable report addresses")
+	}
+
+	msgCtx, msgTask := trace.NewTask(ctx, "DMARC failure report")
+	defer msgTask.End()
+
+	return r.deliver(msgCtx, rcpts, report.subject, report.contentType, report.body)
+}
@@ -0,0 +1,160 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestFailureRequested(t *testing.T) {
+	test := func(rec string, dkimPass, want bool) {
+		t.Helper()
+		res := Result{Eval: evalResult(t, rec, dkimPass)}
+		if got := failureRequested(res); got != want {
+			t.Errorf("%s, dkim pass=%v: want %v, got %v", rec, dkimPass, want, got)
+		}
+	}
+
+	// SPF is never aligned in evalResult.
+	test("v=DMARC1; p=reject", false, false)
+	test("v=DMARC1; p=reject; ruf=mailto:f@example.org", false, true)
+	test("v=DMARC1; p=reject; ruf=mailto:f@example.org", true, false)
+	test("v=DMARC1; p=reject; ruf=mailto:f@example.org; fo=1", true, true)
+	test("v=DMARC1; p=reject; ruf=mailto:f@example.org; fo=d", true, false)
+	test("v=DMARC1; p=reject; ruf=mailto:f@example.org; fo=s", true, true)
+}
+
+func TestRedactAddrs(t *testing.T) {
+	for in, want := range map[string]string{
+		"user@example.org":                       "redacted@example.org",
+		"User <user@example.org>, b@example.com": "User <redacted@example.org>, redacted@example.com",
+		"\"a@b\" <c.d@example.org>":              "\"redacted@b\" <redacted@example.org>",
+		"undisclosed-recipients:;":               "undisclosed-recipients:;",
+		"Group: a@example.org, b@example.org;":   "Group: redacted@example.org, redacted@example.org;",
+		"<a+tag@example.org>,\t<b@example.org>":  "<redacted@example.org>,\t<redacted@example.org>",
+	} {
+		if got := redactAddrs(in); got != want {
+			t.Errorf("%s: want %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestReportFailure(t *testing.T) {
+	tgt := testutils.Target{}
+	r := &Reporter{
+		log:                testutils.Logger(t, modName),
+		target:             &tgt,
+		resolver:           &mockdns.Resolver{Zones: map[string]mockdns.Zone{}},
+		hostname:           "mx.example.com",
+		orgName:            "Example",
+		from:               "postmaster@example.com",
+		failureReports:     true,
+		failureContent:     "headers",
+		failureRedactRcpts: true,
+		failureLimit:       1,
+		now:                time.Now,
+	}
+
+	res := Result{
+		SourceIP:     net.IPv4(192, 0, 2, 1),
+		EnvelopeFrom: "bounce@example.com",
+		Eval:         evalResult(t, "v=DMARC1; p=reject; ruf=mailto:f@example.org", false),
+		Disposition:  dmarc.PolicyReject,
+	}
+	if !r.allowFailureReport("example.org") {
+		t.Fatal("first report is not allowed")
+	}
+	if r.allowFailureReport("example.org") {
+		t.Error("rate limit is not applied")
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("From", "<spoofer@example.org>")
+	hdr.Add("To", "Victim <victim@example.com>")
+	hdr.Add("Subject", "Urgent")
+	report, err := r.buildFailureReport(res, &module.MsgMetadata{ID: "msgid"}, hdr, buffer.MemoryBuffer{Slice: []byte("secret body")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.sendFailureReport(context.Background(), "example.org", res.Eval.Record.ReportURIFailure, report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("expected 1 message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "f@example.org" {
+		t.Error("wrong recipients:", msg.RcptTo)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != "multipart/report" || params["report-type"] != "feedback-report" {
+		t.Fatal("wrong Content-Type:", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(bytes.NewReader(msg.Body), params["boundary"])
+	var parts []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, p.Header.Get("Content-Type")+"\n"+string(data))
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+	for _, want := range []string{"Feedback-Type: auth-failure", "Auth-Failure: dmarc", "Source-IP: 192.0.2.1",
+		"Reported-Domain: example.org", "Delivery-Result: reject", "Identity-Alignment: none"} {
+		if !strings.Contains(parts[1], want) {
+			t.Errorf("feedback report does not contain %q:\n%s", want, parts[1])
+		}
+	}
+	if !strings.HasPrefix(parts[2], "text/rfc822-headers") {
+		t.Error("wrong original message part type:", parts[2])
+	}
+	if strings.Contains(parts[2], "victim@") || !strings.Contains(parts[2], "redacted@example.com") {
+		t.Error("recipient address is not redacted:", parts[2])
+	}
+	if strings.Contains(parts[2], "secret body") {
+		t.Error("body is included in headers-only report")
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"strconv"
+	"time"
+)
+
+// Feedback is the aggregate report document as defined in RFC 7489
+// Appendix C.
+type Feedback struct {
+	XMLName  xml.Name        `xml:"feedback"`
+	Metadata Metadata        `xml:"report_metadata"`
+	Policy   PolicyPublished `xml:"policy_published"`
+	Records  []Record        `xml:"record"`
+}
+
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type Metadata struct {
+	OrgName          string    `xml:"org_name"`
+	Email            string    `xml:"email"`
+	ExtraContactInfo string    `xml:"extra_contact_info,omitempty"`
+	ReportID         string    `xml:"report_id"`
+	DateRange        DateRange `xml:"date_range"`
+}
+
+type PolicyPublished struct {
+	Domain          string `xml:"domain"`
+	DKIMAlignment   string `xml:"adkim"`
+	SPFAlignment    string `xml:"aspf"`
+	Policy          string `xml:"p"`
+	SubdomainPolicy string `xml:"sp"`
+	Percent         int    `xml:"pct"`
+	FailureOptions  string `xml:"fo,omitempty"`
+}
+
+type Reason struct {
+	Type    string `xml:"type"`
+	Comment string `xml:"comment,omitempty"`
+}
+
+type PolicyEvaluated struct {
+	Disposition string   `xml:"disposition"`
+	DKIM        string   `xml:"dkim"`
+	SPF         string   `xml:"spf"`
+	Reasons     []Reason `xml:"reason,omitempty"`
+}
+
+type Row struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type Identifiers struct {
+	EnvelopeTo   string `xml:"envelope_to,omitempty"`
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+type DKIMAuthResult struct {
+	Domain   string `xml:"domain"`
+	Selector string `xml:"selector,omitempty"`
+	Result   string `xml:"result"`
+}
+
+type SPFAuthResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope,omitempty"`
+	Result string `xml:"result"`
+}
+
+type AuthResults struct {
+	DKIM []DKIMAuthResult `xml:"dkim,omitempty"`
+	SPF  []SPFAuthResult  `xml:"spf"`
+}
+
+type Record struct {
+	Row         Row         `xml:"row"`
+	Identifiers Identifiers `xml:"identifiers"`
+	AuthResults AuthResults `xml:"auth_results"`
+}
+
+// Filename returns the attachment file name for the report as recommended
+// by RFC 7489 Section 7.2.1.1, without the extension.
+func (f *Feedback) Filename(receiver string) string {
+	return receiver + "!" + f.Policy.Domain + "!" +
+		strconv.FormatInt(f.Metadata.DateRange.Begin, 10) + "!" + strconv.FormatInt(f.Metadata.DateRange.End, 10)
+}
+
+// Marshal renders the report as an XML document.
+func (f *Feedback) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(f); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+	return buf.Bytes(), nil
+}
+
+// Compress marshals the report and compresses it using the specified
+// method ("gzip" or "zip"). It returns the compressed data, the attachment
+// file name and its media type.
+func (f *Feedback) Compress(method, receiver string) ([]byte, string, string, error) {
+	doc, err := f.Marshal()
+	if err != nil {
+		return nil, "", "", err
+	}
+	name := f.Filename(receiver) + ".xml"
+
+	var buf bytes.Buffer
+	switch method {
+	case "zip":
+		w := zip.NewWriter(&buf)
+		fw, err := w.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: time.Unix(f.Metadata.DateRange.End, 0),
+		})
+		if err != nil {
+			return nil, "", "", err
+		}
+		if _, err := fw.Write(doc); err != nil {
+			return nil, "", "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", "", err
+		}
+		return buf.Bytes(), f.Filename(receiver) + ".zip", "application/zip", nil
+	default:
+		w := gzip.NewWriter(&buf)
+		w.Name = name
+		if _, err := w.Write(doc); err != nil {
+			return nil, "", "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", "", err
+		}
+		return buf.Bytes(), name + ".gz", "application/gzip", nil
+	}
+}
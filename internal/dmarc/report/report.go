@@ -0,0 +1,586 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package report implements collection of DMARC evaluation results and
+// generation of aggregate reports as defined in RFC 7489 Section 7.2.
+//
+// Results are accumulated in the table module with a counter per unique
+// combination of the source IP, identifiers and authentication results.
+// Reports are periodically rendered for each policy domain, compressed and
+// sent to the addresses listed in the rua tag of the domain DMARC record.
+//
+// Optionally, failure reports (RFC 7489 Section 7.3) are sent for
+// individual messages to the addresses listed in the ruf tag.
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+const modName = "dmarc_reports"
+
+const (
+	rowPrefix    = "row "
+	policyPrefix = "policy "
+	beginKey     = "begin"
+)
+
+// Result is the DMARC evaluation result for the single message.
+type Result struct {
+	SourceIP     net.IP
+	EnvelopeFrom string
+	Eval         dmarc.EvalResult
+	// Disposition is the policy actually applied to the message.
+	Disposition dmarc.Policy
+	// Override is the policy override reason type as defined in RFC 7489
+	// Appendix C (e.g. "trusted_forwarder"), empty if there is none.
+	Override        string
+	OverrideComment string
+}
+
+// rowKey is the part of the aggregate record that identifies the set of
+// messages it counts.
+type rowKey struct {
+	SourceIP        string `json:"ip"`
+	Disposition     string `json:"disposition"`
+	DKIMAligned     bool   `json:"dkim_aligned"`
+	SPFAligned      bool   `json:"spf_aligned"`
+	Override        string `json:"override,omitempty"`
+	OverrideComment string `json:"override_comment,omitempty"`
+	HeaderFrom      string `json:"header_from"`
+	EnvelopeFrom    string `json:"envelope_from,omitempty"`
+	DKIMDomain      string `json:"dkim_domain,omitempty"`
+	DKIMResult      string `json:"dkim_result,omitempty"`
+	SPFDomain       string `json:"spf_domain,omitempty"`
+	SPFScope        string `json:"spf_scope,omitempty"`
+	SPFResult       string `json:"spf_result,omitempty"`
+}
+
+type policyEntry struct {
+	Published PolicyPublished `json:"published"`
+	RUA       []string        `json:"rua"`
+}
+
+type Reporter struct {
+	instName string
+	log      log.Logger
+
+	db          module.MutableTable
+	target      module.DeliveryTarget
+	resolver    dns.Resolver
+	hostname    string
+	orgName     string
+	from        string
+	contactInfo string
+	interval    time.Duration
+	compression string
+
+	failureReports     bool
+	failureContent     string
+	failureRedactRcpts bool
+	failureLimit       int
+
+	// Serializes counter updates.
+	dbLock sync.Mutex
+
+	failureLock   sync.Mutex
+	failureWindow time.Time
+	failureCounts map[string]int
+
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Reporter{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver: dns.DefaultResolver(),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		now:      time.Now,
+	}, nil
+}
+
+func (r *Reporter) Name() string {
+	return modName
+}
+
+func (r *Reporter) InstanceName() string {
+	return r.instName
+}
+
+func (r *Reporter) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &r.log.Debug)
+	cfg.String("hostname", true, true, "", &r.hostname)
+	cfg.String("org_name", false, false, "", &r.orgName)
+	cfg.String("from", false, false, "", &r.from)
+	cfg.String("extra_contact_info", false, false, "", &r.contactInfo)
+	cfg.Custom("db", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var tbl module.MutableTable
+		if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl); err != nil {
+			return nil, err
+		}
+		return tbl, nil
+	}, &r.db)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &r.target)
+	cfg.Duration("interval", false, false, 24*time.Hour, &r.interval)
+	cfg.Enum("compression", false, false, []string{"gzip", "zip"}, "gzip", &r.compression)
+	cfg.Bool("failure_reports", false, false, &r.failureReports)
+	cfg.Enum("failure_content", false, false, []string{"headers", "full"}, "headers", &r.failureContent)
+	cfg.Bool("failure_redact_rcpts", false, true, &r.failureRedactRcpts)
+	cfg.Int("failure_rate_limit", false, false, 10, &r.failureLimit)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if r.orgName == "" {
+		r.orgName = r.hostname
+	}
+	if r.from == "" {
+		r.from = "postmaster@" + r.hostname
+	}
+	if !address.Valid(r.from) {
+		return fmt.Errorf("%s: invalid from address: %s", modName, r.from)
+	}
+	if r.interval <= 0 {
+		return fmt.Errorf("%s: interval should be positive", modName)
+	}
+	if r.failureLimit < 0 {
+		return fmt.Errorf("%s: failure_rate_limit should not be negative", modName)
+	}
+
+	go r.sendLoop()
+	return nil
+}
+
+func (r *Reporter) Close() error {
+	close(r.stop)
+	<-r.stopped
+	return nil
+}
+
+func (r *Reporter) sendLoop() {
+	defer close(r.stopped)
+
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			r.Flush(context.Background())
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Record adds the DMARC evaluation result to the next aggregate report for
+// the policy domain.
+//
+// Results for domains without a DMARC record or without aggregate report
+// addresses are ignored. Errors are logged and not returned since reporting
+// should never affect the message delivery.
+func (r *Reporter) Record(ctx context.Context, res Result) {
+	rec := res.Eval.Record
+	if rec == nil || len(rec.ReportURIAggregate) == 0 {
+		return
+	}
+	switch res.Eval.Authres.Value {
+	case authres.ResultPass, authres.ResultFail:
+	default:
+		// Messages not evaluated due to errors are not reported.
+		return
+	}
+
+	key := rowKey{
+		Disposition:     string(res.Disposition),
+		DKIMAligned:     res.Eval.DKIMAligned,
+		SPFAligned:      res.Eval.SPFAligned,
+		Override:        res.Override,
+		OverrideComment: res.OverrideComment,
+		HeaderFrom:      res.Eval.Authres.From,
+		EnvelopeFrom:    domainOf(res.EnvelopeFrom),
+		DKIMDomain:      res.Eval.DKIMResult.Domain,
+		DKIMResult:      string(res.Eval.DKIMResult.Value),
+		SPFResult:       string(res.Eval.SPFResult.Value),
+	}
+	if res.SourceIP != nil {
+		key.SourceIP = res.SourceIP.String()
+	}
+	if res.Eval.SPFResult.From != "" {
+		key.SPFDomain = domainOf(res.Eval.SPFResult.From)
+		key.SPFScope = "mfrom"
+	} else if res.Eval.SPFResult.Helo != "" {
+		key.SPFDomain = res.Eval.SPFResult.Helo
+		key.SPFScope = "helo"
+	}
+	keyBlob, err := json.Marshal(key)
+	if err != nil {
+		r.log.Error("failed to serialize the result", err)
+		return
+	}
+	policyBlob, err := json.Marshal(policyEntry{
+		Published: publishedPolicy(res.Eval.PolicyDomain, rec),
+		RUA:       rec.ReportURIAggregate,
+	})
+	if err != nil {
+		r.log.Error("failed to serialize the policy", err)
+		return
+	}
+
+	domain := strings.ToLower(res.Eval.PolicyDomain)
+	rowDBKey := rowPrefix + domain + " " + string(keyBlob)
+
+	r.dbLock.Lock()
+	defer r.dbLock.Unlock()
+
+	if _, ok, err := r.db.Lookup(ctx, beginKey); err != nil {
+		r.log.Error("db lookup failed", err)
+		return
+	} else if !ok {
+		if err := r.db.SetKey(beginKey, strconv.FormatInt(r.now().Unix(), 10)); err != nil {
+			r.log.Error("db update failed", err)
+			return
+		}
+	}
+
+	count := 0
+	val, ok, err := r.db.Lookup(ctx, rowDBKey)
+	if err != nil {
+		r.log.Error("db lookup failed", err)
+		return
+	}
+	if ok {
+		count, _ = strconv.Atoi(val)
+	}
+	if err := r.db.SetKey(rowDBKey, strconv.Itoa(count+1)); err != nil {
+		r.log.Error("db update failed", err)
+		return
+	}
+	// The latest published policy is reported.
+	if err := r.db.SetKey(policyPrefix+domain, string(policyBlob)); err != nil {
+		r.log.Error("db update failed", err)
+	}
+}
+
+func publishedPolicy(domain string, rec *dmarc.Record) PolicyPublished {
+	pub := PolicyPublished{
+		Domain:          domain,
+		DKIMAlignment:   string(rec.DKIMAlignment),
+		SPFAlignment:    string(rec.SPFAlignment),
+		Policy:          string(rec.Policy),
+		SubdomainPolicy: string(rec.SubdomainPolicy),
+		Percent:         100,
+	}
+	if pub.DKIMAlignment == "" {
+		pub.DKIMAlignment = "r"
+	}
+	if pub.SPFAlignment == "" {
+		pub.SPFAlignment = "r"
+	}
+	if pub.SubdomainPolicy == "" {
+		pub.SubdomainPolicy = pub.Policy
+	}
+	if rec.Percent != nil {
+		pub.Percent = *rec.Percent
+	}
+	return pub
+}
+
+func domainOf(addr string) string {
+	_, domain, err := address.Split(addr)
+	if err != nil {
+		return addr
+	}
+	return domain
+}
+
+func alignedResult(aligned bool) string {
+	if aligned {
+		return "pass"
+	}
+	return "fail"
+}
+
+// collect reads accumulated results from the database, removes them and
+// returns reports for all policy domains along with their rua addresses.
+func (r *Reporter) collect(ctx context.Context) ([]*Feedback, map[string][]string, error) {
+	r.dbLock.Lock()
+	defer r.dbLock.Unlock()
+
+	keys, err := r.db.Keys()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	begin := r.now().Add(-r.interval).Unix()
+	if val, ok, err := r.db.Lookup(ctx, beginKey); err != nil {
+		return nil, nil, err
+	} else if ok {
+		if stamp, err := strconv.ParseInt(val, 10, 64); err == nil {
+			begin = stamp
+		}
+	}
+	end := r.now().Unix()
+
+	reports := map[string]*Feedback{}
+	var order []string
+	rua := map[string][]string{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, policyPrefix) {
+			continue
+		}
+		val, ok, err := r.db.Lookup(ctx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		var pol policyEntry
+		if err := json.Unmarshal([]byte(val), &pol); err != nil {
+			r.log.Error("malformed policy entry", err, "key", key)
+			continue
+		}
+		domain := strings.TrimPrefix(key, policyPrefix)
+		rua[domain] = pol.RUA
+		reports[domain] = &Feedback{
+			Metadata: Metadata{
+				OrgName:          r.orgName,
+				Email:            r.from,
+				ExtraContactInfo: r.contactInfo,
+				DateRange:        DateRange{Begin: begin, End: end},
+			},
+			Policy: pol.Published,
+		}
+		order = append(order, domain)
+	}
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, rowPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(key, rowPrefix), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		report := reports[parts[0]]
+		if report == nil {
+			continue
+		}
+
+		val, ok, err := r.db.Lookup(ctx, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			continue
+		}
+		count, err := strconv.Atoi(val)
+		if err != nil {
+			r.log.Error("malformed counter", err, "key", key)
+			continue
+		}
+		var row rowKey
+		if err := json.Unmarshal([]byte(parts[1]), &row); err != nil {
+			r.log.Error("malformed row key", err, "key", key)
+			continue
+		}
+		report.Records = append(report.Records, row.record(count))
+	}
+
+	for _, key := range keys {
+		if err := r.db.RemoveKey(key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	result := make([]*Feedback, 0, len(order))
+	for _, domain := range order {
+		if len(reports[domain].Records) == 0 {
+			continue
+		}
+		result = append(result, reports[domain])
+	}
+	return result, rua, nil
+}
+
+func (row rowKey) record(count int) Record {
+	rec := Record{
+		Row: Row{
+			SourceIP: row.SourceIP,
+			Count:    count,
+			PolicyEvaluated: PolicyEvaluated{
+				Disposition: row.Disposition,
+				DKIM:        alignedResult(row.DKIMAligned),
+				SPF:         alignedResult(row.SPFAligned),
+			},
+		},
+		Identifiers: Identifiers{
+			EnvelopeFrom: row.EnvelopeFrom,
+			HeaderFrom:   row.HeaderFrom,
+		},
+	}
+	if row.Override != "" {
+		rec.Row.PolicyEvaluated.Reasons = []Reason{{Type: row.Override, Comment: row.OverrideComment}}
+	}
+	if row.DKIMDomain != "" {
+		rec.AuthResults.DKIM = []DKIMAuthResult{{Domain: row.DKIMDomain, Result: row.DKIMResult}}
+	}
+	spf := SPFAuthResult{Domain: row.SPFDomain, Scope: row.SPFScope, Result: row.SPFResult}
+	if spf.Result == "" {
+		spf.Result = "none"
+	}
+	rec.AuthResults.SPF = []SPFAuthResult{spf}
+	return rec
+}
+
+// Flush generates reports for all results collected since the last call and
+// sends them.
+func (r *Reporter) Flush(ctx context.Context) {
+	reports, rua, err := r.collect(ctx)
+	if err != nil {
+		r.log.Error("failed to read collected results", err)
+		return
+	}
+
+	for _, report := range reports {
+		if err := r.send(ctx, report, rua[report.Policy.Domain]); err != nil {
+			r.log.Error("failed to send the report", err, "domain", report.Policy.Domain)
+			continue
+		}
+		r.log.Msg("aggregate report sent", "domain", report.Policy.Domain,
+			"report_id", report.Metadata.ReportID, "records", len(report.Records))
+	}
+}
+
+// ruaTarget is the parsed mailto: URI from the rua tag.
+type ruaTarget struct {
+	addr string
+	// Maximum report size, 0 if there is no limit.
+	maxSize int64
+}
+
+// parseRUA parses the DMARC URI as defined in RFC 7489 Section 6.2.
+// Only mailto: URIs are supported.
+func parseRUA(uri string) (ruaTarget, error) {
+	if !strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+		return ruaTarget{}, fmt.Errorf("unsupported URI: %s", uri)
+	}
+	uri = uri[len("mailto:"):]
+
+	var t ruaTarget
+	if idx := strings.LastIndexByte(uri, '!'); idx != -1 {
+		size := strings.ToLower(uri[idx+1:])
+		uri = uri[:idx]
+
+		mult := int64(1)
+		if size != "" {
+			switch size[len(size)-1] {
+			case 'k':
+				mult = 1 << 10
+			case 'm':
+				mult = 1 << 20
+			case 'g':
+				mult = 1 << 30
+			case 't':
+				mult = 1 << 40
+			}
+			if mult != 1 {
+				size = size[:len(size)-1]
+			}
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return ruaTarget{}, fmt.Errorf("malformed size limit: %s", size)
+		}
+		t.maxSize = n * mult
+	}
+
+	if !address.Valid(uri) {
+		return ruaTarget{}, fmt.Errorf("invalid address: %s", uri)
+	}
+	t.addr = uri
+	return t, nil
+}
+
+// verifyDestination checks whether the report destination outside of the
+// policy organizational domain agreed to receive reports for it, as required
+// by RFC 7489 Section 7.1.
+func (r *Reporter) verifyDestination(ctx context.Context, policyDomain, addr string) error {
+	_, rcptDomain, err := address.Split(addr)
+	if err != nil {
+		return err
+	}
+	rcptDomain = strings.ToLower(rcptDomain)
+
+	policyOrg, err := publicsuffix.EffectiveTLDPlusOne(policyDomain)
+	if err != nil {
+		return err
+	}
+	rcptOrg, err := publicsuffix.EffectiveTLDPlusOne(rcptDomain)
+	if err != nil {
+		return err
+	}
+	if policyOrg == rcptOrg {
+		return nil
+	}
+
+	txts, err := r.resolver.LookupTXT(ctx, dns.FQDN(policyDomain+"._report._dmarc."+rcptDomain))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return err
+		}
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s does not accept reports for %s", rcptDomain, policyDomain)
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,249 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-msgauth/authres"
+	msgdmarc "github.com/emersion/go-msgauth/dmarc"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type mapTable map[string]string
+
+func (m mapTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	v, ok := m[key]
+	return v, ok, nil
+}
+
+func (m mapTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m mapTable) SetKey(key, value string) error {
+	m[key] = value
+	return nil
+}
+
+func (m mapTable) RemoveKey(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func TestParseRUA(t *testing.T) {
+	for uri, want := range map[string]ruaTarget{
+		"mailto:dmarc@example.org":      {addr: "dmarc@example.org"},
+		"MAILTO:dmarc@example.org!10m":  {addr: "dmarc@example.org", maxSize: 10 << 20},
+		"mailto:dmarc@example.org!2048": {addr: "dmarc@example.org", maxSize: 2048},
+	} {
+		got, err := parseRUA(uri)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", uri, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: want %+v, got %+v", uri, want, got)
+		}
+	}
+	for _, uri := range []string{"https://example.org/dmarc", "mailto:dmarc@example.org!abc", "mailto:"} {
+		if _, err := parseRUA(uri); err == nil {
+			t.Errorf("%s: expected error", uri)
+		}
+	}
+}
+
+func evalResult(t *testing.T, rec string, dkimPass bool) dmarc.EvalResult {
+	t.Helper()
+	record, err := msgdmarc.Parse(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dkimRes authres.ResultValue = authres.ResultFail
+	if dkimPass {
+		dkimRes = authres.ResultPass
+	}
+	res := dmarc.EvaluateAlignment("example.org", record, []authres.Result{
+		&authres.DKIMResult{Value: dkimRes, Domain: "example.org"},
+		&authres.SPFResult{Value: authres.ResultFail, From: "bounce@example.com"},
+	})
+	res.PolicyDomain = "example.org"
+	res.Record = record
+	return res
+}
+
+func TestReporter(t *testing.T) {
+	tgt := testutils.Target{}
+	db := mapTable{}
+	now := time.Unix(1600000000, 0)
+	r := &Reporter{
+		log:         testutils.Logger(t, modName),
+		db:          db,
+		target:      &tgt,
+		resolver:    &mockdns.Resolver{Zones: map[string]mockdns.Zone{}},
+		hostname:    "mx.example.com",
+		orgName:     "Example",
+		from:        "postmaster@example.com",
+		interval:    time.Hour,
+		compression: "gzip",
+		now:         func() time.Time { return now },
+	}
+
+	const rec = "v=DMARC1; p=reject; rua=mailto:dmarc@example.org,mailto:dmarc@thirdparty.example"
+	ip := net.IPv4(192, 0, 2, 1)
+	for i := 0; i < 3; i++ {
+		r.Record(context.Background(), Result{
+			SourceIP:     ip,
+			EnvelopeFrom: "bounce@example.com",
+			Eval:         evalResult(t, rec, true),
+			Disposition:  dmarc.PolicyNone,
+		})
+	}
+	r.Record(context.Background(), Result{
+		SourceIP:     ip,
+		EnvelopeFrom: "bounce@example.com",
+		Eval:         evalResult(t, rec, false),
+		Disposition:  dmarc.PolicyReject,
+	})
+	// No rua - not recorded.
+	r.Record(context.Background(), Result{
+		SourceIP:    ip,
+		Eval:        evalResult(t, "v=DMARC1; p=none", true),
+		Disposition: dmarc.PolicyNone,
+	})
+
+	now = now.Add(time.Hour)
+	r.Flush(context.Background())
+
+	if len(db) != 0 {
+		t.Error("results are not removed after flush:", db)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("expected 1 message, got", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	// thirdparty.example does not authorize reports for example.org.
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "dmarc@example.org" {
+		t.Error("wrong recipients:", msg.RcptTo)
+	}
+	if !strings.HasPrefix(msg.Header.Get("Subject"), "Report Domain: example.org Submitter: Example Report-ID: ") {
+		t.Error("wrong subject:", msg.Header.Get("Subject"))
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(bytes.NewReader(msg.Body), params["boundary"])
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatal(err)
+	}
+	att, err := mr.NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if att.FileName() != "mx.example.com!example.org!1600000000!1600003600.xml.gz" {
+		t.Error("wrong file name:", att.FileName())
+	}
+	gz, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, att))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fb Feedback
+	if err := xml.Unmarshal(doc, &fb); err != nil {
+		t.Fatal(err)
+	}
+	if fb.Policy.Domain != "example.org" || fb.Policy.Policy != "reject" || fb.Policy.Percent != 100 {
+		t.Errorf("wrong policy_published: %+v", fb.Policy)
+	}
+	if fb.Metadata.DateRange.Begin != 1600000000 || fb.Metadata.DateRange.End != 1600003600 {
+		t.Errorf("wrong date_range: %+v", fb.Metadata.DateRange)
+	}
+	if len(fb.Records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(fb.Records))
+	}
+	counts := map[string]int{}
+	for _, rec := range fb.Records {
+		if rec.Row.SourceIP != "192.0.2.1" {
+			t.Error("wrong source_ip:", rec.Row.SourceIP)
+		}
+		if rec.Identifiers.HeaderFrom != "example.org" || rec.Identifiers.EnvelopeFrom != "example.com" {
+			t.Errorf("wrong identifiers: %+v", rec.Identifiers)
+		}
+		if len(rec.AuthResults.SPF) != 1 || rec.AuthResults.SPF[0].Domain != "example.com" {
+			t.Errorf("wrong SPF auth_results: %+v", rec.AuthResults.SPF)
+		}
+		counts[rec.Row.PolicyEvaluated.Disposition+"/"+rec.Row.PolicyEvaluated.DKIM] = rec.Row.Count
+	}
+	if counts["none/pass"] != 3 || counts["reject/fail"] != 1 {
+		t.Error("wrong counts:", counts)
+	}
+
+	// Nothing new is collected - nothing is sent.
+	r.Flush(context.Background())
+	if len(tgt.Messages) != 1 {
+		t.Error("empty report is sent")
+	}
+}
+
+func TestReporter_ExternalDestination(t *testing.T) {
+	r := &Reporter{
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"example.org._report._dmarc.thirdparty.example.": {
+				TXT: []string{"v=DMARC1"},
+			},
+		}},
+	}
+	for addr, ok := range map[string]bool{
+		"dmarc@example.org":          true,
+		"dmarc@reports.example.org":  true,
+		"dmarc@thirdparty.example":   true,
+		"dmarc@otherparty.example":   false,
+		"dmarc@a.thirdparty.example": false,
+	} {
+		err := r.verifyDestination(context.Background(), "example.org", addr)
+		if (err == nil) != ok {
+			t.Errorf("%s: want ok=%v, got err=%v", addr, ok, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// send delivers the report to all valid addresses from the rua tag.
+func (r *Reporter) send(ctx context.Context, report *Feedback, rua []string) error {
+	reportID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	report.Metadata.ReportID = reportID
+
+	data, filename, mediaType, err := report.Compress(r.compression, r.hostname)
+	if err != nil {
+		return err
+	}
+
+	domain := report.Policy.Domain
+	var rcpts []string
+	for _, uri := range rua {
+		t, err := parseRUA(uri)
+		if err != nil {
+			r.log.Error("skipping report URI", err, "domain", domain)
+			continue
+		}
+		if t.maxSize != 0 && int64(len(data)) > t.maxSize {
+			r.log.Msg("report exceeds the size limit, skipping", "domain", domain, "rcpt", t.addr,
+				"size", len(data), "max_size", t.maxSize)
+			continue
+		}
+		if err := r.verifyDestination(ctx, domain, t.addr); err != nil {
+			r.log.Error("skipping report URI", err, "domain", domain, "rcpt", t.addr)
+			continue
+		}
+		rcpts = append(rcpts, t.addr)
+	}
+	if len(rcpts) == 0 {
+		return fmt.Errorf("no usable report addresses")
+	}
+
+	var body bytes.Buffer
+	mw := textproto.NewMultipartWriter(&body)
+
+	textHdr := textproto.Header{}
+	textHdr.Add("Content-Type", "text/plain; charset=utf-8")
+	w, err := mw.CreatePart(textHdr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "This is the DMARC aggregate report for %s generated by %s.\r\n", domain, r.hostname)
+
+	attHdr := textproto.Header{}
+	attHdr.Add("Content-Type", mediaType)
+	attHdr.Add("Content-Disposition", "attachment; filename="+filename)
+	attHdr.Add("Content-Transfer-Encoding", "base64")
+	w, err = mw.CreatePart(attHdr)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		fmt.Fprintf(w, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(w, "%s\r\n", encoded)
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	msgCtx, msgTask := trace.NewTask(ctx, "DMARC aggregate report")
+	defer msgTask.End()
+
+	return r.deliver(msgCtx, rcpts,
+		"Report Domain: "+domain+" Submitter: "+r.orgName+" Report-ID: <"+reportID+">",
+		"multipart/mixed; boundary="+mw.Boundary(), body.Bytes())
+}
+
+// deliver submits the report message to deliver_to.
+func (r *Reporter) deliver(ctx context.Context, rcpts []string, subject, contentType string, body []byte) error {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Date", r.now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-ID", "<"+msgID+"@"+r.hostname+">")
+	hdr.Add("From", r.from)
+	hdr.Add("To", strings.Join(rcpts, ", "))
+	hdr.Add("Subject", subject)
+	hdr.Add("Auto-Submitted", "auto-generated")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", contentType)
+
+	d, err := r.target.Start(ctx, &module.MsgMetadata{ID: msgID}, r.from)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, rcpt := range rcpts {
+		if err := d.AddRcpt(ctx, rcpt); err != nil {
+			r.log.Error("failed to add report recipient", err, "rcpt", rcpt)
+			continue
+		}
+		added++
+	}
+	if added == 0 {
+		if err := d.Abort(ctx); err != nil {
+			r.log.Error("failed to abort the report delivery", err)
+		}
+		return fmt.Errorf("all report recipients are rejected")
+	}
+	if err := d.Body(ctx, hdr, buffer.MemoryBuffer{Slice: body}); err != nil {
+		if err := d.Abort(ctx); err != nil {
+			r.log.Error("failed to abort the report delivery", err)
+		}
+		return err
+	}
+	return d.Commit(ctx)
+}
@@ -56,11 +56,6 @@ type Verifier struct {
 	fetchCancel context.CancelFunc
 
 	resolver Resolver
-
-	// TODO(GH #206): DMARC reporting
-	// FailureReportFunc is the callback that is called when a failure report
-	// is generated. If it is nil - failure reports generation is disabled.
-	// FailureReportFunc func(textproto.Header, io.Reader)
 }
 
 func NewVerifier(r Resolver) *Verifier {
@@ -157,11 +152,14 @@ func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
 	}
 
 	result := EvaluateAlignment(data.fromDomain, data.record, authRes)
+	result.PolicyDomain = data.policyDomain
+	result.Record = data.record
 	if result.Authres.Value == authres.ResultPass || result.Authres.Value == authres.ResultNone {
 		return result, dmarc.PolicyNone
 	}
 
 	if data.record.Percent != nil && rand.Int31n(100) > int32(*data.record.Percent) {
+		result.SampledOut = true
 		return result, dmarc.PolicyNone
 	}
 
@@ -0,0 +1,347 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package batch implements the endpoint that injects messages from signed
+// archives created by target.batch into the message pipeline.
+package batch
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/batch"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "batch"
+
+// progressExt is the extension of the file listing IDs of messages already
+// injected from the archive. It is used to not inject them again if the
+// archive processing is interrupted by a temporary error.
+const progressExt = ".done"
+
+type Endpoint struct {
+	dirs     []string
+	log      log.Logger
+	hostname string
+
+	trustedKeys  []ed25519.PublicKey
+	scanInterval time.Duration
+	processedDir string
+
+	pipeline *msgpipeline.MsgPipeline
+
+	scanLock sync.Mutex
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func New(_ string, dirs []string) (module.Module, error) {
+	return &Endpoint{
+		dirs:    dirs,
+		log:     log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+func (endp *Endpoint) Name() string {
+	return modName
+}
+
+func (endp *Endpoint) InstanceName() string {
+	return modName
+}
+
+func (endp *Endpoint) Init(cfg *config.Map) error {
+	var trustedKeys []string
+
+	cfg.Bool("debug", true, false, &endp.log.Debug)
+	cfg.String("hostname", true, true, "", &endp.hostname)
+	cfg.StringList("trusted_keys", false, true, nil, &trustedKeys)
+	cfg.Duration("scan_interval", false, false, time.Minute, &endp.scanInterval)
+	cfg.String("processed_dir", false, false, "", &endp.processedDir)
+	cfg.AllowUnknown()
+	unknown, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	if len(endp.dirs) == 0 {
+		return fmt.Errorf("%s: at least one directory is required", modName)
+	}
+	for _, key := range trustedKeys {
+		pub, err := batch.ParsePublicKey(key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		endp.trustedKeys = append(endp.trustedKeys, pub)
+	}
+	if endp.processedDir != "" {
+		if err := os.MkdirAll(endp.processedDir, 0o700); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+
+	endp.pipeline, err = msgpipeline.New(cfg.Globals, unknown)
+	if err != nil {
+		return err
+	}
+	endp.pipeline.Hostname = endp.hostname
+	endp.pipeline.Log = log.Logger{Name: modName + "/pipeline", Debug: endp.log.Debug}
+
+	go endp.scanLoop()
+	return nil
+}
+
+func (endp *Endpoint) Close() error {
+	close(endp.stop)
+	<-endp.stopped
+	return nil
+}
+
+func (endp *Endpoint) scanLoop() {
+	defer close(endp.stopped)
+
+	endp.scan()
+
+	tick := time.NewTicker(endp.scanInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			endp.scan()
+		case <-endp.stop:
+			return
+		}
+	}
+}
+
+func (endp *Endpoint) scan() {
+	endp.scanLock.Lock()
+	defer endp.scanLock.Unlock()
+
+	for _, dir := range endp.dirs {
+		names, err := archives(dir)
+		if err != nil {
+			endp.log.Error("failed to list archives", err, "dir", dir)
+			continue
+		}
+		for _, name := range names {
+			select {
+			case <-endp.stop:
+				return
+			default:
+			}
+
+			if err := endp.processArchive(filepath.Join(dir, name)); err != nil {
+				endp.log.Error("archive processing failed, will retry later", err, "archive", name)
+			}
+		}
+	}
+}
+
+// archives returns names of complete archives in the directory, oldest first.
+func archives(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, batch.ArchiveExt) {
+			continue
+		}
+		// Signature is written first, archive without it is not complete.
+		if _, err := os.Stat(filepath.Join(dir, name+batch.SignatureExt)); err != nil {
+			continue
+		}
+		res = append(res, name)
+	}
+	// Names contain the creation timestamp.
+	sort.Strings(res)
+	return res, nil
+}
+
+func (endp *Endpoint) processArchive(path string) error {
+	if err := batch.VerifyArchive(path, endp.trustedKeys); err != nil {
+		if !errors.Is(err, batch.ErrBadSignature) {
+			return err
+		}
+		endp.log.Msg("archive signature verification failed, ignoring it", "archive", filepath.Base(path))
+		os.Rename(path+batch.SignatureExt, path+".rejected"+batch.SignatureExt)
+		return os.Rename(path, path+".rejected")
+	}
+
+	done, err := loadProgress(path + progressExt)
+	if err != nil {
+		return err
+	}
+	progress, err := os.OpenFile(path+progressExt, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	injected := 0
+	err = batch.ReadArchive(path, func(env batch.Envelope, r io.Reader) error {
+		if done[env.ID] {
+			return nil
+		}
+
+		if err := endp.inject(env, r); err != nil {
+			if exterrors.IsTemporaryOrUnspec(err) {
+				return err
+			}
+			endp.log.Error("message rejected", err, "batch_id", env.ID)
+		} else {
+			injected++
+		}
+
+		_, err := io.WriteString(progress, env.ID+"\n")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	endp.log.Msg("archive processed", "archive", filepath.Base(path), "messages", injected)
+	return endp.finishArchive(path)
+}
+
+func (endp *Endpoint) finishArchive(path string) error {
+	os.Remove(path + progressExt)
+	if endp.processedDir == "" {
+		os.Remove(path + batch.SignatureExt)
+		return os.Remove(path)
+	}
+
+	name := filepath.Base(path)
+	if err := os.Rename(path+batch.SignatureExt, filepath.Join(endp.processedDir, name+batch.SignatureExt)); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(endp.processedDir, name))
+}
+
+func loadProgress(path string) (map[string]bool, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]bool{}, nil
+		}
+		return nil, err
+	}
+	done := map[string]bool{}
+	for _, id := range strings.Split(string(blob), "\n") {
+		if id != "" {
+			done[id] = true
+		}
+	}
+	return done, nil
+}
+
+func (endp *Endpoint) inject(env batch.Envelope, r io.Reader) error {
+	ctx := context.Background()
+
+	br := bufio.NewReader(r)
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return exterrors.WithTemporary(err, false)
+	}
+	body, err := buffer.BufferInMemory(br)
+	if err != nil {
+		return err
+	}
+
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	msgMeta := &module.MsgMetadata{
+		ID:           msgID,
+		OriginalFrom: env.From,
+		SMTPOpts:     smtp.MailOptions{UTF8: env.UTF8},
+		Facts:        module.NewFacts(),
+	}
+	dlog := target.DeliveryLogger(endp.log, msgMeta)
+	dlog.Msg("incoming message", "sender", env.From, "batch_id", env.ID)
+
+	header.Add("Received", endp.received(msgMeta, env))
+
+	delivery, err := endp.pipeline.Start(ctx, msgMeta, env.From)
+	if err != nil {
+		return err
+	}
+	for _, rcpt := range env.Rcpts {
+		if err := delivery.AddRcpt(ctx, rcpt); err != nil {
+			// Partial failures are not supported, reject only this
+			// recipient.
+			dlog.Error("RCPT error", err, "rcpt", rcpt)
+		}
+	}
+	if err := delivery.Body(ctx, header, body); err != nil {
+		delivery.Abort(ctx) //nolint:errcheck
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func (endp *Endpoint) received(msgMeta *module.MsgMetadata, env batch.Envelope) string {
+	var b strings.Builder
+	b.WriteString("by ")
+	b.WriteString(target.SanitizeForHeader(endp.hostname))
+	if env.From != "" {
+		b.WriteString(" (envelope-sender <")
+		b.WriteString(target.SanitizeForHeader(env.From))
+		b.WriteString(">)")
+	}
+	b.WriteString(" with BATCH id ")
+	b.WriteString(msgMeta.ID)
+	b.WriteString("; ")
+	b.WriteString(time.Now().Format(time.RFC1123Z))
+	return b.String()
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,122 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package batch
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/batch"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestProcessArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maddy-batch-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []batch.Entry
+	for _, id := range []string{"msg1", "msg2"} {
+		path := filepath.Join(dir, id+".eml")
+		if err := ioutil.WriteFile(path, []byte("Subject: "+id+"\r\n\r\nfoo\r\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, batch.Entry{
+			Envelope: batch.Envelope{
+				ID:       id,
+				From:     "from@example.org",
+				Rcpts:    []string{"rcpt@example.com"},
+				Received: time.Now(),
+			},
+			Path: path,
+		})
+	}
+	name, err := batch.WriteArchive(dir, key, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+
+	tgt := testutils.Target{
+		BodyErr: exterrors.WithTemporary(&exterrors.SMTPError{Code: 451}, true),
+	}
+	endp := &Endpoint{
+		log:         testutils.Logger(t, modName),
+		hostname:    "mx.example.org",
+		trustedKeys: []ed25519.PublicKey{pub},
+		pipeline:    msgpipeline.Mock(&tgt, nil),
+	}
+
+	// Temporary error keeps the archive in place.
+	if err := endp.processArchive(path); err == nil {
+		t.Fatal("temporary error is not returned")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("archive is removed after a temporary error")
+	}
+
+	tgt.BodyErr = nil
+	if err := endp.processArchive(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 2 {
+		t.Fatal("wrong amount of messages injected:", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "from@example.org" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "rcpt@example.com" {
+		t.Error("wrong envelope:", msg.MailFrom, msg.RcptTo)
+	}
+	if !strings.Contains(msg.Header.Get("Received"), "with BATCH") {
+		t.Error("Received field is not added:", msg.Header.Get("Received"))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("archive is not removed")
+	}
+
+	// Archive signed by an unknown key is ignored.
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	name, err = batch.WriteArchive(dir, otherKey, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path = filepath.Join(dir, name)
+	if err := endp.processArchive(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 2 {
+		t.Error("messages from untrusted archive are injected")
+	}
+	if _, err := os.Stat(path + ".rejected"); err != nil {
+		t.Error("untrusted archive is not renamed")
+	}
+}
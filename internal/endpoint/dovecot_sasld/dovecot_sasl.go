@@ -40,6 +40,7 @@ type Endpoint struct {
 	log      log.Logger
 	saslAuth auth.SASLAuth
 
+	listeners   []net.Listener
 	listenersWg sync.WaitGroup
 
 	srv *dovecotsasl.Server
@@ -67,6 +68,10 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("account_status", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddAccountStatus(m, node)
+	})
+	cfg.StringList("auth_impersonators", false, false, nil, &endp.saslAuth.Impersonators)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -75,6 +80,11 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	endp.srv.Log = stdlog.New(endp.log, "", 0)
 
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
+		// Channel binding data is not passed via the Dovecot SASL protocol.
+		if strings.HasSuffix(mech, "-PLUS") {
+			continue
+		}
+
 		mech := mech
 		endp.srv.AddMechanism(mech, mechInfo[mech], func(req *dovecotsasl.AuthReq) sasl.Server {
 			var remoteAddr net.Addr
@@ -82,7 +92,12 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 				remoteAddr = &net.TCPAddr{IP: req.RemoteIP, Port: int(req.RemotePort)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, remoteAddr, func(_ string) error { return nil })
+			// Credentials restricted to specific protocols are checked
+			// against the service name reported by the client (e.g. "imap",
+			// "smtp").
+			saslAuth := endp.saslAuth
+			saslAuth.Protocol = req.Service
+			return saslAuth.CreateSASL(mech, remoteAddr, nil, func(_ string) error { return nil })
 		})
 	}
 
@@ -97,6 +112,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
 		endp.log.Printf("listening on %v", l.Addr())
+		endp.listeners = append(endp.listeners, l)
 
 		endp.listenersWg.Add(1)
 		go func() {
@@ -113,7 +129,12 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 }
 
 func (endp *Endpoint) Close() error {
-	return endp.srv.Close()
+	for _, l := range endp.listeners {
+		l.Close()
+	}
+	err := endp.srv.Close()
+	endp.listenersWg.Wait()
+	return err
 }
 
 func init() {
@@ -21,6 +21,7 @@ package dovecotsasld
 import (
 	"github.com/emersion/go-sasl"
 	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/foxcpp/maddy/internal/auth"
 )
 
 var mechInfo = map[string]dovecotsasl.Mechanism{
@@ -30,4 +31,13 @@ var mechInfo = map[string]dovecotsasl.Mechanism{
 	sasl.Login: {
 		Plaintext: true,
 	},
+	sasl.OAuthBearer: {
+		Plaintext: true,
+	},
+	auth.XOAuth2: {
+		Plaintext: true,
+	},
+	auth.SCRAMSHA256: {
+		MutualAuth: true,
+	},
 }
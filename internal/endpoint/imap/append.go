@@ -0,0 +1,273 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// appendExtension replaces the built-in APPEND command handler to implement
+// CATENATE (RFC 4469), MULTIAPPEND (RFC 3502) and APPENDUID response code
+// from UIDPLUS (RFC 4315).
+//
+// If multiAppend is set, the handler accepts multiple messages and passes
+// them to the storage backend as a single batch.
+type appendExtension struct {
+	multiAppend bool
+	uidPlus     bool
+}
+
+func (ext *appendExtension) Capabilities(c imapserver.Conn) []string {
+	caps := []string{"CATENATE"}
+	if ext.multiAppend {
+		caps = append(caps, "MULTIAPPEND")
+	}
+	return caps
+}
+
+func (ext *appendExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "APPEND" {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &appendHandler{ext: ext}
+	}
+}
+
+// catenatePart is a part of the message specified using CATENATE.
+// Either Text or URL is set.
+type catenatePart struct {
+	Text imap.Literal
+	URL  string
+}
+
+type appendMessage struct {
+	module.IMAPAppendMessage
+
+	// If not nil, message body should be constructed from these parts.
+	Parts []catenatePart
+}
+
+type appendHandler struct {
+	ext *appendExtension
+
+	Mailbox  string
+	Messages []appendMessage
+}
+
+func (cmd *appendHandler) Parse(fields []interface{}) error {
+	if len(fields) < 2 {
+		return errors.New("No enough arguments")
+	}
+
+	mailbox, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	mailbox, err = utf7.Encoding.NewDecoder().String(mailbox)
+	if err != nil {
+		return err
+	}
+	cmd.Mailbox = imap.CanonicalMailboxName(mailbox)
+
+	fields = fields[1:]
+	for len(fields) != 0 {
+		var msg appendMessage
+
+		if flags, ok := fields[0].([]interface{}); ok {
+			msg.Flags, err = imap.ParseStringList(flags)
+			if err != nil {
+				return err
+			}
+			for i, flag := range msg.Flags {
+				msg.Flags[i] = imap.CanonicalFlag(flag)
+			}
+			fields = fields[1:]
+		}
+
+		if len(fields) != 0 {
+			if date, ok := fields[0].(string); ok && !strings.EqualFold(date, "CATENATE") {
+				msg.Date, err = time.Parse(imap.DateTimeLayout, date)
+				if err != nil {
+					return err
+				}
+				fields = fields[1:]
+			}
+		}
+
+		if len(fields) == 0 {
+			return errors.New("Message must be a literal")
+		}
+		if name, ok := fields[0].(string); ok && strings.EqualFold(name, "CATENATE") {
+			if len(fields) < 2 {
+				return errors.New("Missing CATENATE parts")
+			}
+			parts, ok := fields[1].([]interface{})
+			if !ok {
+				return errors.New("CATENATE parts must be a list")
+			}
+			msg.Parts, err = parseCatenateParts(parts)
+			if err != nil {
+				return err
+			}
+			fields = fields[2:]
+
+			cmd.Messages = append(cmd.Messages, msg)
+			continue
+		}
+		lit, ok := fields[0].(imap.Literal)
+		if !ok {
+			return errors.New("Message must be a literal")
+		}
+		msg.Body = lit
+		fields = fields[1:]
+
+		cmd.Messages = append(cmd.Messages, msg)
+	}
+
+	if len(cmd.Messages) > 1 && !cmd.ext.multiAppend {
+		return errors.New("Multiple messages in APPEND are not supported")
+	}
+
+	return nil
+}
+
+func parseCatenateParts(fields []interface{}) ([]catenatePart, error) {
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return nil, errors.New("Malformed CATENATE parts")
+	}
+
+	parts := make([]catenatePart, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		kind, ok := fields[i].(string)
+		if !ok {
+			return nil, errors.New("Malformed CATENATE parts")
+		}
+		switch strings.ToUpper(kind) {
+		case "TEXT":
+			lit, ok := fields[i+1].(imap.Literal)
+			if !ok {
+				return nil, errors.New("CATENATE TEXT must be a literal")
+			}
+			parts = append(parts, catenatePart{Text: lit})
+		case "URL":
+			url, err := imap.ParseString(fields[i+1])
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, catenatePart{URL: url})
+		default:
+			return nil, errors.New("Unknown CATENATE part type: " + kind)
+		}
+	}
+	return parts, nil
+}
+
+func (cmd *appendHandler) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	if err == imapbackend.ErrNoSuchMailbox {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		})
+	} else if err != nil {
+		return err
+	}
+
+	msgs := make([]module.IMAPAppendMessage, 0, len(cmd.Messages))
+	for _, msg := range cmd.Messages {
+		if msg.Parts != nil {
+			msg.Body, err = catenate(ctx.User, msg.Parts)
+			if err != nil {
+				return err
+			}
+		}
+		msgs = append(msgs, msg.IMAPAppendMessage)
+	}
+
+	var okResp *imap.StatusResp
+	if len(msgs) == 1 {
+		msg := msgs[0]
+		uidMbox, ok := mbox.(module.UIDPlusMailbox)
+		if cmd.ext.uidPlus && ok {
+			var uidValidity, uid uint32
+			uidValidity, uid, err = uidMbox.CreateMessageUID(msg.Flags, msg.Date, msg.Body)
+			okResp = &imap.StatusResp{
+				Type:      imap.StatusRespOk,
+				Code:      "APPENDUID",
+				Arguments: []interface{}{uidValidity, uid},
+			}
+		} else {
+			err = mbox.CreateMessage(msg.Flags, msg.Date, msg.Body)
+		}
+	} else {
+		multiMbox, ok := mbox.(module.MultiAppendMailbox)
+		if !ok {
+			return errors.New("Multiple messages in APPEND are not supported")
+		}
+		err = multiMbox.CreateMessages(msgs)
+	}
+	if err != nil {
+		if err == imapbackend.ErrTooBig {
+			return imapserver.ErrStatusResp(&imap.StatusResp{
+				Type: imap.StatusRespNo,
+				Code: "TOOBIG",
+				Info: "Message size exceeding limit",
+			})
+		}
+		return err
+	}
+
+	// Same as for built-in APPEND, send an untagged EXISTS if the backend
+	// doesn't send updates itself.
+	if conn.Server().Updates == nil && ctx.Mailbox != nil && ctx.Mailbox.Name() == mbox.Name() {
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+		if err != nil {
+			return err
+		}
+		status.Flags = nil
+		status.PermanentFlags = nil
+		status.UnseenSeqNum = 0
+
+		if err := conn.WriteResp(&responses.Select{Mailbox: status}); err != nil {
+			return err
+		}
+	}
+
+	if okResp != nil {
+		return imapserver.ErrStatusResp(okResp)
+	}
+	return nil
+}
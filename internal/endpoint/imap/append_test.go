@@ -0,0 +1,80 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestAppendParse(t *testing.T) {
+	lit1 := bytes.NewBufferString("Subject: 1\r\n\r\n")
+	lit2 := bytes.NewBufferString("Subject: 2\r\n\r\n")
+	lit3 := bytes.NewBufferString("Subject: 3\r\n\r\n")
+
+	cmd := appendHandler{ext: &appendExtension{multiAppend: true}}
+	err := cmd.Parse([]interface{}{
+		"INBOX",
+		[]interface{}{"\\Seen", "\\Flagged"}, "06-Sep-2020 12:00:00 +0000", lit1,
+		lit2,
+		[]interface{}{}, lit3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Mailbox != "INBOX" {
+		t.Errorf("wrong mailbox: %s", cmd.Mailbox)
+	}
+	if len(cmd.Messages) != 3 {
+		t.Fatalf("wrong amount of messages: %d", len(cmd.Messages))
+	}
+	if !reflect.DeepEqual(cmd.Messages[0].Flags, []string{imap.SeenFlag, imap.FlaggedFlag}) {
+		t.Errorf("wrong flags: %v", cmd.Messages[0].Flags)
+	}
+	if !cmd.Messages[0].Date.Equal(time.Date(2020, 9, 6, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong date: %v", cmd.Messages[0].Date)
+	}
+	if cmd.Messages[1].Flags != nil || !cmd.Messages[1].Date.IsZero() {
+		t.Errorf("unexpected flags or date for message without them: %+v", cmd.Messages[1])
+	}
+	if cmd.Messages[2].Body != lit3 {
+		t.Errorf("wrong literal for the last message")
+	}
+
+	for _, fields := range [][]interface{}{
+		{"INBOX"},
+		{"INBOX", lit1, []interface{}{"\\Seen"}},
+		{"INBOX", "06-Sep-2020 12:00:00 +0000"},
+	} {
+		cmd := appendHandler{ext: &appendExtension{multiAppend: true}}
+		if err := cmd.Parse(fields); err == nil {
+			t.Errorf("expected error for %v", fields)
+		}
+	}
+
+	cmd = appendHandler{ext: &appendExtension{}}
+	if err := cmd.Parse([]interface{}{"INBOX", lit1, lit2}); err == nil {
+		t.Errorf("expected error for multiple messages without MULTIAPPEND")
+	}
+}
@@ -0,0 +1,347 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math"
+	"mime/quotedprintable"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// binaryExtension is the BINARY (RFC 3516) server extension.
+//
+// go-imap parser does not know about literal8 syntax (~{N}), so each
+// connection is wrapped into literal8Conn that tokenizes commands received
+// from the client and passes literal8 arguments of APPEND to the parser as
+// regular literals. BINARY fetch items are handled by fetchHandler.
+type binaryExtension struct {
+	log log.Logger
+}
+
+func (ext *binaryExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{"BINARY"}
+}
+
+func (ext *binaryExtension) Command(name string) imapserver.HandlerFactory {
+	if name != "FETCH" {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &fetchHandler{}
+	}
+}
+
+func (ext *binaryExtension) NewConn(c imapserver.Conn) imapserver.Conn {
+	// Connection is not served yet, so there is nothing to wait for.
+	err := c.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		return newLiteral8Conn(conn), nil
+	})
+	if err != nil {
+		ext.log.Error("failed to set up literal8 parsing", err, "src_ip", c.Info().RemoteAddr)
+		c.Close()
+	}
+	return &binaryConn{Conn: c}
+}
+
+// binaryConn makes sure literal8Conn stays the outermost wrapper for the
+// connection after STARTTLS or COMPRESS.
+type binaryConn struct {
+	imapserver.Conn
+}
+
+func (c *binaryConn) Upgrade(upgrader imap.ConnUpgrader) error {
+	return c.Conn.Upgrade(func(conn net.Conn) (net.Conn, error) {
+		if l8, ok := conn.(*literal8Conn); ok {
+			conn = l8.Conn
+		}
+		upgraded, err := upgrader(conn)
+		if err != nil {
+			return nil, err
+		}
+		return newLiteral8Conn(upgraded), nil
+	})
+}
+
+// Info returns connection information. go-imap detects TLS by checking
+// the connection type, this does not work once the connection is wrapped.
+func (c *binaryConn) Info() *imap.ConnInfo {
+	info := c.Conn.Info()
+	if info.TLS == nil {
+		info.TLS = c.Conn.TLSState()
+	}
+	return info
+}
+
+// maxCommandHead is the maximum length of the tag and command name that
+// literal8Conn looks at to find the command name.
+const maxCommandHead = 64
+
+// literal8Conn tokenizes commands received from the client the same way
+// go-imap parser does and replaces literal8 markers with regular literal
+// markers. RFC 3516 permits literal8 only for the message in APPEND, markers
+// in other commands are passed as is and are rejected by the parser. Quoted
+// strings and literal contents are never altered.
+type literal8Conn struct {
+	net.Conn
+	r *bufio.Reader
+
+	// Remaining length of the literal being passed through.
+	literal int64
+	// Data to return from Read.
+	pending []byte
+	err     error
+
+	// Beginning of the command line until the command name is known.
+	head     []byte
+	headDone bool
+	isAppend bool
+
+	// The next byte starts a new field.
+	fieldStart bool
+	quoted     bool
+	escaped    bool
+}
+
+func newLiteral8Conn(c net.Conn) *literal8Conn {
+	return &literal8Conn{Conn: c, r: bufio.NewReader(c), fieldStart: true}
+}
+
+func (c *literal8Conn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.literal > 0 {
+			if int64(len(b)) > c.literal {
+				b = b[:c.literal]
+			}
+			n, err := c.r.Read(b)
+			c.literal -= int64(n)
+			return n, err
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.fill()
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 {
+		c.pending = nil
+	}
+	return n, nil
+}
+
+// fill processes bytes received from the client until the end of line,
+// the beginning of a literal or until no more data is buffered.
+func (c *literal8Conn) fill() {
+	for {
+		if len(c.pending) != 0 && c.r.Buffered() == 0 {
+			return
+		}
+
+		ch, err := c.r.ReadByte()
+		if err != nil {
+			c.err = err
+			return
+		}
+
+		if !c.headDone {
+			c.readHead(ch)
+		}
+
+		switch {
+		case c.quoted:
+			c.pending = append(c.pending, ch)
+			switch {
+			case c.escaped:
+				c.escaped = false
+			case ch == '\\':
+				c.escaped = true
+			case ch == '"':
+				c.quoted = false
+			case ch == '\n':
+				c.endLine()
+				return
+			}
+		case ch == '"':
+			c.pending = append(c.pending, ch)
+			c.quoted = true
+			c.fieldStart = false
+		case ch == '~' && c.fieldStart && c.isAppend && c.peek() == '{':
+			// Drop '~', the marker is passed as a regular literal marker.
+			c.r.ReadByte() //nolint:errcheck
+			c.pending = append(c.pending, '{')
+			c.readLiteralMarker()
+			if c.literal > 0 {
+				return
+			}
+		case ch == '{' && c.fieldStart:
+			c.pending = append(c.pending, ch)
+			c.readLiteralMarker()
+			if c.literal > 0 {
+				return
+			}
+		case ch == '\n':
+			c.pending = append(c.pending, ch)
+			c.endLine()
+			return
+		default:
+			c.pending = append(c.pending, ch)
+			c.fieldStart = ch == ' ' || ch == '('
+		}
+	}
+}
+
+func (c *literal8Conn) peek() byte {
+	b, err := c.r.Peek(1)
+	if err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+// readHead collects the tag and the command name.
+func (c *literal8Conn) readHead(ch byte) {
+	if ch == ' ' {
+		if i := bytes.IndexByte(c.head, ' '); i != -1 {
+			c.isAppend = strings.EqualFold(string(c.head[i+1:]), "APPEND")
+			c.headDone = true
+			return
+		}
+	}
+	if ch == '\r' || ch == '\n' || len(c.head) >= maxCommandHead {
+		c.headDone = true
+		return
+	}
+	c.head = append(c.head, ch)
+}
+
+// readLiteralMarker reads the rest of the literal marker after '{' and
+// starts passing through the literal if the marker is well-formed.
+// Otherwise, the data is passed as is and the parser reports the error.
+func (c *literal8Conn) readLiteralMarker() {
+	c.fieldStart = false
+
+	var size int64
+	for {
+		ch, err := c.r.ReadByte()
+		if err != nil {
+			c.err = err
+			return
+		}
+		if ch >= '0' && ch <= '9' {
+			if size <= math.MaxUint32 {
+				size = size*10 + int64(ch-'0')
+			}
+			c.pending = append(c.pending, ch)
+			continue
+		}
+		if ch == '+' && c.peek() == '}' {
+			c.pending = append(c.pending, ch)
+			continue
+		}
+		if ch != '}' {
+			c.r.UnreadByte() //nolint:errcheck
+			return
+		}
+		c.pending = append(c.pending, ch)
+		break
+	}
+	if size > math.MaxUint32 {
+		return
+	}
+
+	// go-imap accepts bare LF too.
+	if c.peek() == '\r' {
+		ch, _ := c.r.ReadByte()
+		c.pending = append(c.pending, ch)
+	}
+	if c.peek() != '\n' {
+		return
+	}
+	ch, _ := c.r.ReadByte()
+	c.pending = append(c.pending, ch)
+	c.literal = size
+}
+
+// endLine resets the tokenizer state at the end of the command line.
+func (c *literal8Conn) endLine() {
+	c.head = c.head[:0]
+	c.headDone = false
+	c.isAppend = false
+	c.fieldStart = true
+	c.quoted = false
+	c.escaped = false
+}
+
+func (c *literal8Conn) Flush() error {
+	if f, ok := c.Conn.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+var errUnknownCTE = errors.New("imap: unknown Content-Transfer-Encoding")
+
+// decodeBinary removes Content-Transfer-Encoding from the body part
+// contents.
+func decodeBinary(encoding string, data []byte) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", "7bit", "8bit", "binary":
+		return data, nil
+	case "base64":
+		data = bytes.Map(func(r rune) rune {
+			switch r {
+			case '\r', '\n', ' ', '\t':
+				return -1
+			}
+			return r
+		}, data)
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(out, data)
+		if err != nil {
+			return nil, err
+		}
+		return out[:n], nil
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+	default:
+		return nil, errUnknownCTE
+	}
+}
+
+// binaryLiteral returns the value to send for the BINARY[] fetch item.
+// Data containing NUL bytes needs to be sent as literal8.
+func binaryLiteral(data []byte) interface{} {
+	if bytes.IndexByte(data, 0) == -1 {
+		return bytes.NewReader(data)
+	}
+	return imap.RawString("~{" + strconv.Itoa(len(data)) + "}\r\n" + string(data))
+}
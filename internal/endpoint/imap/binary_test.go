@@ -0,0 +1,270 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func TestLiteral8Conn(t *testing.T) {
+	long := strings.Repeat("a", 5000)
+	in := "a1 APPEND INBOX ~{7}\r\nx~{1}\r\n\r\n" +
+		"a2 APPEND INBOX ~{3+}\r\nxyz\r\n" +
+		"a3 APPEND INBOX {2}\r\n~{\r\n" +
+		"a4 APPEND INBOX (\\Seen) \"" + long + "\" ~{2}\r\nzz\r\n" +
+		"a5 APPEND INBOX CATENATE (TEXT ~{1}\r\nz URL \"/INBOX/;UID=1\")\r\n" +
+		"a6 APPEND INBOX ~{1}\r\nz ~{2}\r\nzz\r\n" +
+		"a7 APPEND INBOX \"x ~{2}\r\n" +
+		"a8 SELECT ~{5}\r\nINBOX\r\n" +
+		"a9 SEARCH SUBJECT \"\\\" ~{3}\"\r\n" +
+		"a10 APPEND INBOX {99999999999}\r\n~{1}\r\n"
+	expected := "a1 APPEND INBOX {7}\r\nx~{1}\r\n\r\n" +
+		"a2 APPEND INBOX {3+}\r\nxyz\r\n" +
+		"a3 APPEND INBOX {2}\r\n~{\r\n" +
+		"a4 APPEND INBOX (\\Seen) \"" + long + "\" {2}\r\nzz\r\n" +
+		"a5 APPEND INBOX CATENATE (TEXT {1}\r\nz URL \"/INBOX/;UID=1\")\r\n" +
+		"a6 APPEND INBOX {1}\r\nz {2}\r\nzz\r\n" +
+		// Literal8 markers are not converted in quoted strings, in commands
+		// other than APPEND and after a malformed marker.
+		"a7 APPEND INBOX \"x ~{2}\r\n" +
+		"a8 SELECT ~{5}\r\nINBOX\r\n" +
+		"a9 SEARCH SUBJECT \"\\\" ~{3}\"\r\n" +
+		"a10 APPEND INBOX {99999999999}\r\n~{1}\r\n"
+
+	c := newLiteral8Conn(readerConn{r: strings.NewReader(in)})
+	out, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != expected {
+		t.Errorf("Wrong data read:\n%q\nexpected:\n%q", out, expected)
+	}
+}
+
+// testIMAPConn is a minimal IMAP client for testing raw protocol
+// exchanges.
+type testIMAPConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func testIMAPServer(t *testing.T, exts ...imapserver.Extension) *testIMAPConn {
+	t.Helper()
+
+	serv := imapserver.New(memory.New())
+	serv.AllowInsecureAuth = true
+	serv.Enable(exts...)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { serv.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testIMAPConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.readUntil("* OK")
+	c.cmd("a0 LOGIN username password")
+	return c
+}
+
+func (c *testIMAPConn) readUntil(prefix string) string {
+	c.t.Helper()
+
+	var resp strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		resp.WriteString(line)
+		if strings.HasPrefix(line, prefix) {
+			return resp.String()
+		}
+	}
+}
+
+// cmd sends the command and returns all responses to it, the tagged
+// response is the last line.
+func (c *testIMAPConn) cmd(cmd string) string {
+	c.t.Helper()
+
+	if _, err := io.WriteString(c.conn, cmd+"\r\n"); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.readUntil(strings.Fields(cmd)[0] + " ")
+}
+
+func TestBinary(t *testing.T) {
+	c := testIMAPServer(t, &binaryExtension{}, &appendExtension{})
+
+	if resp := c.cmd("a1 CAPABILITY"); !strings.Contains(resp, " BINARY") || !strings.Contains(resp, " CATENATE") {
+		t.Fatalf("BINARY or CATENATE is not advertised: %s", resp)
+	}
+
+	msg := "From: <test@example.org>\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hello\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AAECd29ybGQ=\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: x-unknown\r\n" +
+		"\r\n" +
+		"data\r\n" +
+		"--b--\r\n"
+	resp := c.cmd("a2 APPEND INBOX ~{" + strconv.Itoa(len(msg)) + "+}\r\n" + msg)
+	if !strings.HasPrefix(lastLine(resp), "a2 OK") {
+		t.Fatalf("APPEND with literal8 failed: %s", resp)
+	}
+
+	c.cmd("a3 SELECT INBOX")
+
+	resp = c.cmd("a4 FETCH 2 (BINARY.SIZE[2] BINARY.PEEK[2] BINARY.PEEK[1]<1.3>)")
+	if !strings.HasPrefix(lastLine(resp), "a4 OK") {
+		t.Fatalf("FETCH failed: %s", resp)
+	}
+	if !strings.Contains(resp, "BINARY.SIZE[2] 8") {
+		t.Errorf("Wrong BINARY.SIZE: %s", resp)
+	}
+	if !strings.Contains(resp, "BINARY[2] ~{8}\r\n\x00\x01\x02world") {
+		t.Errorf("Wrong BINARY content: %q", resp)
+	}
+	if !strings.Contains(resp, "BINARY[1]<1> {3}\r\nell") {
+		t.Errorf("Wrong BINARY partial content: %q", resp)
+	}
+	if strings.Contains(resp, "BODY") {
+		t.Errorf("Unexpected BODY items in response: %s", resp)
+	}
+
+	resp = c.cmd("a5 FETCH 2 (BINARY.PEEK[3])")
+	if !strings.HasPrefix(lastLine(resp), "a5 NO [UNKNOWN-CTE]") {
+		t.Errorf("Expected UNKNOWN-CTE, got: %s", resp)
+	}
+}
+
+func TestCatenate(t *testing.T) {
+	c := testIMAPServer(t, &binaryExtension{}, &appendExtension{})
+
+	c.cmd("a1 SELECT INBOX")
+	resp := c.cmd("a2 UID FETCH 1:* (UID)")
+	uid := strings.TrimSuffix(strings.Fields(resp)[4], ")")
+
+	hdr := "Subject: Forward\r\n\r\n"
+	resp = c.cmd("a3 APPEND INBOX CATENATE (TEXT {" + strconv.Itoa(len(hdr)) + "+}\r\n" + hdr +
+		" URL \"/INBOX/;UID=" + uid + "/;SECTION=TEXT\")")
+	if !strings.HasPrefix(lastLine(resp), "a3 OK") {
+		t.Fatalf("APPEND with CATENATE failed: %s", resp)
+	}
+
+	resp = c.cmd("a4 FETCH 2 (BODY.PEEK[])")
+	if !strings.Contains(resp, "Subject: Forward\r\n\r\nHi there :)") {
+		t.Errorf("Wrong message content: %q", resp)
+	}
+
+	// Message from a mailbox other than the target one.
+	c.cmd("a5 CREATE Archive")
+	msg := "Subject: Archived\r\n\r\nOld message"
+	c.cmd("a6 APPEND Archive {" + strconv.Itoa(len(msg)) + "+}\r\n" + msg)
+	resp = c.cmd("a7 STATUS Archive (UIDNEXT UIDVALIDITY)")
+	fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(strings.Split(resp, "\r\n")[0]))
+	var archiveUID, archiveValidity string
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "UIDNEXT":
+			next, _ := strconv.Atoi(fields[i+1])
+			archiveUID = strconv.Itoa(next - 1)
+		case "UIDVALIDITY":
+			archiveValidity = fields[i+1]
+		}
+	}
+	resp = c.cmd("a8 APPEND INBOX CATENATE (TEXT {" + strconv.Itoa(len(hdr)) + "+}\r\n" + hdr +
+		" URL \"imap://username;AUTH=*@mx.example.org/Archive;UIDVALIDITY=" + archiveValidity +
+		"/;UID=" + archiveUID + "/;SECTION=TEXT/;PARTIAL=0.3\")")
+	if !strings.HasPrefix(lastLine(resp), "a8 OK") {
+		t.Fatalf("APPEND with CATENATE from another mailbox failed: %s", resp)
+	}
+	resp = c.cmd("a9 FETCH 3 (BODY.PEEK[])")
+	if !strings.Contains(resp, "Subject: Forward\r\n\r\nOld)") {
+		t.Errorf("Wrong message content: %q", resp)
+	}
+
+	for i, url := range []string{
+		// No such message.
+		"/INBOX/;UID=100",
+		// No such mailbox.
+		"/Missing/;UID=1",
+		"/Archive;UIDVALIDITY=" + archiveValidity + "0/;UID=" + archiveUID,
+		// Mailbox of another user.
+		"imap://otheruser@mx.example.org/Archive/;UID=" + archiveUID,
+		// Anonymous access.
+		"imap://mx.example.org/Archive/;UID=" + archiveUID,
+		"/Archive/;UID=" + archiveUID + "/;URLAUTH=anonymous:internal:0123456789abcdef",
+		"/Archive/;UID=" + archiveUID + "/;SECTION=ABC",
+		"/Archive",
+		"Archive/;UID=" + archiveUID,
+	} {
+		tag := "b" + strconv.Itoa(i)
+		resp = c.cmd(tag + " APPEND INBOX CATENATE (URL \"" + url + "\")")
+		if !strings.HasPrefix(lastLine(resp), tag+" NO [BADURL \""+url+"\"]") {
+			t.Errorf("Expected BADURL for %s, got: %s", url, resp)
+		}
+	}
+
+	resp = c.cmd("c1 STATUS INBOX (MESSAGES)")
+	if !strings.Contains(resp, "MESSAGES 3") {
+		t.Errorf("Messages with bad URLs are appended: %s", resp)
+	}
+}
+
+func lastLine(resp string) string {
+	lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,241 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/internal/auth"
+)
+
+// imapURL is a parsed IMAP URL (RFC 5092) referring to a message or its
+// part.
+type imapURL struct {
+	// User from the authority part of the absolute URL. Empty for absolute
+	// path URLs.
+	User        string
+	Mailbox     string
+	UIDValidity uint32
+	UID         uint32
+	Section     string
+	// Offset and, optionally, length.
+	Partial []uint32
+}
+
+// parseIMAPURL parses the absolute or the absolute path form of the IMAP
+// URL. Host in the authority part of the URL is not checked, it is up to
+// the caller to check the user. URLAUTH is not supported.
+func parseIMAPURL(s string) (*imapURL, error) {
+	var (
+		u   imapURL
+		err error
+	)
+
+	path := s
+	if len(s) >= len("imap://") && strings.EqualFold(s[:len("imap://")], "imap://") {
+		rest := s[len("imap://"):]
+		i := strings.IndexByte(rest, '/')
+		if i == -1 {
+			return nil, errors.New("imap: URL does not contain a path")
+		}
+		path = rest[i:]
+
+		authority := rest[:i]
+		at := strings.LastIndexByte(authority, '@')
+		if at == -1 {
+			return nil, errors.New("imap: anonymous URLs are not supported")
+		}
+		user := authority[:at]
+		if i := strings.Index(strings.ToUpper(user), ";AUTH="); i != -1 {
+			user = user[:i]
+		}
+		u.User, err = url.PathUnescape(user)
+		if err != nil {
+			return nil, err
+		}
+		if u.User == "" {
+			return nil, errors.New("imap: URL does not contain a user name")
+		}
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, errors.New("imap: relative URLs are not supported")
+	}
+	// ';' is not allowed in other parts of the URL without escaping.
+	if upper := strings.ToUpper(path); strings.Contains(upper, ";URLAUTH=") || strings.Contains(upper, ";EXPIRE=") {
+		return nil, errors.New("imap: URLAUTH is not supported")
+	}
+
+	comps := strings.Split(path[1:], "/;")
+
+	mbox := comps[0]
+	if i := strings.Index(strings.ToUpper(mbox), ";UIDVALIDITY="); i != -1 {
+		val, err := strconv.ParseUint(mbox[i+len(";UIDVALIDITY="):], 10, 32)
+		if err != nil {
+			return nil, errors.New("imap: malformed UIDVALIDITY in URL")
+		}
+		u.UIDValidity = uint32(val)
+		mbox = mbox[:i]
+	}
+	u.Mailbox, err = url.PathUnescape(mbox)
+	if err != nil {
+		return nil, err
+	}
+	if u.Mailbox == "" {
+		return nil, errors.New("imap: URL does not contain a mailbox name")
+	}
+	u.Mailbox = imap.CanonicalMailboxName(u.Mailbox)
+
+	for _, comp := range comps[1:] {
+		eq := strings.IndexByte(comp, '=')
+		if eq == -1 {
+			return nil, errors.New("imap: malformed URL component")
+		}
+		key, value := strings.ToUpper(comp[:eq]), comp[eq+1:]
+		switch key {
+		case "UID":
+			val, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || val == 0 {
+				return nil, errors.New("imap: malformed UID in URL")
+			}
+			u.UID = uint32(val)
+		case "SECTION":
+			u.Section, err = url.PathUnescape(value)
+			if err != nil {
+				return nil, err
+			}
+		case "PARTIAL":
+			for _, n := range strings.SplitN(value, ".", 2) {
+				val, err := strconv.ParseUint(n, 10, 32)
+				if err != nil {
+					return nil, errors.New("imap: malformed PARTIAL in URL")
+				}
+				u.Partial = append(u.Partial, uint32(val))
+			}
+		default:
+			return nil, errors.New("imap: unsupported URL component: " + key)
+		}
+	}
+	if u.UID == 0 {
+		return nil, errors.New("imap: URL does not contain a message UID")
+	}
+
+	return &u, nil
+}
+
+func badURL(urlStr string, err error) error {
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespNo,
+		Code:      "BADURL",
+		Arguments: []interface{}{urlStr},
+		Info:      err.Error(),
+	})
+}
+
+// fetchURL returns the contents of the message part referenced by the IMAP
+// URL.
+func fetchURL(user imapbackend.User, urlStr string) ([]byte, error) {
+	u, err := parseIMAPURL(urlStr)
+	if err != nil {
+		return nil, badURL(urlStr, err)
+	}
+	// Mailboxes of other users are not accessible without URLAUTH.
+	if u.User != "" && auth.NormalizeUsername(u.User) != auth.NormalizeUsername(user.Username()) {
+		return nil, badURL(urlStr, errors.New("URL refers to a mailbox of another user"))
+	}
+
+	mbox, err := user.GetMailbox(u.Mailbox)
+	if err != nil {
+		return nil, badURL(urlStr, err)
+	}
+
+	if u.UIDValidity != 0 {
+		status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+		if err != nil {
+			return nil, err
+		}
+		if status.UidValidity != u.UIDValidity {
+			return nil, badURL(urlStr, errors.New("UIDVALIDITY mismatch"))
+		}
+	}
+
+	sect, err := imap.ParseBodySectionName(imap.FetchItem("BODY.PEEK[" + u.Section + "]"))
+	if err != nil {
+		return nil, badURL(urlStr, err)
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(u.UID)
+	ch := make(chan *imap.Message, 1)
+	if err := mbox.ListMessages(true, seqset, []imap.FetchItem{sect.FetchItem()}, ch); err != nil {
+		return nil, err
+	}
+	msg := <-ch
+	if msg == nil {
+		return nil, badURL(urlStr, errors.New("No such message"))
+	}
+	lit := getBody(msg, sect)
+	if lit == nil {
+		return nil, badURL(urlStr, errors.New("No such message part"))
+	}
+	data, err := io.ReadAll(lit)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(u.Partial) != 0 {
+		offset := u.Partial[0]
+		if offset > uint32(len(data)) {
+			offset = uint32(len(data))
+		}
+		data = data[offset:]
+		if len(u.Partial) == 2 && u.Partial[1] < uint32(len(data)) {
+			data = data[:u.Partial[1]]
+		}
+	}
+
+	return data, nil
+}
+
+// catenate constructs the message body from CATENATE parts.
+func catenate(user imapbackend.User, parts []catenatePart) (imap.Literal, error) {
+	var buf bytes.Buffer
+	for _, part := range parts {
+		if part.Text != nil {
+			if _, err := io.Copy(&buf, part.Text); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		data, err := fetchURL(user, part.URL)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	return bytes.NewReader(buf.Bytes()), nil
+}
@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	compress "github.com/emersion/go-imap-compress"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// compressExtension is the COMPRESS=DEFLATE (RFC 4978) server extension.
+//
+// It reuses command parsing from go-imap-compress but provides its own
+// connection wrapper to allow configuring compression level and
+// collecting compression statistics.
+type compressExtension struct {
+	modName string
+	level   int
+
+	// active contains connections that have compression enabled.
+	activeLock sync.Mutex
+	active     map[imapserver.Conn]struct{}
+}
+
+func (ext *compressExtension) setActive(conn imapserver.Conn, active bool) {
+	ext.activeLock.Lock()
+	defer ext.activeLock.Unlock()
+	if ext.active == nil {
+		ext.active = make(map[imapserver.Conn]struct{})
+	}
+	if active {
+		ext.active[conn] = struct{}{}
+	} else {
+		delete(ext.active, conn)
+	}
+}
+
+func (ext *compressExtension) isActive(conn imapserver.Conn) bool {
+	ext.activeLock.Lock()
+	defer ext.activeLock.Unlock()
+	_, ok := ext.active[conn]
+	return ok
+}
+
+func (ext *compressExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{compress.Capability + "=" + compress.Deflate}
+}
+
+func (ext *compressExtension) Command(name string) imapserver.HandlerFactory {
+	if name != compress.Capability {
+		return nil
+	}
+
+	return func() imapserver.Handler {
+		return &compressHandler{ext: ext}
+	}
+}
+
+type compressHandler struct {
+	compress.Handler
+	ext *compressExtension
+}
+
+func (h *compressHandler) Handle(conn imapserver.Conn) error {
+	if h.ext.isActive(conn) {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "COMPRESSIONACTIVE",
+			Info: "DEFLATE is already active",
+		}}
+	}
+	return h.Handler.Handle(conn)
+}
+
+func (h *compressHandler) Upgrade(conn imapserver.Conn) error {
+	return conn.Upgrade(func(c net.Conn) (net.Conn, error) {
+		dc, err := newDeflateConn(c, h.ext.modName, h.ext.level)
+		if err != nil {
+			return nil, err
+		}
+		h.ext.setActive(conn, true)
+		dc.onClose = func() { h.ext.setActive(conn, false) }
+		return dc, nil
+	})
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// countingConn counts bytes actually transferred over the wire.
+type countingConn struct {
+	net.Conn
+	modName string
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	compressBytes.WithLabelValues(c.modName, "in", "compressed").Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	compressBytes.WithLabelValues(c.modName, "out", "compressed").Add(float64(n))
+	return n, err
+}
+
+type deflateConn struct {
+	net.Conn
+	modName string
+
+	r io.ReadCloser
+	w *flate.Writer
+
+	onClose func()
+}
+
+func newDeflateConn(c net.Conn, modName string, level int) (*deflateConn, error) {
+	counted := &countingConn{Conn: c, modName: modName}
+	w, err := flate.NewWriter(counted, level)
+	if err != nil {
+		return nil, err
+	}
+
+	compressedConns.WithLabelValues(modName).Inc()
+
+	return &deflateConn{
+		Conn:    c,
+		modName: modName,
+		r:       flate.NewReader(counted),
+		w:       w,
+	}, nil
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	compressBytes.WithLabelValues(c.modName, "in", "uncompressed").Add(float64(n))
+	return n, err
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	compressBytes.WithLabelValues(c.modName, "out", "uncompressed").Add(float64(n))
+	return n, err
+}
+
+func (c *deflateConn) Flush() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	if f, ok := c.Conn.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (c *deflateConn) Close() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+
+	if err := c.r.Close(); err != nil {
+		return err
+	}
+
+	if err := c.w.Close(); err != nil {
+		return err
+	}
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,136 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeflateConn(t *testing.T) {
+	const modName = "imap_compress_test"
+	counter := func(dir, kind string) float64 {
+		return testutil.ToFloat64(compressBytes.WithLabelValues(modName, dir, kind))
+	}
+	// Counters are global, so only look at the change caused by this test.
+	outUncompressedBefore := counter("out", "uncompressed")
+	outCompressedBefore := counter("out", "compressed")
+	inUncompressedBefore := counter("in", "uncompressed")
+	connsBefore := testutil.ToFloat64(compressedConns.WithLabelValues(modName))
+
+	a, b := net.Pipe()
+
+	server, err := newDeflateConn(a, modName, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newDeflateConn(b, modName, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roundTrip := func(from, to *deflateConn, msg string) {
+		t.Helper()
+		errCh := make(chan error, 1)
+		go func() {
+			if _, err := from.Write([]byte(msg)); err != nil {
+				errCh <- err
+				return
+			}
+			errCh <- from.Flush()
+		}()
+
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(to, buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != msg {
+			t.Fatalf("Wrong data received: %q", buf)
+		}
+	}
+
+	msg := "* OK " + strings.Repeat("compressible ", 100) + "\r\n"
+	roundTrip(server, client, msg)
+	roundTrip(client, server, "a1 NOOP\r\n")
+	roundTrip(server, client, "a1 OK NOOP completed\r\n")
+
+	outUncompressed := counter("out", "uncompressed") - outUncompressedBefore
+	outCompressed := counter("out", "compressed") - outCompressedBefore
+	inUncompressed := counter("in", "uncompressed") - inUncompressedBefore
+	// Both ends use the same module name, so sent and received amounts
+	// are equal.
+	expected := float64(len(msg) + len("a1 NOOP\r\n") + len("a1 OK NOOP completed\r\n"))
+	if outUncompressed != expected || inUncompressed != expected {
+		t.Errorf("Wrong uncompressed counters: out %v, in %v, expected %v", outUncompressed, inUncompressed, expected)
+	}
+	if outCompressed == 0 || outCompressed >= outUncompressed {
+		t.Errorf("Wrong compressed counter: %v (uncompressed %v)", outCompressed, outUncompressed)
+	}
+	if conns := testutil.ToFloat64(compressedConns.WithLabelValues(modName)) - connsBefore; conns != 2 {
+		t.Errorf("Wrong connections counter: %v", conns)
+	}
+
+	closeOnce := make(chan struct{})
+	server.onClose = func() { close(closeOnce) }
+	// net.Pipe is unbuffered, drain the flate trailer written on Close.
+	go io.Copy(io.Discard, b) //nolint:errcheck
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	select {
+	case <-closeOnce:
+	default:
+		t.Error("onClose is not called")
+	}
+}
+
+type testConn struct {
+	imapserver.Conn
+}
+
+func TestCompress_AlreadyActive(t *testing.T) {
+	ext := &compressExtension{modName: "imap_compress_test", level: 6}
+	h := &compressHandler{ext: ext}
+	conn := &testConn{}
+
+	ext.setActive(conn, true)
+	err := h.Handle(conn)
+	statusErr, ok := err.(*imap.ErrStatusResp)
+	if !ok {
+		t.Fatalf("Expected status response error, got %v", err)
+	}
+	if statusErr.Resp.Type != imap.StatusRespNo || statusErr.Resp.Code != "COMPRESSIONACTIVE" {
+		t.Errorf("Wrong status response: %v %v", statusErr.Resp.Type, statusErr.Resp.Code)
+	}
+
+	ext.setActive(conn, false)
+	if ext.isActive(conn) {
+		t.Error("Connection is still marked as active")
+	}
+}
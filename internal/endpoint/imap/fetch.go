@@ -0,0 +1,356 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// binaryItem is a parsed BINARY, BINARY.PEEK or BINARY.SIZE fetch item.
+type binaryItem struct {
+	// Name of the item in the response.
+	name imap.FetchItem
+	// Section part specifier and the corresponding section fetched from
+	// the storage, without partial.
+	part    string
+	section *imap.BodySectionName
+	size    bool
+	partial []int
+}
+
+func parseBinaryItem(item imap.FetchItem) (*binaryItem, bool, error) {
+	s := string(item)
+	bi := &binaryItem{section: &imap.BodySectionName{}}
+	switch {
+	case strings.HasPrefix(s, "BINARY.PEEK["):
+		bi.section.Peek = true
+		s = strings.TrimPrefix(s, "BINARY.PEEK[")
+	case strings.HasPrefix(s, "BINARY.SIZE["):
+		bi.section.Peek = true
+		bi.size = true
+		s = strings.TrimPrefix(s, "BINARY.SIZE[")
+	case strings.HasPrefix(s, "BINARY["):
+		s = strings.TrimPrefix(s, "BINARY[")
+	default:
+		return nil, false, nil
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end == -1 {
+		return nil, false, errors.New("imap: malformed BINARY fetch item")
+	}
+	part, tail := s[:end], s[end+1:]
+	bi.part = part
+
+	if part != "" {
+		for _, idx := range strings.Split(part, ".") {
+			i, err := strconv.Atoi(idx)
+			if err != nil || i <= 0 {
+				return nil, false, errors.New("imap: malformed BINARY section")
+			}
+			bi.section.Path = append(bi.section.Path, i)
+		}
+	}
+
+	if tail != "" {
+		if bi.size || !strings.HasPrefix(tail, "<") || !strings.HasSuffix(tail, ">") {
+			return nil, false, errors.New("imap: malformed BINARY partial")
+		}
+		for _, n := range strings.Split(tail[1:len(tail)-1], ".") {
+			i, err := strconv.Atoi(n)
+			if err != nil || i < 0 {
+				return nil, false, errors.New("imap: malformed BINARY partial")
+			}
+			bi.partial = append(bi.partial, i)
+		}
+		if len(bi.partial) != 2 {
+			return nil, false, errors.New("imap: malformed BINARY partial")
+		}
+	}
+
+	if bi.size {
+		bi.name = imap.FetchItem("BINARY.SIZE[" + part + "]")
+	} else {
+		bi.name = imap.FetchItem("BINARY[" + part + "]")
+		if bi.partial != nil {
+			bi.name += imap.FetchItem("<" + strconv.Itoa(bi.partial[0]) + ">")
+		}
+	}
+
+	return bi, true, nil
+}
+
+// sameSection compares section names ignoring the PEEK flag.
+func sameSection(a, b *imap.BodySectionName) bool {
+	aCopy, bCopy := *a, *b
+	aCopy.Peek, bCopy.Peek = false, false
+	return aCopy.Equal(&bCopy)
+}
+
+// getBody is similar to imap.Message.GetBody but does not depend on the
+// PEEK flag being cleared in the section name by the storage backend.
+func getBody(msg *imap.Message, section *imap.BodySectionName) imap.Literal {
+	for s, body := range msg.Body {
+		if sameSection(s, section) {
+			if body == nil {
+				return bytes.NewReader(nil)
+			}
+			return body
+		}
+	}
+	return nil
+}
+
+// bodyStructurePart returns the body structure for the part with the
+// specified path, nil if there is no such part.
+func bodyStructurePart(bs *imap.BodyStructure, path []int) *imap.BodyStructure {
+	for i, idx := range path {
+		if bs == nil {
+			return nil
+		}
+		if i > 0 && strings.EqualFold(bs.MIMEType, "message") &&
+			strings.EqualFold(bs.MIMESubType, "rfc822") && bs.BodyStructure != nil {
+			bs = bs.BodyStructure
+		}
+		if strings.EqualFold(bs.MIMEType, "multipart") {
+			if idx > len(bs.Parts) {
+				return nil
+			}
+			bs = bs.Parts[idx-1]
+		} else if idx != 1 {
+			return nil
+		}
+	}
+	return bs
+}
+
+// fetchHandler replaces the built-in FETCH command handler to implement
+// BINARY fetch items (RFC 3516) and to format OBJECTID (RFC 8474) items.
+//
+// BINARY items are replaced with corresponding BODY sections before passing
+// the request to the storage backend and the results are decoded before
+// sending them to the client.
+type fetchHandler struct {
+	commands.Fetch
+}
+
+func (cmd *fetchHandler) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	var (
+		items    = make([]imap.FetchItem, 0, len(cmd.Items))
+		binItems []*binaryItem
+		added    []*imap.BodySectionName
+		sections []*imap.BodySectionName
+		hasBS    bool
+		objIDs   []imap.FetchItem
+	)
+	for _, item := range cmd.Items {
+		switch item {
+		case imap.FetchBodyStructure:
+			hasBS = true
+		case fetchEmailID, fetchThreadID:
+			objIDs = append(objIDs, item)
+		}
+		if sect, err := imap.ParseBodySectionName(item); err == nil {
+			sections = append(sections, sect)
+		}
+	}
+	for _, item := range cmd.Items {
+		bi, ok, err := parseBinaryItem(item)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			items = append(items, item)
+			continue
+		}
+		binItems = append(binItems, bi)
+
+		present := false
+		for _, sect := range append(sections, added...) {
+			if sameSection(sect, bi.section) {
+				present = true
+				break
+			}
+		}
+		if !present {
+			added = append(added, bi.section)
+			items = append(items, bi.section.FetchItem())
+		}
+	}
+	if len(binItems) != 0 && !hasBS {
+		items = append(items, imap.FetchBodyStructure)
+	}
+
+	formatObjIDs := func(msg *imap.Message) {
+		for _, item := range objIDs {
+			msg.Items[item] = objectID(msg.Items[item])
+		}
+	}
+
+	if len(binItems) == 0 {
+		if len(objIDs) == 0 {
+			return cmd.list(uid, conn, items, nil)
+		}
+		return cmd.list(uid, conn, items, formatObjIDs)
+	}
+
+	var unknownCTE bool
+	err := cmd.list(uid, conn, items, func(msg *imap.Message) {
+		formatObjIDs(msg)
+
+		// Several items can refer to the same section.
+		cache := make(map[string][]byte)
+		for _, bi := range binItems {
+			data, err := binaryData(msg, bi, cache)
+			if err != nil {
+				unknownCTE = true
+				continue
+			}
+			if bi.size {
+				msg.Items[bi.name] = uint32(len(data))
+			} else {
+				if bi.partial != nil {
+					section := imap.BodySectionName{Partial: bi.partial}
+					data = section.ExtractPartial(data)
+				}
+				msg.Items[bi.name] = binaryLiteral(data)
+			}
+		}
+
+		for k := range msg.Items {
+			sect, err := imap.ParseBodySectionName(k)
+			if err != nil {
+				continue
+			}
+			for _, a := range added {
+				if sameSection(sect, a) {
+					delete(msg.Items, k)
+				}
+			}
+		}
+		if !hasBS {
+			delete(msg.Items, imap.FetchBodyStructure)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if unknownCTE {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "UNKNOWN-CTE",
+			Info: "Cannot decode some of the requested body parts",
+		})
+	}
+	return nil
+}
+
+// list fetches messages from the storage and sends them to the client,
+// calling convert for each message before sending it.
+func (cmd *fetchHandler) list(uid bool, conn imapserver.Conn, items []imap.FetchItem, convert func(*imap.Message)) error {
+	ctx := conn.Context()
+
+	ch := make(chan *imap.Message)
+	out := ch
+	if convert != nil {
+		out = make(chan *imap.Message)
+		go func() {
+			defer close(out)
+			for msg := range ch {
+				convert(msg)
+				out <- msg
+			}
+		}()
+	}
+	res := &responses.Fetch{Messages: out}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteResp(res)
+		// Make sure to drain the message channel.
+		for range out {
+		}
+	}()
+
+	err := ctx.Mailbox.ListMessages(uid, cmd.SeqSet, items, ch)
+	if err != nil {
+		return err
+	}
+
+	return <-done
+}
+
+func binaryData(msg *imap.Message, bi *binaryItem, cache map[string][]byte) ([]byte, error) {
+	data, ok := cache[bi.part]
+	if !ok {
+		if lit := getBody(msg, bi.section); lit != nil {
+			var err error
+			data, err = io.ReadAll(lit)
+			if err != nil {
+				return nil, err
+			}
+		}
+		cache[bi.part] = data
+	}
+	if len(bi.section.Path) == 0 {
+		return data, nil
+	}
+
+	part := bodyStructurePart(msg.BodyStructure, bi.section.Path)
+	if part == nil {
+		return data, nil
+	}
+	return decodeBinary(part.Encoding, data)
+}
+
+func (cmd *fetchHandler) Handle(conn imapserver.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *fetchHandler) UidHandle(conn imapserver.Conn) error {
+	// Append UID to the list of requested items if it isn't already present,
+	// same as the built-in handler does.
+	hasUID := false
+	for _, item := range cmd.Items {
+		if item == imap.FetchUid {
+			hasUID = true
+			break
+		}
+	}
+	if !hasUID {
+		cmd.Items = append(cmd.Items, imap.FetchUid)
+	}
+
+	return cmd.handle(true, conn)
+}
@@ -19,16 +19,18 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imap
 
 import (
+	"compress/flate"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-imap"
 	appendlimit "github.com/emersion/go-imap-appendlimit"
-	compress "github.com/emersion/go-imap-compress"
 	idle "github.com/emersion/go-imap-idle"
 	move "github.com/emersion/go-imap-move"
 	sortthread "github.com/emersion/go-imap-sortthread"
@@ -41,14 +43,15 @@ import (
 	"github.com/emersion/go-sasl"
 	i18nlevel "github.com/foxcpp/go-imap-i18nlevel"
 	namespace "github.com/foxcpp/go-imap-namespace"
-	"github.com/foxcpp/go-imap-sql/children"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/auth"
+	"github.com/foxcpp/maddy/internal/tlsfp"
 	"github.com/foxcpp/maddy/internal/updatepipe"
+	"github.com/foxcpp/maddy/third_party/go-imap-sql/children"
 )
 
 type Endpoint struct {
@@ -63,15 +66,27 @@ type Endpoint struct {
 
 	saslAuth auth.SASLAuth
 
+	public  *publicFolders
+	updates <-chan imapbackend.Update
+
+	name          string
+	compress      bool
+	compressLevel int
+
+	tlsFingerprints *tlsfp.Recorder
+	tlsClientBlock  module.Table
+
 	Log log.Logger
 }
 
 func New(modName string, addrs []string) (module.Module, error) {
 	endp := &Endpoint{
+		name:  modName,
 		addrs: addrs,
 		Log:   log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Protocol: "imap",
 		},
 	}
 
@@ -80,24 +95,35 @@ func New(modName string, addrs []string) (module.Module, error) {
 
 func (endp *Endpoint) Init(cfg *config.Map) error {
 	var (
-		insecureAuth bool
-		ioDebug      bool
-		ioErrors     bool
+		insecureAuth    bool
+		ioDebug         bool
+		ioErrors        bool
+		tlsFingerprints bool
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.StringList("auth_impersonators", false, false, nil, &endp.saslAuth.Impersonators)
 	cfg.Custom("storage", false, true, nil, modconfig.StorageDirective, &endp.Store)
 	cfg.Custom("tls", true, true, nil, tls2.TLSDirective, &endp.tlsConfig)
 	cfg.Bool("insecure_auth", false, false, &insecureAuth)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("io_errors", false, false, &ioErrors)
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.Bool("compress", false, true, &endp.compress)
+	cfg.Int("compress_level", false, false, flate.DefaultCompression, &endp.compressLevel)
+	cfg.Custom("public_folders", false, false, nil, publicFoldersDirective, &endp.public)
+	cfg.Bool("tls_fingerprints", false, false, &tlsFingerprints)
+	cfg.Custom("tls_fingerprint_block", false, false, nil, modconfig.TableDirective, &endp.tlsClientBlock)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	if endp.compressLevel < flate.HuffmanOnly || endp.compressLevel > flate.BestCompression {
+		return fmt.Errorf("imap: compress_level should be in range from %d to %d", flate.HuffmanOnly, flate.BestCompression)
+	}
+
 	var ok bool
 	endp.updater, ok = endp.Store.(imapbackend.BackendUpdater)
 	if !ok {
@@ -112,10 +138,18 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 	// Call Updates once at start, some storage backends initialize update
 	// channel lazily and may not generate updates at all unless it is called.
-	if endp.updater.Updates() == nil {
+	endp.updates = endp.updater.Updates()
+	if endp.updates == nil {
 		return fmt.Errorf("imap: failed to init backend: nil update channel")
 	}
 
+	if endp.public != nil {
+		if err := endp.public.init(endp.Store.GetOrCreateIMAPAcct); err != nil {
+			return fmt.Errorf("imap: failed to open public folders account: %w", err)
+		}
+		endp.updates = endp.public.translateUpdates(endp.updates)
+	}
+
 	addresses := make([]config.Endpoint, 0, len(endp.addrs))
 	for _, addr := range endp.addrs {
 		saddr, err := config.ParseEndpoint(addr)
@@ -127,6 +161,10 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 
 	endp.serv = imapserver.New(endp)
 	endp.serv.AllowInsecureAuth = insecureAuth
+	if (tlsFingerprints || endp.tlsClientBlock != nil) && endp.tlsConfig != nil {
+		endp.tlsFingerprints = tlsfp.NewRecorder(time.Minute)
+		endp.tlsConfig = endp.tlsFingerprints.Wrap(endp.tlsConfig)
+	}
 	endp.serv.TLSConfig = endp.tlsConfig
 	if ioErrors {
 		endp.serv.ErrorLog = &endp.Log
@@ -145,7 +183,10 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		mech := mech
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string) error {
+			if err := endp.checkTLSClient(c.Info().RemoteAddr); err != nil {
+				return auth.FailingSASLServ{Err: err}
+			}
+			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, c.Info().TLS, func(identity string) error {
 				return endp.openAccount(c, identity)
 			})
 		})
@@ -195,7 +236,7 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 }
 
 func (endp *Endpoint) Updates() <-chan imapbackend.Update {
-	return endp.updater.Updates()
+	return endp.updates
 }
 
 func (endp *Endpoint) Name() string {
@@ -217,8 +258,19 @@ func (endp *Endpoint) Close() error {
 	return nil
 }
 
+func (endp *Endpoint) getAccount(username string) (imapbackend.User, error) {
+	u, err := endp.Store.GetOrCreateIMAPAcct(username)
+	if err != nil {
+		return nil, err
+	}
+	if endp.public != nil {
+		u = &publicUser{User: u, pf: endp.public}
+	}
+	return maintenanceUser{User: u}, nil
+}
+
 func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
-	u, err := endp.Store.GetOrCreateIMAPAcct(identity)
+	u, err := endp.getAccount(identity)
 	if err != nil {
 		return err
 	}
@@ -228,14 +280,47 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 	return nil
 }
 
+// checkTLSClient checks the TLS fingerprint of the client against
+// tls_fingerprint_block table.
+func (endp *Endpoint) checkTLSClient(addr net.Addr) error {
+	if endp.tlsFingerprints == nil {
+		return nil
+	}
+	fp, ok := endp.tlsFingerprints.Get(addr.String())
+	if !ok {
+		return nil
+	}
+	endp.Log.DebugMsg("TLS client fingerprint", "src_ip", addr, "ja3", fp.JA3, "ja4", fp.JA4)
+	if endp.tlsClientBlock == nil {
+		return nil
+	}
+
+	for _, key := range []string{fp.JA4, fp.JA3} {
+		_, listed, err := endp.tlsClientBlock.Lookup(context.TODO(), key)
+		if err != nil {
+			endp.Log.Error("tls_fingerprint_block lookup failed", err, "key", key)
+			return nil
+		}
+		if listed {
+			endp.Log.Msg("blocked TLS client", "src_ip", addr, "ja3", fp.JA3, "ja4", fp.JA4)
+			return imapbackend.ErrInvalidCredentials
+		}
+	}
+	return nil
+}
+
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
+	if err := endp.checkTLSClient(connInfo.RemoteAddr); err != nil {
+		return nil, err
+	}
+
 	err := endp.saslAuth.AuthPlain(username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
 		return nil, imapbackend.ErrInvalidCredentials
 	}
 
-	return endp.Store.GetOrCreateIMAPAcct(username)
+	return endp.getAccount(username)
 }
 
 func (endp *Endpoint) EnableChildrenExt() bool {
@@ -251,6 +336,8 @@ func (endp *Endpoint) I18NLevel() int {
 }
 
 func (endp *Endpoint) enableExtensions() error {
+	var appendExt appendExtension
+
 	exts := endp.Store.IMAPExtensions()
 	for _, ext := range exts {
 		switch ext {
@@ -260,22 +347,39 @@ func (endp *Endpoint) enableExtensions() error {
 			endp.serv.Enable(children.NewExtension())
 		case "MOVE":
 			endp.serv.Enable(move.NewExtension())
+		case "MULTIAPPEND":
+			appendExt.multiAppend = true
+		case "UIDPLUS":
+			appendExt.uidPlus = true
+			uidPlus := &uidPlusExtension{}
+			endp.serv.Enable(uidPlus)
+			uidPlus.move = true
 		case "SPECIAL-USE":
 			endp.serv.Enable(specialuse.NewExtension())
 		case "I18NLEVEL=1", "I18NLEVEL=2":
 			endp.serv.Enable(i18nlevel.NewExtension())
 		case "SORT":
 			endp.serv.Enable(sortthread.NewSortExtension())
+		case "OBJECTID":
+			endp.serv.Enable(&objectIDExtension{})
 		}
 		if strings.HasPrefix(ext, "THREAD") {
 			endp.serv.Enable(sortthread.NewThreadExtension())
 		}
 	}
 
-	endp.serv.Enable(compress.NewExtension())
+	endp.serv.Enable(&appendExt)
+	endp.serv.Enable(&binaryExtension{log: endp.Log})
+	if endp.compress {
+		endp.serv.Enable(&compressExtension{
+			modName: endp.name,
+			level:   endp.compressLevel,
+		})
+	}
 	endp.serv.Enable(unselect.NewExtension())
 	endp.serv.Enable(idle.NewExtension())
 	endp.serv.Enable(namespace.NewExtension())
+	endp.serv.Enable(&statusExtension{})
 
 	return nil
 }
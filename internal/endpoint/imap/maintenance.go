@@ -0,0 +1,217 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	imapbackend "github.com/emersion/go-imap/backend"
+	namespace "github.com/foxcpp/go-imap-namespace"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/maintenance"
+)
+
+var errMaintenance = errors.New("imap: server is under maintenance, mailboxes are read-only")
+
+// maintenanceUser rejects all modifications while the maintenance mode is
+// enabled. The mode status is checked on each operation since it can be
+// toggled while the connection is open.
+type maintenanceUser struct {
+	imapbackend.User
+}
+
+func (u maintenanceUser) Namespaces() (personal, other, shared []namespace.Namespace, err error) {
+	if nsUser, ok := u.User.(namespace.User); ok {
+		return nsUser.Namespaces()
+	}
+
+	// Same as the fallback used by the NAMESPACE extension.
+	mboxes, err := u.User.ListMailboxes(false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(mboxes) != 0 {
+		info, err := mboxes[0].Info()
+		if err == nil {
+			personal = []namespace.Namespace{{Prefix: "", Delimiter: info.Delimiter}}
+		}
+	}
+	return personal, nil, nil, nil
+}
+
+func (u maintenanceUser) CreateMessageLimit() *uint32 {
+	if lu, ok := u.User.(interface{ CreateMessageLimit() *uint32 }); ok {
+		return lu.CreateMessageLimit()
+	}
+	return nil
+}
+
+func (u maintenanceUser) GetMailbox(name string) (imapbackend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return maintenanceMailbox{Mailbox: mbox}, nil
+}
+
+func (u maintenanceUser) CreateMailbox(name string) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return u.User.CreateMailbox(name)
+}
+
+func (u maintenanceUser) DeleteMailbox(name string) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return u.User.DeleteMailbox(name)
+}
+
+func (u maintenanceUser) RenameMailbox(existingName, newName string) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return u.User.RenameMailbox(existingName, newName)
+}
+
+type maintenanceMailbox struct {
+	imapbackend.Mailbox
+}
+
+func (m maintenanceMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := m.Mailbox.Status(items)
+	if err != nil {
+		return nil, err
+	}
+	if maintenance.Enabled() {
+		// Makes SELECT report the mailbox as READ-ONLY.
+		status.ReadOnly = true
+	}
+	return status, nil
+}
+
+func (m maintenanceMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	if maintenance.Enabled() {
+		items = peekItems(items)
+	}
+	return m.Mailbox.ListMessages(uid, seqset, items, ch)
+}
+
+func (m maintenanceMailbox) SetSubscribed(subscribed bool) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return m.Mailbox.SetSubscribed(subscribed)
+}
+
+func (m maintenanceMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return m.Mailbox.CreateMessage(flags, date, body)
+}
+
+func (m maintenanceMailbox) CreateMessages(msgs []module.IMAPAppendMessage) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return createMessages(m.Mailbox, msgs)
+}
+
+func (m maintenanceMailbox) CreateMessageUID(flags []string, date time.Time, body imap.Literal) (uint32, uint32, error) {
+	if maintenance.Enabled() {
+		return 0, 0, errMaintenance
+	}
+	return createMessageUID(m.Mailbox, flags, date, body)
+}
+
+func (m maintenanceMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return m.Mailbox.UpdateMessagesFlags(uid, seqset, operation, flags)
+}
+
+func (m maintenanceMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return m.Mailbox.CopyMessages(uid, seqset, dest)
+}
+
+func (m maintenanceMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return moveSameAccount(m.Mailbox, uid, seqset, dest)
+}
+
+func (m maintenanceMailbox) CopyMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	if maintenance.Enabled() {
+		return module.UIDMapping{}, errMaintenance
+	}
+	return copySameAccountUID(m.Mailbox, uid, seqset, dest)
+}
+
+func (m maintenanceMailbox) MoveMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	if maintenance.Enabled() {
+		return module.UIDMapping{}, errMaintenance
+	}
+	return moveSameAccountUID(m.Mailbox, uid, seqset, dest)
+}
+
+func (m maintenanceMailbox) Expunge() error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return m.Mailbox.Expunge()
+}
+
+func (m maintenanceMailbox) ExpungeUIDs(uids *imap.SeqSet) error {
+	if maintenance.Enabled() {
+		return errMaintenance
+	}
+	return expungeUIDs(m.Mailbox, uids)
+}
+
+func (m maintenanceMailbox) CreateMessageLimit() *uint32 {
+	if lm, ok := m.Mailbox.(interface{ CreateMessageLimit() *uint32 }); ok {
+		return lm.CreateMessageLimit()
+	}
+	return nil
+}
+
+func (m maintenanceMailbox) Poll() error {
+	if pm, ok := m.Mailbox.(imapbackend.MailboxPoller); ok {
+		return pm.Poll()
+	}
+	return nil
+}
+
+func (m maintenanceMailbox) Sort(uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	return sortMessages(m.Mailbox, uid, sortCrit, searchCrit)
+}
+
+func (m maintenanceMailbox) Thread(uid bool, threading sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	return threadMessages(m.Mailbox, uid, threading, searchCrit)
+}
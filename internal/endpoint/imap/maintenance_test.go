@@ -0,0 +1,98 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/maintenance"
+)
+
+func TestMaintenanceUser(t *testing.T) {
+	config.StateDirectory = t.TempDir()
+	defer func() {
+		if err := maintenance.Set(false); err != nil {
+			t.Error(err)
+		}
+		config.StateDirectory = ""
+	}()
+
+	inner, err := memory.New().Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := maintenanceUser{User: inner}
+
+	mbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.ReadOnly {
+		t.Error("Mailbox is read-only with maintenance mode disabled")
+	}
+	if err := mbox.UpdateMessagesFlags(false, seqSet1, imap.AddFlags, []string{imap.FlaggedFlag}); err != nil {
+		t.Error("STORE failed with maintenance mode disabled:", err)
+	}
+
+	if err := maintenance.Set(true); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err = mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.ReadOnly {
+		t.Error("Mailbox is not read-only in maintenance mode")
+	}
+	if err := mbox.UpdateMessagesFlags(false, seqSet1, imap.AddFlags, []string{imap.DraftFlag}); !errors.Is(err, errMaintenance) {
+		t.Error("Expected errMaintenance for STORE, got", err)
+	}
+	err = mbox.CreateMessage(nil, time.Now(), bytes.NewReader([]byte("Subject: test\r\n\r\ntest")))
+	if !errors.Is(err, errMaintenance) {
+		t.Error("Expected errMaintenance for APPEND, got", err)
+	}
+	if err := mbox.Expunge(); !errors.Is(err, errMaintenance) {
+		t.Error("Expected errMaintenance for EXPUNGE, got", err)
+	}
+	if err := u.CreateMailbox("Test"); !errors.Is(err, errMaintenance) {
+		t.Error("Expected errMaintenance for CREATE, got", err)
+	}
+
+	ch := make(chan *imap.Message, 1)
+	if err := mbox.ListMessages(false, seqSet1, []imap.FetchItem{imap.FetchFlags}, ch); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-ch
+	for _, flag := range msg.Flags {
+		if flag == imap.DraftFlag {
+			t.Error("Flags changed in maintenance mode")
+		}
+	}
+}
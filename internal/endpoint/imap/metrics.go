@@ -0,0 +1,47 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	compressedConns = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "imap",
+			Name:      "compressed_conns",
+			Help:      "Amount of connections that enabled COMPRESS extension",
+		},
+		[]string{"module"},
+	)
+	compressBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "maddy",
+			Subsystem: "imap",
+			Name:      "compress_bytes",
+			Help:      "Amount of bytes transferred over compressed connections before and after compression",
+		},
+		[]string{"module", "direction", "stage"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(compressedConns)
+	prometheus.MustRegister(compressBytes)
+}
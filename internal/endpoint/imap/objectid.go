@@ -0,0 +1,142 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// OBJECTID (RFC 8474) status and fetch items. Storage backends return
+// identifiers as plain strings, they are converted to the wire format by
+// mailboxStatus and fetchHandler.
+const (
+	statusMailboxID imap.StatusItem = "MAILBOXID"
+	fetchEmailID    imap.FetchItem  = "EMAILID"
+	fetchThreadID   imap.FetchItem  = "THREADID"
+)
+
+// objectID converts the identifier returned by the storage to the
+// parenthesized form used in responses, nil (no identifier) is sent as NIL.
+func objectID(v interface{}) interface{} {
+	id, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	return []interface{}{imap.RawString(id)}
+}
+
+// objectIDExtension implements MAILBOXID response code for CREATE, SELECT
+// and EXAMINE commands from the OBJECTID extension (RFC 8474). STATUS and
+// FETCH items are handled by statusExtension and binaryExtension.
+//
+// Storage backends that list "OBJECTID" in the IMAPExtensions should
+// return the MAILBOXID status item and EMAILID and THREADID fetch items.
+type objectIDExtension struct{}
+
+func (ext *objectIDExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{"OBJECTID"}
+}
+
+func (ext *objectIDExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "CREATE":
+		return func() imapserver.Handler {
+			return &objectIDCreate{}
+		}
+	case "SELECT":
+		return func() imapserver.Handler {
+			return &objectIDSelect{}
+		}
+	case "EXAMINE":
+		return func() imapserver.Handler {
+			hdlr := &objectIDSelect{}
+			hdlr.ReadOnly = true
+			return hdlr
+		}
+	}
+	return nil
+}
+
+// mailboxIDResp returns the MAILBOXID response code for the mailbox, nil
+// if the storage does not provide it.
+func mailboxIDResp(mbox imapbackend.Mailbox) (*imap.StatusResp, error) {
+	status, err := mbox.Status([]imap.StatusItem{statusMailboxID})
+	if err != nil {
+		return nil, err
+	}
+	id := status.Items[statusMailboxID]
+	if id == nil {
+		return nil, nil
+	}
+	return &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "MAILBOXID",
+		Arguments: []interface{}{objectID(id)},
+	}, nil
+}
+
+type objectIDCreate struct {
+	imapserver.Create
+}
+
+func (cmd *objectIDCreate) Handle(conn imapserver.Conn) error {
+	if err := cmd.Create.Handle(conn); err != nil {
+		return err
+	}
+
+	// The mailbox is already created at this point, so failure to get its
+	// identifier should not be reported to the client.
+	mbox, err := conn.Context().User.GetMailbox(cmd.Mailbox)
+	if err != nil {
+		return nil
+	}
+	resp, err := mailboxIDResp(mbox)
+	if err != nil || resp == nil {
+		return nil
+	}
+	return imapserver.ErrStatusResp(resp)
+}
+
+type objectIDSelect struct {
+	imapserver.Select
+}
+
+func (cmd *objectIDSelect) Handle(conn imapserver.Conn) error {
+	// The tagged response is returned as an error.
+	selectErr := cmd.Select.Handle(conn)
+
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return selectErr
+	}
+
+	resp, err := mailboxIDResp(ctx.Mailbox)
+	if err != nil {
+		return err
+	}
+	if resp != nil {
+		resp.Info = "Mailbox ID"
+		if err := conn.WriteResp(resp); err != nil {
+			return err
+		}
+	}
+	return selectErr
+}
@@ -0,0 +1,777 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	sortthread "github.com/emersion/go-imap-sortthread"
+	imapbackend "github.com/emersion/go-imap/backend"
+	namespace "github.com/foxcpp/go-imap-namespace"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+type accessLevel int
+
+const (
+	accessNone accessLevel = iota
+	accessRead
+	accessWrite
+)
+
+func parseAccessLevel(s string) (accessLevel, error) {
+	switch s {
+	case "none":
+		return accessNone, nil
+	case "read":
+		return accessRead, nil
+	case "write":
+		return accessWrite, nil
+	default:
+		return accessNone, errors.New("unknown access level: " + s)
+	}
+}
+
+var errAccessDenied = errors.New("imap: access to the public folder denied")
+
+type accessRule struct {
+	// Folder name relative to the public namespace prefix. Rule also applies
+	// to all subfolders. "*" matches all folders.
+	folder string
+	// List of account names. "*" matches all accounts.
+	users []string
+	level accessLevel
+}
+
+// publicFolders implements the server-wide shared namespace backed by the
+// special account.
+//
+// Folders of that account are shown to all users under the namespace prefix
+// (e.g. #public.Support) if allowed by access rules. Flags, including \Seen,
+// are shared between all users.
+type publicFolders struct {
+	account       string
+	prefix        string
+	defaultAccess accessLevel
+	rules         []accessRule
+
+	// Initialized by init.
+	user  imapbackend.User
+	delim string
+}
+
+func publicFoldersDirective(m *config.Map, node config.Node) (interface{}, error) {
+	pf := &publicFolders{}
+
+	var defaultAccess string
+	cfg := config.NewMap(m.Globals, node)
+	cfg.String("account", false, true, "", &pf.account)
+	cfg.String("prefix", false, false, "#public", &pf.prefix)
+	cfg.Enum("default_access", false, false, []string{"none", "read", "write"}, "read", &defaultAccess)
+	cfg.Callback("access", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) < 3 {
+			return config.NodeErr(node, "expected at least 3 arguments")
+		}
+		level, err := parseAccessLevel(node.Args[1])
+		if err != nil {
+			return config.NodeErr(node, "%v", err)
+		}
+		pf.rules = append(pf.rules, accessRule{
+			folder: node.Args[0],
+			level:  level,
+			users:  node.Args[2:],
+		})
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if pf.prefix == "" {
+		return nil, config.NodeErr(node, "prefix can't be empty")
+	}
+	pf.defaultAccess, _ = parseAccessLevel(defaultAccess)
+
+	return pf, nil
+}
+
+// init opens the public account using the storage backend.
+func (pf *publicFolders) init(getUser func(string) (imapbackend.User, error)) error {
+	var err error
+	pf.user, err = getUser(pf.account)
+	if err != nil {
+		return err
+	}
+
+	pf.delim = "."
+	mboxes, err := pf.user.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	for _, mbox := range mboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return err
+		}
+		if info.Delimiter != "" {
+			pf.delim = info.Delimiter
+			break
+		}
+	}
+
+	return nil
+}
+
+// access returns the access level of the user for the folder.
+//
+// The most specific rule is used. Rule for a longer folder name is more
+// specific, rule listing the user explicitly is more specific than "*".
+func (pf *publicFolders) access(username, folder string) accessLevel {
+	level := pf.defaultAccess
+	bestFolder, bestUser := -1, false
+	for _, rule := range pf.rules {
+		folderLen := -1
+		switch {
+		case rule.folder == "*":
+			folderLen = 0
+		case strings.EqualFold(rule.folder, folder),
+			strings.HasPrefix(strings.ToLower(folder), strings.ToLower(rule.folder+pf.delim)):
+			folderLen = len(rule.folder)
+		}
+		if folderLen == -1 {
+			continue
+		}
+
+		explicitUser := false
+		matched := false
+		for _, u := range rule.users {
+			if u == username {
+				explicitUser = true
+				matched = true
+				break
+			}
+			if u == "*" {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		if folderLen > bestFolder || (folderLen == bestFolder && explicitUser && !bestUser) {
+			level = rule.level
+			bestFolder = folderLen
+			bestUser = explicitUser
+		}
+	}
+	return level
+}
+
+// folder returns the public folder name for the mailbox name if it is in the
+// public namespace.
+func (pf *publicFolders) folder(name string) (string, bool) {
+	if !strings.HasPrefix(name, pf.prefix+pf.delim) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, pf.prefix+pf.delim), true
+}
+
+// translateUpdates redirects updates for public account mailboxes to all
+// connections that have them selected.
+func (pf *publicFolders) translateUpdates(in <-chan imapbackend.Update) <-chan imapbackend.Update {
+	out := make(chan imapbackend.Update)
+	go func() {
+		defer close(out)
+		for upd := range in {
+			if upd.Username() != pf.user.Username() || upd.Mailbox() == "" {
+				out <- upd
+				continue
+			}
+
+			wrapped := publicUpdate{Update: upd, mailbox: pf.prefix + pf.delim + upd.Mailbox()}
+			switch upd := upd.(type) {
+			case *imapbackend.MailboxUpdate:
+				out <- &imapbackend.MailboxUpdate{Update: wrapped, MailboxStatus: upd.MailboxStatus}
+			case *imapbackend.MessageUpdate:
+				out <- &imapbackend.MessageUpdate{Update: wrapped, Message: upd.Message}
+			case *imapbackend.ExpungeUpdate:
+				out <- &imapbackend.ExpungeUpdate{Update: wrapped, SeqNum: upd.SeqNum}
+			default:
+				out <- upd
+			}
+		}
+	}()
+	return out
+}
+
+type publicUpdate struct {
+	imapbackend.Update
+	mailbox string
+}
+
+func (u publicUpdate) Username() string {
+	return ""
+}
+
+func (u publicUpdate) Mailbox() string {
+	return u.mailbox
+}
+
+// publicUser adds the public namespace to the user account.
+type publicUser struct {
+	imapbackend.User
+	pf *publicFolders
+}
+
+func (u *publicUser) Namespaces() (personal, other, shared []namespace.Namespace, err error) {
+	if nsUser, ok := u.User.(namespace.User); ok {
+		personal, other, shared, err = nsUser.Namespaces()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		personal = []namespace.Namespace{{Prefix: "", Delimiter: u.pf.delim}}
+	}
+
+	shared = append(shared, namespace.Namespace{
+		Prefix:    u.pf.prefix + u.pf.delim,
+		Delimiter: u.pf.delim,
+	})
+	return personal, other, shared, nil
+}
+
+func (u *publicUser) CreateMessageLimit() *uint32 {
+	if lu, ok := u.User.(interface{ CreateMessageLimit() *uint32 }); ok {
+		return lu.CreateMessageLimit()
+	}
+	return nil
+}
+
+func (u *publicUser) ListMailboxes(subscribed bool) ([]imapbackend.Mailbox, error) {
+	personal, err := u.User.ListMailboxes(subscribed)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]imapbackend.Mailbox, 0, len(personal))
+	for _, mbox := range personal {
+		res = append(res, &personalMailbox{Mailbox: mbox, u: u})
+	}
+
+	// Subscriptions of the public account are shared, so all accessible
+	// folders are considered subscribed.
+	public, err := u.pf.user.ListMailboxes(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, mbox := range public {
+		level := u.pf.access(u.Username(), mbox.Name())
+		if level == accessNone {
+			continue
+		}
+		res = append(res, &publicMailbox{Mailbox: mbox, u: u, level: level})
+	}
+
+	return res, nil
+}
+
+// getPublic returns the public folder if user has at least the specified
+// access level to it.
+func (u *publicUser) getPublic(folder string, minLevel accessLevel) (*publicMailbox, error) {
+	level := u.pf.access(u.Username(), folder)
+	if level == accessNone {
+		return nil, imapbackend.ErrNoSuchMailbox
+	}
+	if level < minLevel {
+		return nil, errAccessDenied
+	}
+
+	mbox, err := u.pf.user.GetMailbox(folder)
+	if err != nil {
+		return nil, err
+	}
+	return &publicMailbox{Mailbox: mbox, u: u, level: level}, nil
+}
+
+func (u *publicUser) GetMailbox(name string) (imapbackend.Mailbox, error) {
+	if folder, ok := u.pf.folder(name); ok {
+		return u.getPublic(folder, accessRead)
+	}
+
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &personalMailbox{Mailbox: mbox, u: u}, nil
+}
+
+func (u *publicUser) CreateMailbox(name string) error {
+	if folder, ok := u.pf.folder(name); ok {
+		if u.pf.access(u.Username(), folder) != accessWrite {
+			return errAccessDenied
+		}
+		return u.pf.user.CreateMailbox(folder)
+	}
+	return u.User.CreateMailbox(name)
+}
+
+func (u *publicUser) DeleteMailbox(name string) error {
+	if folder, ok := u.pf.folder(name); ok {
+		if u.pf.access(u.Username(), folder) != accessWrite {
+			return errAccessDenied
+		}
+		return u.pf.user.DeleteMailbox(folder)
+	}
+	return u.User.DeleteMailbox(name)
+}
+
+func (u *publicUser) RenameMailbox(existingName, newName string) error {
+	existingFolder, existingPublic := u.pf.folder(existingName)
+	newFolder, newPublic := u.pf.folder(newName)
+	switch {
+	case existingPublic && newPublic:
+		if u.pf.access(u.Username(), existingFolder) != accessWrite ||
+			u.pf.access(u.Username(), newFolder) != accessWrite {
+			return errAccessDenied
+		}
+		return u.pf.user.RenameMailbox(existingFolder, newFolder)
+	case !existingPublic && !newPublic:
+		return u.User.RenameMailbox(existingName, newName)
+	default:
+		return errors.New("imap: mailboxes can't be moved between personal and public namespaces")
+	}
+}
+
+// copyMessages copies messages to the mailbox owned by a different account.
+//
+// It returns UIDs of copied messages so they can be deleted to implement
+// MOVE. UIDs assigned to copies are reported only if the destination mailbox
+// implements module.UIDPlusMailbox.
+func copyMessages(src imapbackend.Mailbox, uid bool, seqset *imap.SeqSet, dest imapbackend.Mailbox) (module.UIDMapping, error) {
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+
+	ch := make(chan *imap.Message)
+	done := make(chan []*imap.Message, 1)
+	go func() {
+		var msgs []*imap.Message
+		for msg := range ch {
+			msgs = append(msgs, msg)
+		}
+		done <- msgs
+	}()
+	err := src.ListMessages(uid, seqset, items, ch)
+	msgs := <-done
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+
+	uidDest, _ := dest.(module.UIDPlusMailbox)
+
+	var mapping module.UIDMapping
+	for _, msg := range msgs {
+		// Only one body section is requested, but storage backends differ
+		// in whether PEEK is kept in the section name so GetBody can't be used.
+		var body imap.Literal
+		for _, literal := range msg.Body {
+			body = literal
+		}
+		if body == nil {
+			return module.UIDMapping{}, errors.New("imap: storage did not return the message body")
+		}
+		bodyBlob := new(bytes.Buffer)
+		if _, err := bodyBlob.ReadFrom(body); err != nil {
+			return module.UIDMapping{}, err
+		}
+
+		flags := make([]string, 0, len(msg.Flags))
+		for _, f := range msg.Flags {
+			if f != imap.RecentFlag {
+				flags = append(flags, f)
+			}
+		}
+		date := msg.InternalDate
+		if date.IsZero() {
+			date = time.Now()
+		}
+
+		if uidDest == nil {
+			if err := dest.CreateMessage(flags, date, bytes.NewReader(bodyBlob.Bytes())); err != nil {
+				return module.UIDMapping{}, err
+			}
+		} else {
+			uidValidity, destUID, err := uidDest.CreateMessageUID(flags, date, bytes.NewReader(bodyBlob.Bytes()))
+			if err != nil {
+				return module.UIDMapping{}, err
+			}
+			mapping.UIDValidity = uidValidity
+			mapping.Dest = append(mapping.Dest, destUID)
+		}
+		mapping.Src = append(mapping.Src, msg.Uid)
+	}
+
+	return mapping, nil
+}
+
+// moveMessages moves messages to the mailbox owned by a different account.
+func moveMessages(src imapbackend.Mailbox, uid bool, seqset *imap.SeqSet, dest imapbackend.Mailbox) (module.UIDMapping, error) {
+	delMbox, ok := src.(interface {
+		DelMessages(uid bool, seqset *imap.SeqSet) error
+	})
+	if !ok {
+		return module.UIDMapping{}, errors.New("imap: MOVE between personal and public namespaces is not supported")
+	}
+
+	mapping, err := copyMessages(src, uid, seqset, dest)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	if len(mapping.Src) == 0 {
+		return mapping, nil
+	}
+	return mapping, delMbox.DelMessages(true, uidSet(mapping.Src))
+}
+
+// resolveDest returns the destination mailbox for COPY and MOVE commands.
+//
+// If the destination is owned by the same account as srcPublic indicates,
+// sameAccountName is set and mbox is nil.
+func (u *publicUser) resolveDest(srcPublic bool, dest string) (mbox imapbackend.Mailbox, sameAccountName string, err error) {
+	folder, destPublic := u.pf.folder(dest)
+	if destPublic {
+		pub, err := u.getPublic(folder, accessWrite)
+		if err != nil {
+			return nil, "", err
+		}
+		if srcPublic {
+			return nil, folder, nil
+		}
+		return pub.Mailbox, "", nil
+	}
+
+	if !srcPublic {
+		return nil, dest, nil
+	}
+	mbox, err = u.User.GetMailbox(dest)
+	return mbox, "", err
+}
+
+// personalMailbox wraps the mailbox of the user account to handle copying
+// to the public folders.
+type personalMailbox struct {
+	imapbackend.Mailbox
+	u *publicUser
+}
+
+func (m *personalMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	destMbox, destName, err := m.u.resolveDest(false, dest)
+	if err != nil {
+		return err
+	}
+	if destMbox == nil {
+		return m.Mailbox.CopyMessages(uid, seqset, destName)
+	}
+	_, err = copyMessages(m.Mailbox, uid, seqset, destMbox)
+	return err
+}
+
+func (m *personalMailbox) CopyMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	destMbox, destName, err := m.u.resolveDest(false, dest)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	if destMbox == nil {
+		return copySameAccountUID(m.Mailbox, uid, seqset, destName)
+	}
+	return copyMessages(m.Mailbox, uid, seqset, destMbox)
+}
+
+func (m *personalMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	destMbox, destName, err := m.u.resolveDest(false, dest)
+	if err != nil {
+		return err
+	}
+	if destMbox == nil {
+		return moveSameAccount(m.Mailbox, uid, seqset, destName)
+	}
+	_, err = moveMessages(m.Mailbox, uid, seqset, destMbox)
+	return err
+}
+
+func (m *personalMailbox) MoveMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	destMbox, destName, err := m.u.resolveDest(false, dest)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	if destMbox == nil {
+		return moveSameAccountUID(m.Mailbox, uid, seqset, destName)
+	}
+	return moveMessages(m.Mailbox, uid, seqset, destMbox)
+}
+
+func (m *personalMailbox) CreateMessageUID(flags []string, date time.Time, body imap.Literal) (uint32, uint32, error) {
+	return createMessageUID(m.Mailbox, flags, date, body)
+}
+
+func (m *personalMailbox) ExpungeUIDs(uids *imap.SeqSet) error {
+	return expungeUIDs(m.Mailbox, uids)
+}
+
+func (m *personalMailbox) CreateMessages(msgs []module.IMAPAppendMessage) error {
+	return createMessages(m.Mailbox, msgs)
+}
+
+func (m *personalMailbox) Sort(uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	return sortMessages(m.Mailbox, uid, sortCrit, searchCrit)
+}
+
+func (m *personalMailbox) Thread(uid bool, threading sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	return threadMessages(m.Mailbox, uid, threading, searchCrit)
+}
+
+// publicMailbox wraps the mailbox of the public account to enforce access
+// level and add the namespace prefix to its name.
+type publicMailbox struct {
+	imapbackend.Mailbox
+	u     *publicUser
+	level accessLevel
+}
+
+func (m *publicMailbox) Name() string {
+	return m.u.pf.prefix + m.u.pf.delim + m.Mailbox.Name()
+}
+
+func (m *publicMailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := m.Mailbox.Info()
+	if err != nil {
+		return nil, err
+	}
+	infoCpy := *info
+	infoCpy.Name = m.Name()
+	return &infoCpy, nil
+}
+
+func (m *publicMailbox) ListMessages(uid bool, seqset *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	if m.level == accessWrite {
+		return m.Mailbox.ListMessages(uid, seqset, items, ch)
+	}
+
+	// Make sure fetching the body does not set \Seen flag for read-only
+	// users.
+	return m.Mailbox.ListMessages(uid, seqset, peekItems(items), ch)
+}
+
+// peekItems converts BODY[...] fetch items into BODY.PEEK[...] so fetching
+// them does not change the \Seen flag.
+func peekItems(items []imap.FetchItem) []imap.FetchItem {
+	res := make([]imap.FetchItem, 0, len(items))
+	for _, item := range items {
+		section, err := imap.ParseBodySectionName(item)
+		if err != nil || section.Peek {
+			res = append(res, item)
+			continue
+		}
+		section.Peek = true
+		res = append(res, section.FetchItem())
+	}
+	return res
+}
+
+func (m *publicMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	if m.level != accessWrite {
+		return errAccessDenied
+	}
+	return m.Mailbox.CreateMessage(flags, date, body)
+}
+
+func (m *publicMailbox) CreateMessageUID(flags []string, date time.Time, body imap.Literal) (uint32, uint32, error) {
+	if m.level != accessWrite {
+		return 0, 0, errAccessDenied
+	}
+	return createMessageUID(m.Mailbox, flags, date, body)
+}
+
+func (m *publicMailbox) CreateMessages(msgs []module.IMAPAppendMessage) error {
+	if m.level != accessWrite {
+		return errAccessDenied
+	}
+	return createMessages(m.Mailbox, msgs)
+}
+
+func (m *publicMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	if m.level != accessWrite {
+		return errAccessDenied
+	}
+	return m.Mailbox.UpdateMessagesFlags(uid, seqset, operation, flags)
+}
+
+func (m *publicMailbox) Expunge() error {
+	if m.level != accessWrite {
+		return errAccessDenied
+	}
+	return m.Mailbox.Expunge()
+}
+
+func (m *publicMailbox) ExpungeUIDs(uids *imap.SeqSet) error {
+	if m.level != accessWrite {
+		return errAccessDenied
+	}
+	return expungeUIDs(m.Mailbox, uids)
+}
+
+func (m *publicMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	destMbox, destName, err := m.u.resolveDest(true, dest)
+	if err != nil {
+		return err
+	}
+	if destMbox == nil {
+		return m.Mailbox.CopyMessages(uid, seqset, destName)
+	}
+	_, err = copyMessages(m.Mailbox, uid, seqset, destMbox)
+	return err
+}
+
+func (m *publicMailbox) CopyMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	destMbox, destName, err := m.u.resolveDest(true, dest)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	if destMbox == nil {
+		return copySameAccountUID(m.Mailbox, uid, seqset, destName)
+	}
+	return copyMessages(m.Mailbox, uid, seqset, destMbox)
+}
+
+func (m *publicMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error {
+	if m.level != accessWrite {
+		return errAccessDenied
+	}
+
+	destMbox, destName, err := m.u.resolveDest(true, dest)
+	if err != nil {
+		return err
+	}
+	if destMbox == nil {
+		return moveSameAccount(m.Mailbox, uid, seqset, destName)
+	}
+	_, err = moveMessages(m.Mailbox, uid, seqset, destMbox)
+	return err
+}
+
+func (m *publicMailbox) MoveMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	if m.level != accessWrite {
+		return module.UIDMapping{}, errAccessDenied
+	}
+
+	destMbox, destName, err := m.u.resolveDest(true, dest)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	if destMbox == nil {
+		return moveSameAccountUID(m.Mailbox, uid, seqset, destName)
+	}
+	return moveMessages(m.Mailbox, uid, seqset, destMbox)
+}
+
+func (m *publicMailbox) Sort(uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	return sortMessages(m.Mailbox, uid, sortCrit, searchCrit)
+}
+
+func (m *publicMailbox) Thread(uid bool, threading sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	return threadMessages(m.Mailbox, uid, threading, searchCrit)
+}
+
+func moveSameAccount(mbox imapbackend.Mailbox, uid bool, seqset *imap.SeqSet, dest string) error {
+	moveMbox, ok := mbox.(interface {
+		MoveMessages(uid bool, seqset *imap.SeqSet, dest string) error
+	})
+	if !ok {
+		return errors.New("imap: MOVE is not supported by the storage")
+	}
+	return moveMbox.MoveMessages(uid, seqset, dest)
+}
+
+func uidPlusMailbox(mbox imapbackend.Mailbox) (module.UIDPlusMailbox, error) {
+	uidMbox, ok := mbox.(module.UIDPlusMailbox)
+	if !ok {
+		return nil, errors.New("imap: UIDPLUS is not supported by the storage")
+	}
+	return uidMbox, nil
+}
+
+func createMessageUID(mbox imapbackend.Mailbox, flags []string, date time.Time, body imap.Literal) (uint32, uint32, error) {
+	uidMbox, err := uidPlusMailbox(mbox)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uidMbox.CreateMessageUID(flags, date, body)
+}
+
+func copySameAccountUID(mbox imapbackend.Mailbox, uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	uidMbox, err := uidPlusMailbox(mbox)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	return uidMbox.CopyMessagesUID(uid, seqset, dest)
+}
+
+func moveSameAccountUID(mbox imapbackend.Mailbox, uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	uidMbox, err := uidPlusMailbox(mbox)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	return uidMbox.MoveMessagesUID(uid, seqset, dest)
+}
+
+func expungeUIDs(mbox imapbackend.Mailbox, uids *imap.SeqSet) error {
+	uidMbox, err := uidPlusMailbox(mbox)
+	if err != nil {
+		return err
+	}
+	return uidMbox.ExpungeUIDs(uids)
+}
+
+func createMessages(mbox imapbackend.Mailbox, msgs []module.IMAPAppendMessage) error {
+	multiMbox, ok := mbox.(module.MultiAppendMailbox)
+	if !ok {
+		return errors.New("imap: MULTIAPPEND is not supported by the storage")
+	}
+	return multiMbox.CreateMessages(msgs)
+}
+
+func sortMessages(mbox imapbackend.Mailbox, uid bool, sortCrit []sortthread.SortCriterion, searchCrit *imap.SearchCriteria) ([]uint32, error) {
+	sortMbox, ok := mbox.(sortthread.SortMailbox)
+	if !ok {
+		return nil, errors.New("imap: SORT is not supported by the storage")
+	}
+	return sortMbox.Sort(uid, sortCrit, searchCrit)
+}
+
+func threadMessages(mbox imapbackend.Mailbox, uid bool, threading sortthread.ThreadAlgorithm, searchCrit *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	threadMbox, ok := mbox.(sortthread.ThreadMailbox)
+	if !ok {
+		return nil, errors.New("imap: THREAD is not supported by the storage")
+	}
+	return threadMbox.Thread(uid, threading, searchCrit)
+}
@@ -0,0 +1,219 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+)
+
+var seqSet1, _ = imap.ParseSeqSet("1")
+
+type namedUser struct {
+	imapbackend.User
+	name string
+}
+
+func (u namedUser) Username() string {
+	return u.name
+}
+
+func testPublicUser(t *testing.T, username string) *publicUser {
+	t.Helper()
+
+	pub, err := memory.New().Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Support", "Support/Team", "Archive"} {
+		if err := pub.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pf := &publicFolders{
+		account:       "public",
+		prefix:        "#public",
+		defaultAccess: accessRead,
+		rules: []accessRule{
+			{folder: "Support", users: []string{"alice"}, level: accessWrite},
+			{folder: "Archive", users: []string{"*"}, level: accessNone},
+			{folder: "Archive", users: []string{"alice"}, level: accessRead},
+		},
+	}
+	if err := pf.init(func(string) (imapbackend.User, error) { return pub, nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	personal, err := memory.New().Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &publicUser{User: namedUser{User: personal, name: username}, pf: pf}
+}
+
+func TestPublicFolders_Access(t *testing.T) {
+	u := testPublicUser(t, "alice")
+	pf := u.pf
+
+	if pf.delim != "/" {
+		t.Fatalf("Delimiter is not detected: %q", pf.delim)
+	}
+
+	for _, c := range []struct {
+		user, folder string
+		level        accessLevel
+	}{
+		{"alice", "Support", accessWrite},
+		{"alice", "support", accessWrite},
+		{"alice", "Support/Team", accessWrite},
+		{"alice", "SupportX", accessRead},
+		{"bob", "Support", accessRead},
+		{"bob", "Archive", accessNone},
+		{"alice", "Archive", accessRead},
+		{"bob", "INBOX", accessRead},
+	} {
+		if level := pf.access(c.user, c.folder); level != c.level {
+			t.Errorf("access(%s, %s) = %v, want %v", c.user, c.folder, level, c.level)
+		}
+	}
+}
+
+func TestPublicFolders_List(t *testing.T) {
+	u := testPublicUser(t, "bob")
+
+	mboxes, err := u.ListMailboxes(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, mbox := range mboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names[info.Name] = true
+	}
+
+	for _, name := range []string{"INBOX", "#public/INBOX", "#public/Support", "#public/Support/Team"} {
+		if !names[name] {
+			t.Errorf("%s is not listed", name)
+		}
+	}
+	if names["#public/Archive"] {
+		t.Errorf("Inaccessible folder is listed")
+	}
+
+	if _, err := u.GetMailbox("#public/Archive"); !errors.Is(err, imapbackend.ErrNoSuchMailbox) {
+		t.Errorf("Expected ErrNoSuchMailbox for inaccessible folder, got %v", err)
+	}
+}
+
+func TestPublicFolders_ReadOnly(t *testing.T) {
+	u := testPublicUser(t, "bob")
+
+	mbox, err := u.GetMailbox("#public/Support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mbox.Name() != "#public/Support" {
+		t.Errorf("Wrong mailbox name: %s", mbox.Name())
+	}
+
+	err = mbox.CreateMessage(nil, time.Now(), bytes.NewReader([]byte("Subject: test\r\n\r\ntest")))
+	if !errors.Is(err, errAccessDenied) {
+		t.Errorf("Expected errAccessDenied for APPEND, got %v", err)
+	}
+	if err := u.CreateMailbox("#public/Support/New"); !errors.Is(err, errAccessDenied) {
+		t.Errorf("Expected errAccessDenied for CREATE, got %v", err)
+	}
+
+	inbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.CopyMessages(false, seqSet1, "#public/Support"); !errors.Is(err, errAccessDenied) {
+		t.Errorf("Expected errAccessDenied for COPY, got %v", err)
+	}
+}
+
+func TestPublicFolders_Copy(t *testing.T) {
+	u := testPublicUser(t, "alice")
+
+	inbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.CopyMessages(false, seqSet1, "#public/Support"); err != nil {
+		t.Fatal(err)
+	}
+
+	support, err := u.GetMailbox("#public/Support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := support.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 1 {
+		t.Errorf("Message is not copied to the public folder, messages: %d", status.Messages)
+	}
+
+	// Copy within the public namespace and back to the personal one.
+	if err := support.CopyMessages(false, seqSet1, "#public/Support/Team"); err != nil {
+		t.Fatal(err)
+	}
+	if err := support.CopyMessages(false, seqSet1, "INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	status, err = inbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Messages != 2 {
+		t.Errorf("Message is not copied to the personal mailbox, messages: %d", status.Messages)
+	}
+}
+
+func TestPublicFolders_Updates(t *testing.T) {
+	u := testPublicUser(t, "alice")
+
+	in := make(chan imapbackend.Update, 2)
+	out := u.pf.translateUpdates(in)
+
+	in <- &imapbackend.ExpungeUpdate{Update: imapbackend.NewUpdate("username", "Support"), SeqNum: 1}
+	in <- &imapbackend.ExpungeUpdate{Update: imapbackend.NewUpdate("alice", "INBOX"), SeqNum: 2}
+	close(in)
+
+	upd := (<-out).(*imapbackend.ExpungeUpdate)
+	if upd.Username() != "" || upd.Mailbox() != "#public/Support" || upd.SeqNum != 1 {
+		t.Errorf("Wrong translated update: %v %v %v", upd.Username(), upd.Mailbox(), upd.SeqNum)
+	}
+	upd = (<-out).(*imapbackend.ExpungeUpdate)
+	if upd.Username() != "alice" || upd.Mailbox() != "INBOX" {
+		t.Errorf("Personal update changed: %v %v", upd.Username(), upd.Mailbox())
+	}
+}
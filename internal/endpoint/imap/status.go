@@ -0,0 +1,301 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// statusSize is the STATUS=SIZE (RFC 8438) status item.
+const statusSize imap.StatusItem = "SIZE"
+
+// statusExtension implements LIST-STATUS (RFC 5819) and STATUS=SIZE
+// (RFC 8438).
+//
+// Storage backends may provide the SIZE item themselves, otherwise it is
+// calculated by summing RFC822.SIZE of all messages in the mailbox.
+type statusExtension struct{}
+
+func (ext *statusExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{"LIST-STATUS", "STATUS=SIZE"}
+}
+
+func (ext *statusExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "LIST":
+		return func() imapserver.Handler {
+			return &listStatus{}
+		}
+	case "STATUS":
+		return func() imapserver.Handler {
+			return &statusHandler{}
+		}
+	}
+	return nil
+}
+
+func mailboxSize(mbox imapbackend.Mailbox) (uint64, error) {
+	ch := make(chan *imap.Message, 16)
+	done := make(chan uint64, 1)
+	go func() {
+		var size uint64
+		for msg := range ch {
+			size += uint64(msg.Size)
+		}
+		done <- size
+	}()
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	err := mbox.ListMessages(true, seqset, []imap.FetchItem{imap.FetchRFC822Size}, ch)
+	size := <-done
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// mailboxStatus returns the status containing only the requested items.
+func mailboxStatus(mbox imapbackend.Mailbox, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := mbox.Status(items)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make(map[imap.StatusItem]interface{}, len(items))
+	for _, k := range items {
+		filtered[k] = status.Items[k]
+		if k == statusMailboxID {
+			filtered[k] = objectID(status.Items[k])
+			continue
+		}
+		if k != statusSize {
+			continue
+		}
+
+		switch size := status.Items[k].(type) {
+		case nil:
+			total, err := mailboxSize(mbox)
+			if err != nil {
+				return nil, err
+			}
+			filtered[k] = imap.RawString(strconv.FormatUint(total, 10))
+		case uint64:
+			filtered[k] = imap.RawString(strconv.FormatUint(size, 10))
+		}
+	}
+	status.Items = filtered
+
+	return status, nil
+}
+
+type statusHandler struct {
+	imapserver.Status
+}
+
+func (cmd *statusHandler) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	status, err := mailboxStatus(mbox, cmd.Items)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteResp(&responses.Status{Mailbox: status})
+}
+
+type listStatus struct {
+	Reference   string
+	Mailbox     string
+	StatusItems []imap.StatusItem
+}
+
+func (cmd *listStatus) Parse(fields []interface{}) error {
+	// Selection options (RFC 5258) are not supported, but an empty list is
+	// allowed.
+	if len(fields) != 0 {
+		if opts, ok := fields[0].([]interface{}); ok {
+			if len(opts) != 0 {
+				return errors.New("LIST selection options are not supported")
+			}
+			fields = fields[1:]
+		}
+	}
+
+	if len(fields) < 2 {
+		return errors.New("No enough arguments")
+	}
+
+	dec := utf7.Encoding.NewDecoder()
+	ref, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	if ref, err = dec.String(ref); err != nil {
+		return err
+	}
+	cmd.Reference = imap.CanonicalMailboxName(ref)
+
+	mailbox, err := imap.ParseString(fields[1])
+	if err != nil {
+		return err
+	}
+	if mailbox, err = dec.String(mailbox); err != nil {
+		return err
+	}
+	cmd.Mailbox = imap.CanonicalMailboxName(mailbox)
+
+	fields = fields[2:]
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if kw, ok := fields[0].(string); !ok || !strings.EqualFold(kw, "RETURN") || len(fields) != 2 {
+		return errors.New("Unexpected LIST arguments")
+	}
+	opts, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("LIST return options should be a list")
+	}
+	for i := 0; i < len(opts); i++ {
+		opt, ok := opts[i].(string)
+		if !ok {
+			return errors.New("Malformed LIST return options")
+		}
+
+		switch strings.ToUpper(opt) {
+		case "CHILDREN", "SPECIAL-USE":
+			// Always returned.
+		case "STATUS":
+			if i+1 == len(opts) {
+				return errors.New("Missing STATUS items")
+			}
+			items, ok := opts[i+1].([]interface{})
+			if !ok {
+				return errors.New("STATUS items should be a list")
+			}
+			for _, item := range items {
+				item, ok := item.(string)
+				if !ok {
+					return errors.New("Malformed STATUS item")
+				}
+				cmd.StatusItems = append(cmd.StatusItems, imap.StatusItem(strings.ToUpper(item)))
+			}
+			i++
+		default:
+			return errors.New("Unsupported LIST return option: " + opt)
+		}
+	}
+
+	return nil
+}
+
+func (cmd *listStatus) Handle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	mailboxes, err := ctx.User.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	var (
+		infos   []*imap.MailboxInfo
+		matched []imapbackend.Mailbox
+	)
+	for _, mbox := range mailboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return err
+		}
+
+		// An empty ("" string) mailbox name argument is a special request to return
+		// the hierarchy delimiter and the root name of the name given in the
+		// reference.
+		if cmd.Mailbox == "" {
+			infos = append(infos, &imap.MailboxInfo{
+				Attributes: []string{imap.NoSelectAttr},
+				Delimiter:  info.Delimiter,
+				Name:       info.Delimiter,
+			})
+			break
+		}
+
+		if info.Match(cmd.Reference, cmd.Mailbox) {
+			infos = append(infos, info)
+			matched = append(matched, mbox)
+		}
+	}
+
+	ch := make(chan *imap.MailboxInfo, len(infos))
+	for _, info := range infos {
+		ch <- info
+	}
+	close(ch)
+	if err := conn.WriteResp(&responses.List{Mailboxes: ch}); err != nil {
+		return err
+	}
+
+	if len(cmd.StatusItems) == 0 {
+		return nil
+	}
+
+	for i, mbox := range matched {
+		if hasAttr(infos[i].Attributes, imap.NoSelectAttr) {
+			continue
+		}
+
+		status, err := mailboxStatus(mbox, cmd.StatusItems)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteResp(&responses.Status{Mailbox: status}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestListStatusParse(t *testing.T) {
+	test := func(fields []interface{}, ref, mbox string, items []imap.StatusItem, fail bool) {
+		t.Helper()
+
+		cmd := &listStatus{}
+		err := cmd.Parse(fields)
+		if fail {
+			if err == nil {
+				t.Errorf("Expected failure for %v", fields)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", fields, err)
+			return
+		}
+		if cmd.Reference != ref || cmd.Mailbox != mbox {
+			t.Errorf("Wrong ref/mailbox for %v: %q %q", fields, cmd.Reference, cmd.Mailbox)
+		}
+		if !reflect.DeepEqual(cmd.StatusItems, items) {
+			t.Errorf("Wrong status items for %v: %v", fields, cmd.StatusItems)
+		}
+	}
+
+	test([]interface{}{"", "*"}, "", "*", nil, false)
+	test([]interface{}{[]interface{}{}, "", "%"}, "", "%", nil, false)
+	test([]interface{}{"", "*", "RETURN", []interface{}{"STATUS", []interface{}{"messages", "SIZE"}}},
+		"", "*", []imap.StatusItem{imap.StatusMessages, statusSize}, false)
+	test([]interface{}{"", "*", "RETURN", []interface{}{"CHILDREN", "STATUS", []interface{}{"UNSEEN"}, "SPECIAL-USE"}},
+		"", "*", []imap.StatusItem{imap.StatusUnseen}, false)
+	test([]interface{}{"inbox", ""}, "INBOX", "", nil, false)
+
+	test([]interface{}{""}, "", "", nil, true)
+	test([]interface{}{[]interface{}{"SUBSCRIBED"}, "", "*"}, "", "", nil, true)
+	test([]interface{}{"", "*", "RETURN", []interface{}{"STATUS"}}, "", "", nil, true)
+	test([]interface{}{"", "*", "RETURN", []interface{}{"SUBSCRIBED"}}, "", "", nil, true)
+	test([]interface{}{"", "*", "FOO", []interface{}{}}, "", "", nil, true)
+}
@@ -0,0 +1,202 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// uidPlusExtension implements COPYUID response code and UID EXPUNGE command
+// from the UIDPLUS extension (RFC 4315). APPENDUID is handled by
+// appendExtension.
+type uidPlusExtension struct {
+	// go-imap ignores extensions that provide the MOVE command handler so it
+	// is provided only if move is set after the extension is enabled.
+	move bool
+}
+
+func (ext *uidPlusExtension) Capabilities(c imapserver.Conn) []string {
+	return []string{"UIDPLUS"}
+}
+
+func (ext *uidPlusExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "COPY":
+		return func() imapserver.Handler {
+			return &uidPlusCopy{}
+		}
+	case "EXPUNGE":
+		return func() imapserver.Handler {
+			return &uidPlusExpunge{}
+		}
+	case "MOVE":
+		if !ext.move {
+			return nil
+		}
+		return func() imapserver.Handler {
+			return &uidPlusMove{}
+		}
+	}
+	return nil
+}
+
+func uidSet(uids []uint32) *imap.SeqSet {
+	set := new(imap.SeqSet)
+	for _, uid := range uids {
+		set.AddNum(uid)
+	}
+	return set
+}
+
+type uidPlusCopy struct {
+	imapserver.Copy
+}
+
+func (cmd *uidPlusCopy) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	mbox, ok := ctx.Mailbox.(module.UIDPlusMailbox)
+	if !ok {
+		return ctx.Mailbox.CopyMessages(uid, cmd.SeqSet, cmd.Mailbox)
+	}
+
+	mapping, err := mbox.CopyMessagesUID(uid, cmd.SeqSet, cmd.Mailbox)
+	if err != nil {
+		return err
+	}
+	if len(mapping.Dest) == 0 {
+		return nil
+	}
+
+	return imapserver.ErrStatusResp(copyUIDResp(mapping))
+}
+
+func copyUIDResp(mapping module.UIDMapping) *imap.StatusResp {
+	return &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "COPYUID",
+		Arguments: []interface{}{mapping.UIDValidity, uidSet(mapping.Src), uidSet(mapping.Dest)},
+	}
+}
+
+func (cmd *uidPlusCopy) Handle(conn imapserver.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *uidPlusCopy) UidHandle(conn imapserver.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+type uidPlusMove struct {
+	imapserver.Move
+}
+
+func (cmd *uidPlusMove) handle(uid bool, conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	mbox, ok := ctx.Mailbox.(module.UIDPlusMailbox)
+	if !ok {
+		if uid {
+			return cmd.Move.UidHandle(conn)
+		}
+		return cmd.Move.Handle(conn)
+	}
+
+	mapping, err := mbox.MoveMessagesUID(uid, cmd.SeqSet, cmd.Mailbox)
+	if err != nil {
+		return err
+	}
+	if len(mapping.Dest) == 0 {
+		return nil
+	}
+
+	// RFC 6851 requires COPYUID to be sent in an untagged response since
+	// the tagged one is sent after EXPUNGE responses.
+	resp := copyUIDResp(mapping)
+	resp.Info = "Messages moved"
+	return conn.WriteResp(resp)
+}
+
+func (cmd *uidPlusMove) Handle(conn imapserver.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *uidPlusMove) UidHandle(conn imapserver.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+type uidPlusExpunge struct {
+	imapserver.Expunge
+
+	// Set only for UID EXPUNGE.
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *uidPlusExpunge) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+
+	seqSet, ok := fields[0].(string)
+	if !ok {
+		return errors.New("Invalid sequence set")
+	}
+	var err error
+	cmd.SeqSet, err = imap.ParseSeqSet(seqSet)
+	return err
+}
+
+func (cmd *uidPlusExpunge) Handle(conn imapserver.Conn) error {
+	if cmd.SeqSet != nil {
+		return errors.New("Unexpected arguments")
+	}
+	return cmd.Expunge.Handle(conn)
+}
+
+func (cmd *uidPlusExpunge) UidHandle(conn imapserver.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+	if cmd.SeqSet == nil {
+		return errors.New("No enough arguments")
+	}
+
+	mbox, ok := ctx.Mailbox.(module.UIDPlusMailbox)
+	if !ok {
+		return errors.New("UID EXPUNGE is not supported")
+	}
+
+	// EXPUNGE responses are sent by the storage backend via the updates
+	// channel.
+	return mbox.ExpungeUIDs(cmd.SeqSet)
+}
@@ -0,0 +1,259 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mtasts implements the HTTPS endpoint serving the MTA-STS policy
+// (RFC 8461) for domains hosted by the server.
+//
+// The policy is served at https://mta-sts.<domain>/.well-known/mta-sts.txt
+// and lists MX hosts of the server (the global hostname by default). The
+// policy identifier for the _mta-sts DNS record is derived from the policy
+// contents, see Policy.ID.
+package mtasts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "mta_sts"
+
+// PolicyPath is the path the policy is served at.
+const PolicyPath = "/.well-known/mta-sts.txt"
+
+// maxMaxAge is the maximum max_age value allowed by RFC 8461.
+const maxMaxAge = 31557600 * time.Second
+
+type Endpoint struct {
+	addrs     []string
+	logger    log.Logger
+	tlsConfig *tls.Config
+
+	domains    []string
+	domainsSet map[string]struct{}
+	policy     Policy
+	policyText string
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var hostname string
+
+	cfg.Bool("debug", true, false, &e.logger.Debug)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.StringList("domains", false, true, nil, &e.domains)
+	cfg.StringList("mx", false, false, nil, &e.policy.MX)
+	cfg.Enum("mode", false, false, []string{"enforce", "testing", "none"}, "testing", &e.policy.Mode)
+	cfg.Duration("max_age", false, false, 7*24*time.Hour, &e.policy.MaxAge)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(e.policy.MX) == 0 {
+		if hostname == "" {
+			return fmt.Errorf("%s: mx or hostname is required", modName)
+		}
+		e.policy.MX = []string{hostname}
+	}
+	for i, mx := range e.policy.MX {
+		normalized, err := dns.ForLookup(strings.TrimPrefix(mx, "*."))
+		if err != nil {
+			return fmt.Errorf("%s: invalid MX name %s: %v", modName, mx, err)
+		}
+		if strings.HasPrefix(mx, "*.") {
+			normalized = "*." + normalized
+		}
+		e.policy.MX[i] = normalized
+	}
+	if e.policy.MaxAge < time.Second || e.policy.MaxAge > maxMaxAge {
+		return fmt.Errorf("%s: max_age should be between 1s and %v", modName, maxMaxAge)
+	}
+
+	e.domainsSet = make(map[string]struct{}, len(e.domains))
+	for i, domain := range e.domains {
+		normalized, err := dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("%s: invalid domain %s: %v", modName, domain, err)
+		}
+		e.domains[i] = normalized
+		e.domainsSet[normalized] = struct{}{}
+	}
+	e.policyText = e.policy.Text()
+
+	if module.NoRun {
+		return nil
+	}
+
+	e.checkCertificates()
+
+	e.serv.Handler = e
+	// TLS handshake errors from scanners and misconfigured clients are
+	// not interesting.
+	e.serv.ErrorLog = stdlog.New(e.logger.DebugWriter(), "", 0)
+	for _, a := range e.addrs {
+		a := a
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		l, err := net.Listen(endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			defer e.listenersWg.Done()
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// checkCertificates logs a warning for each domain with the policy host
+// name not covered by any configured certificate. Policies served without a
+// valid certificate are ignored by senders.
+func (e *Endpoint) checkCertificates() {
+	if e.tlsConfig == nil || len(e.tlsConfig.Certificates) == 0 {
+		return
+	}
+
+	var leafs []*x509.Certificate
+	for _, cert := range e.tlsConfig.Certificates {
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) != 0 {
+			var err error
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				continue
+			}
+		}
+		if leaf != nil {
+			leafs = append(leafs, leaf)
+		}
+	}
+
+	for _, domain := range e.domains {
+		covered := false
+		for _, leaf := range leafs {
+			if leaf.VerifyHostname("mta-sts."+domain) == nil {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			e.logger.Msg("no certificate for the policy host, senders will ignore the policy",
+				"host", "mta-sts."+domain)
+		}
+	}
+}
+
+// Domains returns the list of domains the policy is served for.
+func (e *Endpoint) Domains() []string {
+	return e.domains
+}
+
+// Policy returns the served policy.
+func (e *Endpoint) Policy() Policy {
+	return e.policy
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != PolicyPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	domain := strings.TrimPrefix(host, "mta-sts.")
+	if _, ok := e.domainsSet[domain]; !ok || domain == host {
+		e.logger.DebugMsg("policy requested for unknown domain", "host", r.Host, "remote_addr", r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := io.WriteString(w, e.policyText); err != nil {
+		e.logger.DebugMsg("failed to write response", "reason", err)
+	}
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
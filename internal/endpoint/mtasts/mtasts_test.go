@@ -0,0 +1,95 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mtasts
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestPolicy(t *testing.T) {
+	p := Policy{
+		Mode:   "enforce",
+		MX:     []string{"mx1.example.org", "*.mx.example.org"},
+		MaxAge: 7 * 24 * time.Hour,
+	}
+	want := "version: STSv1\r\n" +
+		"mode: enforce\r\n" +
+		"mx: mx1.example.org\r\n" +
+		"mx: *.mx.example.org\r\n" +
+		"max_age: 604800\r\n"
+	if text := p.Text(); text != want {
+		t.Errorf("wrong policy text:\n%s", text)
+	}
+
+	id := p.ID()
+	if len(id) != 20 {
+		t.Errorf("wrong ID length: %s", id)
+	}
+	if rec := p.DNSRecord(); rec != "v=STSv1; id="+id {
+		t.Errorf("wrong DNS record: %s", rec)
+	}
+
+	p.Mode = "testing"
+	if p.ID() == id {
+		t.Errorf("ID is not changed after the policy change")
+	}
+}
+
+func TestEndpoint_ServeHTTP(t *testing.T) {
+	e := &Endpoint{
+		logger:     testutils.Logger(t, modName),
+		domainsSet: map[string]struct{}{"example.org": {}},
+		policyText: "version: STSv1\r\n",
+	}
+
+	test := func(method, url string, wantCode int) {
+		t.Helper()
+		req := httptest.NewRequest(method, url, nil)
+		w := httptest.NewRecorder()
+		e.ServeHTTP(w, req)
+		resp := w.Result()
+		if resp.StatusCode != wantCode {
+			t.Errorf("%s %s: wrong status: %d, want %d", method, url, resp.StatusCode, wantCode)
+			return
+		}
+		if wantCode != http.StatusOK {
+			return
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("%s %s: wrong Content-Type: %s", method, url, ct)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		if string(body) != e.policyText {
+			t.Errorf("%s %s: wrong body: %q", method, url, body)
+		}
+	}
+
+	test("GET", "https://mta-sts.example.org/.well-known/mta-sts.txt", http.StatusOK)
+	test("GET", "https://MTA-STS.Example.org:443/.well-known/mta-sts.txt", http.StatusOK)
+	test("GET", "https://mta-sts.example.com/.well-known/mta-sts.txt", http.StatusNotFound)
+	test("GET", "https://example.org/.well-known/mta-sts.txt", http.StatusNotFound)
+	test("GET", "https://mta-sts.example.org/", http.StatusNotFound)
+	test("POST", "https://mta-sts.example.org/.well-known/mta-sts.txt", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,62 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mtasts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy is the MTA-STS policy as defined in RFC 8461 Section 3.2.
+type Policy struct {
+	// Mode is one of "enforce", "testing" or "none".
+	Mode   string
+	MX     []string
+	MaxAge time.Duration
+}
+
+// Text returns the policy file contents.
+func (p Policy) Text() string {
+	var b strings.Builder
+	b.WriteString("version: STSv1\r\n")
+	b.WriteString("mode: " + p.Mode + "\r\n")
+	for _, mx := range p.MX {
+		b.WriteString("mx: " + mx + "\r\n")
+	}
+	b.WriteString("max_age: " + strconv.FormatInt(int64(p.MaxAge/time.Second), 10) + "\r\n")
+	return b.String()
+}
+
+// ID returns the policy identifier for the _mta-sts DNS record.
+//
+// It is derived from the policy contents so it changes each time the policy
+// is changed, as required by RFC 8461 Section 3.1.
+func (p Policy) ID() string {
+	sum := sha256.Sum256([]byte(p.Text()))
+	return hex.EncodeToString(sum[:10])
+}
+
+// DNSRecord returns the value of the TXT record that should be published at
+// _mta-sts.<domain>.
+func (p Policy) DNSRecord() string {
+	return "v=STSv1; id=" + p.ID()
+}
@@ -0,0 +1,157 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package openmetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// eventsBufferSize is the amount of log events that can be queued for a slow
+// stream client before they start being dropped.
+const eventsBufferSize = 512
+
+// droppedReportInterval is how often the stream client is notified about
+// dropped events if there are no new events to send.
+const droppedReportInterval = time.Second
+
+type eventFilter struct {
+	module string
+	check  string
+	msgID  string
+	debug  bool
+}
+
+func filterFromQuery(r *http.Request) eventFilter {
+	q := r.URL.Query()
+	f := eventFilter{
+		module: q.Get("module"),
+		check:  q.Get("check"),
+		msgID:  q.Get("msg_id"),
+	}
+	switch q.Get("level") {
+	case "debug":
+		f.debug = true
+	}
+	return f
+}
+
+func (f eventFilter) match(ev log.Event) bool {
+	if ev.Debug && !f.debug {
+		return false
+	}
+	if f.module != "" && ev.Module != f.module && !strings.HasPrefix(ev.Module, f.module+"/") {
+		return false
+	}
+	if f.check != "" {
+		checkField, _ := ev.Fields["check"].(string)
+		if ev.Module != f.check && ev.Module != "check."+f.check &&
+			checkField != f.check && checkField != "check."+f.check {
+			return false
+		}
+	}
+	if f.msgID != "" {
+		msgID, _ := ev.Fields["msg_id"].(string)
+		traceID, _ := ev.Fields["trace_id"].(string)
+		if msgID != f.msgID && traceID != f.msgID {
+			return false
+		}
+	}
+	return true
+}
+
+// serveEvents streams log events to the client using the Server-Sent Events
+// (EventSource) protocol.
+func (e *Endpoint) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	filter := filterFromQuery(r)
+
+	sub := log.Subscribe(eventsBufferSize)
+	defer log.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	e.logger.DebugMsg("event stream client connected", "remote_addr", r.RemoteAddr)
+	defer e.logger.DebugMsg("event stream client disconnected", "remote_addr", r.RemoteAddr)
+
+	ticker := time.NewTicker(droppedReportInterval)
+	defer ticker.Stop()
+
+	var lastDropped uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			// Make sure the client learns about lost events even if the
+			// stream goes quiet after them.
+			if err := reportDropped(w, sub, &lastDropped); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := reportDropped(w, sub, &lastDropped); err != nil {
+				return
+			}
+			if !filter.match(ev) {
+				continue
+			}
+
+			evBlob, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", evBlob); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// reportDropped sends the "dropped" event with the amount of events dropped
+// since the last call, if any.
+func reportDropped(w io.Writer, sub *log.Subscription, lastDropped *uint64) error {
+	dropped := sub.Dropped()
+	if dropped == *lastDropped {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "event: dropped\ndata: %d\n\n", dropped-*lastDropped); err != nil {
+		return err
+	}
+	*lastDropped = dropped
+	return nil
+}
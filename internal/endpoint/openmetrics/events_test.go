@@ -0,0 +1,123 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package openmetrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+func TestEventFilter(t *testing.T) {
+	events := map[string]log.Event{
+		"plain":   {Module: "smtp", Message: "msg"},
+		"sub":     {Module: "smtp/pipeline", Message: "msg"},
+		"debug":   {Module: "smtp", Message: "msg", Debug: true},
+		"check":   {Module: "smtp/pipeline", Message: "msg", Fields: map[string]interface{}{"check": "check.dnsbl"}},
+		"msgID":   {Module: "smtp", Message: "msg", Fields: map[string]interface{}{"msg_id": "abc"}},
+		"traceID": {Module: "queue", Message: "msg", Fields: map[string]interface{}{"trace_id": "abc"}},
+		"other":   {Module: "imap", Message: "msg"},
+	}
+
+	test := func(query string, expected ...string) {
+		t.Helper()
+		f := filterFromQuery(httptest.NewRequest("GET", "/events?"+query, nil))
+		matched := map[string]bool{}
+		for _, name := range expected {
+			matched[name] = true
+		}
+		for name, ev := range events {
+			if f.match(ev) != matched[name] {
+				t.Errorf("%s: %s: expected match=%v", query, name, matched[name])
+			}
+		}
+	}
+
+	test("", "plain", "sub", "check", "msgID", "traceID", "other")
+	test("level=debug", "plain", "sub", "debug", "check", "msgID", "traceID", "other")
+	test("module=smtp", "plain", "sub", "check", "msgID")
+	test("check=dnsbl", "check")
+	test("msg_id=abc", "msgID", "traceID")
+}
+
+func TestIsLocal(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"tcp://127.0.0.1:9749": true,
+		"tcp://[::1]:9749":     true,
+		"tcp://localhost:9749": true,
+		"unix:///run/om.sock":  true,
+		"tcp://0.0.0.0:9749":   false,
+		"tcp://192.0.2.1:9749": false,
+	} {
+		endp, err := config.ParseEndpoint(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isLocal(endp) != expected {
+			t.Errorf("%s: expected %v", addr, expected)
+		}
+	}
+}
+
+func TestLogStream_NonLocal(t *testing.T) {
+	mod, err := New(modName, []string{"tcp://0.0.0.0:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{{Name: "log_stream", Args: []string{"yes"}}},
+	}))
+	if err == nil {
+		mod.(*Endpoint).Close()
+		t.Fatal("log_stream enabled on non-local listener")
+	}
+}
+
+func TestReportDropped(t *testing.T) {
+	sub := log.Subscribe(1)
+	defer log.Unsubscribe(sub)
+
+	l := log.Logger{Name: "test", Out: log.NopOutput{}}
+	for i := 0; i < 3; i++ {
+		l.Msg("event")
+	}
+
+	var (
+		buf  bytes.Buffer
+		last uint64
+	)
+	// Nothing is read from the subscription, the notice is still sent.
+	if err := reportDropped(&buf, sub, &last); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "event: dropped\ndata: 2\n\n" {
+		t.Errorf("Wrong notice: %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := reportDropped(&buf, sub, &last); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Notice is sent twice: %q", buf.String())
+	}
+}
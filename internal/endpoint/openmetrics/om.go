@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package openmetrics
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -26,16 +27,23 @@ import (
 	"sync"
 
 	"github.com/foxcpp/maddy/framework/config"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/adminui"
+	"github.com/foxcpp/maddy/internal/rejectstats"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const modName = "openmetrics"
 
 type Endpoint struct {
-	addrs  []string
-	logger log.Logger
+	addrs     []string
+	logger    log.Logger
+	logStream bool
+	adminUI   *adminui.UI
+	rejStats  *rejectstats.Aggregator
+	tlsConfig *tls.Config
 
 	listenersWg sync.WaitGroup
 	serv        http.Server
@@ -51,34 +59,66 @@ func New(_ string, args []string) (module.Module, error) {
 
 func (e *Endpoint) Init(cfg *config.Map) error {
 	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.Bool("log_stream", false, false, &e.logStream)
+	cfg.Custom("admin_ui", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		return adminui.New(m.Globals, node, e.logger)
+	}, &e.adminUI)
+	cfg.Custom("rejection_stats", false, false, nil, rejectStatsDirective, &e.rejStats)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	e.mux = http.NewServeMux()
-	e.mux.Handle("/metrics", promhttp.Handler())
-	e.serv.Handler = e.mux
-
-	for _, a := range e.addrs {
-		a := a
-		endp, err := config.ParseEndpoint(a)
-		if err != nil {
-			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
-		}
-		if endp.IsTLS() {
-			return fmt.Errorf("%s: TLS is not supported yet", modName)
+	endpoints, err := e.parseEndpoints()
+	if err != nil {
+		if e.adminUI != nil {
+			e.adminUI.Close()
 		}
+		return err
+	}
+
+	listeners := make([]net.Listener, 0, len(endpoints))
+	for _, endp := range endpoints {
 		l, err := net.Listen(endp.Network(), endp.Address())
 		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			if e.adminUI != nil {
+				e.adminUI.Close()
+			}
 			return fmt.Errorf("%s: %v", modName, err)
 		}
+		if endp.IsTLS() {
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+		listeners = append(listeners, l)
+	}
+
+	e.mux = http.NewServeMux()
+	e.mux.Handle("/metrics", promhttp.Handler())
+	if e.logStream {
+		e.mux.HandleFunc("/events", e.serveEvents)
+	}
+	if e.adminUI != nil {
+		e.mux.Handle(adminui.Prefix, e.adminUI)
+	}
+	if e.rejStats != nil {
+		rejectstats.Register(e.rejStats)
+		e.mux.HandleFunc("/rejections", e.serveRejections)
+	}
+	e.serv.Handler = e.mux
+
+	for i, endp := range endpoints {
+		endp, l := endp, listeners[i]
 
 		e.listenersWg.Add(1)
 		go func() {
+			defer e.listenersWg.Done()
 			e.logger.Println("listening on", endp.String())
 			err := e.serv.Serve(l)
 			if err != nil && !errors.Is(err, http.ErrServerClosed) {
-				e.logger.Error("serve failed", err, "endpoint", a)
+				e.logger.Error("serve failed", err, "endpoint", endp.String())
 			}
 		}()
 	}
@@ -86,6 +126,42 @@ func (e *Endpoint) Init(cfg *config.Map) error {
 	return nil
 }
 
+func (e *Endpoint) parseEndpoints() ([]config.Endpoint, error) {
+	endpoints := make([]config.Endpoint, 0, len(e.addrs))
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		if endp.IsTLS() && e.tlsConfig == nil {
+			return nil, fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+		}
+		// Log stream has no authentication and admin UI credentials are
+		// sent in plain text without TLS.
+		if e.logStream && !isLocal(endp) {
+			return nil, fmt.Errorf("%s: log_stream can be used only with loopback or Unix socket listeners, %s is not", modName, a)
+		}
+		if e.adminUI != nil && !endp.IsTLS() && !isLocal(endp) {
+			return nil, fmt.Errorf("%s: admin_ui can be used only with TLS, loopback or Unix socket listeners, %s is not", modName, a)
+		}
+		endpoints = append(endpoints, endp)
+	}
+	return endpoints, nil
+}
+
+// isLocal reports whether the endpoint is accessible only from the local
+// machine.
+func isLocal(endp config.Endpoint) bool {
+	if endp.Scheme == "unix" {
+		return true
+	}
+	if endp.Host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(endp.Host)
+	return ip != nil && ip.IsLoopback()
+}
+
 func (e *Endpoint) Name() string {
 	return modName
 }
@@ -98,6 +174,12 @@ func (e *Endpoint) Close() error {
 	if err := e.serv.Close(); err != nil {
 		return err
 	}
+	if e.adminUI != nil {
+		e.adminUI.Close()
+	}
+	if e.rejStats != nil {
+		rejectstats.Unregister(e.rejStats)
+	}
 	e.listenersWg.Wait()
 	return nil
 }
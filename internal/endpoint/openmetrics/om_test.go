@@ -0,0 +1,74 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package openmetrics
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/adminui"
+)
+
+func TestParseEndpoints_AdminUI(t *testing.T) {
+	check := func(addr string, tlsConfig *tls.Config, ok bool) {
+		t.Helper()
+		e := &Endpoint{
+			addrs:     []string{addr},
+			adminUI:   &adminui.UI{},
+			tlsConfig: tlsConfig,
+		}
+		_, err := e.parseEndpoints()
+		if (err == nil) != ok {
+			t.Errorf("%s: ok=%v, err: %v", addr, ok, err)
+		}
+	}
+
+	check("tcp://127.0.0.1:9749", nil, true)
+	check("unix:///run/maddy/om.sock", nil, true)
+	check("tcp://0.0.0.0:9749", nil, false)
+	check("tls://0.0.0.0:9749", nil, false)
+	check("tls://0.0.0.0:9749", &tls.Config{}, true)
+}
+
+func TestInit_ListenFailure(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	sock := filepath.Join(t.TempDir(), "om.sock")
+	mod, err := New(modName, []string{"unix://" + sock, "tcp://" + busy.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err == nil {
+		mod.(*Endpoint).Close()
+		t.Fatal("Init succeeded with the address in use")
+	}
+
+	// Unix socket is removed when the listener is closed.
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Error("listener opened before the failure is not closed:", err)
+	}
+}
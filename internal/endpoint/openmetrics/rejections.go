@@ -0,0 +1,71 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package openmetrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/rejectstats"
+)
+
+// RejectionsResponse is the JSON body returned by the /rejections handler.
+type RejectionsResponse struct {
+	Current rejectstats.Report   `json:"current"`
+	Reports []rejectstats.Report `json:"reports"`
+}
+
+func rejectStatsDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var (
+		period time.Duration
+		keep   int
+		top    int
+	)
+
+	childM := config.NewMap(m.Globals, node)
+	childM.Duration("period", false, false, 24*time.Hour, &period)
+	childM.Int("keep", false, false, 7, &keep)
+	childM.Int("top", false, false, 20, &top)
+	if _, err := childM.Process(); err != nil {
+		return nil, err
+	}
+
+	if period <= 0 {
+		return nil, config.NodeErr(node, "period should be positive")
+	}
+	if keep < 0 || top < 0 {
+		return nil, config.NodeErr(node, "keep and top can't be negative")
+	}
+
+	return rejectstats.NewAggregator(period, keep, top), nil
+}
+
+func (e *Endpoint) serveRejections(w http.ResponseWriter, r *http.Request) {
+	cur, reports := e.rejStats.Reports()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(RejectionsResponse{
+		Current: cur,
+		Reports: reports,
+	}); err != nil {
+		e.logger.Error("failed to write response", err)
+	}
+}
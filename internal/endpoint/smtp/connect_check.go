@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// connectCheckTimeout limits the time spent on connection-stage checks before
+// the greeting is sent.
+const connectCheckTimeout = 30 * time.Second
+
+var errConnDropped = errors.New("smtp: connection dropped by the connection-stage check")
+
+// connCheckListener runs connection-stage checks of the pipeline (see
+// module.ConnectCheck) for accepted connections.
+type connCheckListener struct {
+	net.Listener
+	endp *Endpoint
+	// Set for implicit TLS listeners, the rejection can't be reported to
+	// the client before the handshake.
+	tls bool
+}
+
+func (l connCheckListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &connCheckConn{Conn: conn, endp: l.endp, tls: l.tls}, nil
+}
+
+// connCheckConn runs checks on the first read or write, that is before the
+// greeting is sent (or the TLS handshake is started for implicit TLS).
+type connCheckConn struct {
+	net.Conn
+	endp *Endpoint
+	tls  bool
+
+	checkOnce sync.Once
+	dropped   bool
+}
+
+func (c *connCheckConn) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), connectCheckTimeout)
+	defer cancel()
+
+	err := c.endp.pipeline.RunConnectChecks(ctx, c.RemoteAddr())
+	if err == nil {
+		return
+	}
+	c.dropped = true
+
+	c.endp.Log.Error("connection dropped", err, "src_ip", c.RemoteAddr())
+	if !c.tls {
+		// RFC 5321, Section 3.1 permits 554 as the greeting. 421 is used
+		// for temporary errors so the client may retry later.
+		smtpErr := c.endp.replyErr("", replyInfo{remoteAddr: c.RemoteAddr()}, true, "CONNECT", err)
+		code, enchCode := 554, smtpErr.EnhancedCode
+		if smtpErr.Code/100 == 4 {
+			code = 421
+		}
+		if enchCode == smtp.EnhancedCodeNotSet {
+			enchCode = smtp.EnhancedCode{code / 100, 0, 0}
+		}
+
+		var reply strings.Builder
+		lines := strings.Split(smtpErr.Message, "\n")
+		for i, line := range lines {
+			sep := '-'
+			if i == len(lines)-1 {
+				sep = ' '
+			}
+			fmt.Fprintf(&reply, "%d%c%d.%d.%d %s\r\n", code, sep, enchCode[0], enchCode[1], enchCode[2], line)
+		}
+		_, _ = io.WriteString(c.Conn, reply.String())
+	}
+	c.Conn.Close()
+}
+
+func (c *connCheckConn) Read(b []byte) (int, error) {
+	c.checkOnce.Do(c.check)
+	if c.dropped {
+		return 0, errConnDropped
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *connCheckConn) Write(b []byte) (int, error) {
+	c.checkOnce.Do(c.check)
+	if c.dropped {
+		return 0, errConnDropped
+	}
+	return c.Conn.Write(b)
+}
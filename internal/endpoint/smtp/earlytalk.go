@@ -0,0 +1,133 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// earlyTalker detects clients that send data before the greeting, this is
+// prohibited by RFC 5321 and is typical for spam bots that do not wait for
+// server responses.
+//
+// The greeting is delayed and the connection is watched for incoming data
+// meanwhile. Clients that talk early are rejected right away if the action
+// is 'reject', otherwise the action is applied to all messages from the
+// session.
+type earlyTalker struct {
+	delay  time.Duration
+	action modconfig.FailAction
+	log    log.Logger
+
+	// Remote addresses of detected early talkers.
+	conns sync.Map
+}
+
+var errEarlyTalker = errors.New("smtp: client sent data before the greeting")
+
+func (et *earlyTalker) detected(addr net.Addr) bool {
+	if et == nil || addr == nil {
+		return false
+	}
+	_, ok := et.conns.Load(addr.String())
+	return ok
+}
+
+type earlyTalkListener struct {
+	net.Listener
+	et *earlyTalker
+}
+
+func (l earlyTalkListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &earlyTalkConn{Conn: conn, et: l.et}, nil
+}
+
+type earlyTalkConn struct {
+	net.Conn
+	et *earlyTalker
+
+	greetOnce sync.Once
+	rejected  bool
+	closeOnce sync.Once
+
+	// Data read while waiting for the greeting delay, returned by
+	// subsequent Read calls.
+	pending []byte
+}
+
+// greet waits for the greeting delay and checks whether the client sent
+// anything.
+func (c *earlyTalkConn) greet() {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.et.delay)); err != nil {
+		return
+	}
+	buf := make([]byte, 512)
+	n, _ := c.Conn.Read(buf)
+	_ = c.Conn.SetReadDeadline(time.Time{})
+	if n == 0 {
+		return
+	}
+	c.pending = buf[:n]
+
+	c.et.log.Msg("early talker detected", "src_ip", c.RemoteAddr())
+	if c.et.action.Reject {
+		c.rejected = true
+		_, _ = c.Conn.Write([]byte("554 5.5.1 Protocol error: data sent before the greeting\r\n"))
+		c.Close()
+		return
+	}
+	c.et.conns.Store(c.RemoteAddr().String(), struct{}{})
+}
+
+func (c *earlyTalkConn) Write(b []byte) (int, error) {
+	c.greetOnce.Do(c.greet)
+	if c.rejected {
+		return 0, errEarlyTalker
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *earlyTalkConn) Read(b []byte) (int, error) {
+	if c.rejected {
+		return 0, errEarlyTalker
+	}
+	if len(c.pending) != 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *earlyTalkConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.et.conns.Delete(c.RemoteAddr().String())
+	})
+	return c.Conn.Close()
+}
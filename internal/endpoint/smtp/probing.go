@@ -0,0 +1,80 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// Address probing protection modes.
+const (
+	probingOff     = "off"
+	probingUniform = "uniform"
+	probingDiscard = "discard"
+)
+
+// isUnknownRcpt reports whether the RCPT error indicates that the recipient
+// mailbox does not exist.
+func isUnknownRcpt(err error) bool {
+	enchCode, ok := exterrors.Fields(err)["smtp_enchcode"].(exterrors.EnhancedCode)
+	return ok && enchCode == exterrors.EnhancedCode{5, 1, 1}
+}
+
+// uniformRcptErr is returned for all non-existent recipients in the 'uniform'
+// mode so the reply wording does not depend on the module that rejected the
+// address.
+func uniformRcptErr(err error) error {
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+		Message:      "Recipient address rejected",
+		Err:          err,
+	}
+}
+
+// filterRcptErr applies the probing protection to the RCPT error. nil is
+// returned if the recipient should be accepted and then silently discarded.
+func (s *Session) filterRcptErr(to string, err error) error {
+	if !isUnknownRcpt(err) {
+		return err
+	}
+
+	switch s.endp.probingProtection {
+	case probingUniform:
+		return uniformRcptErr(err)
+	case probingDiscard:
+		s.discardedRcpts = append(s.discardedRcpts, to)
+		s.log.Msg("RCPT discarded", "rcpt", to, "reason", err.Error(), "msg_id", s.msgMeta.ID)
+		return nil
+	}
+	return err
+}
+
+// padRcptTime delays the RCPT reply so it takes at least rcpt_response_time
+// since start, making lookup timing differences invisible to the client.
+func (s *Session) padRcptTime(start time.Time) {
+	if s.endp.rcptResponseTime == 0 {
+		return
+	}
+	if wait := s.endp.rcptResponseTime - time.Since(start); wait > 0 {
+		time.Sleep(wait)
+	}
+}
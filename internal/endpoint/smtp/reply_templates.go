@@ -0,0 +1,159 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// replyInfo is the information about the client used to customize error
+// replies.
+type replyInfo struct {
+	remoteAddr net.Addr
+	mailFrom   string
+	facts      *module.Facts
+}
+
+// replyTemplates replaces rejection messages with the localized versions
+// configured for the client.
+type replyTemplates struct {
+	log log.Logger
+
+	senderLocales  module.Table
+	countryLocales module.Table
+
+	// locale -> key -> message, key is a check name, an enhanced code,
+	// a basic code or "default".
+	messages map[string]map[string]string
+}
+
+func replyTemplatesDirective(m *config.Map, node config.Node) (interface{}, error) {
+	rt := &replyTemplates{
+		messages: map[string]map[string]string{},
+	}
+
+	cfg := config.NewMap(m.Globals, node)
+	cfg.Custom("sender_locales", false, false, nil, modconfig.TableDirective, &rt.senderLocales)
+	cfg.Custom("country_locales", false, false, nil, modconfig.TableDirective, &rt.countryLocales)
+	cfg.Callback("locale", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 1 {
+			return config.NodeErr(node, "exactly one argument is required")
+		}
+		locale := strings.ToLower(node.Args[0])
+		if _, ok := rt.messages[locale]; ok {
+			return config.NodeErr(node, "duplicate locale: %s", locale)
+		}
+		if len(node.Children) == 0 {
+			return config.NodeErr(node, "at least one message is required")
+		}
+
+		msgs := make(map[string]string, len(node.Children))
+		for _, child := range node.Children {
+			if len(child.Args) == 0 {
+				return config.NodeErr(child, "message is required")
+			}
+			msg, err := modconfig.JoinReplyLines(child.Args)
+			if err != nil {
+				return config.NodeErr(child, "%v", err)
+			}
+			msgs[strings.ToLower(child.Name)] = msg
+		}
+		rt.messages[locale] = msgs
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if rt.senderLocales == nil && rt.countryLocales == nil {
+		return nil, config.NodeErr(node, "sender_locales or country_locales should be set")
+	}
+	if len(rt.messages) == 0 {
+		return nil, config.NodeErr(node, "at least one locale should be defined")
+	}
+
+	return rt, nil
+}
+
+// locale selects the locale for the client. Sender domain mapping takes
+// precedence over the client country.
+func (rt *replyTemplates) locale(ctx context.Context, info replyInfo) string {
+	if rt.senderLocales != nil && info.mailFrom != "" {
+		_, domain, err := address.Split(info.mailFrom)
+		if err == nil && domain != "" {
+			domain, err = dns.ForLookup(domain)
+		}
+		if err == nil && domain != "" {
+			locale, ok, err := rt.senderLocales.Lookup(ctx, domain)
+			if err != nil {
+				rt.log.Error("sender_locales lookup failed", err, "domain", domain)
+			} else if ok {
+				return strings.ToLower(locale)
+			}
+		}
+	}
+
+	if rt.countryLocales != nil {
+		country, ok := info.facts.String(module.FactGeoCountry)
+		if ok && country != "" {
+			locale, ok, err := rt.countryLocales.Lookup(ctx, strings.ToUpper(country))
+			if err != nil {
+				rt.log.Error("country_locales lookup failed", err, "country", country)
+			} else if ok {
+				return strings.ToLower(locale)
+			}
+		}
+	}
+
+	return ""
+}
+
+// template returns the localized message for the reply.
+func (rt *replyTemplates) template(ctx context.Context, info replyInfo, code int, enchCode [3]int, checkName string) (string, bool) {
+	msgs, ok := rt.messages[rt.locale(ctx, info)]
+	if !ok {
+		return "", false
+	}
+
+	keys := []string{
+		fmt.Sprintf("%d.%d.%d", enchCode[0], enchCode[1], enchCode[2]),
+		strconv.Itoa(code),
+		"default",
+	}
+	if checkName != "" {
+		keys = append([]string{strings.ToLower(checkName)}, keys...)
+	}
+	for _, key := range keys {
+		if msg, ok := msgs[key]; ok {
+			return msg, true
+		}
+	}
+	return "", false
+}
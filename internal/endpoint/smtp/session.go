@@ -21,6 +21,7 @@ package smtp
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -29,6 +30,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -38,6 +40,9 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/maintenance"
+	"github.com/foxcpp/maddy/internal/rejectstats"
+	"github.com/foxcpp/maddy/internal/tlsfp"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -78,6 +83,8 @@ type Session struct {
 	connState        module.ConnState
 	repeatedMailErrs int
 	loggedRcptErrors int
+	sessionRcpts     int
+	tlsFingerprint   tlsfp.Fingerprint
 
 	// Specific for the currently handled message.
 	// msgCtx is not used for cancellation or timeouts, only for tracing.
@@ -93,6 +100,11 @@ type Session struct {
 	delivery    module.Delivery
 	deliveryErr error
 
+	// Recipients accepted but not passed to the delivery due to the
+	// rcpt_probing_protection discard mode.
+	acceptedRcpts  int
+	discardedRcpts []string
+
 	log log.Logger
 }
 
@@ -135,18 +147,28 @@ func (s *Session) cleanSession() {
 	s.msgMeta = nil
 	s.delivery = nil
 	s.deliveryErr = nil
+	s.acceptedRcpts = 0
+	s.discardedRcpts = nil
 	s.msgCtx = nil
 	s.msgTask.End()
 }
 
 func (s *Session) AuthPlain(username, password string) error {
+	return s.authPlain("", username, password)
+}
+
+// authPlain checks credentials and, if identity is not empty, whether
+// username is allowed to act as identity (see auth_impersonators).
+func (s *Session) authPlain(identity, username, password string) error {
+	s.endp.tarpit.delay(s.sessionCtx, s.connState.RemoteAddr)
+
 	if s.endp.serv.AuthDisabled {
 		return smtp.ErrAuthUnsupported
 	}
 
 	// Executed before authentication and session initialization.
 	if err := s.endp.pipeline.RunEarlyChecks(context.TODO(), &s.connState.ConnectionState); err != nil {
-		return s.endp.wrapErr("", true, "AUTH", err)
+		return s.endp.wrapErr("", s.replyInfo(), true, "AUTH", err)
 	}
 
 	err := s.endp.saslAuth.AuthPlain(username, password)
@@ -170,42 +192,82 @@ func (s *Session) AuthPlain(username, password string) error {
 		}
 	}
 
+	if identity != "" && identity != username {
+		if err := s.endp.saslAuth.Authorize(username, identity, s.connState.RemoteAddr); err != nil {
+			failedLogins.WithLabelValues(s.endp.name).Inc()
+			return &smtp.SMTPError{
+				Code:         535,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+				Message:      "Not permitted to act as the requested identity",
+			}
+		}
+		// Password of the impersonator is not passed down the pipeline
+		// since it is not valid for identity.
+		s.connState.AuthUser = identity
+		return nil
+	}
+
 	s.connState.AuthUser = username
 	s.connState.AuthPassword = password
 
 	return nil
 }
 
-func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.MailOptions) (string, error) {
-	var err error
+func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.MailOptions) (_ *module.MsgMetadata, err error) {
 	msgMeta := &module.MsgMetadata{
 		Conn:     &s.connState,
 		SMTPOpts: opts,
+		Facts:    module.NewFacts(),
+	}
+	defer func() {
+		if err != nil {
+			s.recordRejection("MAIL", from, "", msgMeta, err)
+		}
+	}()
+
+	msgMeta.ID, err = module.GenerateMsgID()
+	if err != nil {
+		return msgMeta, err
+	}
+	if s.connState.TLS.HandshakeComplete {
+		msgMeta.Facts.Set(module.FactTLSVersion, tlsVersionName(s.connState.TLS.Version))
+		msgMeta.Facts.Set(module.FactTLSCipher, tls.CipherSuiteName(s.connState.TLS.CipherSuite))
+	}
+	if s.tlsFingerprint.JA3 != "" {
+		msgMeta.Facts.Set(module.FactTLSJA3, s.tlsFingerprint.JA3)
+		msgMeta.Facts.Set(module.FactTLSJA4, s.tlsFingerprint.JA4)
+	}
+	earlyTalker := s.endp.earlyTalker.detected(s.connState.RemoteAddr)
+	if earlyTalker {
+		msgMeta.Quarantine = s.endp.earlyTalker.action.Quarantine
+		if score := s.endp.earlyTalker.action.Score; score != 0 {
+			msgMeta.Facts.Set(module.FactSessionScore, score)
+		}
 	}
 
+	logFields := []interface{}{
+		"src_host", msgMeta.Conn.Hostname,
+		"src_ip", msgMeta.Conn.RemoteAddr.String(),
+		"sender", from,
+		"msg_id", msgMeta.ID,
+	}
 	if s.connState.AuthUser != "" {
-		s.log.Msg("incoming message",
-			"src_host", msgMeta.Conn.Hostname,
-			"src_ip", msgMeta.Conn.RemoteAddr.String(),
-			"sender", from,
-			"msg_id", msgMeta.ID,
-			"username", s.connState.AuthUser,
-		)
-	} else {
-		s.log.Msg("incoming message",
-			"src_host", msgMeta.Conn.Hostname,
-			"src_ip", msgMeta.Conn.RemoteAddr.String(),
-			"sender", from,
-			"msg_id", msgMeta.ID,
-		)
+		logFields = append(logFields, "username", s.connState.AuthUser)
+	}
+	if s.tlsFingerprint.JA3 != "" {
+		logFields = append(logFields, "ja3", s.tlsFingerprint.JA3, "ja4", s.tlsFingerprint.JA4)
 	}
+	if earlyTalker {
+		logFields = append(logFields, "early_talker", true)
+	}
+	s.log.Msg("incoming message", logFields...)
 
 	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
 	// used.
 	if !opts.UTF8 {
 		for _, ch := range from {
 			if ch > 128 {
-				return "", &exterrors.SMTPError{
+				return msgMeta, &exterrors.SMTPError{
 					Code:         550,
 					EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
 					Message:      "SMTPUTF8 is required for non-ASCII senders",
@@ -217,9 +279,17 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	// Decode punycode, normalize to NFC and case-fold address.
 	cleanFrom := from
 	if from != "" {
-		cleanFrom, err = address.CleanDomain(from)
+		if err := address.Validate(from, opts.UTF8, s.endp.addrStrictness); err != nil {
+			return msgMeta, &exterrors.SMTPError{
+				Code:         553,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
+				Message:      "Malformed sender address",
+				Err:          err,
+			}
+		}
+		cleanFrom, err = address.Normalize(from)
 		if err != nil {
-			return "", &exterrors.SMTPError{
+			return msgMeta, &exterrors.SMTPError{
 				Code:         553,
 				EnhancedCode: exterrors.EnhancedCode{5, 1, 7},
 				Message:      "Unable to normalize the sender address",
@@ -227,17 +297,13 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 		}
 	}
 
-	msgMeta.ID, err = module.GenerateMsgID()
-	if err != nil {
-		return "", err
-	}
 	msgMeta.OriginalFrom = from
 
 	domain := ""
 	if cleanFrom != "" {
 		_, domain, err = address.Split(cleanFrom)
 		if err != nil {
-			return "", err
+			return msgMeta, err
 		}
 	}
 	remoteIP, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
@@ -245,7 +311,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 		remoteIP = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 	}
 	if err := s.endp.limits.TakeMsg(context.Background(), remoteIP.IP, domain); err != nil {
-		return "", err
+		return msgMeta, err
 	}
 
 	s.msgCtx, s.msgTask = trace.NewTask(ctx, "Incoming Message")
@@ -258,7 +324,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 		s.msgCtx = nil
 		s.msgTask.End()
 		s.endp.limits.ReleaseMsg(remoteIP.IP, domain)
-		return msgMeta.ID, err
+		return msgMeta, err
 	}
 
 	startedSMTPTransactions.WithLabelValues(s.endp.name).Inc()
@@ -267,25 +333,32 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	s.mailFrom = cleanFrom
 	s.delivery = delivery
 
-	return msgMeta.ID, nil
+	return msgMeta, nil
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	s.endp.tarpit.delay(s.sessionCtx, s.connState.RemoteAddr)
+
 	if s.endp.authAlwaysRequired && s.connState.AuthUser == "" {
 		return smtp.ErrAuthRequired
 	}
 
+	if maintenance.Enabled() {
+		return s.endp.wrapErr("", s.replyInfo(), !opts.UTF8, "MAIL", maintenance.SMTPError())
+	}
+
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
 	if !s.endp.deferServerReject {
 		// Will initialize s.msgCtx.
-		msgID, err := s.startDelivery(s.sessionCtx, from, *opts)
+		msgMeta, err := s.startDelivery(s.sessionCtx, from, *opts)
 		if err != nil {
 			if !errors.Is(err, context.DeadlineExceeded) {
-				s.log.Error("MAIL FROM error", err, "msg_id", msgID)
+				s.log.Error("MAIL FROM error", err, "msg_id", msgMeta.ID)
 			}
-			return s.endp.wrapErr(msgID, !opts.UTF8, "MAIL", err)
+			info := replyInfo{remoteAddr: s.connState.RemoteAddr, mailFrom: from, facts: msgMeta.Facts}
+			return s.endp.wrapErr(msgMeta.ID, info, !opts.UTF8, "MAIL", err)
 		}
 	}
 
@@ -305,10 +378,9 @@ func (s *Session) fetchRDNSName(ctx context.Context) {
 		return
 	}
 
-	name, err := dns.LookupAddr(ctx, s.endp.resolver, tcpAddr.IP)
+	ad, name, err := dns.AuthLookupAddr(ctx, s.endp.resolver, tcpAddr.IP)
 	if err != nil {
-		dnsErr, ok := err.(*net.DNSError)
-		if ok && dnsErr.IsNotFound {
+		if dns.IsNotFound(err) {
 			s.connState.RDNSName.Set(nil, nil)
 			return
 		}
@@ -326,13 +398,18 @@ func (s *Session) fetchRDNSName(ctx context.Context) {
 		return
 	}
 
+	s.connState.RDNSAuthenticated = ad
 	s.connState.RDNSName.Set(name, nil)
 }
 
 func (s *Session) Rcpt(to string) error {
+	s.endp.tarpit.delay(s.sessionCtx, s.connState.RemoteAddr)
+
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
+	defer s.padRcptTime(time.Now())
+
 	// deferServerReject = true and this is the first RCPT TO command.
 	if s.delivery == nil {
 		// If we already attempted to initialize the delivery -
@@ -344,16 +421,26 @@ func (s *Session) Rcpt(to string) error {
 		}
 
 		// It will initialize s.msgCtx.
-		msgID, err := s.startDelivery(s.sessionCtx, s.mailFrom, s.opts)
+		msgMeta, err := s.startDelivery(s.sessionCtx, s.mailFrom, s.opts)
 		if err != nil {
 			if !errors.Is(err, context.DeadlineExceeded) {
-				s.log.Error("MAIL FROM error (deferred)", err, "rcpt", to, "msg_id", msgID)
+				s.log.Error("MAIL FROM error (deferred)", err, "rcpt", to, "msg_id", msgMeta.ID)
 			}
-			s.deliveryErr = s.endp.wrapErr(msgID, !s.opts.UTF8, "RCPT", err)
+			info := replyInfo{remoteAddr: s.connState.RemoteAddr, mailFrom: s.mailFrom, facts: msgMeta.Facts}
+			s.deliveryErr = s.endp.wrapErr(msgMeta.ID, info, !s.opts.UTF8, "RCPT", err)
 			return s.deliveryErr
 		}
 	}
 
+	if s.endp.maxSessionRcpts != 0 && s.sessionRcpts >= s.endp.maxSessionRcpts {
+		s.log.Msg("too many recipients in session", "rcpt", to, "msg_id", s.msgMeta.ID)
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+			Message:      "Too many recipients in this session",
+		}
+	}
+
 	rcptCtx, rcptTask := trace.NewTask(s.msgCtx, "RCPT TO")
 	defer rcptTask.End()
 
@@ -365,8 +452,16 @@ func (s *Session) Rcpt(to string) error {
 				s.log.Msg("too many RCPT errors, possible dictonary attack", "src_ip", s.connState.RemoteAddr, "msg_id", s.msgMeta.ID)
 			}
 		}
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "RCPT", err)
+		err = s.filterRcptErr(to, err)
+		if err == nil {
+			s.sessionRcpts++
+		} else {
+			s.recordRejection("RCPT", s.mailFrom, to, s.msgMeta, err)
+		}
+		return s.endp.wrapErr(s.msgMeta.ID, s.replyInfo(), !s.opts.UTF8, "RCPT", err)
 	}
+	s.acceptedRcpts++
+	s.sessionRcpts++
 	s.endp.Log.Msg("RCPT ok", "rcpt", to, "msg_id", s.msgMeta.ID)
 	return nil
 }
@@ -381,7 +476,15 @@ func (s *Session) rcpt(ctx context.Context, to string) error {
 			Message:      "SMTPUTF8 is required for non-ASCII recipients",
 		}
 	}
-	cleanTo, err := address.CleanDomain(to)
+	if err := address.Validate(to, s.opts.UTF8, s.endp.addrStrictness); err != nil {
+		return &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 3},
+			Message:      "Malformed recipient address",
+			Err:          err,
+		}
+	}
+	cleanTo, err := address.Normalize(to)
 	if err != nil {
 		return &exterrors.SMTPError{
 			Code:         501,
@@ -410,7 +513,39 @@ func (s *Session) Logout() error {
 	return nil
 }
 
+// declaredSizeLimit returns the maximum accepted message size for the SIZE
+// value declared by the client. Some slack is allowed since clients may
+// estimate the size (e.g. before line endings conversion).
+func declaredSizeLimit(size int) int64 {
+	return int64(size) + int64(size)/10 + 1024
+}
+
+// sizeErr converts the error returned by go-smtp if max_message_size is
+// exceeded into the one that will be correctly reported to the client.
+func sizeErr(err error) error {
+	if errors.Is(err, smtp.ErrDataTooLarge) {
+		return &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message:      "Message size exceeds limit",
+			Err:          err,
+		}
+	}
+	return err
+}
+
 func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, error) {
+	if s.endp.enforceDeclaredSize && s.opts.Size > 0 {
+		// RFC 1870 allows to reject messages that exceed the declared size.
+		// Reading is stopped at the limit and go-smtp discards the rest so the
+		// oversized message is not buffered.
+		r = limitReader(r, declaredSizeLimit(s.opts.Size), &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message:      "Message size exceeds the declared SIZE",
+		})
+	}
+
 	limitr := limitReader(r, int64(s.endp.maxHeaderBytes), &exterrors.SMTPError{
 		Code:         552,
 		EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
@@ -420,7 +555,7 @@ func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, err
 	bufr := bufio.NewReader(limitr)
 	header, err := textproto.ReadHeader(bufr)
 	if err != nil {
-		return textproto.Header{}, nil, fmt.Errorf("I/O error while parsing header: %w", err)
+		return textproto.Header{}, nil, fmt.Errorf("I/O error while parsing header: %w", sizeErr(err))
 	}
 
 	if s.endp.submission {
@@ -435,13 +570,15 @@ func (s *Session) prepareBody(r io.Reader) (textproto.Header, buffer.Buffer, err
 
 	buf, err := s.endp.buffer(bufr)
 	if err != nil {
-		return textproto.Header{}, nil, fmt.Errorf("I/O error while writing buffer: %w", err)
+		return textproto.Header{}, nil, fmt.Errorf("I/O error while writing buffer: %w", sizeErr(err))
 	}
 
 	return header, buf, nil
 }
 
 func (s *Session) Data(r io.Reader) error {
+	s.endp.tarpit.delay(s.sessionCtx, s.connState.RemoteAddr)
+
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -450,7 +587,8 @@ func (s *Session) Data(r io.Reader) error {
 
 	wrapErr := func(err error) error {
 		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
+		s.recordRejection("DATA", s.mailFrom, "", s.msgMeta, err)
+		return s.endp.wrapErr(s.msgMeta.ID, s.replyInfo(), !s.opts.UTF8, "DATA", err)
 	}
 
 	header, buf, err := s.prepareBody(r)
@@ -470,6 +608,14 @@ func (s *Session) Data(r io.Reader) error {
 		return wrapErr(err)
 	}
 
+	if s.acceptedRcpts == 0 && len(s.discardedRcpts) != 0 {
+		if err := s.delivery.Abort(bodyCtx); err != nil {
+			s.endp.Log.Error("delivery abort failed", err)
+		}
+		s.log.Msg("discarded", "msg_id", s.msgMeta.ID, "rcpts", s.discardedRcpts)
+		return nil
+	}
+
 	if strings.EqualFold(header.Get("TLS-Required"), "No") {
 		s.msgMeta.TLSRequireOverride = true
 	}
@@ -482,21 +628,49 @@ func (s *Session) Data(r io.Reader) error {
 		return wrapErr(err)
 	}
 
-	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+	s.logAccepted()
 
 	return nil
 }
 
+func (s *Session) logAccepted() {
+	facts := s.msgMeta.Facts.Map()
+	if len(facts) == 0 {
+		s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+		return
+	}
+	s.log.Msg("accepted", "msg_id", s.msgMeta.ID, "facts", facts)
+}
+
+func tlsVersionName(ver uint16) string {
+	switch ver {
+	case tls.VersionTLS13:
+		return "1.3"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS10:
+		return "1.0"
+	}
+	return "unknown"
+}
+
 type statusWrapper struct {
 	sc smtp.StatusCollector
 	s  *Session
 }
 
 func (sw statusWrapper) SetStatus(rcpt string, err error) {
-	sw.sc.SetStatus(rcpt, sw.s.endp.wrapErr(sw.s.msgMeta.ID, !sw.s.opts.UTF8, "DATA", err))
+	if err != nil {
+		sw.s.recordRejection("DATA", sw.s.mailFrom, rcpt, sw.s.msgMeta, err)
+	}
+	sw.sc.SetStatus(rcpt, sw.s.endp.wrapErr(sw.s.msgMeta.ID, sw.s.replyInfo(), !sw.s.opts.UTF8, "DATA", err))
 }
 
 func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
+	s.endp.tarpit.delay(s.sessionCtx, s.connState.RemoteAddr)
+
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
 
@@ -505,7 +679,8 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 
 	wrapErr := func(err error) error {
 		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
-		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
+		s.recordRejection("DATA", s.mailFrom, "", s.msgMeta, err)
+		return s.endp.wrapErr(s.msgMeta.ID, s.replyInfo(), !s.opts.UTF8, "DATA", err)
 	}
 
 	header, buf, err := s.prepareBody(r)
@@ -537,7 +712,7 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 		return wrapErr(err)
 	}
 
-	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+	s.logAccepted()
 
 	return nil
 }
@@ -562,11 +737,67 @@ func (s *Session) checkRoutingLoops(header textproto.Header) error {
 	return nil
 }
 
-func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err error) error {
+// recordRejection passes the information about the rejected command to the
+// rejection statistics.
+func (s *Session) recordRejection(command, sender, rcpt string, msgMeta *module.MsgMetadata, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+
+	fields := exterrors.Fields(err)
+	check, _ := fields["check"].(string)
+	if check == "" {
+		check, _ = fields["target"].(string)
+	}
+	code, ok := fields["smtp_code"].(int)
+	if !ok {
+		code = exterrors.SMTPCode(err, 451, 554)
+	}
+	codeStr := strconv.Itoa(code)
+	if enchCode, ok := fields["smtp_enchcode"].(exterrors.EnhancedCode); ok {
+		codeStr += " " + enchCode.FormatLog()
+	}
+
+	var domain string
+	if sender != "" {
+		_, domain, _ = address.Split(sender)
+	}
+	asn, _ := msgMeta.Facts.Int(module.FactClientASN)
+	msg, _ := fields["smtp_msg"].(string)
+	reason, _ := fields["reason"].(string)
+
+	rejectstats.Record(rejectstats.Rejection{
+		Command:      command,
+		MsgID:        msgMeta.ID,
+		Sender:       sender,
+		Rcpt:         rcpt,
+		Check:        check,
+		Code:         codeStr,
+		Message:      msg,
+		Reason:       reason,
+		SenderDomain: domain,
+		ASN:          uint(asn),
+	})
+}
+
+// wrapErr converts err into the reply that is sent to the client.
+//
+// go-smtp writes each reply as a single line so lines of multi-line messages
+// are joined together.
+func (endp *Endpoint) wrapErr(msgId string, info replyInfo, mangleUTF8 bool, command string, err error) error {
 	if err == nil {
 		return nil
 	}
 
+	res := endp.replyErr(msgId, info, mangleUTF8, command, err)
+	res.Message = strings.ReplaceAll(res.Message, "\n", " ")
+	return res
+}
+
+// replyErr is similar to wrapErr but keeps line breaks in the returned
+// message.
+func (endp *Endpoint) replyErr(msgId string, info replyInfo, mangleUTF8 bool, command string, err error) *smtp.SMTPError {
+
 	if errors.Is(err, context.DeadlineExceeded) {
 		return &smtp.SMTPError{
 			Code:         451,
@@ -609,6 +840,15 @@ func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err
 		res.Message = smtpErr.Message
 	}
 
+	res.Message = endp.expandReply(res.Message, info, ctxInfo, res.Message)
+	if endp.replyTemplates != nil && res.Code/100 == 5 {
+		checkName, _ := ctxInfo["check"].(string)
+		tmpl, ok := endp.replyTemplates.template(context.TODO(), info, res.Code, res.EnhancedCode, checkName)
+		if ok {
+			res.Message = endp.expandReply(tmpl, info, ctxInfo, res.Message)
+		}
+	}
+
 	if msgId != "" {
 		res.Message += " (msg ID = " + msgId + ")"
 	}
@@ -635,3 +875,37 @@ func (endp *Endpoint) wrapErr(msgId string, mangleUTF8 bool, command string, err
 
 	return res
 }
+
+// expandReply replaces placeholders in the reply message configured by the
+// server administrator. origMsg is used for {message}.
+func (endp *Endpoint) expandReply(msg string, info replyInfo, fields map[string]interface{}, origMsg string) string {
+	if !strings.Contains(msg, "{") {
+		return msg
+	}
+
+	clientIP := ""
+	if tcpAddr, ok := info.remoteAddr.(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP.String()
+	}
+	checkName, _ := fields["check"].(string)
+
+	return strings.NewReplacer(
+		"{client_ip}", clientIP,
+		"{check}", checkName,
+		"{support_url}", endp.supportURL,
+		"{message}", origMsg,
+	).Replace(msg)
+}
+
+// replyInfo returns the information about the client used to customize error
+// replies.
+func (s *Session) replyInfo() replyInfo {
+	info := replyInfo{
+		remoteAddr: s.connState.RemoteAddr,
+		mailFrom:   s.mailFrom,
+	}
+	if s.msgMeta != nil {
+		info.facts = s.msgMeta.Facts
+	}
+	return info
+}
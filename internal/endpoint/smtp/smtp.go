@@ -34,6 +34,7 @@ import (
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
@@ -45,6 +46,7 @@ import (
 	"github.com/foxcpp/maddy/internal/auth"
 	"github.com/foxcpp/maddy/internal/limits"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/tlsfp"
 	"golang.org/x/net/idna"
 )
 
@@ -67,6 +69,18 @@ type Endpoint struct {
 	maxLoggedRcptErrors int
 	maxReceived         int
 	maxHeaderBytes      int
+	maxSessionRcpts     int
+	enforceDeclaredSize bool
+	addrStrictness      address.Strictness
+
+	probingProtection string
+	rcptResponseTime  time.Duration
+	supportURL        string
+	replyTemplates    *replyTemplates
+
+	tlsFingerprints *tlsfp.Recorder
+	tarpit          *tarpit
+	earlyTalker     *earlyTalker
 
 	listenersWg sync.WaitGroup
 
@@ -91,7 +105,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		buffer:     buffer.BufferInMemory,
 		Log:        log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:      log.Logger{Name: modName + "/sasl"},
+			Protocol: modName,
 		},
 	}
 	return endp, nil
@@ -233,21 +248,34 @@ func bufferModeDirective(_ *config.Map, node config.Node) (interface{}, error) {
 
 func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	var (
-		hostname string
-		err      error
-		ioDebug  bool
+		hostname        string
+		err             error
+		ioDebug         bool
+		tlsFingerprints bool
+		earlyTalkDelay  time.Duration
+		earlyTalkAction modconfig.FailAction
+		useDNSSEC       bool
+		addrStrictness  string
 	)
 
 	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
 		return endp.saslAuth.AddProvider(m, node)
 	})
+	cfg.Callback("account_status", func(m *config.Map, node config.Node) error {
+		return endp.saslAuth.AddAccountStatus(m, node)
+	})
+	cfg.StringList("auth_impersonators", false, false, nil, &endp.saslAuth.Impersonators)
 	cfg.String("hostname", true, true, "", &hostname)
 	cfg.Duration("write_timeout", false, false, 1*time.Minute, &endp.serv.WriteTimeout)
 	cfg.Duration("read_timeout", false, false, 10*time.Minute, &endp.serv.ReadTimeout)
 	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &endp.serv.MaxMessageBytes)
 	cfg.DataSize("max_header_size", false, false, 1*1024*1024, &endp.maxHeaderBytes)
+	cfg.Bool("enforce_declared_size", false, false, &endp.enforceDeclaredSize)
 	cfg.Int("max_recipients", false, false, 20000, &endp.serv.MaxRecipients)
 	cfg.Int("max_received", false, false, 50, &endp.maxReceived)
+	cfg.Int("max_session_recipients", false, false, 0, &endp.maxSessionRcpts)
+	cfg.Enum("address_strictness", false, false,
+		[]string{"lax", "rfc", "strict"}, "rfc", &addrStrictness)
 	cfg.Custom("buffer", false, false, func() (interface{}, error) {
 		path := filepath.Join(config.StateDirectory, "buffer")
 		if err := os.MkdirAll(path, 0o700); err != nil {
@@ -262,6 +290,19 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &endp.Log.Debug)
 	cfg.Bool("defer_sender_reject", false, true, &endp.deferServerReject)
 	cfg.Int("max_logged_rcpt_errors", false, false, 5, &endp.maxLoggedRcptErrors)
+	cfg.Enum("rcpt_probing_protection", false, false,
+		[]string{probingOff, probingUniform, probingDiscard}, probingOff, &endp.probingProtection)
+	cfg.Duration("rcpt_response_time", false, false, 0, &endp.rcptResponseTime)
+	cfg.String("support_url", false, false, "", &endp.supportURL)
+	cfg.Custom("rejection_messages", false, false, nil, replyTemplatesDirective, &endp.replyTemplates)
+	cfg.Bool("tls_fingerprints", false, false, &tlsFingerprints)
+	cfg.Bool("dnssec", false, false, &useDNSSEC)
+	cfg.Custom("tarpit", false, false, nil, tarpitDirective, &endp.tarpit)
+	cfg.Duration("early_talker_delay", false, false, 0, &earlyTalkDelay)
+	cfg.Custom("early_talker_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{Reject: true}, nil
+		}, modconfig.FailActionDirective, &earlyTalkAction)
 	cfg.Custom("limits", false, false, func() (interface{}, error) {
 		return &limits.Group{}, nil
 	}, func(cfg *config.Map, n config.Node) (interface{}, error) {
@@ -277,6 +318,44 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		return err
 	}
 
+	endp.addrStrictness, err = address.ParseStrictness(addrStrictness)
+	if err != nil {
+		return err
+	}
+
+	if endp.lmtp && endp.probingProtection == probingDiscard {
+		return fmt.Errorf("%s: rcpt_probing_protection discard is not supported for LMTP", endp.name)
+	}
+
+	if useDNSSEC {
+		extResolver, err := dns.NewExtResolver()
+		if err != nil {
+			return fmt.Errorf("%s: dnssec: %w", endp.name, err)
+		}
+		endp.resolver = extResolver
+	}
+
+	if endp.tarpit != nil {
+		endp.tarpit.resolver = endp.resolver
+		endp.tarpit.log = log.Logger{Name: endp.name + "/tarpit", Debug: endp.Log.Debug}
+	}
+	if endp.replyTemplates != nil {
+		endp.replyTemplates.log = log.Logger{Name: endp.name + "/rejection_messages", Debug: endp.Log.Debug}
+	}
+
+	if earlyTalkDelay != 0 {
+		endp.earlyTalker = &earlyTalker{
+			delay:  earlyTalkDelay,
+			action: earlyTalkAction,
+			log:    log.Logger{Name: endp.name + "/early_talker", Debug: endp.Log.Debug},
+		}
+	}
+
+	if tlsFingerprints && endp.serv.TLSConfig != nil {
+		endp.tlsFingerprints = tlsfp.NewRecorder(time.Minute)
+		endp.serv.TLSConfig = endp.tlsFingerprints.Wrap(endp.serv.TLSConfig)
+	}
+
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.3.
 	endp.serv.Domain, err = idna.ToASCII(hostname)
 	if err != nil {
@@ -300,9 +379,13 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		}
 	}
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
-		// The code below lacks handling to set AuthPassword. Don't
-		// override sasl.Plain handler so Login() will be called as usual.
+		// PLAIN is handled by the Session to also set AuthPassword.
 		if mech == sasl.Plain {
+			endp.serv.EnableAuth(sasl.Plain, func(c *smtp.Conn) sasl.Server {
+				return sasl.NewPlainServer(func(identity, username, password string) error {
+					return c.Session().(*Session).authPlain(identity, username, password)
+				})
+			})
 			continue
 		}
 
@@ -311,10 +394,15 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 		endp.serv.EnableAuth(mech, func(c *smtp.Conn) sasl.Server {
 			state := c.State()
 			if err := endp.pipeline.RunEarlyChecks(context.TODO(), &state); err != nil {
-				return auth.FailingSASLServ{Err: endp.wrapErr("", true, "AUTH", err)}
+				return auth.FailingSASLServ{Err: endp.wrapErr("", replyInfo{remoteAddr: state.RemoteAddr}, true, "AUTH", err)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, state.RemoteAddr, func(id string) error {
+			var tlsState *tls.ConnectionState
+			if state.TLS.HandshakeComplete {
+				tlsState = &state.TLS
+			}
+
+			return endp.saslAuth.CreateSASL(mech, state.RemoteAddr, tlsState, func(id string) error {
 				c.Session().(*Session).connState.AuthUser = id
 				return nil
 			})
@@ -339,6 +427,15 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 		endp.Log.Printf("listening on %v", addr)
 
+		// With implicit TLS, the client speaks first.
+		if endp.earlyTalker != nil && !addr.IsTLS() {
+			l = earlyTalkListener{Listener: l, et: endp.earlyTalker}
+		}
+		if endp.tarpit != nil {
+			l = tarpitListener{Listener: l, tp: endp.tarpit}
+		}
+		l = connCheckListener{Listener: l, endp: endp, tls: addr.IsTLS()}
+
 		if addr.IsTLS() {
 			if endp.serv.TLSConfig == nil {
 				return fmt.Errorf("%s: can't bind on SMTPS endpoint without TLS configuration", endp.name)
@@ -364,8 +461,9 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 func (endp *Endpoint) NewSession(state smtp.ConnectionState, _ string) (smtp.Session, error) {
 	// Executed before authentication and session initialization.
 	if err := endp.pipeline.RunEarlyChecks(context.TODO(), &state); err != nil {
-		return nil, endp.wrapErr("", true, "EHLO", err)
+		return nil, endp.wrapErr("", replyInfo{remoteAddr: state.RemoteAddr}, true, "EHLO", err)
 	}
+	endp.tarpit.delay(context.TODO(), state.RemoteAddr)
 
 	return endp.newSession(&state), nil
 }
@@ -387,6 +485,9 @@ func (endp *Endpoint) newSession(state *smtp.ConnectionState) smtp.Session {
 		// If it is - we are ssing TLS.
 		if state.TLS.HandshakeComplete {
 			s.connState.Proto = "ESMTPS"
+			if endp.tlsFingerprints != nil {
+				s.tlsFingerprint, _ = endp.tlsFingerprints.Get(state.RemoteAddr.String())
+			}
 		} else {
 			s.connState.Proto = "ESMTP"
 		}
@@ -403,6 +504,11 @@ func (endp *Endpoint) newSession(state *smtp.ConnectionState) smtp.Session {
 }
 
 func (endp *Endpoint) Close() error {
+	// Listeners are closed directly since serv.Close does not know about
+	// listeners that were not passed to Serve yet.
+	for _, l := range endp.listeners {
+		l.Close()
+	}
 	endp.serv.Close()
 	endp.listenersWg.Wait()
 	return nil
@@ -19,7 +19,11 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package smtp
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"io"
 	"math/rand"
 	"net"
 	"os"
@@ -49,7 +53,8 @@ const testMsg = "From: <sender@example.org>\r\n" +
 func testEndpoint(t *testing.T, modName string, authMod module.PlainAuth, tgt module.DeliveryTarget, checks []module.Check, cfg []config.Node) *Endpoint {
 	t.Helper()
 
-	mod, err := New(modName, []string{"tcp://127.0.0.1:" + testPort})
+	// Listeners are set up by testListen after the pipeline is replaced.
+	mod, err := New(modName, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -107,9 +112,26 @@ func testEndpoint(t *testing.T, modName string, authMod module.PlainAuth, tgt mo
 	endp.pipeline.FirstPipeline = true
 	endp.pipeline.Log = testutils.Logger(t, "smtp/pipeline")
 
+	testListen(t, endp)
+
 	return endp
 }
 
+// testListen starts listening on the test port. It should be called after
+// all endpoint fields are set since connection checks use them as soon as a
+// connection is accepted.
+func testListen(t *testing.T, endp *Endpoint) {
+	t.Helper()
+
+	addr, err := config.ParseEndpoint("tcp://127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := endp.setupListeners([]config.Endpoint{addr}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func submitMsg(t *testing.T, cl *smtp.Client, from string, rcpts []string, msg string) error {
 	return submitMsgOpts(t, cl, from, rcpts, nil, msg)
 }
@@ -578,6 +600,581 @@ func TestSMTPDelivery_SubmissionAuthOK(t *testing.T) {
 	}
 }
 
+type disabledAccounts map[string]bool
+
+func (d disabledAccounts) AccountDisabled(username string) (bool, error) {
+	return d[username], nil
+}
+
+func TestSMTPDelivery_SubmissionAuthDisabled(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, nil)
+	endp.saslAuth.Accounts = []module.AccountStatus{disabledAccounts{"disabled": true}}
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Auth(sasl.NewPlainClient("", "disabled", "password"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 535 {
+		t.Fatal("Expected 535 error, got", err)
+	}
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSMTPDelivery_SubmissionImpersonation(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, nil)
+	endp.saslAuth.Impersonators = []string{"admin"}
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Auth(sasl.NewPlainClient("admin", "user", "password"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 535 {
+		t.Fatal("Expected 535 error, got", err)
+	}
+
+	if err := cl.Auth(sasl.NewPlainClient("user", "admin", "password")); err != nil {
+		t.Fatal(err)
+	}
+	if err := submitMsg(t, cl, "user@example.org", []string{"rcpt@example.com"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	if conn := tgt.Messages[0].MsgMeta.Conn; conn.AuthUser != "user" || conn.AuthPassword != "" {
+		t.Errorf("Wrong authentication info: %q, %q", conn.AuthUser, conn.AuthPassword)
+	}
+}
+
+func TestSMTPDelivery_ProbingUniform(t *testing.T) {
+	tgt := testutils.Target{
+		RcptErr: map[string]error{
+			"unknown@example.com": &exterrors.SMTPError{
+				Code:         501,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+				Message:      "User does not exist",
+			},
+		},
+	}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "rcpt_probing_protection",
+			Args: []string{"uniform"},
+		},
+		{
+			Name: "rcpt_response_time",
+			Args: []string{"100ms"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := cl.Rcpt("rcpt@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("RCPT response is not delayed")
+	}
+
+	err = cl.Rcpt("unknown@example.com")
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 550 || !strings.HasPrefix(smtpErr.Message, "Recipient address rejected") {
+		t.Fatal("Wrong error:", smtpErr.Code, smtpErr.Message)
+	}
+}
+
+func TestSMTPDelivery_ProbingDiscard(t *testing.T) {
+	tgt := testutils.Target{
+		RcptErr: map[string]error{
+			"unknown@example.com": &exterrors.SMTPError{
+				Code:         501,
+				EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+				Message:      "User does not exist",
+			},
+		},
+	}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "rcpt_probing_protection",
+			Args: []string{"discard"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"unknown@example.com"}, testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Message to the unknown recipient is delivered")
+	}
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com", "unknown@example.com"}, testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	testutils.CheckMsgID(t, &tgt.Messages[0], "sender@example.org", []string{"rcpt@example.com"}, "")
+}
+
+func TestSMTPDelivery_MaxSessionRcpts(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_session_recipients",
+			Args: []string{"3"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"}, testMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt3@example.com", "rcpt4@example.com"}, testMsg)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 452 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 5, 3}) {
+		t.Fatal("Wrong error:", smtpErr.Code, smtpErr.EnhancedCode)
+	}
+}
+
+func TestSMTPDelivery_AddressStrictness(t *testing.T) {
+	test := func(strictness string, rcpt string, deliveredTo string) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+			{
+				Name: "address_strictness",
+				Args: []string{strictness},
+			},
+		})
+		defer endp.Close()
+
+		cl, err := smtp.Dial("127.0.0.1:" + testPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+
+		err = submitMsg(t, cl, "sender@example.org", []string{rcpt}, testMsg)
+		if deliveredTo == "" {
+			smtpErr, ok := err.(*smtp.SMTPError)
+			if !ok {
+				t.Fatal("Non-SMTPError returned:", err)
+			}
+			if smtpErr.Code != 553 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 3}) {
+				t.Fatal("Wrong error:", smtpErr.Code, smtpErr.EnhancedCode)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tgt.Messages) != 1 {
+			t.Fatal("Expected a message, got", len(tgt.Messages))
+		}
+		testutils.CheckMsgID(t, &tgt.Messages[0], "sender@example.org", []string{deliveredTo}, "")
+	}
+
+	test("rfc", "rcpt@example.com", "rcpt@example.com")
+	test("rfc", "a..b@example.com", "")
+	test("lax", "a..b@example.com", "a..b@example.com")
+	test("rfc", "rcpt@exa_mple.com", "")
+	test("rfc", `"rcpt"@example.com`, "rcpt@example.com")
+	test("strict", `"rcpt"@example.com`, "")
+}
+
+func TestSMTPDelivery_Tarpit(t *testing.T) {
+	test := func(withRDNS bool) time.Duration {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		mod, err := New("smtp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		endp := mod.(*Endpoint)
+		zones := map[string]mockdns.Zone{}
+		if withRDNS {
+			zones["1.0.0.127.in-addr.arpa."] = mockdns.Zone{PTR: []string{"mx.example.org"}}
+		}
+		endp.resolver = &mockdns.Resolver{Zones: zones}
+		endp.Log = testutils.Logger(t, "smtp")
+		err = endp.Init(config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "hostname", Args: []string{"mx.example.com"}},
+				{Name: "tls", Args: []string{"off"}},
+				{Name: "deliver_to", Args: []string{"dummy"}},
+				{
+					Name: "tarpit",
+					Children: []config.Node{
+						{Name: "no_rdns", Args: []string{"yes"}},
+						{Name: "banner_delay", Args: []string{"200ms"}},
+						{Name: "command_delay", Args: []string{"50ms"}},
+					},
+				},
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		endp.pipeline = msgpipeline.Mock(&tgt, nil)
+		endp.pipeline.Hostname = "mx.example.com"
+		endp.pipeline.Resolver = endp.resolver
+		endp.pipeline.FirstPipeline = true
+		endp.pipeline.Log = testutils.Logger(t, "smtp/pipeline")
+		testListen(t, endp)
+		defer endp.Close()
+
+		start := time.Now()
+		cl, err := smtp.Dial("127.0.0.1:" + testPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+
+		if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, testMsg); err != nil {
+			t.Fatal(err)
+		}
+		if len(tgt.Messages) != 1 {
+			t.Fatal("message is not delivered")
+		}
+		return time.Since(start)
+	}
+
+	// Banner, EHLO, MAIL, RCPT, DATA.
+	if elapsed := test(false); elapsed < 400*time.Millisecond {
+		t.Error("client without rDNS is not tarpitted:", elapsed)
+	}
+	if elapsed := test(true); elapsed >= 200*time.Millisecond {
+		t.Error("client with rDNS is tarpitted:", elapsed)
+	}
+}
+
+func TestSMTPDelivery_EarlyTalker(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "early_talker_delay",
+			Args: []string{"100ms"},
+		},
+	})
+	defer endp.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "EHLO mx.example.org\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp, "554 5.5.1 ") {
+		t.Fatalf("early talker is not rejected: %q", resp)
+	}
+
+	// Client that waits for the greeting is accepted.
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+	if err := submitMsg(t, cl, "sender@example.org", []string{"rcpt@example.com"}, testMsg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSMTPDelivery_ConnectCheck_Fail(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			ConnectErr: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Go away",
+			},
+		},
+	}, nil)
+	defer endp.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	resp, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "554 5.7.1 Go away\r\n" {
+		t.Fatalf("wrong greeting: %q", resp)
+	}
+	if _, err := r.ReadString('\n'); err != io.EOF {
+		t.Fatal("connection is not closed:", err)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("message delivered")
+	}
+}
+
+func TestSMTPDelivery_ConnectCheck_Temporary(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			ConnectErr: &exterrors.SMTPError{
+				Code:         451,
+				EnhancedCode: exterrors.EnhancedCode{4, 7, 1},
+				Message:      "Try later",
+			},
+		},
+	}, nil)
+	defer endp.Close()
+
+	_, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 421 {
+		t.Fatal("Wrong SMTP code:", smtpErr.Code)
+	}
+}
+
+func TestSMTPDelivery_ConnectCheck_MultilineTemplate(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			ConnectErr: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Blocked by {check}\nSee {support_url}?ip={client_ip}",
+				CheckName:    "dnsbl",
+			},
+		},
+	}, []config.Node{
+		{
+			Name: "support_url",
+			Args: []string{"https://mail.example.com/blocked"},
+		},
+	})
+	defer endp.Close()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for _, expected := range []string{
+		"554-5.7.1 Blocked by dnsbl\r\n",
+		"554 5.7.1 See https://mail.example.com/blocked?ip=127.0.0.1\r\n",
+	} {
+		resp, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp != expected {
+			t.Fatalf("wrong greeting line: %q", resp)
+		}
+	}
+}
+
+func TestSMTPDelivery_EarlyCheck_Template(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			EarlyErr: &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+				Message:      "Client {client_ip} is blocked\nSee {support_url}",
+			},
+		},
+	}, []config.Node{
+		{
+			Name: "support_url",
+			Args: []string{"https://mail.example.com/blocked"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	err = cl.Mail("sender@example.org", nil)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned")
+	}
+	// go-smtp can't send multi-line replies, lines are joined.
+	if smtpErr.Message != "Client 127.0.0.1 is blocked See https://mail.example.com/blocked" {
+		t.Fatal("Wrong SMTP message:", smtpErr.Message)
+	}
+}
+
+func TestSMTPDelivery_RejectionMessages(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, []module.Check{
+		&testutils.Check{
+			SenderRes: module.CheckResult{
+				Reason: &exterrors.SMTPError{
+					Code:         550,
+					EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+					Message:      "Blocked",
+					CheckName:    "dnsbl",
+				},
+				Reject: true,
+			},
+		},
+	}, nil)
+	endp.deferServerReject = false
+	endp.replyTemplates = &replyTemplates{
+		log: testutils.Logger(t, "smtp/rejection_messages"),
+		senderLocales: testutils.Table{
+			M: map[string]string{"example.de": "de"},
+		},
+		countryLocales: testutils.Table{
+			M: map[string]string{"FR": "fr"},
+		},
+		messages: map[string]map[string]string{
+			"de": {
+				"dnsbl": "Abgelehnt von {check}: {message}",
+			},
+			"fr": {
+				"default": "Rejete",
+			},
+		},
+	}
+	defer endp.Close()
+
+	test := func(sender, expectedMsg string) {
+		t.Helper()
+		cl, err := smtp.Dial("127.0.0.1:" + testPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cl.Close()
+
+		err = cl.Mail(sender, nil)
+		if err == nil {
+			t.Fatal("Expected an error, got none")
+		}
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok {
+			t.Fatal("Non-SMTPError returned")
+		}
+		if !strings.HasPrefix(smtpErr.Message, expectedMsg+" (msg ID = ") {
+			t.Fatal("Wrong SMTP message:", smtpErr.Message)
+		}
+	}
+
+	test("sender@example.de", "Abgelehnt von dnsbl: Blocked")
+	test("sender@example.org", "Blocked")
+}
+
+func TestReplyTemplates(t *testing.T) {
+	rt := &replyTemplates{
+		log: testutils.Logger(t, "smtp/rejection_messages"),
+		senderLocales: testutils.Table{
+			M: map[string]string{"example.de": "de"},
+		},
+		countryLocales: testutils.Table{
+			M: map[string]string{"DE": "de", "FR": "fr"},
+		},
+		messages: map[string]map[string]string{
+			"de": {
+				"dnsbl":   "dnsbl",
+				"5.1.1":   "5.1.1",
+				"552":     "552",
+				"default": "default",
+			},
+		},
+	}
+
+	test := func(sender, country string, code int, enchCode [3]int, checkName, expected string) {
+		t.Helper()
+		facts := module.NewFacts()
+		if country != "" {
+			facts.Set(module.FactGeoCountry, country)
+		}
+		msg, ok := rt.template(context.Background(), replyInfo{mailFrom: sender, facts: facts}, code, enchCode, checkName)
+		if !ok {
+			msg = ""
+		}
+		if msg != expected {
+			t.Errorf("%s, %s, %d, %v, %s: expected %q, got %q", sender, country, code, enchCode, checkName, expected, msg)
+		}
+	}
+
+	test("a@example.de", "", 550, [3]int{5, 7, 1}, "dnsbl", "dnsbl")
+	test("a@EXAMPLE.DE", "", 550, [3]int{5, 1, 1}, "spf", "5.1.1")
+	test("a@example.de", "", 552, [3]int{5, 3, 4}, "", "552")
+	test("a@example.de", "", 554, [3]int{5, 7, 0}, "", "default")
+	test("a@example.org", "DE", 554, [3]int{5, 7, 0}, "", "default")
+	test("a@example.org", "", 554, [3]int{5, 7, 0}, "", "")
+	// No messages for the locale.
+	test("a@example.org", "FR", 554, [3]int{5, 7, 0}, "", "")
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(maddy) SMTP port to use for connections in tests")
 	flag.Parse()
@@ -590,3 +1187,112 @@ func TestMain(m *testing.M) {
 	testPort = *remoteSmtpPort
 	os.Exit(m.Run())
 }
+
+func TestSMTPDelivery_DeclaredSize(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "enforce_declared_size",
+			Args: []string{"yes"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	bigMsg := testMsg + strings.Repeat("a long line of text that makes the message bigger\r\n", 100)
+
+	err = submitMsgOpts(t, cl, "sender@example.org", []string{"rcpt1@example.com"}, &smtp.MailOptions{Size: 100}, bigMsg)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 552 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+		t.Fatal("Wrong error:", smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Message is delivered")
+	}
+
+	// The rest of the message should be discarded and the session should be
+	// usable.
+	if err := cl.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	err = submitMsgOpts(t, cl, "sender@example.org", []string{"rcpt1@example.com"}, &smtp.MailOptions{Size: len(bigMsg)}, bigMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_DeclaredSizeNotEnforced(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	bigMsg := testMsg + strings.Repeat("a long line of text that makes the message bigger\r\n", 100)
+
+	// Not enforced by default.
+	err = submitMsgOpts(t, cl, "sender@example.org", []string{"rcpt1@example.com"}, &smtp.MailOptions{Size: 100}, bigMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+}
+
+func TestSMTPDelivery_MaxMessageSize(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, []config.Node{
+		{
+			Name: "max_message_size",
+			Args: []string{"1K"},
+		},
+	})
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	bigMsg := testMsg + strings.Repeat("a long line of text that makes the message bigger\r\n", 100)
+
+	// Declared size is checked by MAIL FROM.
+	err = submitMsgOpts(t, cl, "sender@example.org", []string{"rcpt1@example.com"}, &smtp.MailOptions{Size: len(bigMsg)}, bigMsg)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 552 {
+		t.Fatal("Wrong error:", smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	}
+
+	// Undeclared size is checked during DATA.
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.com"}, bigMsg)
+	smtpErr, ok = err.(*smtp.SMTPError)
+	if !ok {
+		t.Fatal("Non-SMTPError returned:", err)
+	}
+	if smtpErr.Code != 552 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+		t.Fatal("Wrong error:", smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+	}
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Message is delivered")
+	}
+}
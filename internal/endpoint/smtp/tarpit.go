@@ -0,0 +1,213 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/future"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/msgpipeline"
+)
+
+// tarpit slows down conversation with suspicious clients.
+//
+// The client is considered suspicious if it has no rDNS name (if no_rdns is
+// set) or if any of the configured checks returns a non-empty result for the
+// connection. The decision is made when the connection is accepted, before
+// the greeting is sent, so the greeting can be delayed too.
+type tarpit struct {
+	bannerDelay  time.Duration
+	commandDelay time.Duration
+	noRDNS       bool
+	checks       []module.Check
+	timeout      time.Duration
+
+	resolver dns.Resolver
+	log      log.Logger
+
+	// Remote addresses of tarpitted connections.
+	conns sync.Map
+}
+
+func tarpitDirective(m *config.Map, node config.Node) (interface{}, error) {
+	tp := &tarpit{}
+
+	cfg := config.NewMap(m.Globals, node)
+	cfg.Duration("banner_delay", false, false, 0, &tp.bannerDelay)
+	cfg.Duration("command_delay", false, false, 0, &tp.commandDelay)
+	cfg.Bool("no_rdns", false, false, &tp.noRDNS)
+	cfg.Duration("check_timeout", false, false, 10*time.Second, &tp.timeout)
+	cfg.Custom("checks", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var cg *msgpipeline.CheckGroup
+		if err := modconfig.GroupFromNode("checks", node.Args, node, m.Globals, &cg); err != nil {
+			return nil, err
+		}
+		return cg.L, nil
+	}, &tp.checks)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	if tp.bannerDelay == 0 && tp.commandDelay == 0 {
+		return nil, config.NodeErr(node, "at least one of banner_delay and command_delay should be set")
+	}
+	if !tp.noRDNS && len(tp.checks) == 0 {
+		return nil, config.NodeErr(node, "no_rdns or checks should be set")
+	}
+
+	return tp, nil
+}
+
+// suspicious runs configured checks against the client IP.
+func (tp *tarpit) suspicious(ctx context.Context, conn net.Conn) bool {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tp.timeout)
+	defer cancel()
+
+	rdnsName := future.New()
+	name, err := dns.LookupAddr(ctx, tp.resolver, tcpAddr.IP)
+	if err != nil {
+		rdnsName.Set(nil, err)
+		if tp.noRDNS {
+			tp.log.DebugMsg("no rDNS name", "src_ip", tcpAddr.IP, "reason", err)
+			return true
+		}
+	} else {
+		rdnsName.Set(name, nil)
+	}
+
+	msgMeta := &module.MsgMetadata{
+		Conn: &module.ConnState{
+			Proto: "ESMTP",
+			ConnectionState: smtp.ConnectionState{
+				RemoteAddr: conn.RemoteAddr(),
+				LocalAddr:  conn.LocalAddr(),
+			},
+			RDNSName: rdnsName,
+		},
+		Facts: module.NewFacts(),
+	}
+	for _, check := range tp.checks {
+		state, err := check.CheckStateForMsg(ctx, msgMeta)
+		if err != nil {
+			tp.log.Error("check initialization failed", err, "src_ip", tcpAddr.IP)
+			continue
+		}
+		res := state.CheckConnection(ctx)
+		state.Close()
+
+		if res.Reason != nil || res.Reject || res.Quarantine || res.Score > 0 {
+			checkName := ""
+			if mod, ok := check.(module.Module); ok {
+				checkName = mod.Name()
+			}
+			tp.log.DebugMsg("check matched", "src_ip", tcpAddr.IP, "check", checkName, "reason", res.Reason)
+			return true
+		}
+	}
+	return false
+}
+
+// delay sleeps for the command_delay if the client is tarpitted.
+func (tp *tarpit) delay(ctx context.Context, addr net.Addr) {
+	if tp == nil || tp.commandDelay == 0 || addr == nil {
+		return
+	}
+	if _, ok := tp.conns.Load(addr.String()); !ok {
+		return
+	}
+
+	t := time.NewTimer(tp.commandDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+type tarpitListener struct {
+	net.Listener
+	tp *tarpit
+}
+
+func (l tarpitListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tarpitConn{
+		Conn:   conn,
+		tp:     l.tp,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// tarpitConn delays the first write (the greeting) to tarpitted clients.
+type tarpitConn struct {
+	net.Conn
+	tp *tarpit
+
+	greetOnce sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *tarpitConn) greet() {
+	if !c.tp.suspicious(context.Background(), c.Conn) {
+		return
+	}
+	c.tp.log.Msg("tarpitting the client", "src_ip", c.RemoteAddr())
+	c.tp.conns.Store(c.RemoteAddr().String(), struct{}{})
+
+	if c.tp.bannerDelay == 0 {
+		return
+	}
+	t := time.NewTimer(c.tp.bannerDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-c.closed:
+	}
+}
+
+func (c *tarpitConn) Write(b []byte) (int, error) {
+	c.greetOnce.Do(c.greet)
+	return c.Conn.Write(b)
+}
+
+func (c *tarpitConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.tp.conns.Delete(c.RemoteAddr().String())
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,244 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package calendar implements the IMAP filter that detects calendar
+// invitations (iTIP messages transported using iMIP, RFC 6047) and optionally
+// passes them to the external handler.
+package calendar
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+const modName = "imap.filter.calendar"
+
+// maxPartSize is the maximum size of calendar data that is read from the
+// message. Larger parts are ignored.
+const maxPartSize = 1024 * 1024
+
+// Part is the calendar object found in the message.
+type Part struct {
+	// iTIP method (REQUEST, REPLY, CANCEL, etc), upper-case. Empty if the
+	// object is not an iTIP message (e.g. a plain .ics attachment).
+	Method string
+	Data   []byte
+}
+
+type Filter struct {
+	instName string
+	log      log.Logger
+
+	flag    string
+	webhook string
+	client  *http.Client
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Filter{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (f *Filter) Name() string {
+	return modName
+}
+
+func (f *Filter) InstanceName() string {
+	return f.instName
+}
+
+func (f *Filter) Init(cfg *config.Map) error {
+	var timeout time.Duration
+
+	cfg.Bool("debug", true, false, &f.log.Debug)
+	cfg.String("flag", false, false, "$Invitation", &f.flag)
+	cfg.String("webhook", false, false, "", &f.webhook)
+	cfg.Duration("webhook_timeout", false, false, 10*time.Second, &timeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	f.client = &http.Client{Timeout: timeout}
+	return nil
+}
+
+// methodFromData extracts the METHOD property from the iCalendar object.
+func methodFromData(data []byte) string {
+	scnr := bufio.NewScanner(bytes.NewReader(data))
+	for scnr.Scan() {
+		line := scnr.Text()
+		if len(line) > len("METHOD:") && strings.EqualFold(line[:len("METHOD:")], "METHOD:") {
+			return strings.ToUpper(strings.TrimSpace(line[len("METHOD:"):]))
+		}
+		if strings.EqualFold(line, "BEGIN:VEVENT") || strings.EqualFold(line, "BEGIN:VTODO") {
+			// METHOD is a VCALENDAR property and precedes components.
+			break
+		}
+	}
+	return ""
+}
+
+// FindParts returns calendar objects contained in the message.
+func FindParts(hdr textproto.Header, body io.Reader) ([]Part, error) {
+	entity, err := message.New(message.Header{Header: hdr}, body)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+
+	var parts []Part
+	err = entity.Walk(func(_ []int, e *message.Entity, err error) error {
+		if err != nil {
+			if message.IsUnknownCharset(err) || message.IsUnknownEncoding(err) {
+				return nil
+			}
+			return err
+		}
+
+		mediaType, params, err := e.Header.ContentType()
+		if err != nil {
+			return nil
+		}
+		if mediaType != "text/calendar" && mediaType != "application/ics" {
+			return nil
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(e.Body, maxPartSize+1))
+		if err != nil {
+			return err
+		}
+		if len(data) > maxPartSize {
+			return nil
+		}
+
+		method := strings.ToUpper(params["method"])
+		if method == "" {
+			method = methodFromData(data)
+		}
+		parts = append(parts, Part{Method: method, Data: data})
+		return nil
+	})
+	return parts, err
+}
+
+func (f *Filter) callWebhook(accountName string, msgMeta *module.MsgMetadata, part Part) error {
+	contentType := "text/calendar"
+	if part.Method != "" {
+		contentType = mime.FormatMediaType(contentType, map[string]string{"method": part.Method})
+	}
+
+	r, err := http.NewRequest("POST", f.webhook, bytes.NewReader(part.Data))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("User-Agent", "maddy")
+	r.Header.Set("X-Maddy-Account", accountName)
+	r.Header.Set("X-Maddy-Msg-ID", msgMeta.ID)
+	r.Header.Set("X-Maddy-Sender", msgMeta.OriginalFrom)
+
+	resp, err := f.client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: webhook returned %s", modName, resp.Status)
+	}
+	return nil
+}
+
+func (f *Filter) IMAPFilter(accountName string, msgMeta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (folder string, flags []string, err error) {
+	state, err := f.IMAPFilterStateForMsg(msgMeta, hdr, body)
+	if err != nil {
+		return "", nil, err
+	}
+	return state.IMAPFilter(accountName)
+}
+
+type state struct {
+	f       *Filter
+	msgMeta *module.MsgMetadata
+	parts   []Part
+}
+
+// IMAPFilterStateForMsg parses the message once for all recipients.
+func (f *Filter) IMAPFilterStateForMsg(msgMeta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (module.IMAPFilterState, error) {
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyR.Close()
+
+	parts, err := FindParts(hdr, bufio.NewReader(bodyR))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", modName, err)
+	}
+	if len(parts) != 0 && msgMeta.Facts != nil {
+		method := parts[0].Method
+		if method == "" {
+			method = "PUBLISH"
+		}
+		msgMeta.Facts.Set(module.FactCalendarMethod, method)
+	}
+	return state{f: f, msgMeta: msgMeta, parts: parts}, nil
+}
+
+func (s state) IMAPFilter(accountName string) (folder string, flags []string, err error) {
+	if len(s.parts) == 0 {
+		return "", nil, nil
+	}
+
+	s.f.log.DebugMsg("calendar object found", "msg_id", s.msgMeta.ID, "account", accountName)
+
+	if s.f.flag != "" {
+		flags = []string{s.f.flag}
+	}
+
+	if s.f.webhook != "" {
+		for _, part := range s.parts {
+			if err := s.f.callWebhook(accountName, s.msgMeta, part); err != nil {
+				// The message is still delivered with the flag.
+				s.f.log.Error("webhook failed", err, "msg_id", s.msgMeta.ID, "account", accountName)
+			}
+		}
+	}
+
+	return "", flags, nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,139 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package calendar
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const invite = "From: organizer@example.org\r\n" +
+	"Subject: Meeting\r\n" +
+	"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"You are invited.\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/calendar; charset=utf-8; method=REQUEST\r\n" +
+	"\r\n" +
+	"BEGIN:VCALENDAR\r\n" +
+	"METHOD:REQUEST\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:1@example.org\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n" +
+	"--BOUNDARY--\r\n"
+
+func splitMessage(t *testing.T, msg string) (textproto.Header, buffer.Buffer) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, buffer.MemoryBuffer{Slice: body}
+}
+
+func TestFindParts(t *testing.T) {
+	test := func(msg string, wantMethods ...string) {
+		t.Helper()
+		hdr, body := splitMessage(t, msg)
+		r, _ := body.Open()
+		parts, err := FindParts(hdr, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != len(wantMethods) {
+			t.Fatalf("want %d parts, got %d", len(wantMethods), len(parts))
+		}
+		for i, part := range parts {
+			if part.Method != wantMethods[i] {
+				t.Errorf("part %d: want method %q, got %q", i, wantMethods[i], part.Method)
+			}
+		}
+	}
+
+	test(invite, "REQUEST")
+	test("Content-Type: text/plain\r\n\r\nHello\r\n")
+	test("Content-Type: text/calendar\r\n\r\nBEGIN:VCALENDAR\r\nmethod:cancel\r\nEND:VCALENDAR\r\n", "CANCEL")
+	test("Content-Type: application/ics\r\n\r\nBEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n", "")
+}
+
+func TestIMAPFilter(t *testing.T) {
+	var (
+		gotType    string
+		gotAccount string
+		gotData    string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotType = r.Header.Get("Content-Type")
+		gotAccount = r.Header.Get("X-Maddy-Account")
+		data, _ := ioutil.ReadAll(r.Body)
+		gotData = string(data)
+	}))
+	defer srv.Close()
+
+	f := &Filter{
+		instName: "test",
+		log:      testutils.Logger(t, modName),
+		flag:     "$Invitation",
+		webhook:  srv.URL,
+		client:   srv.Client(),
+	}
+
+	hdr, body := splitMessage(t, invite)
+	msgMeta := &module.MsgMetadata{ID: "test", Facts: module.NewFacts()}
+	folder, flags, err := f.IMAPFilter("user@example.org", msgMeta, hdr, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder != "" {
+		t.Error("folder is changed:", folder)
+	}
+	if len(flags) != 1 || flags[0] != "$Invitation" {
+		t.Error("wrong flags:", flags)
+	}
+	if method, _ := msgMeta.Facts.String(module.FactCalendarMethod); method != "REQUEST" {
+		t.Error("wrong method fact:", method)
+	}
+
+	if gotType != "text/calendar; method=REQUEST" {
+		t.Error("wrong webhook Content-Type:", gotType)
+	}
+	if gotAccount != "user@example.org" {
+		t.Error("wrong webhook account:", gotAccount)
+	}
+	if !strings.HasPrefix(gotData, "BEGIN:VCALENDAR\r\n") {
+		t.Errorf("wrong webhook data: %q", gotData)
+	}
+}
@@ -48,14 +48,45 @@ func (g *Group) IMAPFilter(accountName string, meta *module.MsgMetadata, hdr tex
 	if g == nil {
 		return "", nil, nil
 	}
+	state, err := g.IMAPFilterStateForMsg(meta, hdr, body)
+	if err != nil {
+		return "", nil, err
+	}
+	return state.IMAPFilter(accountName)
+}
+
+type groupState struct {
+	g      *Group
+	states []module.IMAPFilterState
+}
+
+// IMAPFilterStateForMsg prepares all filters for the message once so
+// per-message work is not repeated for each recipient.
+func (g *Group) IMAPFilterStateForMsg(meta *module.MsgMetadata, hdr textproto.Header, body buffer.Buffer) (module.IMAPFilterState, error) {
+	if g == nil {
+		return groupState{}, nil
+	}
+	gs := groupState{g: g, states: make([]module.IMAPFilterState, 0, len(g.Filters))}
+	for _, f := range g.Filters {
+		state, err := module.IMAPFilterStateForMsg(f, meta, hdr, body)
+		if err != nil {
+			g.log.Error("IMAP filter failed", err)
+			continue
+		}
+		gs.states = append(gs.states, state)
+	}
+	return gs, nil
+}
+
+func (gs groupState) IMAPFilter(accountName string) (folder string, flags []string, err error) {
 	var (
 		finalFolder string
-		finalFlags  = make([]string, 0, len(g.Filters))
+		finalFlags  = make([]string, 0, len(gs.states))
 	)
-	for _, f := range g.Filters {
-		folder, flags, err := f.IMAPFilter(accountName, meta, hdr, body)
+	for _, s := range gs.states {
+		folder, flags, err := s.IMAPFilter(accountName)
 		if err != nil {
-			g.log.Error("IMAP filter failed", err)
+			gs.g.log.Error("IMAP filter failed", err)
 			continue
 		}
 		if folder != "" && finalFolder == "" {
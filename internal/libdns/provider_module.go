@@ -1,6 +1,9 @@
 package libdns
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/libdns/libdns"
 )
@@ -27,3 +30,13 @@ func (p *ProviderModule) Name() string {
 func (p *ProviderModule) InstanceName() string {
 	return p.instName
 }
+
+// SetRecords replaces records with the same names and types as recs in the
+// zone. It fails if the provider does not support that.
+func (p *ProviderModule) SetRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	setter, ok := p.RecordAppender.(libdns.RecordSetter)
+	if !ok {
+		return nil, fmt.Errorf("%s: replacing records is not supported by the provider", p.modName)
+	}
+	return setter.SetRecords(ctx, zone, recs)
+}
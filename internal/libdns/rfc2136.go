@@ -0,0 +1,181 @@
+//+build libdns_rfc2136 !libdns_separate
+
+package libdns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+// rfc2136Provider implements libdns interfaces using RFC 2136 dynamic
+// updates, optionally authenticated using TSIG (RFC 8945).
+type rfc2136Provider struct {
+	Server     string
+	KeyName    string
+	KeyAlg     string
+	KeySecret  string
+	Timeout    time.Duration
+	DefaultTTL time.Duration
+}
+
+func (p *rfc2136Provider) rrs(zone string, recs []libdns.Record) ([]dns.RR, error) {
+	rrs := make([]dns.RR, 0, len(recs))
+	for _, rec := range recs {
+		hdr := dns.RR_Header{
+			Name:   dns.Fqdn(libdns.AbsoluteName(rec.Name, zone)),
+			Rrtype: dns.StringToType[strings.ToUpper(rec.Type)],
+			Class:  dns.ClassINET,
+			Ttl:    uint32(rec.TTL / time.Second),
+		}
+		if hdr.Rrtype == dns.TypeNone {
+			return nil, fmt.Errorf("libdns.rfc2136: unknown record type: %s", rec.Type)
+		}
+		if hdr.Ttl == 0 {
+			hdr.Ttl = uint32(p.DefaultTTL / time.Second)
+		}
+
+		switch hdr.Rrtype {
+		case dns.TypeTXT:
+			// Values longer than 255 octets need to be split into several
+			// strings, the value is the concatenation of them.
+			txt := &dns.TXT{Hdr: hdr}
+			val := rec.Value
+			for len(val) > 255 {
+				txt.Txt = append(txt.Txt, val[:255])
+				val = val[255:]
+			}
+			txt.Txt = append(txt.Txt, val)
+			rrs = append(rrs, txt)
+		default:
+			val := rec.Value
+			if hdr.Rrtype == dns.TypeMX || hdr.Rrtype == dns.TypeSRV || hdr.Rrtype == dns.TypeURI {
+				val = strconv.Itoa(rec.Priority) + " " + val
+			}
+			rr, err := dns.NewRR(hdr.String() + val)
+			if err != nil {
+				return nil, fmt.Errorf("libdns.rfc2136: malformed %s record: %w", rec.Type, err)
+			}
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, nil
+}
+
+func (p *rfc2136Provider) exchange(ctx context.Context, m *dns.Msg) error {
+	server := p.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	// Updates with long TXT records do not fit into UDP messages.
+	c := dns.Client{Net: "tcp", Timeout: p.Timeout}
+	if p.KeyName != "" {
+		keyName := dns.Fqdn(strings.ToLower(p.KeyName))
+		c.TsigSecret = map[string]string{keyName: p.KeySecret}
+		m.SetTsig(keyName, dns.Fqdn(p.KeyAlg), 300, time.Now().Unix())
+	}
+
+	resp, _, err := c.ExchangeContext(ctx, m, server)
+	if err != nil {
+		return fmt.Errorf("libdns.rfc2136: %w", err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("libdns.rfc2136: update rejected by %s: %s", server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+func (p *rfc2136Provider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := p.rrs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.Insert(rrs)
+	if err := p.exchange(ctx, m); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// DeleteRecords removes the records from the zone. Records without a value
+// remove all records with the same name and type.
+func (p *rfc2136Provider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := p.rrs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	for i, rr := range rrs {
+		if recs[i].Value == "" {
+			m.RemoveRRset([]dns.RR{rr})
+		} else {
+			m.Remove([]dns.RR{rr})
+		}
+	}
+	if err := p.exchange(ctx, m); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// SetRecords replaces all records with the same names and types as recs in a
+// single update so the change is atomic.
+func (p *rfc2136Provider) SetRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := p.rrs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	removed := make(map[string]bool)
+	for _, rr := range rrs {
+		key := strings.ToLower(rr.Header().Name) + " " + dns.TypeToString[rr.Header().Rrtype]
+		if removed[key] {
+			continue
+		}
+		removed[key] = true
+		m.RemoveRRset([]dns.RR{rr})
+	}
+	m.Insert(rrs)
+	if err := p.exchange(ctx, m); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+func init() {
+	module.Register("libdns.rfc2136", func(modName, instName string, _, _ []string) (module.Module, error) {
+		p := rfc2136Provider{}
+		return &ProviderModule{
+			RecordDeleter:  &p,
+			RecordAppender: &p,
+			setConfig: func(c *config.Map) {
+				c.String("server", false, true, "", &p.Server)
+				c.String("key_name", false, false, "", &p.KeyName)
+				c.Enum("key_alg", false, false,
+					[]string{"hmac-sha1", "hmac-sha224", "hmac-sha256", "hmac-sha384", "hmac-sha512"},
+					"hmac-sha256", &p.KeyAlg)
+				c.String("key_secret", false, false, "", &p.KeySecret)
+				c.Duration("timeout", false, false, 10*time.Second, &p.Timeout)
+				c.Duration("ttl", false, false, time.Hour, &p.DefaultTTL)
+			},
+			instName: instName,
+			modName:  modName,
+		}, nil
+	})
+}
@@ -0,0 +1,125 @@
+//+build libdns_rfc2136 !libdns_separate
+
+package libdns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+const testTsigSecret = "c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0"
+
+func startUpdateServer(t *testing.T, rcode int) (string, <-chan *dns.Msg) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make(chan *dns.Msg, 1)
+	srv := &dns.Server{
+		Listener:   l,
+		TsigSecret: map[string]string{"maddy.": testTsigSecret},
+		// Default function rejects UPDATE messages.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetRcode(req, rcode)
+			if req.IsTsig() != nil {
+				if w.TsigStatus() != nil {
+					resp.SetRcode(req, dns.RcodeNotAuth)
+				}
+				resp.SetTsig("maddy.", dns.HmacSHA256, 300, time.Now().Unix())
+			}
+			msgs <- req
+			_ = w.WriteMsg(resp)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return l.Addr().String(), msgs
+}
+
+func TestRFC2136_Set(t *testing.T) {
+	addr, msgs := startUpdateServer(t, dns.RcodeSuccess)
+	p := rfc2136Provider{
+		Server:     addr,
+		KeyName:    "maddy",
+		KeyAlg:     "hmac-sha256",
+		KeySecret:  testTsigSecret,
+		Timeout:    5 * time.Second,
+		DefaultTTL: time.Hour,
+	}
+
+	longValue := "v=DKIM1; k=rsa; p=" + strings.Repeat("A", 300)
+	_, err := p.SetRecords(context.Background(), "example.org.", []libdns.Record{
+		{Type: "TXT", Name: "sel._domainkey", Value: longValue},
+		{Type: "TLSA", Name: "_25._tcp.mx", Value: "3 1 1 0123456789abcdef", TTL: 5 * time.Minute},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-msgs
+	if req.Opcode != dns.OpcodeUpdate {
+		t.Fatal("Not an update:", req.Opcode)
+	}
+	if req.IsTsig() == nil {
+		t.Fatal("Update is not signed")
+	}
+	if req.Question[0].Name != "example.org." {
+		t.Fatal("Wrong zone:", req.Question[0].Name)
+	}
+	// 2 RRset removals followed by 2 insertions.
+	if len(req.Ns) != 4 {
+		t.Fatal("Wrong update section:", req.Ns)
+	}
+	for _, rr := range req.Ns[:2] {
+		if rr.Header().Class != dns.ClassANY {
+			t.Error("Expected RRset removal, got", rr)
+		}
+	}
+	txt, ok := req.Ns[2].(*dns.TXT)
+	if !ok {
+		t.Fatal("Expected TXT record, got", req.Ns[2])
+	}
+	if txt.Hdr.Name != "sel._domainkey.example.org." || txt.Hdr.Ttl != 3600 {
+		t.Error("Wrong TXT header:", txt.Hdr)
+	}
+	if len(txt.Txt) != 2 || strings.Join(txt.Txt, "") != longValue {
+		t.Error("Wrong TXT value:", txt.Txt)
+	}
+	tlsa, ok := req.Ns[3].(*dns.TLSA)
+	if !ok {
+		t.Fatal("Expected TLSA record, got", req.Ns[3])
+	}
+	if tlsa.Hdr.Name != "_25._tcp.mx.example.org." || tlsa.Hdr.Ttl != 300 || tlsa.Certificate != "0123456789abcdef" {
+		t.Error("Wrong TLSA record:", tlsa)
+	}
+}
+
+func TestRFC2136_Refused(t *testing.T) {
+	addr, _ := startUpdateServer(t, dns.RcodeRefused)
+	p := rfc2136Provider{
+		Server:     addr,
+		Timeout:    5 * time.Second,
+		DefaultTTL: time.Hour,
+	}
+
+	_, err := p.AppendRecords(context.Background(), "example.org.", []libdns.Record{
+		{Type: "TXT", Name: "_mta-sts", Value: "v=STSv1; id=1"},
+	})
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !strings.Contains(err.Error(), "REFUSED") {
+		t.Error("Unexpected error:", err)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package maintenance implements the server-wide read-only maintenance mode.
+//
+// While the mode is enabled, IMAP endpoints serve mailboxes read-only,
+// SMTP endpoints and local storage defer all incoming mail with 4xx
+// codes. This allows to take consistent backups or migrate the storage
+// without stopping the server.
+//
+// The mode is persisted as a flag file in the state directory so it can be
+// toggled by maddyctl. The file is checked on server start and when the
+// configuration reload is requested (SIGUSR2).
+package maintenance
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+// FileName is the name of the flag file in the state directory.
+const FileName = "maintenance"
+
+var enabled int32
+
+// Enabled reports whether the maintenance mode is currently enabled.
+func Enabled() bool {
+	return atomic.LoadInt32(&enabled) == 1
+}
+
+func flagPath() string {
+	return filepath.Join(config.StateDirectory, FileName)
+}
+
+func setFlag(on bool) {
+	var val int32
+	if on {
+		val = 1
+	}
+	if atomic.SwapInt32(&enabled, val) == val {
+		return
+	}
+	if on {
+		log.Printf("maintenance mode enabled, mailboxes are read-only and incoming mail is deferred")
+	} else {
+		log.Printf("maintenance mode disabled")
+	}
+}
+
+// Load updates the maintenance mode status from the flag file.
+func Load() error {
+	_, err := os.Stat(flagPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			setFlag(false)
+			return nil
+		}
+		return err
+	}
+	setFlag(true)
+	return nil
+}
+
+// Set enables or disables the maintenance mode and persists the change.
+//
+// If it is called from a separate process (maddyctl), the server needs to be
+// signaled to reload the state.
+func Set(on bool) error {
+	if on {
+		f, err := os.Create(flagPath())
+		if err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	} else {
+		if err := os.Remove(flagPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	setFlag(on)
+	return nil
+}
+
+// SMTPError returns the error that should be used to defer incoming mail
+// while the maintenance mode is enabled.
+func SMTPError() error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
+		Message:      "Server is under maintenance, try again later",
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maintenance
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestSetLoad(t *testing.T) {
+	config.StateDirectory = t.TempDir()
+	defer func() { config.StateDirectory = "" }()
+
+	if err := Load(); err != nil {
+		t.Fatal(err)
+	}
+	if Enabled() {
+		t.Fatal("Enabled without the flag file")
+	}
+
+	if err := Set(true); err != nil {
+		t.Fatal(err)
+	}
+	if !Enabled() {
+		t.Fatal("Not enabled after Set(true)")
+	}
+	if _, err := os.Stat(filepath.Join(config.StateDirectory, FileName)); err != nil {
+		t.Fatal("Flag file is not created:", err)
+	}
+
+	// Simulate the change made by another process.
+	if err := os.Remove(filepath.Join(config.StateDirectory, FileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(); err != nil {
+		t.Fatal(err)
+	}
+	if Enabled() {
+		t.Fatal("Enabled after the flag file removal")
+	}
+
+	if err := Set(false); err != nil {
+		t.Fatal("Set(false) failed for missing flag file:", err)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mmdb provides access to MaxMind DB files (GeoIP2, GeoLite2 and
+// compatible databases) that are reloaded when changed on disk.
+package mmdb
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// DB is the MaxMind database file that is periodically checked for
+// modification and reopened if necessary.
+type DB struct {
+	path string
+	log  log.Logger
+
+	lock    sync.RWMutex
+	r       *maxminddb.Reader
+	modTime time.Time
+
+	stop chan struct{}
+}
+
+// Open opens the database file at the specified path. If reloadInterval is not
+// zero, the file modification time is checked with that interval and the
+// database is reopened if the file changes.
+func Open(path string, reloadInterval time.Duration, log log.Logger) (*DB, error) {
+	db := &DB{
+		path: path,
+		log:  log,
+		stop: make(chan struct{}),
+	}
+	if err := db.reload(); err != nil {
+		return nil, err
+	}
+
+	if reloadInterval != 0 {
+		go db.reloadLoop(reloadInterval)
+	}
+
+	return db, nil
+}
+
+func (db *DB) reload() error {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return fmt.Errorf("mmdb: %w", err)
+	}
+
+	db.lock.RLock()
+	unchanged := db.r != nil && info.ModTime().Equal(db.modTime)
+	db.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	r, err := maxminddb.Open(db.path)
+	if err != nil {
+		return fmt.Errorf("mmdb: %s: %w", db.path, err)
+	}
+
+	db.lock.Lock()
+	old := db.r
+	db.r = r
+	db.modTime = info.ModTime()
+	db.lock.Unlock()
+
+	if old != nil {
+		if err := old.Close(); err != nil {
+			db.log.Error("failed to close old database", err, "path", db.path)
+		}
+		db.log.Msg("database reloaded", "path", db.path, "build_time", time.Unix(int64(r.Metadata.BuildEpoch), 0))
+	}
+
+	return nil
+}
+
+func (db *DB) reloadLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := db.reload(); err != nil {
+				db.log.Error("database reload failed, using old version", err, "path", db.path)
+			}
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+// Lookup decodes the record for the IP address into result. ok is false if
+// there is no record for the address.
+func (db *DB) Lookup(ip net.IP, result interface{}) (ok bool, err error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	_, ok, err = db.r.LookupNetwork(ip, result)
+	return ok, err
+}
+
+// Country returns the ISO 3166-1 country code for the IP address using
+// GeoIP2-Country or GeoIP2-City database. Empty string is returned if the
+// country is not known.
+func (db *DB) Country(ip net.IP) (string, error) {
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if _, err := db.Lookup(ip, &rec); err != nil {
+		return "", err
+	}
+	return rec.Country.ISOCode, nil
+}
+
+// ASN returns the autonomous system number and organization for the IP
+// address using GeoLite2-ASN or compatible database. Zero ASN is returned if
+// the address is not found.
+func (db *DB) ASN(ip net.IP) (uint, string, error) {
+	var rec struct {
+		Number       uint   `maxminddb:"autonomous_system_number"`
+		Organization string `maxminddb:"autonomous_system_organization"`
+	}
+	if _, err := db.Lookup(ip, &rec); err != nil {
+		return 0, "", err
+	}
+	return rec.Number, rec.Organization, nil
+}
+
+func (db *DB) Close() error {
+	close(db.stop)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return db.r.Close()
+}
@@ -0,0 +1,285 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+// Package arc implements the modifier that adds the Authenticated Received
+// Chain set (RFC 8617) to messages.
+//
+// Sealing lets downstream receivers see the authentication results the
+// message had when it was received by this server, so messages forwarded on
+// behalf of users can pass DMARC checks at receivers that trust the sealer.
+package arc
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/modify/dkim"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.arc"
+
+var signDefault = []string{
+	"From",
+	"Sender",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-Id",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"List-Id",
+	"List-Post",
+	"List-Unsubscribe",
+	"DKIM-Signature",
+}
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	domain     string
+	selector   string
+	authServID string
+	signFields []string
+	signer     crypto.Signer
+
+	resolver dns.Resolver
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		resolver: dns.DefaultResolver(),
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 2:
+		m.domain = inlineArgs[0]
+		m.selector = inlineArgs[1]
+	default:
+		return nil, fmt.Errorf("%s: domain and selector are expected as inline arguments", modName)
+	}
+
+	return m, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		keyPathTemplate string
+		newKeyAlgo      string
+		hostname        string
+	)
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("domain", false, false, m.domain, &m.domain)
+	cfg.String("selector", false, false, m.selector, &m.selector)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.Enum("newkey_algo", false, false,
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.String("authserv_id", false, false, "", &m.authServID)
+	cfg.StringList("sign_fields", false, false, signDefault, &m.signFields)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.domain == "" {
+		return fmt.Errorf("%s: domain is not specified", modName)
+	}
+	if m.selector == "" {
+		return fmt.Errorf("%s: selector is not specified", modName)
+	}
+	if m.authServID == "" {
+		m.authServID = hostname
+	}
+	if m.authServID == "" {
+		return fmt.Errorf("%s: authserv_id is not specified", modName)
+	}
+
+	keyPath := strings.NewReplacer("{domain}", m.domain, "{selector}", m.selector).Replace(keyPathTemplate)
+	signer, newKey, err := dkim.LoadOrGenerateKey(keyPath, newKeyAlgo, m.log)
+	if err != nil {
+		return err
+	}
+	if newKey {
+		dnsPath := keyPath + ".dns"
+		if filepath.Ext(keyPath) == ".key" {
+			dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		}
+		m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+			"put its contents into TXT record for %s._domainkey.%s to make sealing work",
+			newKeyAlgo, keyPath, dnsPath, m.selector, m.domain)
+	}
+	m.signer = signer
+
+	return nil
+}
+
+// fieldsToSign returns the list of header fields to sign, each field name is
+// included once for each occurrence.
+func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
+	seen := make(map[string]struct{}, len(m.signFields))
+	res := make([]string, 0, len(m.signFields))
+	for _, key := range m.signFields {
+		if _, ok := seen[strings.ToLower(key)]; ok {
+			continue
+		}
+		seen[strings.ToLower(key)] = struct{}{}
+
+		for field := h.FieldsByKey(key); field.Next(); {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// authResults returns results from the most recent Authentication-Results
+// field added by this server.
+func (m *Modifier) authResults(h *textproto.Header) string {
+	for field := h.FieldsByKey("Authentication-Results"); field.Next(); {
+		parts := strings.SplitN(field.Value(), ";", 2)
+		// authserv-id can be followed by the version number.
+		id := strings.Fields(parts[0])
+		if len(id) == 0 || !strings.EqualFold(id[0], m.authServID) {
+			continue
+		}
+		if len(parts) == 1 {
+			return "none"
+		}
+		return strings.TrimSpace(parts[1])
+	}
+	return "none"
+}
+
+type state struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return state{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+// chainStatus returns the validation status of the existing ARC chain. The
+// result of check.arc is used if available.
+func (s state) chainStatus(ctx context.Context, h *textproto.Header, body buffer.Buffer) (authres.ResultValue, error) {
+	if !h.Has(arc.FieldSeal) {
+		return authres.ResultNone, nil
+	}
+	if cv, ok := s.msgMeta.Facts.String(module.FactARCResult); ok {
+		return authres.ResultValue(cv), nil
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	res := arc.Verify(ctx, s.m.resolver, *h, r)
+	if res.Err != nil {
+		s.log.DebugMsg("ARC chain is not valid", "reason", res.Err)
+	}
+	return res.CV, nil
+}
+
+func (s state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.arc/RewriteBody").End()
+
+	cv, err := s.chainStatus(ctx, h, body)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": modName})
+	}
+
+	r, err := body.Open()
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": modName})
+	}
+	defer r.Close()
+
+	err = arc.Seal(h, r, arc.SealOptions{
+		Domain:      s.m.domain,
+		Selector:    s.m.selector,
+		Signer:      s.m.signer,
+		AuthServID:  s.m.authServID,
+		AuthResults: s.m.authResults(h),
+		HeaderKeys:  s.m.fieldsToSign(h),
+		CV:          cv,
+	})
+	if err != nil {
+		if errors.Is(err, arc.ErrChainFailed) {
+			s.log.DebugMsg("not sealing, chain is marked as failed")
+			return nil
+		}
+		// Sealing is not required for delivery.
+		s.log.Error("failed to seal the message", err)
+		return nil
+	}
+
+	s.log.DebugMsg("sealed", "domain", s.m.domain, "cv", cv)
+	return nil
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,97 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package arc
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const testMsg = "Authentication-Results: mx.example.org; spf=pass smtp.mailfrom=example.com\r\n" +
+	"Authentication-Results: other.example.org; spf=fail smtp.mailfrom=example.com\r\n" +
+	"From: <foo@example.com>\r\n" +
+	"To: <bar@example.org>\r\n" +
+	"Subject: Hello\r\n" +
+	"\r\n"
+
+func TestSeal(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	mod, err := New("", "test", nil, []string{"example.org", "default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, modName)
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}.key")}},
+			{Name: "newkey_algo", Args: []string{"ed25519"}},
+			{Name: "authserv_id", Args: []string{"mx.example.org"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := ioutil.ReadFile(filepath.Join(dir, "example.org.dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+		"default._domainkey.example.org.": {TXT: []string{string(record)}},
+	}}
+	m.resolver = r
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(testMsg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}
+
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.RewriteBody(context.Background(), &hdr, body); err != nil {
+		t.Fatal(err)
+	}
+
+	if aar := hdr.Get(arc.FieldAAR); aar != "i=1; mx.example.org; spf=pass smtp.mailfrom=example.com" {
+		t.Fatal("wrong", arc.FieldAAR, aar)
+	}
+	res := arc.Verify(context.Background(), r, hdr, strings.NewReader("foobar\r\n"))
+	if res.CV != authres.ResultPass {
+		t.Fatal("sealed message is not accepted:", res.Err)
+	}
+	if res.LatestSealer() != "example.org" {
+		t.Fatal("wrong sealer:", res.Sealers)
+	}
+}
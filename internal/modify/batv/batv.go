@@ -0,0 +1,179 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package batv implements the modifier that tags envelope senders of
+// outgoing messages using BATV (Bounce Address Tag Validation) and removes
+// tags from addresses of incoming bounces.
+//
+// Tags are verified by check.batv.
+package batv
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/prvs"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.batv"
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	domains  map[string]struct{}
+	keys     [][]byte
+	validity time.Duration
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		domains []string
+		keyFile string
+	)
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.StringList("domains", false, true, nil, &domains)
+	cfg.String("key_file", false, false, "batv_keys", &keyFile)
+	cfg.Duration("validity", false, false, 7*24*time.Hour, &m.validity)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	m.domains, err = DomainSet(domains)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if m.validity < 24*time.Hour {
+		return fmt.Errorf("%s: validity should be at least 24h", modName)
+	}
+	m.keys, err = prvs.LoadKeys(keyFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+// DomainSet returns the set of normalized domains.
+func DomainSet(domains []string) (map[string]struct{}, error) {
+	set := make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		norm, err := dns.ForLookup(d)
+		if err != nil {
+			return nil, fmt.Errorf("malformed domain: %s", d)
+		}
+		set[norm] = struct{}{}
+	}
+	return set, nil
+}
+
+// InDomains checks whether the address belongs to one of the domains.
+func InDomains(domains map[string]struct{}, addr string) bool {
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return false
+	}
+	domain, err = dns.ForLookup(domain)
+	if err != nil {
+		return false
+	}
+	_, ok := domains[domain]
+	return ok
+}
+
+type state struct {
+	m   *Modifier
+	log log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return state{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if mailFrom == "" || !InDomains(s.m.domains, mailFrom) {
+		return mailFrom, nil
+	}
+
+	tagged, err := prvs.Sign(s.m.keys, mailFrom, s.m.now(), s.m.validity)
+	if err != nil {
+		s.log.Error("failed to sign the sender address", err, "sender", mailFrom)
+		return mailFrom, nil
+	}
+	s.log.DebugMsg("sender address signed", "sender", mailFrom, "tagged", tagged)
+	return tagged, nil
+}
+
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	if !InDomains(s.m.domains, rcptTo) {
+		return rcptTo, nil
+	}
+
+	orig, tagged := prvs.Strip(rcptTo)
+	if tagged {
+		s.log.DebugMsg("tag removed", "rcpt", rcptTo, "orig_rcpt", orig)
+	}
+	return orig, nil
+}
+
+func (s state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
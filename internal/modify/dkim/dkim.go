@@ -21,12 +21,15 @@ package dkim
 import (
 	"context"
 	"crypto"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -34,6 +37,7 @@ import (
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
@@ -93,12 +97,24 @@ var (
 	}
 )
 
+type signingKey struct {
+	selector string
+	signer   crypto.Signer
+}
+
 type Modifier struct {
 	instName string
 
-	domains        []string
-	selector       string
-	signers        map[string]crypto.Signer
+	domains         []string
+	selector        string
+	ed25519Selector string
+	signers         map[string][]signingKey
+
+	// Keys referenced by keyTable, loaded on demand.
+	keyTable     module.Table
+	tableKeys    map[string]cachedKey
+	tableKeysLck sync.Mutex
+
 	oversignHeader []string
 	signHeader     []string
 	headerCanon    dkim.Canonicalization
@@ -115,7 +131,7 @@ type Modifier struct {
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
 		instName: instName,
-		signers:  map[string]crypto.Signer{},
+		signers:  map[string][]signingKey{},
 		log:      log.Logger{Name: "modify.dkim"},
 	}
 
@@ -151,6 +167,8 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	cfg.Bool("debug", true, false, &m.log.Debug)
 	cfg.StringList("domains", false, false, m.domains, &m.domains)
 	cfg.String("selector", false, false, m.selector, &m.selector)
+	cfg.String("ed25519_selector", false, false, "", &m.ed25519Selector)
+	cfg.Custom("keys", false, false, nil, modconfig.TableDirective, &m.keyTable)
 	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
 	cfg.StringList("oversign_fields", false, false, oversignDefault, &m.oversignHeader)
 	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
@@ -174,12 +192,20 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		return err
 	}
 
-	if len(m.domains) == 0 {
-		return errors.New("sign_domain: at least one domain is needed")
+	if len(m.domains) == 0 && m.keyTable == nil {
+		return errors.New("sign_domain: at least one domain or keys table is needed")
 	}
-	if m.selector == "" {
+	if len(m.domains) != 0 && m.selector == "" {
 		return errors.New("sign_domain: selector is not specified")
 	}
+	if m.ed25519Selector != "" {
+		if m.ed25519Selector == m.selector {
+			return errors.New("sign_domain: ed25519_selector should be different from selector")
+		}
+		if !strings.Contains(keyPathTemplate, "{selector}") {
+			return errors.New("sign_domain: key_path should contain {selector} to use ed25519_selector")
+		}
+	}
 	if m.signSubdomains && len(m.domains) > 1 {
 		return errors.New("sign_domain: only one domain is supported when sign_subdomains is enabled")
 	}
@@ -202,32 +228,124 @@ func (m *Modifier) Init(cfg *config.Map) error {
 			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 		}
 
-		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-		keyPath := keyValues.Replace(keyPathTemplate)
+		normDomain, err := dns.ForLookup(domain)
+		if err != nil {
+			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+		}
 
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+		signer, err := m.domainKey(keyPathTemplate, domain, m.selector, newKeyAlgo)
 		if err != nil {
 			return err
 		}
+		keys := []signingKey{{selector: m.selector, signer: signer}}
 
-		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		if m.ed25519Selector != "" {
+			signer, err := m.domainKey(keyPathTemplate, domain, m.ed25519Selector, "ed25519")
+			if err != nil {
+				return err
+			}
+			if _, ok := signer.(ed25519.PrivateKey); !ok {
+				return fmt.Errorf("sign_domain: key for ed25519_selector is not an Ed25519 key (domain %s)", domain)
 			}
-			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
+			keys = append(keys, signingKey{selector: m.ed25519Selector, signer: signer})
 		}
 
-		normDomain, err := dns.ForLookup(domain)
+		m.signers[normDomain] = keys
+	}
+
+	return nil
+}
+
+func (m *Modifier) domainKey(keyPathTemplate, domain, selector, newKeyAlgo string) (crypto.Signer, error) {
+	keyValues := strings.NewReplacer("{domain}", domain, "{selector}", selector)
+	keyPath := keyValues.Replace(keyPathTemplate)
+
+	signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
+	if err != nil {
+		return nil, err
+	}
+
+	if newKey {
+		dnsPath := keyPath + ".dns"
+		if filepath.Ext(keyPath) == ".key" {
+			dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+		}
+		m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+			"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
+			newKeyAlgo, keyPath, dnsPath, selector, domain)
+	}
+	return signer, nil
+}
+
+// keysForDomain returns keys that should be used to sign messages from the
+// specified domain. keys table takes precedence over statically configured
+// domains.
+func (m *Modifier) keysForDomain(ctx context.Context, normDomain string) ([]signingKey, error) {
+	if m.keyTable != nil {
+		val, ok, err := m.keyTable.Lookup(ctx, normDomain)
 		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+			return nil, err
+		}
+		if ok {
+			return m.parseKeys(val)
 		}
-		m.signers[normDomain] = signer
 	}
+	return m.signers[normDomain], nil
+}
 
-	return nil
+type cachedKey struct {
+	signer  crypto.Signer
+	modTime time.Time
+}
+
+// parseKeys parses the keys table value, it is a whitespace-separated list of
+// selector=key_path pairs.
+func (m *Modifier) parseKeys(val string) ([]signingKey, error) {
+	entries := strings.Fields(val)
+	if len(entries) == 0 {
+		return nil, errors.New("empty key list")
+	}
+
+	keys := make([]signingKey, 0, len(entries))
+	for _, entry := range entries {
+		eq := strings.IndexByte(entry, '=')
+		if eq <= 0 || eq == len(entry)-1 {
+			return nil, fmt.Errorf("malformed key entry: %s", entry)
+		}
+
+		signer, err := m.tableKey(entry[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, signingKey{selector: entry[:eq], signer: signer})
+	}
+	return keys, nil
+}
+
+// tableKey loads the key referenced by the keys table. Keys are cached and
+// reloaded only if the file is modified.
+func (m *Modifier) tableKey(keyPath string) (crypto.Signer, error) {
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	m.tableKeysLck.Lock()
+	defer m.tableKeysLck.Unlock()
+
+	if cached, ok := m.tableKeys[keyPath]; ok && cached.modTime.Equal(info.ModTime()) {
+		return cached.signer, nil
+	}
+
+	signer, err := LoadKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if m.tableKeys == nil {
+		m.tableKeys = make(map[string]cachedKey)
+	}
+	m.tableKeys[keyPath] = cachedKey{signer: signer, modTime: info.ModTime()}
+	return signer, nil
 }
 
 func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
@@ -300,9 +418,12 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 	}
 	// Use first key for null return path (<>) and postmaster (<postmaster>)
 	if domain == "" {
+		if len(s.m.domains) == 0 {
+			s.log.Msg("no key for null return path")
+			return nil
+		}
 		domain = s.m.domains[0]
 	}
-	selector := s.m.selector
 
 	if s.m.signSubdomains {
 		topDomain := s.m.domains[0]
@@ -315,8 +436,12 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
 		return nil
 	}
-	keySigner := s.m.signers[normDomain]
-	if keySigner == nil {
+	keys, err := s.m.keysForDomain(ctx, normDomain)
+	if err != nil {
+		s.log.Error("unable to get keys for domain", err, "domain", normDomain)
+		return nil
+	}
+	if len(keys) == 0 {
 		s.log.Msg("no key for domain", "domain", normDomain)
 		return nil
 	}
@@ -329,51 +454,78 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		if err != nil {
 			return nil
 		}
+	}
 
-		selector, err = idna.ToASCII(selector)
-		if err != nil {
-			return nil
+	headerKeys := s.m.fieldsToSign(h)
+	signers := make([]*dkim.Signer, 0, len(keys))
+	writers := make([]io.Writer, 0, len(keys))
+	closeAll := func() {
+		for _, signer := range signers {
+			signer.Close()
 		}
 	}
+	for _, key := range keys {
+		selector := key.selector
+		if !s.meta.SMTPOpts.UTF8 {
+			selector, err = idna.ToASCII(selector)
+			if err != nil {
+				closeAll()
+				return nil
+			}
+		}
 
-	opts := dkim.SignOptions{
-		Domain:                 domain,
-		Selector:               selector,
-		Identifier:             "@" + domain,
-		Signer:                 keySigner,
-		Hash:                   s.m.hash,
-		HeaderCanonicalization: s.m.headerCanon,
-		BodyCanonicalization:   s.m.bodyCanon,
-		HeaderKeys:             s.m.fieldsToSign(h),
-	}
-	if s.m.sigExpiry != 0 {
-		opts.Expiration = time.Now().Add(s.m.sigExpiry)
-	}
-	signer, err := dkim.NewSigner(&opts)
-	if err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		opts := dkim.SignOptions{
+			Domain:                 domain,
+			Selector:               selector,
+			Identifier:             "@" + domain,
+			Signer:                 key.signer,
+			Hash:                   s.m.hash,
+			HeaderCanonicalization: s.m.headerCanon,
+			BodyCanonicalization:   s.m.bodyCanon,
+			HeaderKeys:             headerKeys,
+		}
+		if s.m.sigExpiry != 0 {
+			opts.Expiration = time.Now().Add(s.m.sigExpiry)
+		}
+		signer, err := dkim.NewSigner(&opts)
+		if err != nil {
+			closeAll()
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
+		signers = append(signers, signer)
+		writers = append(writers, signer)
 	}
-	if err := textproto.WriteHeader(signer, *h); err != nil {
-		signer.Close()
+
+	// Feed the message into all signers at once so it is read only once.
+	w := io.MultiWriter(writers...)
+	if err := textproto.WriteHeader(w, *h); err != nil {
+		closeAll()
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
 	r, err := body.Open()
 	if err != nil {
-		signer.Close()
+		closeAll()
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
-	if _, err := io.Copy(signer, r); err != nil {
-		signer.Close()
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		closeAll()
 		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 	}
 
-	if err := signer.Close(); err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+	for _, signer := range signers {
+		if err := signer.Close(); err != nil {
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		}
 	}
 
-	h.AddRaw([]byte(signer.Signature()))
+	// Add in reverse order so the signature made using the first key ends
+	// up on top.
+	for i := len(signers) - 1; i >= 0; i-- {
+		h.AddRaw([]byte(signers[i].Signature()))
+	}
 
-	s.m.log.DebugMsg("signed", "domain", domain)
+	s.m.log.DebugMsg("signed", "domain", domain, "signatures", len(signers))
 
 	return nil
 }
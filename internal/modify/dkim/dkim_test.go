@@ -26,6 +26,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/emersion/go-message/textproto"
@@ -252,3 +253,120 @@ func TestFieldsToSign(t *testing.T) {
 		t.Errorf("incorrect set of fields to sign\nwant: %v\ngot:  %v", expected, fields)
 	}
 }
+
+func verifySignatures(t *testing.T, zones map[string]mockdns.Zone, hdr textproto.Header, body []byte) []*dkim.Verification {
+	t.Helper()
+
+	var fullBody bytes.Buffer
+	if err := textproto.WriteHeader(&fullBody, hdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fullBody.Write(body); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &mockdns.Resolver{Zones: zones}
+	verifs, err := dkim.VerifyWithOptions(bytes.NewReader(fullBody.Bytes()), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return resolver.LookupTXT(context.Background(), domain)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range verifs {
+		if v.Err != nil {
+			t.Errorf("Verification error for %s: %v", v.Domain, v.Err)
+		}
+	}
+	return verifs
+}
+
+func dnsZone(t *testing.T, dnsPath string) mockdns.Zone {
+	t.Helper()
+	dnsRecord, err := ioutil.ReadFile(dnsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mockdns.Zone{TXT: []string{string(dnsRecord)}}
+}
+
+func TestDualSign(t *testing.T) {
+	dir := testutils.Dir(t)
+
+	mod, err := New("", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"maddy.test"}},
+			{Name: "selector", Args: []string{"rsa"}},
+			{Name: "ed25519_selector", Args: []string{"ed"}},
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+			{Name: "require_sender_match", Args: []string{"off"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, body := signTestMsg(t, m, "test@maddy.test")
+	verifs := verifySignatures(t, map[string]mockdns.Zone{
+		"rsa._domainkey.maddy.test.": dnsZone(t, filepath.Join(dir, "maddy.test_rsa.dns")),
+		"ed._domainkey.maddy.test.":  dnsZone(t, filepath.Join(dir, "maddy.test_ed.dns")),
+	}, hdr, body)
+	if len(verifs) != 2 {
+		t.Fatalf("expected 2 signatures, got %d", len(verifs))
+	}
+
+	algos := []string{}
+	for field := hdr.FieldsByKey("DKIM-Signature"); field.Next(); {
+		for _, tag := range []string{"a=rsa-sha256", "a=ed25519-sha256"} {
+			if strings.Contains(field.Value(), tag) {
+				algos = append(algos, tag)
+			}
+		}
+	}
+	if !reflect.DeepEqual(algos, []string{"a=rsa-sha256", "a=ed25519-sha256"}) {
+		t.Errorf("wrong signature algorithms: %v", algos)
+	}
+}
+
+func TestKeysTable(t *testing.T) {
+	dir := testutils.Dir(t)
+	m := newTestModifier(t, dir, "ed25519", []string{"maddy.test"})
+
+	for _, key := range []struct{ name, algo string }{
+		{"table_rsa", "rsa2048"},
+		{"table_ed", "ed25519"},
+	} {
+		if _, _, err := LoadOrGenerateKey(filepath.Join(dir, key.name+".key"), key.algo, m.log); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.keyTable = testutils.Table{M: map[string]string{
+		"table.test":  "s1=" + filepath.Join(dir, "table_rsa.key") + " s2=" + filepath.Join(dir, "table_ed.key"),
+		"broken.test": "s1",
+	}}
+
+	hdr, body := signTestMsg(t, m, "test@table.test")
+	verifs := verifySignatures(t, map[string]mockdns.Zone{
+		"s1._domainkey.table.test.": dnsZone(t, filepath.Join(dir, "table_rsa.dns")),
+		"s2._domainkey.table.test.": dnsZone(t, filepath.Join(dir, "table_ed.dns")),
+	}, hdr, body)
+	if len(verifs) != 2 {
+		t.Fatalf("expected 2 signatures, got %d", len(verifs))
+	}
+
+	// Statically configured domains are still signed.
+	hdr, body = signTestMsg(t, m, "test@maddy.test")
+	verifyTestMsg(t, dir, []string{"maddy.test"}, hdr, body)
+
+	hdr, _ = signTestMsg(t, m, "test@broken.test")
+	if hdr.Has("DKIM-Signature") {
+		t.Error("message is signed using malformed table entry")
+	}
+}
@@ -32,10 +32,20 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+
+	"github.com/foxcpp/maddy/framework/log"
 )
 
+// LoadOrGenerateKey loads the private key from keyPath or generates a new one
+// using newKeyAlgo if the file does not exist. It allows other modules (e.g.
+// modify.arc) to share keys with modify.dkim.
+func LoadOrGenerateKey(keyPath, newKeyAlgo string, log log.Logger) (pkey crypto.Signer, newKey bool, err error) {
+	m := Modifier{log: log}
+	return m.loadOrGenerateKey(keyPath, newKeyAlgo)
+}
+
 func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
-	f, err := os.Open(keyPath)
+	pkey, err = LoadKey(keyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			pkey, err = m.generateAndWrite(keyPath, newKeyAlgo)
@@ -43,16 +53,33 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 		}
 		return nil, false, err
 	}
+	return pkey, false, nil
+}
+
+// GenerateKey generates a new key using newKeyAlgo and writes it to keyPath
+// along with the DNS record file. It fails if keyPath already exists.
+func GenerateKey(keyPath, newKeyAlgo string, log log.Logger) (crypto.Signer, error) {
+	m := Modifier{log: log}
+	return m.generateAndWrite(keyPath, newKeyAlgo)
+}
+
+// LoadKey reads the private key from keyPath. Error returned by os.Open is
+// returned as is.
+func LoadKey(keyPath string) (crypto.Signer, error) {
+	f, err := os.Open(keyPath)
+	if err != nil {
+		return nil, err
+	}
 	defer f.Close()
 
 	pemBlob, err := ioutil.ReadAll(f)
 	if err != nil {
-		return nil, false, err
+		return nil, err
 	}
 
 	block, _ := pem.Decode(pemBlob)
 	if block == nil {
-		return nil, false, fmt.Errorf("modify.dkim: %s: invalid PEM block", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: invalid PEM block", keyPath)
 	}
 
 	var key interface{}
@@ -60,35 +87,35 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 	case "PRIVATE KEY": // RFC 5208 aka PKCS #8
 		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	case "RSA PRIVATE KEY": // RFC 3447 aka PKCS #1
 		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	case "EC PRIVATE KEY": // RFC 5915
 		key, err = x509.ParseECPrivateKey(block.Bytes)
 		if err != nil {
-			return nil, false, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
+			return nil, fmt.Errorf("modify.dkim: %s: %w", keyPath, err)
 		}
 	default:
-		return nil, false, fmt.Errorf("modify.dkim: %s: not a private key or unsupported format", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: not a private key or unsupported format", keyPath)
 	}
 
 	switch key := key.(type) {
 	case *rsa.PrivateKey:
 		if err := key.Validate(); err != nil {
-			return nil, false, err
+			return nil, err
 		}
 		key.Precompute()
-		return key, false, nil
+		return key, nil
 	case ed25519.PrivateKey:
-		return key, false, nil
+		return key, nil
 	case *ecdsa.PublicKey:
-		return nil, false, fmt.Errorf("modify.dkim: %s: ECDSA keys are not supported", keyPath)
+		return nil, fmt.Errorf("modify.dkim: %s: ECDSA keys are not supported", keyPath)
 	default:
-		return nil, false, fmt.Errorf("modify.dkim: %s: unknown key type: %T", keyPath, key)
+		return nil, fmt.Errorf("modify.dkim: %s: unknown key type: %T", keyPath, key)
 	}
 }
 
@@ -100,16 +127,13 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
 
 	var (
-		pkey     crypto.Signer
-		dkimName = newKeyAlgo
-		err      error
+		pkey crypto.Signer
+		err  error
 	)
 	switch newKeyAlgo {
 	case "rsa4096":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 4096)
 	case "rsa2048":
-		dkimName = "rsa"
 		pkey, err = rsa.GenerateKey(rand.Reader, 2048)
 	case "ed25519":
 		_, pkey, err = ed25519.GenerateKey(rand.Reader)
@@ -131,15 +155,13 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 		return nil, wrapErr(err)
 	}
 
-	_, err = writeDNSRecord(keyPath, dkimName, pkey)
-	if err != nil {
-		return nil, wrapErr(err)
-	}
-
+	// Create the key file first so the DNS record of an existing key is not
+	// overwritten.
 	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
 	if err != nil {
 		return nil, wrapErr(err)
 	}
+	defer f.Close()
 
 	if err := pem.Encode(f, &pem.Block{
 		Type:  "PRIVATE KEY",
@@ -148,25 +170,43 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 		return nil, wrapErr(err)
 	}
 
+	_, err = writeDNSRecord(keyPath, pkey)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+
 	return pkey, nil
 }
 
-func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
+// DNSRecord returns the value of the DKIM key TXT record for the public key
+// of pkey.
+func DNSRecord(pkey crypto.Signer) (string, error) {
 	var (
-		keyBlob []byte
-		pubkey  = pkey.Public()
+		algoName string
+		keyBlob  []byte
 	)
-	switch pubkey := pubkey.(type) {
+	switch pubkey := pkey.Public().(type) {
 	case *rsa.PublicKey:
 		var err error
 		keyBlob, err = x509.MarshalPKIXPublicKey(pubkey)
 		if err != nil {
 			return "", err
 		}
+		algoName = "rsa"
 	case ed25519.PublicKey:
 		keyBlob = pubkey
+		algoName = "ed25519"
 	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
+		return "", fmt.Errorf("modify.dkim: unsupported key type: %T", pubkey)
+	}
+
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", algoName, base64.StdEncoding.EncodeToString(keyBlob)), nil
+}
+
+func writeDNSRecord(keyPath string, pkey crypto.Signer) (string, error) {
+	keyRecord, err := DNSRecord(pkey)
+	if err != nil {
+		return "", err
 	}
 
 	dnsPath := keyPath + ".dns"
@@ -177,7 +217,7 @@ func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, e
 	if err != nil {
 		return "", err
 	}
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob))
+	defer dnsF.Close()
 	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
 		return "", err
 	}
@@ -167,3 +167,37 @@ func TestKeyLoad_existing_pkcs1(t *testing.T) {
 		t.Fatalf("wrong public key returned by loadOrGenerateKey, got %s", pubkey.N.String())
 	}
 }
+
+func TestGenerateKey_existing(t *testing.T) {
+	dir := testutils.Dir(t)
+	keyPath := filepath.Join(dir, "testkey.key")
+
+	signer, err := GenerateKey(keyPath, "ed25519", testutils.Logger(t, "dkim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := DNSRecord(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GenerateKey(keyPath, "ed25519", testutils.Logger(t, "dkim")); err == nil {
+		t.Fatal("existing key overwritten")
+	}
+
+	recordBlob, err := ioutil.ReadFile(filepath.Join(dir, "testkey.dns"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recordBlob) != record {
+		t.Fatalf("DNS record file does not match the key\nwant %s\ngot  %s", record, recordBlob)
+	}
+
+	loaded, err := LoadKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Public().(ed25519.PublicKey).Equal(signer.Public()) {
+		t.Fatal("loaded key does not match the generated one")
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package footer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+)
+
+// maxDepth is the maximum nesting level of multipart entities that are
+// inspected.
+const maxDepth = 16
+
+// errSigned is returned if the message is signed or encrypted and should not
+// be modified.
+var errSigned = errors.New("signed or encrypted message")
+
+type footer struct {
+	text string
+	html string
+}
+
+// isProtected reports whether the entity is signed or encrypted, modifying it
+// would invalidate the signature or break the message.
+func isProtected(mediaType string) bool {
+	switch mediaType {
+	case "multipart/signed", "multipart/encrypted",
+		"application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	}
+	return false
+}
+
+// isInlinePGP reports whether the text contains a PGP signed or encrypted
+// message.
+func isInlinePGP(text []byte) bool {
+	return bytes.Contains(text, []byte("-----BEGIN PGP SIGNED MESSAGE-----")) ||
+		bytes.Contains(text, []byte("-----BEGIN PGP MESSAGE-----"))
+}
+
+func isAttachment(h textproto.Header) bool {
+	disp, _, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+	return err == nil && disp == "attachment"
+}
+
+// add writes the entity with the footer added to w. It returns false if the
+// footer can't be added to the entity, in this case nothing is written.
+func (f *footer) add(h *textproto.Header, body []byte, w io.Writer, depth int) (bool, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if isProtected(mediaType) {
+		return false, errSigned
+	}
+	if isAttachment(*h) {
+		return false, nil
+	}
+
+	switch {
+	case mediaType == "text/plain" || mediaType == "text/html":
+		return f.addText(h, mediaType, params, body, w)
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxDepth:
+		return f.addMultipart(h, mediaType, params, body, w, depth)
+	}
+	return false, nil
+}
+
+type part struct {
+	header textproto.Header
+	body   []byte
+}
+
+func readParts(body []byte, boundary string) ([]part, error) {
+	var parts []part
+	mr := textproto.NewMultipartReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return parts, nil
+			}
+			return nil, err
+		}
+		partBody, err := ioutil.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part{header: p.Header, body: partBody})
+	}
+}
+
+func (f *footer) addMultipart(h *textproto.Header, mediaType string, params map[string]string, body []byte, w io.Writer, depth int) (bool, error) {
+	parts, err := readParts(body, params["boundary"])
+	if err != nil {
+		return false, err
+	}
+	if len(parts) == 0 {
+		return false, nil
+	}
+
+	var (
+		modified = make([][]byte, len(parts))
+		added    bool
+	)
+	// tryPart adds the footer to the part, the modified version is stored
+	// in modified.
+	tryPart := func(i int) error {
+		var buf bytes.Buffer
+		ok, err := f.add(&parts[i].header, parts[i].body, &buf, depth+1)
+		if err != nil {
+			return err
+		}
+		if ok {
+			modified[i] = buf.Bytes()
+			added = true
+		}
+		return nil
+	}
+
+	var extraPart *part
+	switch mediaType {
+	case "multipart/alternative":
+		// Each alternative should have the footer.
+		for i := range parts {
+			if err := tryPart(i); err != nil {
+				return false, err
+			}
+		}
+	case "multipart/mixed":
+		// The first part is the message text, others are attachments. If
+		// the text can't be changed, the footer is added as a separate
+		// part.
+		if err := tryPart(0); err != nil {
+			return false, err
+		}
+		if !added {
+			extraPart = f.textPart()
+			added = true
+		}
+	default:
+		// multipart/related and unknown subtypes are handled as
+		// multipart/mixed but without adding new parts since their meaning
+		// is not known.
+		if err := tryPart(0); err != nil {
+			return false, err
+		}
+	}
+	if !added {
+		return false, nil
+	}
+
+	mw := textproto.NewMultipartWriter(w)
+	if err := mw.SetBoundary(params["boundary"]); err != nil {
+		// Boundary is not RFC-compliant, use a new one.
+		params["boundary"] = mw.Boundary()
+		h.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+	if extraPart != nil {
+		parts = append(parts, *extraPart)
+		modified = append(modified, extraPart.body)
+	}
+	for i, p := range parts {
+		pw, err := mw.CreatePart(p.header)
+		if err != nil {
+			return false, err
+		}
+		partBody := p.body
+		if modified[i] != nil {
+			partBody = modified[i]
+		}
+		if _, err := pw.Write(partBody); err != nil {
+			return false, err
+		}
+	}
+	return true, mw.Close()
+}
+
+// textPart creates the text/plain part containing the footer.
+func (f *footer) textPart() *part {
+	h := textproto.Header{}
+	h.Set("Content-Disposition", "inline")
+	var buf bytes.Buffer
+	// Writes to bytes.Buffer do not fail.
+	_ = encodeText(&h, "text/plain", map[string]string{}, []byte(f.text), &buf)
+	return &part{header: h, body: buf.Bytes()}
+}
+
+func (f *footer) addText(h *textproto.Header, mediaType string, params map[string]string, body []byte, w io.Writer) (bool, error) {
+	entity, err := message.New(message.Header{Header: *h}, bytes.NewReader(body))
+	if err != nil {
+		if message.IsUnknownCharset(err) || message.IsUnknownEncoding(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	text, err := ioutil.ReadAll(entity.Body)
+	if err != nil {
+		return false, err
+	}
+	if isInlinePGP(text) {
+		return false, errSigned
+	}
+
+	if mediaType == "text/html" {
+		text = insertHTML(text, f.html)
+	} else {
+		if len(text) != 0 && !bytes.HasSuffix(text, []byte("\n")) {
+			text = append(text, '\r', '\n')
+		}
+		text = append(text, "\r\n"+f.text+"\r\n"...)
+	}
+
+	return true, encodeText(h, mediaType, params, text, w)
+}
+
+// insertHTML inserts the footer before the closing body tag or appends it to
+// the document if there is no such tag.
+func insertHTML(doc []byte, footer string) []byte {
+	idx := bytes.LastIndex(bytes.ToLower(doc), []byte("</body"))
+	if idx == -1 {
+		out := append([]byte{}, doc...)
+		return append(out, "\r\n"+footer+"\r\n"...)
+	}
+	out := make([]byte, 0, len(doc)+len(footer)+2)
+	out = append(out, doc[:idx]...)
+	out = append(out, footer+"\r\n"...)
+	return append(out, doc[idx:]...)
+}
+
+// encodeText writes the text as UTF-8 quoted-printable and updates content
+// header fields accordingly.
+func encodeText(h *textproto.Header, mediaType string, params map[string]string, text []byte, w io.Writer) error {
+	params["charset"] = "utf-8"
+	h.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	qpw := quotedprintable.NewWriter(w)
+	if _, err := qpw.Write(text); err != nil {
+		return err
+	}
+	return qpw.Close()
+}
+
+// addFooter is a wrapper for footer.add that reads the message body from r.
+// It returns nil body if the footer can't be added.
+//
+// h is changed only if the footer is added.
+func addFooter(f *footer, h *textproto.Header, r io.Reader) ([]byte, error) {
+	body, err := ioutil.ReadAll(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	hdr := h.Copy()
+	ok, err := f.add(&hdr, body, &out, 0)
+	if err != nil || !ok {
+		return nil, err
+	}
+	*h = hdr
+	return out.Bytes(), nil
+}
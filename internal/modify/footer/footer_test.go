@@ -0,0 +1,220 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package footer
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+var testFooter = &footer{
+	text: "Confidential. Ünïcode.",
+	html: "<p>Confidential.</p>",
+}
+
+func readMsg(t *testing.T, msg string) (textproto.Header, string) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, msg[strings.Index(msg, "\r\n\r\n")+4:]
+}
+
+// bodies returns decoded bodies of all text parts of the message.
+func bodies(t *testing.T, hdr textproto.Header, body []byte) map[string][]string {
+	t.Helper()
+	entity, err := message.New(message.Header{Header: hdr}, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := map[string][]string{}
+	err = entity.Walk(func(_ []int, e *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		mediaType, _, _ := e.Header.ContentType()
+		if !strings.HasPrefix(mediaType, "text/") {
+			return nil
+		}
+		b, err := ioutil.ReadAll(e.Body)
+		if err != nil {
+			return err
+		}
+		res[mediaType] = append(res[mediaType], string(b))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestAddFooter_Plain(t *testing.T) {
+	hdr, body := readMsg(t, "Subject: Hi\r\n"+
+		"Content-Type: text/plain; charset=iso-8859-1; format=flowed\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"Gr=FC=DFe\r\n")
+
+	out, err := addFooter(testFooter, &hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil {
+		t.Fatal("footer is not added")
+	}
+	if ct := hdr.Get("Content-Type"); ct != "text/plain; charset=utf-8; format=flowed" {
+		t.Errorf("wrong Content-Type: %s", ct)
+	}
+	got := bodies(t, hdr, out)["text/plain"]
+	if len(got) != 1 || got[0] != "Grüße\r\n\r\nConfidential. Ünïcode.\r\n" {
+		t.Errorf("wrong body: %q", got)
+	}
+}
+
+func TestAddFooter_Alternative(t *testing.T) {
+	hdr, body := readMsg(t, "Subject: Invoice\r\n"+
+		"Content-Type: multipart/mixed; boundary=OUTER\r\n"+
+		"\r\n"+
+		"--OUTER\r\n"+
+		"Content-Type: multipart/alternative; boundary=INNER\r\n"+
+		"\r\n"+
+		"--INNER\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"Hello!\r\n"+
+		"--INNER\r\n"+
+		"Content-Type: text/html\r\n"+
+		"\r\n"+
+		"<html><body><p>Hello!</p></BODY></html>\r\n"+
+		"--INNER--\r\n"+
+		"--OUTER\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"Content-Disposition: attachment; filename=\"notes.txt\"\r\n"+
+		"\r\n"+
+		"Notes\r\n"+
+		"--OUTER--\r\n")
+
+	out, err := addFooter(testFooter, &hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := bodies(t, hdr, out)
+	if len(got["text/plain"]) != 2 || got["text/plain"][0] != "Hello!\r\n\r\nConfidential. Ünïcode.\r\n" {
+		t.Errorf("wrong text/plain bodies: %q", got["text/plain"])
+	}
+	// Attachment is not changed.
+	if got["text/plain"][1] != "Notes" {
+		t.Errorf("attachment is modified: %q", got["text/plain"][1])
+	}
+	if len(got["text/html"]) != 1 || got["text/html"][0] != "<html><body><p>Hello!</p><p>Confidential.</p>\r\n</BODY></html>" {
+		t.Errorf("wrong text/html body: %q", got["text/html"])
+	}
+}
+
+func TestAddFooter_SeparatePart(t *testing.T) {
+	hdr, body := readMsg(t, "Subject: Scan\r\n"+
+		"Content-Type: multipart/mixed; boundary=OUTER\r\n"+
+		"\r\n"+
+		"--OUTER\r\n"+
+		"Content-Type: application/pdf\r\n"+
+		"\r\n"+
+		"%PDF-1.4\r\n"+
+		"--OUTER--\r\n")
+
+	out, err := addFooter(testFooter, &hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := bodies(t, hdr, out)
+	if len(got["text/plain"]) != 1 || got["text/plain"][0] != "Confidential. Ünïcode." {
+		t.Errorf("wrong footer part: %q", got["text/plain"])
+	}
+}
+
+func TestAddFooter_Signed(t *testing.T) {
+	for _, msg := range []string{
+		"Content-Type: multipart/signed; boundary=SIG; protocol=\"application/pgp-signature\"\r\n" +
+			"\r\n" +
+			"--SIG\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"Hello!\r\n" +
+			"--SIG\r\n" +
+			"Content-Type: application/pgp-signature\r\n" +
+			"\r\n" +
+			"-----BEGIN PGP SIGNATURE-----\r\n" +
+			"--SIG--\r\n",
+		"Content-Type: application/pkcs7-mime; smime-type=signed-data\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"MIAGCSqGSIb3DQEHAqCAMIACAQExDzANBglghkgBZQMEAgEFADCABgkqhkiG9w0BBwGggCSABBI=\r\n",
+		"Content-Type: text/plain\r\n" +
+			"\r\n" +
+			"-----BEGIN PGP SIGNED MESSAGE-----\r\n" +
+			"Hash: SHA256\r\n" +
+			"\r\n" +
+			"Hello!\r\n",
+		"Content-Type: multipart/mixed; boundary=OUTER\r\n" +
+			"\r\n" +
+			"--OUTER\r\n" +
+			"Content-Type: multipart/encrypted; boundary=ENC; protocol=\"application/pgp-encrypted\"\r\n" +
+			"\r\n" +
+			"--ENC\r\n" +
+			"Content-Type: application/pgp-encrypted\r\n" +
+			"\r\n" +
+			"Version: 1\r\n" +
+			"--ENC--\r\n" +
+			"--OUTER--\r\n",
+	} {
+		hdr, body := readMsg(t, msg)
+		orig := hdr.Copy()
+		out, err := addFooter(testFooter, &hdr, strings.NewReader(body))
+		if err != errSigned {
+			t.Errorf("expected errSigned, got %v", err)
+		}
+		if out != nil {
+			t.Errorf("signed message is modified: %q", out)
+		}
+		if hdr.Get("Content-Type") != orig.Get("Content-Type") {
+			t.Errorf("header is modified")
+		}
+	}
+}
+
+func TestAddFooter_NoText(t *testing.T) {
+	hdr, body := readMsg(t, "Content-Type: image/png\r\n"+
+		"\r\n"+
+		"PNG\r\n")
+	out, err := addFooter(testFooter, &hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		t.Errorf("message is modified: %q", out)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package footer implements the modifier that appends a disclaimer or footer
+// to messages.
+//
+// The footer is added to text/plain and text/html bodies, including all
+// alternatives of multipart/alternative messages. Signed and encrypted
+// messages are never modified.
+package footer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.footer"
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	footer footer
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+// readFooter returns the value of the directive or the contents of the file
+// specified by the *_file directive.
+func readFooter(name, value, path string) (string, error) {
+	if value != "" && path != "" {
+		return "", fmt.Errorf("%s: %s and %s_file can't be used together", modName, name, name)
+	}
+	if path == "" {
+		return value, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", modName, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// normalizeNewlines converts line endings to CRLF.
+func normalizeNewlines(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var textValue, textPath, htmlValue, htmlPath string
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("text", false, false, "", &textValue)
+	cfg.String("text_file", false, false, "", &textPath)
+	cfg.String("html", false, false, "", &htmlValue)
+	cfg.String("html_file", false, false, "", &htmlPath)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	text, err := readFooter("text", textValue, textPath)
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		return fmt.Errorf("%s: text or text_file is required", modName)
+	}
+	htmlText, err := readFooter("html", htmlValue, htmlPath)
+	if err != nil {
+		return err
+	}
+	if htmlText == "" {
+		htmlText = "<div>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>\n") + "</div>"
+	}
+
+	m.footer = footer{
+		text: normalizeNewlines(text),
+		html: normalizeNewlines(htmlText),
+	}
+	return nil
+}
+
+type state struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return state{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func (s state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s state) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	defer trace.StartRegion(ctx, "modify.footer/ReplaceBody").End()
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyR.Close()
+
+	newBody, err := addFooter(&s.m.footer, h, bodyR)
+	if err != nil {
+		if errors.Is(err, errSigned) {
+			s.log.DebugMsg("signed or encrypted message, skipping")
+			return nil, nil
+		}
+		// The footer is not important enough to reject the message.
+		s.log.Error("malformed message, skipping", err)
+		return nil, nil
+	}
+	if newBody == nil {
+		s.log.DebugMsg("no suitable body part, skipping")
+		return nil, nil
+	}
+
+	s.log.DebugMsg("footer added")
+	return buffer.MemoryBuffer{Slice: newBody}, nil
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
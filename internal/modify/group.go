@@ -111,6 +111,29 @@ func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body
 	return nil
 }
 
+func (gs groupState) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	// Last buffer created by modifiers, nil if the body is not changed yet.
+	var replaced buffer.Buffer
+	for _, state := range gs.states {
+		newBody, err := module.ReplaceBody(ctx, state, h, body)
+		if err != nil {
+			if replaced != nil {
+				replaced.Remove()
+			}
+			return nil, err
+		}
+		if newBody == nil {
+			continue
+		}
+		if replaced != nil {
+			replaced.Remove()
+		}
+		replaced = newBody
+		body = newBody
+	}
+	return replaced, nil
+}
+
 func (gs groupState) Close() error {
 	// We still try close all state objects to minimize
 	// resource leaks when Close fails for one object..
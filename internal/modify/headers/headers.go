@@ -0,0 +1,246 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package headers implements the modifier that adds, removes and rewrites
+// arbitrary header fields.
+//
+// Rules are applied in the order they are specified in the configuration
+// block. Values can be changed using regular expressions or table lookups,
+// the display name of address fields (e.g. From) can be set using the table
+// lookup for the address.
+package headers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.headers"
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	rules []rule
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+// validField checks whether the string can be used as a header field name
+// (RFC 5322 Section 2.2).
+func validField(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if ch <= ' ' || ch > '~' || ch == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func fieldArg(node config.Node) (string, error) {
+	if len(node.Args) == 0 {
+		return "", config.NodeErr(node, "field name is required")
+	}
+	if !validField(node.Args[0]) {
+		return "", config.NodeErr(node, "invalid field name: %s", node.Args[0])
+	}
+	return node.Args[0], nil
+}
+
+func valueArg(node config.Node) (string, error) {
+	if len(node.Args) != 2 {
+		return "", config.NodeErr(node, "exactly two arguments are required")
+	}
+	if strings.ContainsAny(node.Args[1], "\r\n") {
+		return "", config.NodeErr(node, "value can't contain line breaks")
+	}
+	return node.Args[1], nil
+}
+
+func tableArg(m *config.Map, node config.Node) (module.Table, error) {
+	if len(node.Args) < 2 {
+		return nil, config.NodeErr(node, "field name and table are required")
+	}
+	var tbl module.Table
+	if err := modconfig.ModuleFromNode("table", node.Args[1:], node, m.Globals, &tbl); err != nil {
+		return nil, err
+	}
+	return tbl, nil
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Callback("remove", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) == 0 {
+			return config.NodeErr(node, "at least one field name is required")
+		}
+		for _, field := range node.Args {
+			if !validField(strings.TrimSuffix(field, "*")) {
+				return config.NodeErr(node, "invalid field name: %s", field)
+			}
+		}
+		m.rules = append(m.rules, removeRule{fields: node.Args})
+		return nil
+	})
+	cfg.Callback("add", func(_ *config.Map, node config.Node) error {
+		field, err := fieldArg(node)
+		if err != nil {
+			return err
+		}
+		value, err := valueArg(node)
+		if err != nil {
+			return err
+		}
+		m.rules = append(m.rules, addRule{field: field, value: value})
+		return nil
+	})
+	cfg.Callback("set", func(_ *config.Map, node config.Node) error {
+		field, err := fieldArg(node)
+		if err != nil {
+			return err
+		}
+		value, err := valueArg(node)
+		if err != nil {
+			return err
+		}
+		m.rules = append(m.rules, setRule{field: field, value: value})
+		return nil
+	})
+	cfg.Callback("rewrite", func(_ *config.Map, node config.Node) error {
+		field, err := fieldArg(node)
+		if err != nil {
+			return err
+		}
+		if len(node.Args) != 3 {
+			return config.NodeErr(node, "field name, regexp and replacement are required")
+		}
+		re, err := regexp.Compile(node.Args[1])
+		if err != nil {
+			return config.NodeErr(node, "invalid regexp: %v", err)
+		}
+		if strings.ContainsAny(node.Args[2], "\r\n") {
+			return config.NodeErr(node, "replacement can't contain line breaks")
+		}
+		m.rules = append(m.rules, rewriteRule{field: field, re: re, replacement: node.Args[2]})
+		return nil
+	})
+	cfg.Callback("lookup", func(cfgMap *config.Map, node config.Node) error {
+		field, err := fieldArg(node)
+		if err != nil {
+			return err
+		}
+		tbl, err := tableArg(cfgMap, node)
+		if err != nil {
+			return err
+		}
+		m.rules = append(m.rules, lookupRule{field: field, table: tbl})
+		return nil
+	})
+	cfg.Callback("display_name", func(cfgMap *config.Map, node config.Node) error {
+		field, err := fieldArg(node)
+		if err != nil {
+			return err
+		}
+		tbl, err := tableArg(cfgMap, node)
+		if err != nil {
+			return err
+		}
+		m.rules = append(m.rules, displayNameRule{field: field, table: tbl})
+		return nil
+	})
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(m.rules) == 0 {
+		return fmt.Errorf("%s: at least one rule is required", modName)
+	}
+	return nil
+}
+
+type state struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return state{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func (s state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	for _, r := range s.m.rules {
+		if err := r.apply(ctx, h); err != nil {
+			return exterrors.WithTemporary(
+				exterrors.WithFields(err, map[string]interface{}{"modifier": modName}),
+				true,
+			)
+		}
+	}
+	return nil
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,164 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package headers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type failingTable struct{}
+
+func (failingTable) Lookup(context.Context, string) (string, bool, error) {
+	return "", false, errors.New("table error")
+}
+
+func readHeader(t *testing.T, hdr string) textproto.Header {
+	t.Helper()
+	h, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdr + "\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func writeHeader(t *testing.T, h textproto.Header) string {
+	t.Helper()
+	var b bytes.Buffer
+	if err := textproto.WriteHeader(&b, h); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func testRules(t *testing.T, rules []rule, hdr, want string) {
+	t.Helper()
+
+	m := &Modifier{rules: rules, log: testutils.Logger(t, modName)}
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := readHeader(t, hdr)
+	if err := state.RewriteBody(context.Background(), &h, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := writeHeader(t, h); got != want {
+		t.Errorf("wrong header:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	testRules(t, []rule{removeRule{fields: []string{"user-agent", "X-Originating-*"}}},
+		"From: <foo@example.org>\r\n"+
+			"User-Agent: Test/1.0\r\n"+
+			"X-Originating-IP: [192.0.2.1]\r\n"+
+			"X-Originating-Host: client.example.org\r\n"+
+			"X-Mailer: Test\r\n",
+		"From: <foo@example.org>\r\n"+
+			"X-Mailer: Test\r\n\r\n")
+}
+
+func TestAddSet(t *testing.T) {
+	testRules(t, []rule{
+		addRule{field: "X-Added", value: "1"},
+		setRule{field: "Organization", value: "Example"},
+	},
+		"Organization: Old\r\n"+
+			"Organization: Older\r\n"+
+			"Subject: Hello\r\n",
+		"Organization: Example\r\n"+
+			"X-Added: 1\r\n"+
+			"Subject: Hello\r\n\r\n")
+}
+
+func TestRewrite(t *testing.T) {
+	testRules(t, []rule{rewriteRule{
+		field:       "Received",
+		re:          regexp.MustCompile(`from \S+ \(\s*\[[0-9.]+\]\)`),
+		replacement: "from [redacted]",
+	}},
+		"Received: from client (\r\n [192.0.2.1]) by mx.example.org\r\n"+
+			"Subject: Hello\r\n"+
+			"Received: from relay.example.com by relay2.example.com\r\n",
+		"Received: from [redacted] by mx.example.org\r\n"+
+			"Received: from relay.example.com by relay2.example.com\r\n"+
+			"Subject: Hello\r\n\r\n")
+
+	// Header is not changed if nothing matches.
+	testRules(t, []rule{rewriteRule{
+		field:       "Subject",
+		re:          regexp.MustCompile(`^\[EXT\] `),
+		replacement: "",
+	}},
+		"Subject: Hello\r\n"+
+			"From: <foo@example.org>\r\n",
+		"Subject: Hello\r\n"+
+			"From: <foo@example.org>\r\n\r\n")
+}
+
+func TestLookup(t *testing.T) {
+	testRules(t, []rule{lookupRule{
+		field: "X-Priority",
+		table: testutils.Table{M: map[string]string{"1 (Highest)": "3"}},
+	}},
+		"X-Priority: 1 (Highest)\r\n",
+		"X-Priority: 3\r\n\r\n")
+}
+
+func TestDisplayName(t *testing.T) {
+	tbl := testutils.Table{M: map[string]string{
+		"foo@example.org": "Foo Bar",
+		"baz@example.org": "Bäz",
+	}}
+	testRules(t, []rule{displayNameRule{field: "From", table: tbl}},
+		"From: \"Not Foo\" <Foo@example.org>\r\n",
+		"From: \"Foo Bar\" <Foo@example.org>\r\n\r\n")
+	testRules(t, []rule{displayNameRule{field: "From", table: tbl}},
+		"From: baz@example.org, <other@example.org>\r\n",
+		"From: =?utf-8?q?B=C3=A4z?= <baz@example.org>, <other@example.org>\r\n\r\n")
+	// Malformed fields are left as is.
+	testRules(t, []rule{displayNameRule{field: "From", table: tbl}},
+		"From: foo@\r\n",
+		"From: foo@\r\n\r\n")
+}
+
+func TestLookupError(t *testing.T) {
+	m := &Modifier{
+		rules: []rule{lookupRule{field: "Subject", table: failingTable{}}},
+		log:   testutils.Logger(t, modName),
+	}
+	state, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := readHeader(t, "Subject: Hello\r\n")
+	if err := state.RewriteBody(context.Background(), &h, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
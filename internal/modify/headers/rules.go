@@ -0,0 +1,198 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package headers
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// rule is a single header transformation.
+type rule interface {
+	apply(ctx context.Context, h *textproto.Header) error
+}
+
+// unfold removes line breaks inserted by header folding.
+func unfold(value string) string {
+	return strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+}
+
+// replaceValues replaces values of all fields with the specified key. The
+// function is called for each field value and returns the new value and
+// whether it should be changed.
+//
+// Fields keep their relative order but are moved to the top of the header if
+// any of them is changed.
+func replaceValues(h *textproto.Header, field string, replace func(value string) (string, bool, error)) error {
+	values := h.Values(field)
+	changed := false
+	for i, val := range values {
+		newVal, ok, err := replace(unfold(val))
+		if err != nil {
+			return err
+		}
+		if ok && newVal != values[i] {
+			values[i] = newVal
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	h.Del(field)
+	// Add prepends the field, so add them in reverse order.
+	for i := len(values) - 1; i >= 0; i-- {
+		h.Add(field, values[i])
+	}
+	return nil
+}
+
+// removeRule removes all fields with the specified names. Names ending with
+// '*' match all fields with the prefix.
+type removeRule struct {
+	fields []string
+}
+
+func (r removeRule) matches(key string) bool {
+	for _, field := range r.fields {
+		if strings.HasSuffix(field, "*") {
+			if len(key) >= len(field)-1 && strings.EqualFold(key[:len(field)-1], field[:len(field)-1]) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(key, field) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r removeRule) apply(_ context.Context, h *textproto.Header) error {
+	fields := h.Fields()
+	for fields.Next() {
+		if r.matches(fields.Key()) {
+			fields.Del()
+		}
+	}
+	return nil
+}
+
+type addRule struct {
+	field string
+	value string
+}
+
+func (r addRule) apply(_ context.Context, h *textproto.Header) error {
+	h.Add(r.field, r.value)
+	return nil
+}
+
+// setRule replaces all fields with the specified name with a single one.
+type setRule struct {
+	field string
+	value string
+}
+
+func (r setRule) apply(_ context.Context, h *textproto.Header) error {
+	h.Set(r.field, r.value)
+	return nil
+}
+
+// rewriteRule replaces matches of the regular expression in the field value.
+type rewriteRule struct {
+	field       string
+	re          *regexp.Regexp
+	replacement string
+}
+
+func (r rewriteRule) apply(_ context.Context, h *textproto.Header) error {
+	return replaceValues(h, r.field, func(value string) (string, bool, error) {
+		if !r.re.MatchString(value) {
+			return value, false, nil
+		}
+		return r.re.ReplaceAllString(value, r.replacement), true, nil
+	})
+}
+
+// lookupRule replaces the field value with the table lookup result.
+type lookupRule struct {
+	field string
+	table module.Table
+}
+
+func (r lookupRule) apply(ctx context.Context, h *textproto.Header) error {
+	return replaceValues(h, r.field, func(value string) (string, bool, error) {
+		newValue, ok, err := r.table.Lookup(ctx, strings.TrimSpace(value))
+		if err != nil {
+			return "", false, fmt.Errorf("%s lookup: %w", r.field, err)
+		}
+		return newValue, ok, nil
+	})
+}
+
+// displayNameRule sets the display name of addresses in the field to the
+// table lookup result for the address.
+type displayNameRule struct {
+	field string
+	table module.Table
+}
+
+func (r displayNameRule) apply(ctx context.Context, h *textproto.Header) error {
+	return replaceValues(h, r.field, func(value string) (string, bool, error) {
+		addrs, err := mail.ParseAddressList(value)
+		if err != nil {
+			// Leave malformed fields as is, they are not ours to fix.
+			return value, false, nil
+		}
+
+		changed := false
+		for _, addr := range addrs {
+			key, err := address.ForLookup(addr.Address)
+			if err != nil {
+				continue
+			}
+			name, ok, err := r.table.Lookup(ctx, key)
+			if err != nil {
+				return "", false, fmt.Errorf("%s display name lookup: %w", r.field, err)
+			}
+			if ok && name != addr.Name {
+				addr.Name = name
+				changed = true
+			}
+		}
+		if !changed {
+			return value, false, nil
+		}
+
+		formatted := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			formatted = append(formatted, addr.String())
+		}
+		return strings.Join(formatted, ", "), true, nil
+	})
+}
@@ -97,20 +97,23 @@ func (r replaceAddr) Close() error {
 }
 
 func (r replaceAddr) rewrite(ctx context.Context, val string) (string, error) {
-	normAddr, err := address.ForLookup(val)
+	keys, err := address.LookupKeys(val)
 	if err != nil {
 		return val, fmt.Errorf("malformed address: %v", err)
 	}
+	normAddr := keys[0]
 
-	replacement, ok, err := r.table.Lookup(ctx, normAddr)
-	if err != nil {
-		return val, err
-	}
-	if ok {
-		if !address.Valid(replacement) {
-			return "", fmt.Errorf("refusing to replace recipient with the invalid address %s", replacement)
+	for _, key := range keys {
+		replacement, ok, err := r.table.Lookup(ctx, key)
+		if err != nil {
+			return val, err
+		}
+		if ok {
+			if err := address.Validate(replacement, true, address.RFC); err != nil {
+				return "", fmt.Errorf("refusing to replace recipient with the invalid address %s: %w", replacement, err)
+			}
+			return replacement, nil
 		}
-		return replacement, nil
 	}
 
 	mbox, domain, err := address.Split(normAddr)
@@ -122,14 +125,14 @@ func (r replaceAddr) rewrite(ctx context.Context, val string) (string, error) {
 
 	// mbox is already normalized, since it is a part of address.ForLookup
 	// result.
-	replacement, ok, err = r.table.Lookup(ctx, mbox)
+	replacement, ok, err := r.table.Lookup(ctx, mbox)
 	if err != nil {
 		return val, err
 	}
 	if ok {
 		if strings.Contains(replacement, "@") && !strings.HasPrefix(replacement, `"`) && !strings.HasSuffix(replacement, `"`) {
-			if !address.Valid(replacement) {
-				return "", fmt.Errorf("refusing to replace recipient with invalid address %s", replacement)
+			if err := address.Validate(replacement, true, address.RFC); err != nil {
+				return "", fmt.Errorf("refusing to replace recipient with invalid address %s: %w", replacement, err)
 			}
 			return replacement, nil
 		}
@@ -92,6 +92,14 @@ func testReplaceAddr(t *testing.T, modName string) {
 		map[string]string{
 			"\u00E9@foo.example.com": "rcpt@foo.example.com",
 		})
+	test("rcpt@\u00E9.example.com", "rcpt@foo.example.com",
+		map[string]string{
+			"rcpt@xn--9ca.example.com": "rcpt@foo.example.com",
+		})
+	test("rcpt@XN--9CA.example.com.", "rcpt@foo.example.com",
+		map[string]string{
+			"rcpt@\u00E9.example.com": "rcpt@foo.example.com",
+		})
 }
 
 func TestReplaceAddr_RewriteSender(t *testing.T) {
@@ -0,0 +1,187 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package srs implements the modifier that rewrites envelope senders of
+// forwarded messages using SRS (Sender Rewriting Scheme) and restores
+// original addresses for bounces sent to rewritten addresses.
+package srs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/modify/batv"
+	"github.com/foxcpp/maddy/internal/prvs"
+	"github.com/foxcpp/maddy/internal/srs"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.srs"
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	domain       string
+	localDomains map[string]struct{}
+	keys         [][]byte
+	maxAge       time.Duration
+
+	rewriteSender bool
+	reverseRcpt   bool
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		now:      time.Now,
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		localDomains []string
+		keyFile      string
+		mode         string
+	)
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("domain", false, true, "", &m.domain)
+	cfg.StringList("local_domains", false, false, nil, &localDomains)
+	cfg.String("key_file", false, false, "srs_keys", &keyFile)
+	cfg.Duration("max_age", false, false, 21*24*time.Hour, &m.maxAge)
+	cfg.Enum("mode", false, false, []string{"both", "forward", "reverse"}, "both", &mode)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	var err error
+	m.domain, err = dns.ForLookup(m.domain)
+	if err != nil {
+		return fmt.Errorf("%s: malformed domain: %w", modName, err)
+	}
+	m.localDomains, err = batv.DomainSet(append(localDomains, m.domain))
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	if m.maxAge < 24*time.Hour {
+		return fmt.Errorf("%s: max_age should be at least 24h", modName)
+	}
+	m.keys, err = prvs.LoadKeys(keyFile)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+
+	m.rewriteSender = mode != "reverse"
+	m.reverseRcpt = mode != "forward"
+	return nil
+}
+
+type state struct {
+	m   *Modifier
+	log log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return state{
+		m:   m,
+		log: target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	if !s.m.rewriteSender || mailFrom == "" || batv.InDomains(s.m.localDomains, mailFrom) {
+		return mailFrom, nil
+	}
+
+	rewritten, err := srs.Forward(s.m.keys, mailFrom, s.m.domain, s.m.now())
+	if err != nil {
+		s.log.Error("failed to rewrite the sender address", err, "sender", mailFrom)
+		return mailFrom, nil
+	}
+	s.log.DebugMsg("sender address rewritten", "sender", mailFrom, "srs_sender", rewritten)
+	return rewritten, nil
+}
+
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	if !s.m.reverseRcpt || !srs.IsSRS(rcptTo) {
+		return rcptTo, nil
+	}
+	_, domain, err := address.Split(rcptTo)
+	if err != nil || !dns.Equal(domain, s.m.domain) {
+		return rcptTo, nil
+	}
+
+	orig, err := srs.Reverse(s.m.keys, rcptTo, s.m.now(), s.m.maxAge)
+	if err != nil {
+		// Delivering to arbitrary addresses would make the server an open
+		// relay.
+		reason := "Invalid SRS address"
+		if errors.Is(err, srs.ErrExpired) {
+			reason = "SRS address expired"
+		}
+		return "", &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      reason,
+			Err:          err,
+			Misc: map[string]interface{}{
+				"modifier": modName,
+			},
+		}
+	}
+	s.log.DebugMsg("SRS address reversed", "rcpt", rcptTo, "orig_rcpt", orig)
+	return orig, nil
+}
+
+func (s state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package srs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestModifier(t *testing.T) {
+	mod, err := New("", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, modName)
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domain", Args: []string{"example.org"}},
+			{Name: "local_domains", Args: []string{"example.com"}},
+			{Name: "key_file", Args: []string{filepath.Join(testutils.Dir(t), "srs_keys")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.now = func() time.Time { return time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC) }
+
+	st, err := m.ModStateForMsg(context.Background(), &module.MsgMetadata{ID: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sender := range []string{"", "user@example.com", "user@example.org"} {
+		rewritten, err := st.RewriteSender(context.Background(), sender)
+		if err != nil || rewritten != sender {
+			t.Errorf("local sender %q rewritten to %q (err %v)", sender, rewritten, err)
+		}
+	}
+
+	rewritten, err := st.RewriteSender(context.Background(), "user@remote.invalid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, err := st.RewriteRcpt(context.Background(), rewritten)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "user@remote.invalid" {
+		t.Fatal("wrong reversed address:", orig)
+	}
+
+	_, err = st.RewriteRcpt(context.Background(), "SRS0=AAAA=AA=remote.invalid=user@example.org")
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatal("forged address accepted:", err)
+	}
+
+	// Not our domain, left for other modules.
+	other := "SRS0=AAAA=AA=remote.invalid=user@example.net"
+	if rcpt, err := st.RewriteRcpt(context.Background(), other); err != nil || rcpt != other {
+		t.Fatal("address in other domain changed:", rcpt, err)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package strip_attachments implements the modifier that removes disallowed
+// attachments from messages and replaces them with text parts explaining the
+// removal.
+//
+// The set of disallowed attachments is defined using the same policy as used
+// by check.attachment.
+package strip_attachments
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/check/attachment"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.strip_attachments"
+
+const defaultNotice = `The attachment "{file}" was removed from this message by the mail server.
+Reason: {reason}.`
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	policy attachment.Policy
+	notice string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	m.policy.AddDirectives(cfg)
+	cfg.String("notice", false, false, defaultNotice, &m.notice)
+	_, err := cfg.Process()
+	return err
+}
+
+type state struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return state{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+func (s state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	return nil
+}
+
+func (s state) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	defer trace.StartRegion(ctx, "modify.strip_attachments/ReplaceBody").End()
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer bodyR.Close()
+
+	newBody, removed, err := stripMessage(&s.m.policy, s.m.notice, h, bodyR)
+	if err != nil {
+		// Malformed messages can't be inspected, so they are rejected
+		// instead of letting attachments through.
+		return nil, &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      "Malformed message",
+			Err:          err,
+			Misc: map[string]interface{}{
+				"modifier": modName,
+			},
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+
+	for _, v := range removed {
+		s.log.Msg("attachment removed", "file", v.File, "reason", v.Reason)
+	}
+
+	return buffer.MemoryBuffer{Slice: newBody}, nil
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
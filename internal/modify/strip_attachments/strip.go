@@ -0,0 +1,157 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package strip_attachments
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/check/attachment"
+)
+
+// maxDepth is the maximum nesting level of multipart entities that are
+// inspected. Parts nested deeper are copied as is.
+const maxDepth = 16
+
+type stripper struct {
+	policy  *attachment.Policy
+	notice  string
+	removed []attachment.Violation
+}
+
+// strip writes the entity with disallowed attachments replaced with text
+// parts to w.
+//
+// If the entity itself is disallowed (non-multipart message), h is modified to
+// describe the replacement.
+func (s *stripper) strip(h *textproto.Header, body io.Reader, w io.Writer, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && depth < maxDepth {
+		if boundary := params["boundary"]; boundary != "" {
+			return s.stripMultipart(h, mediaType, params, body, w, depth)
+		}
+	}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	v, err := s.checkPart(*h, raw)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		_, err = w.Write(raw)
+		return err
+	}
+
+	s.removed = append(s.removed, *v)
+	replaceHeader(h)
+	_, err = io.WriteString(w, s.noticeText(v))
+	return err
+}
+
+func (s *stripper) checkPart(h textproto.Header, raw []byte) (*attachment.Violation, error) {
+	entity, err := message.New(message.Header{Header: h}, bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+	return s.policy.CheckPart(entity.Header, entity.Body)
+}
+
+func (s *stripper) stripMultipart(h *textproto.Header, mediaType string, params map[string]string, body io.Reader, w io.Writer, depth int) error {
+	mr := textproto.NewMultipartReader(body, params["boundary"])
+	mw := textproto.NewMultipartWriter(w)
+	if err := mw.SetBoundary(params["boundary"]); err != nil {
+		// Boundary is not RFC-compliant, use a new one.
+		params["boundary"] = mw.Boundary()
+		h.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		var partBody bytes.Buffer
+		partHdr := p.Header
+		if err := s.strip(&partHdr, p, &partBody, depth+1); err != nil {
+			return err
+		}
+
+		pw, err := mw.CreatePart(partHdr)
+		if err != nil {
+			return err
+		}
+		if _, err := pw.Write(partBody.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return mw.Close()
+}
+
+func (s *stripper) noticeText(v *attachment.Violation) string {
+	text := strings.ReplaceAll(s.notice, "{file}", v.File)
+	text = strings.ReplaceAll(text, "{reason}", v.Reason)
+	return strings.ReplaceAll(text, "\n", "\r\n") + "\r\n"
+}
+
+// replaceHeader changes content-related header fields to describe the notice
+// text part.
+func replaceHeader(h *textproto.Header) {
+	h.Del("Content-Disposition")
+	h.Del("Content-Description")
+	h.Del("Content-ID")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "8bit")
+}
+
+// stripMessage is a wrapper for stripper.strip that reads the message body
+// from r.
+//
+// h is changed only if any attachments are removed.
+func stripMessage(policy *attachment.Policy, notice string, h *textproto.Header, r io.Reader) ([]byte, []attachment.Violation, error) {
+	s := stripper{policy: policy, notice: notice}
+
+	var out bytes.Buffer
+	hdr := h.Copy()
+	if err := s.strip(&hdr, bufio.NewReader(r), &out, 0); err != nil {
+		return nil, nil, err
+	}
+	if len(s.removed) != 0 {
+		*h = hdr
+	}
+	return out.Bytes(), s.removed, nil
+}
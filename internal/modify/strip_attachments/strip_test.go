@@ -0,0 +1,167 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package strip_attachments
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/internal/check/attachment"
+)
+
+func testPolicy() *attachment.Policy {
+	return &attachment.Policy{
+		Extensions: map[string]struct{}{"exe": {}},
+		MIMETypes:  map[string]struct{}{},
+	}
+}
+
+func readMsg(t *testing.T, msg string) (textproto.Header, string) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, msg[strings.Index(msg, "\r\n\r\n")+4:]
+}
+
+const multipartMsg = "Subject: Invoice\r\n" +
+	"Content-Type: multipart/mixed; boundary=OUTER\r\n" +
+	"\r\n" +
+	"--OUTER\r\n" +
+	"Content-Type: multipart/alternative; boundary=INNER\r\n" +
+	"\r\n" +
+	"--INNER\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello!\r\n" +
+	"--INNER\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Hello!</p>\r\n" +
+	"--INNER--\r\n" +
+	"--OUTER\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.exe\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"TVqQAAMAAAAEAAAA//8AALgAAAAAAAAAQAAAAAAAAAAA\r\n" +
+	"--OUTER\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"\r\n" +
+	"%PDF-1.4\r\n" +
+	"--OUTER--\r\n"
+
+func TestStripMessage(t *testing.T) {
+	hdr, body := readMsg(t, multipartMsg)
+
+	out, removed, err := stripMessage(testPolicy(), "{file} removed: {reason}", &hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].File != "invoice.exe" {
+		t.Fatalf("wrong removed attachments: %+v", removed)
+	}
+
+	entity, err := message.New(message.Header{Header: hdr}, bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	err = entity.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if part.MultipartReader() != nil {
+			return nil
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(part.Body); err != nil {
+			return err
+		}
+		parts = append(parts, mediaType+": "+strings.TrimSpace(buf.String()))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"text/plain: Hello!",
+		"text/html: <p>Hello!</p>",
+		"text/plain: invoice.exe removed: disallowed extension exe",
+		"application/pdf: %PDF-1.4",
+	}
+	if strings.Join(parts, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("wrong parts after stripping:\n%s", strings.Join(parts, "\n"))
+	}
+}
+
+func TestStripMessage_Clean(t *testing.T) {
+	hdr, body := readMsg(t, "Subject: Hello\r\n"+
+		"Content-Type: text/plain\r\n"+
+		"\r\n"+
+		"Hello!\r\n")
+
+	out, removed, err := stripMessage(testPolicy(), defaultNotice, &hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Fatalf("unexpected removed attachments: %+v", removed)
+	}
+	if string(out) != body {
+		t.Fatalf("body changed: %q", out)
+	}
+}
+
+func TestStripMessage_SinglePart(t *testing.T) {
+	hdr, body := readMsg(t, "Subject: Setup\r\n"+
+		"Content-Type: application/octet-stream; name=\"setup.exe\"\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		"TVqQAAMAAAAEAAAA//8AALgAAAAAAAAAQAAAAAAAAAAA\r\n")
+
+	out, removed, err := stripMessage(testPolicy(), "{file} removed", &hdr, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 {
+		t.Fatalf("wrong removed attachments: %+v", removed)
+	}
+	if ct := hdr.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("wrong Content-Type: %v", ct)
+	}
+	if cte := hdr.Get("Content-Transfer-Encoding"); cte != "8bit" {
+		t.Errorf("wrong Content-Transfer-Encoding: %v", cte)
+	}
+	if hdr.Get("Subject") != "Setup" {
+		t.Errorf("Subject is lost")
+	}
+	if string(out) != "setup.exe removed\r\n" {
+		t.Errorf("wrong body: %q", out)
+	}
+}
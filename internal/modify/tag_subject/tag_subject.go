@@ -0,0 +1,187 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tag_subject implements the modifier that prepends a tag (e.g.
+// "[SPAM]") to the Subject of messages considered spam.
+//
+// A message is considered spam if it was quarantined by a check or its
+// total score (see 'score' block in the message pipeline) reached the
+// configured threshold. Optionally, the quarantine flag is cleared afterwards
+// so the message is delivered normally and users can filter it using the
+// tag.
+package tag_subject
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "modify.tag_subject"
+
+type Modifier struct {
+	instName string
+	log      log.Logger
+
+	tag             string
+	score           float64
+	quarantined     bool
+	clearQuarantine bool
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &Modifier{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		m.tag = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("%s: at most one inline argument is expected", modName)
+	}
+	return m, nil
+}
+
+func (m *Modifier) Name() string {
+	return modName
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	defaultTag := m.tag
+	if defaultTag == "" {
+		defaultTag = "[SPAM]"
+	}
+
+	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.String("tag", false, false, defaultTag, &m.tag)
+	cfg.Float("score", false, false, 0, &m.score)
+	cfg.Bool("quarantined", false, true, &m.quarantined)
+	cfg.Bool("clear_quarantine", false, false, &m.clearQuarantine)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(m.tag) == "" {
+		return fmt.Errorf("%s: tag can't be empty", modName)
+	}
+	if strings.ContainsAny(m.tag, "\r\n") {
+		return fmt.Errorf("%s: tag can't contain line breaks", modName)
+	}
+	if !m.quarantined && m.score == 0 {
+		return fmt.Errorf("%s: either quarantined or score should be set", modName)
+	}
+	return nil
+}
+
+type state struct {
+	m       *Modifier
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return state{
+		m:       m,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s state) RewriteRcpt(ctx context.Context, rcptTo string) (string, error) {
+	return rcptTo, nil
+}
+
+// isSpam reports whether the message should be tagged and the reason for
+// logging.
+func (s state) isSpam() (bool, string) {
+	if s.m.quarantined && s.msgMeta.Quarantine {
+		return true, "quarantined"
+	}
+	if s.m.score != 0 {
+		if score, ok := s.msgMeta.Facts.Float(module.FactSpamScore); ok && score >= s.m.score {
+			return true, "score"
+		}
+	}
+	return false, ""
+}
+
+// tagSubject returns the Subject field value with the tag prepended. The
+// value is returned unchanged if it already starts with the tag.
+func tagSubject(subject, tag string) string {
+	encodedTag := tag
+	for _, ch := range tag {
+		if ch > 127 {
+			encodedTag = mime.QEncoding.Encode("utf-8", tag)
+			break
+		}
+	}
+
+	trimmed := strings.TrimSpace(subject)
+	if trimmed == "" {
+		return encodedTag
+	}
+	if strings.HasPrefix(trimmed, encodedTag) {
+		return subject
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(trimmed); err == nil && strings.HasPrefix(decoded, tag) {
+		return subject
+	}
+	return encodedTag + " " + trimmed
+}
+
+func (s state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	spam, reason := s.isSpam()
+	if !spam {
+		return nil
+	}
+
+	h.Set("Subject", tagSubject(h.Get("Subject"), s.m.tag))
+	if s.m.clearQuarantine && s.msgMeta.Quarantine {
+		s.msgMeta.Quarantine = false
+		s.log.Msg("subject tagged, quarantine cleared", "reason", reason)
+		return nil
+	}
+	s.log.DebugMsg("subject tagged", "reason", reason)
+	return nil
+}
+
+func (s state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
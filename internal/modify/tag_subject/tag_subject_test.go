@@ -0,0 +1,92 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tag_subject
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestTagSubject(t *testing.T) {
+	for _, c := range []struct {
+		subject, tag, want string
+	}{
+		{"Hello", "[SPAM]", "[SPAM] Hello"},
+		{"", "[SPAM]", "[SPAM]"},
+		{"[SPAM] Hello", "[SPAM]", "[SPAM] Hello"},
+		{"=?utf-8?q?Gr=C3=BC=C3=9Fe?=", "[SPAM]", "[SPAM] =?utf-8?q?Gr=C3=BC=C3=9Fe?="},
+		{"Hello", "[Спам]", "=?utf-8?q?[=D0=A1=D0=BF=D0=B0=D0=BC]?= Hello"},
+		{"=?utf-8?q?[=D0=A1=D0=BF=D0=B0=D0=BC]_Hello?=", "[Спам]", "=?utf-8?q?[=D0=A1=D0=BF=D0=B0=D0=BC]_Hello?="},
+	} {
+		if got := tagSubject(c.subject, c.tag); got != c.want {
+			t.Errorf("tagSubject(%q, %q) = %q, want %q", c.subject, c.tag, got, c.want)
+		}
+	}
+}
+
+func TestModifier(t *testing.T) {
+	test := func(m *Modifier, quarantine bool, score interface{}, wantSubject string, wantQuarantine bool) {
+		t.Helper()
+
+		msgMeta := &module.MsgMetadata{
+			ID:         "test",
+			Quarantine: quarantine,
+			Facts:      module.NewFacts(),
+		}
+		if score != nil {
+			msgMeta.Facts.Set(module.FactSpamScore, score)
+		}
+		m.log = testutils.Logger(t, modName)
+
+		state, err := m.ModStateForMsg(context.Background(), msgMeta)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := textproto.Header{}
+		hdr.Add("Subject", "Hello")
+		if err := state.RewriteBody(context.Background(), &hdr, nil); err != nil {
+			t.Fatal(err)
+		}
+		if subj := hdr.Get("Subject"); subj != wantSubject {
+			t.Errorf("wrong subject: %q, want %q", subj, wantSubject)
+		}
+		if msgMeta.Quarantine != wantQuarantine {
+			t.Errorf("wrong quarantine flag: %v, want %v", msgMeta.Quarantine, wantQuarantine)
+		}
+	}
+
+	m := &Modifier{tag: "[SPAM]", quarantined: true}
+	test(m, false, nil, "Hello", false)
+	test(m, true, nil, "[SPAM] Hello", true)
+	test(m, false, 100.0, "Hello", false)
+
+	m = &Modifier{tag: "[SPAM]", score: 5}
+	test(m, true, nil, "Hello", true)
+	test(m, false, 4.9, "Hello", false)
+	test(m, false, 5.0, "[SPAM] Hello", false)
+	test(m, false, 7, "[SPAM] Hello", false)
+
+	m = &Modifier{tag: "[SPAM]", quarantined: true, score: 5, clearQuarantine: true}
+	test(m, true, 1.0, "[SPAM] Hello", false)
+	test(m, false, 6.0, "[SPAM] Hello", false)
+}
@@ -0,0 +1,105 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// annotationField is the header field used to record check failures with
+// the 'annotate' action. It is removed from received messages to prevent
+// spoofing.
+const annotationField = "X-Maddy-Annotation"
+
+type annotation struct {
+	check  string
+	weight float64
+	reason string
+}
+
+// addAnnotation records the check failure. Only the first failure is recorded
+// for each check, e.g. if it is reported for multiple recipients.
+func (cr *checkRunner) addAnnotation(res module.CheckResult) {
+	check, _ := exterrors.Fields(res.Reason)["check"].(string)
+	if check == "" {
+		check = "unknown"
+	}
+	reason := ""
+	if res.Reason != nil {
+		reason = res.Reason.Error()
+		if smtpErr, ok := res.Reason.(*exterrors.SMTPError); ok {
+			reason = smtpErr.Message
+		}
+	}
+
+	cr.annotationsLock.Lock()
+	defer cr.annotationsLock.Unlock()
+	if _, ok := cr.annotations[check]; ok {
+		return
+	}
+	if cr.annotations == nil {
+		cr.annotations = make(map[string]annotation)
+	}
+	cr.annotations[check] = annotation{check: check, weight: res.AnnotateWeight, reason: reason}
+}
+
+// applyAnnotations adds header fields and facts for recorded check failures.
+func (cr *checkRunner) applyAnnotations(header *textproto.Header) {
+	if len(cr.annotations) == 0 {
+		return
+	}
+
+	checks := make([]string, 0, len(cr.annotations))
+	for check := range cr.annotations {
+		checks = append(checks, check)
+	}
+	sort.Strings(checks)
+
+	total := 0.0
+	// Add prepends the field, iterate backwards to keep them sorted.
+	for i := len(checks) - 1; i >= 0; i-- {
+		a := cr.annotations[checks[i]]
+		total += a.weight
+		cr.msgMeta.Facts.Set(module.FactAnnotationPrefix+a.check, a.weight)
+
+		value := a.check + "; weight=" + formatScore(a.weight)
+		if a.reason != "" {
+			value += "; reason=\"" + sanitizeReason(a.reason) + "\""
+		}
+		header.Add(annotationField, value)
+	}
+	cr.msgMeta.Facts.Set(module.FactAnnotationWeight, total)
+}
+
+func sanitizeReason(reason string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '"' || r == '\\':
+			return '\''
+		case r < ' ' || r == 0x7f:
+			return ' '
+		}
+		return r
+	}, reason)
+}
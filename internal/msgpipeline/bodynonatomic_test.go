@@ -22,6 +22,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/emersion/go-msgauth/authres"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/modify"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -65,6 +66,68 @@ func TestMsgPipeline_BodyNonAtomic(t *testing.T) {
 	}
 }
 
+func TestMsgPipeline_BodyNonAtomic_Checks(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.SPFResult{Value: authres.ResultPass, From: "FROM"},
+			},
+		},
+	}
+	rejectCheck := testutils.Check{
+		InstName: "reject_check",
+		BodyRes:  module.CheckResult{Reject: true, Reason: errors.New("go away")},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"example.com": {
+						checks:  []module.Check{&rejectCheck},
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	// Body checks are done the same way as for Body.
+	c := multipleErrs{}
+	testutils.DoTestDeliveryNonAtomic(t, c, &d, "sender@example.org", []string{"tester@example.org"})
+	if c["tester@example.org"] != nil {
+		t.Fatal("unexpected error:", c["tester@example.org"])
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if target.Messages[0].Header.Get("Authentication-Results") == "" {
+		t.Error("Authentication-Results field is not added")
+	}
+
+	// Rejection by the recipient block check fails only recipients of that
+	// block.
+	c = multipleErrs{}
+	testutils.DoTestDeliveryNonAtomic(t, c, &d, "sender@example.org", []string{"tester@example.org", "tester@example.com"})
+	if c["tester@example.com"] == nil {
+		t.Error("recipient block check is not applied:", c)
+	}
+	if c["tester@example.org"] != nil {
+		t.Error("unexpected error for recipient in other block:", c["tester@example.org"])
+	}
+	if len(target.Messages) != 2 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 2, len(target.Messages))
+	}
+	testutils.CheckMsg(t, &target.Messages[1], "sender@example.org", []string{"tester@example.org"})
+}
+
 func TestMsgPipeline_BodyNonAtomic_ModifiedRcpt(t *testing.T) {
 	err := errors.New("go away")
 
@@ -20,8 +20,10 @@ package msgpipeline
 
 import (
 	"context"
+	"net"
 	"runtime/debug"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
@@ -30,7 +32,10 @@ import (
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/arc"
+	"github.com/foxcpp/maddy/internal/bimi"
 	"github.com/foxcpp/maddy/internal/dmarc"
+	"github.com/foxcpp/maddy/internal/dmarc/report"
 )
 
 // checkRunner runs groups of checks, collects and merges results.
@@ -44,10 +49,46 @@ type checkRunner struct {
 	checkedRcptsPerCheck map[module.CheckState]map[string]struct{}
 	checkedRcptsLock     sync.Mutex
 
+	// States that already got CheckBody call. A check listed in multiple
+	// blocks selected for the message scans the body only once.
+	bodyChecked map[module.CheckState]struct{}
+
 	resolver      dns.Resolver
 	doDMARC       bool
 	didDMARCFetch bool
 	dmarcVerify   *dmarc.Verifier
+	dmarcReports  *report.Reporter
+	scoring       *scoringCfg
+
+	// firstPipeline is set if the message is received from the network and
+	// so header fields added by other servers should not be trusted.
+	firstPipeline bool
+
+	// BIMI is evaluated after DMARC, bimiFetcher is nil if indicators should
+	// not be fetched.
+	doBIMI      bool
+	bimiFetcher *bimi.Fetcher
+
+	// ARC sealer domains trusted to override DMARC failures. The message is
+	// kept to verify the ARC chain if DMARC fails and to include it in DMARC
+	// failure reports.
+	dmarcForwarders []string
+	dmarcHeader     textproto.Header
+	dmarcBody       buffer.Buffer
+
+	// Mailing list policy profile. Rejections by relaxed checks are kept in
+	// deferredRejects until the message header is checked.
+	mailingList     *mailingListCfg
+	isMailingList   bool
+	listDetected    bool
+	relaxedStates   map[module.CheckState]struct{}
+	deferredRejects []error
+	deferredLock    sync.Mutex
+
+	// Check failures recorded using the 'annotate' action, keyed by the
+	// check name.
+	annotations     map[string]annotation
+	annotationsLock sync.Mutex
 
 	log log.Logger
 
@@ -57,14 +98,17 @@ type checkRunner struct {
 }
 
 func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver) *checkRunner {
-	return &checkRunner{
+	cr := &checkRunner{
 		msgMeta:              msgMeta,
 		checkedRcptsPerCheck: map[module.CheckState]map[string]struct{}{},
+		bodyChecked:          map[module.CheckState]struct{}{},
 		log:                  log,
 		resolver:             r,
 		dmarcVerify:          dmarc.NewVerifier(r),
 		states:               make(map[module.Check]module.CheckState),
 	}
+	cr.mergedRes.Score, _ = msgMeta.Facts.Float(module.FactSessionScore)
+	return cr
 }
 
 func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) ([]module.CheckState, error) {
@@ -93,6 +137,12 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 		states = append(states, state)
 		newStates = append(newStates, state)
 		newStatesMap[check] = state
+		if cr.mailingList != nil && cr.mailingList.isRelaxed(check) {
+			if cr.relaxedStates == nil {
+				cr.relaxedStates = make(map[module.CheckState]struct{})
+			}
+			cr.relaxedStates[state] = struct{}{}
+		}
 	}
 
 	if len(newStates) == 0 {
@@ -105,7 +155,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	// Done outside of check loop above to make sure we can run these for multiple
 	// checks in parallel.
 	if cr.mailFromReceived {
-		err := cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err := cr.runAndMergeResults(ctx, newStates, func(s module.CheckState) module.CheckResult {
 			res := s.CheckConnection(ctx)
 			return res
 		})
@@ -113,7 +163,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 			closeStates()
 			return nil, err
 		}
-		err = cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err = cr.runAndMergeResults(ctx, newStates, func(s module.CheckState) module.CheckResult {
 			res := s.CheckSender(ctx, cr.mailFrom)
 			return res
 		})
@@ -126,7 +176,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	if len(cr.checkedRcpts) != 0 {
 		for _, rcpt := range cr.checkedRcpts {
 			rcpt := rcpt
-			err := cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+			err := cr.runAndMergeResults(ctx, states, func(s module.CheckState) module.CheckResult {
 				// Avoid calling CheckRcpt for the same recipient for the same check
 				// multiple times, even if requested.
 				cr.checkedRcptsLock.Lock()
@@ -159,10 +209,14 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	return states, nil
 }
 
-func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner func(module.CheckState) module.CheckResult) error {
+func (cr *checkRunner) runAndMergeResults(ctx context.Context, states []module.CheckState, runner func(module.CheckState) module.CheckResult) error {
 	data := struct {
 		authResLock sync.Mutex
 		headerLock  sync.Mutex
+		scoreLock   sync.Mutex
+
+		delay     time.Duration
+		delayLock sync.Mutex
 
 		quarantineErr    error
 		quarantineCheck  string
@@ -172,6 +226,10 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 		rejectCheck  string
 		setRejectErr sync.Once
 
+		redirectErr error
+		redirectTo  []string
+		setRedirect sync.Once
+
 		wg sync.WaitGroup
 	}{}
 
@@ -208,14 +266,51 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				data.headerLock.Unlock()
 			}
 
+			if subCheckRes.Score != 0 {
+				data.scoreLock.Lock()
+				cr.mergedRes.Score += subCheckRes.Score
+				data.scoreLock.Unlock()
+			}
+
+			if len(subCheckRes.Redirect) != 0 && !subCheckRes.Reject {
+				data.setRedirect.Do(func() {
+					data.redirectErr = subCheckRes.Reason
+					data.redirectTo = subCheckRes.Redirect
+				})
+			}
+
+			if subCheckRes.Annotate {
+				cr.addAnnotation(subCheckRes)
+			}
+
+			if subCheckRes.Delay != 0 {
+				data.delayLock.Lock()
+				if subCheckRes.Delay > data.delay {
+					data.delay = subCheckRes.Delay
+				}
+				data.delayLock.Unlock()
+			}
+
 			if subCheckRes.Quarantine {
 				data.setQuarantineErr.Do(func() {
 					data.quarantineErr = subCheckRes.Reason
 				})
+			} else if subCheckRes.Reject && cr.relaxReject(state, subCheckRes.Reason) {
+				// Deferred or waived by the mailing list profile.
 			} else if subCheckRes.Reject {
 				data.setRejectErr.Do(func() {
 					data.rejectErr = subCheckRes.Reason
 				})
+			} else if len(subCheckRes.Redirect) != 0 {
+				// Handled above.
+			} else if subCheckRes.Reason != nil && subCheckRes.Delay != 0 {
+				cr.log.Error("delayed", subCheckRes.Reason, "delay", subCheckRes.Delay)
+			} else if subCheckRes.Annotate {
+				cr.log.Error("annotated", subCheckRes.Reason, "weight", subCheckRes.AnnotateWeight)
+			} else if subCheckRes.Reason != nil && subCheckRes.Score != 0 {
+				// 'action score' case. Actual action is decided later
+				// by applyResults using the total score.
+				cr.log.Error("scored", subCheckRes.Reason, "score", subCheckRes.Score)
 			} else if subCheckRes.Reason != nil {
 				// 'action ignore' case. There is Reason, but action.Apply set
 				// both Reject and Quarantine to false. Log the reason for
@@ -226,6 +321,9 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 	}
 
 	data.wg.Wait()
+	if data.delay != 0 {
+		cr.delay(ctx, data.delay)
+	}
 	if data.rejectErr != nil {
 		return data.rejectErr
 	}
@@ -235,9 +333,64 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 		cr.mergedRes.Quarantine = true
 	}
 
+	if data.redirectTo != nil && cr.mergedRes.Redirect == nil {
+		cr.log.Error("redirected", data.redirectErr, "redirect_to", data.redirectTo)
+		cr.mergedRes.Redirect = data.redirectTo
+	}
+
 	return nil
 }
 
+// delay waits before the reply is sent to the client as requested by the
+// 'delay' check action.
+func (cr *checkRunner) delay(ctx context.Context, d time.Duration) {
+	cr.log.Msg("delaying reply", "delay", d)
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
+
+// relaxReject checks whether the rejection by the check should be deferred
+// until the message header is checked for mailing list signatures or waived if
+// the message is already known to come from the mailing list.
+func (cr *checkRunner) relaxReject(state module.CheckState, reason error) bool {
+	if _, ok := cr.relaxedStates[state]; !ok {
+		return false
+	}
+	if !cr.listDetected {
+		cr.deferredLock.Lock()
+		cr.deferredRejects = append(cr.deferredRejects, reason)
+		cr.deferredLock.Unlock()
+		return true
+	}
+	if cr.isMailingList {
+		cr.log.Error("rejection waived for mailing list", reason)
+		return true
+	}
+	return false
+}
+
+// detectMailingList checks whether the message comes from the mailing list
+// and sets the corresponding fact.
+func (cr *checkRunner) detectMailingList(header textproto.Header) {
+	if cr.mailingList == nil || cr.listDetected {
+		return
+	}
+	cr.listDetected = true
+
+	listID, ok := cr.mailingList.detect(header)
+	if !ok {
+		return
+	}
+	cr.isMailingList = true
+	cr.msgMeta.Facts.Set(module.FactMailingList, listID)
+	cr.log.DebugMsg("mailing list message", "list_id", listID)
+}
+
 func (cr *checkRunner) checkConnSender(ctx context.Context, checks []module.Check, mailFrom string) error {
 	cr.mailFrom = mailFrom
 	cr.mailFromReceived = true
@@ -253,7 +406,7 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 		return err
 	}
 
-	err = cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	err = cr.runAndMergeResults(ctx, states, func(s module.CheckState) module.CheckResult {
 		cr.checkedRcptsLock.Lock()
 		if _, ok := cr.checkedRcptsPerCheck[s][rcptTo]; ok {
 			cr.checkedRcptsLock.Unlock()
@@ -274,6 +427,10 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 }
 
 func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, header textproto.Header, body buffer.Buffer) error {
+	// Checks initialized now will get CheckConnection and CheckSender calls
+	// replayed, so detection is done before that.
+	cr.detectMailingList(header)
+
 	states, err := cr.checkStates(ctx, checks)
 	if err != nil {
 		return err
@@ -282,22 +439,122 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 	if cr.doDMARC && !cr.didDMARCFetch {
 		cr.dmarcVerify.FetchRecord(ctx, header)
 		cr.didDMARCFetch = true
+		if len(cr.dmarcForwarders) != 0 || cr.dmarcReports != nil {
+			cr.dmarcHeader = header.Copy()
+			cr.dmarcBody = body
+		}
+	}
+
+	unchecked := states[:0]
+	for _, state := range states {
+		if _, ok := cr.bodyChecked[state]; ok {
+			continue
+		}
+		cr.bodyChecked[state] = struct{}{}
+		unchecked = append(unchecked, state)
+	}
+	if len(unchecked) == 0 {
+		return nil
 	}
 
-	return cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	return cr.runAndMergeResults(ctx, unchecked, func(s module.CheckState) module.CheckResult {
 		res := s.CheckBody(ctx, header, body)
 		return res
 	})
 }
 
-func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) error {
+// trustedForwarder verifies the ARC chain of the message and returns the
+// domain of the last sealer if the chain is valid and the sealer is listed in
+// dmarc_trusted_forwarders.
+//
+// If the chain was already validated by check.arc, its result is used.
+func (cr *checkRunner) trustedForwarder(ctx context.Context) string {
+	if len(cr.dmarcForwarders) == 0 {
+		return ""
+	}
+
+	var sealer string
+	if cv, ok := cr.msgMeta.Facts.String(module.FactARCResult); ok {
+		if cv != string(authres.ResultPass) {
+			return ""
+		}
+		sealer, _ = cr.msgMeta.Facts.String(module.FactARCSealer)
+	} else {
+		if cr.dmarcBody == nil {
+			return ""
+		}
+
+		r, err := cr.dmarcBody.Open()
+		if err != nil {
+			cr.log.Error("failed to open body for ARC verification", err)
+			return ""
+		}
+		defer r.Close()
+
+		res := arc.Verify(ctx, cr.resolver, cr.dmarcHeader, r)
+		if res.CV != authres.ResultPass {
+			if res.Err != nil {
+				cr.log.DebugMsg("ARC chain is not valid", "reason", res.Err)
+			}
+			return ""
+		}
+		sealer = res.LatestSealer()
+	}
+
+	for _, domain := range cr.dmarcForwarders {
+		if dns.Equal(domain, sealer) {
+			return sealer
+		}
+	}
+	cr.log.DebugMsg("ARC sealer is not trusted", "arc_sealer", sealer)
+	return ""
+}
+
+func (cr *checkRunner) applyResults(ctx context.Context, hostname string, header *textproto.Header) error {
+	if len(cr.deferredRejects) != 0 {
+		if !cr.isMailingList {
+			return cr.deferredRejects[0]
+		}
+		for _, reason := range cr.deferredRejects {
+			cr.log.Error("rejection waived for mailing list", reason)
+		}
+	}
+
 	if cr.mergedRes.Quarantine {
 		cr.msgMeta.Quarantine = true
 	}
 
+	cr.applyAnnotations(header)
+
 	if cr.doDMARC {
 		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
+		reportRes := report.Result{Eval: dmarcRes}
+		if dmarcRes.SampledOut {
+			reportRes.Override = "sampled_out"
+		}
+		if policy != dmarc.PolicyNone && dmarcRes.Authres.Value == authres.ResultFail {
+			// RFC 7489 Section 6.7 allows local policy exceptions for
+			// trusted forwarders.
+			if sealer := cr.trustedForwarder(ctx); sealer != "" {
+				cr.log.Msg("DMARC policy overridden", "reason", dmarcRes.Authres.Reason, "arc_sealer", sealer)
+				dmarcRes.Authres.Reason = "policy overridden, trusted forwarder " + sealer
+				policy = dmarc.PolicyNone
+				reportRes.Override = "trusted_forwarder"
+				reportRes.OverrideComment = "ARC sealed by " + sealer
+			}
+		}
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
+		if cr.dmarcReports != nil {
+			reportRes.Disposition = policy
+			reportRes.EnvelopeFrom = cr.mailFrom
+			if cr.msgMeta.Conn != nil {
+				if tcpAddr, ok := cr.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+					reportRes.SourceIP = tcpAddr.IP
+				}
+			}
+			cr.dmarcReports.Record(ctx, reportRes)
+			cr.dmarcReports.ReportFailure(ctx, reportRes, cr.msgMeta, cr.dmarcHeader, cr.dmarcBody)
+		}
 		switch policy {
 		case dmarc.PolicyReject:
 			code := 550
@@ -325,6 +582,20 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 			// Mimick the message structure for regular checks.
 			cr.log.Msg("quarantined", "reason", dmarcRes.Authres.Reason, "check", "dmarc")
 		}
+
+		if cr.doBIMI {
+			cr.applyBIMI(ctx, header, dmarcRes)
+		}
+	}
+
+	scoring := cr.scoring
+	if cr.isMailingList && cr.mailingList.scoring != nil {
+		scoring = cr.mailingList.scoring
+	}
+	if scoring != nil {
+		if err := cr.applyScore(scoring, header); err != nil {
+			return err
+		}
 	}
 
 	// After results for all checks are checked, authRes will be populated with values
@@ -343,6 +614,31 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	return nil
 }
 
+// applyBIMI replaces any BIMI-Location and BIMI-Indicator fields present in
+// the message with ones based on the BIMI record of the sender domain.
+func (cr *checkRunner) applyBIMI(ctx context.Context, header *textproto.Header, dmarcRes dmarc.EvalResult) {
+	bimi.StripHeaders(header)
+
+	// Quarantined messages should not look trustworthy.
+	if cr.msgMeta.Quarantine {
+		return
+	}
+
+	res := bimi.Evaluate(ctx, cr.resolver, cr.bimiFetcher, *header, dmarcRes)
+	switch res.Authres.Value {
+	case authres.ResultPass:
+		cr.log.DebugMsg("BIMI passed", "domain", res.Domain, "selector", res.Selector, "location", res.Location)
+	case authres.ResultFail, authres.ResultTempError:
+		cr.log.Msg("BIMI check failed", "reason", res.Reason, "domain", res.Domain, "selector", res.Selector)
+	default:
+		cr.log.DebugMsg("BIMI not applied", "result", res.Authres.Value, "reason", res.Reason)
+	}
+	if res.Authres.Value != bimi.ResultSkipped {
+		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &res.Authres)
+	}
+	res.AddHeaders(header)
+}
+
 func (cr *checkRunner) close() {
 	cr.dmarcVerify.Close()
 	for _, state := range cr.states {
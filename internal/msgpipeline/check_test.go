@@ -20,10 +20,13 @@ package msgpipeline
 
 import (
 	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -446,3 +449,419 @@ func TestMsgPipeline_RcptCheck_Errors(t *testing.T) {
 			check_.UnclosedStates, sourceCheck.UnclosedStates, globalCheck.UnclosedStates)
 	}
 }
+
+func TestMsgPipeline_Score(t *testing.T) {
+	test := func(scoring scoringCfg, scores []float64, shouldReject, shouldQuarantine bool, flag string) {
+		t.Helper()
+
+		target := testutils.Target{}
+		checks := make([]module.Check, 0, len(scores))
+		for _, score := range scores {
+			checks = append(checks, &testutils.Check{
+				BodyRes: module.CheckResult{
+					Reason: errors.New("scored"),
+					Score:  score,
+				},
+			})
+		}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: checks,
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+				scoring: &scoring,
+			},
+			Log: testutils.Logger(t, "msgpipeline"),
+		}
+
+		_, err := testutils.DoTestDeliveryErr(t, &d, "whatever@whatever", []string{"whatever@whatever"})
+		if shouldReject {
+			if err == nil {
+				t.Error("expected message to be rejected")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(target.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+		}
+		msg := target.Messages[0]
+		if msg.MsgMeta.Quarantine != shouldQuarantine {
+			t.Errorf("wrong quarantine flag, want %v", shouldQuarantine)
+		}
+		if val := msg.Header.Get("X-Spam-Flag"); val != flag {
+			t.Errorf("wrong X-Spam-Flag value, want %q, got %q", flag, val)
+		}
+		if val, _ := msg.MsgMeta.Facts.Float(module.FactSpamScore); msg.Header.Get(scoreField) != formatScore(val) {
+			t.Errorf("%s %v does not match spam.score fact %v", scoreField, msg.Header.Get(scoreField), val)
+		}
+	}
+
+	scoring := scoringCfg{addHeader: 2, quarantine: 5, reject: 10}
+	test(scoring, []float64{0.5, 1}, false, false, "")
+	test(scoring, []float64{1, 1.5}, false, false, "YES")
+	test(scoring, []float64{2, 3.5, -0.5}, false, true, "YES")
+	test(scoring, []float64{4, 4, 4}, true, false, "")
+	test(scoringCfg{}, []float64{100}, false, false, "")
+}
+
+func TestMsgPipeline_ScoreStripSpamFields(t *testing.T) {
+	test := func(firstPipeline bool, scores []float64, wantFields map[string][]string) {
+		t.Helper()
+
+		target := testutils.Target{}
+		checks := make([]module.Check, 0, len(scores))
+		for _, score := range scores {
+			checkHdr := textproto.Header{}
+			checkHdr.Add("X-Spam-Flag", "NO")
+			checkHdr.Add("X-Spam-Score", formatScore(score))
+			checks = append(checks, &testutils.Check{
+				BodyRes: module.CheckResult{
+					Reason: errors.New("scored"),
+					Score:  score,
+					Header: checkHdr,
+				},
+			})
+		}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: checks,
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+				scoring: &scoringCfg{addHeader: 5},
+			},
+			Hostname:      "mx.example.org",
+			FirstPipeline: firstPipeline,
+			Log:           testutils.Logger(t, "msgpipeline"),
+		}
+
+		hdr := "X-Spam-Flag: NO\r\n" +
+			"x-spam-status: No, score=-100\r\n" +
+			"X-Maddy-Spam-Score: -100.00\r\n" +
+			"From: <test@example.org>\r\n\r\n"
+		msgMeta := &module.MsgMetadata{
+			ID:   "score",
+			Conn: &module.ConnState{Proto: "ESMTP"},
+		}
+		if _, err := doTestDeliveryMeta(t, &d, "test@example.org", []string{"rcpt@example.com"}, hdr, msgMeta); err != nil {
+			t.Fatal(err)
+		}
+		if len(target.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+		}
+		msg := target.Messages[0]
+
+		for key, want := range wantFields {
+			got := msg.Header.Values(key)
+			if strings.Join(got, "|") != strings.Join(want, "|") {
+				t.Errorf("wrong %s values, want %q, got %q", key, want, got)
+			}
+		}
+	}
+
+	// Fields added by the check are kept, the ones that came with the message
+	// are removed.
+	test(true, []float64{1}, map[string][]string{
+		"X-Spam-Flag":   {"NO"},
+		"X-Spam-Score":  {"1.00"},
+		"X-Spam-Status": nil,
+		scoreField:      {"1.00"},
+	})
+	// Flag is replaced if the total score is above the threshold.
+	test(true, []float64{3, 3}, map[string][]string{
+		"X-Spam-Flag": {"YES"},
+		scoreField:    {"6.00"},
+	})
+	// Message from the previous pipeline is not changed.
+	test(false, []float64{1}, map[string][]string{
+		"X-Spam-Status": {"No, score=-100"},
+		scoreField:      {"1.00", "-100.00"},
+	})
+}
+
+func TestMsgPipeline_SessionScore(t *testing.T) {
+	target := testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{
+				&testutils.Check{
+					BodyRes: module.CheckResult{
+						Reason: errors.New("scored"),
+						Score:  4,
+					},
+				},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+			scoring: &scoringCfg{reject: 10},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	facts := module.NewFacts()
+	facts.Set(module.FactSessionScore, 6.0)
+	_, err := testutils.DoTestDeliveryErrMeta(t, &d, "whatever@whatever", []string{"whatever@whatever"}, &module.MsgMetadata{
+		Facts: facts,
+	})
+	if err == nil {
+		t.Error("session score is not added to the message score")
+	}
+}
+
+func TestMsgPipeline_BodyCheckOnce(t *testing.T) {
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			AuthResult: []authres.Result{
+				&authres.SPFResult{Value: authres.ResultPass, From: "FROM"},
+			},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				checks: []module.Check{&check},
+				perRcpt: map[string]*rcptBlock{
+					"example.org": {
+						checks:  []module.Check{&check},
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					checks:  []module.Check{&check},
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname: "TEST-HOST",
+		Log:      testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "whatever@whatever", []string{"a@example.org", "b@example.org", "c@example.com"})
+
+	if check.BodyCalls != 1 {
+		t.Errorf("CheckBody called %d times, want 1", check.BodyCalls)
+	}
+	// Recipient blocks with their own checks get separate deliveries.
+	if len(target.Messages) != 2 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 2, len(target.Messages))
+	}
+	for _, msg := range target.Messages {
+		_, parsed, err := authres.Parse(msg.Header.Get("Authentication-Results"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parsed) != 1 {
+			t.Errorf("result is added %d times", len(parsed))
+		}
+	}
+	if check.UnclosedStates != 0 {
+		t.Fatalf("check state objects leak or double-closed, alive counter: %v", check.UnclosedStates)
+	}
+}
+
+func TestMsgPipeline_Redirect(t *testing.T) {
+	test := func(checks []module.Check, shouldReject bool) {
+		t.Helper()
+
+		target, reviewTarget := testutils.Target{}, testutils.Target{}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: checks,
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{
+						"review@example.org": {
+							targets: []module.DeliveryTarget{&reviewTarget},
+						},
+					},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+			},
+			Log: testutils.Logger(t, "msgpipeline"),
+		}
+
+		_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+		if shouldReject {
+			if err == nil {
+				t.Error("expected message to be rejected")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if len(target.Messages) != 0 {
+			t.Fatalf("message delivered to the original recipients")
+		}
+		if len(reviewTarget.Messages) != 1 {
+			t.Fatalf("wrong amount of messages redirected, want %d, got %d", 1, len(reviewTarget.Messages))
+		}
+		msg := reviewTarget.Messages[0]
+		if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "review@example.org" {
+			t.Errorf("wrong recipients: %v", msg.RcptTo)
+		}
+		origTo := msg.Header.Values("X-Original-To")
+		if len(origTo) != 2 || origTo[0] != "rcpt1@example.com" || origTo[1] != "rcpt2@example.com" {
+			t.Errorf("wrong X-Original-To fields: %v", origTo)
+		}
+	}
+
+	redirectRes := module.CheckResult{
+		Reason:   errors.New("suspicious"),
+		Redirect: []string{"review@example.org"},
+	}
+
+	t.Run("rcpt check", func(t *testing.T) {
+		test([]module.Check{&testutils.Check{RcptRes: redirectRes}}, false)
+	})
+	t.Run("body check", func(t *testing.T) {
+		test([]module.Check{&testutils.Check{BodyRes: redirectRes}}, false)
+	})
+	t.Run("reject wins", func(t *testing.T) {
+		test([]module.Check{
+			&testutils.Check{BodyRes: redirectRes},
+			&testutils.Check{BodyRes: module.CheckResult{
+				Reason: errors.New("bad"),
+				Reject: true,
+			}},
+		}, true)
+	})
+}
+
+func TestMsgPipeline_Annotate(t *testing.T) {
+	target := testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{
+				&testutils.Check{
+					RcptRes: module.CheckResult{
+						Reason: &exterrors.SMTPError{
+							Message:   "No \"good\" records",
+							CheckName: "spf",
+						},
+						Annotate:       true,
+						AnnotateWeight: 1.5,
+					},
+				},
+				&testutils.Check{
+					BodyRes: module.CheckResult{
+						Reason:         &exterrors.SMTPError{Message: "Bad", CheckName: "dkim"},
+						Annotate:       true,
+						AnnotateWeight: -0.5,
+					},
+				},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Hostname:      "mx.example.org",
+		FirstPipeline: true,
+		Log:           testutils.Logger(t, "msgpipeline"),
+	}
+
+	hdr := "X-Maddy-Annotation: spoofed; weight=100.00\r\n" +
+		"From: <test@example.org>\r\n\r\n"
+	msgMeta := &module.MsgMetadata{
+		ID:   "annotate",
+		Conn: &module.ConnState{Proto: "ESMTP"},
+	}
+	if _, err := doTestDeliveryMeta(t, &d, "test@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"}, hdr, msgMeta); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	msg := target.Messages[0]
+
+	if msg.MsgMeta.Quarantine {
+		t.Error("annotated message is quarantined")
+	}
+	fields := msg.Header.Values("X-Maddy-Annotation")
+	want := []string{
+		"dkim; weight=-0.50; reason=\"Bad\"",
+		"spf; weight=1.50; reason=\"No 'good' records\"",
+	}
+	if len(fields) != len(want) {
+		t.Fatalf("wrong annotation fields: %q", fields)
+	}
+	for i := range want {
+		if fields[i] != want[i] {
+			t.Errorf("wrong annotation field %d, want %q, got %q", i, want[i], fields[i])
+		}
+	}
+
+	if w, _ := msg.MsgMeta.Facts.Float(module.FactAnnotationWeight); w != 1 {
+		t.Errorf("wrong total weight: %v", w)
+	}
+	if w, _ := msg.MsgMeta.Facts.Float(module.FactAnnotationPrefix + "spf"); w != 1.5 {
+		t.Errorf("wrong spf weight: %v", w)
+	}
+}
+
+func TestMsgPipeline_Delay(t *testing.T) {
+	test := func(checks []module.Check, shouldReject bool) {
+		t.Helper()
+
+		target := testutils.Target{}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: checks,
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&target},
+					},
+				},
+			},
+			Log: testutils.Logger(t, "msgpipeline"),
+		}
+
+		start := time.Now()
+		_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt@example.com"})
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("reply is not delayed, elapsed %v", elapsed)
+		}
+		if shouldReject != (err != nil) {
+			t.Errorf("unexpected result: %v", err)
+		}
+	}
+
+	test([]module.Check{&testutils.Check{RcptRes: module.CheckResult{
+		Reason: errors.New("suspicious"),
+		Delay:  50 * time.Millisecond,
+	}}}, false)
+	test([]module.Check{&testutils.Check{BodyRes: module.CheckResult{
+		Reason: errors.New("bad"),
+		Reject: true,
+		Delay:  50 * time.Millisecond,
+	}}}, true)
+}
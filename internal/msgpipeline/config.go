@@ -29,6 +29,8 @@ import (
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/bimi"
+	"github.com/foxcpp/maddy/internal/dmarc/report"
 	"github.com/foxcpp/maddy/internal/modify"
 )
 
@@ -44,6 +46,12 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	dmarcForwarders []string
+	scoring         *scoringCfg
+	mailingList     *mailingListCfg
+	dmarcReports    *report.Reporter
+	doBIMI          bool
+	bimiFetcher     *bimi.Fetcher
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -52,6 +60,7 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 	}
 	var defaultSrcRaw []config.Node
 	var othersRaw []config.Node
+	bimiIndicator := true
 	for _, node := range nodes {
 		switch node.Name {
 		case "check":
@@ -129,6 +138,64 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
+		case "dmarc_trusted_forwarders":
+			if len(node.Args) == 0 {
+				return msgpipelineCfg{}, config.NodeErr(node, "expected at least one domain")
+			}
+			for _, domain := range node.Args {
+				domain, err := dns.ForLookup(domain)
+				if err != nil {
+					return msgpipelineCfg{}, config.NodeErr(node, "invalid domain: %v", err)
+				}
+				cfg.dmarcForwarders = append(cfg.dmarcForwarders, domain)
+			}
+		case "dmarc_reports":
+			if err := modconfig.ModuleFromNode("", node.Args, node, globals, &cfg.dmarcReports); err != nil {
+				return msgpipelineCfg{}, err
+			}
+		case "bimi":
+			switch len(node.Args) {
+			case 1:
+				switch node.Args[0] {
+				case "yes":
+					cfg.doBIMI = true
+				case "no":
+				default:
+					return msgpipelineCfg{}, config.NodeErr(node, "invalid argument for bimi")
+				}
+			case 0:
+				cfg.doBIMI = true
+			}
+		case "bimi_indicator":
+			if len(node.Args) != 1 {
+				return msgpipelineCfg{}, config.NodeErr(node, "expected exactly one argument")
+			}
+			switch node.Args[0] {
+			case "yes":
+				bimiIndicator = true
+			case "no":
+				bimiIndicator = false
+			default:
+				return msgpipelineCfg{}, config.NodeErr(node, "invalid argument for bimi_indicator")
+			}
+		case "score":
+			if cfg.scoring != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'score' block")
+			}
+			scoring, err := parseScoringCfg(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+			cfg.scoring = scoring
+		case "mailing_list":
+			if cfg.mailingList != nil {
+				return msgpipelineCfg{}, config.NodeErr(node, "duplicate 'mailing_list' block")
+			}
+			mailingList, err := parseMailingListCfg(globals, node)
+			if err != nil {
+				return msgpipelineCfg{}, err
+			}
+			cfg.mailingList = mailingList
 		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
@@ -136,6 +203,15 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 		}
 	}
 
+	if cfg.doBIMI {
+		if !cfg.doDMARC {
+			return msgpipelineCfg{}, fmt.Errorf("bimi requires dmarc to be enabled")
+		}
+		if bimiIndicator {
+			cfg.bimiFetcher = bimi.NewFetcher()
+		}
+	}
+
 	if len(cfg.perSource) == 0 && len(defaultSrcRaw) == 0 {
 		if len(othersRaw) == 0 {
 			return msgpipelineCfg{}, fmt.Errorf("empty pipeline configuration, use 'reject' to reject messages")
@@ -227,6 +303,15 @@ func parseMsgPipelineSrcCfg(globals map[string]interface{}, nodes []config.Node)
 				return sourceBlock{}, config.NodeErr(node, "duplicate 'default_destination' block")
 			}
 			defaultRcptRaw = node.Children
+		case "max_recipients":
+			if len(node.Args) != 1 {
+				return sourceBlock{}, config.NodeErr(node, "expected exactly one argument")
+			}
+			maxRcpts, err := strconv.Atoi(node.Args[0])
+			if err != nil || maxRcpts <= 0 {
+				return sourceBlock{}, config.NodeErr(node, "invalid recipients limit: %s", node.Args[0])
+			}
+			src.maxRcpts = maxRcpts
 		case "deliver_to", "reroute", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
@@ -298,6 +383,13 @@ func parseMsgPipelineRcptCfg(globals map[string]interface{}, nodes []config.Node
 			}
 
 			rcpt.targets = append(rcpt.targets, pipeline)
+		case "content":
+			rule, err := parseContentRule(globals, node)
+			if err != nil {
+				return nil, err
+			}
+
+			rcpt.content = append(rcpt.content, rule)
 		case "reject":
 			if len(rcpt.targets) != 0 {
 				return nil, config.NodeErr(node, "can't use 'reject' and 'deliver_to' together")
@@ -312,6 +404,9 @@ func parseMsgPipelineRcptCfg(globals map[string]interface{}, nodes []config.Node
 			return nil, config.NodeErr(node, "invalid directive")
 		}
 	}
+	if len(rcpt.content) != 0 && len(rcpt.targets) == 0 && rcpt.rejectErr == nil {
+		return nil, fmt.Errorf("msgpipeline: deliver_to or reroute is required for messages not matched by 'content' rules")
+	}
 	return &rcpt, nil
 }
 
@@ -320,14 +415,14 @@ func parseRejectDirective(node config.Node) (*exterrors.SMTPError, error) {
 	enchCode := exterrors.EnhancedCode{5, 7, 0}
 	msg := "Message rejected due to a local policy"
 	var err error
-	switch len(node.Args) {
-	case 3:
-		msg = node.Args[2]
-		if msg == "" {
-			return nil, config.NodeErr(node, "message can't be empty")
+	switch {
+	case len(node.Args) >= 3:
+		msg, err = modconfig.JoinReplyLines(node.Args[2:])
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
 		}
 		fallthrough
-	case 2:
+	case len(node.Args) == 2:
 		enchCode, err = parseEnhancedCode(node.Args[1])
 		if err != nil {
 			return nil, config.NodeErr(node, "%v", err)
@@ -336,7 +431,7 @@ func parseRejectDirective(node config.Node) (*exterrors.SMTPError, error) {
 			return nil, config.NodeErr(node, "enhanced code should use either 4 or 5 as a first number")
 		}
 		fallthrough
-	case 1:
+	case len(node.Args) == 1:
 		code, err = strconv.Atoi(node.Args[0])
 		if err != nil {
 			return nil, config.NodeErr(node, "invalid error code integer: %v", err)
@@ -344,9 +439,6 @@ func parseRejectDirective(node config.Node) (*exterrors.SMTPError, error) {
 		if (code/100) != 4 && (code/100) != 5 {
 			return nil, config.NodeErr(node, "error code should start with either 4 or 5")
 		}
-	case 0:
-	default:
-		return nil, config.NodeErr(node, "invalid count of arguments")
 	}
 	return &exterrors.SMTPError{
 		Code:         code,
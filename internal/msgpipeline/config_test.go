@@ -196,6 +196,35 @@ func TestMsgPipelineCfg(t *testing.T) {
 				}`,
 			fail: true,
 		},
+		{
+			name: "multi-line reject message",
+			str: `
+				default_destination {
+					reject 550 5.7.1 "Blocked" "See {support_url}"
+				}`,
+			value: msgpipelineCfg{
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						rejectErr: &exterrors.SMTPError{
+							Message:      "Blocked\nSee {support_url}",
+							Code:         550,
+							EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+							Reason:       "reject directive used",
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "empty reject message line",
+			str: `
+				default_destination {
+					reject 550 5.7.1 "Blocked" ""
+				}`,
+			fail: true,
+		},
 		{
 			name: "destination together with source",
 			str: `
@@ -0,0 +1,304 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/check/attachment"
+)
+
+// contentRule is the 'content' block of the destination block. It selects
+// the delivery targets for the recipient based on the message contents.
+//
+// All conditions of the rule should match.
+type contentRule struct {
+	headers []headerCond
+
+	attachment      bool
+	attachmentTypes []string
+
+	minSize int
+	maxSize int // 0 - unlimited
+
+	block *rcptBlock
+}
+
+type headerCond struct {
+	field string
+	re    *regexp.Regexp
+}
+
+// contentRcpt is the recipient matched by the destination block with
+// 'content' rules. Targets for it are selected once the message body is
+// received.
+type contentRcpt struct {
+	block      *rcptBlock
+	to         string
+	originalTo string
+}
+
+func parseContentRule(globals map[string]interface{}, node config.Node) (*contentRule, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "content: no arguments expected")
+	}
+
+	rule := &contentRule{}
+	conditions := 0
+	var targetNodes []config.Node
+	for _, child := range node.Children {
+		switch child.Name {
+		case "header", "subject":
+			field, pattern := "Subject", ""
+			switch {
+			case child.Name == "subject" && len(child.Args) == 1:
+				pattern = child.Args[0]
+			case child.Name == "header" && len(child.Args) == 2:
+				field, pattern = child.Args[0], child.Args[1]
+			default:
+				return nil, config.NodeErr(child, "wrong amount of arguments")
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, config.NodeErr(child, "%v", err)
+			}
+			rule.headers = append(rule.headers, headerCond{field: field, re: re})
+		case "attachment":
+			rule.attachment = true
+			for _, arg := range child.Args {
+				if _, err := path.Match(arg, ""); err != nil {
+					return nil, config.NodeErr(child, "malformed media type pattern: %s", arg)
+				}
+				rule.attachmentTypes = append(rule.attachmentTypes, strings.ToLower(arg))
+			}
+		case "size":
+			if len(child.Args) != 1 && len(child.Args) != 2 {
+				return nil, config.NodeErr(child, "expected minimum and optionally maximum size")
+			}
+			var err error
+			rule.minSize, err = config.ParseDataSize(child.Args[0])
+			if err != nil {
+				return nil, config.NodeErr(child, "%v", err)
+			}
+			if len(child.Args) == 2 {
+				rule.maxSize, err = config.ParseDataSize(child.Args[1])
+				if err != nil {
+					return nil, config.NodeErr(child, "%v", err)
+				}
+				if rule.maxSize < rule.minSize {
+					return nil, config.NodeErr(child, "maximum size is smaller than minimum")
+				}
+			}
+		case "deliver_to", "reroute", "reject":
+			targetNodes = append(targetNodes, child)
+			continue
+		default:
+			return nil, config.NodeErr(child, "invalid directive")
+		}
+		conditions++
+	}
+	if conditions == 0 {
+		return nil, config.NodeErr(node, "content: at least one condition is required")
+	}
+
+	var err error
+	rule.block, err = parseMsgPipelineRcptCfg(globals, targetNodes)
+	if err != nil {
+		return nil, err
+	}
+	if len(rule.block.targets) == 0 && rule.block.rejectErr == nil {
+		return nil, config.NodeErr(node, "content: deliver_to, reroute or reject is required")
+	}
+	return rule, nil
+}
+
+// msgContent provides message properties used by content rules. Expensive
+// ones are computed once when needed.
+type msgContent struct {
+	header textproto.Header
+	body   buffer.Buffer
+
+	size int
+
+	scanned     bool
+	attachments []string // media types
+}
+
+func (c *msgContent) messageSize() int {
+	if c.size == 0 {
+		var hdr strings.Builder
+		_ = textproto.WriteHeader(&hdr, c.header)
+		c.size = hdr.Len() + c.body.Len()
+	}
+	return c.size
+}
+
+func (c *msgContent) attachmentTypes() ([]string, error) {
+	if c.scanned {
+		return c.attachments, nil
+	}
+	c.scanned = true
+
+	r, err := c.body.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entity, err := message.New(message.Header{Header: c.header}, r)
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		// Malformed messages are considered to have no attachments.
+		return nil, nil
+	}
+
+	// Walk errors are ignored for the same reason.
+	_ = entity.Walk(func(_ []int, part *message.Entity, err error) error {
+		if err != nil || part.MultipartReader() != nil {
+			return nil
+		}
+		disp, _, _ := part.Header.ContentDisposition()
+		if !strings.EqualFold(disp, "attachment") && attachment.PartFileName(part.Header) == "" {
+			return nil
+		}
+		mediaType, _, err := part.Header.ContentType()
+		if err != nil {
+			mediaType = "application/octet-stream"
+		}
+		c.attachments = append(c.attachments, strings.ToLower(mediaType))
+		return nil
+	})
+	return c.attachments, nil
+}
+
+func (r *contentRule) match(c *msgContent) (bool, error) {
+	for _, cond := range r.headers {
+		matched := false
+		for _, value := range c.header.Values(cond.field) {
+			if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			if cond.re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if r.minSize != 0 || r.maxSize != 0 {
+		size := c.messageSize()
+		if size < r.minSize || (r.maxSize != 0 && size > r.maxSize) {
+			return false, nil
+		}
+	}
+
+	if r.attachment {
+		types, err := c.attachmentTypes()
+		if err != nil {
+			return false, err
+		}
+		if !matchAnyType(types, r.attachmentTypes) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func matchAnyType(types, patterns []string) bool {
+	for _, t := range types {
+		if len(patterns) == 0 {
+			return true
+		}
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, t); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// routeByContent starts deliveries for recipients matched by destination
+// blocks with 'content' rules. The first matching rule is used, targets of
+// the destination block itself are used if none matches.
+//
+// It is called after modifiers are applied so rules see the message as it
+// will be delivered.
+func (dd *msgpipelineDelivery) routeByContent(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if len(dd.contentRcpts) == 0 {
+		return nil
+	}
+
+	content := &msgContent{header: header, body: body}
+	for _, rcpt := range dd.contentRcpts {
+		block := rcpt.block
+		for i, rule := range rcpt.block.content {
+			ok, err := rule.match(content)
+			if err != nil {
+				return err
+			}
+			if ok {
+				dd.log.Debugf("recipient %s matched by content rule %d", rcpt.to, i+1)
+				block = rule.block
+				break
+			}
+		}
+
+		wrapErr := func(err error) error {
+			return exterrors.WithFields(err, map[string]interface{}{
+				"effective_rcpt": rcpt.to,
+			})
+		}
+		if block.rejectErr != nil {
+			return wrapErr(block.rejectErr)
+		}
+
+		for _, tgt := range block.targets {
+			wrapErr := wrapErr
+			if _, ok := tgt.(*MsgPipeline); ok {
+				wrapErr = func(err error) error { return err }
+			}
+
+			// Checks of the block selected by RCPT TO are the ones that
+			// were run for the recipient.
+			delivery, err := dd.getDelivery(ctx, tgt, rcpt.block)
+			if err != nil {
+				return wrapErr(err)
+			}
+			if err := delivery.AddRcpt(ctx, rcpt.to); err != nil {
+				return wrapErr(err)
+			}
+			delivery.recipients = append(delivery.recipients, rcpt.originalTo)
+		}
+	}
+	dd.contentRcpts = nil
+	return nil
+}
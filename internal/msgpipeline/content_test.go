@@ -0,0 +1,230 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"bufio"
+	"context"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+const invoiceMsg = "Subject: =?utf-8?q?Invoice_=E2=84=96_42?=\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=invoice.pdf\r\n" +
+	"\r\n" +
+	"%PDF-1.4\r\n" +
+	"--b--\r\n"
+
+const plainMsg = "Subject: Invoice question\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello.\r\n"
+
+func readTestMsg(t *testing.T, msg string) (textproto.Header, buffer.Buffer) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(msg))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := buffer.BufferInMemory(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hdr, body
+}
+
+func deliverTestMsg(t *testing.T, tgt module.DeliveryTarget, to []string, msg string) error {
+	t.Helper()
+	hdr, body := readTestMsg(t, msg)
+
+	ctx := context.Background()
+	msgMeta := &module.MsgMetadata{ID: "testing", OriginalRcpts: map[string]string{}}
+	delivery, err := tgt.Start(ctx, msgMeta, "sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range to {
+		if err := delivery.AddRcpt(ctx, rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := delivery.Body(ctx, hdr, body); err != nil {
+		if err := delivery.Abort(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func TestContentRule_Match(t *testing.T) {
+	test := func(rule contentRule, msg string, expected bool) {
+		t.Helper()
+		hdr, body := readTestMsg(t, msg)
+		matched, err := rule.match(&msgContent{header: hdr, body: body})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matched != expected {
+			t.Errorf("match = %v, want %v", matched, expected)
+		}
+	}
+	subject := func(re string) []headerCond {
+		return []headerCond{{field: "Subject", re: regexp.MustCompile(re)}}
+	}
+
+	test(contentRule{headers: subject("^Invoice №")}, invoiceMsg, true)
+	test(contentRule{headers: subject("^Invoice №")}, plainMsg, false)
+	test(contentRule{headers: []headerCond{{field: "X-Missing", re: regexp.MustCompile("")}}}, plainMsg, false)
+	test(contentRule{attachment: true}, invoiceMsg, true)
+	test(contentRule{attachment: true}, plainMsg, false)
+	test(contentRule{attachment: true, attachmentTypes: []string{"application/pdf"}}, invoiceMsg, true)
+	test(contentRule{attachment: true, attachmentTypes: []string{"image/*"}}, invoiceMsg, false)
+	test(contentRule{headers: subject("Invoice"), attachment: true}, plainMsg, false)
+	test(contentRule{minSize: 100}, plainMsg, false)
+	test(contentRule{minSize: 10, maxSize: 100}, plainMsg, true)
+	test(contentRule{maxSize: 100}, invoiceMsg, false)
+}
+
+func TestContentRule_Parse(t *testing.T) {
+	test := func(cfg string, fail bool) {
+		t.Helper()
+		nodes, err := parser.Read(strings.NewReader(cfg), "literal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseMsgPipelineRcptCfg(nil, nodes)
+		if fail && err == nil {
+			t.Errorf("%s: expected an error", cfg)
+		}
+		if !fail && err != nil {
+			t.Errorf("%s: unexpected error: %v", cfg, err)
+		}
+	}
+
+	test(`content {
+		subject "(?i)invoice"
+		header X-Mailer "^Billing"
+		attachment application/pdf image/*
+		size 1K 10M
+		reject 550 5.7.1 "No invoices"
+	}
+	reject`, false)
+	test(`content {
+		reject
+	}
+	reject`, true)
+	test(`content {
+		subject "("
+		reject
+	}
+	reject`, true)
+	test(`content {
+		size 10M 1K
+		reject
+	}
+	reject`, true)
+	test(`content {
+		subject invoice
+	}
+	reject`, true)
+	test(`content {
+		subject invoice
+		modify {}
+		reject
+	}
+	reject`, true)
+	test(`content {
+		subject invoice
+		reject
+	}`, true)
+}
+
+func TestMsgPipeline_ContentRouting(t *testing.T) {
+	accounting := testutils.Target{InstName: "accounting"}
+	generic := testutils.Target{InstName: "generic"}
+	other := testutils.Target{InstName: "other"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{
+					"invoices@example.org": {
+						targets: []module.DeliveryTarget{&generic},
+						content: []*contentRule{
+							{
+								attachment:      true,
+								attachmentTypes: []string{"application/pdf"},
+								block: &rcptBlock{
+									targets: []module.DeliveryTarget{&accounting},
+								},
+							},
+						},
+					},
+				},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&other},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	if err := deliverTestMsg(t, &d, []string{"invoices@example.org", "rcpt@example.org"}, invoiceMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := deliverTestMsg(t, &d, []string{"invoices@example.org"}, plainMsg); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(tgt *testutils.Target, rcpt, subject string) {
+		t.Helper()
+		if len(tgt.Messages) != 1 {
+			t.Fatalf("%s: want 1 message, got %d", tgt.InstName, len(tgt.Messages))
+		}
+		msg := tgt.Messages[0]
+		if !reflect.DeepEqual(msg.RcptTo, []string{rcpt}) {
+			t.Errorf("%s: wrong recipients: %v", tgt.InstName, msg.RcptTo)
+		}
+		if msg.Header.Get("Subject") != subject {
+			t.Errorf("%s: wrong message delivered: %s", tgt.InstName, msg.Header.Get("Subject"))
+		}
+	}
+	invoiceSubject := "=?utf-8?q?Invoice_=E2=84=96_42?="
+	check(&accounting, "invoices@example.org", invoiceSubject)
+	check(&generic, "invoices@example.org", "Invoice question")
+	check(&other, "rcpt@example.org", invoiceSubject)
+}
@@ -43,18 +43,24 @@ func doTestDelivery(t *testing.T, tgt module.DeliveryTarget, from string, to []s
 	IDRaw := sha1.Sum([]byte(t.Name()))
 	encodedID := hex.EncodeToString(IDRaw[:])
 
-	body := buffer.MemoryBuffer{Slice: []byte("foobar")}
-	ctx := module.MsgMetadata{
+	return doTestDeliveryMeta(t, tgt, from, to, hdr, &module.MsgMetadata{
 		DontTraceSender: true,
 		ID:              encodedID,
-	}
+	})
+}
+
+func doTestDeliveryMeta(t *testing.T, tgt module.DeliveryTarget, from string, to []string, hdr string, msgMeta *module.MsgMetadata) (string, error) {
+	t.Helper()
+
+	encodedID := msgMeta.ID
+	body := buffer.MemoryBuffer{Slice: []byte("foobar")}
 
 	hdrParsed, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(hdr)))
 	if err != nil {
 		panic(err)
 	}
 
-	delivery, err := tgt.Start(context.Background(), &ctx, from)
+	delivery, err := tgt.Start(context.Background(), msgMeta, from)
 	if err != nil {
 		return encodedID, err
 	}
@@ -221,3 +227,127 @@ func TestDMARC(t *testing.T) {
 		&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
 	}, false, true, authres.ResultFail)
 }
+
+func TestDMARC_TrustedForwarder(t *testing.T) {
+	// Sealed by lists.example.net using the Ed25519 key with all seed bytes
+	// set to 1.
+	const hdr = "ARC-Seal: i=1; a=ed25519-sha256; cv=none; d=lists.example.net; s=sel; b=RpZcti/szzWOo9EYKH8BrPjcmTptknPueLhzhEgW9t7UN+WPkD3L5dBnXKl7DARY8ssOPztLnWDOcPNgDg8JBQ==\r\n" +
+		"ARC-Message-Signature: i=1; a=ed25519-sha256; c=relaxed/relaxed; d=lists.example.net; s=sel;\r\n" +
+		" h=From:Subject; bh=e/D3HyFx1VjJ1nyCC/+peRnWJ5samzUsxgHXVU3wd+k=; b=viI4wm79gQf5YVZHMjzSzWLR1pZEx0o7IFsJ5kZueoRCf0B1XIiInoq6Bc8+m2Dtm7LF3VRmASKvj2t0evtGDQ==\r\n" +
+		"ARC-Authentication-Results: i=1; lists.example.net; spf=pass smtp.mailfrom=example.org\r\n" +
+		"From: hello@example.com\r\n\r\n"
+
+	test := func(forwarders []string, reject bool) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		p := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{
+					&testutils.Check{
+						BodyRes: module.CheckResult{
+							AuthResult: []authres.Result{
+								&authres.DKIMResult{Value: authres.ResultPass, Domain: "lists.example.net"},
+								&authres.SPFResult{Value: authres.ResultPass, From: "lists.example.net"},
+							},
+						},
+					},
+				},
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				doDMARC:         true,
+				dmarcForwarders: forwarders,
+			},
+			Log: testutils.Logger(t, "pipeline"),
+			Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"_dmarc.example.com.": {
+					TXT: []string{"v=DMARC1; p=reject"},
+				},
+				"sel._domainkey.lists.example.net.": {
+					TXT: []string{"v=DKIM1; k=ed25519; p=iojj3XQJ8ZX9UtstPLpdcspnCb8dlBIb83SIAbQPb1w="},
+				},
+			}},
+		}
+
+		_, err := doTestDelivery(t, &p, "test@lists.example.net", []string{"test@example.org"}, hdr)
+		if reject {
+			if err == nil {
+				t.Error("expected message to be rejected")
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %v %+v", err, exterrors.Fields(err))
+			return
+		}
+		if res := dmarcResult(t, tgt.Messages[0].Header); res != authres.ResultFail {
+			t.Errorf("expected DMARC result to be 'fail', got '%v'", res)
+		}
+	}
+
+	test(nil, true)
+	test([]string{"other.example.net"}, true)
+	test([]string{"lists.example.net"}, false)
+}
+
+func TestBIMI(t *testing.T) {
+	test := func(policy string, hdr string, location string) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		p := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{
+					&testutils.Check{
+						BodyRes: module.CheckResult{
+							AuthResult: []authres.Result{
+								&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.org"},
+								&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
+							},
+						},
+					},
+				},
+				perSource: map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+				doDMARC: true,
+				doBIMI:  true,
+			},
+			Log: testutils.Logger(t, "pipeline"),
+			Resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+				"_dmarc.example.org.": {
+					TXT: []string{"v=DMARC1; p=" + policy},
+				},
+				"default._bimi.example.org.": {
+					TXT: []string{"v=BIMI1; l=https://example.org/logo.svg"},
+				},
+			}},
+		}
+
+		_, err := doTestDelivery(t, &p, "test@example.org", []string{"test@example.com"}, hdr)
+		if err != nil {
+			t.Fatalf("unexpected error: %v %+v", err, exterrors.Fields(err))
+		}
+		msgHdr := tgt.Messages[0].Header
+		if got := msgHdr.Get("BIMI-Location"); got != location {
+			t.Errorf("expected BIMI-Location to be %q, got %q", location, got)
+		}
+		if msgHdr.Has("BIMI-Indicator") {
+			t.Error("client-supplied BIMI-Indicator is not removed")
+		}
+	}
+
+	test("reject", "From: hello@example.org\r\n\r\n", "v=BIMI1; l=https://example.org/logo.svg")
+	test("reject", "BIMI-Location: v=BIMI1; l=https://evil.example/logo.svg\r\nBIMI-Indicator: AAAA\r\nFrom: hello@example.org\r\n\r\n",
+		"v=BIMI1; l=https://example.org/logo.svg")
+	test("none", "BIMI-Location: v=BIMI1; l=https://evil.example/logo.svg\r\nBIMI-Indicator: AAAA\r\nFrom: hello@example.org\r\n\r\n", "")
+}
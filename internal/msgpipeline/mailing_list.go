@@ -0,0 +1,130 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package msgpipeline
+
+import (
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// defaultListSignatures are header fields that are added only by mailing list
+// software.
+//
+// List-Unsubscribe is not included since it is commonly used by newsletters and
+// other bulk senders.
+var defaultListSignatures = []string{
+	"List-Id",
+	"List-Post",
+	"X-Mailman-Version",
+	"X-BeenThere",
+	"X-Mailing-List",
+	"Mailing-List",
+	"X-Google-Group-Id",
+	"X-Listprocessor-Version",
+}
+
+// mailingListCfg is the policy profile applied to the mailing list traffic.
+type mailingListCfg struct {
+	signatures []string
+
+	// Names of checks whose rejections are waived for mailing list messages.
+	// Since the message header is needed to tell whether the message comes
+	// from the list, rejections from these checks are deferred until the
+	// message body is received.
+	relaxedChecks map[string]struct{}
+
+	// Score thresholds used instead of the pipeline-wide ones, nil if
+	// not changed.
+	scoring *scoringCfg
+}
+
+func parseMailingListCfg(globals map[string]interface{}, node config.Node) (*mailingListCfg, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "mailing_list: no arguments expected")
+	}
+
+	ml := &mailingListCfg{
+		relaxedChecks: map[string]struct{}{},
+	}
+	var relaxed []string
+	cfg := config.NewMap(globals, node)
+	cfg.StringList("signatures", false, false, defaultListSignatures, &ml.signatures)
+	cfg.StringList("relaxed_checks", false, false, nil, &relaxed)
+	cfg.Callback("score", func(m *config.Map, node config.Node) error {
+		if ml.scoring != nil {
+			return config.NodeErr(node, "duplicate 'score' block")
+		}
+		var err error
+		ml.scoring, err = parseScoringCfg(globals, node)
+		return err
+	})
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	for _, name := range relaxed {
+		ml.relaxedChecks[name] = struct{}{}
+	}
+
+	return ml, nil
+}
+
+// isRelaxed checks whether rejections by the check should be waived for the
+// mailing list traffic. The check is matched by the module or instance name.
+func (ml *mailingListCfg) isRelaxed(check module.Check) bool {
+	mod, ok := check.(module.Module)
+	if !ok {
+		return false
+	}
+	if _, ok := ml.relaxedChecks[mod.InstanceName()]; ok {
+		return true
+	}
+	_, ok = ml.relaxedChecks[mod.Name()]
+	return ok
+}
+
+// detect checks whether the message comes from the mailing list.
+//
+// Returned string is the list identifier (List-Id value without the
+// description) if it is known, the name of the matched header field otherwise.
+func (ml *mailingListCfg) detect(header textproto.Header) (string, bool) {
+	if listID := header.Get("List-Id"); listID != "" {
+		// RFC 2919: List-Id: [phrase] <list-label.list-id-namespace>
+		if start := strings.LastIndexByte(listID, '<'); start != -1 {
+			if end := strings.IndexByte(listID[start:], '>'); end != -1 {
+				listID = listID[start+1 : start+end]
+			}
+		}
+		return strings.ToLower(strings.TrimSpace(listID)), true
+	}
+
+	if strings.EqualFold(strings.TrimSpace(header.Get("Precedence")), "list") {
+		return "Precedence", true
+	}
+
+	for _, field := range ml.signatures {
+		if header.Has(field) {
+			return field, true
+		}
+	}
+
+	return "", false
+}
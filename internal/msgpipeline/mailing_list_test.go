@@ -0,0 +1,135 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package msgpipeline
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestMsgPipeline_MailingList(t *testing.T) {
+	test := func(t *testing.T, hdr string, relaxed bool, wantListID string, wantErr bool) {
+		t.Helper()
+
+		tgt := testutils.Target{}
+		check := testutils.Check{
+			InstName: "rdns",
+			ConnRes: module.CheckResult{
+				Reject: true,
+				Reason: &exterrors.SMTPError{Code: 550, Message: "rDNS mismatch"},
+			},
+		}
+		ml := &mailingListCfg{
+			signatures:    defaultListSignatures,
+			relaxedChecks: map[string]struct{}{},
+		}
+		if relaxed {
+			ml.relaxedChecks["rdns"] = struct{}{}
+		}
+		d := MsgPipeline{
+			msgpipelineCfg: msgpipelineCfg{
+				globalChecks: []module.Check{&check},
+				mailingList:  ml,
+				perSource:    map[string]sourceBlock{},
+				defaultSource: sourceBlock{
+					perRcpt: map[string]*rcptBlock{},
+					defaultRcpt: &rcptBlock{
+						targets: []module.DeliveryTarget{&tgt},
+					},
+				},
+			},
+			Log: testutils.Logger(t, "msgpipeline"),
+		}
+
+		_, err := doTestDelivery(t, &d, "list-bounces@example.org", []string{"test@example.com"}, hdr)
+		if (err != nil) != wantErr {
+			t.Fatalf("want err=%v, got %v", wantErr, err)
+		}
+		if wantErr {
+			return
+		}
+		if len(tgt.Messages) != 1 {
+			t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(tgt.Messages))
+		}
+		listID, _ := tgt.Messages[0].MsgMeta.Facts.String(module.FactMailingList)
+		if listID != wantListID {
+			t.Fatalf("want list ID %q, got %q", wantListID, listID)
+		}
+	}
+
+	t.Run("list-id", func(t *testing.T) {
+		test(t, "From: a@example.org\r\nList-Id: Test list <Test.Lists.Example.Org>\r\n\r\n", true, "test.lists.example.org", false)
+	})
+	t.Run("precedence", func(t *testing.T) {
+		test(t, "From: a@example.org\r\nPrecedence: list\r\n\r\n", true, "Precedence", false)
+	})
+	t.Run("signature", func(t *testing.T) {
+		test(t, "From: a@example.org\r\nX-Mailman-Version: 2.1.29\r\n\r\n", true, "X-Mailman-Version", false)
+	})
+	t.Run("not a list", func(t *testing.T) {
+		test(t, "From: a@example.org\r\nPrecedence: bulk\r\n\r\n", true, "", true)
+	})
+	t.Run("not relaxed", func(t *testing.T) {
+		test(t, "From: a@example.org\r\nList-Id: <test.lists.example.org>\r\n\r\n", false, "", true)
+	})
+}
+
+func TestMsgPipeline_MailingListScore(t *testing.T) {
+	tgt := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			Score:  7,
+			Reason: &exterrors.SMTPError{Code: 550, Message: "Looks like spam"},
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			scoring:      &scoringCfg{reject: 5},
+			mailingList: &mailingListCfg{
+				signatures: defaultListSignatures,
+				scoring:    &scoringCfg{quarantine: 5, reject: 10},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&tgt},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	if _, err := doTestDelivery(t, &d, "a@example.org", []string{"test@example.com"}, "From: a@example.org\r\n\r\n"); err == nil {
+		t.Fatal("expected rejection for non-list message")
+	}
+
+	if _, err := doTestDelivery(t, &d, "a@example.org", []string{"test@example.com"}, "From: a@example.org\r\nList-Post: <mailto:list@example.org>\r\n\r\n"); err != nil {
+		t.Fatal("unexpected error for list message:", err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(tgt.Messages))
+	}
+	if !tgt.Messages[0].MsgMeta.Quarantine {
+		t.Fatal("list message is not quarantined")
+	}
+}
@@ -707,3 +707,41 @@ func TestMsgPipeline_RcptModifier_Errors(t *testing.T) {
 			mod.UnclosedStates, globalMod.UnclosedStates, sourceMod.UnclosedStates)
 	}
 }
+
+func TestMsgPipeline_BodyReplacer(t *testing.T) {
+	target := testutils.Target{}
+	mod1, mod2 := testutils.Modifier{
+		InstName: "first_modifier",
+		NewBody:  []byte("first body\r\n"),
+	}, testutils.Modifier{
+		InstName: "second_modifier",
+		NewBody:  []byte("second body\r\n"),
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{mod1},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				modifiers: modify.Group{
+					Modifiers: []module.Modifier{mod2},
+				},
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com"})
+
+	if len(target.Messages) != 1 {
+		t.Fatalf("wrong amount of messages received, want %d, got %d", 1, len(target.Messages))
+	}
+	if body := string(target.Messages[0].Body); body != "second body\r\n" {
+		t.Fatalf("wrong body: %q", body)
+	}
+}
@@ -20,6 +20,7 @@ package msgpipeline
 
 import (
 	"context"
+	"net"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -76,6 +77,10 @@ type sourceBlock struct {
 	rcptIn      []rcptIn
 	perRcpt     map[string]*rcptBlock
 	defaultRcpt *rcptBlock
+
+	// maxRcpts is the max. amount of recipients per message, zero means no
+	// limit.
+	maxRcpts int
 }
 
 type rcptBlock struct {
@@ -83,6 +88,10 @@ type rcptBlock struct {
 	modifiers modify.Group
 	rejectErr error
 	targets   []module.DeliveryTarget
+
+	// If not empty, targets are selected when the message body is received,
+	// see routeByContent.
+	content []*contentRule
 }
 
 func New(globals map[string]interface{}, cfg []config.Node) (*MsgPipeline, error) {
@@ -111,6 +120,24 @@ func (d *MsgPipeline) RunEarlyChecks(ctx context.Context, state *smtp.Connection
 	return eg.Wait()
 }
 
+// RunConnectChecks runs global checks implementing module.ConnectCheck. It
+// should be called before the greeting is sent to the client.
+func (d *MsgPipeline) RunConnectChecks(ctx context.Context, remoteAddr net.Addr) error {
+	eg, checkCtx := errgroup.WithContext(ctx)
+
+	for _, check := range d.globalChecks {
+		connectCheck, ok := check.(module.ConnectCheck)
+		if !ok {
+			continue
+		}
+
+		eg.Go(func() error {
+			return connectCheck.CheckConnect(checkCtx, remoteAddr)
+		})
+	}
+	return eg.Wait()
+}
+
 // Start starts new message delivery, runs connection and sender checks, sender modifiers
 // and selects source block from config to use for handling.
 //
@@ -121,16 +148,26 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 	dd := msgpipelineDelivery{
 		d:                  d,
 		rcptModifiersState: make(map[*rcptBlock]module.ModifierState),
-		deliveries:         make(map[module.DeliveryTarget]*delivery),
+		deliveries:         make(map[deliveryKey]*delivery),
 		msgMeta:            msgMeta,
 		log:                target.DeliveryLogger(d.Log, msgMeta),
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.dmarcForwarders = d.dmarcForwarders
+	dd.checkRunner.scoring = d.scoring
+	dd.checkRunner.firstPipeline = d.FirstPipeline
+	dd.checkRunner.mailingList = d.mailingList
+	dd.checkRunner.dmarcReports = d.dmarcReports
+	dd.checkRunner.doBIMI = d.doBIMI
+	dd.checkRunner.bimiFetcher = d.bimiFetcher
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
 	}
+	if msgMeta.Facts == nil {
+		msgMeta.Facts = module.NewFacts()
+	}
 
 	if err := dd.start(ctx, msgMeta, mailFrom); err != nil {
 		dd.close()
@@ -260,6 +297,16 @@ type delivery struct {
 	recipients []string
 }
 
+// deliveryKey identifies the delivery object for the target.
+//
+// Recipients from blocks that have their own checks get separate delivery
+// objects (block is set) so body check rejection by such block can be
+// reported only for its recipients in BodyNonAtomic.
+type deliveryKey struct {
+	target module.DeliveryTarget
+	block  *rcptBlock
+}
+
 type msgpipelineDelivery struct {
 	d *MsgPipeline
 
@@ -272,12 +319,36 @@ type msgpipelineDelivery struct {
 	sourceAddr  string
 	sourceBlock sourceBlock
 
-	deliveries  map[module.DeliveryTarget]*delivery
+	deliveries  map[deliveryKey]*delivery
 	msgMeta     *module.MsgMetadata
 	checkRunner *checkRunner
+	rcptCount   int
+
+	// Original addresses of accepted recipients, used to report delivery
+	// status if the message is redirected by a check.
+	rcpts      []string
+	redirected bool
+
+	// Recipients waiting for routeByContent.
+	contentRcpts []contentRcpt
+
+	// Body buffers created by modifiers, removed once the delivery is
+	// finished.
+	replacedBodies []buffer.Buffer
 }
 
 func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
+	if dd.sourceBlock.maxRcpts != 0 && dd.rcptCount >= dd.sourceBlock.maxRcpts {
+		return &exterrors.SMTPError{
+			Code:         452,
+			EnhancedCode: exterrors.EnhancedCode{4, 5, 3},
+			Message:      "Too many recipients",
+			Misc: map[string]interface{}{
+				"max_recipients": dd.sourceBlock.maxRcpts,
+			},
+		}
+	}
+
 	if err := dd.checkRunner.checkRcpt(ctx, dd.d.globalChecks, to); err != nil {
 		return err
 	}
@@ -342,6 +413,17 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 		dd.msgMeta.OriginalRcpts[to] = originalTo
 	}
 
+	if len(rcptBlock.content) != 0 {
+		dd.contentRcpts = append(dd.contentRcpts, contentRcpt{
+			block:      rcptBlock,
+			to:         to,
+			originalTo: originalTo,
+		})
+		dd.rcpts = append(dd.rcpts, originalTo)
+		dd.rcptCount++
+		return nil
+	}
+
 	for _, tgt := range rcptBlock.targets {
 		// Do not wrap errors coming from nested pipeline target delivery since
 		// that pipeline itself will insert effective_rcpt field and could do
@@ -352,7 +434,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 			wrapErr = func(err error) error { return err }
 		}
 
-		delivery, err := dd.getDelivery(ctx, tgt)
+		delivery, err := dd.getDelivery(ctx, tgt, rcptBlock)
 		if err != nil {
 			return wrapErr(err)
 		}
@@ -363,19 +445,48 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string) error {
 		delivery.recipients = append(delivery.recipients, originalTo)
 	}
 
+	dd.rcpts = append(dd.rcpts, originalTo)
+	dd.rcptCount++
 	return nil
 }
 
 func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
-	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
+	body, err := dd.processBody(ctx, &header, body, nil)
+	if err != nil {
 		return err
 	}
-	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
-		return err
+
+	for _, delivery := range dd.deliveries {
+		if err := delivery.Body(ctx, header, body); err != nil {
+			return err
+		}
+		dd.log.Debugf("delivery.Body ok, Delivery object = %T", delivery)
+	}
+	return nil
+}
+
+// processBody does all per-message work: runs body checks from all blocks
+// selected for the message, applies their results and runs modifiers. It
+// returns the body buffer that should be passed to delivery targets.
+//
+// It is done once for the message, regardless of the amount of recipients
+// and delivery targets.
+//
+// If rejectBlock is not nil, it is called for recipient blocks rejected by
+// their body checks instead of failing the whole message.
+func (dd *msgpipelineDelivery) processBody(ctx context.Context, header *textproto.Header, body buffer.Buffer, rejectBlock func(*rcptBlock, error)) (buffer.Buffer, error) {
+	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, *header, body); err != nil {
+		return nil, err
+	}
+	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, *header, body); err != nil {
+		return nil, err
 	}
 	for blk := range dd.rcptModifiersState {
-		if err := dd.checkRunner.checkBody(ctx, blk.checks, header, body); err != nil {
-			return err
+		if err := dd.checkRunner.checkBody(ctx, blk.checks, *header, body); err != nil {
+			if rejectBlock == nil {
+				return nil, err
+			}
+			rejectBlock(blk, err)
 		}
 	}
 
@@ -386,36 +497,65 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 		// per recommendation in RFC 7001, Section 4 (see GH issue #135).
 		received, err := target.GenerateReceived(ctx, dd.msgMeta, dd.d.Hostname, dd.msgMeta.OriginalFrom)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		header.Add("Received", received)
+
+		// Only annotations added by this server can be trusted.
+		header.Del(annotationField)
 	}
 
-	if err := dd.checkRunner.applyResults(dd.d.Hostname, &header); err != nil {
-		return err
+	if err := dd.checkRunner.applyResults(ctx, dd.d.Hostname, header); err != nil {
+		return nil, err
+	}
+
+	if redirectTo := dd.checkRunner.mergedRes.Redirect; len(redirectTo) != 0 {
+		if err := dd.redirect(ctx, header, redirectTo); err != nil {
+			return nil, err
+		}
 	}
 
 	// Run modifiers after Authentication-Results addition to make
 	// sure signatures, etc will cover it.
-	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
-		return err
+	body, err := dd.rewriteBody(ctx, header, body)
+	if err != nil {
+		return nil, err
 	}
-	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
-		return err
+
+	if err := dd.routeByContent(ctx, *header, body); err != nil {
+		return nil, err
 	}
+	return body, nil
+}
+
+// rewriteBody runs all modifiers on the message header and body and returns
+// the body buffer that should be passed to delivery targets.
+func (dd *msgpipelineDelivery) rewriteBody(ctx context.Context, header *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	states := make([]module.ModifierState, 0, 2+len(dd.rcptModifiersState))
+	states = append(states, dd.globalModifiersState, dd.sourceModifiersState)
 	for _, modifiers := range dd.rcptModifiersState {
-		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
-			return err
+		states = append(states, modifiers)
+	}
+
+	for _, state := range states {
+		newBody, err := module.ReplaceBody(ctx, state, header, body)
+		if err != nil {
+			return nil, err
+		}
+		if newBody != nil {
+			dd.replacedBodies = append(dd.replacedBodies, newBody)
+			body = newBody
 		}
 	}
+	return body, nil
+}
 
-	for _, delivery := range dd.deliveries {
-		if err := delivery.Body(ctx, header, body); err != nil {
-			return err
+func (dd msgpipelineDelivery) removeReplacedBodies() {
+	for _, body := range dd.replacedBodies {
+		if err := body.Remove(); err != nil {
+			dd.log.Error("failed to remove the body buffer", err)
 		}
-		dd.log.Debugf("delivery.Body ok, Delivery object = %T", delivery)
 	}
-	return nil
 }
 
 // statusCollector wraps StatusCollector and adds reverse translation
@@ -441,42 +581,40 @@ func (sc statusCollector) SetStatus(rcptTo string, err error) {
 
 func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, body buffer.Buffer) {
 	setStatusAll := func(err error) {
-		for _, delivery := range dd.deliveries {
-			for _, rcpt := range delivery.recipients {
-				c.SetStatus(rcpt, err)
-			}
+		// dd.rcpts also includes recipients that are not passed to any
+		// target yet (see routeByContent).
+		for _, rcpt := range dd.rcpts {
+			c.SetStatus(rcpt, err)
 		}
 	}
 
-	if err := dd.checkRunner.checkBody(ctx, dd.d.globalChecks, header, body); err != nil {
-		setStatusAll(err)
-		return
-	}
-	if err := dd.checkRunner.checkBody(ctx, dd.sourceBlock.checks, header, body); err != nil {
+	rejected := make(map[*rcptBlock]error)
+	body, err := dd.processBody(ctx, &header, body, func(blk *rcptBlock, err error) {
+		rejected[blk] = err
+	})
+	if err != nil {
 		setStatusAll(err)
 		return
 	}
 
-	// Run modifiers after Authentication-Results addition to make
-	// sure signatures, etc will cover it.
-	if err := dd.globalModifiersState.RewriteBody(ctx, &header, body); err != nil {
-		setStatusAll(err)
-		return
-	}
-	if err := dd.sourceModifiersState.RewriteBody(ctx, &header, body); err != nil {
-		setStatusAll(err)
-		return
-	}
-	for _, modifiers := range dd.rcptModifiersState {
-		if err := modifiers.RewriteBody(ctx, &header, body); err != nil {
-			setStatusAll(err)
-			return
+	for key, delivery := range dd.deliveries {
+		// Recipients from blocks rejected by their own body checks fail
+		// without affecting other recipients.
+		if err, ok := rejected[key.block]; ok && key.block != nil {
+			for _, rcpt := range delivery.recipients {
+				c.SetStatus(rcpt, err)
+			}
+			if err := delivery.Abort(ctx); err != nil {
+				dd.log.Error("delivery.Abort failure", err, "target", objectName(key.target))
+			}
+			delete(dd.deliveries, key)
+			continue
 		}
-	}
 
-	for _, delivery := range dd.deliveries {
+		// Statuses reported by the target for redirection addresses can't be
+		// mapped to the original recipients.
 		partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
-		if ok {
+		if ok && !dd.redirected {
 			partDelivery.BodyNonAtomic(ctx, statusCollector{
 				originalRcpts: dd.msgMeta.OriginalRcpts,
 				wrapped:       c,
@@ -494,6 +632,7 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 
 func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
 	dd.close()
+	defer dd.removeReplacedBodies()
 
 	for _, delivery := range dd.deliveries {
 		if err := delivery.Commit(ctx); err != nil {
@@ -520,6 +659,7 @@ func (dd *msgpipelineDelivery) close() {
 
 func (dd msgpipelineDelivery) Abort(ctx context.Context) error {
 	dd.close()
+	defer dd.removeReplacedBodies()
 
 	var lastErr error
 	for _, delivery := range dd.deliveries {
@@ -607,8 +747,14 @@ func (dd *msgpipelineDelivery) getRcptModifiers(ctx context.Context, rcptBlock *
 	return rcptModifiersState, nil
 }
 
-func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.DeliveryTarget) (*delivery, error) {
-	delivery_, ok := dd.deliveries[tgt]
+// getDelivery returns the delivery object for the target that is used for
+// recipients from the block, starting it if necessary.
+func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.DeliveryTarget, block *rcptBlock) (*delivery, error) {
+	key := deliveryKey{target: tgt}
+	if len(block.checks) != 0 {
+		key.block = block
+	}
+	delivery_, ok := dd.deliveries[key]
 	if ok {
 		return delivery_, nil
 	}
@@ -622,7 +768,7 @@ func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.Deliv
 
 	dd.log.Debugf("tgt.Start(%s) ok, target = %s", dd.sourceAddr, objectName(tgt))
 
-	dd.deliveries[tgt] = delivery_
+	dd.deliveries[key] = delivery_
 	return delivery_, nil
 }
 
@@ -25,6 +25,7 @@ import (
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/testutils"
 )
@@ -389,6 +390,33 @@ func TestMsgPipeline_PerSourceReject(t *testing.T) {
 	}
 }
 
+func TestMsgPipeline_SourceMaxRcpts(t *testing.T) {
+	target := testutils.Target{}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+				maxRcpts: 2,
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+
+	_, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com", "rcpt3@example.com"})
+	if err == nil {
+		t.Fatal("expected error for delivery.AddRcpt, got nil")
+	}
+	if code, _ := exterrors.Fields(err)["smtp_code"].(int); code != 452 {
+		t.Fatal("wrong SMTP code:", code)
+	}
+}
+
 func TestMsgPipeline_PerRcptReject(t *testing.T) {
 	target := testutils.Target{}
 	d := MsgPipeline{
@@ -0,0 +1,99 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"context"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// redirect aborts deliveries started for the message recipients and
+// delivers the message to the addresses specified by the 'redirect' check
+// action instead.
+//
+// Redirection addresses are routed using the same source block as the
+// original recipients, but recipient checks are not executed for them.
+// Original recipients are recorded in X-Original-To fields so the message
+// can be released from the review mailbox.
+func (dd *msgpipelineDelivery) redirect(ctx context.Context, header *textproto.Header, to []string) error {
+	for key, delivery := range dd.deliveries {
+		if err := delivery.Abort(ctx); err != nil {
+			dd.log.Error("delivery.Abort failure", err, "target", objectName(key.target))
+		}
+		delete(dd.deliveries, key)
+	}
+	dd.redirected = true
+	dd.contentRcpts = nil
+
+	// Add prepends the field, so iterate backwards to keep the recipients
+	// order.
+	for i := len(dd.rcpts) - 1; i >= 0; i-- {
+		header.Add("X-Original-To", dd.rcpts[i])
+	}
+
+	for _, rcpt := range to {
+		if err := dd.addRedirectRcpt(ctx, rcpt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dd *msgpipelineDelivery) addRedirectRcpt(ctx context.Context, to string) error {
+	to, err := dd.globalModifiersState.RewriteRcpt(ctx, to)
+	if err != nil {
+		return err
+	}
+	to, err = dd.sourceModifiersState.RewriteRcpt(ctx, to)
+	if err != nil {
+		return err
+	}
+
+	rcptBlock, err := dd.rcptBlockForAddr(ctx, to)
+	if err != nil {
+		return err
+	}
+	if rcptBlock.rejectErr != nil {
+		return rcptBlock.rejectErr
+	}
+
+	rcptModifiersState, err := dd.getRcptModifiers(ctx, rcptBlock, to)
+	if err != nil {
+		return err
+	}
+	to, err = rcptModifiersState.RewriteRcpt(ctx, to)
+	if err != nil {
+		return err
+	}
+	dd.log.Debugln("redirecting message to", to)
+
+	for _, tgt := range rcptBlock.targets {
+		delivery, err := dd.getDelivery(ctx, tgt, rcptBlock)
+		if err != nil {
+			return err
+		}
+		if err := delivery.AddRcpt(ctx, to); err != nil {
+			return err
+		}
+		// Delivery status is reported for all original recipients.
+		delivery.recipients = dd.rcpts
+	}
+	return nil
+}
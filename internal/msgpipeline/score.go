@@ -0,0 +1,120 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// scoreField is the header field used to record the total message score. It
+// is distinct from X-Spam-Score added by spamc and rspamd checks, which
+// contains the score assigned by the scanner alone.
+const scoreField = "X-Maddy-Spam-Score"
+
+// scoringCfg contains thresholds for the total message score collected from
+// checks using 'score' action.
+//
+// Zero threshold value means the corresponding action is disabled.
+type scoringCfg struct {
+	addHeader  float64
+	quarantine float64
+	reject     float64
+}
+
+func parseScoringCfg(globals map[string]interface{}, node config.Node) (*scoringCfg, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "score: no arguments expected")
+	}
+
+	scoring := &scoringCfg{}
+	cfg := config.NewMap(globals, node)
+	cfg.Float("add_header", false, false, 0, &scoring.addHeader)
+	cfg.Float("quarantine", false, false, 0, &scoring.quarantine)
+	cfg.Float("reject", false, false, 0, &scoring.reject)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+
+	return scoring, nil
+}
+
+func thresholdReached(score, threshold float64) bool {
+	return threshold != 0 && score >= threshold
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'f', 2, 64)
+}
+
+// stripSpamFields removes X-Spam-* fields and the total score field from the
+// message header. Fields added by other servers can't be trusted and would be
+// confused with the ones added by this server.
+func stripSpamFields(header *textproto.Header) {
+	for f := header.Fields(); f.Next(); {
+		key := strings.ToLower(f.Key())
+		if strings.HasPrefix(key, "x-spam-") || key == strings.ToLower(scoreField) {
+			f.Del()
+		}
+	}
+}
+
+// applyScore takes actions configured for the total message score.
+func (cr *checkRunner) applyScore(scoring *scoringCfg, header *textproto.Header) error {
+	score := cr.mergedRes.Score
+	cr.msgMeta.Facts.Set(module.FactSpamScore, score)
+
+	if thresholdReached(score, scoring.reject) {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected due to a high spam score",
+			CheckName:    "score",
+			Misc: map[string]interface{}{
+				"score":     score,
+				"threshold": scoring.reject,
+			},
+		}
+	}
+	if thresholdReached(score, scoring.quarantine) {
+		cr.msgMeta.Quarantine = true
+
+		// Mimick the message structure for regular checks.
+		cr.log.Msg("quarantined", "score", score, "check", "score")
+	}
+
+	if cr.firstPipeline {
+		stripSpamFields(header)
+	}
+
+	header.Add(scoreField, formatScore(score))
+	if thresholdReached(score, scoring.addHeader) {
+		// Total score takes precedence over the verdict of a single
+		// scanner.
+		cr.mergedRes.Header.Del("X-Spam-Flag")
+		header.Add("X-Spam-Flag", "YES")
+	}
+
+	return nil
+}
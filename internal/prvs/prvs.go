@@ -0,0 +1,207 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package prvs implements the "prvs" tagging scheme of Bounce Address Tag
+// Validation (BATV, draft-levine-smtp-batv-01).
+//
+// The tagged address has the form:
+//
+//	prvs=KDDDSSSSSS=local-part@domain
+//
+// where K is the key number, DDD is the expiration day (days since epoch
+// modulo 1000) and SSSSSS is the first 3 bytes of HMAC-SHA1 over "KDDD" and
+// the original address, hex-encoded.
+package prvs
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+const (
+	prefix = "prvs="
+	tagLen = 10
+)
+
+var (
+	ErrNotTagged = errors.New("prvs: address is not tagged")
+	ErrMalformed = errors.New("prvs: malformed tag")
+	ErrExpired   = errors.New("prvs: tag expired")
+	ErrBadSig    = errors.New("prvs: tag signature mismatch")
+)
+
+func dayNumber(t time.Time) int {
+	return int(t.Unix()/(24*60*60)) % 1000
+}
+
+func signature(key []byte, keyNum, day int, addr string) string {
+	mac := hmac.New(sha1.New, key)
+	fmt.Fprintf(mac, "%d%03d%s", keyNum, day, strings.ToLower(addr))
+	return hex.EncodeToString(mac.Sum(nil)[:3])
+}
+
+// Sign returns the tagged address valid for validity duration since now.
+//
+// The first key is used for signing. Null and already tagged addresses are
+// returned unchanged.
+func Sign(keys [][]byte, addr string, now time.Time, validity time.Duration) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	if len(keys) == 0 {
+		return "", errors.New("prvs: no keys")
+	}
+	mbox, domain, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(strings.ToLower(mbox), prefix) {
+		return addr, nil
+	}
+
+	day := dayNumber(now.Add(validity))
+	tag := fmt.Sprintf("%d%03d%s", 0, day, signature(keys[0], 0, day, addr))
+	return prefix + tag + "=" + mbox + "@" + domain, nil
+}
+
+// Strip returns the original address from the tagged one. If the address is
+// not tagged, it is returned as is and tagged is false.
+func Strip(addr string) (orig string, tagged bool) {
+	mbox, domain, err := address.Split(addr)
+	if err != nil || !strings.HasPrefix(strings.ToLower(mbox), prefix) {
+		return addr, false
+	}
+	parts := strings.SplitN(mbox[len(prefix):], "=", 2)
+	if len(parts) != 2 || len(parts[0]) != tagLen || parts[1] == "" {
+		return addr, false
+	}
+	return parts[1] + "@" + domain, true
+}
+
+// Verify checks the tag of the address and returns the original address.
+//
+// maxAge is the max. amount of time the tag is considered valid, it should
+// be not less than the validity used for signing. Tags with the
+// expiration day more than maxAge in the future are rejected too, since day
+// numbers wrap around each 1000 days.
+func Verify(keys [][]byte, addr string, now time.Time, maxAge time.Duration) (string, error) {
+	orig, tagged := Strip(addr)
+	if !tagged {
+		return addr, ErrNotTagged
+	}
+	mbox, _, _ := address.Split(addr)
+	tag := mbox[len(prefix) : len(prefix)+tagLen]
+
+	keyNum := int(tag[0] - '0')
+	if keyNum < 0 || keyNum > 9 {
+		return orig, ErrMalformed
+	}
+	if keyNum >= len(keys) {
+		return orig, ErrBadSig
+	}
+	day, err := strconv.Atoi(tag[1:4])
+	if err != nil {
+		return orig, ErrMalformed
+	}
+
+	// Expiration day relative to today, accounting for the wrap-around.
+	today := dayNumber(now)
+	left := (day - today + 1000) % 1000
+	maxDays := int(maxAge / (24 * time.Hour))
+	if left > maxDays {
+		return orig, ErrExpired
+	}
+
+	want := signature(keys[keyNum], keyNum, day, orig)
+	if !hmac.Equal([]byte(strings.ToLower(tag[4:])), []byte(want)) {
+		return orig, ErrBadSig
+	}
+	return orig, nil
+}
+
+// LoadKeys reads signing keys from the file, one hex-encoded key per line.
+// The first key is used for signing, others (up to 10 keys in total) are
+// accepted for verification to allow key rotation.
+//
+// If the file does not exist, it is created with a single random key.
+func LoadKeys(path string) ([][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return generateKey(path)
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) < 16 {
+			return nil, fmt.Errorf("%s: malformed key, should be at least 16 bytes in hex", path)
+		}
+		keys = append(keys, key)
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	if len(keys) > 10 {
+		return nil, fmt.Errorf("%s: too many keys, at most 10 are allowed", path)
+	}
+	return keys, nil
+}
+
+func generateKey(path string) ([][]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key)); err != nil {
+		return nil, err
+	}
+	return [][]byte{key}, nil
+}
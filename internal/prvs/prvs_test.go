@@ -0,0 +1,101 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package prvs
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	keys := [][]byte{[]byte("0123456789abcdef"), []byte("fedcba9876543210")}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tagged, err := Sign(keys, "User@example.org", now, 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tagged, "prvs=0") || !strings.HasSuffix(tagged, "=User@example.org") {
+		t.Fatal("malformed tagged address:", tagged)
+	}
+
+	orig, err := Verify(keys, tagged, now.Add(3*24*time.Hour), 7*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "User@example.org" {
+		t.Fatal("wrong original address:", orig)
+	}
+	if _, err := Verify(keys, strings.ToUpper(tagged[:5])+tagged[5:], now, 7*24*time.Hour); err != nil {
+		t.Error("tag verification is case-sensitive:", err)
+	}
+
+	if _, err := Verify(keys, tagged, now.Add(9*24*time.Hour), 7*24*time.Hour); !errors.Is(err, ErrExpired) {
+		t.Error("expired tag accepted:", err)
+	}
+	if _, err := Verify(keys[1:], tagged, now, 7*24*time.Hour); !errors.Is(err, ErrBadSig) {
+		t.Error("tag signed using other key accepted:", err)
+	}
+	forged := strings.Replace(tagged, "=User@", "=other@", 1)
+	if _, err := Verify(keys, forged, now, 7*24*time.Hour); !errors.Is(err, ErrBadSig) {
+		t.Error("tag for other address accepted:", err)
+	}
+	if _, err := Verify(keys, "user@example.org", now, 7*24*time.Hour); !errors.Is(err, ErrNotTagged) {
+		t.Error("untagged address accepted:", err)
+	}
+
+	again, err := Sign(keys, tagged, now, 7*24*time.Hour)
+	if err != nil || again != tagged {
+		t.Error("tagged address is signed again:", again, err)
+	}
+	if null, err := Sign(keys, "", now, 7*24*time.Hour); err != nil || null != "" {
+		t.Error("null address is signed:", null, err)
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "batv_keys")
+
+	keys, err := LoadKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatal("wrong amount of generated keys:", len(keys))
+	}
+
+	loaded, err := LoadKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded[0]) != string(keys[0]) {
+		t.Fatal("generated key is not saved")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("not-hex\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeys(path); err == nil {
+		t.Fatal("malformed key accepted")
+	}
+}
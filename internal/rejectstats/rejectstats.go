@@ -0,0 +1,315 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package rejectstats aggregates information about rejected SMTP commands
+// into periodic reports.
+//
+// Rejections are always counted in the maddy_smtp_rejections Prometheus
+// metric. Detailed reports (top rejecting checks, reply codes, sender domains
+// and client ASNs) are collected only if the aggregator is enabled using the
+// rejection_stats directive of the openmetrics endpoint.
+//
+// Other consumers of rejection information (e.g. the admin UI) receive
+// rejections by registering a Collector.
+package rejectstats
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var rejections = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "maddy",
+		Subsystem: "smtp",
+		Name:      "rejections",
+		Help:      "Rejected SMTP commands by check and reply code",
+	},
+	[]string{"check", "smtp_code"},
+)
+
+func init() {
+	prometheus.MustRegister(rejections)
+}
+
+// Rejection describes the single rejected SMTP command.
+type Rejection struct {
+	Time time.Time
+	// Command is the rejected SMTP command: "MAIL", "RCPT" or "DATA".
+	Command string
+	MsgID   string
+	Sender  string
+	// Rcpt is the rejected recipient, empty if the rejection is not specific
+	// to a recipient.
+	Rcpt string
+	// Check is the name of module that caused the rejection, empty if
+	// unknown.
+	Check string
+	// Code is the SMTP reply code with the enhanced code, e.g. "550 5.7.1".
+	Code string
+	// Message is the reply text returned by the check, without
+	// per-message details added by the endpoint.
+	Message string
+	// Reason is the reason reported by the check, empty if unknown.
+	Reason       string
+	SenderDomain string
+	// ASN is the client autonomous system number, zero if unknown.
+	ASN uint
+}
+
+// Entry is a single line of the report top list.
+type Entry struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// Report contains aggregated rejections for the period.
+type Report struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Total         int       `json:"total"`
+	Checks        []Entry   `json:"checks"`
+	Codes         []Entry   `json:"codes"`
+	Reasons       []Entry   `json:"reasons"`
+	SenderDomains []Entry   `json:"sender_domains"`
+	ASNs          []Entry   `json:"asns"`
+}
+
+// maxKeys is the upper limit on the amount of distinct values counted in
+// each report list. Values seen after the limit is reached are counted as
+// otherKey.
+const (
+	maxKeys  = 10000
+	otherKey = "<other>"
+)
+
+type counters struct {
+	start         time.Time
+	total         int
+	checks        map[string]int
+	codes         map[string]int
+	reasons       map[string]int
+	senderDomains map[string]int
+	asns          map[string]int
+}
+
+func newCounters(start time.Time) *counters {
+	return &counters{
+		start:         start,
+		checks:        map[string]int{},
+		codes:         map[string]int{},
+		reasons:       map[string]int{},
+		senderDomains: map[string]int{},
+		asns:          map[string]int{},
+	}
+}
+
+func inc(m map[string]int, key string) {
+	if _, ok := m[key]; !ok && len(m) >= maxKeys {
+		key = otherKey
+	}
+	m[key]++
+}
+
+func topN(m map[string]int, n int) []Entry {
+	res := make([]Entry, 0, len(m))
+	for k, v := range m {
+		res = append(res, Entry{Key: k, Count: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Key < res[j].Key
+	})
+	if n != 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+func (c *counters) report(end time.Time, top int) Report {
+	return Report{
+		Start:         c.start,
+		End:           end,
+		Total:         c.total,
+		Checks:        topN(c.checks, top),
+		Codes:         topN(c.codes, top),
+		Reasons:       topN(c.reasons, top),
+		SenderDomains: topN(c.senderDomains, top),
+		ASNs:          topN(c.asns, top),
+	}
+}
+
+// Aggregator collects rejections into reports covering fixed periods.
+type Aggregator struct {
+	period time.Duration
+	keep   int
+	top    int
+
+	lock    sync.Mutex
+	cur     *counters
+	reports []Report // newest first
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+// NewAggregator creates the aggregator that produces a report each period and
+// keeps the specified amount of finished reports. Each report list is
+// truncated to top entries.
+func NewAggregator(period time.Duration, keep, top int) *Aggregator {
+	return &Aggregator{
+		period: period,
+		keep:   keep,
+		top:    top,
+		now:    time.Now,
+	}
+}
+
+// rotate finishes the current report if its period has passed. lock should be
+// held.
+func (a *Aggregator) rotate() {
+	now := a.now()
+	start := now.Truncate(a.period)
+	if a.cur == nil {
+		a.cur = newCounters(start)
+		return
+	}
+	if !start.After(a.cur.start) {
+		return
+	}
+
+	a.reports = append([]Report{a.cur.report(a.cur.start.Add(a.period), a.top)}, a.reports...)
+	if len(a.reports) > a.keep {
+		a.reports = a.reports[:a.keep]
+	}
+	a.cur = newCounters(start)
+}
+
+// reasonKey formats the Reasons entry key: the check name, reply code and
+// the reply text (or the reason reported by the check if there is no text).
+func reasonKey(check string, r Rejection) string {
+	key := check + ": " + r.Code
+	text := r.Message
+	if text == "" {
+		text = r.Reason
+	}
+	if text != "" {
+		key += " " + text
+	}
+	return key
+}
+
+// Add counts the rejection in the report for the current period.
+func (a *Aggregator) Add(r Rejection) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.rotate()
+
+	check := r.Check
+	if check == "" {
+		check = "unknown"
+	}
+	domain := r.SenderDomain
+	if domain == "" {
+		domain = "<>"
+	}
+	asn := "unknown"
+	if r.ASN != 0 {
+		asn = "AS" + strconv.FormatUint(uint64(r.ASN), 10)
+	}
+
+	a.cur.total++
+	inc(a.cur.checks, check)
+	inc(a.cur.codes, r.Code)
+	inc(a.cur.reasons, reasonKey(check, r))
+	inc(a.cur.senderDomains, domain)
+	inc(a.cur.asns, asn)
+}
+
+// Reports returns the report for the current (unfinished) period and
+// finished reports, newest first.
+func (a *Aggregator) Reports() (Report, []Report) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.rotate()
+
+	reports := make([]Report, len(a.reports))
+	copy(reports, a.reports)
+	return a.cur.report(a.now(), a.top), reports
+}
+
+// Collector receives all rejections passed to Record.
+type Collector interface {
+	Add(r Rejection)
+}
+
+var (
+	collectorsLock sync.RWMutex
+	collectors     []Collector
+)
+
+// Register adds the collector that receives all rejections.
+func Register(c Collector) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	collectors = append(collectors, c)
+}
+
+// Unregister removes the collector added using Register.
+func Unregister(c Collector) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	for i, other := range collectors {
+		if other == c {
+			collectors = append(collectors[:i:i], collectors[i+1:]...)
+			return
+		}
+	}
+}
+
+// Record registers the rejection in metrics and passes it to all registered
+// collectors.
+func Record(r Rejection) {
+	check := r.Check
+	if check == "" {
+		check = "unknown"
+	}
+	code := r.Code
+	if len(code) > 3 {
+		code = code[:3]
+	}
+	rejections.WithLabelValues(check, code).Inc()
+
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	collectorsLock.RLock()
+	defer collectorsLock.RUnlock()
+	for _, c := range collectors {
+		c.Add(r)
+	}
+}
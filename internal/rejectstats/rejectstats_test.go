@@ -0,0 +1,109 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rejectstats
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAggregator(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+	a := NewAggregator(time.Hour, 2, 2)
+	a.now = func() time.Time { return now }
+
+	a.Add(Rejection{Check: "check.dnsbl", Code: "554 5.7.0", Message: "Client identity is listed", SenderDomain: "example.org", ASN: 64500})
+	a.Add(Rejection{Check: "check.dnsbl", Code: "554 5.7.0", Message: "Client identity is listed", SenderDomain: "example.org", ASN: 64500})
+	a.Add(Rejection{Check: "check.spf", Code: "550 5.7.23", Reason: "fail", SenderDomain: "example.com"})
+	a.Add(Rejection{Code: "550 5.1.1"})
+
+	cur, reports := a.Reports()
+	if len(reports) != 0 {
+		t.Fatal("unexpected finished reports:", reports)
+	}
+	if cur.Total != 4 {
+		t.Fatal("wrong total:", cur.Total)
+	}
+	if want := []Entry{{"check.dnsbl", 2}, {"check.spf", 1}}; !reflect.DeepEqual(cur.Checks, want) {
+		t.Error("wrong checks:", cur.Checks)
+	}
+	if want := []Entry{{"check.dnsbl: 554 5.7.0 Client identity is listed", 2}, {"check.spf: 550 5.7.23 fail", 1}}; !reflect.DeepEqual(cur.Reasons, want) {
+		t.Error("wrong reasons:", cur.Reasons)
+	}
+	if want := []Entry{{"example.org", 2}, {"<>", 1}}; !reflect.DeepEqual(cur.SenderDomains, want) {
+		t.Error("wrong sender domains:", cur.SenderDomains)
+	}
+	if want := []Entry{{"AS64500", 2}, {"unknown", 2}}; !reflect.DeepEqual(cur.ASNs, want) {
+		t.Error("wrong ASNs:", cur.ASNs)
+	}
+
+	for i := 0; i < 3; i++ {
+		now = now.Add(time.Hour)
+		a.Add(Rejection{Check: "check.rspamd", Code: "550 5.7.1"})
+	}
+
+	cur, reports = a.Reports()
+	if len(reports) != 2 {
+		t.Fatal("wrong amount of finished reports:", len(reports))
+	}
+	if cur.Total != 1 || !cur.Start.Equal(time.Date(2020, 1, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Error("wrong current report:", cur)
+	}
+	if reports[0].Total != 1 || !reports[0].End.Equal(cur.Start) {
+		t.Error("wrong newest report:", reports[0])
+	}
+	if reports[1].Total != 1 || !reports[1].Start.Equal(time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Error("old reports are not dropped:", reports[1])
+	}
+}
+
+type collector []Rejection
+
+func (c *collector) Add(r Rejection) {
+	*c = append(*c, r)
+}
+
+func TestRecord(t *testing.T) {
+	var c collector
+	Register(&c)
+	Record(Rejection{Check: "check.spf", Code: "550 5.7.23", MsgID: "1"})
+	Unregister(&c)
+	Record(Rejection{Check: "check.spf", Code: "550 5.7.23", MsgID: "2"})
+
+	if len(c) != 1 || c[0].MsgID != "1" || c[0].Time.IsZero() {
+		t.Fatal("wrong rejections received:", c)
+	}
+}
+
+func TestAggregator_KeysLimit(t *testing.T) {
+	a := NewAggregator(time.Hour, 1, 0)
+	for i := 0; i < maxKeys+10; i++ {
+		a.Add(Rejection{Code: "550 5.7.1", SenderDomain: strconv.Itoa(i) + ".example.org"})
+	}
+
+	cur, _ := a.Reports()
+	if len(cur.SenderDomains) != maxKeys+1 {
+		t.Fatal("wrong amount of sender domains:", len(cur.SenderDomains))
+	}
+	if cur.SenderDomains[0] != (Entry{otherKey, 10}) {
+		t.Error("wrong first entry:", cur.SenderDomains[0])
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// Message is the information about the message available to the script.
+type Message struct {
+	Header textproto.Header
+	// Size is the message size in octets, including the header.
+	Size int64
+
+	// EnvelopeFrom is the MAIL FROM address, it is empty for bounces.
+	EnvelopeFrom string
+	// EnvelopeTo is the recipient address the script is executed for.
+	EnvelopeTo string
+}
+
+// Vacation describes a vacation auto-reply requested by the script (RFC
+// 5230). It is up to the caller to decide whether the reply should be
+// actually sent.
+type Vacation struct {
+	Days      int
+	Subject   string
+	From      string
+	Addresses []string
+	MIME      bool
+	Handle    string
+	Reason    string
+}
+
+// Result is the set of actions resulting from the script execution.
+type Result struct {
+	// Keep is set if the message should be stored in the default mailbox,
+	// either due to explicit keep or implicit keep.
+	Keep bool
+	// FileInto lists additional mailboxes the message should be stored
+	// in.
+	FileInto []string
+	Redirect []string
+
+	Reject       bool
+	RejectReason string
+
+	Vacation *Vacation
+}
+
+var ErrTooManyRedirects = errors.New("sieve: too many redirect actions")
+
+type execState struct {
+	msg      *Message
+	res      Result
+	explKeep bool
+	// cancelKeep is set once an action cancelling implicit keep is
+	// executed.
+	cancelKeep bool
+	stopped    bool
+}
+
+// Execute runs the script for the message.
+//
+// If error is returned, the caller should ignore any actions and do an
+// implicit keep as required by RFC 5228, Section 2.10.6.
+func (s *Script) Execute(msg Message) (Result, error) {
+	st := execState{msg: &msg}
+	if err := st.run(s.cmds); err != nil {
+		return Result{Keep: true}, err
+	}
+
+	st.res.Keep = st.explKeep || !st.cancelKeep
+	if st.res.Reject && (st.res.Keep || len(st.res.FileInto) != 0) {
+		return Result{Keep: true}, errors.New("sieve: reject cannot be used together with keep or fileinto")
+	}
+	if st.res.Reject && st.res.Vacation != nil {
+		return Result{Keep: true}, errors.New("sieve: reject cannot be used together with vacation")
+	}
+	return st.res, nil
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+func (st *execState) run(cmds []command) error {
+	for _, cmd := range cmds {
+		if st.stopped {
+			return nil
+		}
+
+		switch cmd := cmd.(type) {
+		case *ifCmd:
+			for _, br := range cmd.branches {
+				if br.cond == nil || br.cond.eval(st.msg) {
+					if err := st.run(br.block); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		case stopCmd:
+			st.stopped = true
+		case keepCmd:
+			st.explKeep = true
+		case discardCmd:
+			st.cancelKeep = true
+		case fileintoCmd:
+			st.cancelKeep = true
+			st.res.FileInto = appendUnique(st.res.FileInto, cmd.mailbox)
+		case redirectCmd:
+			st.cancelKeep = true
+			st.res.Redirect = appendUnique(st.res.Redirect, cmd.addr)
+			if len(st.res.Redirect) > MaxRedirects {
+				return ErrTooManyRedirects
+			}
+		case rejectCmd:
+			if st.res.Reject {
+				return errors.New("sieve: multiple reject actions")
+			}
+			st.cancelKeep = true
+			st.res.Reject = true
+			st.res.RejectReason = cmd.reason
+		case vacationCmd:
+			if st.res.Vacation != nil {
+				return errors.New("sieve: multiple vacation actions")
+			}
+			vac := cmd.vac
+			st.res.Vacation = &vac
+		default:
+			panic(fmt.Sprintf("sieve: unexpected command type %T", cmd))
+		}
+	}
+	return nil
+}
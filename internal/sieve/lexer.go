@@ -0,0 +1,268 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokTag
+	tokNumber
+	tokString
+	tokLBracket
+	tokRBracket
+	tokComma
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokSemicolon
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokEOF:
+		return "end of script"
+	case tokIdent:
+		return "identifier"
+	case tokTag:
+		return "tag"
+	case tokNumber:
+		return "number"
+	case tokString:
+		return "string"
+	case tokLBracket:
+		return "'['"
+	case tokRBracket:
+		return "']'"
+	case tokComma:
+		return "','"
+	case tokLParen:
+		return "'('"
+	case tokRParen:
+		return "')'"
+	case tokLBrace:
+		return "'{'"
+	case tokRBrace:
+		return "'}'"
+	case tokSemicolon:
+		return "';'"
+	}
+	return "unknown token"
+}
+
+type token struct {
+	kind tokenKind
+	line int
+	str  string
+	num  int64
+}
+
+// lexer splits the script into tokens as defined in RFC 5228, Section 8.1.
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("sieve: line %d: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end == -1 {
+				return l.errorf("unterminated comment")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	start := l.pos
+	c := l.src[l.pos]
+	simple := map[byte]tokenKind{
+		'[': tokLBracket, ']': tokRBracket, ',': tokComma, '(': tokLParen,
+		')': tokRParen, '{': tokLBrace, '}': tokRBrace, ';': tokSemicolon,
+	}
+	if kind, ok := simple[c]; ok {
+		l.pos++
+		return token{kind: kind, line: l.line}, nil
+	}
+
+	switch {
+	case c == '"':
+		return l.quoted()
+	case c == ':':
+		l.pos++
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos], l.pos == start+1) {
+			l.pos++
+		}
+		if l.pos == start+1 {
+			return token{}, l.errorf("malformed tag")
+		}
+		return token{kind: tokTag, line: l.line, str: strings.ToLower(l.src[start+1 : l.pos])}, nil
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && l.src[l.pos] >= '0' && l.src[l.pos] <= '9' {
+			l.pos++
+		}
+		num, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+		if err != nil {
+			return token{}, l.errorf("malformed number: %v", err)
+		}
+		if l.pos < len(l.src) {
+			mult := int64(1)
+			switch l.src[l.pos] {
+			case 'k', 'K':
+				mult = 1 << 10
+			case 'm', 'M':
+				mult = 1 << 20
+			case 'g', 'G':
+				mult = 1 << 30
+			}
+			if mult != 1 {
+				l.pos++
+				num *= mult
+			}
+		}
+		return token{kind: tokNumber, line: l.line, num: num}, nil
+	case isIdentChar(c, true):
+		for l.pos < len(l.src) && isIdentChar(l.src[l.pos], false) {
+			l.pos++
+		}
+		ident := strings.ToLower(l.src[start:l.pos])
+		if ident == "text" && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			return l.multiline()
+		}
+		return token{kind: tokIdent, line: l.line, str: ident}, nil
+	}
+
+	return token{}, l.errorf("unexpected character: %q", c)
+}
+
+func (l *lexer) quoted() (token, error) {
+	line := l.line
+	l.pos++ // opening quote
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return token{kind: tokString, line: line, str: b.String()}, nil
+		case '\\':
+			// Only \" and \\ are meaningful, other escapes are ignored
+			// (RFC 5228, Section 2.4.2).
+			if l.pos+1 < len(l.src) {
+				l.pos++
+				c = l.src[l.pos]
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return token{}, l.errorf("unterminated string")
+}
+
+func (l *lexer) multiline() (token, error) {
+	line := l.line
+
+	// Whitespace and a hash comment are allowed before the line break.
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '#' {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+	if l.pos < len(l.src) && l.src[l.pos] == '\r' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != '\n' {
+		return token{}, l.errorf("line break expected after text:")
+	}
+	l.pos++
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var lineStr string
+		if end == -1 {
+			lineStr = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			lineStr = l.src[l.pos : l.pos+end]
+			l.pos += end + 1
+			l.line++
+		}
+		lineStr = strings.TrimSuffix(lineStr, "\r")
+
+		if lineStr == "." {
+			return token{kind: tokString, line: line, str: b.String()}, nil
+		}
+		if strings.HasPrefix(lineStr, "..") {
+			lineStr = lineStr[1:]
+		}
+		b.WriteString(lineStr)
+		b.WriteString("\r\n")
+	}
+	l.line = line
+	return token{}, l.errorf("unterminated multi-line string")
+}
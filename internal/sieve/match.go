@@ -0,0 +1,446 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+)
+
+type test interface {
+	eval(m *Message) bool
+}
+
+type matchType int
+
+const (
+	matchIs matchType = iota
+	matchContains
+	matchMatches
+)
+
+type addressPart int
+
+const (
+	partAll addressPart = iota
+	partLocal
+	partDomain
+)
+
+type matcher struct {
+	typ      matchType
+	caseFold bool
+	keys     []string
+}
+
+func (m matcher) match(value string) bool {
+	if m.caseFold {
+		value = asciiLower(value)
+	}
+	for _, key := range m.keys {
+		if m.caseFold {
+			key = asciiLower(key)
+		}
+		switch m.typ {
+		case matchIs:
+			if value == key {
+				return true
+			}
+		case matchContains:
+			if strings.Contains(value, key) {
+				return true
+			}
+		case matchMatches:
+			if globMatch(key, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// asciiLower implements the i;ascii-casemap comparator (RFC 4790, Section
+// 9.2) which folds only ASCII letters.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+// globMatch implements the :matches match type. '*' matches any sequence of
+// characters, '?' matches a single character and '\' escapes the next
+// character.
+func globMatch(pattern, value string) bool {
+	pr, vr := []rune(pattern), []rune(value)
+	var (
+		p, v         int
+		starP, starV = -1, -1
+	)
+	for v < len(vr) {
+		if p < len(pr) {
+			switch pr[p] {
+			case '*':
+				starP, starV = p, v
+				p++
+				continue
+			case '?':
+				p++
+				v++
+				continue
+			case '\\':
+				if p+1 < len(pr) && pr[p+1] == vr[v] {
+					p += 2
+					v++
+					continue
+				}
+			default:
+				if pr[p] == vr[v] {
+					p++
+					v++
+					continue
+				}
+			}
+		}
+		if starP == -1 {
+			return false
+		}
+		p = starP + 1
+		starV++
+		v = starV
+	}
+	for p < len(pr) && pr[p] == '*' {
+		p++
+	}
+	return p == len(pr)
+}
+
+var headerDecoder = mime.WordDecoder{}
+
+// headerValues returns decoded values of all fields with the specified name.
+func headerValues(m *Message, name string) []string {
+	fields := m.Header.FieldsByKey(name)
+	var values []string
+	for fields.Next() {
+		raw := fields.Value()
+		dec, err := headerDecoder.DecodeHeader(raw)
+		if err != nil {
+			dec = raw
+		}
+		values = append(values, strings.TrimSpace(dec))
+	}
+	return values
+}
+
+func addressValue(addr string, part addressPart) string {
+	switch part {
+	case partLocal:
+		if i := strings.LastIndexByte(addr, '@'); i != -1 {
+			return addr[:i]
+		}
+		return addr
+	case partDomain:
+		if i := strings.LastIndexByte(addr, '@'); i != -1 {
+			return addr[i+1:]
+		}
+		return ""
+	}
+	return addr
+}
+
+type addressTest struct {
+	headers []string
+	part    addressPart
+	matcher matcher
+}
+
+func (t addressTest) eval(m *Message) bool {
+	for _, name := range t.headers {
+		for _, value := range headerValues(m, name) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				// Not a valid address list, match against the raw value as
+				// a best effort.
+				if t.matcher.match(addressValue(value, t.part)) {
+					return true
+				}
+				continue
+			}
+			for _, addr := range list {
+				if t.matcher.match(addressValue(addr.Address, t.part)) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+type envelopeTest struct {
+	parts   []string
+	part    addressPart
+	matcher matcher
+}
+
+func (t envelopeTest) eval(m *Message) bool {
+	for _, name := range t.parts {
+		var addr string
+		switch asciiLower(name) {
+		case "from":
+			addr = m.EnvelopeFrom
+		case "to":
+			addr = m.EnvelopeTo
+		default:
+			continue
+		}
+		if t.matcher.match(addressValue(addr, t.part)) {
+			return true
+		}
+	}
+	return false
+}
+
+type headerTest struct {
+	headers []string
+	matcher matcher
+}
+
+func (t headerTest) eval(m *Message) bool {
+	for _, name := range t.headers {
+		for _, value := range headerValues(m, name) {
+			if t.matcher.match(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type existsTest struct {
+	headers []string
+}
+
+func (t existsTest) eval(m *Message) bool {
+	for _, name := range t.headers {
+		if !m.Header.Has(name) {
+			return false
+		}
+	}
+	return true
+}
+
+type sizeTest struct {
+	over  bool
+	limit int64
+}
+
+func (t sizeTest) eval(m *Message) bool {
+	if t.over {
+		return m.Size > t.limit
+	}
+	return m.Size < t.limit
+}
+
+type allofTest struct{ tests []test }
+
+func (t allofTest) eval(m *Message) bool {
+	for _, sub := range t.tests {
+		if !sub.eval(m) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyofTest struct{ tests []test }
+
+func (t anyofTest) eval(m *Message) bool {
+	for _, sub := range t.tests {
+		if sub.eval(m) {
+			return true
+		}
+	}
+	return false
+}
+
+type notTest struct{ test test }
+
+func (t notTest) eval(m *Message) bool {
+	return !t.test.eval(m)
+}
+
+type constTest bool
+
+func (t constTest) eval(*Message) bool {
+	return bool(t)
+}
+
+func (c *compiler) test(n *testNode) (test, error) {
+	switch n.name {
+	case "true", "false":
+		if len(n.args) != 0 || len(n.tests) != 0 {
+			return nil, errorf(n.line, "%s does not accept arguments", n.name)
+		}
+		return constTest(n.name == "true"), nil
+	case "not":
+		if len(n.args) != 0 || len(n.tests) != 1 || n.testList {
+			return nil, errorf(n.line, "not expects a single test")
+		}
+		sub, err := c.test(n.tests[0])
+		if err != nil {
+			return nil, err
+		}
+		return notTest{test: sub}, nil
+	case "allof", "anyof":
+		if len(n.args) != 0 || !n.testList {
+			return nil, errorf(n.line, "%s expects a test list", n.name)
+		}
+		tests := make([]test, 0, len(n.tests))
+		for _, sub := range n.tests {
+			t, err := c.test(sub)
+			if err != nil {
+				return nil, err
+			}
+			tests = append(tests, t)
+		}
+		if n.name == "allof" {
+			return allofTest{tests: tests}, nil
+		}
+		return anyofTest{tests: tests}, nil
+	}
+
+	if len(n.tests) != 0 {
+		return nil, errorf(n.line, "%s does not accept nested tests", n.name)
+	}
+
+	switch n.name {
+	case "exists":
+		if len(n.args) != 1 || n.args[0].kind != argStrings {
+			return nil, errorf(n.line, "exists expects a string list")
+		}
+		return existsTest{headers: n.args[0].strs}, nil
+	case "size":
+		if len(n.args) != 2 || n.args[0].kind != argTag || n.args[1].kind != argNumber ||
+			(n.args[0].tag != "over" && n.args[0].tag != "under") {
+			return nil, errorf(n.line, "size expects :over or :under and a number")
+		}
+		return sizeTest{over: n.args[0].tag == "over", limit: n.args[1].num}, nil
+	case "header":
+		m, _, pos, err := c.matchArgs(n, false)
+		if err != nil {
+			return nil, err
+		}
+		m.keys = pos[1].strs
+		return headerTest{headers: pos[0].strs, matcher: m}, nil
+	case "address":
+		m, part, pos, err := c.matchArgs(n, true)
+		if err != nil {
+			return nil, err
+		}
+		m.keys = pos[1].strs
+		return addressTest{headers: pos[0].strs, part: part, matcher: m}, nil
+	case "envelope":
+		if err := c.need(n.line, "envelope", n.name); err != nil {
+			return nil, err
+		}
+		m, part, pos, err := c.matchArgs(n, true)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range pos[0].strs {
+			switch asciiLower(name) {
+			case "from", "to":
+			default:
+				return nil, errorf(n.line, "envelope: unsupported envelope part: %q", name)
+			}
+		}
+		m.keys = pos[1].strs
+		return envelopeTest{parts: pos[0].strs, part: part, matcher: m}, nil
+	}
+	return nil, errorf(n.line, "unknown test: %s", n.name)
+}
+
+// matchArgs parses the optional COMPARATOR, ADDRESS-PART and MATCH-TYPE
+// arguments and checks that exactly two string lists follow them.
+func (c *compiler) matchArgs(n *testNode, allowPart bool) (matcher, addressPart, []arg, error) {
+	m := matcher{typ: matchIs, caseFold: true}
+	part := partAll
+
+	var seenMatch, seenPart, seenComparator bool
+	i := 0
+	for ; i < len(n.args) && n.args[i].kind == argTag; i++ {
+		a := n.args[i]
+		switch a.tag {
+		case "is", "contains", "matches":
+			if seenMatch {
+				return m, part, nil, errorf(a.line, "multiple match types specified")
+			}
+			seenMatch = true
+			switch a.tag {
+			case "contains":
+				m.typ = matchContains
+			case "matches":
+				m.typ = matchMatches
+			}
+		case "all", "localpart", "domain":
+			if !allowPart {
+				return m, part, nil, errorf(a.line, "unexpected tag :%s", a.tag)
+			}
+			if seenPart {
+				return m, part, nil, errorf(a.line, "multiple address parts specified")
+			}
+			seenPart = true
+			switch a.tag {
+			case "localpart":
+				part = partLocal
+			case "domain":
+				part = partDomain
+			}
+		case "comparator":
+			if seenComparator {
+				return m, part, nil, errorf(a.line, "multiple comparators specified")
+			}
+			seenComparator = true
+			if i+1 >= len(n.args) || n.args[i+1].kind != argStrings || len(n.args[i+1].strs) != 1 {
+				return m, part, nil, errorf(a.line, ":comparator expects a string")
+			}
+			i++
+			switch cmp := n.args[i].strs[0]; cmp {
+			case "i;ascii-casemap":
+				m.caseFold = true
+			case "i;octet":
+				m.caseFold = false
+			default:
+				return m, part, nil, errorf(a.line, "unsupported comparator: %q", cmp)
+			}
+		default:
+			return m, part, nil, errorf(a.line, "unexpected tag :%s", a.tag)
+		}
+	}
+
+	pos := n.args[i:]
+	if len(pos) != 2 || pos[0].kind != argStrings || pos[1].kind != argStrings {
+		return m, part, nil, errorf(n.line, "%s expects two string lists", n.name)
+	}
+	return m, part, pos, nil
+}
@@ -0,0 +1,243 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"fmt"
+)
+
+type argKind int
+
+const (
+	argTag argKind = iota
+	argNumber
+	argStrings
+)
+
+// arg is a single positional or tagged argument of a command or test.
+type arg struct {
+	kind argKind
+	line int
+	tag  string
+	num  int64
+	strs []string
+	// list is set if the string argument used the bracketed list syntax.
+	list bool
+}
+
+type testNode struct {
+	name  string
+	line  int
+	args  []arg
+	tests []*testNode
+	// testList is set if tests were specified using the parenthesized list
+	// syntax.
+	testList bool
+}
+
+type cmdNode struct {
+	name     string
+	line     int
+	args     []arg
+	tests    []*testNode
+	testList bool
+	hasBlock bool
+	block    []*cmdNode
+}
+
+// parser builds the generic syntax tree described by RFC 5228, Section 8.2.
+// Command-specific validation is done later by compile.
+type parser struct {
+	lex *lexer
+	tok token
+}
+
+func (p *parser) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("sieve: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) advance() error {
+	tok, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = tok
+	return nil
+}
+
+func (p *parser) expect(kind tokenKind) error {
+	if p.tok.kind != kind {
+		return p.errorf(p.tok.line, "expected %v, got %v", kind, p.tok.kind)
+	}
+	return p.advance()
+}
+
+func parse(src string) ([]*cmdNode, error) {
+	p := parser{lex: &lexer{src: src, line: 1}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf(p.tok.line, "unexpected %v", p.tok.kind)
+	}
+	return cmds, nil
+}
+
+func (p *parser) commands() ([]*cmdNode, error) {
+	var cmds []*cmdNode
+	for p.tok.kind == tokIdent {
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (p *parser) command() (*cmdNode, error) {
+	cmd := &cmdNode{name: p.tok.str, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	cmd.args, cmd.tests, cmd.testList, err = p.arguments()
+	if err != nil {
+		return nil, err
+	}
+
+	switch p.tok.kind {
+	case tokSemicolon:
+		return cmd, p.advance()
+	case tokLBrace:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		cmd.hasBlock = true
+		cmd.block, err = p.commands()
+		if err != nil {
+			return nil, err
+		}
+		return cmd, p.expect(tokRBrace)
+	}
+	return nil, p.errorf(p.tok.line, "expected ';' or block after %s, got %v", cmd.name, p.tok.kind)
+}
+
+func (p *parser) arguments() ([]arg, []*testNode, bool, error) {
+	var args []arg
+	for {
+		a := arg{line: p.tok.line}
+		switch p.tok.kind {
+		case tokTag:
+			a.kind = argTag
+			a.tag = p.tok.str
+		case tokNumber:
+			a.kind = argNumber
+			a.num = p.tok.num
+		case tokString:
+			a.kind = argStrings
+			a.strs = []string{p.tok.str}
+		case tokLBracket:
+			strs, err := p.stringList()
+			if err != nil {
+				return nil, nil, false, err
+			}
+			args = append(args, arg{kind: argStrings, line: a.line, strs: strs, list: true})
+			continue
+		case tokIdent:
+			t, err := p.test()
+			if err != nil {
+				return nil, nil, false, err
+			}
+			return args, []*testNode{t}, false, nil
+		case tokLParen:
+			tests, err := p.testList()
+			if err != nil {
+				return nil, nil, false, err
+			}
+			return args, tests, true, nil
+		default:
+			return args, nil, false, nil
+		}
+		args = append(args, a)
+		if err := p.advance(); err != nil {
+			return nil, nil, false, err
+		}
+	}
+}
+
+func (p *parser) stringList() ([]string, error) {
+	if err := p.expect(tokLBracket); err != nil {
+		return nil, err
+	}
+	var strs []string
+	for {
+		if p.tok.kind != tokString {
+			return nil, p.errorf(p.tok.line, "expected string in list, got %v", p.tok.kind)
+		}
+		strs = append(strs, p.tok.str)
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == tokRBracket {
+			return strs, p.advance()
+		}
+		if err := p.expect(tokComma); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) test() (*testNode, error) {
+	t := &testNode{name: p.tok.str, line: p.tok.line}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	var err error
+	t.args, t.tests, t.testList, err = p.arguments()
+	return t, err
+}
+
+func (p *parser) testList() ([]*testNode, error) {
+	if err := p.expect(tokLParen); err != nil {
+		return nil, err
+	}
+	var tests []*testNode
+	for {
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf(p.tok.line, "expected test, got %v", p.tok.kind)
+		}
+		t, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, t)
+		if p.tok.kind == tokRParen {
+			return tests, p.advance()
+		}
+		if err := p.expect(tokComma); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,371 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Extensions lists capabilities that can be passed to require.
+var Extensions = []string{
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"envelope",
+	"fileinto",
+	"reject",
+	"vacation",
+}
+
+const (
+	// MaxRedirects is the maximum amount of distinct redirect actions a script
+	// is allowed to execute for a single message.
+	MaxRedirects = 4
+
+	// MinVacationDays and MaxVacationDays bound the :days argument of
+	// vacation. Values outside of the range are silently adjusted.
+	MinVacationDays = 1
+	MaxVacationDays = 30
+
+	// DefaultVacationDays is used if :days is not specified.
+	DefaultVacationDays = 7
+)
+
+// Script is a compiled Sieve script ready for execution.
+type Script struct {
+	cmds []command
+}
+
+type (
+	command interface{}
+
+	ifBranch struct {
+		// cond is nil for the else branch.
+		cond  test
+		block []command
+	}
+	ifCmd struct {
+		branches []ifBranch
+	}
+	stopCmd     struct{}
+	keepCmd     struct{}
+	discardCmd  struct{}
+	fileintoCmd struct{ mailbox string }
+	redirectCmd struct{ addr string }
+	rejectCmd   struct{ reason string }
+	vacationCmd struct{ vac Vacation }
+)
+
+// Parse parses and validates the Sieve script.
+//
+// Errors include the line number of the offending construct.
+func Parse(src string) (*Script, error) {
+	nodes, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	c := compiler{caps: map[string]bool{}}
+	cmds, err := c.block(nodes, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{cmds: cmds}, nil
+}
+
+type compiler struct {
+	caps map[string]bool
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("sieve: line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (c *compiler) need(line int, capability, what string) error {
+	if !c.caps[capability] {
+		return errorf(line, "%s requires %q capability", what, capability)
+	}
+	return nil
+}
+
+func (c *compiler) block(nodes []*cmdNode, topLevel bool) ([]command, error) {
+	var (
+		cmds       []command
+		requireOk  = topLevel
+		lastIf     *ifCmd
+		lastIfDone bool
+	)
+	for _, n := range nodes {
+		if n.name != "require" {
+			requireOk = false
+		}
+		if n.name != "elsif" && n.name != "else" {
+			lastIf = nil
+		}
+
+		switch n.name {
+		case "require":
+			if !requireOk {
+				return nil, errorf(n.line, "require is allowed only at the beginning of the script")
+			}
+			if err := c.require(n); err != nil {
+				return nil, err
+			}
+			continue
+		case "if":
+			br, err := c.branch(n, true)
+			if err != nil {
+				return nil, err
+			}
+			lastIf = &ifCmd{branches: []ifBranch{br}}
+			lastIfDone = false
+			cmds = append(cmds, lastIf)
+			continue
+		case "elsif", "else":
+			if lastIf == nil || lastIfDone {
+				return nil, errorf(n.line, "%s without preceding if", n.name)
+			}
+			br, err := c.branch(n, n.name == "elsif")
+			if err != nil {
+				return nil, err
+			}
+			lastIf.branches = append(lastIf.branches, br)
+			lastIfDone = n.name == "else"
+			continue
+		}
+
+		if n.hasBlock {
+			return nil, errorf(n.line, "%s does not accept a block", n.name)
+		}
+		if len(n.tests) != 0 {
+			return nil, errorf(n.line, "%s does not accept tests", n.name)
+		}
+
+		cmd, err := c.action(n)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, nil
+}
+
+func (c *compiler) require(n *cmdNode) error {
+	if len(n.args) != 1 || n.args[0].kind != argStrings || len(n.tests) != 0 {
+		return errorf(n.line, "require expects a string list")
+	}
+	for _, capability := range n.args[0].strs {
+		known := false
+		for _, ext := range Extensions {
+			if ext == capability {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return errorf(n.line, "unsupported capability: %q", capability)
+		}
+		c.caps[capability] = true
+	}
+	return nil
+}
+
+func (c *compiler) branch(n *cmdNode, hasCond bool) (ifBranch, error) {
+	if !n.hasBlock {
+		return ifBranch{}, errorf(n.line, "%s requires a block", n.name)
+	}
+	if len(n.args) != 0 {
+		return ifBranch{}, errorf(n.line, "unexpected arguments for %s", n.name)
+	}
+
+	var br ifBranch
+	if hasCond {
+		if len(n.tests) != 1 || n.testList {
+			return ifBranch{}, errorf(n.line, "%s requires exactly one test", n.name)
+		}
+		var err error
+		br.cond, err = c.test(n.tests[0])
+		if err != nil {
+			return ifBranch{}, err
+		}
+	} else if len(n.tests) != 0 {
+		return ifBranch{}, errorf(n.line, "else does not accept tests")
+	}
+
+	var err error
+	br.block, err = c.block(n.block, false)
+	return br, err
+}
+
+// singleString checks that args consist of a single string and returns it.
+func singleString(n *cmdNode, args []arg) (string, error) {
+	if len(args) != 1 || args[0].kind != argStrings || len(args[0].strs) != 1 {
+		return "", errorf(n.line, "%s expects a single string argument", n.name)
+	}
+	return args[0].strs[0], nil
+}
+
+func (c *compiler) action(n *cmdNode) (command, error) {
+	switch n.name {
+	case "stop", "keep", "discard":
+		if len(n.args) != 0 {
+			return nil, errorf(n.line, "%s does not accept arguments", n.name)
+		}
+		switch n.name {
+		case "stop":
+			return stopCmd{}, nil
+		case "keep":
+			return keepCmd{}, nil
+		}
+		return discardCmd{}, nil
+	case "fileinto":
+		if err := c.need(n.line, "fileinto", n.name); err != nil {
+			return nil, err
+		}
+		mbox, err := singleString(n, n.args)
+		if err != nil {
+			return nil, err
+		}
+		return fileintoCmd{mailbox: mbox}, nil
+	case "redirect":
+		addr, err := singleString(n, n.args)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(addr, "@") {
+			return nil, errorf(n.line, "redirect: invalid address: %q", addr)
+		}
+		return redirectCmd{addr: addr}, nil
+	case "reject":
+		if err := c.need(n.line, "reject", n.name); err != nil {
+			return nil, err
+		}
+		reason, err := singleString(n, n.args)
+		if err != nil {
+			return nil, err
+		}
+		return rejectCmd{reason: reason}, nil
+	case "vacation":
+		if err := c.need(n.line, "vacation", n.name); err != nil {
+			return nil, err
+		}
+		return c.vacation(n)
+	}
+	return nil, errorf(n.line, "unknown command: %s", n.name)
+}
+
+func (c *compiler) vacation(n *cmdNode) (command, error) {
+	tags, pos, err := splitTags(n.line, n.args, map[string]argKind{
+		"days":      argNumber,
+		"subject":   argStrings,
+		"from":      argStrings,
+		"addresses": argStrings,
+		"handle":    argStrings,
+		"mime":      argTag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reason, err := singleString(n, pos)
+	if err != nil {
+		return nil, err
+	}
+
+	vac := Vacation{
+		Days:   DefaultVacationDays,
+		Reason: reason,
+	}
+	if a, ok := tags["days"]; ok {
+		vac.Days = int(a.num)
+		if vac.Days < MinVacationDays {
+			vac.Days = MinVacationDays
+		}
+		if vac.Days > MaxVacationDays {
+			vac.Days = MaxVacationDays
+		}
+	}
+	single := func(name string) (string, error) {
+		a, ok := tags[name]
+		if !ok {
+			return "", nil
+		}
+		if len(a.strs) != 1 {
+			return "", errorf(a.line, ":%s expects a single string", name)
+		}
+		return a.strs[0], nil
+	}
+	if vac.Subject, err = single("subject"); err != nil {
+		return nil, err
+	}
+	if vac.From, err = single("from"); err != nil {
+		return nil, err
+	}
+	if vac.Handle, err = single("handle"); err != nil {
+		return nil, err
+	}
+	if a, ok := tags["addresses"]; ok {
+		vac.Addresses = a.strs
+	}
+	_, vac.MIME = tags["mime"]
+
+	if vac.Handle == "" {
+		// RFC 5230, Section 4.2: Handle is derived from the arguments so
+		// changing the reply text resets the response tracking.
+		h := sha1.New()
+		for _, s := range []string{vac.Reason, vac.Subject, vac.From, fmt.Sprint(vac.MIME)} {
+			h.Write([]byte(s))
+			h.Write([]byte{0})
+		}
+		vac.Handle = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return vacationCmd{vac: vac}, nil
+}
+
+// splitTags separates tagged arguments from positional ones.
+//
+// spec maps the tag name to the kind of value it takes. argTag means the tag
+// does not take a value.
+func splitTags(line int, args []arg, spec map[string]argKind) (map[string]arg, []arg, error) {
+	tags := make(map[string]arg)
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a.kind != argTag {
+			return tags, args[i:], nil
+		}
+		kind, ok := spec[a.tag]
+		if !ok {
+			return nil, nil, errorf(a.line, "unexpected tag :%s", a.tag)
+		}
+		if _, dup := tags[a.tag]; dup {
+			return nil, nil, errorf(a.line, "duplicate tag :%s", a.tag)
+		}
+		if kind == argTag {
+			tags[a.tag] = a
+			continue
+		}
+		if i+1 >= len(args) || args[i+1].kind != kind {
+			return nil, nil, errorf(a.line, "missing or invalid value for :%s", a.tag)
+		}
+		i++
+		tags[a.tag] = args[i]
+	}
+	return tags, nil, nil
+}
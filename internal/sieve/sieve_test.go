@@ -0,0 +1,259 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sieve
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+func testMessage() Message {
+	hdr := textproto.Header{}
+	hdr.Add("From", "Alice Example <alice@example.org>")
+	hdr.Add("To", "bob@example.com, carol@example.net")
+	hdr.Add("Subject", "=?utf-8?q?Re:_Meeting_=C3=A0_la_plage?=")
+	hdr.Add("List-Id", "<dev.lists.example.org>")
+	return Message{
+		Header:       hdr,
+		Size:         2048,
+		EnvelopeFrom: "alice-bounces@example.org",
+		EnvelopeTo:   "bob@example.com",
+	}
+}
+
+func TestExecute(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		res    Result
+	}{
+		{
+			name:   "empty",
+			script: ``,
+			res:    Result{Keep: true},
+		},
+		{
+			name: "fileinto",
+			script: `require "fileinto";
+				if header :contains "list-id" "dev.lists" { fileinto "Lists/Dev"; }`,
+			res: Result{FileInto: []string{"Lists/Dev"}},
+		},
+		{
+			name: "fileinto and keep",
+			script: `require ["fileinto"];
+				fileinto "Archive"; keep;`,
+			res: Result{Keep: true, FileInto: []string{"Archive"}},
+		},
+		{
+			name:   "discard",
+			script: `if address :domain "from" "EXAMPLE.ORG" { discard; stop; } keep;`,
+			res:    Result{},
+		},
+		{
+			name:   "octet comparator",
+			script: `if address :comparator "i;octet" :domain "from" "EXAMPLE.ORG" { discard; }`,
+			res:    Result{Keep: true},
+		},
+		{
+			name: "elsif",
+			script: `require "fileinto";
+				if size :over 10K { fileinto "Big"; }
+				elsif size :over 1K { fileinto "Medium"; }
+				else { fileinto "Small"; }`,
+			res: Result{FileInto: []string{"Medium"}},
+		},
+		{
+			name:   "redirect",
+			script: `if anyof (false, header :matches "subject" "Re: *plage") { redirect "beach@example.org"; }`,
+			res:    Result{Redirect: []string{"beach@example.org"}},
+		},
+		{
+			name:   "redirect dedup",
+			script: `redirect "a@example.org"; redirect "a@example.org"; keep;`,
+			res:    Result{Keep: true, Redirect: []string{"a@example.org"}},
+		},
+		{
+			name: "envelope",
+			script: `require "envelope";
+				if allof (envelope :localpart :is "from" "alice-bounces", not exists "X-Spam") { discard; }`,
+			res: Result{},
+		},
+		{
+			name: "reject",
+			script: `require "reject";
+				if address :all :is "to" "carol@example.net" { reject text:
+I do not want
+.. your mail
+.
+; }`,
+			res: Result{Reject: true, RejectReason: "I do not want\r\n. your mail\r\n"},
+		},
+		{
+			name: "vacation",
+			script: `require "vacation";
+				vacation :days 100 :subject "Away" :handle "h" :addresses ["bob@example.net"] "I'm away";`,
+			res: Result{Keep: true, Vacation: &Vacation{
+				Days:      MaxVacationDays,
+				Subject:   "Away",
+				Addresses: []string{"bob@example.net"},
+				Handle:    "h",
+				Reason:    "I'm away",
+			}},
+		},
+		{
+			name: "comments",
+			script: `# comment
+				/* multi-line
+				   comment */ if true { discard; }`,
+			res: Result{},
+		},
+	}
+
+	for _, case_ := range cases {
+		case_ := case_
+		t.Run(case_.name, func(t *testing.T) {
+			s, err := Parse(case_.script)
+			if err != nil {
+				t.Fatal("Parse:", err)
+			}
+			res, err := s.Execute(testMessage())
+			if err != nil {
+				t.Fatal("Execute:", err)
+			}
+			if !reflect.DeepEqual(res, case_.res) {
+				t.Errorf("wrong result\nwant %+v\ngot  %+v", case_.res, res)
+			}
+		})
+	}
+}
+
+func TestExecute_VacationDefaultHandle(t *testing.T) {
+	exec := func(script string) *Vacation {
+		t.Helper()
+		s, err := Parse(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := s.Execute(testMessage())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Vacation
+	}
+
+	a := exec(`require "vacation"; vacation "Away";`)
+	b := exec(`require "vacation"; vacation :days 3 "Away";`)
+	c := exec(`require "vacation"; vacation "Away until Monday";`)
+	if a.Days != DefaultVacationDays {
+		t.Error("Wrong default days:", a.Days)
+	}
+	if a.Handle == "" || a.Handle != b.Handle {
+		t.Error("Handle should depend only on the reply content")
+	}
+	if a.Handle == c.Handle {
+		t.Error("Handle should change with the reply text")
+	}
+}
+
+func TestExecute_Errors(t *testing.T) {
+	for _, script := range []string{
+		`require "reject"; reject "no"; keep;`,
+		`require "reject"; reject "a"; reject "b";`,
+		`require "vacation"; vacation "a"; vacation "b";`,
+		`redirect "a@example.org"; redirect "b@example.org"; redirect "c@example.org";
+		 redirect "d@example.org"; redirect "e@example.org";`,
+	} {
+		s, err := Parse(script)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", script, err)
+		}
+		res, err := s.Execute(testMessage())
+		if err == nil {
+			t.Errorf("Execute(%q): expected error", script)
+		}
+		if !reflect.DeepEqual(res, Result{Keep: true}) {
+			t.Errorf("Execute(%q): expected implicit keep on error, got %+v", script, res)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	cases := map[string]string{
+		`fileinto "a";`:                               "line 1: fileinto requires \"fileinto\" capability",
+		`require "imap4flags";`:                       "unsupported capability",
+		`keep; require "fileinto";`:                   "require is allowed only",
+		"keep;\nelse { keep; }":                       "line 2: else without preceding if",
+		`if true { keep; } else { } else { }`:         "without preceding if",
+		`if true keep;`:                               "if requires a block",
+		`if true { keep }`:                            "expected ';'",
+		`if header :is :contains "a" "b" {}`:          "multiple match types",
+		`if header :is "a" { }`:                       "expects two string lists",
+		`if size 10 { }`:                              "size expects",
+		`if header :comparator "i;foo" "a" "b" {}`:    "unsupported comparator",
+		`if address :domain "from" "x" {} keep`:       "expected ';'",
+		`if allof true {}`:                            "expects a test list",
+		`if not (true) {}`:                            "not expects a single test",
+		`redirect "no-at-sign";`:                      "invalid address",
+		`require "vacation"; vacation :days "a" "b";`: "invalid value for :days",
+		`require "vacation"; vacation :foo "b";`:      "unexpected tag :foo",
+		`stop 1;`:                                     "does not accept arguments",
+		`foo;`:                                        "unknown command",
+		`if foo {}`:                                   "unknown test",
+		`if true { keep;`:                             "expected '}'",
+		`keep; /* unterminated`:                       "unterminated comment",
+		`reject "unterminated`:                        "unterminated string",
+		"require \"reject\";\nreject text:\nfoo\n":    "line 2: unterminated multi-line string",
+	}
+	for script, wantErr := range cases {
+		_, err := Parse(script)
+		if err == nil {
+			t.Errorf("Parse(%q): expected error", script)
+			continue
+		}
+		if !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("Parse(%q): expected error containing %q, got %v", script, wantErr, err)
+		}
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, value string
+		match          bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbb", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*@example.org", "user@example.org", true},
+		{`a\*c`, "a*c", true},
+		{`a\*c`, "abc", false},
+		{"*a*b", "xaxxab", true},
+		{"ä?", "äö", true},
+	}
+	for _, case_ := range cases {
+		if got := globMatch(case_.pattern, case_.value); got != case_.match {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", case_.pattern, case_.value, got, case_.match)
+		}
+	}
+}
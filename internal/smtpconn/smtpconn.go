@@ -25,6 +25,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 // - Wrapping of returned errors using the exterrors package.
 // - SMTPUTF8/IDNA support.
 // - TLS support mode (don't use, attempt, require).
+// - Recording of the SMTP dialogue for troubleshooting (Transcript).
 package smtpconn
 
 import (
@@ -78,7 +79,13 @@ type C struct {
 	// "ADDRESS said: ..."
 	AddrInSMTPMsg bool
 
+	// Form of domains in addresses sent to the server. U-labels are sent
+	// only if SMTPUTF8 is used for the message, A-labels are used otherwise.
+	DomainForm address.DomainForm
+
 	serverName string
+	utf8       bool
+	transcript *Transcript
 	cl         *smtp.Client
 	rcpts      []string
 }
@@ -96,6 +103,24 @@ func New() *C {
 	}
 }
 
+// SetTranscript makes C record the SMTP dialogue into t. Passing nil stops
+// the recording.
+//
+// If called before Connect, the dialogue is recorded starting from the
+// server greeting. If called for an existing connection, the recording is
+// continued in a new section of t.
+func (c *C) SetTranscript(t *Transcript) {
+	c.transcript = t
+	if c.cl == nil {
+		return
+	}
+	if t == nil {
+		c.cl.DebugWriter = nil
+		return
+	}
+	c.cl.DebugWriter = t.session("reusing connection to " + c.serverName)
+}
+
 func (c *C) wrapClientErr(err error, serverName string) error {
 	if err == nil {
 		return nil
@@ -204,10 +229,18 @@ func (err TLSError) Unwrap() error {
 func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint, starttls bool, tlsConfig *tls.Config) (didTLS bool, cl *smtp.Client, err error) {
 	var conn net.Conn
 
+	var ts *transcriptSession
+	if c.transcript != nil {
+		ts = c.transcript.session("connection to " + endp.Address())
+	}
+
 	dialCtx, cancel := context.WithTimeout(ctx, c.ConnectTimeout)
 	conn, err = c.Dialer(dialCtx, endp.Network(), endp.Address())
 	cancel()
 	if err != nil {
+		if ts != nil {
+			ts.note("connection failed: %v", err)
+		}
 		return false, nil, err
 	}
 
@@ -217,6 +250,12 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 		conn = tls.Client(conn, cfg)
 	}
 
+	var rc *recordingConn
+	if ts != nil {
+		rc = &recordingConn{Conn: conn, s: ts}
+		conn = rc
+	}
+
 	// This uses initial greeting timeout of 5 minutes (hardcoded).
 	if lmtp {
 		cl, err = smtp.NewClientLMTP(conn, endp.Host)
@@ -224,9 +263,18 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 		cl, err = smtp.NewClient(conn, endp.Host)
 	}
 	if err != nil {
+		if ts != nil {
+			ts.note("greeting failed: %v", err)
+		}
 		conn.Close()
 		return false, nil, err
 	}
+	if ts != nil {
+		// Further reads and writes are recorded by go-smtp. This also makes
+		// sure that TLS-encrypted data is not recorded after STARTTLS.
+		rc.stop()
+		cl.DebugWriter = ts
+	}
 
 	cl.CommandTimeout = c.CommandTimeout
 	cl.SubmissionTimeout = c.SubmissionTimeout
@@ -248,6 +296,9 @@ func (c *C) attemptConnect(ctx context.Context, lmtp bool, endp config.Endpoint,
 	cfg := tlsConfig.Clone()
 	cfg.ServerName = endp.Host
 	if err := cl.StartTLS(cfg); err != nil {
+		if ts != nil {
+			ts.note("TLS handshake failed: %v", err)
+		}
 		// After the handshake failure, the connection may be in a bad state.
 		// We attempt to send the proper QUIT command though, in case the error happened
 		// *after* the handshake (e.g. PKI verification fail), we don't log the error in
@@ -287,19 +338,22 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 	if opts.UTF8 {
 		if ok, _ := c.cl.Extension("SMTPUTF8"); ok {
 			outOpts.UTF8 = true
-		} else {
-			var err error
-			from, err = address.ToASCII(from)
-			if err != nil {
-				return &exterrors.SMTPError{
-					Code:         550,
-					EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
-					Message:      "SMTPUTF8 is unsupported, cannot convert sender address",
-					Misc: map[string]interface{}{
-						"remote_server": c.serverName,
-					},
-					Err: err,
-				}
+		}
+	}
+	c.utf8 = outOpts.UTF8
+
+	if from != "" {
+		var err error
+		from, err = c.wireAddr(from)
+		if err != nil {
+			return &exterrors.SMTPError{
+				Code:         550,
+				EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
+				Message:      "SMTPUTF8 is unsupported, cannot convert sender address",
+				Misc: map[string]interface{}{
+					"remote_server": c.serverName,
+				},
+				Err: err,
 			}
 		}
 	}
@@ -312,7 +366,23 @@ func (c *C) Mail(ctx context.Context, from string, opts smtp.MailOptions) error
 	return nil
 }
 
+// wireAddr converts the address into the form sent to the server.
+//
+// Addresses are normalized to U-labels by endpoints, so they have to be
+// converted back to A-labels if SMTPUTF8 is not used even if the client
+// sent them in the A-label form.
+func (c *C) wireAddr(addr string) (string, error) {
+	if !c.utf8 {
+		return address.ToASCII(addr)
+	}
+	if c.DomainForm == address.FormASCII {
+		return address.Canonical(addr, address.FormASCII)
+	}
+	return addr, nil
+}
+
 // Rcpts returns the list of recipients that were accepted by the remote server.
+// Addresses are returned as they were passed to Rcpt.
 func (c *C) Rcpts() []string {
 	return c.rcpts
 }
@@ -332,24 +402,20 @@ func (c *C) Client() *smtp.Client {
 func (c *C) Rcpt(ctx context.Context, to string) error {
 	defer trace.StartRegion(ctx, "smtpconn/RCPT TO").End()
 
-	// If necessary, the extension flag is enabled in Start.
-	if ok, _ := c.cl.Extension("SMTPUTF8"); !address.IsASCII(to) && !ok {
-		var err error
-		to, err = address.ToASCII(to)
-		if err != nil {
-			return &exterrors.SMTPError{
-				Code:         553,
-				EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
-				Message:      "SMTPUTF8 is unsupported, cannot convert recipient address",
-				Misc: map[string]interface{}{
-					"remote_server": c.serverName,
-				},
-				Err: err,
-			}
+	wireTo, err := c.wireAddr(to)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         553,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 7},
+			Message:      "SMTPUTF8 is unsupported, cannot convert recipient address",
+			Misc: map[string]interface{}{
+				"remote_server": c.serverName,
+			},
+			Err: err,
 		}
 	}
 
-	if err := c.cl.Rcpt(to); err != nil {
+	if err := c.cl.Rcpt(wireTo); err != nil {
 		return c.wrapClientErr(err, c.serverName)
 	}
 
@@ -25,6 +25,7 @@ import (
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/internal/testutils"
@@ -52,6 +53,9 @@ func TestSMTPUTF8(t *testing.T) {
 	type test struct {
 		clientSender string
 		clientRcpt   string
+		// Message does not use SMTPUTF8.
+		clientASCII bool
+		domainForm  address.DomainForm
 
 		serverUTF8   bool
 		serverSender string
@@ -70,6 +74,7 @@ func TestSMTPUTF8(t *testing.T) {
 
 		c := New()
 		c.Log = testutils.Logger(t, "target.smtp")
+		c.DomainForm = case_.domainForm
 		if _, err := c.Connect(context.Background(), config.Endpoint{
 			Scheme: "tcp",
 			Host:   "127.0.0.1",
@@ -80,7 +85,7 @@ func TestSMTPUTF8(t *testing.T) {
 		defer c.Close()
 
 		err := doTestDelivery(t, c, case_.clientSender, []string{case_.clientRcpt},
-			smtp.MailOptions{UTF8: true})
+			smtp.MailOptions{UTF8: !case_.clientASCII})
 		if err != nil {
 			if case_.expectErr == nil {
 				t.Error("Unexpected failure")
@@ -162,4 +167,21 @@ func TestSMTPUTF8(t *testing.T) {
 		serverUTF8:   true,
 		expectUTF8:   true,
 	})
+	check(test{
+		clientSender: "test@тест.org",
+		clientRcpt:   "test@тест.example.invalid",
+		clientASCII:  true,
+		serverSender: "test@xn--e1aybc.org",
+		serverRcpt:   "test@xn--e1aybc.example.invalid",
+		serverUTF8:   true,
+	})
+	check(test{
+		clientSender: "тест@тест.org",
+		clientRcpt:   "test@ТЕСТ.example.invalid",
+		domainForm:   address.FormASCII,
+		serverSender: "тест@xn--e1aybc.org",
+		serverRcpt:   "test@xn--e1aybc.example.invalid",
+		serverUTF8:   true,
+		expectUTF8:   true,
+	})
 }
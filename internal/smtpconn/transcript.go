@@ -0,0 +1,242 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtpconn
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// maxTranscriptLine is the maximum length of the recorded line, longer lines
+// are truncated.
+const maxTranscriptLine = 1024
+
+// Transcript records the SMTP dialogue of one or more connections.
+//
+// Message data sent after the DATA command is not recorded, only its size.
+// Credentials sent during SASL authentication are replaced with
+// "<redacted>".
+//
+// Transcript is safe for concurrent use, each connection is recorded as a
+// separate section.
+type Transcript struct {
+	mu       sync.Mutex
+	sessions []*transcriptSession
+}
+
+type transcriptSession struct {
+	t     *Transcript
+	title string
+	lines []string
+
+	partial   []byte
+	truncated bool
+
+	inData    bool
+	dataBytes int
+	inAuth    bool
+}
+
+type transcriptKey struct{}
+
+// WithTranscript returns the context that makes connections created by the
+// delivery targets record the SMTP dialogue into t.
+func WithTranscript(ctx context.Context, t *Transcript) context.Context {
+	return context.WithValue(ctx, transcriptKey{}, t)
+}
+
+// TranscriptFromContext returns the Transcript set using WithTranscript or
+// nil.
+func TranscriptFromContext(ctx context.Context) *Transcript {
+	t, _ := ctx.Value(transcriptKey{}).(*Transcript)
+	return t
+}
+
+func (t *Transcript) session(title string) *transcriptSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := &transcriptSession{t: t, title: title}
+	t.sessions = append(t.sessions, s)
+	return s
+}
+
+// Empty reports whether nothing was recorded.
+func (t *Transcript) Empty() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.sessions) == 0
+}
+
+// String returns the recorded dialogue. Lines sent by the client are prefixed
+// with "C: ", lines sent by the server are prefixed with "S: ".
+func (t *Transcript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var sb strings.Builder
+	for _, s := range t.sessions {
+		sb.WriteString("* ")
+		sb.WriteString(s.title)
+		sb.WriteString("\n")
+		for _, l := range s.lines {
+			sb.WriteString(l)
+			sb.WriteString("\n")
+		}
+		if len(s.partial) != 0 {
+			sb.WriteString("?: ")
+			sb.Write(s.partial)
+			sb.WriteString(" [incomplete]\n")
+		}
+	}
+	return sb.String()
+}
+
+func (s *transcriptSession) note(format string, args ...interface{}) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.lines = append(s.lines, "* "+fmt.Sprintf(format, args...))
+}
+
+// Write consumes the raw data sent over the connection in both directions.
+//
+// go-smtp client logs both directions into the same io.Writer, so direction
+// is determined from the line contents: server replies start with a
+// three-digit code. This is not ambiguous since the protocol is lock-step
+// and data that can look like a reply (message body and SASL responses) is
+// tracked separately.
+func (s *transcriptSession) Write(b []byte) (int, error) {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+
+	n := len(b)
+	for len(b) != 0 {
+		var chunk []byte
+		if i := bytes.IndexByte(b, '\n'); i != -1 {
+			chunk, b = b[:i+1], b[i+1:]
+		} else {
+			chunk, b = b, nil
+		}
+
+		if s.inData {
+			s.dataBytes += len(chunk)
+		}
+		if room := maxTranscriptLine - len(s.partial); room < len(chunk) {
+			if room > 0 {
+				s.partial = append(s.partial, chunk[:room]...)
+			}
+			s.truncated = true
+		} else {
+			s.partial = append(s.partial, chunk...)
+		}
+
+		if chunk[len(chunk)-1] != '\n' {
+			continue
+		}
+		s.line(strings.TrimRight(string(s.partial), "\r\n"))
+		s.partial = s.partial[:0]
+		s.truncated = false
+	}
+	return n, nil
+}
+
+func (s *transcriptSession) line(l string) {
+	if s.inData {
+		if l == "." && !s.truncated {
+			s.lines = append(s.lines,
+				fmt.Sprintf("C: <message data, %d bytes>", s.dataBytes-len(".\r\n")),
+				"C: .")
+			s.inData = false
+			s.dataBytes = 0
+		}
+		return
+	}
+
+	if s.truncated {
+		l += " [truncated]"
+	}
+	s.lines = append(s.lines, s.classify(l))
+}
+
+func (s *transcriptSession) classify(l string) string {
+	if isReply(l) && !s.inAuth {
+		switch {
+		case strings.HasPrefix(l, "354"):
+			s.inData = true
+		case strings.HasPrefix(l, "334"):
+			s.inAuth = true
+		}
+		return "S: " + l
+	}
+
+	if s.inAuth {
+		// Client response to the SASL challenge.
+		s.inAuth = false
+		if l == "*" {
+			return "C: *"
+		}
+		return "C: <redacted>"
+	}
+
+	if fields := strings.Fields(l); len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		// Initial response.
+		return "C: " + fields[0] + " " + fields[1] + " <redacted>"
+	}
+
+	return "C: " + l
+}
+
+func isReply(l string) bool {
+	if len(l) < 3 {
+		return false
+	}
+	for _, ch := range l[:3] {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return len(l) == 3 || l[3] == ' ' || l[3] == '-'
+}
+
+// recordingConn passes the data read from the connection to the transcript
+// until stop is called.
+//
+// It is used to record the server greeting that is read by go-smtp before
+// it is possible to set Client.DebugWriter.
+type recordingConn struct {
+	net.Conn
+	s       *transcriptSession
+	stopped bool
+}
+
+func (rc *recordingConn) Read(b []byte) (int, error) {
+	n, err := rc.Conn.Read(b)
+	if n > 0 && !rc.stopped {
+		rc.s.Write(b[:n])
+	}
+	return n, err
+}
+
+func (rc *recordingConn) stop() {
+	rc.stopped = true
+}
@@ -0,0 +1,131 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtpconn
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestTranscript(t *testing.T) {
+	_, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	tr := &Transcript{}
+	c := New()
+	c.Log = testutils.Logger(t, "smtpconn")
+	c.SetTranscript(tr)
+	if _, err := c.Connect(context.Background(), config.Endpoint{
+		Scheme: "tcp",
+		Host:   "127.0.0.1",
+		Port:   testPort,
+	}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := doTestDelivery(t, c, "test@example.org", []string{"rcpt@example.invalid"}, smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	c.SetTranscript(nil)
+	c.Close()
+
+	lines := strings.Split(strings.TrimSpace(tr.String()), "\n")
+	if !strings.HasPrefix(lines[0], "* connection to 127.0.0.1:"+testPort) {
+		t.Error("Wrong section title:", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "S: 220 ") {
+		t.Error("Greeting is not recorded:", lines[1])
+	}
+	for _, expected := range []string{
+		"C: MAIL FROM:<test@example.org> BODY=8BITMIME",
+		"C: RCPT TO:<rcpt@example.invalid>",
+		"C: DATA",
+		"C: <message data, 22 bytes>",
+		"C: .",
+	} {
+		found := false
+		for _, l := range lines {
+			if l == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Missing line %q in transcript:\n%s", expected, tr.String())
+		}
+	}
+	for _, l := range lines {
+		if l == "C: QUIT" || strings.Contains(l, "foobar") {
+			t.Errorf("Unexpected line %q in transcript", l)
+		}
+	}
+}
+
+func TestTranscript_Redaction(t *testing.T) {
+	tr := &Transcript{}
+	s := tr.session("test")
+	for _, chunk := range []string{
+		"220 mx.example.org ESMTP\r\n",
+		"AUTH PLAIN AHVzZXIAcGFzcw==\r\n",
+		"235 2.7.0 OK\r\n",
+		"AUTH LOGIN\r\n",
+		"334 VXNlcm5hbWU6\r\n",
+		"dXNlcg==\r\n",
+		"334 UGFzc3dvcmQ6\r\n",
+		"123 not a reply\r\n",
+		"535 5.7.8 Invalid credentials\r\n",
+		"DATA\r\n",
+		"354 Go ahead\r\n",
+		"Subject: secret\r\n\r\n200 OK\r\n..\r\n",
+		"more text without a line end",
+		"\r\n.\r\n",
+		"250 2.0.0 OK\r\n",
+		"QUIT",
+	} {
+		if _, err := s.Write([]byte(chunk)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := strings.Join([]string{
+		"* test",
+		"S: 220 mx.example.org ESMTP",
+		"C: AUTH PLAIN <redacted>",
+		"S: 235 2.7.0 OK",
+		"C: AUTH LOGIN",
+		"S: 334 VXNlcm5hbWU6",
+		"C: <redacted>",
+		"S: 334 UGFzc3dvcmQ6",
+		"C: <redacted>",
+		"S: 535 5.7.8 Invalid credentials",
+		"C: DATA",
+		"S: 354 Go ahead",
+		"C: <message data, 61 bytes>",
+		"C: .",
+		"S: 250 2.0.0 OK",
+		"?: QUIT [incomplete]",
+	}, "\n") + "\n"
+	if actual := tr.String(); actual != expected {
+		t.Errorf("Wrong transcript:\n%s\nExpected:\n%s", actual, expected)
+	}
+}
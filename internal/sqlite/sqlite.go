@@ -0,0 +1,91 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package sqlite contains helpers for safe use of the SQLite database shared
+// by multiple processes, e.g. the server and maddyctl.
+//
+// SQLite handles concurrent access to the database itself, but connections
+// fail with "database is locked" errors immediately unless the busy timeout
+// is set. Additionally, schema creation and migrations done by different
+// processes at the same time can conflict, so they are serialized using an
+// advisory lock on the separate lock file.
+package sqlite
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBusyTimeout is the default amount of milliseconds to wait for the
+// database lock.
+const DefaultBusyTimeout = 5000
+
+// DefaultLockTimeout is the default amount of time to wait for the schema
+// lock held by another process.
+const DefaultLockTimeout = 30 * time.Second
+
+// ErrLockTimeout is returned by LockSchema if the lock is not acquired in
+// time.
+var ErrLockTimeout = errors.New("sqlite: timed out waiting for the schema lock")
+
+// Path returns the database file path from the go-sqlite3 DSN. Empty string
+// is returned for in-memory databases.
+func Path(dsn string) string {
+	dsn = strings.TrimPrefix(dsn, "file:")
+	if idx := strings.IndexByte(dsn, '?'); idx != -1 {
+		dsn = dsn[:idx]
+	}
+	if dsn == "" || strings.HasPrefix(dsn, ":memory:") {
+		return ""
+	}
+	return dsn
+}
+
+// WithBusyTimeout adds the busy timeout (in milliseconds) parameter to the
+// go-sqlite3 DSN unless it is already set.
+func WithBusyTimeout(dsn string, timeout int) string {
+	// Also matches _timeout, the alias used by go-sqlite3.
+	if strings.Contains(dsn, "_timeout=") {
+		return dsn
+	}
+	if !strings.Contains(dsn, "?") {
+		return dsn + "?_busy_timeout=" + strconv.Itoa(timeout)
+	}
+	return dsn + "&_busy_timeout=" + strconv.Itoa(timeout)
+}
+
+// LockSchema acquires the exclusive advisory lock for schema changes of the
+// database. The returned function should be called to release it.
+//
+// The lock is held on the file next to the database with the .lock
+// extension. For in-memory databases locking is not done.
+func LockSchema(dsn string, timeout time.Duration) (func(), error) {
+	path := Path(dsn)
+	if path == "" {
+		return func() {}, nil
+	}
+
+	unlock, err := lockFile(path+".lock", timeout)
+	if err != nil {
+		return nil, fmt.Errorf("sqlite: %w", err)
+	}
+	return unlock, nil
+}
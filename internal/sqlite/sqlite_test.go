@@ -0,0 +1,87 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package sqlite
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestPath(t *testing.T) {
+	for dsn, want := range map[string]string{
+		"maddy.db":                       "maddy.db",
+		"/var/lib/maddy/imapsql.db":      "/var/lib/maddy/imapsql.db",
+		"file:test.db?cache=shared":      "test.db",
+		":memory:":                       "",
+		"file::memory:?cache=shared":     "",
+		"file:/tmp/a.db?_busy_timeout=5": "/tmp/a.db",
+	} {
+		if got := Path(dsn); got != want {
+			t.Errorf("%s: want %q, got %q", dsn, want, got)
+		}
+	}
+}
+
+func TestWithBusyTimeout(t *testing.T) {
+	for dsn, want := range map[string]string{
+		"maddy.db":                    "maddy.db?_busy_timeout=5000",
+		"file:test.db?cache=shared":   "file:test.db?cache=shared&_busy_timeout=5000",
+		"maddy.db?_busy_timeout=100":  "maddy.db?_busy_timeout=100",
+		"maddy.db?_timeout=100&_fk=1": "maddy.db?_timeout=100&_fk=1",
+	} {
+		if got := WithBusyTimeout(dsn, DefaultBusyTimeout); got != want {
+			t.Errorf("%s: want %q, got %q", dsn, want, got)
+		}
+	}
+}
+
+func TestLockSchema(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("advisory locking is not implemented on Windows")
+	}
+
+	dsn := filepath.Join(testutils.Dir(t), "test.db")
+
+	unlock, err := LockSchema(dsn, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LockSchema(dsn, 100*time.Millisecond); err == nil {
+		t.Fatal("lock is acquired twice")
+	}
+
+	unlock()
+
+	unlock, err = LockSchema(dsn, time.Second)
+	if err != nil {
+		t.Fatal("lock is not released:", err)
+	}
+	unlock()
+
+	unlock, err = LockSchema(":memory:", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
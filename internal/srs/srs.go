@@ -0,0 +1,191 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package srs implements the Sender Rewriting Scheme used to preserve SPF
+// alignment for forwarded messages.
+//
+// The address format is compatible with libsrs2 (used by postsrsd):
+//
+//	SRS0=HHHH=TT=orig-domain=orig-local@forwarder-domain
+//	SRS1=HHHH=first-forwarder-domain==HHHH=TT=orig-domain=orig-local@forwarder-domain
+//
+// where TT is the timestamp (days since epoch modulo 1024 encoded using
+// base32) and HHHH is the beginning of base64-encoded HMAC-SHA1 over the rest
+// of the address, lower-cased.
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+const (
+	hashLen      = 4
+	timeAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timeSlots    = 1024
+)
+
+var (
+	ErrNotSRS    = errors.New("srs: address is not rewritten")
+	ErrMalformed = errors.New("srs: malformed address")
+	ErrExpired   = errors.New("srs: address expired")
+	ErrBadHash   = errors.New("srs: hash mismatch")
+)
+
+func hash(key []byte, parts ...string) string {
+	mac := hmac.New(sha1.New, key)
+	for _, p := range parts {
+		mac.Write([]byte(strings.ToLower(p)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLen]
+}
+
+func checkHash(keys [][]byte, got string, parts ...string) error {
+	for _, key := range keys {
+		// Compared case-insensitively since some MTAs lower-case addresses.
+		if strings.EqualFold(got, hash(key, parts...)) {
+			return nil
+		}
+	}
+	return ErrBadHash
+}
+
+func timestamp(t time.Time) string {
+	day := int(t.Unix()/(24*60*60)) % timeSlots
+	return string([]byte{timeAlphabet[(day>>5)&31], timeAlphabet[day&31]})
+}
+
+func checkTimestamp(ts string, now time.Time, maxAge time.Duration) error {
+	if len(ts) != 2 {
+		return ErrMalformed
+	}
+	day := 0
+	for _, c := range strings.ToUpper(ts) {
+		i := strings.IndexRune(timeAlphabet, c)
+		if i == -1 {
+			return ErrMalformed
+		}
+		day = day<<5 | i
+	}
+
+	today := int(now.Unix()/(24*60*60)) % timeSlots
+	age := (today - day + timeSlots) % timeSlots
+	if age > int(maxAge/(24*time.Hour)) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// IsSRS checks whether the address local-part uses SRS0 or SRS1 format.
+func IsSRS(addr string) bool {
+	mbox, _, err := address.Split(addr)
+	if err != nil || len(mbox) < 5 {
+		return false
+	}
+	prefix := strings.ToUpper(mbox[:4])
+	return (prefix == "SRS0" || prefix == "SRS1") && isSep(mbox[4])
+}
+
+func isSep(c byte) bool {
+	return c == '=' || c == '+' || c == '-'
+}
+
+// Forward rewrites the address so it belongs to the domain.
+//
+// The first key is used for signing. SRS0 addresses of other forwarders are
+// converted to SRS1 and SRS1 addresses keep the original first forwarder
+// domain so the address does not grow with each hop. Null address is
+// returned unchanged.
+func Forward(keys [][]byte, addr, domain string, now time.Time) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	if len(keys) == 0 {
+		return "", errors.New("srs: no keys")
+	}
+	mbox, mboxDomain, err := address.Split(addr)
+	if err != nil {
+		return "", err
+	}
+	if mboxDomain == "" {
+		return "", ErrMalformed
+	}
+
+	if IsSRS(addr) {
+		switch strings.ToUpper(mbox[:4]) {
+		case "SRS0":
+			// Keep the separator used by the first forwarder.
+			rest := mbox[4:]
+			return "SRS1=" + hash(keys[0], mboxDomain, rest) + "=" + mboxDomain + "=" + rest + "@" + domain, nil
+		case "SRS1":
+			parts := strings.SplitN(mbox[5:], "=", 3)
+			if len(parts) == 3 && parts[1] != "" {
+				firstDomain, rest := parts[1], parts[2]
+				return "SRS1=" + hash(keys[0], firstDomain, rest) + "=" + firstDomain + "=" + rest + "@" + domain, nil
+			}
+			// Malformed, treat as a regular address.
+		}
+	}
+
+	ts := timestamp(now)
+	return "SRS0=" + hash(keys[0], ts, mboxDomain, mbox) + "=" + ts + "=" + mboxDomain + "=" + mbox + "@" + domain, nil
+}
+
+// Reverse returns the address the SRS address was created from.
+//
+// For SRS0 addresses it is the original sender address, timestamp is checked
+// using maxAge. For SRS1 addresses it is the SRS0 address of the first
+// forwarder.
+func Reverse(keys [][]byte, addr string, now time.Time, maxAge time.Duration) (string, error) {
+	if !IsSRS(addr) {
+		return addr, ErrNotSRS
+	}
+	mbox, _, _ := address.Split(addr)
+
+	switch strings.ToUpper(mbox[:4]) {
+	case "SRS0":
+		parts := strings.SplitN(mbox[5:], "=", 4)
+		if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+			return addr, ErrMalformed
+		}
+		hashVal, ts, origDomain, origMbox := parts[0], parts[1], parts[2], parts[3]
+		if err := checkHash(keys, hashVal, ts, origDomain, origMbox); err != nil {
+			return addr, err
+		}
+		if err := checkTimestamp(ts, now, maxAge); err != nil {
+			return addr, err
+		}
+		return origMbox + "@" + origDomain, nil
+	default: // SRS1
+		parts := strings.SplitN(mbox[5:], "=", 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return addr, ErrMalformed
+		}
+		hashVal, firstDomain, rest := parts[0], parts[1], parts[2]
+		if err := checkHash(keys, hashVal, firstDomain, rest); err != nil {
+			return addr, err
+		}
+		return "SRS0" + rest + "@" + firstDomain, nil
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardReverse(t *testing.T) {
+	keys := [][]byte{[]byte("0123456789abcdef"), []byte("fedcba9876543210")}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	maxAge := 21 * 24 * time.Hour
+
+	rewritten, err := Forward(keys, "User@example.org", "forwarder.example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "=example.org=User@forwarder.example.com") {
+		t.Fatal("malformed rewritten address:", rewritten)
+	}
+
+	orig, err := Reverse(keys, rewritten, now.Add(10*24*time.Hour), maxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "User@example.org" {
+		t.Fatal("wrong original address:", orig)
+	}
+	if _, err := Reverse(keys, strings.ToLower(rewritten), now, maxAge); err != nil {
+		t.Error("hash verification is case-sensitive:", err)
+	}
+
+	if _, err := Reverse(keys, rewritten, now.Add(22*24*time.Hour), maxAge); !errors.Is(err, ErrExpired) {
+		t.Error("expired address accepted:", err)
+	}
+	if _, err := Reverse(keys[1:], rewritten, now, maxAge); !errors.Is(err, ErrBadHash) {
+		t.Error("address signed using other key accepted:", err)
+	}
+	forged := strings.Replace(rewritten, "=User@", "=other@", 1)
+	if _, err := Reverse(keys, forged, now, maxAge); !errors.Is(err, ErrBadHash) {
+		t.Error("address for other sender accepted:", err)
+	}
+	if _, err := Reverse(keys, "user@example.org", now, maxAge); !errors.Is(err, ErrNotSRS) {
+		t.Error("regular address accepted:", err)
+	}
+	if _, err := Reverse(keys, "SRS0=abcd@forwarder.example.com", now, maxAge); !errors.Is(err, ErrMalformed) {
+		t.Error("malformed address accepted:", err)
+	}
+
+	if null, err := Forward(keys, "", "forwarder.example.com", now); err != nil || null != "" {
+		t.Error("null address is rewritten:", null, err)
+	}
+}
+
+func TestForwardReverse_SRS1(t *testing.T) {
+	keys1 := [][]byte{[]byte("0123456789abcdef")}
+	keys2 := [][]byte{[]byte("fedcba9876543210")}
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	srs0, err := Forward(keys1, "user@example.org", "first.example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs1, err := Forward(keys2, srs0, "second.example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=first.example.com==") {
+		t.Fatal("malformed SRS1 address:", srs1)
+	}
+
+	// Third forwarder keeps the first one.
+	srs1Again, err := Forward(keys1, srs1, "third.example.com", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(srs1Again, "=first.example.com==") || strings.Contains(srs1Again, "second.example.com") {
+		t.Fatal("malformed SRS1 address:", srs1Again)
+	}
+
+	back, err := Reverse(keys2, srs1, now, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back != srs0 {
+		t.Fatalf("wrong reversed address, want %s, got %s", srs0, back)
+	}
+	orig, err := Reverse(keys1, back, now, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orig != "user@example.org" {
+		t.Fatal("wrong original address:", orig)
+	}
+}
@@ -1,4 +1,5 @@
-//+build cgo,!no_sqlite3
+//go:build cgo && !no_sqlite3
+// +build cgo,!no_sqlite3
 
 package blob
 
@@ -7,10 +8,10 @@ import (
 	"testing"
 
 	backendtests "github.com/foxcpp/go-imap-backend-tests"
-	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/framework/module"
 	imapsql2 "github.com/foxcpp/maddy/internal/storage/imapsql"
 	"github.com/foxcpp/maddy/internal/testutils"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
 )
 
 type testBack struct {
@@ -21,15 +21,18 @@ package imapsql
 import (
 	"context"
 	"runtime/trace"
+	"time"
 
 	specialuse "github.com/emersion/go-imap-specialuse"
 	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-message/textproto"
-	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/maintenance"
+	"github.com/foxcpp/maddy/internal/sieve"
 	"github.com/foxcpp/maddy/internal/target"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
 )
 
 type delivery struct {
@@ -39,6 +42,44 @@ type delivery struct {
 	mailFrom string
 
 	addedRcpts map[string]struct{}
+
+	// Recipients with forwarding rules, Sieve scripts or out-of-office
+	// settings. They are added to
+	// d.d only after the message header is available and rules are
+	// evaluated.
+	pendingRcpts []pendingRcpt
+	forwardTo    []forwardAddr
+	forwardedBy  []string
+	fwd          module.Delivery
+
+	// Subaddresses of recipients (see subaddress_delimiter).
+	subaddrs map[string]string
+	// Mailboxes selected by Sieve scripts for the copy stored using d.d.
+	sieveMboxes map[string]string
+	// Additional copies requested by Sieve scripts, stored on Commit.
+	copies       []mboxCopy
+	header       textproto.Header
+	body         buffer.Buffer
+	replies      []module.Delivery
+	vacationSent []vacationRecord
+}
+
+type pendingRcpt struct {
+	accountName string
+	userHeader  textproto.Header
+	rules       []ForwardRule
+	script      *sieve.Script
+	vacation    *VacationSettings
+}
+
+type mboxCopy struct {
+	rcpt    pendingRcpt
+	mailbox string
+}
+
+type forwardAddr struct {
+	user string
+	to   string
 }
 
 func (d *delivery) String() string {
@@ -67,12 +108,71 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 		return nil
 	}
 
+	deactivated, err := d.store.DeactivatedIMAPAcct(accountName)
+	if err != nil {
+		return err
+	}
+	if deactivated != nil {
+		return deactivatedRcptErr(deactivated)
+	}
+
+	// Subaddress is usually removed by rewrites before the message gets
+	// here, so also check the address used by the client.
+	subaddr := d.store.subaddress(rcptTo)
+	if subaddr == "" {
+		if original, ok := d.msgMeta.OriginalRcpts[rcptTo]; ok {
+			subaddr = d.store.subaddress(original)
+		}
+	}
+	if subaddr != "" {
+		if d.subaddrs == nil {
+			d.subaddrs = make(map[string]string)
+		}
+		d.subaddrs[accountName] = subaddr
+	}
+
 	// This header is added to the message only for that recipient.
 	// go-imap-sql does certain optimizations to store the message
 	// with small amount of per-recipient data in a efficient way.
 	userHeader := textproto.Header{}
 	userHeader.Add("Delivered-To", accountName)
 
+	var rules []ForwardRule
+	if d.store.forwardTarget != nil {
+		rules, err = d.store.ForwardRules(accountName)
+		if err != nil {
+			return err
+		}
+	}
+	script, err := d.store.loadSieveScript(accountName)
+	if err != nil {
+		return err
+	}
+	vacation, err := d.store.loadVacation(accountName)
+	if err != nil {
+		return err
+	}
+	if len(rules) != 0 || script != nil || vacation != nil {
+		d.pendingRcpts = append(d.pendingRcpts, pendingRcpt{
+			accountName: accountName,
+			userHeader:  userHeader,
+			rules:       rules,
+			script:      script,
+			vacation:    vacation,
+		})
+		d.addedRcpts[accountName] = struct{}{}
+		return nil
+	}
+
+	if err := d.addLocalRcpt(accountName, userHeader); err != nil {
+		return err
+	}
+
+	d.addedRcpts[accountName] = struct{}{}
+	return nil
+}
+
+func (d *delivery) addLocalRcpt(accountName string, userHeader textproto.Header) error {
 	if err := d.d.AddRcpt(accountName, userHeader); err != nil {
 		if err == imapsql.ErrUserDoesntExists || err == backend.ErrNoSuchMailbox {
 			return userDoesNotExist(err)
@@ -88,22 +188,116 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 		}
 		return err
 	}
+	return nil
+}
 
-	d.addedRcpts[accountName] = struct{}{}
+// applyForwarding evaluates forwarding rules and Sieve scripts of pending
+// recipients and adds recipients that should keep the local copy to the
+// delivery.
+func (d *delivery) applyForwarding(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	for _, rcpt := range d.pendingRcpts {
+		keepCopy := true
+		var addrs []string
+
+		// Quarantined messages are never forwarded. Neither are messages
+		// that were already delivered to that user once - this is
+		// a forwarding loop.
+		looped := target.DeliveredTo(header, rcpt.accountName)
+		if !d.msgMeta.Quarantine && !looped {
+			addrs, keepCopy = forwardAddrs(rcpt.rules, d.mailFrom, header)
+		}
+		if looped {
+			d.store.Log.Msg("forwarding loop detected, keeping local copy", "msg_id", d.msgMeta.ID, "username", rcpt.accountName)
+		}
+
+		for _, addr := range addrs {
+			d.forwardTo = append(d.forwardTo, forwardAddr{user: rcpt.accountName, to: addr})
+		}
+		if len(addrs) != 0 {
+			d.forwardedBy = append(d.forwardedBy, rcpt.accountName)
+		}
+
+		// Sieve script is executed and out-of-office response is sent only
+		// for messages that are stored locally.
+		mboxes := []string{""}
+		if keepCopy && !d.msgMeta.Quarantine && !looped {
+			var err error
+			if rcpt.script != nil {
+				mboxes, err = d.runSieve(ctx, rcpt, header, body)
+			} else if rcpt.vacation != nil {
+				err = d.sendVacation(ctx, rcpt.accountName, rcpt.vacation.action(), header)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		if !keepCopy || len(mboxes) == 0 {
+			delete(d.addedRcpts, rcpt.accountName)
+			continue
+		}
+		if mboxes[0] != "" {
+			if err := d.store.prepareSieveMailbox(rcpt.accountName, mboxes[0]); err != nil {
+				return err
+			}
+			if d.sieveMboxes == nil {
+				d.sieveMboxes = make(map[string]string)
+			}
+			d.sieveMboxes[rcpt.accountName] = mboxes[0]
+		}
+		for _, mbox := range mboxes[1:] {
+			d.copies = append(d.copies, mboxCopy{rcpt: rcpt, mailbox: mbox})
+		}
+		if err := d.addLocalRcpt(rcpt.accountName, rcpt.userHeader); err != nil {
+			return err
+		}
+	}
+	d.pendingRcpts = nil
 	return nil
 }
 
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
 	defer trace.StartRegion(ctx, "sql/Body").End()
 
-	if !d.msgMeta.Quarantine && d.store.filters != nil {
-		for rcpt := range d.addedRcpts {
-			folder, flags, err := d.store.filters.IMAPFilter(rcpt, d.msgMeta, header, body)
-			if err != nil {
-				d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
-				continue
+	if err := d.applyForwarding(ctx, header, body); err != nil {
+		return err
+	}
+
+	// Folder selection order: Sieve fileinto, imap_filter, subaddress.
+	// Quarantined messages always go to Junk.
+	var subaddrMboxes map[string]string
+	if !d.msgMeta.Quarantine && len(d.subaddrs) != 0 {
+		subaddrMboxes = d.subaddressMailboxes()
+		for rcpt, mbox := range subaddrMboxes {
+			d.d.UserMailbox(rcpt, mbox, nil)
+		}
+	}
+	for rcpt, mbox := range d.sieveMboxes {
+		d.d.UserMailbox(rcpt, mbox, nil)
+	}
+
+	if !d.msgMeta.Quarantine && d.store.filters != nil && len(d.addedRcpts) != 0 {
+		// Per-message work of filters (e.g. body parsing) is done once,
+		// only folder and flags selection is done for each recipient.
+		filterState, err := module.IMAPFilterStateForMsg(d.store.filters, d.msgMeta, header, body)
+		if err != nil {
+			d.store.Log.Error("IMAPFilter failed", err, "msg_id", d.msgMeta.ID)
+		} else {
+			for rcpt := range d.addedRcpts {
+				folder, flags, err := filterState.IMAPFilter(rcpt)
+				if err != nil {
+					d.store.Log.Error("IMAPFilter failed", err, "rcpt", rcpt)
+					continue
+				}
+				if folder == "" {
+					folder = subaddrMboxes[rcpt]
+				}
+				if mbox := d.sieveMboxes[rcpt]; mbox != "" {
+					// fileinto in the user script takes precedence.
+					folder = mbox
+				}
+				d.d.UserMailbox(rcpt, folder, flags)
 			}
-			d.d.UserMailbox(rcpt, folder, flags)
 		}
 	}
 
@@ -122,36 +316,87 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 		}
 	}
 
-	header = header.Copy()
-	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
-	err := d.d.BodyParsed(header, body.Len(), body)
-	if _, ok := err.(imapsql.SerializationError); ok {
-		return &exterrors.SMTPError{
-			Code:         453,
-			EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
-			Message:      "Storage access serialiation problem, try again later",
-			TargetName:   "imapsql",
-			Err:          err,
+	if len(d.addedRcpts) != 0 {
+		localHdr := header.Copy()
+		localHdr.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+		err := d.d.BodyParsed(localHdr, body.Len(), body)
+		if _, ok := err.(imapsql.SerializationError); ok {
+			return &exterrors.SMTPError{
+				Code:         453,
+				EnhancedCode: exterrors.EnhancedCode{4, 3, 2},
+				Message:      "Storage access serialiation problem, try again later",
+				TargetName:   "imapsql",
+				Err:          err,
+			}
+		}
+		if err != nil {
+			return err
 		}
+		if len(d.copies) != 0 {
+			d.header = localHdr
+			d.body = body
+		}
+	}
+
+	if err := d.forwardMessage(ctx, header, body); err != nil {
+		return forwardErr(err)
 	}
-	return err
+	return nil
 }
 
 func (d *delivery) Abort(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Abort").End()
 
+	if d.fwd != nil {
+		if err := d.fwd.Abort(ctx); err != nil {
+			d.store.Log.Error("failed to abort forwarding", err, "msg_id", d.msgMeta.ID)
+		}
+	}
+	for _, reply := range d.replies {
+		if err := reply.Abort(ctx); err != nil {
+			d.store.Log.Error("failed to abort automatic response", err, "msg_id", d.msgMeta.ID)
+		}
+	}
 	return d.d.Abort()
 }
 
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
 
-	return d.d.Commit()
+	if d.fwd != nil {
+		if err := d.fwd.Commit(ctx); err != nil {
+			d.d.Abort() //nolint:errcheck
+			return forwardErr(err)
+		}
+	}
+	if err := d.d.Commit(); err != nil {
+		return err
+	}
+
+	for _, reply := range d.replies {
+		if err := reply.Commit(ctx); err != nil {
+			d.store.Log.Error("failed to send automatic response", err, "msg_id", d.msgMeta.ID)
+		}
+	}
+	now := time.Now()
+	for _, rec := range d.vacationSent {
+		if err := d.store.recordVacation(rec.user, rec.sender, rec.handle, now); err != nil {
+			d.store.Log.Error("failed to record vacation response", err, "msg_id", d.msgMeta.ID, "username", rec.user)
+		}
+	}
+	if len(d.copies) != 0 && d.body != nil {
+		d.storeCopies(d.header, d.body)
+	}
+	return nil
 }
 
 func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
 	defer trace.StartRegion(ctx, "sql/Start").End()
 
+	if maintenance.Enabled() {
+		return nil, maintenance.SMTPError()
+	}
+
 	return &delivery{
 		store:      store,
 		msgMeta:    msgMeta,
@@ -4,8 +4,8 @@ import (
 	"context"
 	"io"
 
-	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/foxcpp/maddy/framework/module"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
 )
 
 type ExtBlob struct {
@@ -0,0 +1,309 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// Forwarding rules are kept in a separate table managed by maddy, the same
+// way as deactivated accounts. Rules are ignored if forward_target is not
+// configured.
+//
+// Matching messages are submitted to the forward_target module with the
+// original envelope sender. The target is expected to be a pipeline that
+// makes forwarding SPF-safe (e.g. rewrites the sender using SRS) and delivers
+// the message to the remote queue.
+
+// ForwardRule describes the single forwarding rule of the account.
+type ForwardRule struct {
+	// Address is the address to forward messages to.
+	Address string
+	// Match is the condition the message should satisfy to be forwarded.
+	// Empty string matches all messages. See ParseForwardMatch for the syntax.
+	Match string
+	// KeepCopy specifies whether the message should also be stored in the
+	// account.
+	KeepCopy bool
+}
+
+// forwardMatch is the parsed ForwardRule.Match value.
+type forwardMatch struct {
+	kind  string
+	field string
+	value string
+}
+
+// ParseForwardMatch checks the syntax of the forwarding condition.
+//
+// Supported conditions:
+//
+//	from:<address or domain>  - envelope sender or From header address
+//	subject:<text>            - Subject contains the text
+//	header:<name>:<text>      - the header field contains the text
+//
+// Text comparisons are case-insensitive.
+func ParseForwardMatch(match string) error {
+	_, err := parseForwardMatch(match)
+	return err
+}
+
+func parseForwardMatch(match string) (forwardMatch, error) {
+	if match == "" {
+		return forwardMatch{}, nil
+	}
+
+	parts := strings.SplitN(match, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return forwardMatch{}, fmt.Errorf("malformed condition: %s", match)
+	}
+	switch kind := strings.ToLower(parts[0]); kind {
+	case "from":
+		value, err := address.ForLookup(parts[1])
+		if err != nil && strings.Contains(parts[1], "@") {
+			return forwardMatch{}, fmt.Errorf("malformed address: %s", parts[1])
+		}
+		return forwardMatch{kind: kind, value: value}, nil
+	case "subject":
+		return forwardMatch{kind: "header", field: "Subject", value: strings.ToLower(parts[1])}, nil
+	case "header":
+		hdrParts := strings.SplitN(parts[1], ":", 2)
+		if len(hdrParts) != 2 || hdrParts[0] == "" || hdrParts[1] == "" {
+			return forwardMatch{}, fmt.Errorf("malformed header condition: %s", match)
+		}
+		return forwardMatch{kind: kind, field: hdrParts[0], value: strings.ToLower(hdrParts[1])}, nil
+	default:
+		return forwardMatch{}, fmt.Errorf("unknown condition type: %s", parts[0])
+	}
+}
+
+func matchSender(pattern, sender string) bool {
+	sender, err := address.ForLookup(sender)
+	if err != nil {
+		return false
+	}
+	if strings.Contains(pattern, "@") {
+		return sender == pattern
+	}
+	_, domain, err := address.Split(sender)
+	if err != nil {
+		return false
+	}
+	return domain == pattern || strings.HasSuffix(domain, "."+pattern)
+}
+
+func (m forwardMatch) matches(mailFrom string, header textproto.Header) bool {
+	switch m.kind {
+	case "":
+		return true
+	case "from":
+		if matchSender(m.value, mailFrom) {
+			return true
+		}
+		from, err := mail.ParseAddress(header.Get("From"))
+		if err != nil {
+			return false
+		}
+		return matchSender(m.value, from.Address)
+	case "header":
+		for _, v := range header.Values(m.field) {
+			if strings.Contains(strings.ToLower(v), m.value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (store *Storage) initForwarding() error {
+	_, err := store.Back.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_forwarding (
+			username VARCHAR(255) NOT NULL,
+			address VARCHAR(255) NOT NULL,
+			match_cond TEXT NOT NULL,
+			keep_copy INTEGER NOT NULL,
+			PRIMARY KEY (username, address)
+		)`)
+	if err != nil {
+		return fmt.Errorf("imapsql: forwarding schema: %w", err)
+	}
+	return nil
+}
+
+// SetForwardRule adds the forwarding rule to the account or replaces the
+// existing rule for the same address.
+func (store *Storage) SetForwardRule(username string, rule ForwardRule) error {
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if err := u.Logout(); err != nil {
+		store.Log.Error("logout failed", err, "username", username)
+	}
+	if err := address.Validate(rule.Address, true, address.RFC); err != nil {
+		return fmt.Errorf("imapsql: invalid forwarding address: %s: %w", rule.Address, err)
+	}
+	if err := ParseForwardMatch(rule.Match); err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
+
+	keepCopy := 0
+	if rule.KeepCopy {
+		keepCopy = 1
+	}
+
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(store.rebindSQL(`
+		DELETE FROM maddy_forwarding
+		WHERE username = ? AND address = ?`), username, rule.Address); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(store.rebindSQL(`
+		INSERT INTO maddy_forwarding(username, address, match_cond, keep_copy)
+		VALUES (?, ?, ?, ?)`), username, rule.Address, rule.Match, keepCopy); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveForwardRule removes the forwarding rule for the address from the
+// account.
+func (store *Storage) RemoveForwardRule(username, addr string) error {
+	_, err := store.Back.DB.Exec(store.rebindSQL(`
+		DELETE FROM maddy_forwarding
+		WHERE username = ? AND address = ?`), username, addr)
+	return err
+}
+
+// ForwardRules returns forwarding rules of the account.
+func (store *Storage) ForwardRules(username string) ([]ForwardRule, error) {
+	rows, err := store.Back.DB.Query(store.rebindSQL(`
+		SELECT address, match_cond, keep_copy
+		FROM maddy_forwarding
+		WHERE username = ?
+		ORDER BY address`), username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []ForwardRule
+	for rows.Next() {
+		var (
+			rule     ForwardRule
+			keepCopy int
+		)
+		if err := rows.Scan(&rule.Address, &rule.Match, &keepCopy); err != nil {
+			return nil, err
+		}
+		rule.KeepCopy = keepCopy != 0
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// forwardAddrs returns addresses the message should be forwarded to according
+// to rules and whether the local copy should be stored.
+func forwardAddrs(rules []ForwardRule, mailFrom string, header textproto.Header) (addrs []string, keepCopy bool) {
+	keepCopy = true
+	matched := false
+	for _, rule := range rules {
+		m, err := parseForwardMatch(rule.Match)
+		if err != nil || !m.matches(mailFrom, header) {
+			continue
+		}
+		if !matched {
+			// Local copy is dropped only if all matching rules say so.
+			matched = true
+			keepCopy = false
+		}
+		keepCopy = keepCopy || rule.KeepCopy
+		addrs = append(addrs, rule.Address)
+	}
+	return addrs, keepCopy
+}
+
+// forwardMessage submits the message to forward_target for addresses selected
+// by applyForwarding.
+func (d *delivery) forwardMessage(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if len(d.forwardTo) == 0 {
+		return nil
+	}
+
+	msgMeta := d.msgMeta.DeepCopy()
+	fwdID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	msgMeta.TraceID = d.msgMeta.Trace()
+	msgMeta.ID = fwdID
+	msgMeta.OriginalRcpts = nil
+
+	fwd, err := d.store.forwardTarget.Start(ctx, msgMeta, d.mailFrom)
+	if err != nil {
+		return err
+	}
+	for _, fwdAddr := range d.forwardTo {
+		if err := fwd.AddRcpt(ctx, fwdAddr.to); err != nil {
+			fwd.Abort(ctx) //nolint:errcheck
+			return err
+		}
+	}
+
+	header = header.Copy()
+	for _, user := range d.forwardedBy {
+		// Allows to detect forwarding loops.
+		header.Add("Delivered-To", user)
+	}
+	if err := fwd.Body(ctx, header, body); err != nil {
+		fwd.Abort(ctx) //nolint:errcheck
+		return err
+	}
+
+	for _, fwdAddr := range d.forwardTo {
+		d.store.Log.Msg("message forwarded", "msg_id", d.msgMeta.ID, "forward_id", fwdID,
+			"username", fwdAddr.user, "rcpt", fwdAddr.to)
+	}
+	d.fwd = fwd
+	return nil
+}
+
+func forwardErr(err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 4, 0},
+		Message:      "Failed to forward the message, try again later",
+		TargetName:   "imapsql",
+		Err:          err,
+	}
+}
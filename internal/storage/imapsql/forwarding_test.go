@@ -0,0 +1,186 @@
+//+build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestParseForwardMatch(t *testing.T) {
+	for _, valid := range []string{"", "from:example.org", "from:a@example.org", "subject:invoice", "header:List-Id:announce"} {
+		if err := ParseForwardMatch(valid); err != nil {
+			t.Errorf("%q: unexpected error: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"from:", "subject", "header:List-Id", "body:text"} {
+		if err := ParseForwardMatch(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestForwardAddrs(t *testing.T) {
+	rules := []ForwardRule{
+		{Address: "all@example.com"},
+		{Address: "boss@example.com", Match: "from:example.net", KeepCopy: true},
+		{Address: "bills@example.com", Match: "subject:INVOICE"},
+	}
+	hdr := textproto.Header{}
+	hdr.Add("From", "Sender <sender@sub.example.net>")
+	hdr.Add("Subject", "Your invoice")
+
+	addrs, keepCopy := forwardAddrs(rules, "", hdr)
+	if len(addrs) != 3 || !keepCopy {
+		t.Fatalf("wrong result: %v, keepCopy=%v", addrs, keepCopy)
+	}
+
+	addrs, keepCopy = forwardAddrs(rules[2:], "sender@example.org", textproto.Header{})
+	if len(addrs) != 0 || !keepCopy {
+		t.Fatalf("wrong result for non-matching message: %v, keepCopy=%v", addrs, keepCopy)
+	}
+
+	addrs, keepCopy = forwardAddrs(rules[:1], "sender@example.org", textproto.Header{})
+	if len(addrs) != 1 || keepCopy {
+		t.Fatalf("wrong result for forward-only rule: %v, keepCopy=%v", addrs, keepCopy)
+	}
+}
+
+func inboxCount(t *testing.T, store *Storage, username string) uint32 {
+	t.Helper()
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Logout()
+	mbox, err := u.GetMailbox(imap.InboxName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Messages
+}
+
+func deliver(t *testing.T, store *Storage, hdr textproto.Header, msgMeta *module.MsgMetadata, rcpts ...string) {
+	t.Helper()
+	ctx := context.Background()
+	d, err := store.Start(ctx, msgMeta, "sender@example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range rcpts {
+		if err := d.AddRcpt(ctx, rcpt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Body(ctx, hdr, buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	store := sqliteTestStorage(t)
+	tgt := testutils.Target{}
+	store.forwardTarget = &tgt
+
+	for _, user := range []string{"fwd@example.org", "copy@example.org", "plain@example.org"} {
+		if err := store.CreateIMAPAcct(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetForwardRule("fwd@example.org", ForwardRule{Address: "fwd@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetForwardRule("copy@example.org", ForwardRule{
+		Address:  "copy@example.com",
+		Match:    "subject:urgent",
+		KeepCopy: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetForwardRule("plain@example.org", ForwardRule{Address: "bad"}); err == nil {
+		t.Fatal("invalid address is accepted")
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Subject", "Urgent!")
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test1"}, "fwd@example.org", "copy@example.org", "plain@example.org")
+
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("wrong amount of forwarded messages: %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	forwardID := testutils.CheckMsgID(t, &msg, "sender@example.net", []string{"fwd@example.com", "copy@example.com"}, "")
+	if got := msg.Header.Values("Delivered-To"); len(got) != 2 {
+		t.Errorf("wrong Delivered-To fields: %v", got)
+	}
+	if forwardID == "test1" {
+		t.Error("forwarded message has the same ID")
+	}
+	if msg.MsgMeta.TraceID != "test1" {
+		t.Errorf("forwarded message has wrong TraceID: %q", msg.MsgMeta.TraceID)
+	}
+
+	for user, want := range map[string]uint32{
+		"fwd@example.org":   0,
+		"copy@example.org":  1,
+		"plain@example.org": 1,
+	} {
+		if got := inboxCount(t, store, user); got != want {
+			t.Errorf("%s: want %d messages, got %d", user, want, got)
+		}
+	}
+
+	// Quarantined and looped messages are kept locally.
+	deliver(t, store, textproto.Header{}, &module.MsgMetadata{ID: "test2", Quarantine: true}, "fwd@example.org")
+	hdr = textproto.Header{}
+	hdr.Add("Delivered-To", "fwd@example.org")
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test3"}, "fwd@example.org")
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("message is forwarded: %d", len(tgt.Messages))
+	}
+	if got := inboxCount(t, store, "fwd@example.org"); got != 1 {
+		t.Errorf("looped message is not stored: %d", got)
+	}
+
+	if err := store.RemoveForwardRule("fwd@example.org", "fwd@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := store.ForwardRules("fwd@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 0 {
+		t.Fatalf("rule is not removed: %v", rules)
+	}
+}
@@ -17,7 +17,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 */
 
 // Package imapsql implements SQL-based storage module
-// using go-imap-sql library (github.com/foxcpp/go-imap-sql).
+// using go-imap-sql library (copy of github.com/foxcpp/go-imap-sql in
+// third_party/go-imap-sql).
 //
 // Interfaces implemented:
 // - module.StorageBackend
@@ -35,18 +36,21 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-imap"
 	sortthread "github.com/emersion/go-imap-sortthread"
 	"github.com/emersion/go-imap/backend"
-	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
 	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/authz"
+	"github.com/foxcpp/maddy/internal/sqlite"
 	"github.com/foxcpp/maddy/internal/updatepipe"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
 
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
@@ -57,7 +61,8 @@ type Storage struct {
 	instName string
 	Log      log.Logger
 
-	junkMbox string
+	junkMbox      string
+	subaddrDelims string
 
 	driver string
 	dsn    []string
@@ -68,8 +73,12 @@ type Storage struct {
 	updPipe     updatepipe.P
 	updPushStop chan struct{}
 
+	purgeStop chan struct{}
+
 	filters module.IMAPFilter
 
+	forwardTarget module.DeliveryTarget
+
 	deliveryMap       module.Table
 	deliveryNormalize func(context.Context, string) (string, error)
 	authMap           module.Table
@@ -109,6 +118,8 @@ func (store *Storage) Init(cfg *config.Map) error {
 		compression       []string
 		authNormalize     string
 		deliveryNormalize string
+		domainForm        string
+		purgeInterval     time.Duration
 
 		blobStore module.BlobStore
 	)
@@ -140,9 +151,10 @@ func (store *Storage) Init(cfg *config.Map) error {
 	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
 	cfg.Bool("debug", true, false, &store.Log.Debug)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
-	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
+	cfg.Int("sqlite3_busy_timeout", false, false, sqlite.DefaultBusyTimeout, &opts.BusyTimeout)
 	cfg.Bool("sqlite3_exclusive_lock", false, false, &opts.ExclusiveLock)
 	cfg.String("junk_mailbox", false, false, "Junk", &store.junkMbox)
+	cfg.String("subaddress_delimiter", false, false, "", &store.subaddrDelims)
 	cfg.Custom("imap_filter", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, func(m *config.Map, node config.Node) (interface{}, error) {
@@ -158,6 +170,11 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.Enum("domain_form", false, false, []string{"preserve", "unicode", "ascii"}, "preserve", &domainForm)
+	cfg.Duration("purge_interval", false, false, 1*time.Hour, &purgeInterval)
+	cfg.Custom("forward_target", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, modconfig.DeliveryDirective, &store.forwardTarget)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -174,6 +191,19 @@ func (store *Storage) Init(cfg *config.Map) error {
 	if !ok {
 		return errors.New("imapsql: unknown normalization function: " + deliveryNormalize)
 	}
+	authNormFunc, ok := authz.NormalizeFuncs[authNormalize]
+	if !ok {
+		return errors.New("imapsql: unknown normalization function: " + authNormalize)
+	}
+	if domainForm != "preserve" {
+		form, err := address.ParseDomainForm(domainForm)
+		if err != nil {
+			return err
+		}
+		deliveryNormFunc = withDomainForm(deliveryNormFunc, form)
+		authNormFunc = withDomainForm(authNormFunc, form)
+	}
+
 	store.deliveryNormalize = func(ctx context.Context, s string) (string, error) {
 		return deliveryNormFunc(s)
 	}
@@ -191,10 +221,6 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
-	authNormFunc, ok := authz.NormalizeFuncs[authNormalize]
-	if !ok {
-		return errors.New("imapsql: unknown normalization function: " + authNormalize)
-	}
 	store.authNormalize = func(ctx context.Context, s string) (string, error) {
 		return authNormFunc(s)
 	}
@@ -251,6 +277,23 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
+	if driver == "sqlite3" {
+		if module.NoRun && opts.ExclusiveLock {
+			// Exclusive locking mode would block the server until maddyctl
+			// exits.
+			store.Log.Msg("sqlite3_exclusive_lock is ignored by maddyctl")
+			opts.ExclusiveLock = false
+		}
+
+		// Schema creation and upgrades are serialized between processes
+		// using the same database.
+		unlock, err := sqlite.LockSchema(dsnStr, sqlite.DefaultLockTimeout)
+		if err != nil {
+			return fmt.Errorf("imapsql: %w", err)
+		}
+		defer unlock()
+	}
+
 	store.Back, err = imapsql.New(driver, dsnStr, ExtBlobStore{Base: blobStore}, opts)
 	if err != nil {
 		return fmt.Errorf("imapsql: %s", err)
@@ -264,6 +307,23 @@ func (store *Storage) Init(cfg *config.Map) error {
 	store.Back.EnableChildrenExt()
 	store.Back.EnableSpecialUseExt()
 
+	if err := store.initOffboarding(); err != nil {
+		return err
+	}
+	if err := store.initForwarding(); err != nil {
+		return err
+	}
+	if err := store.initSieve(); err != nil {
+		return err
+	}
+	if err := store.initVacation(); err != nil {
+		return err
+	}
+	if purgeInterval != 0 && !module.NoRun {
+		store.purgeStop = make(chan struct{})
+		go store.purgeLoop(purgeInterval)
+	}
+
 	return nil
 }
 
@@ -346,8 +406,9 @@ func (store *Storage) I18NLevel() int {
 	return 1
 }
 
+// IMAPExtensions returns the list of IMAP extensions supported by the storage.
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT", "MULTIAPPEND", "UIDPLUS", "OBJECTID"}
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
@@ -367,13 +428,41 @@ func (store *Storage) EnableChildrenExt() bool {
 	return store.Back.EnableChildrenExt()
 }
 
+// withDomainForm converts the domain of account names returned by normFunc
+// into the specified form. Names without a domain are returned as is.
+func withDomainForm(normFunc func(string) (string, error), form address.DomainForm) func(string) (string, error) {
+	return func(s string) (string, error) {
+		s, err := normFunc(s)
+		if err != nil {
+			return "", err
+		}
+		mbox, domain, err := address.Split(s)
+		if err != nil || domain == "" {
+			return s, nil
+		}
+		domain, err = address.CanonicalDomain(domain, form)
+		if err != nil {
+			return "", err
+		}
+		return mbox + "@" + domain, nil
+	}
+}
+
 func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error) {
 	accountName, err := store.authNormalize(context.TODO(), username)
 	if err != nil {
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	if err := store.checkDeactivated(accountName); err != nil {
+		return nil, err
+	}
+
+	u, err := store.Back.GetOrCreateUser(accountName)
+	if err != nil {
+		return nil, err
+	}
+	return imapUser{User: u.(*imapsql.User)}, nil
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -396,7 +485,24 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 	return "", true, nil
 }
 
+// Ping executes a cheap query against the database to check whether it
+// is reachable. It is used to measure the database latency.
+func (store *Storage) Ping(ctx context.Context) error {
+	usr, err := store.Back.GetUser("")
+	if err != nil {
+		if errors.Is(err, imapsql.ErrUserDoesntExists) {
+			return nil
+		}
+		return err
+	}
+	return usr.Logout()
+}
+
 func (store *Storage) Close() error {
+	if store.purgeStop != nil {
+		close(store.purgeStop)
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
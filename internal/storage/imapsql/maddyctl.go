@@ -19,7 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package imapsql
 
 import (
+	"errors"
+
 	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
 )
 
 // These methods wrap corresponding go-imap-sql methods, but also apply
@@ -34,7 +37,16 @@ func (store *Storage) CreateIMAPAcct(accountName string) error {
 }
 
 func (store *Storage) DeleteIMAPAcct(accountName string) error {
-	return store.Back.DeleteUser(accountName)
+	err := store.Back.DeleteUser(accountName)
+	if err != nil && !errors.Is(err, imapsql.ErrUserDoesntExists) {
+		return err
+	}
+	// Clean up deactivation status, if any, even if the account is already
+	// gone.
+	if err := store.ReactivateIMAPAcct(accountName); err != nil {
+		return err
+	}
+	return err
 }
 
 func (store *Storage) GetIMAPAcct(accountName string) (backend.User, error) {
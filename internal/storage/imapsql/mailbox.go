@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/module"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
+)
+
+// imapUser wraps the go-imap-sql user object to return mailboxes
+// implementing optional module interfaces.
+type imapUser struct {
+	*imapsql.User
+}
+
+func (u imapUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mboxes, err := u.User.ListMailboxes(subscribed)
+	if err != nil {
+		return nil, err
+	}
+	for i, mbox := range mboxes {
+		mboxes[i] = &imapMailbox{Mailbox: mbox.(*imapsql.Mailbox)}
+	}
+	return mboxes, nil
+}
+
+func (u imapUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &imapMailbox{Mailbox: mbox.(*imapsql.Mailbox)}, nil
+}
+
+// imapMailbox implements module.MultiAppendMailbox and module.UIDPlusMailbox
+// on top of the go-imap-sql mailbox object.
+type imapMailbox struct {
+	*imapsql.Mailbox
+}
+
+func (m *imapMailbox) CreateMessages(msgs []module.IMAPAppendMessage) error {
+	appendMsgs := make([]imapsql.AppendMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		appendMsgs = append(appendMsgs, imapsql.AppendMessage{
+			Flags: msg.Flags,
+			Date:  msg.Date,
+			Body:  msg.Body,
+		})
+	}
+	_, _, err := m.AppendMessages(appendMsgs)
+	return err
+}
+
+func (m *imapMailbox) CopyMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	uidValidity, src, destUids, err := m.Mailbox.CopyMessagesUID(uid, seqset, dest)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	return module.UIDMapping{UIDValidity: uidValidity, Src: src, Dest: destUids}, nil
+}
+
+func (m *imapMailbox) MoveMessagesUID(uid bool, seqset *imap.SeqSet, dest string) (module.UIDMapping, error) {
+	uidValidity, src, destUids, err := m.Mailbox.MoveMessagesUID(uid, seqset, dest)
+	if err != nil {
+		return module.UIDMapping{}, err
+	}
+	return module.UIDMapping{UIDValidity: uidValidity, Src: src, Dest: destUids}, nil
+}
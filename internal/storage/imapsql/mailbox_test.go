@@ -0,0 +1,271 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/module"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
+)
+
+func testMailbox(t *testing.T, store *Storage, name string) backend.Mailbox {
+	t.Helper()
+
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "INBOX" {
+		if err := u.CreateMailbox(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mbox, err := u.GetMailbox(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbox
+}
+
+func mboxMessages(t *testing.T, mbox backend.Mailbox) uint32 {
+	t.Helper()
+
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Messages
+}
+
+func TestCreateMessages(t *testing.T) {
+	store := sqliteTestStorage(t)
+	mbox := testMailbox(t, store, "INBOX")
+
+	multiMbox, ok := mbox.(module.MultiAppendMailbox)
+	if !ok {
+		t.Fatal("Mailbox does not implement MultiAppendMailbox")
+	}
+
+	err := multiMbox.CreateMessages([]module.IMAPAppendMessage{
+		{Flags: []string{imap.SeenFlag}, Body: bytes.NewReader([]byte("Subject: 1\r\n\r\n1\r\n"))},
+		{Body: bytes.NewReader([]byte("Subject: 2\r\n\r\n2\r\n"))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := mboxMessages(t, mbox); count != 2 {
+		t.Fatalf("Expected 2 messages, got %d", count)
+	}
+
+	// Malformed header in the second message fails the whole batch.
+	err = multiMbox.CreateMessages([]module.IMAPAppendMessage{
+		{Body: bytes.NewReader([]byte("Subject: 3\r\n\r\n3\r\n"))},
+		{Body: bytes.NewReader([]byte("Subject"))},
+	})
+	if err == nil {
+		t.Fatal("Expected an error for malformed message")
+	}
+	if count := mboxMessages(t, mbox); count != 2 {
+		t.Fatalf("Expected 2 messages after failed append, got %d", count)
+	}
+}
+
+func TestUIDPlus(t *testing.T) {
+	store := sqliteTestStorage(t)
+	inbox := testMailbox(t, store, "INBOX")
+	target := testMailbox(t, store, "Target")
+
+	uidInbox, ok := inbox.(module.UIDPlusMailbox)
+	if !ok {
+		t.Fatal("Mailbox does not implement UIDPlusMailbox")
+	}
+	uidTarget := target.(module.UIDPlusMailbox)
+
+	status, err := target.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint32(1); i <= 3; i++ {
+		_, uid, err := uidInbox.CreateMessageUID(nil, time.Time{}, bytes.NewReader([]byte("Subject: 1\r\n\r\n1\r\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid != i {
+			t.Fatalf("Expected UID %d, got %d", i, uid)
+		}
+	}
+
+	seqset, _ := imap.ParseSeqSet("1,3")
+	mapping, err := uidInbox.CopyMessagesUID(true, seqset, "Target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapping.UIDValidity != status.UidValidity {
+		t.Errorf("Wrong UIDVALIDITY: %d, expected %d", mapping.UIDValidity, status.UidValidity)
+	}
+	if !reflect.DeepEqual(mapping.Src, []uint32{1, 3}) || !reflect.DeepEqual(mapping.Dest, []uint32{1, 2}) {
+		t.Errorf("Wrong COPY mapping: %v -> %v", mapping.Src, mapping.Dest)
+	}
+
+	// Sequence number 2 is UID 2.
+	seqset, _ = imap.ParseSeqSet("2:*")
+	mapping, err = uidInbox.MoveMessagesUID(false, seqset, "Target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mapping.Src, []uint32{2, 3}) || !reflect.DeepEqual(mapping.Dest, []uint32{3, 4}) {
+		t.Errorf("Wrong MOVE mapping: %v -> %v", mapping.Src, mapping.Dest)
+	}
+	if count := mboxMessages(t, inbox); count != 1 {
+		t.Fatalf("Expected 1 message in source mailbox, got %d", count)
+	}
+
+	seqset, _ = imap.ParseSeqSet("1:3")
+	if err := target.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	// Message with UID 3 is not removed since it is not in the set, UID 4
+	// is not removed since it does not have the \Deleted flag.
+	seqset, _ = imap.ParseSeqSet("1:2,4")
+	if err := uidTarget.ExpungeUIDs(seqset); err != nil {
+		t.Fatal(err)
+	}
+	if count := mboxMessages(t, target); count != 2 {
+		t.Fatalf("Expected 2 messages after UID EXPUNGE, got %d", count)
+	}
+
+	// Body of the copied message is still accessible from the source
+	// mailbox.
+	seqset, _ = imap.ParseSeqSet("1")
+	ch := make(chan *imap.Message, 1)
+	if err := inbox.ListMessages(true, seqset, []imap.FetchItem{imap.FetchRFC822Size}, ch); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-ch; msg == nil || msg.Size == 0 {
+		t.Fatal("Source message is missing after UID EXPUNGE of its copy")
+	}
+}
+
+func TestMailboxSizeAndObjectIDs(t *testing.T) {
+	store := sqliteTestStorage(t)
+	inbox := testMailbox(t, store, "INBOX")
+	target := testMailbox(t, store, "Target")
+
+	status := func(mbox backend.Mailbox) (uint64, string) {
+		t.Helper()
+		status, err := mbox.Status([]imap.StatusItem{imapsql.StatusSize, imapsql.StatusMailboxID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, _ := status.Items[imapsql.StatusSize].(uint64)
+		id, _ := status.Items[imapsql.StatusMailboxID].(string)
+		return size, id
+	}
+
+	msgs := []string{"Subject: 1\r\n\r\n1\r\n", "Subject: 22\r\n\r\n22\r\n", "Subject: 333\r\n\r\n333\r\n"}
+	var total uint64
+	for _, msg := range msgs {
+		if err := inbox.CreateMessage(nil, time.Time{}, bytes.NewReader([]byte(msg))); err != nil {
+			t.Fatal(err)
+		}
+		total += uint64(len(msg))
+	}
+	if size, _ := status(inbox); size != total {
+		t.Fatalf("Wrong INBOX size after APPEND: %d, expected %d", size, total)
+	}
+
+	seqset, _ := imap.ParseSeqSet("1:2")
+	if err := inbox.CopyMessages(true, seqset, "Target"); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := status(target); size != uint64(len(msgs[0])+len(msgs[1])) {
+		t.Fatalf("Wrong target size after COPY: %d", size)
+	}
+
+	seqset, _ = imap.ParseSeqSet("3")
+	if err := inbox.(backend.MoveMailbox).MoveMessages(true, seqset, "Target"); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := status(inbox); size != uint64(len(msgs[0])+len(msgs[1])) {
+		t.Fatalf("Wrong INBOX size after MOVE: %d", size)
+	}
+	if size, _ := status(target); size != total {
+		t.Fatalf("Wrong target size after MOVE: %d", size)
+	}
+
+	seqset, _ = imap.ParseSeqSet("1")
+	if err := target.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := status(target); size != total-uint64(len(msgs[0])) {
+		t.Fatalf("Wrong target size after EXPUNGE: %d", size)
+	}
+
+	// Copies share EMAILID, MAILBOXID survives renames.
+	emailID := func(mbox backend.Mailbox, uid uint32) interface{} {
+		t.Helper()
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uid)
+		ch := make(chan *imap.Message, 1)
+		if err := mbox.ListMessages(true, seqset, []imap.FetchItem{imapsql.FetchEmailID, imapsql.FetchThreadID}, ch); err != nil {
+			t.Fatal(err)
+		}
+		msg := <-ch
+		if msg == nil {
+			t.Fatal("No message returned")
+		}
+		if msg.Items[imapsql.FetchThreadID] != nil {
+			t.Error("Unexpected THREADID:", msg.Items[imapsql.FetchThreadID])
+		}
+		return msg.Items[imapsql.FetchEmailID]
+	}
+	srcID, copyID := emailID(inbox, 2), emailID(target, 2)
+	if srcID == nil || srcID != copyID {
+		t.Errorf("Copy has different EMAILID: %v, %v", srcID, copyID)
+	}
+
+	_, mboxID := status(target)
+	u, err := store.GetOrCreateIMAPAcct("test@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.RenameMailbox("Target", "Renamed"); err != nil {
+		t.Fatal(err)
+	}
+	renamed, err := u.GetMailbox("Renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, id := status(renamed); id == "" || id != mboxID {
+		t.Errorf("MAILBOXID changed after rename: %v, %v", mboxID, id)
+	}
+	if _, id := status(inbox); id == mboxID {
+		t.Error("Mailboxes have the same MAILBOXID")
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/internal/authz"
+)
+
+func TestWithDomainForm(t *testing.T) {
+	test := func(form address.DomainForm, in, want string) {
+		t.Helper()
+
+		norm := withDomainForm(authz.NormalizeFuncs["precis_casefold_email"], form)
+		actual, err := norm(in)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", in, err)
+			return
+		}
+		if actual != want {
+			t.Errorf("%s: want %s, got %s", in, want, actual)
+		}
+	}
+
+	test(address.FormUnicode, "Test@XN--E1AYBC.example.org", "test@тест.example.org")
+	test(address.FormASCII, "Test@ТЕСТ.example.org", "test@xn--e1aybc.example.org")
+	test(address.FormASCII, "test@example.org.", "test@example.org")
+
+	noop := withDomainForm(authz.NormalizeFuncs["noop"], address.FormASCII)
+	if actual, _ := noop("Test"); actual != "Test" {
+		t.Errorf("Test: name without domain changed to %s", actual)
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
+)
+
+// Deactivated accounts are kept in a separate table managed by maddy, the
+// go-imap-sql schema is not changed.
+//
+// Deactivated account can't be used to log in and no messages are delivered
+// to it. Its data is kept until the purge time and the account is deleted
+// afterwards.
+
+// ErrAccountDeactivated is returned by GetOrCreateIMAPAcct for deactivated
+// accounts.
+var ErrAccountDeactivated = errors.New("imapsql: account is deactivated")
+
+// DeactivatedAcct describes the deactivated account.
+type DeactivatedAcct struct {
+	Username      string
+	DeactivatedAt time.Time
+	// PurgeAt is the time after which the account is deleted. Zero value means
+	// the account is kept forever.
+	PurgeAt time.Time
+	// Message is returned to senders instead of the default rejection
+	// message, if not empty.
+	Message string
+}
+
+func (store *Storage) rebindSQL(req string) string {
+	if store.driver != "postgres" {
+		return req
+	}
+
+	var res strings.Builder
+	indx := 1
+	for _, chr := range req {
+		if chr == '?' {
+			res.WriteString("$" + strconv.Itoa(indx))
+			indx++
+			continue
+		}
+		res.WriteRune(chr)
+	}
+	return res.String()
+}
+
+func (store *Storage) initOffboarding() error {
+	_, err := store.Back.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_deactivated_accts (
+			username VARCHAR(255) PRIMARY KEY NOT NULL,
+			deactivated_at BIGINT NOT NULL,
+			purge_at BIGINT NOT NULL,
+			message TEXT NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("imapsql: offboarding schema: %w", err)
+	}
+	return nil
+}
+
+// DeactivateIMAPAcct marks the account as deactivated. If retention is not
+// zero, the account is deleted after that time passes.
+func (store *Storage) DeactivateIMAPAcct(username string, retention time.Duration, message string) error {
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if err := u.Logout(); err != nil {
+		store.Log.Error("logout failed", err, "username", username)
+	}
+
+	// Message is used in the SMTP reply, so it should be a single line.
+	message = strings.Join(strings.Fields(message), " ")
+
+	now := time.Now()
+	var purgeAt int64
+	if retention != 0 {
+		purgeAt = now.Add(retention).Unix()
+	}
+
+	if err := store.ReactivateIMAPAcct(username); err != nil {
+		return err
+	}
+	_, err = store.Back.DB.Exec(store.rebindSQL(`
+		INSERT INTO maddy_deactivated_accts(username, deactivated_at, purge_at, message)
+		VALUES (?, ?, ?, ?)`), username, now.Unix(), purgeAt, message)
+	return err
+}
+
+// ReactivateIMAPAcct removes the deactivation mark from the account.
+func (store *Storage) ReactivateIMAPAcct(username string) error {
+	_, err := store.Back.DB.Exec(store.rebindSQL(`
+		DELETE FROM maddy_deactivated_accts
+		WHERE username = ?`), username)
+	return err
+}
+
+// DeactivatedIMAPAcct returns the deactivation status of the account, nil
+// is returned if the account is not deactivated.
+func (store *Storage) DeactivatedIMAPAcct(username string) (*DeactivatedAcct, error) {
+	acct := DeactivatedAcct{Username: username}
+	var deactivatedAt, purgeAt int64
+	err := store.Back.DB.QueryRow(store.rebindSQL(`
+		SELECT deactivated_at, purge_at, message
+		FROM maddy_deactivated_accts
+		WHERE username = ?`), username).Scan(&deactivatedAt, &purgeAt, &acct.Message)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	acct.DeactivatedAt = time.Unix(deactivatedAt, 0)
+	if purgeAt != 0 {
+		acct.PurgeAt = time.Unix(purgeAt, 0)
+	}
+	return &acct, nil
+}
+
+// ListDeactivatedIMAPAccts returns all deactivated accounts.
+func (store *Storage) ListDeactivatedIMAPAccts() ([]DeactivatedAcct, error) {
+	rows, err := store.Back.DB.Query(`
+		SELECT username, deactivated_at, purge_at, message
+		FROM maddy_deactivated_accts
+		ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []DeactivatedAcct
+	for rows.Next() {
+		var (
+			acct                   DeactivatedAcct
+			deactivatedAt, purgeAt int64
+		)
+		if err := rows.Scan(&acct.Username, &deactivatedAt, &purgeAt, &acct.Message); err != nil {
+			return nil, err
+		}
+		acct.DeactivatedAt = time.Unix(deactivatedAt, 0)
+		if purgeAt != 0 {
+			acct.PurgeAt = time.Unix(purgeAt, 0)
+		}
+		res = append(res, acct)
+	}
+	return res, rows.Err()
+}
+
+// PurgeDeactivatedIMAPAccts deletes all deactivated accounts with the purge
+// time before now. It returns the list of deleted accounts.
+func (store *Storage) PurgeDeactivatedIMAPAccts(now time.Time) ([]string, error) {
+	accts, err := store.ListDeactivatedIMAPAccts()
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for _, acct := range accts {
+		if acct.PurgeAt.IsZero() || acct.PurgeAt.After(now) {
+			continue
+		}
+		if err := store.DeleteIMAPAcct(acct.Username); err != nil && !errors.Is(err, imapsql.ErrUserDoesntExists) {
+			return purged, fmt.Errorf("%s: %w", acct.Username, err)
+		}
+		purged = append(purged, acct.Username)
+	}
+	return purged, nil
+}
+
+func (store *Storage) purgeLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			purged, err := store.PurgeDeactivatedIMAPAccts(time.Now())
+			if err != nil {
+				store.Log.Error("failed to purge deactivated accounts", err)
+			}
+			for _, username := range purged {
+				store.Log.Msg("deactivated account purged", "username", username)
+			}
+		case <-store.purgeStop:
+			return
+		}
+	}
+}
+
+// checkDeactivated returns ErrAccountDeactivated if the account is
+// deactivated.
+func (store *Storage) checkDeactivated(username string) error {
+	acct, err := store.DeactivatedIMAPAcct(username)
+	if err != nil {
+		return err
+	}
+	if acct != nil {
+		return ErrAccountDeactivated
+	}
+	return nil
+}
+
+// AccountDisabled implements module.AccountStatus. Deactivated accounts are
+// reported as disabled so they can't be used for authentication in other
+// endpoints (e.g. submission).
+func (store *Storage) AccountDisabled(username string) (bool, error) {
+	accountName, err := store.authNormalize(context.TODO(), username)
+	if err != nil {
+		return false, nil
+	}
+
+	acct, err := store.DeactivatedIMAPAcct(accountName)
+	if err != nil {
+		return false, err
+	}
+	return acct != nil, nil
+}
+
+func deactivatedRcptErr(acct *DeactivatedAcct) error {
+	msg := acct.Message
+	if msg == "" {
+		msg = "Mailbox is disabled"
+	}
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 2, 1},
+		Message:      msg,
+		TargetName:   "imapsql",
+		Misc: map[string]interface{}{
+			"reason": "account deactivated",
+		},
+	}
+}
@@ -0,0 +1,155 @@
+//go:build cgo && !nosqlite3
+// +build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
+)
+
+func sqliteTestStorage(t *testing.T) *Storage {
+	dir := t.TempDir()
+	db, err := imapsql.New("sqlite3", filepath.Join(dir, "test.db"), &imapsql.FSStore{Root: dir}, imapsql.Opts{
+		LazyUpdatesInit: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Storage{
+		Back:   db,
+		Log:    testutils.Logger(t, "imapsql"),
+		driver: "sqlite3",
+		deliveryNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+		authNormalize: func(_ context.Context, s string) (string, error) {
+			return s, nil
+		},
+	}
+	if err := store.initOffboarding(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.initForwarding(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.initSieve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.initVacation(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+	})
+	return store
+}
+
+func TestOffboarding(t *testing.T) {
+	store := sqliteTestStorage(t)
+
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeactivateIMAPAcct("test@example.org", time.Hour, "Mailbox closed,\ncontact info@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetOrCreateIMAPAcct("test@example.org"); !errors.Is(err, ErrAccountDeactivated) {
+		t.Fatalf("login to the deactivated account is not blocked: %v", err)
+	}
+	if disabled, err := store.AccountDisabled("test@example.org"); err != nil || !disabled {
+		t.Fatalf("deactivated account is not reported as disabled: %v %v", disabled, err)
+	}
+
+	d, err := store.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.AddRcpt(context.Background(), "test@example.org")
+	var smtpErr *exterrors.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("delivery to the deactivated account is not rejected: %v", err)
+	}
+	if smtpErr.Message != "Mailbox closed, contact info@example.org" {
+		t.Fatalf("wrong rejection message: %v", smtpErr.Message)
+	}
+	if err := d.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := store.PurgeDeactivatedIMAPAccts(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 0 {
+		t.Fatalf("account purged before the retention period ends: %v", purged)
+	}
+	if _, err := store.GetIMAPAcct("test@example.org"); err != nil {
+		t.Fatal("account data is not kept:", err)
+	}
+
+	purged, err = store.PurgeDeactivatedIMAPAccts(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0] != "test@example.org" {
+		t.Fatalf("wrong purged accounts: %v", purged)
+	}
+	if _, err := store.GetIMAPAcct("test@example.org"); !errors.Is(err, imapsql.ErrUserDoesntExists) {
+		t.Fatal("account is not deleted:", err)
+	}
+	accts, err := store.ListDeactivatedIMAPAccts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accts) != 0 {
+		t.Fatalf("deactivation status is not removed: %v", accts)
+	}
+}
+
+func TestOffboarding_Reactivate(t *testing.T) {
+	store := sqliteTestStorage(t)
+
+	if err := store.CreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeactivateIMAPAcct("test@example.org", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.ReactivateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetOrCreateIMAPAcct("test@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if disabled, err := store.AccountDisabled("test@example.org"); err != nil || disabled {
+		t.Fatalf("reactivated account is reported as disabled: %v %v", disabled, err)
+	}
+}
@@ -0,0 +1,548 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+// Sieve scripts are kept in a separate table managed by maddy, one active
+// script per account. The script is executed for each message stored in the
+// account, after forwarding rules are evaluated.
+//
+// redirect, reject and vacation actions need to send messages, they are
+// submitted to forward_target and ignored if it is not configured. Vacation
+// responses are tracked per (user, sender, handle) to not send them more often
+// than requested by the script.
+
+func (store *Storage) initSieve() error {
+	_, err := store.Back.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_sieve (
+			username VARCHAR(255) PRIMARY KEY NOT NULL,
+			script TEXT NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("imapsql: sieve schema: %w", err)
+	}
+	_, err = store.Back.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_sieve_vacation (
+			username VARCHAR(255) NOT NULL,
+			sender VARCHAR(255) NOT NULL,
+			handle VARCHAR(255) NOT NULL,
+			sent_at BIGINT NOT NULL,
+			PRIMARY KEY (username, sender, handle)
+		)`)
+	if err != nil {
+		return fmt.Errorf("imapsql: sieve schema: %w", err)
+	}
+	return nil
+}
+
+// SetSieveScript checks the script and makes it active for the account,
+// replacing the existing one.
+func (store *Storage) SetSieveScript(username, script string) error {
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if err := u.Logout(); err != nil {
+		store.Log.Error("logout failed", err, "username", username)
+	}
+	if _, err := sieve.Parse(script); err != nil {
+		return err
+	}
+
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(store.rebindSQL(`
+		DELETE FROM maddy_sieve
+		WHERE username = ?`), username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(store.rebindSQL(`
+		INSERT INTO maddy_sieve(username, script)
+		VALUES (?, ?)`), username, script); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveSieveScript removes the Sieve script of the account.
+func (store *Storage) RemoveSieveScript(username string) error {
+	_, err := store.Back.DB.Exec(store.rebindSQL(`
+		DELETE FROM maddy_sieve
+		WHERE username = ?`), username)
+	return err
+}
+
+// SieveScript returns the Sieve script of the account. Empty string is
+// returned if there is no script.
+func (store *Storage) SieveScript(username string) (string, error) {
+	var script string
+	err := store.Back.DB.QueryRow(store.rebindSQL(`
+		SELECT script
+		FROM maddy_sieve
+		WHERE username = ?`), username).Scan(&script)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return script, err
+}
+
+func (store *Storage) loadSieveScript(username string) (*sieve.Script, error) {
+	src, err := store.SieveScript(username)
+	if err != nil {
+		return nil, err
+	}
+	if src == "" {
+		return nil, nil
+	}
+	script, err := sieve.Parse(src)
+	if err != nil {
+		// Scripts are checked when they are set, this can happen only if
+		// the script was put into the DB directly.
+		store.Log.Error("malformed Sieve script, ignoring", err, "username", username)
+		return nil, nil
+	}
+	return script, nil
+}
+
+// vacationKey returns the value used to track vacation responses for the
+// handle.
+func vacationKey(handle string) string {
+	if len(handle) <= 64 {
+		return handle
+	}
+	sum := sha1.Sum([]byte(handle))
+	return hex.EncodeToString(sum[:])
+}
+
+func (store *Storage) vacationSentAt(username, sender, handle string) (time.Time, error) {
+	var sentAt int64
+	err := store.Back.DB.QueryRow(store.rebindSQL(`
+		SELECT sent_at
+		FROM maddy_sieve_vacation
+		WHERE username = ? AND sender = ? AND handle = ?`), username, sender, vacationKey(handle)).Scan(&sentAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sentAt, 0), nil
+}
+
+func (store *Storage) recordVacation(username, sender, handle string, sentAt time.Time) error {
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// Records older than the maximum allowed interval are not needed anymore.
+	if _, err := tx.Exec(store.rebindSQL(`
+		DELETE FROM maddy_sieve_vacation
+		WHERE username = ? AND (sent_at < ? OR (sender = ? AND handle = ?))`),
+		username, sentAt.Add(-sieve.MaxVacationDays*24*time.Hour).Unix(), sender, vacationKey(handle)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(store.rebindSQL(`
+		INSERT INTO maddy_sieve_vacation(username, sender, handle, sent_at)
+		VALUES (?, ?, ?, ?)`), username, sender, vacationKey(handle), sentAt.Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type vacationRecord struct {
+	user   string
+	sender string
+	handle string
+}
+
+// runSieve executes the script of the pending recipient and schedules
+// resulting actions. It returns the list of mailboxes the message should be
+// stored in, empty string means the default one.
+func (d *delivery) runSieve(ctx context.Context, rcpt pendingRcpt, header textproto.Header, body buffer.Buffer) ([]string, error) {
+	res, err := rcpt.script.Execute(sieve.Message{
+		Header:       header,
+		Size:         int64(body.Len() + headerSize(header)),
+		EnvelopeFrom: d.mailFrom,
+		EnvelopeTo:   rcpt.accountName,
+	})
+	if err != nil {
+		d.store.Log.Error("Sieve script failed, keeping the message", err, "msg_id", d.msgMeta.ID, "username", rcpt.accountName)
+		return []string{""}, nil
+	}
+
+	var mboxes []string
+	if res.Keep {
+		mboxes = append(mboxes, "")
+	}
+	mboxes = append(mboxes, res.FileInto...)
+
+	if len(res.Redirect) != 0 {
+		if d.store.forwardTarget == nil {
+			d.store.Log.Msg("Sieve redirect ignored, forward_target is not configured, keeping the message",
+				"msg_id", d.msgMeta.ID, "username", rcpt.accountName)
+			if !res.Keep {
+				mboxes = append([]string{""}, mboxes...)
+			}
+		} else {
+			for _, addr := range res.Redirect {
+				d.forwardTo = append(d.forwardTo, forwardAddr{user: rcpt.accountName, to: addr})
+			}
+			if n := len(d.forwardedBy); n == 0 || d.forwardedBy[n-1] != rcpt.accountName {
+				d.forwardedBy = append(d.forwardedBy, rcpt.accountName)
+			}
+		}
+	}
+
+	if res.Reject {
+		d.store.Log.Msg("message rejected by Sieve script", "msg_id", d.msgMeta.ID, "username", rcpt.accountName)
+		if err := d.sieveReject(ctx, rcpt.accountName, res.RejectReason, header); err != nil {
+			return nil, err
+		}
+	}
+
+	// Out-of-office settings are used only if the script does not send its
+	// own response.
+	vac := res.Vacation
+	if vac == nil && rcpt.vacation != nil {
+		vac = rcpt.vacation.action()
+	}
+	if vac != nil {
+		if err := d.sendVacation(ctx, rcpt.accountName, vac, header); err != nil {
+			return nil, err
+		}
+	}
+
+	return mboxes, nil
+}
+
+func headerSize(header textproto.Header) int {
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, header); err != nil {
+		return 0
+	}
+	return buf.Len()
+}
+
+func (d *delivery) sieveReject(ctx context.Context, user, reason string, header textproto.Header) error {
+	// Rejection notices are never sent to bounces (RFC 5429, Section 2.1).
+	if d.mailFrom == "" || d.store.forwardTarget == nil {
+		return nil
+	}
+
+	replyHdr := replyHeader(user, d.mailFrom, "Rejected: "+header.Get("Subject"), header)
+	text := fmt.Sprintf("Your message to %s was automatically rejected:\r\n\r\n%s\r\n", user, reason)
+	body, err := textBody(replyHdr, text)
+	if err != nil {
+		return err
+	}
+	return d.sendReply(ctx, user, replyHdr, body)
+}
+
+// vacationSkipReason checks whether the vacation response should be sent for
+// the message as described in RFC 5230, Section 4.5, and RFC 3834.
+func (d *delivery) vacationSkipReason(user string, vac *sieve.Vacation, header textproto.Header) (string, error) {
+	if d.mailFrom == "" {
+		return "null sender", nil
+	}
+	if d.store.forwardTarget == nil {
+		return "forward_target is not configured", nil
+	}
+
+	sender, err := address.ForLookup(d.mailFrom)
+	if err != nil {
+		return "malformed sender", nil
+	}
+	senderLocal, _, err := address.Split(sender)
+	if err != nil {
+		return "malformed sender", nil
+	}
+	switch {
+	case senderLocal == "mailer-daemon", senderLocal == "listserv", senderLocal == "majordomo",
+		strings.HasPrefix(senderLocal, "owner-"), strings.HasSuffix(senderLocal, "-request"):
+		return "sender is a robot", nil
+	}
+
+	if v := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return "auto-submitted message", nil
+	}
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return "bulk message", nil
+	}
+	fields := header.Fields()
+	for fields.Next() {
+		if strings.HasPrefix(strings.ToLower(fields.Key()), "list-") {
+			return "mailing list message", nil
+		}
+	}
+	if isList, _ := d.msgMeta.Facts.Bool(module.FactMailingList); isList {
+		return "mailing list message", nil
+	}
+
+	own := map[string]struct{}{}
+	for _, addr := range append([]string{user}, vac.Addresses...) {
+		if addr, err := address.ForLookup(addr); err == nil {
+			own[addr] = struct{}{}
+		}
+	}
+	if _, ok := own[sender]; ok {
+		return "message from the user itself", nil
+	}
+	addressed := false
+	for _, field := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc", "Resent-Bcc"} {
+		for _, value := range header.Values(field) {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+			for _, addr := range list {
+				addr, err := address.ForLookup(addr.Address)
+				if err != nil {
+					continue
+				}
+				if _, ok := own[addr]; ok {
+					addressed = true
+				}
+			}
+		}
+	}
+	if !addressed {
+		return "user is not listed in recipient fields", nil
+	}
+
+	sentAt, err := d.store.vacationSentAt(user, sender, vac.Handle)
+	if err != nil {
+		return "", err
+	}
+	if time.Since(sentAt) < time.Duration(vac.Days)*24*time.Hour {
+		return "response was sent recently", nil
+	}
+	return "", nil
+}
+
+// sendVacation sends the vacation response unless it should be skipped. It is
+// used both for Sieve vacation action and out-of-office settings.
+func (d *delivery) sendVacation(ctx context.Context, user string, vac *sieve.Vacation, header textproto.Header) error {
+	skip, err := d.vacationSkipReason(user, vac, header)
+	if err != nil {
+		return err
+	}
+	if skip != "" {
+		d.store.Log.DebugMsg("vacation response not sent", "msg_id", d.msgMeta.ID, "username", user, "reason", skip)
+		return nil
+	}
+
+	subject := vac.Subject
+	if subject == "" {
+		subject = "Auto: " + header.Get("Subject")
+	} else {
+		subject = mime.QEncoding.Encode("utf-8", subject)
+	}
+	replyHdr := replyHeader(user, d.mailFrom, subject, header)
+	if vac.From != "" {
+		if from, err := mail.ParseAddress(vac.From); err == nil {
+			replyHdr.Set("From", from.String())
+		}
+	}
+
+	var body []byte
+	if vac.MIME {
+		// Reason is a MIME entity, its header is merged into the message
+		// header.
+		br := bufio.NewReader(strings.NewReader(vac.Reason))
+		partHdr, err := textproto.ReadHeader(br)
+		if err != nil {
+			d.store.Log.Error("malformed vacation :mime reason", err, "msg_id", d.msgMeta.ID, "username", user)
+			return nil
+		}
+		fields := partHdr.Fields()
+		for fields.Next() {
+			replyHdr.Add(fields.Key(), fields.Value())
+		}
+		replyHdr.Set("MIME-Version", "1.0")
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(br); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	} else {
+		body, err = textBody(replyHdr, vac.Reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := d.sendReply(ctx, user, replyHdr, body); err != nil {
+		return err
+	}
+	sender, _ := address.ForLookup(d.mailFrom)
+	d.vacationSent = append(d.vacationSent, vacationRecord{user: user, sender: sender, handle: vac.Handle})
+	return nil
+}
+
+// replyHeader creates the header for the automatic response to the message.
+func replyHeader(user, to, subject string, orig textproto.Header) textproto.Header {
+	h := textproto.Header{}
+	h.Add("Date", time.Now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	h.Add("From", user)
+	h.Add("To", to)
+	h.Add("Subject", subject)
+	h.Add("Auto-Submitted", "auto-replied")
+	if msgID := orig.Get("Message-Id"); msgID != "" {
+		h.Add("In-Reply-To", msgID)
+		refs := strings.TrimSpace(orig.Get("References") + " " + msgID)
+		h.Add("References", refs)
+	}
+	return h
+}
+
+// textBody sets the header fields for a plain text body and encodes text.
+func textBody(h textproto.Header, text string) ([]byte, error) {
+	h.Set("MIME-Version", "1.0")
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sendReply submits the automatic response to forward_target using the null
+// sender. It is committed together with the delivery.
+func (d *delivery) sendReply(ctx context.Context, user string, header textproto.Header, body []byte) error {
+	replyID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	domain := "localhost"
+	if _, userDomain, err := address.Split(user); err == nil && userDomain != "" {
+		domain = userDomain
+	}
+	header.Set("Message-Id", "<"+replyID+"@"+domain+">")
+
+	msgMeta := &module.MsgMetadata{
+		ID:      replyID,
+		TraceID: d.msgMeta.Trace(),
+	}
+	reply, err := d.store.forwardTarget.Start(ctx, msgMeta, "")
+	if err != nil {
+		return err
+	}
+	if err := reply.AddRcpt(ctx, d.mailFrom); err != nil {
+		reply.Abort(ctx) //nolint:errcheck
+		return err
+	}
+	if err := reply.Body(ctx, header, buffer.MemoryBuffer{Slice: body}); err != nil {
+		reply.Abort(ctx) //nolint:errcheck
+		return err
+	}
+
+	d.store.Log.Msg("automatic response generated", "msg_id", d.msgMeta.ID, "reply_id", replyID,
+		"username", user, "rcpt", d.mailFrom)
+	d.replies = append(d.replies, reply)
+	return nil
+}
+
+// prepareSieveMailbox creates the mailbox used by fileinto if it does not
+// exist. go-imap-sql silently uses the INBOX otherwise.
+func (store *Storage) prepareSieveMailbox(username, mbox string) error {
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			store.Log.Error("logout failed", err, "username", username)
+		}
+	}()
+
+	if _, err := u.GetMailbox(mbox); err == nil {
+		return nil
+	} else if !errors.Is(err, backend.ErrNoSuchMailbox) {
+		return err
+	}
+	if err := u.CreateMailbox(mbox); err != nil && !errors.Is(err, backend.ErrMailboxAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+// storeCopies stores additional copies of the message requested by Sieve
+// scripts. It is done after the main delivery is committed since SQLite does
+// not allow concurrent write transactions. Failures are only logged since the
+// message is already stored once.
+func (d *delivery) storeCopies(header textproto.Header, body buffer.Buffer) {
+	for _, cp := range d.copies {
+		mbox := cp.mailbox
+		if mbox == "" {
+			mbox = "INBOX"
+		}
+
+		cd := d.store.Back.NewDelivery()
+		err := cd.AddRcpt(cp.rcpt.accountName, cp.rcpt.userHeader)
+		if err == nil {
+			err = cd.Mailbox(mbox)
+		}
+		if err == nil {
+			err = cd.BodyParsed(header, body.Len(), body)
+		}
+		if err == nil {
+			err = cd.Commit()
+		}
+		if err != nil {
+			cd.Abort() //nolint:errcheck
+			d.store.Log.Error("failed to store message copy", err, "msg_id", d.msgMeta.ID,
+				"username", cp.rcpt.accountName, "mailbox", mbox)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+//+build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func mailboxCount(t *testing.T, store *Storage, username, mailbox string) uint32 {
+	t.Helper()
+	u, err := store.GetIMAPAcct(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Logout()
+	mbox, err := u.GetMailbox(mailbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusMessages})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Messages
+}
+
+func TestSieve(t *testing.T) {
+	store := sqliteTestStorage(t)
+	tgt := testutils.Target{}
+	store.forwardTarget = &tgt
+
+	scripts := map[string]string{
+		"vacation@example.org": `require ["fileinto", "vacation"];
+			if header :contains "subject" "work" { fileinto "Work"; keep; }
+			vacation :days 1 "I'm away";`,
+		"reject@example.org":   `require "reject"; reject "Go away";`,
+		"redirect@example.org": `redirect "redirect@example.com";`,
+	}
+	for user, script := range scripts {
+		if err := store.CreateIMAPAcct(user); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.SetSieveScript(user, script); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.SetSieveScript("vacation@example.org", `fileinto "Work";`); err == nil {
+		t.Fatal("invalid script is accepted")
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("To", "vacation@example.org, reject@example.org")
+	hdr.Add("Subject", "Work stuff")
+	hdr.Add("Message-Id", "<1@example.net>")
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test1"}, "vacation@example.org", "reject@example.org", "redirect@example.org")
+
+	for _, c := range []struct {
+		user, mbox string
+		want       uint32
+	}{
+		{"vacation@example.org", imap.InboxName, 1},
+		{"vacation@example.org", "Work", 1},
+		{"reject@example.org", imap.InboxName, 0},
+		{"redirect@example.org", imap.InboxName, 0},
+	} {
+		if got := mailboxCount(t, store, c.user, c.mbox); got != c.want {
+			t.Errorf("%s/%s: want %d messages, got %d", c.user, c.mbox, c.want, got)
+		}
+	}
+
+	// Vacation response, rejection notice and redirected message.
+	if len(tgt.Messages) != 3 {
+		t.Fatalf("wrong amount of generated messages: %d", len(tgt.Messages))
+	}
+	var redirected, vacation, rejection *testutils.Msg
+	for i, msg := range tgt.Messages {
+		switch {
+		case msg.MailFrom != "":
+			redirected = &tgt.Messages[i]
+		case msg.Header.Get("From") == "vacation@example.org":
+			vacation = &tgt.Messages[i]
+		case msg.Header.Get("From") == "reject@example.org":
+			rejection = &tgt.Messages[i]
+		}
+	}
+	if redirected == nil || vacation == nil || rejection == nil {
+		t.Fatalf("unexpected messages generated: %+v", tgt.Messages)
+	}
+	testutils.CheckMsgID(t, redirected, "sender@example.net", []string{"redirect@example.com"}, "")
+	if got := redirected.Header.Get("Delivered-To"); got != "redirect@example.org" {
+		t.Errorf("wrong Delivered-To in redirected message: %q", got)
+	}
+	for _, msg := range []*testutils.Msg{vacation, rejection} {
+		if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "sender@example.net" {
+			t.Errorf("wrong response recipients: %v", msg.RcptTo)
+		}
+		if msg.Header.Get("Auto-Submitted") != "auto-replied" {
+			t.Error("Auto-Submitted field is missing")
+		}
+		if msg.Header.Get("In-Reply-To") != "<1@example.net>" {
+			t.Errorf("wrong In-Reply-To: %q", msg.Header.Get("In-Reply-To"))
+		}
+	}
+	if got := vacation.Header.Get("Subject"); got != "Auto: Work stuff" {
+		t.Errorf("wrong vacation subject: %q", got)
+	}
+	if !strings.Contains(string(vacation.Body), "I'm away") {
+		t.Errorf("wrong vacation body: %q", vacation.Body)
+	}
+	if !strings.Contains(string(rejection.Body), "Go away") {
+		t.Errorf("wrong rejection body: %q", rejection.Body)
+	}
+
+	// Vacation response is sent only once during the :days interval and
+	// never to mailing lists.
+	tgt.Messages = nil
+	hdr.Set("Subject", "Hello again")
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test2"}, "vacation@example.org")
+	hdr.Add("List-Id", "<list.example.net>")
+	if err := store.RemoveSieveScript("vacation@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetSieveScript("vacation@example.org", `require "vacation"; vacation :handle "other" "Away";`); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test3"}, "vacation@example.org")
+	if len(tgt.Messages) != 0 {
+		t.Fatalf("unexpected vacation responses: %d", len(tgt.Messages))
+	}
+	if got := mailboxCount(t, store, "vacation@example.org", imap.InboxName); got != 3 {
+		t.Errorf("want 3 messages in INBOX, got %d", got)
+	}
+
+	if err := store.RemoveSieveScript("vacation@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	script, err := store.SieveScript("vacation@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script != "" {
+		t.Fatal("script is not removed")
+	}
+}
@@ -0,0 +1,136 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/foxcpp/maddy/framework/address"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
+)
+
+// subaddress returns the part of the local part after the first delimiter
+// character, e.g. "lists" for "user+lists@example.org". Empty string is
+// returned if subaddress_delimiter is not set or the address has no
+// subaddress.
+func (store *Storage) subaddress(addr string) string {
+	if store.subaddrDelims == "" {
+		return ""
+	}
+	mbox, _, err := address.Split(addr)
+	if err != nil {
+		return ""
+	}
+	indx := strings.IndexAny(mbox, store.subaddrDelims)
+	if indx == -1 {
+		return ""
+	}
+	return mbox[indx+1:]
+}
+
+// isSpecialUse reports whether the mailbox has a special-use attribute
+// (RFC 6154).
+func isSpecialUse(info *imap.MailboxInfo) bool {
+	for _, attr := range info.Attributes {
+		switch attr {
+		case imap.AllAttr, imap.ArchiveAttr, imap.DraftsAttr, imap.FlaggedAttr,
+			imap.JunkAttr, imap.SentAttr, imap.TrashAttr, imap.ImportantAttr:
+			return true
+		}
+	}
+	return false
+}
+
+// subaddressMailbox returns the name of the existing user folder matching
+// the subaddress. Matching is case-insensitive, exact match is preferred.
+// Empty string is returned if there is no such folder.
+//
+// Only top-level folders without special-use attributes are considered so
+// the sender cannot put messages into Sent, Trash or a nested folder.
+func (store *Storage) subaddressMailbox(username, subaddr string) (string, error) {
+	if strings.Contains(subaddr, imapsql.MailboxPathSep) {
+		return "", nil
+	}
+
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := u.Logout(); err != nil {
+			store.Log.Error("logout failed", err, "username", username)
+		}
+	}()
+
+	mbox, err := u.GetMailbox(subaddr)
+	if errors.Is(err, backend.ErrNoSuchMailbox) {
+		mbox = nil
+
+		mboxes, err := u.ListMailboxes(false)
+		if err != nil {
+			return "", err
+		}
+		for _, m := range mboxes {
+			if strings.EqualFold(m.Name(), subaddr) {
+				mbox = m
+				break
+			}
+		}
+		if mbox == nil {
+			return "", nil
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	info, err := mbox.Info()
+	if err != nil {
+		return "", err
+	}
+	if isSpecialUse(info) {
+		return "", nil
+	}
+	return mbox.Name(), nil
+}
+
+// subaddressMailboxes resolves subaddresses of recipients kept for local
+// delivery into folder names.
+func (d *delivery) subaddressMailboxes() map[string]string {
+	mboxes := make(map[string]string, len(d.subaddrs))
+	for rcpt, subaddr := range d.subaddrs {
+		if _, ok := d.addedRcpts[rcpt]; !ok {
+			continue
+		}
+		mbox, err := d.store.subaddressMailbox(rcpt, subaddr)
+		if err != nil {
+			// Not fatal, the message is stored in INBOX.
+			d.store.Log.Error("subaddress folder lookup failed", err, "msg_id", d.msgMeta.ID, "username", rcpt)
+			continue
+		}
+		if mbox == "" {
+			d.store.Log.DebugMsg("no folder for subaddress, using INBOX", "msg_id", d.msgMeta.ID, "username", rcpt, "subaddress", subaddr)
+			continue
+		}
+		mboxes[rcpt] = mbox
+	}
+	return mboxes
+}
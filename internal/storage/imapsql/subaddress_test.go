@@ -0,0 +1,124 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+	imapsql "github.com/foxcpp/maddy/third_party/go-imap-sql"
+)
+
+func TestSubaddress(t *testing.T) {
+	store := &Storage{subaddrDelims: "+-"}
+	for addr, want := range map[string]string{
+		"user+lists@example.org": "lists",
+		"user-lists@example.org": "lists",
+		"user+a+b@example.org":   "a+b",
+		"user@example.org":       "",
+		"user+@example.org":      "",
+		"postmaster":             "",
+		"first.last@example.org": "",
+		"user+Lists@example.org": "Lists",
+		"user-x+y@example.org":   "x+y",
+		"not an address":         "",
+		"+lists@example.org":     "lists",
+	} {
+		if got := store.subaddress(addr); got != want {
+			t.Errorf("subaddress(%q) = %q, want %q", addr, got, want)
+		}
+	}
+
+	store.subaddrDelims = ""
+	if got := store.subaddress("user+lists@example.org"); got != "" {
+		t.Errorf("subaddress with no delimiter = %q", got)
+	}
+}
+
+func TestSubaddressDelivery(t *testing.T) {
+	store := sqliteTestStorage(t)
+	store.Back.EnableSpecialUseExt()
+	store.subaddrDelims = "+"
+	store.junkMbox = "Junk"
+	// Mimic delivery_map stripping the subaddress.
+	store.deliveryNormalize = func(_ context.Context, s string) (string, error) {
+		mbox, domain := s[:strings.IndexByte(s, '@')], s[strings.IndexByte(s, '@'):]
+		if indx := strings.IndexByte(mbox, '+'); indx != -1 {
+			mbox = mbox[:indx]
+		}
+		return mbox + domain, nil
+	}
+
+	for _, user := range []string{"a@example.org", "b@example.org"} {
+		if err := store.CreateIMAPAcct(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := store.GetIMAPAcct("a@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mbox := range []string{"Lists", "Lists.Work"} {
+		if err := u.CreateMailbox(mbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := u.(*imapsql.User).CreateMailboxSpecial("Sent", imap.SentAttr); err != nil {
+		t.Fatal(err)
+	}
+	u.Logout()
+
+	hdr := textproto.Header{}
+	hdr.Add("Message-Id", "<1@example.net>")
+
+	// Subaddress in the recipient address, case-insensitive match.
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test1"}, "a+lists@example.org")
+	// Subaddress removed by rewrites, but present in the original address.
+	deliver(t, store, hdr, &module.MsgMetadata{
+		ID:            "test2",
+		OriginalRcpts: map[string]string{"a@example.org": "a+Lists@example.org"},
+	}, "a@example.org")
+	// No matching folder.
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test3"}, "a+other@example.org", "b+lists@example.org")
+	// Special-use and nested folders are not used.
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test5"}, "a+sent@example.org")
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test6"}, "a+Lists.Work@example.org")
+	// Quarantined messages go to Junk.
+	deliver(t, store, hdr, &module.MsgMetadata{ID: "test4", Quarantine: true}, "a+lists@example.org")
+
+	for _, c := range []struct {
+		user, mbox string
+		want       uint32
+	}{
+		{"a@example.org", "Lists", 2},
+		{"a@example.org", imap.InboxName, 3},
+		{"a@example.org", "Sent", 0},
+		{"a@example.org", "Lists.Work", 0},
+		{"a@example.org", "Junk", 1},
+		{"b@example.org", imap.InboxName, 1},
+	} {
+		if got := mailboxCount(t, store, c.user, c.mbox); got != c.want {
+			t.Errorf("%s/%s: want %d messages, got %d", c.user, c.mbox, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/sieve"
+)
+
+// Out-of-office settings are a simpler alternative to the Sieve vacation
+// action for users that do not need scripts. Responses are generated using
+// the same code as Sieve vacation responses and are subject to the same
+// rate limiting and loop avoidance rules.
+
+// vacationHandle is the Sieve vacation handle used for responses generated
+// using out-of-office settings.
+const vacationHandle = "maddy-vacation"
+
+// VacationSettings are per-user out-of-office settings.
+type VacationSettings struct {
+	Enabled bool
+	Subject string
+	Message string
+
+	// Days is the minimal interval between responses sent to the same
+	// sender.
+	Days int
+
+	// Responses are sent only between Start and End. Zero values mean no
+	// limit.
+	Start time.Time
+	End   time.Time
+}
+
+// Active reports whether the responses should be sent at the specified time.
+func (vs VacationSettings) Active(now time.Time) bool {
+	if !vs.Enabled {
+		return false
+	}
+	if !vs.Start.IsZero() && now.Before(vs.Start) {
+		return false
+	}
+	if !vs.End.IsZero() && !now.Before(vs.End) {
+		return false
+	}
+	return true
+}
+
+func (vs VacationSettings) action() *sieve.Vacation {
+	return &sieve.Vacation{
+		Days:    vs.Days,
+		Subject: vs.Subject,
+		Handle:  vacationHandle,
+		Reason:  vs.Message,
+	}
+}
+
+func (store *Storage) initVacation() error {
+	_, err := store.Back.DB.Exec(`
+		CREATE TABLE IF NOT EXISTS maddy_vacation (
+			username VARCHAR(255) PRIMARY KEY NOT NULL,
+			enabled INTEGER NOT NULL,
+			subject TEXT NOT NULL,
+			message TEXT NOT NULL,
+			days INTEGER NOT NULL,
+			start_at BIGINT NOT NULL,
+			end_at BIGINT NOT NULL
+		)`)
+	if err != nil {
+		return fmt.Errorf("imapsql: vacation schema: %w", err)
+	}
+	return nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(ts int64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(ts, 0)
+}
+
+// SetVacation replaces out-of-office settings of the account.
+//
+// Responses already sent using the previous settings are forgotten so senders
+// will get the new message.
+func (store *Storage) SetVacation(username string, vs VacationSettings) error {
+	u, err := store.Back.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if err := u.Logout(); err != nil {
+		store.Log.Error("logout failed", err, "username", username)
+	}
+
+	if vs.Message == "" {
+		return errors.New("imapsql: vacation message can't be empty")
+	}
+	if vs.Days == 0 {
+		vs.Days = sieve.DefaultVacationDays
+	}
+	if vs.Days < sieve.MinVacationDays || vs.Days > sieve.MaxVacationDays {
+		return fmt.Errorf("imapsql: vacation interval should be between %d and %d days",
+			sieve.MinVacationDays, sieve.MaxVacationDays)
+	}
+	if !vs.Start.IsZero() && !vs.End.IsZero() && !vs.End.After(vs.Start) {
+		return errors.New("imapsql: vacation end should be after start")
+	}
+
+	enabled := 0
+	if vs.Enabled {
+		enabled = 1
+	}
+
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(store.rebindSQL(`
+		DELETE FROM maddy_vacation
+		WHERE username = ?`), username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(store.rebindSQL(`
+		INSERT INTO maddy_vacation(username, enabled, subject, message, days, start_at, end_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		username, enabled, vs.Subject, vs.Message, vs.Days, unixOrZero(vs.Start), unixOrZero(vs.End)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(store.rebindSQL(`
+		DELETE FROM maddy_sieve_vacation
+		WHERE username = ? AND handle = ?`), username, vacationHandle); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveVacation removes out-of-office settings of the account.
+func (store *Storage) RemoveVacation(username string) error {
+	_, err := store.Back.DB.Exec(store.rebindSQL(`
+		DELETE FROM maddy_vacation
+		WHERE username = ?`), username)
+	return err
+}
+
+// Vacation returns out-of-office settings of the account. nil is returned if
+// there are no settings.
+func (store *Storage) Vacation(username string) (*VacationSettings, error) {
+	var (
+		vs           VacationSettings
+		enabled      int
+		start, endTs int64
+	)
+	err := store.Back.DB.QueryRow(store.rebindSQL(`
+		SELECT enabled, subject, message, days, start_at, end_at
+		FROM maddy_vacation
+		WHERE username = ?`), username).Scan(&enabled, &vs.Subject, &vs.Message, &vs.Days, &start, &endTs)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	vs.Enabled = enabled != 0
+	vs.Start = timeOrZero(start)
+	vs.End = timeOrZero(endTs)
+	return &vs, nil
+}
+
+// loadVacation returns out-of-office settings of the account if responses
+// should be sent now.
+func (store *Storage) loadVacation(username string) (*VacationSettings, error) {
+	vs, err := store.Vacation(username)
+	if err != nil {
+		return nil, err
+	}
+	if vs == nil || !vs.Active(time.Now()) {
+		return nil, nil
+	}
+	return vs, nil
+}
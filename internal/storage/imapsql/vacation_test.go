@@ -0,0 +1,142 @@
+//+build cgo,!nosqlite3
+
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+
+package imapsql
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestVacation(t *testing.T) {
+	store := sqliteTestStorage(t)
+	tgt := testutils.Target{}
+	store.forwardTarget = &tgt
+
+	const user = "away@example.org"
+	if err := store.CreateIMAPAcct(user); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vs := range []VacationSettings{
+		{Enabled: true},
+		{Enabled: true, Message: "Away", Days: 100},
+		{Enabled: true, Message: "Away", Start: time.Now(), End: time.Now().Add(-time.Hour)},
+	} {
+		if err := store.SetVacation(user, vs); err == nil {
+			t.Errorf("invalid settings accepted: %+v", vs)
+		}
+	}
+
+	vs := VacationSettings{
+		Enabled: true,
+		Subject: "Out of office",
+		Message: "Back on Monday",
+		End:     time.Now().Add(time.Hour),
+	}
+	if err := store.SetVacation(user, vs); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.Vacation(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.Message != vs.Message || stored.Days != 7 || stored.End.Unix() != vs.End.Unix() {
+		t.Fatalf("wrong stored settings: %+v", stored)
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("To", user)
+	hdr.Add("Subject", "Hello")
+	hdr.Add("Message-Id", "<1@example.net>")
+
+	expectReplies := func(msgID string, hdr textproto.Header, want int) {
+		t.Helper()
+		tgt.Messages = nil
+		deliver(t, store, hdr, &module.MsgMetadata{ID: msgID}, user)
+		if len(tgt.Messages) != want {
+			t.Fatalf("%s: want %d responses, got %d", msgID, want, len(tgt.Messages))
+		}
+	}
+
+	expectReplies("test1", hdr, 1)
+	reply := tgt.Messages[0]
+	if reply.MailFrom != "" || len(reply.RcptTo) != 1 || reply.RcptTo[0] != "sender@example.net" {
+		t.Errorf("wrong response envelope: %q -> %v", reply.MailFrom, reply.RcptTo)
+	}
+	if got := reply.Header.Get("Subject"); got != "Out of office" {
+		t.Errorf("wrong subject: %q", got)
+	}
+	if reply.Header.Get("Auto-Submitted") != "auto-replied" {
+		t.Error("Auto-Submitted field is missing")
+	}
+	if !strings.Contains(string(reply.Body), "Back on Monday") {
+		t.Errorf("wrong body: %q", reply.Body)
+	}
+
+	// Response is sent once per interval.
+	expectReplies("test2", hdr, 0)
+
+	// New settings reset the interval.
+	vs.Message = "Back on Tuesday"
+	if err := store.SetVacation(user, vs); err != nil {
+		t.Fatal(err)
+	}
+	bulkHdr := hdr.Copy()
+	bulkHdr.Add("Precedence", "bulk")
+	expectReplies("test3", bulkHdr, 0)
+	expectReplies("test4", hdr, 1)
+
+	vs.Enabled = false
+	if err := store.SetVacation(user, vs); err != nil {
+		t.Fatal(err)
+	}
+	expectReplies("test5", hdr, 0)
+
+	vs.Enabled = true
+	vs.Start = time.Now().Add(-2 * time.Hour)
+	vs.End = time.Now().Add(-time.Hour)
+	if err := store.SetVacation(user, vs); err != nil {
+		t.Fatal(err)
+	}
+	expectReplies("test6", hdr, 0)
+
+	if got := mailboxCount(t, store, user, imap.InboxName); got != 6 {
+		t.Errorf("want 6 messages in INBOX, got %d", got)
+	}
+
+	if err := store.RemoveVacation(user); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = store.Vacation(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != nil {
+		t.Fatal("settings are not removed")
+	}
+}
@@ -0,0 +1,464 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package summary
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// certWarnBefore is how long before the certificate expiry the warning
+	// is included in the summary.
+	certWarnBefore = 14 * 24 * time.Hour
+	// queueWarnAge is the age of the oldest queued message that causes the
+	// warning.
+	queueWarnAge = 24 * time.Hour
+	// diskWarnUsage is the disk usage ratio that causes the warning.
+	diskWarnUsage = 0.9
+	// historyLines is the maximum amount of previous periods listed in the
+	// summary.
+	historyLines = 14
+)
+
+type volumeMetric struct {
+	name string
+	desc string
+	// Label used to break down the total, if any.
+	label string
+}
+
+var volumeMetrics = []volumeMetric{
+	{"maddy_smtp_started_transactions", "SMTP transactions started", "module"},
+	{"maddy_smtp_smtp_completed_transactions", "Messages accepted", "module"},
+	{"maddy_smtp_aborted_transactions", "Transactions aborted", "module"},
+	{"maddy_smtp_rejections", "Commands rejected", ""},
+	{"maddy_check_quarantined", "Messages quarantined", ""},
+	{"maddy_smtp_ratelimit_deferred", "Deferred by rate limits", ""},
+	{"maddy_remote_conns_tls_level", "Outbound connections", "level"},
+}
+
+type volumeLine struct {
+	desc  string
+	count float64
+	// Average over previous periods, negative if there are none.
+	avg       float64
+	breakdown []entry
+}
+
+type entry struct {
+	key   string
+	count float64
+}
+
+type queueStatus struct {
+	name     string
+	messages int
+	oldest   time.Time
+	maxTries int
+	err      error
+}
+
+type certStatus struct {
+	names    []string
+	notAfter time.Time
+}
+
+type diskStatus struct {
+	path        string
+	total, free uint64
+	err         error
+}
+
+type summary struct {
+	hostname string
+	start    time.Time
+	end      time.Time
+	warnings []string
+
+	volume      []volumeLine
+	rejections  []entry
+	quarantines []entry
+	queues      []queueStatus
+	certs       []certStatus
+	certsErr    error
+	disks       []diskStatus
+	// Previous periods, newest first.
+	history []*Period
+}
+
+// parseKey splits the counter key into the metric name and labels.
+func parseKey(key string) (string, map[string]string) {
+	idx := strings.IndexByte(key, '{')
+	if idx == -1 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	name, rest := key[:idx], key[idx+1:len(key)-1]
+
+	labels := make(map[string]string)
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq == -1 || eq+1 >= len(rest) || rest[eq+1] != '"' {
+			break
+		}
+		label := rest[:eq]
+
+		// Find the closing quote, skipping escaped characters.
+		end := eq + 2
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			break
+		}
+		val, err := strconv.Unquote(rest[eq+1 : end+1])
+		if err != nil {
+			break
+		}
+		labels[label] = val
+		rest = strings.TrimPrefix(rest[end+1:], ",")
+	}
+	return name, labels
+}
+
+// total returns the sum of all counters for the metric.
+func (c Counters) total(name string) float64 {
+	var sum float64
+	for key, val := range c {
+		if key == name || strings.HasPrefix(key, name+"{") {
+			sum += val
+		}
+	}
+	return sum
+}
+
+// by returns the sum of counters for the metric grouped using the key
+// function.
+func (c Counters) by(name string, keyFunc func(labels map[string]string) string) map[string]float64 {
+	res := make(map[string]float64)
+	for key, val := range c {
+		if !strings.HasPrefix(key, name+"{") {
+			continue
+		}
+		_, labels := parseKey(key)
+		res[keyFunc(labels)] += val
+	}
+	return res
+}
+
+func topEntries(m map[string]float64, n int) []entry {
+	res := make([]entry, 0, len(m))
+	for k, v := range m {
+		if v == 0 {
+			continue
+		}
+		res = append(res, entry{key: k, count: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].count != res[j].count {
+			return res[i].count > res[j].count
+		}
+		return res[i].key < res[j].key
+	})
+	if n != 0 && len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
+
+func labelValue(name string) func(map[string]string) string {
+	return func(labels map[string]string) string {
+		if v := labels[name]; v != "" {
+			return v
+		}
+		return "unknown"
+	}
+}
+
+// summarize collects the summary for the finished period p. history
+// contains stored finished periods, newest first, and may include p.
+func (r *Reporter) summarize(p *Period, history []*Period) *summary {
+	sum := &summary{
+		hostname: r.hostname,
+		start:    p.Start,
+		end:      p.End,
+	}
+	for _, h := range history {
+		if h.Start.Equal(p.Start) {
+			continue
+		}
+		sum.history = append(sum.history, h)
+	}
+
+	for _, m := range volumeMetrics {
+		line := volumeLine{
+			desc:  m.desc,
+			count: p.Counters.total(m.name),
+			avg:   -1,
+		}
+		if len(sum.history) != 0 {
+			var total float64
+			for _, h := range sum.history {
+				total += h.Counters.total(m.name)
+			}
+			line.avg = total / float64(len(sum.history))
+		}
+		if m.label != "" {
+			line.breakdown = topEntries(p.Counters.by(m.name, labelValue(m.label)), 0)
+			if len(line.breakdown) < 2 {
+				line.breakdown = nil
+			}
+		}
+		sum.volume = append(sum.volume, line)
+	}
+
+	sum.rejections = topEntries(p.Counters.by("maddy_smtp_rejections", func(labels map[string]string) string {
+		return labelValue("check")(labels) + " " + labels["smtp_code"]
+	}), r.top)
+	sum.quarantines = topEntries(p.Counters.by("maddy_check_quarantined", labelValue("check")), r.top)
+
+	now := r.now()
+
+	for _, q := range r.queues {
+		status := queueStatus{name: q.InstanceName()}
+		entries, err := q.Entries()
+		if err != nil {
+			status.err = err
+			sum.warnings = append(sum.warnings, fmt.Sprintf("Failed to read queue %s: %v", status.name, err))
+			sum.queues = append(sum.queues, status)
+			continue
+		}
+		for _, e := range entries {
+			status.messages++
+			if status.oldest.IsZero() || e.Meta.FirstAttempt.Before(status.oldest) {
+				status.oldest = e.Meta.FirstAttempt
+			}
+			for _, tries := range e.Meta.TriesCount {
+				if tries > status.maxTries {
+					status.maxTries = tries
+				}
+			}
+		}
+		if status.messages != 0 && now.Sub(status.oldest) > queueWarnAge {
+			sum.warnings = append(sum.warnings, fmt.Sprintf("Queue %s has messages not delivered for %s", status.name, formatAge(now.Sub(status.oldest))))
+		}
+		sum.queues = append(sum.queues, status)
+	}
+
+	if r.tlsConfig != nil {
+		sum.certs, sum.certsErr = certificates(r.tlsConfig)
+		for _, cert := range sum.certs {
+			names := strings.Join(cert.names, ", ")
+			switch left := cert.notAfter.Sub(now); {
+			case left <= 0:
+				sum.warnings = append(sum.warnings, fmt.Sprintf("Certificate for %s has expired", names))
+			case left < certWarnBefore:
+				sum.warnings = append(sum.warnings, fmt.Sprintf("Certificate for %s expires in %s", names, formatAge(left)))
+			}
+		}
+	}
+
+	for _, path := range r.disks {
+		status := diskStatus{path: path}
+		status.total, status.free, status.err = diskUsage(path)
+		if status.err == nil && status.total != 0 {
+			if used := 1 - float64(status.free)/float64(status.total); used >= diskWarnUsage {
+				sum.warnings = append(sum.warnings, fmt.Sprintf("Disk containing %s is %.0f%% full", path, used*100))
+			}
+		}
+		sum.disks = append(sum.disks, status)
+	}
+
+	return sum
+}
+
+// certificates returns certificates from the TLS configuration.
+func certificates(cfg *tls.Config) ([]certStatus, error) {
+	if cfg.GetConfigForClient != nil {
+		var err error
+		cfg, err = cfg.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Certificates) == 0 && cfg.GetCertificate != nil {
+		return nil, errors.New("certificates are obtained dynamically and cannot be listed")
+	}
+
+	var res []certStatus
+	for _, cert := range cfg.Certificates {
+		leaf := cert.Leaf
+		if leaf == nil {
+			if len(cert.Certificate) == 0 {
+				continue
+			}
+			var err error
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		status := certStatus{
+			names:    leaf.DNSNames,
+			notAfter: leaf.NotAfter,
+		}
+		if len(status.names) == 0 {
+			status.names = []string{leaf.Subject.CommonName}
+		}
+		res = append(res, status)
+	}
+	return res, nil
+}
+
+// formatAge formats the duration in days or hours.
+func formatAge(d time.Duration) string {
+	if d >= 48*time.Hour {
+		return strconv.Itoa(int(d/(24*time.Hour))) + " days"
+	}
+	return strconv.Itoa(int(d/time.Hour)) + " hours"
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return strconv.FormatUint(b, 10) + " B"
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
+const timeLayout = "2006-01-02 15:04 -0700"
+
+// Text renders the summary as a plain text with CRLF line endings.
+func (sum *summary) Text() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Summary for %s\n", sum.hostname)
+	fmt.Fprintf(&b, "Period: %s - %s\n", sum.start.Format(timeLayout), sum.end.Format(timeLayout))
+
+	if len(sum.warnings) != 0 {
+		b.WriteString("\nWarnings:\n")
+		for _, w := range sum.warnings {
+			fmt.Fprintf(&b, "  - %s\n", w)
+		}
+	}
+
+	b.WriteString("\nMessage volume")
+	if len(sum.history) != 0 {
+		b.WriteString(" (average over previous periods in parentheses)")
+	}
+	b.WriteString(":\n")
+	for _, line := range sum.volume {
+		fmt.Fprintf(&b, "  %-28s %8.0f", line.desc, line.count)
+		if line.avg >= 0 {
+			fmt.Fprintf(&b, " (%.0f)", line.avg)
+		}
+		b.WriteString("\n")
+		if len(line.breakdown) != 0 {
+			parts := make([]string, 0, len(line.breakdown))
+			for _, e := range line.breakdown {
+				parts = append(parts, fmt.Sprintf("%s %.0f", e.key, e.count))
+			}
+			fmt.Fprintf(&b, "    %s\n", strings.Join(parts, ", "))
+		}
+	}
+
+	writeEntries(&b, "Top rejection reasons", sum.rejections)
+	writeEntries(&b, "Top quarantining checks", sum.quarantines)
+
+	if len(sum.queues) != 0 {
+		b.WriteString("\nQueues:\n")
+		for _, q := range sum.queues {
+			switch {
+			case q.err != nil:
+				fmt.Fprintf(&b, "  %s: %v\n", q.name, q.err)
+			case q.messages == 0:
+				fmt.Fprintf(&b, "  %s: empty\n", q.name)
+			default:
+				fmt.Fprintf(&b, "  %s: %d messages, oldest queued at %s, up to %d attempts\n",
+					q.name, q.messages, q.oldest.Format(timeLayout), q.maxTries)
+			}
+		}
+	}
+
+	if len(sum.certs) != 0 || sum.certsErr != nil {
+		b.WriteString("\nCertificates:\n")
+		if sum.certsErr != nil {
+			fmt.Fprintf(&b, "  %v\n", sum.certsErr)
+		}
+		for _, cert := range sum.certs {
+			fmt.Fprintf(&b, "  %s: valid until %s\n", strings.Join(cert.names, ", "), cert.notAfter.Format(timeLayout))
+		}
+	}
+
+	if len(sum.disks) != 0 {
+		b.WriteString("\nDisk usage:\n")
+		for _, d := range sum.disks {
+			if d.err != nil {
+				fmt.Fprintf(&b, "  %s: %v\n", d.path, d.err)
+				continue
+			}
+			var used float64
+			if d.total != 0 {
+				used = 100 - float64(d.free)/float64(d.total)*100
+			}
+			fmt.Fprintf(&b, "  %s: %.0f%% used, %s free of %s\n", d.path, used, formatBytes(d.free), formatBytes(d.total))
+		}
+	}
+
+	if len(sum.history) != 0 {
+		b.WriteString("\nPrevious periods:\n")
+		fmt.Fprintf(&b, "  %-10s %10s %10s %12s\n", "Start", "Accepted", "Rejected", "Quarantined")
+		for i, h := range sum.history {
+			if i == historyLines {
+				break
+			}
+			fmt.Fprintf(&b, "  %-10s %10.0f %10.0f %12.0f\n", h.Start.Format("2006-01-02"),
+				h.Counters.total("maddy_smtp_smtp_completed_transactions"),
+				h.Counters.total("maddy_smtp_rejections"),
+				h.Counters.total("maddy_check_quarantined"))
+		}
+	}
+
+	return strings.ReplaceAll(b.String(), "\n", "\r\n")
+}
+
+func writeEntries(b *strings.Builder, title string, entries []entry) {
+	if len(entries) == 0 {
+		return
+	}
+	fmt.Fprintf(b, "\n%s:\n", title)
+	for _, e := range entries {
+		fmt.Fprintf(b, "  %-36s %8.0f\n", e.key, e.count)
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package summary
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// send delivers the summary to configured recipients.
+func (r *Reporter) send(ctx context.Context, sum *summary) error {
+	msgID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+
+	subject := fmt.Sprintf("Summary for %s: %s", r.hostname, sum.start.Format("2006-01-02"))
+	if len(sum.warnings) != 0 {
+		subject += fmt.Sprintf(" (%d warnings)", len(sum.warnings))
+	}
+
+	hdr := textproto.Header{}
+	hdr.Add("Date", r.now().Format("Mon, 2 Jan 2006 15:04:05 -0700"))
+	hdr.Add("Message-ID", "<"+msgID+"@"+r.hostname+">")
+	hdr.Add("From", r.from)
+	hdr.Add("To", strings.Join(r.rcpts, ", "))
+	hdr.Add("Subject", subject)
+	hdr.Add("Auto-Submitted", "auto-generated")
+	hdr.Add("MIME-Version", "1.0")
+	hdr.Add("Content-Type", "text/plain; charset=utf-8")
+	hdr.Add("Content-Transfer-Encoding", "8bit")
+
+	msgCtx, msgTask := trace.NewTask(ctx, "Summary report")
+	defer msgTask.End()
+
+	d, err := r.target.Start(msgCtx, &module.MsgMetadata{ID: msgID}, r.from)
+	if err != nil {
+		return err
+	}
+	added := 0
+	for _, rcpt := range r.rcpts {
+		if err := d.AddRcpt(msgCtx, rcpt); err != nil {
+			r.log.Error("failed to add summary recipient", err, "rcpt", rcpt)
+			continue
+		}
+		added++
+	}
+	if added == 0 {
+		if err := d.Abort(msgCtx); err != nil {
+			r.log.Error("failed to abort the summary delivery", err)
+		}
+		return fmt.Errorf("all summary recipients are rejected")
+	}
+	if err := d.Body(msgCtx, hdr, buffer.MemoryBuffer{Slice: []byte(sum.Text())}); err != nil {
+		if err := d.Abort(msgCtx); err != nil {
+			r.log.Error("failed to abort the summary delivery", err)
+		}
+		return err
+	}
+	return d.Commit(msgCtx)
+}
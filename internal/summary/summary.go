@@ -0,0 +1,402 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package summary implements the periodic summary email for server
+// operators.
+//
+// Counters exposed via Prometheus metrics are sampled periodically and
+// accumulated per report period in the table module, so statistics survive
+// restarts and are kept for several periods to show the trend. At the end of
+// each period the summary of message volumes, top rejection reasons, queue
+// health, TLS certificates expiry and disk usage is sent to the configured
+// addresses.
+package summary
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	tls2 "github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target/queue"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const modName = "summary_report"
+
+const (
+	currentKey   = "current"
+	periodPrefix = "period "
+
+	// sampleInterval is how often counters are added to the current period.
+	// Counts since the last sample are lost if the server crashes.
+	sampleInterval = 5 * time.Minute
+)
+
+// Counters maps the metric name with labels (e.g.
+// maddy_smtp_rejections{check="check.dnsbl",smtp_code="554"}) to its value.
+type Counters map[string]float64
+
+// Period contains counter increments for the single report period.
+type Period struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end,omitempty"`
+	Counters Counters  `json:"counters"`
+}
+
+type Reporter struct {
+	instName string
+	log      log.Logger
+
+	db        module.MutableTable
+	target    module.DeliveryTarget
+	hostname  string
+	from      string
+	rcpts     []string
+	weekly    bool
+	keep      int
+	top       int
+	queues    []*queue.Queue
+	tlsConfig *tls.Config
+	disks     []string
+	gatherer  prometheus.Gatherer
+
+	// Serializes sampling.
+	lock sync.Mutex
+	// Counter values at the time of the last sample.
+	last Counters
+
+	stop    chan struct{}
+	stopped chan struct{}
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Reporter{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		gatherer: prometheus.DefaultGatherer,
+		last:     Counters{},
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		now:      time.Now,
+	}, nil
+}
+
+func (r *Reporter) Name() string {
+	return modName
+}
+
+func (r *Reporter) InstanceName() string {
+	return r.instName
+}
+
+func (r *Reporter) Init(cfg *config.Map) error {
+	var period string
+
+	cfg.Bool("debug", true, false, &r.log.Debug)
+	cfg.String("hostname", true, true, "", &r.hostname)
+	cfg.String("from", false, false, "", &r.from)
+	cfg.StringList("to", false, true, nil, &r.rcpts)
+	cfg.Custom("db", false, true, nil, func(m *config.Map, node config.Node) (interface{}, error) {
+		var tbl module.MutableTable
+		if err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl); err != nil {
+			return nil, err
+		}
+		return tbl, nil
+	}, &r.db)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &r.target)
+	cfg.Enum("period", false, false, []string{"daily", "weekly"}, "daily", &period)
+	cfg.Int("keep", false, false, 30, &r.keep)
+	cfg.Int("top", false, false, 10, &r.top)
+	cfg.Callback("queue", func(m *config.Map, node config.Node) error {
+		var tgt module.DeliveryTarget
+		if err := modconfig.ModuleFromNode("target", node.Args, node, m.Globals, &tgt); err != nil {
+			return err
+		}
+		q, ok := tgt.(*queue.Queue)
+		if !ok {
+			return config.NodeErr(node, "module is not a queue")
+		}
+		r.queues = append(r.queues, q)
+		return nil
+	})
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &r.tlsConfig)
+	cfg.StringList("disk_usage", false, false, []string{config.StateDirectory}, &r.disks)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	r.weekly = period == "weekly"
+	if r.from == "" {
+		r.from = "postmaster@" + r.hostname
+	}
+	if !address.Valid(r.from) {
+		return fmt.Errorf("%s: invalid from address: %s", modName, r.from)
+	}
+	for _, rcpt := range r.rcpts {
+		if !address.Valid(rcpt) {
+			return fmt.Errorf("%s: invalid recipient address: %s", modName, rcpt)
+		}
+	}
+	if r.keep < 1 {
+		return fmt.Errorf("%s: keep should be positive", modName)
+	}
+	if r.top < 0 {
+		return fmt.Errorf("%s: top can't be negative", modName)
+	}
+
+	go r.sampleLoop()
+	return nil
+}
+
+func (r *Reporter) Close() error {
+	close(r.stop)
+	<-r.stopped
+
+	// Save counts collected since the last sample.
+	if err := r.sample(context.Background()); err != nil {
+		r.log.Error("failed to save statistics", err)
+	}
+	return nil
+}
+
+func (r *Reporter) sampleLoop() {
+	defer close(r.stopped)
+
+	t := time.NewTicker(sampleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := r.sample(context.Background()); err != nil {
+				r.log.Error("failed to save statistics", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// periodStart returns the start of the report period containing t: the
+// local midnight for daily reports or the midnight of the last Monday for
+// weekly ones.
+func (r *Reporter) periodStart(t time.Time) time.Time {
+	y, m, d := t.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	if r.weekly {
+		start = start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	}
+	return start
+}
+
+func (r *Reporter) periodEnd(start time.Time) time.Time {
+	if r.weekly {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// gather returns current values of all maddy counters.
+func (r *Reporter) gather() (Counters, error) {
+	families, err := r.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	res := Counters{}
+	for _, f := range families {
+		if f.GetType() != dto.MetricType_COUNTER || !strings.HasPrefix(f.GetName(), "maddy_") {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			res[counterKey(f.GetName(), m.GetLabel())] = m.GetCounter().GetValue()
+		}
+	}
+	return res, nil
+}
+
+func counterKey(name string, labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"="+strconv.Quote(l.GetValue()))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (r *Reporter) loadCurrent(ctx context.Context) (*Period, error) {
+	val, ok, err := r.db.Lookup(ctx, currentKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return &Period{Start: r.periodStart(r.now()), Counters: Counters{}}, nil
+	}
+	var p Period
+	if err := json.Unmarshal([]byte(val), &p); err != nil {
+		return nil, fmt.Errorf("malformed current period: %w", err)
+	}
+	if p.Counters == nil {
+		p.Counters = Counters{}
+	}
+	return &p, nil
+}
+
+func (r *Reporter) store(key string, p *Period) error {
+	val, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return r.db.SetKey(key, string(val))
+}
+
+// sample adds counter increments since the last sample to the current
+// period. If the period is over, it is saved into the history and the
+// summary is sent.
+//
+// Increments are attributed to the period when they are sampled, so period
+// boundaries are accurate only up to sampleInterval.
+func (r *Reporter) sample(ctx context.Context) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	cur, err := r.gather()
+	if err != nil {
+		return err
+	}
+	p, err := r.loadCurrent(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Finish the period before adding new increments, so counts collected
+	// while the server was down don't end up in a long finished period.
+	var finished *Period
+	if now := r.now(); !now.Before(r.periodEnd(p.Start)) {
+		finished = p
+		finished.End = r.periodEnd(p.Start)
+		if err := r.store(periodPrefix+strconv.FormatInt(p.Start.Unix(), 10), finished); err != nil {
+			return err
+		}
+		p = &Period{Start: r.periodStart(now), Counters: Counters{}}
+	}
+
+	for key, val := range cur {
+		delta := val - r.last[key]
+		if delta < 0 {
+			// Counter was reset.
+			delta = val
+		}
+		if delta != 0 {
+			p.Counters[key] += delta
+		}
+	}
+	r.last = cur
+	if err := r.store(currentKey, p); err != nil {
+		return err
+	}
+	if finished == nil {
+		return nil
+	}
+
+	history, err := r.history()
+	if err != nil {
+		r.log.Error("failed to read history", err)
+	}
+
+	sum := r.summarize(finished, history)
+	if err := r.send(ctx, sum); err != nil {
+		r.log.Error("failed to send the summary", err, "period_start", finished.Start)
+		return nil
+	}
+	r.log.Msg("summary sent", "period_start", finished.Start, "warnings", len(sum.warnings))
+	return nil
+}
+
+// history returns stored finished periods, newest first. Periods beyond the
+// keep limit are removed.
+func (r *Reporter) history() ([]*Period, error) {
+	keys, err := r.db.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	var starts []int64
+	for _, key := range keys {
+		if !strings.HasPrefix(key, periodPrefix) {
+			continue
+		}
+		start, err := strconv.ParseInt(strings.TrimPrefix(key, periodPrefix), 10, 64)
+		if err != nil {
+			r.log.Msg("malformed history key, skipping", "key", key)
+			continue
+		}
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i] > starts[j]
+	})
+
+	var res []*Period
+	for i, start := range starts {
+		key := periodPrefix + strconv.FormatInt(start, 10)
+		if i >= r.keep {
+			if err := r.db.RemoveKey(key); err != nil {
+				return res, err
+			}
+			continue
+		}
+
+		val, _, err := r.db.Lookup(context.Background(), key)
+		if err != nil {
+			return res, err
+		}
+		var p Period
+		if err := json.Unmarshal([]byte(val), &p); err != nil {
+			r.log.Error("malformed history entry, skipping", err, "key", key)
+			continue
+		}
+		res = append(res, &p)
+	}
+	return res, nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,194 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package summary
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/internal/testutils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type mapTable map[string]string
+
+func (m mapTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	v, ok := m[key]
+	return v, ok, nil
+}
+
+func (m mapTable) Keys() ([]string, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m mapTable) SetKey(key, value string) error {
+	m[key] = value
+	return nil
+}
+
+func (m mapTable) RemoveKey(key string) error {
+	delete(m, key)
+	return nil
+}
+
+func TestParseKey(t *testing.T) {
+	name, labels := parseKey(`maddy_smtp_rejections{check="a,\"b\"",smtp_code="554"}`)
+	if name != "maddy_smtp_rejections" {
+		t.Errorf("wrong name: %s", name)
+	}
+	if len(labels) != 2 || labels["check"] != `a,"b"` || labels["smtp_code"] != "554" {
+		t.Errorf("wrong labels: %v", labels)
+	}
+
+	name, labels = parseKey("maddy_test")
+	if name != "maddy_test" || labels != nil {
+		t.Errorf("wrong result for key without labels: %s %v", name, labels)
+	}
+}
+
+func TestReporter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	started := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maddy_smtp_started_transactions",
+	}, []string{"module"})
+	rejections := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "maddy_smtp_rejections",
+	}, []string{"check", "smtp_code"})
+	reg.MustRegister(started, rejections)
+
+	tgt := testutils.Target{}
+	db := mapTable{}
+	now := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	r := &Reporter{
+		log:      testutils.Logger(t, modName),
+		db:       db,
+		target:   &tgt,
+		hostname: "mx.example.org",
+		from:     "postmaster@mx.example.org",
+		rcpts:    []string{"admin@example.org"},
+		keep:     2,
+		top:      10,
+		gatherer: reg,
+		last:     Counters{},
+		now:      func() time.Time { return now },
+	}
+
+	sample := func() {
+		t.Helper()
+		if err := r.sample(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// First day.
+	started.WithLabelValues("smtp").Add(10)
+	sample()
+	started.WithLabelValues("smtp").Add(5)
+	sample()
+	now = now.Add(24 * time.Hour)
+	sample()
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(tgt.Messages))
+	}
+
+	// Second day, the server is restarted in the middle.
+	started.WithLabelValues("smtp").Add(5)
+	rejections.WithLabelValues("check.dnsbl", "554").Add(3)
+	sample()
+	started.Reset()
+	rejections.Reset()
+	r.last = Counters{}
+	started.WithLabelValues("smtp").Add(15)
+	started.WithLabelValues("submission").Add(2)
+	rejections.WithLabelValues("check.dnsbl", "554").Add(4)
+	rejections.WithLabelValues("check.spf", "550").Add(1)
+	sample()
+	now = now.Add(24 * time.Hour)
+	sample()
+	if len(tgt.Messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(tgt.Messages))
+	}
+
+	msg := tgt.Messages[1]
+	if msg.MailFrom != "postmaster@mx.example.org" || len(msg.RcptTo) != 1 || msg.RcptTo[0] != "admin@example.org" {
+		t.Errorf("wrong envelope: %s %v", msg.MailFrom, msg.RcptTo)
+	}
+	if subj := msg.Header.Get("Subject"); subj != "Summary for mx.example.org: 2026-10-15" {
+		t.Errorf("wrong subject: %s", subj)
+	}
+	text := string(msg.Body)
+	for _, want := range []string{
+		"Period: 2026-10-15 00:00 +0000 - 2026-10-16 00:00 +0000\r\n",
+		"  SMTP transactions started          22 (15)\r\n",
+		"    smtp 20, submission 2\r\n",
+		"  Commands rejected                   8 (0)\r\n",
+		"  check.dnsbl 554                             7\r\n",
+		"  check.spf 550                               1\r\n",
+		"  2026-10-14          0          0            0\r\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("summary does not contain %q:\n%s", want, text)
+		}
+	}
+
+	// Third and fourth days, the oldest period should be removed.
+	now = now.Add(48 * time.Hour)
+	sample()
+	if len(tgt.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(tgt.Messages))
+	}
+	// The period when the server was not running is skipped entirely.
+	if !strings.Contains(string(tgt.Messages[2].Body), "Period: 2026-10-16 00:00 +0000 - 2026-10-17 00:00 +0000\r\n") {
+		t.Errorf("wrong period:\n%s", tgt.Messages[2].Body)
+	}
+	keys, _ := db.Keys()
+	if len(keys) != 3 || keys[0] != currentKey {
+		t.Errorf("wrong stored keys: %v", keys)
+	}
+	if _, ok := db[periodPrefix+"1791936000"]; ok {
+		t.Errorf("the oldest period is not removed")
+	}
+}
+
+func TestReporter_Warnings(t *testing.T) {
+	now := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	r := &Reporter{
+		hostname: "mx.example.org",
+		disks:    []string{"/nonexistent/path"},
+		now:      func() time.Time { return now },
+	}
+	sum := r.summarize(&Period{Start: now, End: now.Add(24 * time.Hour), Counters: Counters{}}, nil)
+	if len(sum.disks) != 1 || sum.disks[0].err == nil {
+		t.Errorf("expected disk usage error, got %+v", sum.disks)
+	}
+	if len(sum.warnings) != 0 {
+		t.Errorf("unexpected warnings: %v", sum.warnings)
+	}
+	if !strings.Contains(sum.Text(), "  /nonexistent/path: ") {
+		t.Errorf("disk error is not included:\n%s", sum.Text())
+	}
+}
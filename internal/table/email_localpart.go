@@ -20,6 +20,7 @@ package table
 
 import (
 	"context"
+	"strings"
 
 	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/config"
@@ -56,6 +57,14 @@ func (s *EmailLocalpart) Lookup(ctx context.Context, key string) (string, bool,
 		// Invalid email, no local part mapping.
 		return "", false, nil
 	}
+	if strings.HasPrefix(mbox, `"`) {
+		// Quoting is a part of the address syntax, not of the local-part
+		// value.
+		mbox, err = address.UnquoteMbox(mbox)
+		if err != nil {
+			return "", false, nil
+		}
+	}
 	return mbox, true, nil
 }
 
@@ -0,0 +1,324 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlite"
+)
+
+// AliasInfo describes the alias stored in the sql_aliases table.
+type AliasInfo struct {
+	Alias  string
+	Target string
+	// ExpiresAt is the time after which the alias can't be used, zero
+	// value means the alias does not expire.
+	ExpiresAt time.Time
+	// MaxUses is the amount of lookups after which the alias can't be used, 0
+	// means no limit.
+	MaxUses int
+	// Uses is the amount of successful lookups.
+	Uses int
+}
+
+// Expired reports whether the alias can't be used anymore.
+func (ai AliasInfo) Expired(now time.Time) bool {
+	if !ai.ExpiresAt.IsZero() && !now.Before(ai.ExpiresAt) {
+		return true
+	}
+	return ai.MaxUses != 0 && ai.Uses >= ai.MaxUses
+}
+
+// SQLAliases is the table module that stores aliases in the SQL database
+// along with the expiry time and usage counters.
+//
+// Each successful lookup counts as an alias use. Lookups of expired aliases
+// fail with the SMTP error so the recipient is rejected.
+type SQLAliases struct {
+	modName  string
+	instName string
+
+	driver    string
+	tableName string
+	db        *sql.DB
+}
+
+func NewSQLAliases(modName, instName string, _, _ []string) (module.Module, error) {
+	return &SQLAliases{
+		modName:  modName,
+		instName: instName,
+	}, nil
+}
+
+func (s *SQLAliases) Name() string {
+	return s.modName
+}
+
+func (s *SQLAliases) InstanceName() string {
+	return s.instName
+}
+
+func (s *SQLAliases) Init(cfg *config.Map) error {
+	var (
+		dsnParts    []string
+		busyTimeout int
+	)
+	cfg.String("driver", false, true, "", &s.driver)
+	cfg.StringList("dsn", false, true, nil, &dsnParts)
+	cfg.String("table_name", false, false, "aliases", &s.tableName)
+	cfg.Int("sqlite3_busy_timeout", false, false, sqlite.DefaultBusyTimeout, &busyTimeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	dsn := strings.Join(dsnParts, " ")
+	if s.driver == "sqlite3" {
+		dsn = sqlite.WithBusyTimeout(dsn, busyTimeout)
+		unlock, err := sqlite.LockSchema(dsn, sqlite.DefaultLockTimeout)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "%v", err)
+		}
+		defer unlock()
+	}
+
+	db, err := sql.Open(s.driver, dsn)
+	if err != nil {
+		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
+	}
+	s.db = db
+
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		alias VARCHAR(255) PRIMARY KEY NOT NULL,
+		target TEXT NOT NULL,
+		expires_at BIGINT NOT NULL DEFAULT 0,
+		max_uses BIGINT NOT NULL DEFAULT 0,
+		uses BIGINT NOT NULL DEFAULT 0
+	)`, s.tableName))
+	if err != nil {
+		return config.NodeErr(cfg.Block, "init query failed: %v", err)
+	}
+
+	return nil
+}
+
+// query replaces ? placeholders with ones used by the driver and the TABLE
+// word with the table name.
+func (s *SQLAliases) query(q string) string {
+	q = strings.Replace(q, "TABLE", s.tableName, 1)
+	if s.driver != "postgres" {
+		return q
+	}
+
+	var res strings.Builder
+	indx := 1
+	for _, chr := range q {
+		if chr == '?' {
+			res.WriteString("$" + strconv.Itoa(indx))
+			indx++
+			continue
+		}
+		res.WriteRune(chr)
+	}
+	return res.String()
+}
+
+func (s *SQLAliases) Close() error {
+	return s.db.Close()
+}
+
+func scanAlias(row interface{ Scan(...interface{}) error }) (AliasInfo, error) {
+	var (
+		ai        AliasInfo
+		expiresAt int64
+	)
+	if err := row.Scan(&ai.Alias, &ai.Target, &expiresAt, &ai.MaxUses, &ai.Uses); err != nil {
+		return AliasInfo{}, err
+	}
+	if expiresAt != 0 {
+		ai.ExpiresAt = time.Unix(expiresAt, 0)
+	}
+	return ai, nil
+}
+
+// GetAlias returns the information about the alias without counting it as a
+// use. nil is returned if there is no such alias.
+func (s *SQLAliases) GetAlias(alias string) (*AliasInfo, error) {
+	ai, err := scanAlias(s.db.QueryRow(s.query(`
+		SELECT alias, target, expires_at, max_uses, uses
+		FROM TABLE
+		WHERE alias = ?`), alias))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ai, nil
+}
+
+func aliasExpiredErr(alias string) error {
+	return &exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+		Message:      "This address is no longer in use",
+		Misc: map[string]interface{}{
+			"alias":  alias,
+			"reason": "alias expired",
+		},
+	}
+}
+
+func (s *SQLAliases) Lookup(ctx context.Context, key string) (string, bool, error) {
+	ai, err := s.GetAlias(key)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: lookup %s: %w", s.modName, key, err)
+	}
+	if ai == nil {
+		return "", false, nil
+	}
+
+	now := time.Now()
+	if ai.Expired(now) {
+		return "", false, aliasExpiredErr(key)
+	}
+
+	// Conditions are repeated in the query to make sure concurrent lookups
+	// do not exceed max_uses.
+	res, err := s.db.ExecContext(ctx, s.query(`
+		UPDATE TABLE
+		SET uses = uses + 1
+		WHERE alias = ? AND (max_uses = 0 OR uses < max_uses) AND (expires_at = 0 OR expires_at > ?)`),
+		key, now.Unix())
+	if err != nil {
+		return "", false, fmt.Errorf("%s: lookup %s: %w", s.modName, key, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return "", false, fmt.Errorf("%s: lookup %s: %w", s.modName, key, err)
+	}
+	if affected == 0 {
+		return "", false, aliasExpiredErr(key)
+	}
+
+	return ai.Target, true, nil
+}
+
+// Aliases returns the information about all aliases.
+func (s *SQLAliases) Aliases() ([]AliasInfo, error) {
+	rows, err := s.db.Query(s.query(`
+		SELECT alias, target, expires_at, max_uses, uses
+		FROM TABLE
+		ORDER BY alias`))
+	if err != nil {
+		return nil, fmt.Errorf("%s: list: %w", s.modName, err)
+	}
+	defer rows.Close()
+
+	var res []AliasInfo
+	for rows.Next() {
+		ai, err := scanAlias(rows)
+		if err != nil {
+			return nil, fmt.Errorf("%s: list: %w", s.modName, err)
+		}
+		res = append(res, ai)
+	}
+	return res, rows.Err()
+}
+
+// SetAlias creates the alias or replaces the existing one. Uses counter is
+// reset.
+func (s *SQLAliases) SetAlias(ai AliasInfo) error {
+	var expiresAt int64
+	if !ai.ExpiresAt.IsZero() {
+		expiresAt = ai.ExpiresAt.Unix()
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("%s: set %s: %w", s.modName, ai.Alias, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if _, err := tx.Exec(s.query(`DELETE FROM TABLE WHERE alias = ?`), ai.Alias); err != nil {
+		return fmt.Errorf("%s: set %s: %w", s.modName, ai.Alias, err)
+	}
+	_, err = tx.Exec(s.query(`
+		INSERT INTO TABLE(alias, target, expires_at, max_uses, uses)
+		VALUES (?, ?, ?, ?, ?)`), ai.Alias, ai.Target, expiresAt, ai.MaxUses, ai.Uses)
+	if err != nil {
+		return fmt.Errorf("%s: set %s: %w", s.modName, ai.Alias, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: set %s: %w", s.modName, ai.Alias, err)
+	}
+	return nil
+}
+
+func (s *SQLAliases) Keys() ([]string, error) {
+	aliases, err := s.Aliases()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(aliases))
+	for _, ai := range aliases {
+		keys = append(keys, ai.Alias)
+	}
+	return keys, nil
+}
+
+func (s *SQLAliases) RemoveKey(k string) error {
+	if _, err := s.db.Exec(s.query(`DELETE FROM TABLE WHERE alias = ?`), k); err != nil {
+		return fmt.Errorf("%s: del %s: %w", s.modName, k, err)
+	}
+	return nil
+}
+
+// SetKey creates the permanent alias without usage limit.
+func (s *SQLAliases) SetKey(k, v string) error {
+	return s.SetAlias(AliasInfo{Alias: k, Target: v})
+}
+
+// PurgeExpired removes all aliases that expired before the specified time.
+// Aliases with exhausted usage limit are kept. It returns the amount of
+// removed aliases.
+func (s *SQLAliases) PurgeExpired(before time.Time) (int, error) {
+	res, err := s.db.Exec(s.query(`
+		DELETE FROM TABLE
+		WHERE expires_at != 0 AND expires_at <= ?`), before.Unix())
+	if err != nil {
+		return 0, fmt.Errorf("%s: purge: %w", s.modName, err)
+	}
+	affected, err := res.RowsAffected()
+	return int(affected), err
+}
+
+func init() {
+	module.Register("table.sql_aliases", NewSQLAliases)
+}
@@ -0,0 +1,144 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package table
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testSQLAliases(t *testing.T) *SQLAliases {
+	mod, err := NewSQLAliases("table.sql_aliases", "", nil, nil)
+	if err != nil {
+		t.Fatal("Module create failed:", err)
+	}
+	tbl := mod.(*SQLAliases)
+	err = tbl.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "driver",
+				Args: []string{"sqlite3"},
+			},
+			{
+				Name: "dsn",
+				Args: []string{filepath.Join(testutils.Dir(t), "test.db")},
+			},
+		},
+	}))
+	if err != nil {
+		t.Fatal("Init failed:", err)
+	}
+	t.Cleanup(func() {
+		tbl.Close()
+	})
+	return tbl
+}
+
+func checkAliasLookup(t *testing.T, tbl *SQLAliases, key, target string, expired bool) {
+	t.Helper()
+
+	res, ok, err := tbl.Lookup(context.Background(), key)
+	if expired {
+		var smtpErr *exterrors.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+			t.Fatalf("expected rejection for %s, got %v %v %v", key, res, ok, err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error for %s: %v", key, err)
+	}
+	if target == "" {
+		if ok {
+			t.Fatalf("unexpected lookup result for %s: %v", key, res)
+		}
+		return
+	}
+	if !ok || res != target {
+		t.Fatalf("wrong lookup result for %s: %v %v", key, res, ok)
+	}
+}
+
+func TestSQLAliases(t *testing.T) {
+	tbl := testSQLAliases(t)
+
+	if err := tbl.SetKey("permanent@example.org", "user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.SetAlias(AliasInfo{
+		Alias:     "expired@example.org",
+		Target:    "user@example.org",
+		ExpiresAt: time.Now().Add(-time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.SetAlias(AliasInfo{
+		Alias:     "temporary@example.org",
+		Target:    "user@example.org",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.SetAlias(AliasInfo{
+		Alias:   "burner@example.org",
+		Target:  "user@example.org",
+		MaxUses: 2,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	checkAliasLookup(t, tbl, "missing@example.org", "", false)
+	checkAliasLookup(t, tbl, "permanent@example.org", "user@example.org", false)
+	checkAliasLookup(t, tbl, "temporary@example.org", "user@example.org", false)
+	checkAliasLookup(t, tbl, "expired@example.org", "", true)
+	checkAliasLookup(t, tbl, "burner@example.org", "user@example.org", false)
+	checkAliasLookup(t, tbl, "burner@example.org", "user@example.org", false)
+	checkAliasLookup(t, tbl, "burner@example.org", "", true)
+
+	ai, err := tbl.GetAlias("burner@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ai.Uses != 2 {
+		t.Fatalf("wrong uses counter: %d", ai.Uses)
+	}
+
+	purged, err := tbl.PurgeExpired(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("wrong amount of purged aliases: %d", purged)
+	}
+
+	keys, err := tbl.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("wrong keys after purge: %v", keys)
+	}
+}
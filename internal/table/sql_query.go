@@ -26,6 +26,7 @@ import (
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlite"
 	_ "github.com/lib/pq"
 )
 
@@ -69,11 +70,14 @@ func (s *SQL) Init(cfg *config.Map) error {
 		listQuery   string
 		removeQuery string
 		setQuery    string
+
+		busyTimeout int
 	)
 	cfg.StringList("init", false, false, nil, &initQueries)
 	cfg.String("driver", false, true, "", &driver)
 	cfg.StringList("dsn", false, true, nil, &dsnParts)
 	cfg.Bool("named_args", false, false, &s.namedArgs)
+	cfg.Int("sqlite3_busy_timeout", false, false, sqlite.DefaultBusyTimeout, &busyTimeout)
 
 	cfg.String("lookup", false, true, "", &lookupQuery)
 
@@ -89,7 +93,22 @@ func (s *SQL) Init(cfg *config.Map) error {
 		return config.NodeErr(cfg.Block, "PostgreSQL driver does not support named_args")
 	}
 
-	db, err := sql.Open(driver, strings.Join(dsnParts, " "))
+	dsn := strings.Join(dsnParts, " ")
+	if driver == "sqlite3" {
+		dsn = sqlite.WithBusyTimeout(dsn, busyTimeout)
+
+		// Init queries usually create tables, serialize them with other
+		// processes using the same database.
+		if len(initQueries) != 0 {
+			unlock, err := sqlite.LockSchema(dsn, sqlite.DefaultLockTimeout)
+			if err != nil {
+				return config.NodeErr(cfg.Block, "%v", err)
+			}
+			defer unlock()
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
 	}
@@ -21,9 +21,11 @@ package table
 import (
 	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/sqlite"
 	_ "github.com/lib/pq"
 )
 
@@ -61,12 +63,14 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 		tableName   string
 		keyColumn   string
 		valueColumn string
+		busyTimeout int
 	)
 	cfg.String("driver", false, true, "", &driver)
 	cfg.StringList("dsn", false, true, nil, &dsnParts)
 	cfg.String("table_name", false, true, "", &tableName)
 	cfg.String("key_column", false, false, "key", &keyColumn)
 	cfg.String("value_column", false, false, "value", &valueColumn)
+	cfg.Int("sqlite3_busy_timeout", false, false, sqlite.DefaultBusyTimeout, &busyTimeout)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -113,6 +117,10 @@ func (s *SQLTable) Init(cfg *config.Map) error {
 				Name: "named_args",
 				Args: []string{useNamedArgs},
 			},
+			{
+				Name: "sqlite3_busy_timeout",
+				Args: []string{strconv.Itoa(busyTimeout)},
+			},
 			{
 				Name: "lookup",
 				Args: []string{lookupQuery},
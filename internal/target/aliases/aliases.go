@@ -0,0 +1,317 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package aliases implements the target.aliases module that expands
+// recipients using sendmail-style aliases: lists of addresses, :include:
+// files and delivery to external commands.
+//
+// Addresses the recipient expands to are passed to the deliver_to target,
+// commands are executed with the message as the standard input.
+package aliases
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.aliases"
+
+// exTempFail is EX_TEMPFAIL from sysexits.h. Commands use it to request
+// a delivery retry.
+const exTempFail = 75
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	table        module.Table
+	mailboxes    module.Table
+	target       module.DeliveryTarget
+	allowInclude bool
+	allowPipe    bool
+	pipeTimeout  time.Duration
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Custom("aliases", false, true, nil, modconfig.TableDirective, &t.table)
+	cfg.Custom("mailboxes", false, false, nil, modconfig.TableDirective, &t.mailboxes)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &t.target)
+	cfg.Bool("allow_include", false, true, &t.allowInclude)
+	cfg.Bool("allow_pipe", false, false, &t.allowPipe)
+	cfg.Duration("pipe_timeout", false, false, 5*time.Minute, &t.pipeTimeout)
+	_, err := cfg.Process()
+	return err
+}
+
+type pipeCmd struct {
+	cmd  string
+	rcpt string
+}
+
+type delivery struct {
+	t        *Target
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+
+	// Delivery to deliver_to, started once the first address is added.
+	d     module.Delivery
+	addrs map[string]struct{}
+	pipes []pipeCmd
+	// Expanded aliases, added as Delivered-To to detect forwarding loops.
+	aliases []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+		addrs:    make(map[string]struct{}),
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	defer trace.StartRegion(ctx, modName+"/AddRcpt").End()
+
+	exp := expansion{seen: make(map[string]struct{})}
+	if err := d.t.expandAddr(ctx, rcptTo, 0, map[string]bool{}, &exp); err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 5},
+			Message:      "Alias expansion failed",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+	if len(exp.addrs) == 0 && len(exp.pipes) == 0 {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "Alias has no members",
+			TargetName:   modName,
+		}
+	}
+	if len(exp.addrs) != 1 || exp.addrs[0] != rcptTo || len(exp.pipes) != 0 {
+		d.log.DebugMsg("alias expanded", "rcpt", rcptTo, "addrs", exp.addrs, "pipes", exp.pipes)
+		d.aliases = append(d.aliases, rcptTo)
+	}
+
+	for _, addr := range exp.addrs {
+		if _, ok := d.addrs[addr]; ok {
+			continue
+		}
+		if d.d == nil {
+			var err error
+			d.d, err = d.t.target.Start(ctx, d.msgMeta, d.mailFrom)
+			if err != nil {
+				return err
+			}
+		}
+		if err := d.d.AddRcpt(ctx, addr); err != nil {
+			return err
+		}
+		d.addrs[addr] = struct{}{}
+		// Do not disclose alias members in bounces.
+		if d.msgMeta.OriginalRcpts != nil && addr != rcptTo {
+			original, ok := d.msgMeta.OriginalRcpts[rcptTo]
+			if !ok {
+				original = rcptTo
+			}
+			d.msgMeta.OriginalRcpts[addr] = original
+		}
+	}
+	for _, cmd := range exp.pipes {
+		d.pipes = append(d.pipes, pipeCmd{cmd: cmd, rcpt: rcptTo})
+	}
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, modName+"/Body").End()
+
+	if len(d.aliases) != 0 {
+		header = header.Copy()
+		for _, alias := range d.aliases {
+			if target.DeliveredTo(header, alias) {
+				d.log.Msg("forwarding loop detected", "rcpt", alias)
+				return target.LoopError(modName, alias)
+			}
+		}
+		for _, alias := range d.aliases {
+			header.Add("Delivered-To", alias)
+		}
+	}
+
+	if d.d != nil {
+		if err := d.d.Body(ctx, header, body); err != nil {
+			return err
+		}
+	}
+
+	ran := make(map[string]struct{}, len(d.pipes))
+	for _, p := range d.pipes {
+		if _, ok := ran[p.cmd]; ok {
+			continue
+		}
+		ran[p.cmd] = struct{}{}
+		if err := d.runPipe(ctx, p, header, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPipe executes the command using the shell, passing the message as the
+// standard input. SENDER and RECIPIENT environment variables are set to the
+// envelope sender and the alias address.
+func (d *delivery) runPipe(ctx context.Context, p pipeCmd, header textproto.Header, body buffer.Buffer) error {
+	ctx, cancel := context.WithTimeout(ctx, d.t.pipeTimeout)
+	defer cancel()
+
+	bodyR, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer bodyR.Close()
+
+	header = header.Copy()
+	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, header); err != nil {
+		return err
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", p.cmd)
+	cmd.Env = append(os.Environ(), "SENDER="+d.mailFrom, "RECIPIENT="+p.rcpt)
+	cmd.Stdin = io.MultiReader(&hdrBuf, bodyR)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	setProcessGroup(cmd)
+
+	err = cmd.Start()
+	if err == nil {
+		// Processes started by the command keep its output open, so all of
+		// them are killed on timeout, not just the shell.
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				killProcessGroup(cmd)
+			case <-done:
+			}
+		}()
+		err = cmd.Wait()
+		close(done)
+	}
+	if err == nil {
+		d.log.Msg("message piped to command", "rcpt", p.rcpt, "cmd", p.cmd)
+		return nil
+	}
+
+	misc := map[string]interface{}{
+		"cmd":    p.cmd,
+		"rcpt":   p.rcpt,
+		"output": strings.TrimSpace(truncate(out.String(), 512)),
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		misc["exit_code"] = exitErr.ExitCode()
+		if exitErr.ExitCode() != exTempFail {
+			return &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 3, 0},
+				Message:      "Delivery to the command failed",
+				TargetName:   modName,
+				Err:          err,
+				Misc:         misc,
+			}
+		}
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Delivery to the command failed, try again later",
+		TargetName:   modName,
+		Err:          err,
+		Misc:         misc,
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	if d.d != nil {
+		return d.d.Abort(ctx)
+	}
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	if d.d != nil {
+		return d.d.Commit(ctx)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,285 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package aliases
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type multiTable map[string][]string
+
+func (m multiTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	values := m[key]
+	if len(values) == 0 {
+		return "", false, nil
+	}
+	return values[0], true, nil
+}
+
+func (m multiTable) LookupMulti(_ context.Context, key string) ([]string, error) {
+	return m[key], nil
+}
+
+func testTarget(t *testing.T, table module.Table, tgt module.DeliveryTarget) *Target {
+	return &Target{
+		log:          testutils.Logger(t, modName),
+		table:        table,
+		target:       tgt,
+		allowInclude: true,
+		allowPipe:    true,
+		pipeTimeout:  10 * time.Second,
+	}
+}
+
+func TestSplitEntries(t *testing.T) {
+	for value, want := range map[string][]string{
+		"":                           nil,
+		"a@example.org":              {"a@example.org"},
+		" a , b,,c ":                 {"a", "b", "c"},
+		`"|cmd a, b", c`:             {`"|cmd a, b"`, "c"},
+		`"john, doe"@example.org, a`: {`"john, doe"@example.org`, "a"},
+		`a\,b, c`:                    {`a\,b`, "c"},
+	} {
+		got := splitEntries(value)
+		if len(got) == 0 && len(want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("splitEntries(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(listPath, []byte("# members\nc@example.com, d\n\nteam\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tbl := multiTable{
+		"root":              {"admin@example.org"},
+		"admin@example.org": {"a@example.org, b"},
+		"team@example.org":  {"x@example.org", "y@example.org"},
+		"list@example.org":  {":include:" + listPath},
+		"keep@example.org":  {"keep@example.org, archive@example.org"},
+		"self":              {`\self, other`},
+		"loop1@example.org": {"loop2@example.org"},
+		"loop2@example.org": {"loop3@example.org"},
+		"loop3@example.org": {"loop1@example.org"},
+		"pipe@example.org":  {`"|/usr/bin/handler --flag, arg"`, "a"},
+		"empty@example.org": {""},
+		"deep0@example.org": {"deep1@example.org"},
+	}
+	for i := 1; i <= maxDepth; i++ {
+		tbl["deep"+strconv.Itoa(i)+"@example.org"] = []string{"deep" + strconv.Itoa(i+1) + "@example.org"}
+	}
+	tgt := testTarget(t, tbl, nil)
+
+	test := func(rcpt string, addrs, pipes []string, fail bool) {
+		t.Helper()
+		exp := expansion{seen: map[string]struct{}{}}
+		err := tgt.expandAddr(context.Background(), rcpt, 0, map[string]bool{}, &exp)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %v %v", rcpt, exp.addrs, exp.pipes)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", rcpt, err)
+			return
+		}
+		sort.Strings(exp.addrs)
+		if !reflect.DeepEqual(exp.addrs, addrs) || !reflect.DeepEqual(exp.pipes, pipes) {
+			t.Errorf("%s: got %q %q, want %q %q", rcpt, exp.addrs, exp.pipes, addrs, pipes)
+		}
+	}
+
+	test("user@example.org", []string{"user@example.org"}, nil, false)
+	test("root@example.org", []string{"a@example.org", "b@example.org"}, nil, false)
+	test("Team@Example.org", []string{"x@example.org", "y@example.org"}, nil, false)
+	test("list@example.org", []string{"c@example.com", "d@example.org", "x@example.org", "y@example.org"}, nil, false)
+	test("keep@example.org", []string{"archive@example.org", "keep@example.org"}, nil, false)
+	test("self@example.org", []string{"other@example.org", "self@example.org"}, nil, false)
+	test("loop1@example.org", []string{"loop1@example.org"}, nil, false)
+	test("pipe@example.org", []string{"a@example.org"}, []string{"/usr/bin/handler --flag, arg"}, false)
+	test("empty@example.org", nil, nil, false)
+	test("deep0@example.org", nil, nil, true)
+
+	tgt.allowPipe = false
+	test("pipe@example.org", nil, nil, true)
+	tgt.allowInclude = false
+	test("list@example.org", nil, nil, true)
+}
+
+func TestExpand_CatchAll(t *testing.T) {
+	tbl := multiTable{
+		"*@example.org":     {"postmaster"},
+		"*@xn--e1aybc.org":  {"admin@example.org"},
+		"sales@example.org": {"bob@example.org"},
+		"postmaster":        {"admin@example.org"},
+		"*@example.com":     {"nobody@example.com"},
+	}
+	tgt := testTarget(t, tbl, nil)
+
+	test := func(rcpt string, addrs []string) {
+		t.Helper()
+		exp := expansion{seen: map[string]struct{}{}}
+		if err := tgt.expandAddr(context.Background(), rcpt, 0, map[string]bool{}, &exp); err != nil {
+			t.Errorf("%s: unexpected error: %v", rcpt, err)
+			return
+		}
+		if !reflect.DeepEqual(exp.addrs, addrs) {
+			t.Errorf("%s: got %q, want %q", rcpt, exp.addrs, addrs)
+		}
+	}
+
+	// Without the mailboxes table, catch-all entries are not used.
+	test("unknown@example.org", []string{"unknown@example.org"})
+
+	tgt.mailboxes = testutils.Table{M: map[string]string{
+		"admin@example.org": "",
+		"bob@example.org":   "",
+		"user@example.org":  "",
+	}}
+	test("user@example.org", []string{"user@example.org"})
+	test("sales@example.org", []string{"bob@example.org"})
+	test("unknown@example.org", []string{"admin@example.org"})
+	test("Unknown@Example.org", []string{"admin@example.org"})
+	test("unknown@тест.org", []string{"admin@example.org"})
+	test("unknown@xn--e1aybc.org", []string{"admin@example.org"})
+	test("unknown@example.net", []string{"unknown@example.net"})
+	// Catch-all pointing to the non-existent address.
+	test("unknown@example.com", []string{"nobody@example.com"})
+}
+
+func TestDelivery(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	tbl := multiTable{
+		"team@example.org":  {"a@example.org, b@example.org, c@example.org"},
+		"robot@example.org": {`"|cat > ` + out + `; echo $SENDER $RECIPIENT >> ` + out + `"`},
+		"empty@example.org": {""},
+	}
+	next := testutils.Target{}
+	tgt := testTarget(t, tbl, &next)
+
+	msgMeta := &module.MsgMetadata{OriginalRcpts: map[string]string{}}
+	testutils.DoTestDeliveryMeta(t, tgt, "sender@example.com",
+		[]string{"team@example.org", "a@example.org", "robot@example.org", "d@example.org"}, msgMeta)
+
+	if len(next.Messages) != 1 {
+		t.Fatal("Expected 1 message, got", len(next.Messages))
+	}
+	testutils.CheckMsg(t, &next.Messages[0], "sender@example.com",
+		[]string{"a@example.org", "b@example.org", "c@example.org", "d@example.org"})
+	if msgMeta.OriginalRcpts["b@example.org"] != "team@example.org" {
+		t.Error("Wrong OriginalRcpts:", msgMeta.OriginalRcpts)
+	}
+	if _, ok := msgMeta.OriginalRcpts["d@example.org"]; ok {
+		t.Error("Wrong OriginalRcpts:", msgMeta.OriginalRcpts)
+	}
+
+	piped, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Return-Path: <sender@example.com>\r\n" +
+		"Delivered-To: robot@example.org\r\nDelivered-To: team@example.org\r\nA: 1\r\nB: 2\r\n\r\nfoobar\r\nsender@example.com robot@example.org\n"
+	if string(piped) != want {
+		t.Errorf("Wrong command input:\n%q\nwant:\n%q", piped, want)
+	}
+
+	_, err = testutils.DoTestDeliveryErr(t, tgt, "sender@example.com", []string{"empty@example.org"})
+	if err == nil || exterrors.IsTemporary(err) {
+		t.Error("Expected permanent error for an empty alias, got", err)
+	}
+}
+
+func TestDelivery_Loop(t *testing.T) {
+	tbl := multiTable{
+		"team@example.org": {"a@example.com, b@example.org"},
+	}
+	next := testutils.Target{}
+	tgt := testTarget(t, tbl, &next)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.com", []string{"team@example.org"})
+	if len(next.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(next.Messages))
+	}
+	if got := next.Messages[0].Header.Get("Delivered-To"); got != "team@example.org" {
+		t.Errorf("Wrong Delivered-To: %q", got)
+	}
+
+	// Message forwarded back to the alias by a@example.com.
+	delivery, err := tgt.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "Team@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	err = delivery.Body(context.Background(), next.Messages[0].Header, nil)
+	if err == nil || exterrors.IsTemporary(err) {
+		t.Error("Expected permanent error for a loop, got", err)
+	}
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Messages) != 1 {
+		t.Error("Looped message was delivered")
+	}
+}
+
+func TestDelivery_PipeFail(t *testing.T) {
+	for cmd, temporary := range map[string]bool{
+		"exit 75":     true,
+		"exit 1":      false,
+		"sleep 10":    true,
+		"nonexistent": false,
+	} {
+		tbl := multiTable{"robot@example.org": {"|" + cmd}}
+		tgt := testTarget(t, tbl, &testutils.Target{})
+		tgt.pipeTimeout = 100 * time.Millisecond
+
+		_, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.com", []string{"robot@example.org"})
+		if err == nil {
+			t.Errorf("%s: expected an error", cmd)
+			continue
+		}
+		if exterrors.IsTemporary(err) != temporary {
+			t.Errorf("%s: temporary = %v, want %v (%v)", cmd, !temporary, temporary, err)
+		}
+		if fields := exterrors.Fields(err); fields["cmd"] != cmd {
+			t.Errorf("%s: wrong error fields: %v", cmd, fields)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package aliases
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// maxDepth limits the nesting of aliases and :include: files.
+const maxDepth = 10
+
+// expansion is the result of the recipient expansion.
+type expansion struct {
+	addrs []string
+	pipes []string
+
+	seen map[string]struct{}
+}
+
+func (e *expansion) addAddr(addr string) {
+	if _, ok := e.seen[addr]; ok {
+		return
+	}
+	e.seen[addr] = struct{}{}
+	e.addrs = append(e.addrs, addr)
+}
+
+func (e *expansion) addPipe(cmd string) {
+	if _, ok := e.seen["|"+cmd]; ok {
+		return
+	}
+	e.seen["|"+cmd] = struct{}{}
+	e.pipes = append(e.pipes, cmd)
+}
+
+// splitEntries splits the alias value into comma-separated entries. Commas
+// in double quotes do not separate entries.
+func splitEntries(value string) []string {
+	var (
+		entries []string
+		quoted  bool
+		start   int
+	)
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				entries = append(entries, value[start:i])
+				start = i + 1
+			}
+		}
+	}
+	entries = append(entries, value[start:])
+
+	res := entries[:0]
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if e != "" {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// lookup returns values for the alias. The full address is looked up first
+// (with the domain in both U-label and A-label forms), then the local part.
+// nil slice is returned if addr is not an alias.
+func (t *Target) lookup(ctx context.Context, addr string) ([]string, error) {
+	keys, _ := address.LookupKeys(addr)
+	if mbox, domain, err := address.Split(addr); err == nil && domain != "" {
+		keys = append(keys, mbox)
+	}
+	return t.lookupKeys(ctx, keys)
+}
+
+// catchAll returns values of the "*@domain" entry for the domain of addr if
+// addr is not in the mailboxes table. nil slice is returned if catch-all is
+// not used for addr.
+func (t *Target) catchAll(ctx context.Context, addr string) ([]string, error) {
+	if t.mailboxes == nil {
+		return nil, nil
+	}
+	_, domain, err := address.Split(addr)
+	if err != nil || domain == "" {
+		return nil, nil
+	}
+
+	keys, _ := address.LookupKeys(addr)
+	for _, key := range keys {
+		_, ok, err := t.mailboxes.Lookup(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return nil, nil
+		}
+	}
+
+	keys, err = address.LookupKeys("*@" + domain)
+	if err != nil {
+		return nil, nil
+	}
+	return t.lookupKeys(ctx, keys)
+}
+
+func (t *Target) lookupKeys(ctx context.Context, keys []string) ([]string, error) {
+	for _, key := range keys {
+		if multi, ok := t.table.(module.MultiTable); ok {
+			values, err := multi.LookupMulti(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if len(values) != 0 {
+				return values, nil
+			}
+			continue
+		}
+
+		value, ok, err := t.table.Lookup(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return []string{value}, nil
+		}
+	}
+	return nil, nil
+}
+
+// expandAddr adds the addresses and commands the address expands to.
+//
+// chain contains aliases that are being expanded. Aliases that refer to
+// themselves (directly or not) are delivered to as is, e.g. "user: user,
+// archive@example.org" keeps a copy in the user mailbox.
+func (t *Target) expandAddr(ctx context.Context, addr string, depth int, chain map[string]bool, exp *expansion) error {
+	key, err := address.ForLookup(addr)
+	if err != nil {
+		return fmt.Errorf("malformed address %s: %w", addr, err)
+	}
+	if chain[key] {
+		exp.addAddr(addr)
+		return nil
+	}
+
+	values, err := t.lookup(ctx, key)
+	if err != nil {
+		return err
+	}
+	if values == nil {
+		values, err = t.catchAll(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+	if values == nil {
+		exp.addAddr(addr)
+		return nil
+	}
+	if depth >= maxDepth {
+		return fmt.Errorf("too many nested aliases, possible loop at %s", addr)
+	}
+
+	_, domain, _ := address.Split(key)
+	chain[key] = true
+	defer delete(chain, key)
+	for _, value := range values {
+		for _, entry := range splitEntries(value) {
+			if err := t.expandEntry(ctx, entry, domain, depth+1, chain, exp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// expandEntry handles the single entry of the alias value. Unqualified
+// addresses are qualified using domain.
+func (t *Target) expandEntry(ctx context.Context, entry, domain string, depth int, chain map[string]bool, exp *expansion) error {
+	// "|command, with a comma" and ":include:/path with spaces"
+	if len(entry) >= 2 && entry[0] == '"' && entry[len(entry)-1] == '"' {
+		entry = entry[1 : len(entry)-1]
+	}
+
+	switch {
+	case strings.HasPrefix(entry, "|"):
+		if !t.allowPipe {
+			return fmt.Errorf("delivery to commands is not allowed: %s", entry)
+		}
+		cmd := strings.TrimSpace(entry[1:])
+		if cmd == "" {
+			return fmt.Errorf("empty command in alias")
+		}
+		exp.addPipe(cmd)
+		return nil
+	case len(entry) >= 9 && strings.EqualFold(entry[:9], ":include:"):
+		if !t.allowInclude {
+			return fmt.Errorf(":include: is not allowed: %s", entry)
+		}
+		if depth >= maxDepth {
+			return fmt.Errorf("too many nested :include: files at %s", entry)
+		}
+		entries, err := readInclude(strings.TrimSpace(entry[9:]))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := t.expandEntry(ctx, entry, domain, depth+1, chain, exp); err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasPrefix(entry, `\`):
+		// sendmail syntax for "do not expand further".
+		exp.addAddr(qualify(entry[1:], domain))
+		return nil
+	default:
+		return t.expandAddr(ctx, qualify(entry, domain), depth, chain, exp)
+	}
+}
+
+func qualify(addr, domain string) string {
+	if domain == "" || strings.Contains(addr, "@") || strings.EqualFold(addr, "postmaster") {
+		return addr
+	}
+	return addr + "@" + domain
+}
+
+// readInclude reads entries from the :include: file. Each line can contain
+// multiple comma-separated entries, lines starting with # are ignored.
+func readInclude(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, splitEntries(line)...)
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
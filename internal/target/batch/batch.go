@@ -0,0 +1,348 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package batch implements the target.batch module that collects messages
+// into signed archives for store-and-forward transfer over intermittent
+// links.
+//
+// Messages are written to the staging directory as they are received and
+// are packed into archives in the output directory periodically or once
+// enough messages are collected. Archives are transferred by external means
+// (rsync, ssh, removable media) and injected on the other side by the
+// batch endpoint.
+package batch
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/batch"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.batch"
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	outDir        string
+	stagingDir    string
+	key           ed25519.PrivateKey
+	maxMessages   int
+	flushInterval time.Duration
+
+	flushLock sync.Mutex
+	flushCh   chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		flushCh:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var keyPath string
+
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.String("out_dir", false, true, "", &t.outDir)
+	cfg.String("staging_dir", false, false, filepath.Join(config.StateDirectory, "batch_"+t.instName), &t.stagingDir)
+	cfg.String("signing_key", false, false, filepath.Join(config.StateDirectory, "batch_"+t.instName+".key"), &keyPath)
+	cfg.Int("max_messages", false, false, 100, &t.maxMessages)
+	cfg.Duration("flush_interval", false, false, 5*time.Minute, &t.flushInterval)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if t.maxMessages <= 0 {
+		return fmt.Errorf("%s: max_messages should be positive", modName)
+	}
+	if t.flushInterval <= 0 {
+		return fmt.Errorf("%s: flush_interval should be positive", modName)
+	}
+
+	var err error
+	t.key, err = batch.LoadPrivateKey(keyPath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	t.log.Printf("signing public key: %s", batch.FormatPublicKey(t.key.Public().(ed25519.PublicKey)))
+
+	for _, dir := range []string{t.outDir, t.stagingDir} {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	}
+
+	go t.flushLoop()
+	return nil
+}
+
+func (t *Target) Close() error {
+	close(t.stop)
+	<-t.stopped
+	return nil
+}
+
+func (t *Target) flushLoop() {
+	defer close(t.stopped)
+
+	tick := time.NewTicker(t.flushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.flushCh:
+		case <-t.stop:
+			t.flush()
+			return
+		}
+		t.flush()
+	}
+}
+
+// staged returns IDs of messages in the staging directory, oldest first.
+func (t *Target) staged() ([]string, error) {
+	dir, err := os.Open(t.stagingDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	// IDs are random so ordering by file name is not enough. Message files
+	// are written before envelope files so only complete messages are
+	// returned.
+	type stagedMsg struct {
+		id    string
+		mtime time.Time
+	}
+	var msgs []stagedMsg
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(t.stagingDir, name))
+		if err != nil {
+			continue
+		}
+		msgs = append(msgs, stagedMsg{id: strings.TrimSuffix(name, ".json"), mtime: info.ModTime()})
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].mtime.Before(msgs[j].mtime)
+	})
+
+	ids := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.id)
+	}
+	return ids, nil
+}
+
+// flush packs all staged messages into archives.
+func (t *Target) flush() {
+	t.flushLock.Lock()
+	defer t.flushLock.Unlock()
+
+	ids, err := t.staged()
+	if err != nil {
+		t.log.Error("failed to list staged messages", err)
+		return
+	}
+
+	for len(ids) != 0 {
+		chunk := ids
+		if len(chunk) > t.maxMessages {
+			chunk = chunk[:t.maxMessages]
+		}
+		ids = ids[len(chunk):]
+
+		entries := make([]batch.Entry, 0, len(chunk))
+		for _, id := range chunk {
+			envBlob, err := ioutil.ReadFile(filepath.Join(t.stagingDir, id+".json"))
+			if err != nil {
+				t.log.Error("failed to read staged envelope", err, "msg_id", id)
+				continue
+			}
+			var env batch.Envelope
+			if err := json.Unmarshal(envBlob, &env); err != nil {
+				t.log.Error("malformed staged envelope", err, "msg_id", id)
+				continue
+			}
+			entries = append(entries, batch.Entry{
+				Envelope: env,
+				Path:     filepath.Join(t.stagingDir, id+".eml"),
+			})
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		name, err := batch.WriteArchive(t.outDir, t.key, entries)
+		if err != nil {
+			t.log.Error("failed to write archive", err)
+			return
+		}
+		for _, e := range entries {
+			os.Remove(filepath.Join(t.stagingDir, e.Envelope.ID+".json"))
+			os.Remove(e.Path)
+		}
+		t.log.Msg("archive written", "archive", name, "messages", len(entries))
+	}
+}
+
+type delivery struct {
+	t       *Target
+	log     log.Logger
+	msgMeta *module.MsgMetadata
+	env     batch.Envelope
+	written bool
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:       t,
+		log:     target.DeliveryLogger(t.log, msgMeta),
+		msgMeta: msgMeta,
+		env: batch.Envelope{
+			ID:       msgMeta.ID,
+			From:     mailFrom,
+			UTF8:     msgMeta.SMTPOpts.UTF8,
+			Received: time.Now(),
+		},
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	d.env.Rcpts = append(d.env.Rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if err := d.writeMessage(header, body); err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+			Message:      "Failed to store the message",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+	d.written = true
+	return nil
+}
+
+func (d *delivery) writeMessage(header textproto.Header, body buffer.Buffer) error {
+	f, err := os.OpenFile(d.msgPath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := textproto.WriteHeader(f, header); err != nil {
+		return err
+	}
+	r, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (d *delivery) msgPath() string {
+	return filepath.Join(d.t.stagingDir, d.env.ID+".eml")
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	if d.written {
+		return os.Remove(d.msgPath())
+	}
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	envBlob, err := json.Marshal(d.env)
+	if err != nil {
+		return err
+	}
+
+	// Write to the temporary file first so flush never sees an incomplete
+	// envelope.
+	envPath := filepath.Join(d.t.stagingDir, d.env.ID+".json")
+	if err := ioutil.WriteFile(envPath+".tmp", envBlob, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(envPath+".tmp", envPath); err != nil {
+		return err
+	}
+	d.log.DebugMsg("message staged", "rcpts", len(d.env.Rcpts))
+
+	ids, err := d.t.staged()
+	if err == nil && len(ids) >= d.t.maxMessages {
+		select {
+		case d.t.flushCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -24,11 +24,14 @@ import (
 )
 
 func DeliveryLogger(l log.Logger, msgMeta *module.MsgMetadata) log.Logger {
-	fields := make(map[string]interface{}, len(l.Fields)+1)
+	fields := make(map[string]interface{}, len(l.Fields)+2)
 	for k, v := range l.Fields {
 		fields[k] = v
 	}
 	fields["msg_id"] = msgMeta.ID
+	if msgMeta.TraceID != "" && msgMeta.TraceID != msgMeta.ID {
+		fields["trace_id"] = msgMeta.TraceID
+	}
 	l.Fields = fields
 	return l
 }
@@ -0,0 +1,272 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package httpapi implements delivery targets that submit messages using
+// HTTP APIs of email service providers instead of SMTP.
+//
+// This is useful if outbound connections to port 25 are blocked by the
+// hosting provider. Each provider is registered as a separate module:
+// target.ses (Amazon SES), target.mailgun and target.sendgrid.
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// provider is the provider-specific part of the target.
+type provider interface {
+	// configure adds provider-specific directives to cfg. Values should be
+	// validated in validate after cfg.Process.
+	configure(cfg *config.Map)
+	validate() error
+
+	// request creates the HTTP request that submits the message.
+	request(ctx context.Context, mailFrom string, rcpts []string, header textproto.Header, body []byte) (*http.Request, error)
+}
+
+type Target struct {
+	modName  string
+	instName string
+	prov     provider
+	client   *http.Client
+
+	log log.Logger
+}
+
+func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+
+	var prov provider
+	switch modName {
+	case "target.ses":
+		prov = &ses{}
+	case "target.mailgun":
+		prov = &mailgun{}
+	case "target.sendgrid":
+		prov = &sendgrid{}
+	default:
+		return nil, fmt.Errorf("%s: unknown provider", modName)
+	}
+
+	return &Target{
+		modName:  modName,
+		instName: instName,
+		prov:     prov,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return t.modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	var timeout time.Duration
+
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Duration("timeout", false, false, time.Minute, &timeout)
+	t.prov.configure(cfg)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if err := t.prov.validate(); err != nil {
+		return fmt.Errorf("%s: %w", t.modName, err)
+	}
+
+	t.client = &http.Client{Timeout: timeout}
+	return nil
+}
+
+type delivery struct {
+	t   *Target
+	log log.Logger
+
+	mailFrom string
+	rcpts    []string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		mailFrom: mailFrom,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, b buffer.Buffer) error {
+	defer trace.StartRegion(ctx, d.t.modName+"/Body").End()
+
+	r, err := b.Open()
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"target": d.t.modName})
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return exterrors.WithFields(err, map[string]interface{}{"target": d.t.modName})
+	}
+
+	req, err := d.t.prov.request(ctx, d.mailFrom, d.rcpts, header, body)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      "Message cannot be submitted to the API provider",
+			TargetName:   d.t.modName,
+			Err:          err,
+		}
+	}
+
+	resp, err := d.t.client.Do(req)
+	if err != nil {
+		return d.t.requestError(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err := d.t.statusError(resp.StatusCode, respBody); err != nil {
+		return err
+	}
+
+	d.log.DebugMsg("message submitted", "http_status", resp.StatusCode, "response", string(respBody))
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	return nil
+}
+
+// writeMessage serializes the message as it should be passed to the API.
+func writeMessage(header textproto.Header, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := textproto.WriteHeader(&buf, header); err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+// requestError converts the error of the HTTP request into a temporary
+// SMTP error.
+func (t *Target) requestError(err error) error {
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 4, 2},
+		Message:      "API provider is unavailable",
+		TargetName:   t.modName,
+		Err:          err,
+	}
+}
+
+// statusError maps the HTTP status code of the API response into an SMTP
+// error.
+//
+// Authentication and server errors are considered temporary so messages are
+// not bounced due to misconfiguration or provider outages. Other client
+// errors mean that the message is rejected by the provider and are
+// permanent, so the sender gets the bounce.
+func (t *Target) statusError(status int, respBody []byte) error {
+	if status >= 200 && status < 300 {
+		return nil
+	}
+
+	misc := map[string]interface{}{
+		"http_status": status,
+		"response":    strings.TrimSpace(string(respBody)),
+	}
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 7, 0},
+			Message:      "Authentication to the API provider failed",
+			TargetName:   t.modName,
+			Misc:         misc,
+		}
+	case status == http.StatusTooManyRequests:
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 5},
+			Message:      "API provider rate limit exceeded",
+			TargetName:   t.modName,
+			Misc:         misc,
+		}
+	case status == http.StatusRequestEntityTooLarge:
+		return &exterrors.SMTPError{
+			Code:         552,
+			EnhancedCode: exterrors.EnhancedCode{5, 3, 4},
+			Message:      "Message is too big for the API provider",
+			TargetName:   t.modName,
+			Misc:         misc,
+		}
+	case status >= 400 && status < 500:
+		return &exterrors.SMTPError{
+			Code:         554,
+			EnhancedCode: exterrors.EnhancedCode{5, 6, 0},
+			Message:      "Message rejected by the API provider",
+			TargetName:   t.modName,
+			Misc:         misc,
+		}
+	default:
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 4, 2},
+			Message:      "API provider is unavailable",
+			TargetName:   t.modName,
+			Misc:         misc,
+		}
+	}
+}
+
+func init() {
+	module.Register("target.ses", New)
+	module.Register("target.mailgun", New)
+	module.Register("target.sendgrid", New)
+}
@@ -0,0 +1,202 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func testTarget(t *testing.T, modName string, prov provider) *Target {
+	return &Target{
+		modName: modName,
+		prov:    prov,
+		client:  http.DefaultClient,
+		log:     testutils.Logger(t, modName),
+	}
+}
+
+func TestMailgun(t *testing.T) {
+	var (
+		rcpts []string
+		msg   []byte
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/example.org/messages.mime" {
+			t.Error("wrong path:", r.URL.Path)
+		}
+		if user, pass, _ := r.BasicAuth(); user != "api" || pass != "key" {
+			t.Error("wrong credentials:", user, pass)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Fatal(err)
+		}
+		rcpts = r.MultipartForm.Value["to"]
+		f, _, err := r.FormFile("message")
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, _ = ioutil.ReadAll(f)
+	}))
+	defer srv.Close()
+
+	tgt := testTarget(t, "target.mailgun", &mailgun{domain: "example.org", apiKey: "key", endpoint: srv.URL})
+	testutils.DoTestDelivery(t, tgt, "test@example.org", []string{"rcpt1@example.com", "rcpt2@example.com"})
+
+	if len(rcpts) != 2 || rcpts[0] != "rcpt1@example.com" || rcpts[1] != "rcpt2@example.com" {
+		t.Error("wrong recipients:", rcpts)
+	}
+	if string(msg) != testutils.DeliveryData {
+		t.Errorf("wrong message: %q", msg)
+	}
+}
+
+func TestSES(t *testing.T) {
+	var req sesRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/email/outbound-emails" {
+			t.Error("wrong path:", r.URL.Path)
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20200102/us-east-1/ses/aws4_request, ") {
+			t.Error("wrong authorization:", auth)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer srv.Close()
+
+	prov := &ses{
+		region:    "us-east-1",
+		accessKey: "AKID",
+		secretKey: "secret",
+		endpoint:  srv.URL,
+		now: func() time.Time {
+			return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		},
+	}
+	tgt := testTarget(t, "target.ses", prov)
+	testutils.DoTestDelivery(t, tgt, "test@example.org", []string{"rcpt@example.com"})
+
+	if req.FromEmailAddress != "test@example.org" {
+		t.Error("wrong sender:", req.FromEmailAddress)
+	}
+	if len(req.Destination.ToAddresses) != 1 || req.Destination.ToAddresses[0] != "rcpt@example.com" {
+		t.Error("wrong recipients:", req.Destination.ToAddresses)
+	}
+	if string(req.Content.Raw.Data) != testutils.DeliveryData {
+		t.Errorf("wrong message: %q", req.Content.Raw.Data)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	for status, code := range map[int]int{
+		http.StatusBadRequest:            554,
+		http.StatusUnauthorized:          451,
+		http.StatusTooManyRequests:       451,
+		http.StatusRequestEntityTooLarge: 552,
+		http.StatusInternalServerError:   451,
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+
+		tgt := testTarget(t, "target.sendgrid", &sendgrid{apiKey: "key", endpoint: srv.URL})
+		_, err := testutils.DoTestDeliveryErr(t, tgt, "test@example.org", []string{"rcpt@example.com"})
+		srv.Close()
+
+		if err == nil {
+			t.Errorf("%d: no error", status)
+			continue
+		}
+		if got := exterrors.Fields(err)["smtp_code"]; got != code {
+			t.Errorf("%d: want SMTP code %d, got %v", status, code, got)
+		}
+	}
+}
+
+func TestConvertSendgrid(t *testing.T) {
+	const msg = "From: Sender <sender@example.org>\r\n" +
+		"To: rcpt@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"Message-Id: <foo@example.org>\r\n" +
+		"Mime-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Hi</p>\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Hi\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=doc.pdf\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"cGRm\r\n" +
+		"--b--\r\n"
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := msg[strings.Index(msg, "\r\n\r\n")+4:]
+
+	req, err := convertSendgrid("bounce@example.org", []string{"a@example.com", "b@example.com"}, hdr, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.From.Email != "sender@example.org" || req.From.Name != "Sender" {
+		t.Error("wrong From:", req.From)
+	}
+	if req.Subject != "Hello" {
+		t.Error("wrong Subject:", req.Subject)
+	}
+	if len(req.Personalizations) != 2 {
+		t.Error("wrong personalizations:", req.Personalizations)
+	}
+	if len(req.Content) != 2 || req.Content[0].Type != "text/plain" || req.Content[1].Type != "text/html" {
+		t.Error("wrong content:", req.Content)
+	}
+	if len(req.Attachments) != 1 || req.Attachments[0].Filename != "doc.pdf" || !bytes.Equal(req.Attachments[0].Content, []byte("pdf")) {
+		t.Error("wrong attachments:", req.Attachments)
+	}
+	if req.Headers["Message-Id"] != "<foo@example.org>" {
+		t.Error("wrong headers:", req.Headers)
+	}
+	if _, ok := req.Headers["Subject"]; ok {
+		t.Error("reserved header is passed:", req.Headers)
+	}
+}
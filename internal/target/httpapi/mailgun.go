@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// mailgun submits messages using the Mailgun messages.mime API. The message
+// is passed as is.
+type mailgun struct {
+	domain   string
+	apiKey   string
+	endpoint string
+}
+
+func (m *mailgun) configure(cfg *config.Map) {
+	cfg.String("domain", false, true, "", &m.domain)
+	cfg.String("api_key", false, true, "", &m.apiKey)
+	cfg.String("endpoint", false, false, "https://api.mailgun.net", &m.endpoint)
+}
+
+func (m *mailgun) validate() error {
+	if m.domain == "" || m.apiKey == "" {
+		return errors.New("domain and api_key are required")
+	}
+	m.endpoint = strings.TrimSuffix(m.endpoint, "/")
+	return nil
+}
+
+func (m *mailgun) request(ctx context.Context, _ string, rcpts []string, header textproto.Header, body []byte) (*http.Request, error) {
+	msg, err := writeMessage(header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, rcpt := range rcpts {
+		if err := w.WriteField("to", rcpt); err != nil {
+			return nil, err
+		}
+	}
+	part, err := w.CreateFormFile("message", "message.eml")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", m.endpoint+"/v3/"+m.domain+"/messages.mime", &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth("api", m.apiKey)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, nil
+}
@@ -0,0 +1,239 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	_ "github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// sendgrid submits messages using the SendGrid v3 mail/send API.
+//
+// The API does not accept raw MIME messages so the message is converted:
+// text/plain and text/html bodies are used as the content, other parts are
+// passed as attachments and header fields not controlled by the API are
+// passed as custom headers.
+type sendgrid struct {
+	apiKey   string
+	endpoint string
+}
+
+func (s *sendgrid) configure(cfg *config.Map) {
+	cfg.String("api_key", false, true, "", &s.apiKey)
+	cfg.String("endpoint", false, false, "https://api.sendgrid.com", &s.endpoint)
+}
+
+func (s *sendgrid) validate() error {
+	if s.apiKey == "" {
+		return errors.New("api_key is required")
+	}
+	s.endpoint = strings.TrimSuffix(s.endpoint, "/")
+	return nil
+}
+
+type sendgridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendgridPersonalization struct {
+	To []sendgridAddress `json:"to"`
+}
+
+type sendgridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendgridAttachment struct {
+	Content     []byte `json:"content"`
+	Type        string `json:"type,omitempty"`
+	Filename    string `json:"filename"`
+	Disposition string `json:"disposition,omitempty"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+type sendgridRequest struct {
+	Personalizations []sendgridPersonalization `json:"personalizations"`
+	From             sendgridAddress           `json:"from"`
+	ReplyTo          *sendgridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject,omitempty"`
+	Content          []sendgridContent         `json:"content,omitempty"`
+	Attachments      []sendgridAttachment      `json:"attachments,omitempty"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+// Header fields that are set by SendGrid or using dedicated request fields.
+var sendgridReserved = map[string]bool{
+	"from":                      true,
+	"to":                        true,
+	"cc":                        true,
+	"bcc":                       true,
+	"reply-to":                  true,
+	"subject":                   true,
+	"content-type":              true,
+	"content-transfer-encoding": true,
+	"mime-version":              true,
+	"received":                  true,
+	"dkim-signature":            true,
+}
+
+func convertSendgrid(mailFrom string, rcpts []string, header textproto.Header, body []byte) (*sendgridRequest, error) {
+	msg, err := writeMessage(header, body)
+	if err != nil {
+		return nil, err
+	}
+	mr, err := mail.CreateReader(bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	defer mr.Close()
+
+	req := &sendgridRequest{
+		From:    sendgridAddress{Email: mailFrom},
+		Headers: map[string]string{},
+	}
+	for _, rcpt := range rcpts {
+		// Separate personalization for each recipient to not expose the
+		// recipients list.
+		req.Personalizations = append(req.Personalizations, sendgridPersonalization{
+			To: []sendgridAddress{{Email: rcpt}},
+		})
+	}
+
+	from, err := mr.Header.AddressList("From")
+	if err == nil && len(from) != 0 {
+		req.From = sendgridAddress{Email: from[0].Address, Name: from[0].Name}
+	}
+	replyTo, err := mr.Header.AddressList("Reply-To")
+	if err == nil && len(replyTo) != 0 {
+		req.ReplyTo = &sendgridAddress{Email: replyTo[0].Address, Name: replyTo[0].Name}
+	}
+	req.Subject, _ = mr.Header.Subject()
+
+	seen := map[string]bool{}
+	fields := header.Fields()
+	for fields.Next() {
+		key := strings.ToLower(fields.Key())
+		// Only one value per field is supported by the API.
+		if sendgridReserved[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		req.Headers[fields.Key()] = fields.Value()
+	}
+
+	var plain, html *sendgridContent
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		partBody, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		switch h := part.Header.(type) {
+		case *mail.InlineHeader:
+			ct, _, _ := h.ContentType()
+			if ct == "" {
+				ct = "text/plain"
+			}
+			switch {
+			case ct == "text/plain" && plain == nil:
+				plain = &sendgridContent{Type: ct, Value: string(partBody)}
+				continue
+			case ct == "text/html" && html == nil:
+				html = &sendgridContent{Type: ct, Value: string(partBody)}
+				continue
+			}
+
+			// Inline images, etc.
+			cid := strings.Trim(h.Get("Content-Id"), "<>")
+			req.Attachments = append(req.Attachments, sendgridAttachment{
+				Content:     partBody,
+				Type:        ct,
+				Filename:    fmt.Sprintf("part%d", len(req.Attachments)+1),
+				Disposition: "inline",
+				ContentID:   cid,
+			})
+		case *mail.AttachmentHeader:
+			ct, _, _ := h.ContentType()
+			filename, _ := h.Filename()
+			if filename == "" {
+				filename = fmt.Sprintf("part%d", len(req.Attachments)+1)
+			}
+			req.Attachments = append(req.Attachments, sendgridAttachment{
+				Content:     partBody,
+				Type:        ct,
+				Filename:    filename,
+				Disposition: "attachment",
+			})
+		}
+	}
+
+	// text/plain should go first per API requirements.
+	if plain != nil {
+		req.Content = append(req.Content, *plain)
+	}
+	if html != nil {
+		req.Content = append(req.Content, *html)
+	}
+	if len(req.Content) == 0 {
+		return nil, errors.New("message has no text/plain or text/html body")
+	}
+
+	return req, nil
+}
+
+func (s *sendgrid) request(ctx context.Context, mailFrom string, rcpts []string, header textproto.Header, body []byte) (*http.Request, error) {
+	sgReq, err := convertSendgrid(mailFrom, rcpts, header, body)
+	if err != nil {
+		return nil, err
+	}
+	reqBody, err := json.Marshal(sgReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint+"/v3/mail/send", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
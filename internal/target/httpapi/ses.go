@@ -0,0 +1,154 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+// ses submits messages using the Amazon SES v2 SendEmail API with raw
+// message content. The message is passed as is.
+type ses struct {
+	region           string
+	accessKey        string
+	secretKey        string
+	endpoint         string
+	configurationSet string
+
+	now func() time.Time
+}
+
+func (s *ses) configure(cfg *config.Map) {
+	cfg.String("region", false, true, "", &s.region)
+	cfg.String("access_key", false, true, "", &s.accessKey)
+	cfg.String("secret_key", false, true, "", &s.secretKey)
+	cfg.String("endpoint", false, false, "", &s.endpoint)
+	cfg.String("configuration_set", false, false, "", &s.configurationSet)
+}
+
+func (s *ses) validate() error {
+	if s.region == "" || s.accessKey == "" || s.secretKey == "" {
+		return errors.New("region, access_key and secret_key are required")
+	}
+	if s.endpoint == "" {
+		s.endpoint = "https://email." + s.region + ".amazonaws.com"
+	}
+	s.endpoint = strings.TrimSuffix(s.endpoint, "/")
+	if s.now == nil {
+		s.now = time.Now
+	}
+	return nil
+}
+
+type sesRequest struct {
+	FromEmailAddress string `json:",omitempty"`
+	Destination      struct {
+		ToAddresses []string
+	}
+	Content struct {
+		Raw struct {
+			Data []byte
+		}
+	}
+	ConfigurationSetName string `json:",omitempty"`
+}
+
+func (s *ses) request(ctx context.Context, mailFrom string, rcpts []string, header textproto.Header, body []byte) (*http.Request, error) {
+	msg, err := writeMessage(header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	sesReq := sesRequest{
+		FromEmailAddress:     mailFrom,
+		ConfigurationSetName: s.configurationSet,
+	}
+	sesReq.Destination.ToAddresses = rcpts
+	sesReq.Content.Raw.Data = msg
+	reqBody, err := json.Marshal(sesReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint+"/v2/email/outbound-emails", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, reqBody)
+	return req, nil
+}
+
+// sign adds the AWS Signature Version 4 to the request.
+func (s *ses) sign(req *http.Request, body []byte) {
+	const service = "ses"
+
+	t := s.now().UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256") + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + s.region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
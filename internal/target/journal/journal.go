@@ -0,0 +1,301 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package journal implements the target.journal module that stores a copy
+// of each message for compliance archiving.
+//
+// The module is used as an additional delivery target next to the normal
+// one. The copy contains the envelope in X-Envelope-From and X-Envelope-To
+// header fields and is either delivered to the archive address using
+// another target or written to a Maildir directory.
+package journal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/trace"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.journal"
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	target      module.DeliveryTarget
+	archiveAddr string
+	maildir     string
+	required    bool
+
+	hostname string
+	counter  uint64
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Custom("deliver_to", false, false, nil, modconfig.DeliveryDirective, &t.target)
+	cfg.String("archive_address", false, false, "", &t.archiveAddr)
+	cfg.String("maildir", false, false, "", &t.maildir)
+	cfg.Bool("required", false, true, &t.required)
+	cfg.String("hostname", true, false, "", &t.hostname)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	switch {
+	case t.target != nil && t.maildir != "":
+		return fmt.Errorf("%s: deliver_to and maildir can't be used together", modName)
+	case t.target != nil:
+		if t.archiveAddr == "" {
+			return fmt.Errorf("%s: archive_address is required for deliver_to", modName)
+		}
+	case t.maildir != "":
+		if !filepath.IsAbs(t.maildir) {
+			t.maildir = filepath.Join(config.StateDirectory, t.maildir)
+		}
+		if err := createMaildir(t.maildir); err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+	default:
+		return fmt.Errorf("%s: either deliver_to or maildir is required", modName)
+	}
+	if t.hostname == "" {
+		t.hostname = "localhost"
+	}
+	return nil
+}
+
+func createMaildir(path string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(path, sub), 0o700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type delivery struct {
+	t        *Target
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+	rcpts    []string
+
+	d       module.Delivery
+	tmpPath string
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+	}, nil
+}
+
+// AddRcpt only records the recipient, one copy is stored for all of them.
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	d.rcpts = append(d.rcpts, rcptTo)
+	return nil
+}
+
+// journalHeader returns the header with envelope fields added. Original
+// addresses (before any rewriting) are used.
+func (d *delivery) journalHeader(header textproto.Header) textproto.Header {
+	header = header.Copy()
+	// Do not let the sender spoof the envelope.
+	header.Del("X-Envelope-From")
+	header.Del("X-Envelope-To")
+
+	seen := make(map[string]struct{}, len(d.rcpts))
+	for i := len(d.rcpts) - 1; i >= 0; i-- {
+		rcpt := d.rcpts[i]
+		if original, ok := d.msgMeta.OriginalRcpts[rcpt]; ok {
+			rcpt = original
+		}
+		if _, ok := seen[rcpt]; ok {
+			continue
+		}
+		seen[rcpt] = struct{}{}
+		header.Add("X-Envelope-To", "<"+target.SanitizeForHeader(rcpt)+">")
+	}
+	from := d.msgMeta.OriginalFrom
+	if from == "" {
+		from = d.mailFrom
+	}
+	header.Add("X-Envelope-From", "<"+target.SanitizeForHeader(from)+">")
+	return header
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, modName+"/Body").End()
+
+	if len(d.rcpts) == 0 {
+		return nil
+	}
+
+	var err error
+	if d.t.target != nil {
+		err = d.deliverCopy(ctx, d.journalHeader(header), body)
+		if err != nil && d.d != nil {
+			if err := d.d.Abort(ctx); err != nil {
+				d.log.Error("failed to abort the journal copy delivery", err)
+			}
+			d.d = nil
+		}
+	} else {
+		err = d.writeMaildir(d.journalHeader(header), body)
+	}
+	return d.handleErr(err)
+}
+
+func (d *delivery) handleErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if !d.t.required {
+		d.log.Error("failed to store the journal copy", err)
+		return nil
+	}
+	return &exterrors.SMTPError{
+		Code:         451,
+		EnhancedCode: exterrors.EnhancedCode{4, 3, 0},
+		Message:      "Unable to store the message copy, try again later",
+		TargetName:   modName,
+		Err:          err,
+	}
+}
+
+func (d *delivery) deliverCopy(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	// Null sender, failures should not be reported to the message author.
+	var err error
+	d.d, err = d.t.target.Start(ctx, d.msgMeta, "")
+	if err != nil {
+		return err
+	}
+	if err := d.d.AddRcpt(ctx, d.t.archiveAddr); err != nil {
+		return err
+	}
+	return d.d.Body(ctx, header, body)
+}
+
+// writeMaildir writes the message into the tmp directory, it is moved to new
+// on Commit.
+func (d *delivery) writeMaildir(header textproto.Header, body buffer.Buffer) error {
+	name := strconv.FormatInt(time.Now().Unix(), 10) + ".M" +
+		strconv.Itoa(os.Getpid()) + "Q" + strconv.FormatUint(atomic.AddUint64(&d.t.counter, 1), 10) +
+		"_" + d.msgMeta.ID + "." + d.t.hostname
+	tmpPath := filepath.Join(d.t.maildir, "tmp", name)
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d.tmpPath = tmpPath
+
+	var hdrBuf bytes.Buffer
+	if err := textproto.WriteHeader(&hdrBuf, header); err != nil {
+		return err
+	}
+	bodyR, err := body.Open()
+	if err != nil {
+		return err
+	}
+	defer bodyR.Close()
+
+	if _, err := io.Copy(f, io.MultiReader(&hdrBuf, bodyR)); err != nil {
+		os.Remove(d.tmpPath)
+		d.tmpPath = ""
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		os.Remove(d.tmpPath)
+		d.tmpPath = ""
+		return err
+	}
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	if d.tmpPath != "" {
+		if err := os.Remove(d.tmpPath); err != nil {
+			d.log.Error("failed to remove the journal copy", err)
+		}
+	}
+	if d.d != nil {
+		return d.d.Abort(ctx)
+	}
+	return nil
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	if d.tmpPath != "" {
+		name := filepath.Base(d.tmpPath)
+		if err := os.Rename(d.tmpPath, filepath.Join(d.t.maildir, "new", name)); err != nil {
+			return d.handleErr(err)
+		}
+		d.log.Msg("journal copy stored", "path", filepath.Join(d.t.maildir, "new", name))
+	}
+	if d.d != nil {
+		if err := d.d.Commit(ctx); err != nil {
+			return d.handleErr(err)
+		}
+		d.log.Msg("journal copy delivered", "archive_address", d.t.archiveAddr)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
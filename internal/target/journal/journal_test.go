@@ -0,0 +1,122 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package journal
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestJournal_Target(t *testing.T) {
+	archive := testutils.Target{}
+	tgt := &Target{
+		log:         testutils.Logger(t, modName),
+		target:      &archive,
+		archiveAddr: "journal@example.org",
+		required:    true,
+	}
+
+	msgMeta := &module.MsgMetadata{
+		OriginalFrom:  "Sender@example.com",
+		OriginalRcpts: map[string]string{"alice@example.org": "team@example.org"},
+	}
+	testutils.DoTestDeliveryMeta(t, tgt, "sender@example.com",
+		[]string{"alice@example.org", "bob@example.org"}, msgMeta)
+
+	if len(archive.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(archive.Messages))
+	}
+	msg := archive.Messages[0]
+	testutils.CheckMsg(t, &msg, "", []string{"journal@example.org"})
+	if from := msg.Header.Get("X-Envelope-From"); from != "<Sender@example.com>" {
+		t.Error("Wrong X-Envelope-From:", from)
+	}
+	to := msg.Header.Values("X-Envelope-To")
+	if len(to) != 2 || to[0] != "<team@example.org>" || to[1] != "<bob@example.org>" {
+		t.Error("Wrong X-Envelope-To:", to)
+	}
+}
+
+func TestJournal_Maildir(t *testing.T) {
+	dir := t.TempDir()
+	tgt := &Target{
+		log:      testutils.Logger(t, modName),
+		maildir:  dir,
+		required: true,
+		hostname: "mx.example.org",
+	}
+	if err := createMaildir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.com", []string{"rcpt@example.org"})
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatal("Expected a message file, got", len(files))
+	}
+	if !strings.HasSuffix(files[0].Name(), ".mx.example.org") {
+		t.Error("Wrong file name:", files[0].Name())
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "new", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "X-Envelope-From: <sender@example.com>\r\nX-Envelope-To: <rcpt@example.org>\r\n" +
+		"A: 1\r\nB: 2\r\n\r\nfoobar\r\n"
+	if string(blob) != want {
+		t.Errorf("Wrong message:\n%q\nwant:\n%q", blob, want)
+	}
+
+	tmpFiles, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmpFiles) != 0 {
+		t.Error("Files left in tmp:", len(tmpFiles))
+	}
+}
+
+func TestJournal_Required(t *testing.T) {
+	archive := testutils.Target{BodyErr: errors.New("no space left")}
+	tgt := &Target{
+		log:         testutils.Logger(t, modName),
+		target:      &archive,
+		archiveAddr: "journal@example.org",
+		required:    true,
+	}
+	if _, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.com", []string{"rcpt@example.org"}); err == nil {
+		t.Error("Expected an error")
+	}
+
+	tgt.required = false
+	testutils.DoTestDelivery(t, tgt, "sender@example.com", []string{"rcpt@example.org"})
+	if len(archive.Messages) != 0 {
+		t.Error("Failed copy was delivered")
+	}
+}
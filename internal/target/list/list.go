@@ -0,0 +1,370 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package list implements the target.list module that expands mailing list
+// addresses into list members.
+//
+// Messages are passed to the deliver_to target with the envelope sender
+// replaced by the list bounce address and with List-* header fields added.
+// Recipients that are not lists are passed to deliver_to unchanged.
+package list
+
+import (
+	"context"
+	"fmt"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/buffer"
+	"github.com/foxcpp/maddy/framework/config"
+	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+const modName = "target.list"
+
+type Target struct {
+	instName string
+	log      log.Logger
+
+	members     module.Table
+	target      module.DeliveryTarget
+	membersOnly bool
+	bounceAddr  string
+	unsubscribe []string
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Target{
+		instName: instName,
+		log:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (t *Target) Name() string {
+	return modName
+}
+
+func (t *Target) InstanceName() string {
+	return t.instName
+}
+
+func (t *Target) Init(cfg *config.Map) error {
+	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Custom("members", false, true, nil, modconfig.TableDirective, &t.members)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &t.target)
+	cfg.Bool("members_only", false, false, &t.membersOnly)
+	cfg.String("bounce_address", false, false, "{local}-bounces@{domain}", &t.bounceAddr)
+	cfg.StringList("unsubscribe", false, false,
+		[]string{"mailto:{local}-owner@{domain}?subject=unsubscribe"}, &t.unsubscribe)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(t.unsubscribe) == 1 && t.unsubscribe[0] == "off" {
+		t.unsubscribe = nil
+	}
+	if !strings.Contains(t.bounceAddr, "@") {
+		return fmt.Errorf("%s: bounce_address should be an address", modName)
+	}
+	return nil
+}
+
+// expandTemplate replaces {list}, {local} and {domain} placeholders with
+// parts of the list address.
+func expandTemplate(tmpl, list string) string {
+	local, domain, _ := address.Split(list)
+	return strings.NewReplacer(
+		"{list}", list,
+		"{local}", local,
+		"{domain}", domain,
+	).Replace(tmpl)
+}
+
+// lookupMembers returns members of the list or nil if addr is not a list.
+func (t *Target) lookupMembers(ctx context.Context, addr string) ([]string, error) {
+	keys, err := address.LookupKeys(addr)
+	if err != nil {
+		return nil, nil
+	}
+
+	var values []string
+	for _, key := range keys {
+		if multi, ok := t.members.(module.MultiTable); ok {
+			values, err = multi.LookupMulti(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			value, ok, err := t.members.Lookup(ctx, key)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				values = []string{value}
+			}
+		}
+		if values != nil {
+			break
+		}
+	}
+
+	var members []string
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			member = strings.TrimSpace(member)
+			if member == "" {
+				continue
+			}
+			members = append(members, member)
+		}
+	}
+	if values != nil && members == nil {
+		// Empty list, still a list.
+		members = []string{}
+	}
+	return members, nil
+}
+
+func isMember(members []string, addr string) bool {
+	for _, member := range members {
+		if address.Equal(member, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+type listDelivery struct {
+	list    string
+	d       module.Delivery
+	members map[string]struct{}
+}
+
+type delivery struct {
+	t        *Target
+	log      log.Logger
+	msgMeta  *module.MsgMetadata
+	mailFrom string
+
+	lists []*listDelivery
+	// Delivery for recipients that are not lists, started with the original
+	// sender.
+	pass module.Delivery
+}
+
+func (t *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
+	return &delivery{
+		t:        t,
+		log:      target.DeliveryLogger(t.log, msgMeta),
+		msgMeta:  msgMeta,
+		mailFrom: mailFrom,
+	}, nil
+}
+
+func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
+	defer trace.StartRegion(ctx, modName+"/AddRcpt").End()
+
+	members, err := d.t.lookupMembers(ctx, rcptTo)
+	if err != nil {
+		return &exterrors.SMTPError{
+			Code:         451,
+			EnhancedCode: exterrors.EnhancedCode{4, 3, 5},
+			Message:      "List expansion failed",
+			TargetName:   modName,
+			Err:          err,
+		}
+	}
+	if members == nil {
+		if d.pass == nil {
+			d.pass, err = d.t.target.Start(ctx, d.msgMeta, d.mailFrom)
+			if err != nil {
+				return err
+			}
+		}
+		return d.pass.AddRcpt(ctx, rcptTo)
+	}
+
+	if len(members) == 0 {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 1, 1},
+			Message:      "List has no members",
+			TargetName:   modName,
+		}
+	}
+	if d.t.membersOnly && !isMember(members, d.mailFrom) {
+		return &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 2},
+			Message:      "Posting to the list is restricted to its members",
+			TargetName:   modName,
+			Misc: map[string]interface{}{
+				"list": rcptTo,
+			},
+		}
+	}
+
+	var ld *listDelivery
+	for _, l := range d.lists {
+		if address.Equal(l.list, rcptTo) {
+			ld = l
+		}
+	}
+	if ld == nil {
+		ld = &listDelivery{list: rcptTo, members: make(map[string]struct{})}
+		ld.d, err = d.t.target.Start(ctx, d.msgMeta, expandTemplate(d.t.bounceAddr, rcptTo))
+		if err != nil {
+			return err
+		}
+		d.lists = append(d.lists, ld)
+	}
+
+	d.log.DebugMsg("list expanded", "rcpt", rcptTo, "members", members)
+	var lastErr error
+	for _, member := range members {
+		if _, ok := ld.members[member]; ok {
+			continue
+		}
+		if err := ld.d.AddRcpt(ctx, member); err != nil {
+			// Delivery to other members should not fail because of
+			// one bad address.
+			d.log.Error("failed to add list member", err, "list", rcptTo, "member", member)
+			lastErr = err
+			continue
+		}
+		ld.members[member] = struct{}{}
+		// Do not disclose list members in bounces.
+		if d.msgMeta.OriginalRcpts != nil {
+			d.msgMeta.OriginalRcpts[member] = rcptTo
+		}
+	}
+	if len(ld.members) == 0 {
+		return lastErr
+	}
+	return nil
+}
+
+// listID returns the List-Id value for the list address (RFC 2919).
+func listID(list string) string {
+	local, domain, err := address.Split(list)
+	if err != nil || domain == "" {
+		return "<" + list + ">"
+	}
+	return "<" + local + "." + domain + ">"
+}
+
+func (d *delivery) listHeader(header textproto.Header, list string) (textproto.Header, error) {
+	id := listID(list)
+	for _, existing := range header.Values("List-Id") {
+		if strings.Contains(existing, id) {
+			return header, &exterrors.SMTPError{
+				Code:         554,
+				EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+				Message:      "Mailing list loop detected",
+				TargetName:   modName,
+				Misc: map[string]interface{}{
+					"list": list,
+				},
+			}
+		}
+	}
+
+	header = header.Copy()
+	// Fields set by other lists the message passed through are replaced.
+	for _, field := range []string{"List-Id", "List-Post", "List-Unsubscribe", "Precedence"} {
+		header.Del(field)
+	}
+	if len(d.t.unsubscribe) != 0 {
+		uris := make([]string, 0, len(d.t.unsubscribe))
+		for _, uri := range d.t.unsubscribe {
+			uris = append(uris, "<"+expandTemplate(uri, list)+">")
+		}
+		header.Add("List-Unsubscribe", strings.Join(uris, ", "))
+	}
+	header.Add("List-Post", "<mailto:"+list+">")
+	header.Add("List-Id", id)
+	header.Add("Precedence", "list")
+	return header, nil
+}
+
+func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, modName+"/Body").End()
+
+	for _, ld := range d.lists {
+		if len(ld.members) == 0 {
+			continue
+		}
+		listHdr, err := d.listHeader(header, ld.list)
+		if err != nil {
+			return err
+		}
+		if err := ld.d.Body(ctx, listHdr, body); err != nil {
+			return err
+		}
+	}
+	if d.pass != nil {
+		return d.pass.Body(ctx, header, body)
+	}
+	return nil
+}
+
+func (d *delivery) Abort(ctx context.Context) error {
+	var lastErr error
+	for _, ld := range d.lists {
+		if err := ld.d.Abort(ctx); err != nil {
+			lastErr = err
+		}
+	}
+	if d.pass != nil {
+		if err := d.pass.Abort(ctx); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+func (d *delivery) Commit(ctx context.Context) error {
+	for _, ld := range d.lists {
+		if len(ld.members) == 0 {
+			if err := ld.d.Abort(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ld.d.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	if d.pass != nil {
+		return d.pass.Commit(ctx)
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
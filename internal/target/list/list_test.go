@@ -0,0 +1,147 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package list
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/exterrors"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+type multiTable map[string][]string
+
+func (m multiTable) Lookup(_ context.Context, key string) (string, bool, error) {
+	values, ok := m[key]
+	if !ok {
+		return "", false, nil
+	}
+	return values[0], true, nil
+}
+
+func (m multiTable) LookupMulti(_ context.Context, key string) ([]string, error) {
+	return m[key], nil
+}
+
+func testTarget(t *testing.T, members module.Table, tgt module.DeliveryTarget) *Target {
+	return &Target{
+		log:         testutils.Logger(t, modName),
+		members:     members,
+		target:      tgt,
+		bounceAddr:  "{local}-bounces@{domain}",
+		unsubscribe: []string{"mailto:{local}-owner@{domain}?subject=unsubscribe", "https://example.org/unsub?list={list}"},
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	tbl := multiTable{
+		"team@example.org":  {"a@example.org, b@example.org", "c@example.org"},
+		"empty@example.org": {""},
+	}
+	next := testutils.Target{}
+	tgt := testTarget(t, tbl, &next)
+
+	msgMeta := &module.MsgMetadata{OriginalRcpts: map[string]string{}}
+	testutils.DoTestDeliveryMeta(t, tgt, "sender@example.com",
+		[]string{"Team@example.org", "d@example.org"}, msgMeta)
+
+	if len(next.Messages) != 2 {
+		t.Fatal("Expected 2 messages, got", len(next.Messages))
+	}
+	listMsg := next.Messages[0]
+	testutils.CheckMsg(t, &listMsg, "Team-bounces@example.org",
+		[]string{"a@example.org", "b@example.org", "c@example.org"})
+	for field, want := range map[string]string{
+		"List-Id":          "<Team.example.org>",
+		"List-Post":        "<mailto:Team@example.org>",
+		"List-Unsubscribe": "<mailto:Team-owner@example.org?subject=unsubscribe>, <https://example.org/unsub?list=Team@example.org>",
+		"Precedence":       "list",
+	} {
+		if got := listMsg.Header.Get(field); got != want {
+			t.Errorf("Wrong %s: %q, want %q", field, got, want)
+		}
+	}
+	if msgMeta.OriginalRcpts["b@example.org"] != "Team@example.org" {
+		t.Error("Wrong OriginalRcpts:", msgMeta.OriginalRcpts)
+	}
+
+	passMsg := next.Messages[1]
+	testutils.CheckMsg(t, &passMsg, "sender@example.com", []string{"d@example.org"})
+	if passMsg.Header.Has("List-Id") {
+		t.Error("List-Id added to a message for a non-list recipient")
+	}
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "sender@example.com", []string{"empty@example.org"})
+	if err == nil || exterrors.IsTemporary(err) {
+		t.Error("Expected permanent error for an empty list, got", err)
+	}
+}
+
+func TestDelivery_MembersOnly(t *testing.T) {
+	tbl := multiTable{
+		"team@example.org": {"a@example.org, b@example.org"},
+	}
+	next := testutils.Target{}
+	tgt := testTarget(t, tbl, &next)
+	tgt.membersOnly = true
+
+	_, err := testutils.DoTestDeliveryErr(t, tgt, "stranger@example.com", []string{"team@example.org"})
+	if err == nil || exterrors.IsTemporary(err) {
+		t.Error("Expected permanent error for a non-member, got", err)
+	}
+	if len(next.Messages) != 0 {
+		t.Fatal("Message from a non-member was delivered")
+	}
+
+	testutils.DoTestDelivery(t, tgt, "B@Example.org", []string{"team@example.org"})
+	if len(next.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(next.Messages))
+	}
+}
+
+func TestDelivery_Loop(t *testing.T) {
+	tbl := multiTable{
+		"team@example.org": {"team@example.org"},
+	}
+	next := testutils.Target{}
+	tgt := testTarget(t, tbl, &next)
+
+	testutils.DoTestDelivery(t, tgt, "sender@example.com", []string{"team@example.org"})
+	if len(next.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(next.Messages))
+	}
+
+	// Message coming back through the list.
+	delivery, err := tgt.Start(context.Background(), &module.MsgMetadata{ID: "test"}, "team-bounces@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := delivery.AddRcpt(context.Background(), "team@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	err = delivery.Body(context.Background(), next.Messages[0].Header, nil)
+	if err == nil || exterrors.IsTemporary(err) {
+		t.Error("Expected permanent error for a loop, got", err)
+	}
+	if err := delivery.Abort(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package target
+
+import (
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/exterrors"
+)
+
+// DeliveredTo reports whether the message header contains the Delivered-To
+// field for the address, that is, the message already passed through it.
+//
+// Modules that send messages off-host on behalf of an address (aliases,
+// forwarding) add the field and check it to detect forwarding loops.
+func DeliveredTo(header textproto.Header, addr string) bool {
+	for _, v := range header.Values("Delivered-To") {
+		v = strings.TrimSpace(v)
+		v = strings.TrimSuffix(strings.TrimPrefix(v, "<"), ">")
+		if address.Equal(v, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoopError returns the error used to reject the message that came back to
+// the address it already passed through.
+func LoopError(targetName, addr string) error {
+	return &exterrors.SMTPError{
+		Code:         554,
+		EnhancedCode: exterrors.EnhancedCode{5, 4, 6},
+		Message:      "Mail forwarding loop detected",
+		TargetName:   targetName,
+		Misc: map[string]interface{}{
+			"rcpt": addr,
+		},
+	}
+}
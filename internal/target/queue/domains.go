@@ -0,0 +1,172 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/address"
+	"github.com/foxcpp/maddy/framework/dns"
+)
+
+// stuckCheckInterval is how often domains are checked if stuck_domain_alert
+// is set.
+const stuckCheckInterval = 5 * time.Minute
+
+// DomainStatus describes queued messages for a destination domain.
+type DomainStatus struct {
+	Domain string `json:"domain"`
+	// Amount of messages with pending recipients in the domain.
+	Messages int `json:"messages"`
+	// Amount of pending recipients in the domain.
+	Recipients int `json:"recipients"`
+	// Time the oldest message was queued.
+	Oldest time.Time `json:"oldest"`
+	// Time of the last delivery attempt, zero if there were none.
+	LastAttempt time.Time `json:"last_attempt"`
+	// Error returned by the last delivery attempt.
+	LastError string `json:"last_error,omitempty"`
+}
+
+func rcptDomain(rcpt string) string {
+	_, domain, err := address.Split(rcpt)
+	if err != nil {
+		return ""
+	}
+	domain, _ = dns.ForLookup(domain)
+	return domain
+}
+
+// Domains returns the status of queued messages aggregated by recipient
+// domains, sorted by the oldest message.
+func (q *Queue) Domains() ([]DomainStatus, error) {
+	entries, err := q.Entries()
+	if err != nil {
+		return nil, err
+	}
+
+	byDomain := make(map[string]*DomainStatus)
+	for _, e := range entries {
+		counted := make(map[string]bool)
+		for _, rcpt := range e.Meta.To {
+			domain := rcptDomain(rcpt)
+			status := byDomain[domain]
+			if status == nil {
+				status = &DomainStatus{Domain: domain, Oldest: e.Meta.FirstAttempt}
+				byDomain[domain] = status
+			}
+
+			status.Recipients++
+			if !counted[domain] {
+				counted[domain] = true
+				status.Messages++
+			}
+			if e.Meta.FirstAttempt.Before(status.Oldest) {
+				status.Oldest = e.Meta.FirstAttempt
+			}
+			if !e.Meta.LastAttempt.Before(status.LastAttempt) {
+				status.LastAttempt = e.Meta.LastAttempt
+				if rcptErr := e.Meta.RcptErrs[rcpt]; rcptErr != nil {
+					status.LastError = fmt.Sprintf("%d %d.%d.%d %s", rcptErr.Code,
+						rcptErr.EnhancedCode[0], rcptErr.EnhancedCode[1], rcptErr.EnhancedCode[2],
+						rcptErr.Message)
+				}
+			}
+		}
+	}
+
+	res := make([]DomainStatus, 0, len(byDomain))
+	for _, status := range byDomain {
+		res = append(res, *status)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Oldest.Equal(res[j].Oldest) {
+			return res[i].Oldest.Before(res[j].Oldest)
+		}
+		return res[i].Domain < res[j].Domain
+	})
+	return res, nil
+}
+
+// StuckDomains returns domains with messages queued for longer than age.
+func (q *Queue) StuckDomains(age time.Duration) ([]DomainStatus, error) {
+	domains, err := q.Domains()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var stuck []DomainStatus
+	for _, d := range domains {
+		if now.Sub(d.Oldest) > age {
+			stuck = append(stuck, d)
+		}
+	}
+	return stuck, nil
+}
+
+// checkStuck logs domains that became stuck or recovered since the previous
+// check. alerted is updated to contain currently stuck domains.
+func (q *Queue) checkStuck(alerted map[string]bool) {
+	stuck, err := q.StuckDomains(q.stuckAlert)
+	if err != nil {
+		q.Log.Error("failed to read the queue", err)
+		return
+	}
+	stuckDomains.WithLabelValues(q.name, q.location).Set(float64(len(stuck)))
+
+	current := make(map[string]bool, len(stuck))
+	for _, d := range stuck {
+		current[d.Domain] = true
+		if alerted[d.Domain] {
+			continue
+		}
+		q.Log.Error("messages for the domain are not delivered", nil,
+			"domain", d.Domain,
+			"oldest_age", time.Since(d.Oldest).Truncate(time.Second).String(),
+			"messages", d.Messages,
+			"last_error", d.LastError)
+	}
+	for domain := range alerted {
+		if !current[domain] {
+			q.Log.Msg("messages for the domain are no longer stuck", "domain", domain)
+		}
+		delete(alerted, domain)
+	}
+	for domain := range current {
+		alerted[domain] = true
+	}
+}
+
+func (q *Queue) stuckCheckLoop() {
+	t := time.NewTicker(stuckCheckInterval)
+	defer t.Stop()
+
+	alerted := make(map[string]bool)
+	for {
+		select {
+		case <-q.stopStuckCheck:
+			return
+		case <-t.C:
+			q.checkStuck(alerted)
+		}
+	}
+}
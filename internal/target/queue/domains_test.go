@@ -0,0 +1,111 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestQueueDomains(t *testing.T) {
+	q := &Queue{
+		name:     "queue",
+		location: t.TempDir(),
+		Log:      testutils.Logger(t, "queue"),
+	}
+
+	now := time.Now()
+	for _, meta := range []*QueueMetadata{
+		{
+			MsgMeta:      &module.MsgMetadata{ID: "1"},
+			To:           []string{"a@example.org", "b@Example.org", "c@example.com"},
+			FirstAttempt: now.Add(-3 * time.Hour),
+			LastAttempt:  now.Add(-time.Hour),
+			RcptErrs: map[string]*smtp.SMTPError{
+				"a@example.org": {Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 1}, Message: "Connection refused"},
+			},
+		},
+		{
+			MsgMeta:      &module.MsgMetadata{ID: "2"},
+			To:           []string{"d@example.org"},
+			FirstAttempt: now.Add(-time.Hour),
+			LastAttempt:  now.Add(-time.Minute),
+			RcptErrs: map[string]*smtp.SMTPError{
+				"d@example.org": {Code: 451, EnhancedCode: smtp.EnhancedCode{4, 4, 2}, Message: "Timeout"},
+			},
+		},
+		{
+			MsgMeta:      &module.MsgMetadata{ID: "3"},
+			To:           []string{"e@example.net"},
+			FirstAttempt: now.Add(-time.Minute),
+		},
+	} {
+		if err := q.updateMetadataOnDisk(meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	domains, err := q.Domains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 3 {
+		t.Fatal("Wrong amount of domains:", domains)
+	}
+	// Sorted by the oldest message, then by name.
+	if domains[0].Domain != "example.com" || domains[1].Domain != "example.org" || domains[2].Domain != "example.net" {
+		t.Fatal("Wrong order:", domains)
+	}
+
+	org := domains[1]
+	if org.Messages != 2 || org.Recipients != 3 {
+		t.Error("Wrong example.org status:", org)
+	}
+	if !org.Oldest.Equal(now.Add(-3*time.Hour)) || !org.LastAttempt.Equal(now.Add(-time.Minute)) {
+		t.Error("Wrong example.org times:", org.Oldest, org.LastAttempt)
+	}
+	if org.LastError != "451 4.4.2 Timeout" {
+		t.Error("Wrong example.org last error:", org.LastError)
+	}
+	if domains[0].Messages != 1 || domains[0].LastError != "" {
+		t.Error("Wrong example.com status:", domains[0])
+	}
+	if !domains[2].LastAttempt.IsZero() {
+		t.Error("Wrong example.net status:", domains[2])
+	}
+
+	stuck, err := q.StuckDomains(2 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stuck) != 2 || stuck[0].Domain != "example.com" || stuck[1].Domain != "example.org" {
+		t.Error("Wrong stuck domains:", stuck)
+	}
+
+	q.stuckAlert = 2 * time.Hour
+	alerted := map[string]bool{"example.net": true}
+	q.checkStuck(alerted)
+	if len(alerted) != 2 || !alerted["example.org"] || !alerted["example.com"] {
+		t.Error("Wrong alerted domains:", alerted)
+	}
+}
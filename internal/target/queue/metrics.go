@@ -30,6 +30,17 @@ var queuedMsgs = prometheus.NewGaugeVec(
 	[]string{"module", "location"},
 )
 
+var stuckDomains = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "maddy",
+		Subsystem: "queue",
+		Name:      "stuck_domains",
+		Help:      "Amount of domains with messages queued for longer than stuck_domain_alert",
+	},
+	[]string{"module", "location"},
+)
+
 func init() {
 	prometheus.MustRegister(queuedMsgs)
+	prometheus.MustRegister(stuckDomains)
 }
@@ -70,6 +70,7 @@ import (
 	"runtime"
 	"runtime/debug"
 	"runtime/trace"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -85,6 +86,7 @@ import (
 	"github.com/foxcpp/maddy/framework/module"
 	"github.com/foxcpp/maddy/internal/dsn"
 	"github.com/foxcpp/maddy/internal/msgpipeline"
+	"github.com/foxcpp/maddy/internal/smtpconn"
 	"github.com/foxcpp/maddy/internal/target"
 )
 
@@ -150,6 +152,18 @@ type Queue struct {
 	Log    log.Logger
 	Target module.DeliveryTarget
 
+	// If non-zero, domains with messages queued for longer are reported.
+	stuckAlert     time.Duration
+	stopStuckCheck chan struct{}
+
+	// Record SMTP dialogue of failed delivery attempts, see transcript.go.
+	recordTranscripts   bool
+	transcriptRetention time.Duration
+
+	// Per-recipient or per-domain schedules to hold non-urgent deliveries,
+	// see quiet.go.
+	quietHours module.Table
+
 	deliveryWg sync.WaitGroup
 	// Buffered channel used to restrict count of deliveries attempted
 	// in parallel.
@@ -217,6 +231,10 @@ func (q *Queue) Init(cfg *config.Map) error {
 	cfg.Custom("target", false, true, nil, modconfig.DeliveryDirective, &q.Target)
 	cfg.String("hostname", true, true, "", &q.hostname)
 	cfg.String("autogenerated_msg_domain", true, false, "", &q.autogenMsgDomain)
+	cfg.Duration("stuck_domain_alert", false, false, 0, &q.stuckAlert)
+	cfg.Bool("record_transcripts", false, false, &q.recordTranscripts)
+	cfg.Duration("transcript_retention", false, false, 7*24*time.Hour, &q.transcriptRetention)
+	cfg.Custom("quiet_hours", false, false, nil, modconfig.TableDirective, &q.quietHours)
 	cfg.Custom("bounce", false, false, nil, func(m *config.Map, node config.Node) (interface{}, error) {
 		return msgpipeline.New(m.Globals, node.Children)
 	}, &q.dsnPipeline)
@@ -257,10 +275,22 @@ func (q *Queue) start(maxParallelism int) error {
 
 	q.Log.Debugf("delivery target: %T", q.Target)
 
+	if q.recordTranscripts {
+		q.cleanupTranscripts()
+	}
+
+	if q.stuckAlert != 0 {
+		q.stopStuckCheck = make(chan struct{})
+		go q.stuckCheckLoop()
+	}
+
 	return nil
 }
 
 func (q *Queue) Close() error {
+	if q.stopStuckCheck != nil {
+		close(q.stopStuckCheck)
+	}
 	q.wheel.Close()
 	q.deliveryWg.Wait()
 
@@ -375,9 +405,28 @@ func toSMTPErr(err error) *smtp.SMTPError {
 func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 
-	partialErr := q.deliver(meta, header, body)
+	var tr *smtpconn.Transcript
+	if q.recordTranscripts {
+		tr = &smtpconn.Transcript{}
+	}
+	attemptStart := time.Now()
+
+	rcpts, heldRcpts, releaseTime := q.holdQuietRcpts(meta, header, attemptStart)
+	for _, rcpt := range heldRcpts {
+		dl.Msg("held for quiet hours", "rcpt", rcpt, "release_time", releaseTime)
+	}
+	meta.To = rcpts
+
+	partialErr := partialError{Errs: map[string]error{}}
+	if len(meta.To) != 0 {
+		partialErr = q.deliver(meta, header, body, tr)
+	}
 	dl.Debugf("errors: %v", partialErr.Errs)
 
+	if tr != nil && len(partialErr.Errs) != 0 && !tr.Empty() {
+		q.saveTranscript(meta.MsgMeta, attemptStart, tr, partialErr.Errs)
+	}
+
 	// While iterating the list of recipients we also pick the smallest tries count
 	// and use it to calculate the delay for the next attempt.
 	smallestTriesCount := 999999
@@ -425,24 +474,32 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		q.emitDSN(meta, header, failedRcpts)
 	}
 	// No recipients to try, either all failed or all succeeded.
-	if len(newRcpts) == 0 {
+	if len(newRcpts) == 0 && len(heldRcpts) == 0 {
 		q.removeFromDisk(meta.MsgMeta)
 		return
 	}
 
-	meta.To = newRcpts
-	meta.LastAttempt = time.Now()
+	retrying := len(newRcpts) != 0
+	meta.To = append(newRcpts, heldRcpts...)
+	if len(rcpts) != 0 {
+		meta.LastAttempt = time.Now()
+	}
 
 	if err := q.updateMetadataOnDisk(meta); err != nil {
 		dl.Error("meta-data update", err)
 	}
 
-	nextTryTime := time.Now()
-	// Delay between retries grows exponentally, the formula is:
-	// initialRetryTime * retryTimeScale ^ (smallestTriesCount - 1)
-	dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
-	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-	nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
+	nextTryTime := releaseTime
+	if retrying {
+		// Delay between retries grows exponentally, the formula is:
+		// initialRetryTime * retryTimeScale ^ (smallestTriesCount - 1)
+		dl.Debugf("delay: %v * %v ^ (%v - 1)", q.initialRetryTime, q.retryTimeScale, smallestTriesCount)
+		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
+		retryTime := time.Now().Add(q.initialRetryTime * scaleFactor)
+		if nextTryTime.IsZero() || retryTime.Before(nextTryTime) {
+			nextTryTime = retryTime
+		}
+	}
 	dl.Msg("will retry",
 		"attempts_count", meta.TriesCount,
 		"next_try_delay", time.Until(nextTryTime),
@@ -459,7 +516,7 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 	})
 }
 
-func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) partialError {
+func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffer.Buffer, tr *smtpconn.Transcript) partialError {
 	dl := target.DeliveryLogger(q.Log, meta.MsgMeta)
 	perr := partialError{
 		Errs:       map[string]error{},
@@ -467,10 +524,16 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	}
 
 	msgMeta := meta.MsgMeta.DeepCopy()
+	msgMeta.TraceID = meta.MsgMeta.Trace()
 	msgMeta.ID = msgMeta.ID + "-" + strconv.FormatInt(time.Now().Unix(), 16)
 	dl.Debugf("using message ID = %s", msgMeta.ID)
 
-	msgCtx, msgTask := trace.NewTask(context.Background(), "Queue delivery")
+	ctx := context.Background()
+	if tr != nil {
+		ctx = smtpconn.WithTranscript(ctx, tr)
+	}
+
+	msgCtx, msgTask := trace.NewTask(ctx, "Queue delivery")
 	defer msgTask.End()
 
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
@@ -714,6 +777,42 @@ func (q *Queue) readDiskQueue() error {
 	return nil
 }
 
+// Entry describes a message stored in the queue.
+type Entry struct {
+	ID   string
+	Meta *QueueMetadata
+}
+
+// Entries returns the list of messages currently stored in the queue sorted
+// by the first delivery attempt time.
+//
+// Messages with unreadable meta-data are skipped.
+func (q *Queue) Entries() ([]Entry, error) {
+	dirInfo, err := ioutil.ReadDir(q.location)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(dirInfo))
+	for _, entry := range dirInfo {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".meta") {
+			continue
+		}
+		id := entry.Name()[:len(entry.Name())-5]
+
+		meta, err := q.readMessageMeta(id)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, Entry{ID: id, Meta: meta})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Meta.FirstAttempt.Before(entries[j].Meta.FirstAttempt)
+	})
+	return entries, nil
+}
+
 func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
 	id := meta.MsgMeta.ID
 
@@ -885,6 +984,11 @@ func (q *Queue) Name() string {
 	return "queue"
 }
 
+// Len returns the amount of messages scheduled for delivery attempts.
+func (q *Queue) Len() int {
+	return q.wheel.Len()
+}
+
 func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpts []string) {
 	// If, apparently, we have no DSN msgpipeline configured - do nothing.
 	if q.dsnPipeline == nil {
@@ -947,7 +1051,8 @@ func (q *Queue) emitDSN(meta *QueueMetadata, header textproto.Header, failedRcpt
 	dsnBody := buffer.MemoryBuffer{Slice: dsnBodyBlob.Bytes()}
 
 	dsnMeta := &module.MsgMetadata{
-		ID: dsnID,
+		ID:      dsnID,
+		TraceID: meta.MsgMeta.Trace(),
 		SMTPOpts: smtp.MailOptions{
 			UTF8:       meta.MsgMeta.SMTPOpts.UTF8,
 			RequireTLS: meta.MsgMeta.SMTPOpts.RequireTLS,
@@ -247,13 +247,16 @@ func TestQueueDelivery(t *testing.T) {
 	q := newTestQueue(t, &dt)
 	defer cleanQueue(t, q)
 
-	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
 
 	// Wait for the delivery to complete and stop processing.
 	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
 	q.Close()
 
 	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"}, "")
+	if msg.MsgMeta.TraceID != id {
+		t.Errorf("wrong TraceID for the delivery attempt: %q, want %q", msg.MsgMeta.TraceID, id)
+	}
 
 	// There should be no queued messages.
 	checkQueueDir(t, q, []string{})
@@ -655,7 +658,7 @@ func TestQueueDSN(t *testing.T) {
 	q.dsnPipeline = &dsnTarget
 	defer cleanQueue(t, q)
 
-	testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
 
 	// Wait for message delivery attempt to complete (aborted because all recipients fail).
 	readMsgChanTimeout(t, dt.aborted, 5*time.Second)
@@ -663,6 +666,10 @@ func TestQueueDSN(t *testing.T) {
 	// Wait for DSN.
 	msg := readMsgChanTimeout(t, dsnTarget.committed, 5*time.Second)
 
+	if msg.MsgMeta.TraceID != id {
+		t.Errorf("wrong TraceID in DSN: %q, want %q", msg.MsgMeta.TraceID, id)
+	}
+
 	if msg.MailFrom != "" {
 		t.Fatalf("wrong MAIL FROM address in DSN: %v", msg.MailFrom)
 	}
@@ -0,0 +1,234 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/address"
+)
+
+// quietHours is the schedule during which non-urgent deliveries are held.
+//
+// It is specified in the quiet_hours table using the following format:
+//
+//	HH:MM-HH:MM [tz=ZONE] [batch=DURATION]
+//
+// If batch is set, messages held during quiet hours are released every
+// DURATION (counting from the start of the quiet hours) instead of the end
+// of quiet hours.
+type quietHours struct {
+	// Minutes since midnight.
+	start, end int
+	loc        *time.Location
+	batch      time.Duration
+}
+
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("malformed time: %s", s)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, fmt.Errorf("malformed time: %s", s)
+	}
+	min, err := strconv.Atoi(parts[1])
+	if err != nil || min < 0 || min > 59 {
+		return 0, fmt.Errorf("malformed time: %s", s)
+	}
+	return hour*60 + min, nil
+}
+
+func parseQuietHours(s string) (quietHours, error) {
+	qh := quietHours{loc: time.Local}
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return qh, fmt.Errorf("empty quiet hours value")
+	}
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return qh, fmt.Errorf("malformed time range: %s", fields[0])
+	}
+	var err error
+	qh.start, err = parseClock(times[0])
+	if err != nil {
+		return qh, err
+	}
+	qh.end, err = parseClock(times[1])
+	if err != nil {
+		return qh, err
+	}
+	if qh.start == qh.end {
+		return qh, fmt.Errorf("empty time range: %s", fields[0])
+	}
+
+	for _, opt := range fields[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return qh, fmt.Errorf("malformed option: %s", opt)
+		}
+		switch kv[0] {
+		case "tz":
+			qh.loc, err = time.LoadLocation(kv[1])
+			if err != nil {
+				return qh, err
+			}
+		case "batch":
+			qh.batch, err = time.ParseDuration(kv[1])
+			if err != nil {
+				return qh, err
+			}
+			if qh.batch <= 0 {
+				return qh, fmt.Errorf("batch interval should be positive")
+			}
+		default:
+			return qh, fmt.Errorf("unknown option: %s", kv[0])
+		}
+	}
+
+	return qh, nil
+}
+
+// window returns the bounds of quiet hours period t falls into. ok is false
+// if t is outside of quiet hours.
+func (qh quietHours) window(t time.Time) (start, end time.Time, ok bool) {
+	t = t.In(qh.loc)
+	y, m, d := t.Date()
+	// The period may start on the previous day if it crosses midnight.
+	for _, dayOffset := range []int{0, -1} {
+		start = time.Date(y, m, d+dayOffset, qh.start/60, qh.start%60, 0, 0, qh.loc)
+		endDay := d + dayOffset
+		if qh.end < qh.start {
+			endDay++
+		}
+		end = time.Date(y, m, endDay, qh.end/60, qh.end%60, 0, 0, qh.loc)
+
+		if !t.Before(start) && t.Before(end) {
+			return start, end, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// releaseTime returns the time when the message received at arrival should be
+// delivered. Delivery should not be held if the returned time is not after
+// now.
+func (qh quietHours) releaseTime(arrival, now time.Time) time.Time {
+	start, end, ok := qh.window(now)
+	if !ok {
+		return now
+	}
+	if qh.batch == 0 {
+		return end
+	}
+
+	// Messages queued before quiet hours (e.g. retried after a temporary
+	// failure) go into the first batch.
+	if arrival.Before(start) {
+		arrival = start
+	}
+	batches := arrival.Sub(start)/qh.batch + 1
+	release := start.Add(batches * qh.batch)
+	if release.After(end) {
+		return end
+	}
+	return release
+}
+
+// isUrgent checks whether the message is marked as urgent and so should not
+// be held during quiet hours.
+func isUrgent(header textproto.Header) bool {
+	if strings.EqualFold(strings.TrimSpace(header.Get("Priority")), "urgent") {
+		return true
+	}
+	if strings.EqualFold(strings.TrimSpace(header.Get("Importance")), "high") {
+		return true
+	}
+	// "1 (Highest)", "2 (High)"
+	xPriority := strings.TrimSpace(header.Get("X-Priority"))
+	return strings.HasPrefix(xPriority, "1") || strings.HasPrefix(xPriority, "2")
+}
+
+// quietHoursFor looks up quiet hours schedule for the recipient using the
+// full address and then the domain as a key.
+func (q *Queue) quietHoursFor(rcpt string) (quietHours, bool, error) {
+	key, err := address.ForLookup(rcpt)
+	if err != nil {
+		key = rcpt
+	}
+	keys := []string{key}
+	if _, domain, err := address.Split(key); err == nil && domain != "" {
+		keys = append(keys, domain)
+	}
+
+	for _, key := range keys {
+		val, ok, err := q.quietHours.Lookup(context.TODO(), key)
+		if err != nil {
+			return quietHours{}, false, err
+		}
+		if !ok {
+			continue
+		}
+		qh, err := parseQuietHours(val)
+		if err != nil {
+			return quietHours{}, false, fmt.Errorf("quiet_hours: %s: %w", key, err)
+		}
+		return qh, true, nil
+	}
+	return quietHours{}, false, nil
+}
+
+// holdQuietRcpts splits the list of recipients into ones that should be
+// attempted now and ones that are held because of quiet hours.
+//
+// The earliest release time of held recipients is returned.
+func (q *Queue) holdQuietRcpts(meta *QueueMetadata, header textproto.Header, now time.Time) (attempt, held []string, release time.Time) {
+	if q.quietHours == nil || isUrgent(header) {
+		return meta.To, nil, time.Time{}
+	}
+
+	for _, rcpt := range meta.To {
+		qh, ok, err := q.quietHoursFor(rcpt)
+		if err != nil {
+			q.Log.Error("quiet hours lookup failed", err, "rcpt", rcpt, "msg_id", meta.MsgMeta.ID)
+		}
+		if !ok {
+			attempt = append(attempt, rcpt)
+			continue
+		}
+
+		rcptRelease := qh.releaseTime(meta.FirstAttempt, now)
+		if !rcptRelease.After(now) {
+			attempt = append(attempt, rcpt)
+			continue
+		}
+		held = append(held, rcpt)
+		if release.IsZero() || rcptRelease.Before(release) {
+			release = rcptRelease
+		}
+	}
+	return attempt, held, release
+}
@@ -0,0 +1,169 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/testutils"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	for _, s := range []string{
+		"22:00-07:00",
+		"01:30-02:00 tz=UTC",
+		"22:00-07:00 batch=1h tz=Europe/Berlin",
+	} {
+		if _, err := parseQuietHours(s); err != nil {
+			t.Errorf("parseQuietHours(%q): unexpected error: %v", s, err)
+		}
+	}
+	for _, s := range []string{
+		"",
+		"22:00",
+		"22:00-07:00-08:00",
+		"24:00-07:00",
+		"22:60-07:00",
+		"22-07",
+		"07:00-07:00",
+		"22:00-07:00 batch=0s",
+		"22:00-07:00 tz=Nowhere/Nothing",
+		"22:00-07:00 urgent",
+		"22:00-07:00 color=red",
+	} {
+		if _, err := parseQuietHours(s); err == nil {
+			t.Errorf("parseQuietHours(%q): no error", s)
+		}
+	}
+}
+
+func TestQuietHours_ReleaseTime(t *testing.T) {
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2020, 1, day, hour, min, 0, 0, time.UTC)
+	}
+
+	test := func(schedule string, arrival, now, expected time.Time) {
+		t.Helper()
+		qh, err := parseQuietHours(schedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := qh.releaseTime(arrival, now); !got.Equal(expected) {
+			t.Errorf("%s: releaseTime(%v, %v) = %v, want %v", schedule, arrival, now, got, expected)
+		}
+	}
+
+	// Crossing midnight.
+	test("22:00-07:00 tz=UTC", at(1, 23, 0), at(1, 23, 0), at(2, 7, 0))
+	test("22:00-07:00 tz=UTC", at(2, 3, 0), at(2, 3, 0), at(2, 7, 0))
+	test("22:00-07:00 tz=UTC", at(1, 21, 59), at(1, 21, 59), at(1, 21, 59))
+	test("22:00-07:00 tz=UTC", at(2, 7, 0), at(2, 7, 0), at(2, 7, 0))
+	test("22:00-07:00 tz=UTC", at(2, 12, 0), at(2, 12, 0), at(2, 12, 0))
+
+	// Same day.
+	test("01:00-05:00 tz=UTC", at(1, 1, 0), at(1, 1, 0), at(1, 5, 0))
+	test("01:00-05:00 tz=UTC", at(1, 0, 59), at(1, 0, 59), at(1, 0, 59))
+	test("01:00-05:00 tz=UTC", at(1, 23, 0), at(1, 23, 0), at(1, 23, 0))
+
+	// Time zones.
+	test("22:00-07:00 tz=Europe/Moscow", at(1, 20, 0), at(1, 20, 0), at(2, 4, 0))
+
+	// Batches.
+	test("22:00-07:00 batch=2h tz=UTC", at(1, 22, 30), at(1, 22, 30), at(2, 0, 0))
+	test("22:00-07:00 batch=2h tz=UTC", at(1, 22, 30), at(2, 0, 0), at(2, 0, 0))
+	test("22:00-07:00 batch=2h tz=UTC", at(2, 0, 0), at(2, 0, 0), at(2, 2, 0))
+	test("22:00-07:00 batch=2h tz=UTC", at(2, 6, 30), at(2, 6, 30), at(2, 7, 0))
+	// Retried messages that arrived before quiet hours are released with
+	// the first batch.
+	test("22:00-07:00 batch=2h tz=UTC", at(1, 12, 0), at(2, 1, 0), at(2, 0, 0))
+}
+
+func TestIsUrgent(t *testing.T) {
+	for _, c := range []struct {
+		field, value string
+		urgent       bool
+	}{
+		{"Subject", "urgent", false},
+		{"Priority", "urgent", true},
+		{"Priority", "normal", false},
+		{"Importance", "High", true},
+		{"Importance", "low", false},
+		{"X-Priority", "1 (Highest)", true},
+		{"X-Priority", "2", true},
+		{"X-Priority", "3 (Normal)", false},
+	} {
+		hdr := textproto.Header{}
+		hdr.Add(c.field, c.value)
+		if got := isUrgent(hdr); got != c.urgent {
+			t.Errorf("isUrgent(%s: %s) = %v, want %v", c.field, c.value, got, c.urgent)
+		}
+	}
+}
+
+func TestQueueDelivery_QuietHours(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+	schedule := now.Add(-time.Hour).Format("15:04") + "-" + now.Add(time.Hour).Format("15:04") + " tz=UTC"
+
+	dt := unreliableTarget{committed: make(chan testutils.Msg, 10)}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.quietHours = testutils.Table{
+		M: map[string]string{
+			"tester1@example.org": schedule,
+			"example.com":         schedule,
+		},
+	}
+
+	id := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org", "tester3@example.com"})
+
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	q.Close()
+
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester2@example.org"}, "")
+
+	// Held recipients are kept in the queue and are not counted as attempts.
+	checkQueueDir(t, q, []string{id})
+	meta, err := q.readMessageMeta(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(meta.To, []string{"tester1@example.org", "tester3@example.com"}) {
+		t.Error("Wrong recipients left in queue:", meta.To)
+	}
+	if len(meta.TriesCount) != 0 {
+		t.Error("Held recipients counted as attempts:", meta.TriesCount)
+	}
+
+	urgent := textproto.Header{}
+	urgent.Add("Priority", "urgent")
+	rcpts, held, _ := q.holdQuietRcpts(&QueueMetadata{
+		MsgMeta:      &module.MsgMetadata{ID: "urgent"},
+		To:           []string{"tester1@example.org", "tester2@example.org"},
+		FirstAttempt: now,
+	}, urgent, now)
+	if len(rcpts) != 2 || len(held) != 0 {
+		t.Error("Urgent message held:", held)
+	}
+}
@@ -70,6 +70,13 @@ func (tw *TimeWheel) Add(target time.Time, value interface{}) {
 	tw.updateNotify <- target
 }
 
+// Len returns the amount of scheduled slots.
+func (tw *TimeWheel) Len() int {
+	tw.slotsLock.Lock()
+	defer tw.slotsLock.Unlock()
+	return tw.slots.Len()
+}
+
 func (tw *TimeWheel) Close() {
 	atomic.StoreUint32(&tw.stopped, 1)
 
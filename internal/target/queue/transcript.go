@@ -0,0 +1,119 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+	"github.com/foxcpp/maddy/internal/target"
+)
+
+// transcriptDir is the subdirectory of the queue location used to store
+// transcripts of failed delivery attempts.
+//
+// Transcripts are kept after the message is removed from the queue (e.g.
+// after a permanent failure) until they are older than transcriptRetention.
+const transcriptDir = "transcripts"
+
+// saveTranscript appends the transcript of the failed delivery attempt to
+// the transcript file of the message.
+func (q *Queue) saveTranscript(msgMeta *module.MsgMetadata, started time.Time, tr *smtpconn.Transcript, errs map[string]error) {
+	dl := target.DeliveryLogger(q.Log, msgMeta)
+
+	dir := filepath.Join(q.location, transcriptDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		dl.Error("failed to create transcripts directory", err)
+		return
+	}
+	q.cleanupTranscripts()
+
+	rcpts := make([]string, 0, len(errs))
+	for rcpt := range errs {
+		rcpts = append(rcpts, rcpt)
+	}
+	sort.Strings(rcpts)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "=== delivery attempt at %s\n", started.UTC().Format(time.RFC3339))
+	sb.WriteString(tr.String())
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(&sb, "* failed %s: %v\n", rcpt, errs[rcpt])
+	}
+	sb.WriteString("\n")
+
+	f, err := os.OpenFile(filepath.Join(dir, msgMeta.ID), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		dl.Error("failed to save delivery transcript", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(sb.String()); err != nil {
+		dl.Error("failed to save delivery transcript", err)
+	}
+}
+
+// cleanupTranscripts removes transcripts that were not updated for longer
+// than transcriptRetention.
+func (q *Queue) cleanupTranscripts() {
+	dir := filepath.Join(q.location, transcriptDir)
+	dirInfo, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			q.Log.Error("failed to read transcripts directory", err)
+		}
+		return
+	}
+
+	for _, entry := range dirInfo {
+		if entry.IsDir() || time.Since(entry.ModTime()) < q.transcriptRetention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			q.Log.Error("failed to remove old transcript", err, "msg_id", entry.Name())
+		}
+	}
+}
+
+// Transcript returns recorded transcripts of failed delivery attempts for
+// the message.
+//
+// Transcripts are recorded only if record_transcripts is enabled.
+func (q *Queue) Transcript(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || strings.HasPrefix(id, ".") {
+		return "", fmt.Errorf("queue: malformed message ID: %s", id)
+	}
+
+	blob, err := ioutil.ReadFile(filepath.Join(q.location, transcriptDir, id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("queue: no transcripts recorded for message %s", id)
+		}
+		return "", err
+	}
+	return string(blob), nil
+}
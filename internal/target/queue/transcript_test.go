@@ -0,0 +1,76 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+)
+
+func TestQueueTranscript(t *testing.T) {
+	dt := unreliableTarget{}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+	q.transcriptRetention = time.Hour
+
+	msgMeta := &module.MsgMetadata{ID: "msg1"}
+	q.saveTranscript(msgMeta, time.Now(), &smtpconn.Transcript{}, map[string]error{
+		"tester2@example.org": errors.New("second"),
+		"tester1@example.org": errors.New("first"),
+	})
+	q.saveTranscript(msgMeta, time.Now(), &smtpconn.Transcript{}, map[string]error{
+		"tester1@example.org": errors.New("third"),
+	})
+
+	transcript, err := q.Transcript("msg1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(transcript, "=== delivery attempt at ") != 2 {
+		t.Error("Expected two attempts in transcript:\n", transcript)
+	}
+	first := strings.Index(transcript, "* failed tester1@example.org: first")
+	second := strings.Index(transcript, "* failed tester2@example.org: second")
+	third := strings.Index(transcript, "* failed tester1@example.org: third")
+	if first == -1 || second < first || third < second {
+		t.Error("Wrong errors order in transcript:\n", transcript)
+	}
+
+	for _, id := range []string{"msg2", "", "../msg1", ".."} {
+		if _, err := q.Transcript(id); err == nil {
+			t.Errorf("No error for %q", id)
+		}
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(q.location, transcriptDir, "msg1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	q.cleanupTranscripts()
+	if _, err := q.Transcript("msg1"); err == nil {
+		t.Error("Old transcript is not removed")
+	}
+}
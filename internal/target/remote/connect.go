@@ -213,6 +213,7 @@ func (rd *remoteDelivery) connectionForDomain(ctx context.Context, domain string
 	if pooledConn != nil && !rd.msgMeta.SMTPOpts.RequireTLS {
 		conn = pooledConn.(*mxConn)
 		rd.Log.Msg("reusing cached connection", "domain", domain, "transactions_counter", conn.transactions)
+		conn.SetTranscript(smtpconn.TranscriptFromContext(ctx))
 	} else {
 		rd.Log.DebugMsg("opening new connection", "domain", domain, "cache_ignored", pooledConn != nil)
 		conn, err = rd.newConn(ctx, domain)
@@ -285,6 +286,8 @@ func (rd *remoteDelivery) newConn(ctx context.Context, domain string) (*mxConn,
 	conn.Log = rd.Log
 	conn.Hostname = rd.rt.hostname
 	conn.AddrInSMTPMsg = true
+	conn.DomainForm = rd.rt.domainForm
+	conn.SetTranscript(smtpconn.TranscriptFromContext(ctx))
 	if rd.rt.connectTimeout != 0 {
 		conn.ConnectTimeout = rd.rt.connectTimeout
 	}
@@ -72,6 +72,7 @@ type Target struct {
 	limits            *limits.Group
 	allowSecOverride  bool
 	relaxedREQUIRETLS bool
+	domainForm        address.DomainForm
 
 	pool           *pool.P
 	connReuseLimit int
@@ -99,7 +100,10 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 }
 
 func (rt *Target) Init(cfg *config.Map) error {
-	var err error
+	var (
+		err        error
+		domainForm string
+	)
 	rt.extResolver, err = dns.NewExtResolver()
 	if err != nil {
 		rt.Log.Error("cannot initialize DNSSEC-aware resolver, DNSSEC and DANE are not available", err)
@@ -134,6 +138,7 @@ func (rt *Target) Init(cfg *config.Map) error {
 	}, &rt.limits)
 	cfg.Bool("requiretls_override", false, true, &rt.allowSecOverride)
 	cfg.Bool("relaxed_requiretls", false, true, &rt.relaxedREQUIRETLS)
+	cfg.Enum("domain_form", false, false, []string{"unicode", "ascii"}, "unicode", &domainForm)
 	cfg.Int("conn_reuse_limit", false, false, 10, &rt.connReuseLimit)
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &rt.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &rt.commandTimeout)
@@ -151,6 +156,10 @@ func (rt *Target) Init(cfg *config.Map) error {
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
+	rt.domainForm, err = address.ParseDomainForm(domainForm)
+	if err != nil {
+		return err
+	}
 	rt.pool = pool.New(poolCfg)
 
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
@@ -440,6 +449,7 @@ func (rd *remoteDelivery) Close() error {
 			conn.Close()
 		} else {
 			rd.Log.Debugf("returning connection for %s to pool", conn.ServerName())
+			conn.SetTranscript(nil)
 			rd.rt.pool.Return(conn.domain, conn)
 		}
 	}
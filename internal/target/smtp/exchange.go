@@ -0,0 +1,86 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// target.exchange_online is target.smtp with defaults suitable for relaying
+// to Exchange Online using an inbound connector.
+//
+// Exchange Online connectors authenticate the sending server using the
+// client TLS certificate (the certificate name should match the connector
+// TlsSenderCertificateName) or the source IP. In both cases TLS 1.2 or
+// newer is required.
+const exchangeOnlineModName = "target.exchange_online"
+
+const exchangeOnlineMXSuffix = ".mail.protection.outlook.com"
+
+// Header fields Exchange Online uses to carry internal organization state.
+// Messages relayed over a connector that is trusted as a part of the
+// organization may have them honored, so fields set by the original sender
+// are removed.
+var exchangeOnlineInternalHeaders = []string{
+	"x-ms-exchange-organization-",
+	"x-ms-exchange-crosstenant-",
+	"x-ms-exchange-transport-",
+}
+
+// exchangeOnlineTarget returns the endpoint address for the tenant.
+//
+// The tenant is specified either as the MX host prefix (contoso-com) or
+// as the accepted domain (contoso.com).
+func exchangeOnlineTarget(tenant string) string {
+	host := strings.ReplaceAll(strings.ToLower(tenant), ".", "-") + exchangeOnlineMXSuffix
+	return "tcp://" + host + ":25"
+}
+
+func (u *Downstream) configureExchangeOnline(tenant string) {
+	if tenant != "" {
+		u.targetsArg = append(u.targetsArg, exchangeOnlineTarget(tenant))
+	}
+	if u.tlsConfig.MinVersion < tls.VersionTLS12 {
+		u.tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	if len(u.tlsConfig.Certificates) == 0 && u.tlsConfig.GetClientCertificate == nil {
+		u.log.Println("no client certificate configured, the Exchange Online connector should use IP-based authentication")
+	}
+	u.stripHeaders = exchangeOnlineInternalHeaders
+}
+
+// stripHeaderPrefixes returns the copy of the header without fields that
+// have any of the specified prefixes (lowercase) in the name.
+func stripHeaderPrefixes(header textproto.Header, prefixes []string) textproto.Header {
+	header = header.Copy()
+	fields := header.Fields()
+	for fields.Next() {
+		key := strings.ToLower(fields.Key())
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				fields.Del()
+				break
+			}
+		}
+	}
+	return header
+}
@@ -0,0 +1,78 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/foxcpp/maddy/framework/config"
+)
+
+func TestExchangeOnline_Init(t *testing.T) {
+	mod, err := NewDownstream(exchangeOnlineModName, "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{
+				Name: "hostname",
+				Args: []string{"mx.example.org"},
+			},
+			{
+				Name: "tenant",
+				Args: []string{"Example.org"},
+			},
+		},
+	})); err != nil {
+		t.Fatal(err)
+	}
+
+	tgt := mod.(*Downstream)
+	if len(tgt.endpoints) != 1 || tgt.endpoints[0].Host != "example-org.mail.protection.outlook.com" || tgt.endpoints[0].Port != "25" {
+		t.Fatal("wrong endpoints:", tgt.endpoints)
+	}
+	if !tgt.requireTLS {
+		t.Error("TLS is not required")
+	}
+	if tgt.tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Error("wrong minimal TLS version:", tgt.tlsConfig.MinVersion)
+	}
+}
+
+func TestStripHeaderPrefixes(t *testing.T) {
+	hdr := textproto.Header{}
+	hdr.Add("From", "test@example.org")
+	hdr.Add("X-MS-Exchange-Organization-SCL", "-1")
+	hdr.Add("X-MS-Exchange-CrossTenant-Id", "00000000-0000-0000-0000-000000000000")
+	hdr.Add("X-MS-Has-Attach", "yes")
+
+	stripped := stripHeaderPrefixes(hdr, exchangeOnlineInternalHeaders)
+	if stripped.Has("X-MS-Exchange-Organization-SCL") || stripped.Has("X-MS-Exchange-CrossTenant-Id") {
+		t.Error("internal fields are not removed")
+	}
+	if !stripped.Has("From") || !stripped.Has("X-MS-Has-Attach") {
+		t.Error("unrelated fields are removed")
+	}
+	if !hdr.Has("X-MS-Exchange-Organization-SCL") {
+		t.Error("original header is modified")
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package smtp_downstream
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/internal/smtpconn"
+)
+
+const (
+	balanceOrdered  = "ordered"
+	balanceWeighted = "weighted"
+)
+
+// upstream is the single downstream server with its health state.
+type upstream struct {
+	endp   config.Endpoint
+	weight int
+	backup bool
+
+	lock      sync.Mutex
+	down      bool
+	lastError error
+}
+
+func (up *upstream) String() string {
+	return net.JoinHostPort(up.endp.Host, up.endp.Port)
+}
+
+func (up *upstream) isDown() bool {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	return up.down
+}
+
+// setDown updates the health state and returns true if it was changed.
+func (up *upstream) setDown(down bool, err error) bool {
+	up.lock.Lock()
+	defer up.lock.Unlock()
+	changed := up.down != down
+	up.down = down
+	up.lastError = err
+	return changed
+}
+
+func parseWeights(weights []string, count int) ([]int, error) {
+	if len(weights) != 0 && len(weights) != count {
+		return nil, fmt.Errorf("weights: expected %d values, got %d", count, len(weights))
+	}
+	res := make([]int, count)
+	for i := range res {
+		res[i] = 1
+		if len(weights) == 0 {
+			continue
+		}
+		w, err := strconv.Atoi(weights[i])
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("weights: invalid value: %s", weights[i])
+		}
+		res[i] = w
+	}
+	return res, nil
+}
+
+// weightedOrder returns upstreams in the random order where upstreams with
+// bigger weights are more likely to be placed first.
+func weightedOrder(ups []*upstream) []*upstream {
+	left := append([]*upstream(nil), ups...)
+	res := make([]*upstream, 0, len(ups))
+	for len(left) != 0 {
+		total := 0
+		for _, up := range left {
+			total += up.weight
+		}
+		pick := rand.Intn(total)
+		for i, up := range left {
+			pick -= up.weight
+			if pick < 0 {
+				res = append(res, up)
+				left = append(left[:i], left[i+1:]...)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// connectOrder returns the list of upstreams in the order connection
+// attempts should be made.
+//
+// Healthy primary servers are tried first, then healthy backup servers. If
+// health checks are enabled, servers that are down are tried last in case
+// the health state is stale.
+func (u *Downstream) connectOrder() []*upstream {
+	var primary, backup, down []*upstream
+	for _, up := range u.upstreams {
+		switch {
+		case up.isDown():
+			down = append(down, up)
+		case up.backup:
+			backup = append(backup, up)
+		default:
+			primary = append(primary, up)
+		}
+	}
+
+	if u.balance == balanceWeighted {
+		primary = weightedOrder(primary)
+		backup = weightedOrder(backup)
+	}
+
+	res := make([]*upstream, 0, len(u.upstreams))
+	res = append(res, primary...)
+	res = append(res, backup...)
+	return append(res, down...)
+}
+
+// markFailed marks the upstream as down after a failed connection attempt.
+// It will be returned into rotation by the health check.
+func (u *Downstream) markFailed(up *upstream, err error) {
+	if u.healthInterval == 0 {
+		return
+	}
+	if up.setDown(true, err) {
+		u.log.Msg("downstream server is down", "downstream_server", up.String(), "reason", err)
+	}
+}
+
+func (u *Downstream) probe(up *upstream) error {
+	ctx, cancel := context.WithTimeout(context.Background(), u.healthTimeout)
+	defer cancel()
+
+	conn := smtpconn.New()
+	conn.Log = u.log
+	conn.Hostname = u.hostname
+	conn.AddrInSMTPMsg = false
+	conn.ConnectTimeout = u.healthTimeout
+	conn.CommandTimeout = u.healthTimeout
+
+	var (
+		didTLS bool
+		err    error
+	)
+	if u.lmtp {
+		didTLS, err = conn.ConnectLMTP(ctx, up.endp, u.attemptStartTLS, &u.tlsConfig)
+	} else {
+		didTLS, err = conn.Connect(ctx, up.endp, u.attemptStartTLS, &u.tlsConfig)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if !didTLS && u.requireTLS {
+		return fmt.Errorf("TLS is required, but unsupported by downstream")
+	}
+	return conn.Noop()
+}
+
+func (u *Downstream) checkHealth() {
+	var wg sync.WaitGroup
+	for _, up := range u.upstreams {
+		up := up
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := u.probe(up)
+			if !up.setDown(err != nil, err) {
+				return
+			}
+			if err != nil {
+				u.log.Msg("downstream server is down", "downstream_server", up.String(), "reason", err)
+			} else {
+				u.log.Msg("downstream server is up", "downstream_server", up.String())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (u *Downstream) healthLoop() {
+	t := time.NewTicker(u.healthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			u.checkHealth()
+		case <-u.stopHealth:
+			return
+		}
+	}
+}
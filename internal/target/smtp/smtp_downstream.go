@@ -31,12 +31,13 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"net"
 	"runtime/trace"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
+	"github.com/foxcpp/maddy/framework/address"
 	"github.com/foxcpp/maddy/framework/buffer"
 	"github.com/foxcpp/maddy/framework/config"
 	tls2 "github.com/foxcpp/maddy/framework/config/tls"
@@ -58,13 +59,26 @@ type Downstream struct {
 	attemptStartTLS bool
 	hostname        string
 	endpoints       []config.Endpoint
+	backupEndpoints []config.Endpoint
+	weights         []int
 	saslFactory     saslClientFactory
 	tlsConfig       tls.Config
+	domainForm      address.DomainForm
 
 	connectTimeout    time.Duration
 	commandTimeout    time.Duration
 	submissionTimeout time.Duration
 
+	// Header field name prefixes to remove from messages, set by presets.
+	stripHeaders []string
+
+	balance        string
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	upstreams      []*upstream
+	upstreamsOnce  sync.Once
+	stopHealth     chan struct{}
+
 	log log.Logger
 }
 
@@ -84,33 +98,59 @@ func NewDownstream(modName, instName string, _, inlineArgs []string) (module.Mod
 		instName:   instName,
 		lmtp:       modName == "target.lmtp" || modName == "lmtp_downstream", /* compatibility with 0.3 configs */
 		targetsArg: inlineArgs,
+		stopHealth: make(chan struct{}),
 		log:        log.Logger{Name: modName},
 	}, nil
 }
 
 func (u *Downstream) Init(cfg *config.Map) error {
-	var targetsArg []string
+	var (
+		targetsArg []string
+		backupArg  []string
+		weightsArg []string
+		tenant     string
+		domainForm string
+	)
+	exchangeOnline := u.modName == exchangeOnlineModName
 	cfg.Bool("debug", true, false, &u.log.Debug)
-	cfg.Bool("require_tls", false, false, &u.requireTLS)
+	cfg.Bool("require_tls", false, exchangeOnline, &u.requireTLS)
 	cfg.Bool("attempt_starttls", false, !u.lmtp, &u.attemptStartTLS)
 	cfg.String("hostname", true, true, "", &u.hostname)
 	cfg.StringList("targets", false, false, nil, &targetsArg)
+	cfg.StringList("backup_targets", false, false, nil, &backupArg)
+	cfg.Enum("balance", false, false, []string{balanceOrdered, balanceWeighted}, balanceOrdered, &u.balance)
+	cfg.StringList("weights", false, false, nil, &weightsArg)
+	cfg.Duration("health_check_interval", false, false, 0, &u.healthInterval)
+	cfg.Duration("health_check_timeout", false, false, 30*time.Second, &u.healthTimeout)
 	cfg.Custom("auth", false, false, func() (interface{}, error) {
 		return nil, nil
 	}, saslAuthDirective, &u.saslFactory)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return tls.Config{}, nil
 	}, tls2.TLSClientBlock, &u.tlsConfig)
+	cfg.Enum("domain_form", false, false, []string{"unicode", "ascii"}, "unicode", &domainForm)
 	cfg.Duration("connect_timeout", false, false, 5*time.Minute, &u.connectTimeout)
 	cfg.Duration("command_timeout", false, false, 5*time.Minute, &u.commandTimeout)
 	cfg.Duration("submission_timeout", false, false, 5*time.Minute, &u.submissionTimeout)
+	if exchangeOnline {
+		cfg.String("tenant", false, false, "", &tenant)
+	}
 
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
+	if exchangeOnline {
+		u.configureExchangeOnline(tenant)
+	}
+
 	var err error
+	u.domainForm, err = address.ParseDomainForm(domainForm)
+	if err != nil {
+		return err
+	}
+
+	// INTERNATIONALIZATION: See RFC 6531 Section 3.7.1.
 	u.hostname, err = idna.ToASCII(u.hostname)
 	if err != nil {
 		return fmt.Errorf("%s: cannot represent the hostname as an A-label name: %w", u.modName, err)
@@ -130,6 +170,46 @@ func (u *Downstream) Init(cfg *config.Map) error {
 		return fmt.Errorf("%s: at least one target endpoint is required", u.modName)
 	}
 
+	for _, tgt := range backupArg {
+		endp, err := config.ParseEndpoint(tgt)
+		if err != nil {
+			return err
+		}
+		u.backupEndpoints = append(u.backupEndpoints, endp)
+	}
+
+	// Weights are specified for primary targets followed by backup ones.
+	u.weights, err = parseWeights(weightsArg, len(u.endpoints)+len(u.backupEndpoints))
+	if err != nil {
+		return fmt.Errorf("%s: %w", u.modName, err)
+	}
+	u.upstreamsOnce.Do(u.initUpstreams)
+
+	if u.healthInterval != 0 {
+		go u.healthLoop()
+	}
+
+	return nil
+}
+
+func (u *Downstream) initUpstreams() {
+	for i, endp := range append(append([]config.Endpoint(nil), u.endpoints...), u.backupEndpoints...) {
+		weight := 1
+		if i < len(u.weights) {
+			weight = u.weights[i]
+		}
+		u.upstreams = append(u.upstreams, &upstream{
+			endp:   endp,
+			weight: weight,
+			backup: i >= len(u.endpoints),
+		})
+	}
+}
+
+func (u *Downstream) Close() error {
+	if u.healthInterval != 0 {
+		close(u.stopHealth)
+	}
 	return nil
 }
 
@@ -190,6 +270,8 @@ func (d *delivery) connect(ctx context.Context) error {
 	conn.Log = d.log
 	conn.Hostname = d.u.hostname
 	conn.AddrInSMTPMsg = false
+	conn.DomainForm = d.u.domainForm
+	conn.SetTranscript(smtpconn.TranscriptFromContext(ctx))
 	if d.u.connectTimeout != 0 {
 		conn.ConnectTimeout = d.u.connectTimeout
 	}
@@ -200,20 +282,22 @@ func (d *delivery) connect(ctx context.Context) error {
 		conn.SubmissionTimeout = d.u.submissionTimeout
 	}
 
-	for _, endp := range d.u.endpoints {
+	d.u.upstreamsOnce.Do(d.u.initUpstreams)
+	for _, up := range d.u.connectOrder() {
 		var (
 			didTLS bool
 			err    error
 		)
 		if d.u.lmtp {
-			didTLS, err = conn.ConnectLMTP(ctx, endp, d.u.attemptStartTLS, &d.u.tlsConfig)
+			didTLS, err = conn.ConnectLMTP(ctx, up.endp, d.u.attemptStartTLS, &d.u.tlsConfig)
 		} else {
-			didTLS, err = conn.Connect(ctx, endp, d.u.attemptStartTLS, &d.u.tlsConfig)
+			didTLS, err = conn.Connect(ctx, up.endp, d.u.attemptStartTLS, &d.u.tlsConfig)
 		}
 		if err != nil {
-			if len(d.u.endpoints) != 1 {
-				d.log.Msg("connect error", err, "downstream_server", net.JoinHostPort(endp.Host, endp.Port))
+			if len(d.u.upstreams) != 1 {
+				d.log.Msg("connect error", err, "downstream_server", up.String())
 			}
+			d.u.markFailed(up, err)
 			lastErr = err
 			continue
 		}
@@ -223,6 +307,7 @@ func (d *delivery) connect(ctx context.Context) error {
 		if !didTLS && d.u.requireTLS {
 			conn.Close()
 			lastErr = errors.New("TLS is required, but unsupported by downstream")
+			d.u.markFailed(up, lastErr)
 			continue
 		}
 
@@ -262,6 +347,10 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string) error {
 }
 
 func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffer.Buffer) error {
+	if len(d.u.stripHeaders) != 0 {
+		header = stripHeaderPrefixes(header, d.u.stripHeaders)
+	}
+
 	r, err := body.Open()
 	if err != nil {
 		return exterrors.WithFields(err, map[string]interface{}{"target": d.u.modName})
@@ -272,6 +361,10 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 }
 
 func (d *lmtpDelivery) BodyNonAtomic(ctx context.Context, sc module.StatusCollector, header textproto.Header, body buffer.Buffer) {
+	if len(d.u.stripHeaders) != 0 {
+		header = stripHeaderPrefixes(header, d.u.stripHeaders)
+	}
+
 	r, err := body.Open()
 	if err != nil {
 		modErr := d.u.moduleError(err)
@@ -316,4 +409,5 @@ func (d *delivery) Commit(ctx context.Context) error {
 func init() {
 	module.Register("target.smtp", NewDownstream)
 	module.Register("target.lmtp", NewDownstream)
+	module.Register(exchangeOnlineModName, NewDownstream)
 }
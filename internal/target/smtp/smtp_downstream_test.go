@@ -147,6 +147,76 @@ func TestDownstreamDelivery_Fallback(t *testing.T) {
 	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
 }
 
+func TestDownstreamDelivery_BackupFailover(t *testing.T) {
+	be, srv := testutils.SMTPServer(t, "127.0.0.2:"+testPort)
+	defer srv.Close()
+	defer testutils.CheckSMTPConnLeak(t, srv)
+
+	mod := &Downstream{
+		hostname: "mx.example.invalid",
+		endpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.1",
+				Port:   testPort,
+			},
+		},
+		backupEndpoints: []config.Endpoint{
+			{
+				Scheme: "tcp",
+				Host:   "127.0.0.2",
+				Port:   testPort,
+			},
+		},
+		healthInterval: time.Hour,
+		log:            testutils.Logger(t, "target.smtp"),
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	be.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+
+	order := mod.connectOrder()
+	if order[0].String() != "127.0.0.2:"+testPort || !order[1].isDown() {
+		t.Fatal("failed primary is not moved to the end:", order[0], order[1])
+	}
+
+	// Primary is returned into rotation by the health check once it is up.
+	primary, primarySrv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
+	defer primarySrv.Close()
+	mod.checkHealth()
+	if mod.connectOrder()[0].String() != "127.0.0.1:"+testPort {
+		t.Fatal("primary is not used after failback")
+	}
+
+	testutils.DoTestDelivery(t, mod, "test@example.invalid", []string{"rcpt@example.invalid"})
+	primary.CheckMsg(t, 0, "test@example.invalid", []string{"rcpt@example.invalid"})
+}
+
+func TestParseWeights(t *testing.T) {
+	weights, err := parseWeights([]string{"3", "1"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights[0] != 3 || weights[1] != 1 {
+		t.Fatal("wrong weights:", weights)
+	}
+
+	weights, err = parseWeights(nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights[0] != 1 || weights[1] != 1 {
+		t.Fatal("wrong default weights:", weights)
+	}
+
+	if _, err := parseWeights([]string{"1"}, 2); err == nil {
+		t.Error("mismatched count is accepted")
+	}
+	if _, err := parseWeights([]string{"0", "1"}, 2); err == nil {
+		t.Error("zero weight is accepted")
+	}
+}
+
 func TestDownstreamDelivery_MAILErr(t *testing.T) {
 	be, srv := testutils.SMTPServer(t, "127.0.0.1:"+testPort)
 	defer srv.Close()
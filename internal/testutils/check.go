@@ -20,6 +20,7 @@ package testutils
 
 import (
 	"context"
+	"net"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-smtp"
@@ -29,12 +30,13 @@ import (
 )
 
 type Check struct {
-	InitErr   error
-	EarlyErr  error
-	ConnRes   module.CheckResult
-	SenderRes module.CheckResult
-	RcptRes   module.CheckResult
-	BodyRes   module.CheckResult
+	InitErr    error
+	EarlyErr   error
+	ConnectErr error
+	ConnRes    module.CheckResult
+	SenderRes  module.CheckResult
+	RcptRes    module.CheckResult
+	BodyRes    module.CheckResult
 
 	ConnCalls   int
 	SenderCalls int
@@ -74,6 +76,10 @@ func (c *Check) CheckConnection(ctx context.Context, state *smtp.ConnectionState
 	return c.EarlyErr
 }
 
+func (c *Check) CheckConnect(ctx context.Context, remoteAddr net.Addr) error {
+	return c.ConnectErr
+}
+
 type checkState struct {
 	msgMeta *module.MsgMetadata
 	check   *Check
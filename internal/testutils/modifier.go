@@ -38,6 +38,8 @@ type Modifier struct {
 	MailFrom map[string]string
 	RcptTo   map[string]string
 	AddHdr   textproto.Header
+	// If not nil, the message body is replaced with this value.
+	NewBody []byte
 
 	UnclosedStates int
 }
@@ -109,6 +111,16 @@ func (ms modifierState) RewriteBody(ctx context.Context, h *textproto.Header, bo
 	return nil
 }
 
+func (ms modifierState) ReplaceBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
+	if err := ms.RewriteBody(ctx, h, body); err != nil {
+		return nil, err
+	}
+	if ms.m.NewBody == nil {
+		return nil, nil
+	}
+	return buffer.MemoryBuffer{Slice: ms.m.NewBody}, nil
+}
+
 func (ms modifierState) Close() error {
 	ms.m.UnclosedStates--
 	return nil
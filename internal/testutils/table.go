@@ -18,14 +18,6 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package testutils
 
-import "context"
+import "github.com/foxcpp/maddy/framework/module/moduletest"
 
-type Table struct {
-	M   map[string]string
-	Err error
-}
-
-func (m Table) Lookup(_ context.Context, a string) (string, bool, error) {
-	b, ok := m.M[a]
-	return b, ok, m.Err
-}
+type Table = moduletest.Table
@@ -22,163 +22,21 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
-	"errors"
-	"io"
-	"io/ioutil"
 	"reflect"
 	"sort"
 	"testing"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/foxcpp/maddy/framework/buffer"
-	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/exterrors"
 	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/framework/module/moduletest"
 )
 
-type Msg struct {
-	MsgMeta  *module.MsgMetadata
-	MailFrom string
-	RcptTo   []string
-	Body     []byte
-	Header   textproto.Header
-}
-
-type Target struct {
-	Messages        []Msg
-	DiscardMessages bool
-
-	StartErr       error
-	RcptErr        map[string]error
-	BodyErr        error
-	PartialBodyErr map[string]error
-	AbortErr       error
-	CommitErr      error
-
-	InstName string
-}
-
-/*
-module.Module is implemented with dummy functions for logging done by MsgPipeline code.
-*/
-
-func (dt Target) Init(*config.Map) error {
-	return nil
-}
-
-func (dt Target) InstanceName() string {
-	if dt.InstName != "" {
-		return dt.InstName
-	}
-	return "test_instance"
-}
-
-func (dt Target) Name() string {
-	return "test_target"
-}
-
-type testTargetDelivery struct {
-	msg Msg
-	tgt *Target
-}
-
-type testTargetDeliveryPartial struct {
-	testTargetDelivery
-}
-
-func (dt *Target) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
-	if dt.PartialBodyErr != nil {
-		return &testTargetDeliveryPartial{
-			testTargetDelivery: testTargetDelivery{
-				tgt: dt,
-				msg: Msg{MsgMeta: msgMeta, MailFrom: mailFrom},
-			},
-		}, dt.StartErr
-	}
-	return &testTargetDelivery{
-		tgt: dt,
-		msg: Msg{MsgMeta: msgMeta, MailFrom: mailFrom},
-	}, dt.StartErr
-}
-
-func (dtd *testTargetDelivery) AddRcpt(ctx context.Context, to string) error {
-	if dtd.tgt.RcptErr != nil {
-		if err := dtd.tgt.RcptErr[to]; err != nil {
-			return err
-		}
-	}
-
-	dtd.msg.RcptTo = append(dtd.msg.RcptTo, to)
-	return nil
-}
-
-func (dtd *testTargetDeliveryPartial) BodyNonAtomic(ctx context.Context, c module.StatusCollector, header textproto.Header, buf buffer.Buffer) {
-	if dtd.tgt.PartialBodyErr != nil {
-		for rcpt, err := range dtd.tgt.PartialBodyErr {
-			c.SetStatus(rcpt, err)
-		}
-		return
-	}
-
-	dtd.msg.Header = header
-
-	body, err := buf.Open()
-	if err != nil {
-		for rcpt, err := range dtd.tgt.PartialBodyErr {
-			c.SetStatus(rcpt, err)
-		}
-		return
-	}
-	defer body.Close()
-
-	dtd.msg.Body, err = ioutil.ReadAll(body)
-	if err != nil {
-		for rcpt, err := range dtd.tgt.PartialBodyErr {
-			c.SetStatus(rcpt, err)
-		}
-	}
-}
-
-func (dtd *testTargetDelivery) Body(ctx context.Context, header textproto.Header, buf buffer.Buffer) error {
-	if dtd.tgt.PartialBodyErr != nil {
-		return errors.New("partial failure occurred, no additional information available")
-	}
-	if dtd.tgt.BodyErr != nil {
-		return dtd.tgt.BodyErr
-	}
-
-	dtd.msg.Header = header
-
-	body, err := buf.Open()
-	if err != nil {
-		return err
-	}
-	defer body.Close()
-
-	if dtd.tgt.DiscardMessages {
-		// Don't bother.
-		_, err = io.Copy(ioutil.Discard, body)
-		return err
-	}
-
-	dtd.msg.Body, err = ioutil.ReadAll(body)
-	return err
-}
-
-func (dtd *testTargetDelivery) Abort(ctx context.Context) error {
-	return dtd.tgt.AbortErr
-}
-
-func (dtd *testTargetDelivery) Commit(ctx context.Context) error {
-	if dtd.tgt.CommitErr != nil {
-		return dtd.tgt.CommitErr
-	}
-	if dtd.tgt.DiscardMessages {
-		return nil
-	}
-	dtd.tgt.Messages = append(dtd.tgt.Messages, dtd.msg)
-	return nil
-}
+type (
+	Msg    = moduletest.Msg
+	Target = moduletest.Target
+)
 
 func DoTestDelivery(t *testing.T, tgt module.DeliveryTarget, from string, to []string) string {
 	t.Helper()
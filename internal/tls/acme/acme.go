@@ -5,10 +5,12 @@ import (
 	"crypto/tls"
 	"fmt"
 	"path/filepath"
+	"sync"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/foxcpp/maddy/framework/config"
 	modconfig "github.com/foxcpp/maddy/framework/config/module"
+	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
@@ -24,6 +26,12 @@ type Loader struct {
 	cfg          *certmagic.Config
 	cancelManage context.CancelFunc
 
+	hostname   string
+	dane       bool
+	resolver   *dns.ExtResolver
+	nextKeyLck sync.Mutex
+	checkTLSA  chan struct{}
+
 	log log.Logger
 }
 
@@ -32,14 +40,14 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 		return nil, fmt.Errorf("%s: no inline args expected", modName)
 	}
 	return &Loader{
-		instName: instName,
-		log:      log.Logger{Name: modName},
+		instName:  instName,
+		checkTLSA: make(chan struct{}, 1),
+		log:       log.Logger{Name: modName},
 	}, nil
 }
 
 func (l *Loader) Init(cfg *config.Map) error {
 	var (
-		hostname   string
 		extraNames []string
 		storePath  string
 		caPath     string
@@ -50,7 +58,7 @@ func (l *Loader) Init(cfg *config.Map) error {
 		provider   certmagic.ACMEDNSProvider
 	)
 	cfg.Bool("debug", true, false, &l.log.Debug)
-	cfg.String("hostname", true, true, "", &hostname)
+	cfg.String("hostname", true, true, "", &l.hostname)
 	cfg.StringList("extra_names", false, false, nil, &extraNames)
 	cfg.String("store_path", false, false,
 		filepath.Join(config.StateDirectory, "acme"), &storePath)
@@ -70,6 +78,7 @@ func (l *Loader) Init(cfg *config.Map) error {
 		err := modconfig.ModuleFromNode("libdns", node.Args, node, m.Globals, &p)
 		return p, err
 	}, &provider)
+	cfg.Bool("dane", false, false, &l.dane)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -80,17 +89,26 @@ func (l *Loader) Init(cfg *config.Map) error {
 	l.cache = certmagic.NewCache(certmagic.CacheOptions{
 		Logger: cmLog,
 		GetConfigForCert: func(c certmagic.Certificate) (*certmagic.Config, error) {
-			return &certmagic.Config{
-				Storage: l.store,
-				Logger:  cmLog,
-			}, nil
+			// Renewals should use the same issuer, key source and event
+			// handler.
+			return l.cfg, nil
 		},
 	})
 
-	l.cfg = certmagic.New(l.cache, certmagic.Config{
+	cmCfg := certmagic.Config{
 		Storage: l.store, // not sure if it is necessary to set these twice
 		Logger:  cmLog,
-	})
+	}
+	if l.dane {
+		var err error
+		l.resolver, err = dns.NewExtResolver()
+		if err != nil {
+			return err
+		}
+		cmCfg.KeySource = l
+		cmCfg.OnEvent = l.onEvent
+	}
+	l.cfg = certmagic.New(l.cache, cmCfg)
 	mngr := certmagic.NewACMEManager(l.cfg, certmagic.ACMEManager{
 		Logger: cmLog,
 		CA:     caPath,
@@ -118,13 +136,17 @@ func (l *Loader) Init(cfg *config.Map) error {
 	}
 
 	manageCtx, cancelManage := context.WithCancel(context.Background())
-	err := l.cfg.ManageAsync(manageCtx, append([]string{hostname}, extraNames...))
+	err := l.cfg.ManageAsync(manageCtx, append([]string{l.hostname}, extraNames...))
 	if err != nil {
 		cancelManage()
 		return err
 	}
 	l.cancelManage = cancelManage
 
+	if l.dane {
+		go l.tlsaCheckLoop(manageCtx)
+	}
+
 	return nil
 }
 
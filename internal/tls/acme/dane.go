@@ -0,0 +1,420 @@
+package acme
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/foxcpp/maddy/framework/dns"
+	mdns "github.com/miekg/dns"
+)
+
+// DANE-EE records pinning the public key (3 1 1) stay valid across
+// renewals since certmagic reuses private keys. To change the key, the
+// loader keeps the "next" key that is generated in advance so records for
+// both keys can be published before the switch (RFC 7671, Section 8.1).
+// The next key is used only when a new certificate is obtained.
+
+const (
+	tlsaService       = "25"
+	daneCheckInterval = 12 * time.Hour
+)
+
+// TLSAStatus describes TLSA records published for the hostname.
+type TLSAStatus struct {
+	// Records are found and DNSSEC-signed.
+	Authenticated bool
+	// Some record matches the served certificate.
+	Current bool
+	// Some record will match the certificate obtained using the next key.
+	Next bool
+}
+
+// TLSAData returns the "3 1 1" TLSA record data for the public key.
+func TLSAData(pub crypto.PublicKey) (string, error) {
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(spki)
+	return "3 1 1 " + hex.EncodeToString(sum[:]), nil
+}
+
+func matchKey(rec dns.TLSA, pub crypto.PublicKey) bool {
+	if rec.Usage != 3 || rec.Selector != 1 {
+		return false
+	}
+	spki, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return false
+	}
+	var data []byte
+	switch rec.MatchingType {
+	case 0:
+		data = spki
+	case 1:
+		sum := sha256.Sum256(spki)
+		data = sum[:]
+	case 2:
+		sum := sha512.Sum512(spki)
+		data = sum[:]
+	default:
+		return false
+	}
+	return strings.EqualFold(rec.Certificate, hex.EncodeToString(data))
+}
+
+func matchCert(rec dns.TLSA, cert *x509.Certificate) bool {
+	// rec.Verify compares hex strings case-sensitively.
+	data, err := mdns.CertificateToDANE(rec.Selector, rec.MatchingType, cert)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(rec.Certificate, data)
+}
+
+// matchTLSA checks whether recs match the served certificate chain and the
+// next key.
+//
+// DANE-TA records are assumed to match the next certificate too since it is
+// issued by the same CA.
+func matchTLSA(recs []dns.TLSA, chain []*x509.Certificate, next crypto.PublicKey) (current, nextOk bool) {
+	for _, rec := range recs {
+		switch rec.Usage {
+		case 2:
+			for _, cert := range chain[1:] {
+				if matchCert(rec, cert) {
+					current = true
+					nextOk = true
+				}
+			}
+		case 3:
+			if matchCert(rec, chain[0]) {
+				current = true
+			}
+			if next != nil && matchKey(rec, next) {
+				nextOk = true
+			}
+		}
+	}
+	return current, nextOk
+}
+
+func (l *Loader) nextKeyPath() string {
+	return path.Join("dane", certmagic.StorageKeys.Safe(l.hostname)+".next.key")
+}
+
+func (l *Loader) readNextKey() (crypto.PrivateKey, error) {
+	blob, err := l.store.Load(l.nextKeyPath())
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(blob)
+	if block == nil {
+		return nil, fmt.Errorf("%s: malformed next key", modName)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func (l *Loader) generateNextKey() (crypto.PrivateKey, error) {
+	key, err := certmagic.StandardKeyGenerator{KeyType: certmagic.P256}.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	blob := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := l.store.Store(l.nextKeyPath(), blob); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// nextKey returns the next key, generating it if necessary.
+func (l *Loader) nextKey() (crypto.PrivateKey, error) {
+	l.nextKeyLck.Lock()
+	defer l.nextKeyLck.Unlock()
+
+	if !l.store.Exists(l.nextKeyPath()) {
+		return l.generateNextKey()
+	}
+	return l.readNextKey()
+}
+
+func publicKey(key crypto.PrivateKey) crypto.PublicKey {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil
+	}
+	return signer.Public()
+}
+
+// GenerateKey implements certmagic.KeyGenerator. The next key is not
+// replaced here since obtaining the certificate may still fail.
+func (l *Loader) GenerateKey() (crypto.PrivateKey, error) {
+	return l.nextKey()
+}
+
+// promoteNextKey replaces the next key if it is used by the current
+// certificate.
+func (l *Loader) promoteNextKey() error {
+	chain, err := l.currentChain()
+	if err != nil {
+		return err
+	}
+
+	l.nextKeyLck.Lock()
+	defer l.nextKeyLck.Unlock()
+
+	if l.store.Exists(l.nextKeyPath()) {
+		next, err := l.readNextKey()
+		if err != nil {
+			return err
+		}
+		currentData, err := TLSAData(chain[0].PublicKey)
+		if err != nil {
+			return err
+		}
+		nextData, err := TLSAData(publicKey(next))
+		if err != nil {
+			return err
+		}
+		if currentData != nextData {
+			return nil
+		}
+	}
+
+	next, err := l.generateNextKey()
+	if err != nil {
+		return err
+	}
+	nextData, err := TLSAData(publicKey(next))
+	if err != nil {
+		return err
+	}
+	l.log.Msg("new next key generated, publish the TLSA record for it", "name", l.hostname, "next_tlsa", nextData)
+	return nil
+}
+
+// currentChain returns the certificate chain for the hostname, loading it
+// from storage if the certificate is not managed by this process.
+func (l *Loader) currentChain() ([]*x509.Certificate, error) {
+	var cert certmagic.Certificate
+	if certs := l.cache.AllMatchingCertificates(l.hostname); len(certs) != 0 {
+		cert = certs[0]
+	} else {
+		var err error
+		cert, err = l.cfg.CacheManagedCertificate(l.hostname)
+		if err != nil {
+			return nil, fmt.Errorf("%s: no certificate for %s: %w", modName, l.hostname, err)
+		}
+	}
+
+	chain := make([]*x509.Certificate, 0, len(cert.Certificate.Certificate))
+	for _, der := range cert.Certificate.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, c)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s: empty certificate chain for %s", modName, l.hostname)
+	}
+	return chain, nil
+}
+
+// Hostname returns the name TLSA records are published for.
+func (l *Loader) Hostname() string {
+	return l.hostname
+}
+
+// TLSARecords returns the TLSA record data for the key of the served
+// certificate and for the next key. Both should be published.
+func (l *Loader) TLSARecords() (current, next string, err error) {
+	if !l.dane {
+		return "", "", fmt.Errorf("%s: dane is not enabled", modName)
+	}
+
+	chain, err := l.currentChain()
+	if err != nil {
+		return "", "", err
+	}
+	current, err = TLSAData(chain[0].PublicKey)
+	if err != nil {
+		return "", "", err
+	}
+	nextKey, err := l.nextKey()
+	if err != nil {
+		return "", "", err
+	}
+	next, err = TLSAData(publicKey(nextKey))
+	if err != nil {
+		return "", "", err
+	}
+	return current, next, nil
+}
+
+// CheckTLSA looks up TLSA records for the hostname and compares them with
+// the served certificate and the next key.
+func (l *Loader) CheckTLSA(ctx context.Context) (TLSAStatus, error) {
+	if !l.dane {
+		return TLSAStatus{}, fmt.Errorf("%s: dane is not enabled", modName)
+	}
+
+	chain, err := l.currentChain()
+	if err != nil {
+		return TLSAStatus{}, err
+	}
+	nextKey, err := l.nextKey()
+	if err != nil {
+		return TLSAStatus{}, err
+	}
+
+	ad, recs, err := l.resolver.AuthLookupTLSA(ctx, tlsaService, "tcp", l.hostname)
+	if err != nil && !dns.IsNotFound(err) {
+		return TLSAStatus{}, err
+	}
+
+	status := TLSAStatus{Authenticated: ad && len(recs) != 0}
+	status.Current, status.Next = matchTLSA(recs, chain, publicKey(nextKey))
+	return status, nil
+}
+
+func (l *Loader) logTLSAStatus(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	status, err := l.CheckTLSA(ctx)
+	if err != nil {
+		l.log.Error("TLSA records check failed", err, "name", l.hostname)
+		return
+	}
+	current, next, err := l.TLSARecords()
+	if err != nil {
+		l.log.Error("TLSA records check failed", err, "name", l.hostname)
+		return
+	}
+
+	if !status.Current {
+		l.log.Error("published TLSA records do not match the served certificate, DANE senders will fail to deliver mail", nil,
+			"name", l.hostname, "expected_tlsa", current)
+	} else if !status.Authenticated {
+		l.log.Msg("TLSA records are not DNSSEC-signed, they will be ignored by senders", "name", l.hostname)
+	}
+	if !status.Next {
+		l.log.Msg("TLSA record for the next key is not published, key rollover is not possible",
+			"name", l.hostname, "next_tlsa", next)
+	}
+}
+
+func (l *Loader) onEvent(event string, data interface{}) {
+	var names []string
+	switch data := data.(type) {
+	case string:
+		names = []string{data}
+	case []string:
+		names = data
+	}
+	matches := false
+	for _, name := range names {
+		if dns.Equal(name, l.hostname) {
+			matches = true
+		}
+	}
+	if !matches {
+		return
+	}
+
+	switch event {
+	case "cert_obtained":
+		if err := l.promoteNextKey(); err != nil {
+			l.log.Error("failed to replace the next key", err, "name", l.hostname)
+		}
+	case "cert_renewed", "cached_managed_cert":
+	default:
+		return
+	}
+
+	select {
+	case l.checkTLSA <- struct{}{}:
+	default:
+	}
+}
+
+func (l *Loader) tlsaCheckLoop(ctx context.Context) {
+	t := time.NewTicker(daneCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-l.checkTLSA:
+		}
+		l.logTLSAStatus(ctx)
+	}
+}
+
+// RolloverKey obtains a new certificate for the hostname using the next
+// key. The previous certificate is restored if that fails.
+//
+// TLSA record for the next key should be published beforehand. Server
+// process continues to use the previous certificate until it is restarted.
+func (l *Loader) RolloverKey(ctx context.Context) error {
+	if !l.dane {
+		return fmt.Errorf("%s: dane is not enabled", modName)
+	}
+	if _, err := l.nextKey(); err != nil {
+		return err
+	}
+
+	// certmagic reuses the stored key for the new certificate, so it has
+	// to be moved out of the way.
+	backup := make(map[string][]byte)
+	for _, issuer := range l.cfg.Issuers {
+		issuerKey := issuer.IssuerKey()
+		for _, key := range []string{
+			certmagic.StorageKeys.SiteCert(issuerKey, l.hostname),
+			certmagic.StorageKeys.SitePrivateKey(issuerKey, l.hostname),
+			certmagic.StorageKeys.SiteMeta(issuerKey, l.hostname),
+		} {
+			if !l.store.Exists(key) {
+				continue
+			}
+			blob, err := l.store.Load(key)
+			if err != nil {
+				return err
+			}
+			backup[key] = blob
+		}
+	}
+	for key := range backup {
+		if err := l.store.Delete(key); err != nil {
+			return err
+		}
+	}
+
+	if err := l.cfg.ObtainCertSync(ctx, l.hostname); err != nil {
+		for key, blob := range backup {
+			if err := l.store.Store(key, blob); err != nil {
+				l.log.Error("failed to restore the previous certificate", err, "key", key)
+			}
+		}
+		return err
+	}
+
+	return l.promoteNextKey()
+}
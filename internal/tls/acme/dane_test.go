@@ -0,0 +1,179 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/foxcpp/maddy/framework/dns"
+	"github.com/foxcpp/maddy/internal/testutils"
+	mdns "github.com/miekg/dns"
+)
+
+func testCert(t *testing.T, name string, key crypto.PrivateKey) tls.Certificate {
+	t.Helper()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(nil, tmpl, tmpl, publicKey(key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func testLoader(t *testing.T) *Loader {
+	t.Helper()
+
+	l := &Loader{
+		hostname:  "mx.example.org",
+		dane:      true,
+		checkTLSA: make(chan struct{}, 1),
+		log:       testutils.Logger(t, modName),
+	}
+	l.store = &certmagic.FileStorage{Path: t.TempDir()}
+	l.cache = certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return l.cfg, nil
+		},
+	})
+	t.Cleanup(func() { l.cache.Stop() })
+	l.cfg = certmagic.New(l.cache, certmagic.Config{Storage: l.store, KeySource: l})
+	return l
+}
+
+func TestTLSAData(t *testing.T) {
+	key, err := certmagic.StandardKeyGenerator{KeyType: certmagic.P256}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(testCert(t, "mx.example.org", key).Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := TLSAData(publicKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := mdns.CertificateToDANE(1, 1, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != "3 1 1 "+expected {
+		t.Fatal("Wrong record data:", data, "expected hash:", expected)
+	}
+}
+
+func TestMatchTLSA(t *testing.T) {
+	gen := certmagic.StandardKeyGenerator{KeyType: certmagic.P256}
+	curKey, _ := gen.GenerateKey()
+	nextKey, _ := gen.GenerateKey()
+	cert, err := x509.ParseCertificate(testCert(t, "mx.example.org", curKey).Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := []*x509.Certificate{cert}
+
+	rec := func(key crypto.PrivateKey) dns.TLSA {
+		data, err := TLSAData(publicKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dns.TLSA{Usage: 3, Selector: 1, MatchingType: 1,
+			Certificate: strings.ToUpper(strings.TrimPrefix(data, "3 1 1 "))}
+	}
+
+	test := func(name string, recs []dns.TLSA, current, next bool) {
+		t.Run(name, func(t *testing.T) {
+			c, n := matchTLSA(recs, chain, publicKey(nextKey))
+			if c != current || n != next {
+				t.Errorf("Wrong result: current=%v next=%v", c, n)
+			}
+		})
+	}
+
+	certHash, err := mdns.CertificateToDANE(0, 1, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test("none", nil, false, false)
+	test("current", []dns.TLSA{rec(curKey)}, true, false)
+	test("next", []dns.TLSA{rec(nextKey)}, false, true)
+	test("both", []dns.TLSA{rec(nextKey), rec(curKey)}, true, true)
+	test("cert hash", []dns.TLSA{{Usage: 3, Selector: 0, MatchingType: 1, Certificate: certHash}}, true, false)
+	test("wrong usage", []dns.TLSA{{Usage: 1, Selector: 1, MatchingType: 1,
+		Certificate: rec(curKey).Certificate}}, false, false)
+}
+
+func TestPromoteNextKey(t *testing.T) {
+	l := testLoader(t)
+
+	next1, err := l.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next2, err := l.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data1, _ := TLSAData(publicKey(next1))
+	data2, _ := TLSAData(publicKey(next2))
+	if data1 != data2 {
+		t.Fatal("Next key changed without the certificate being obtained")
+	}
+
+	// Certificate using some other key, next key should be kept.
+	otherKey, _ := certmagic.StandardKeyGenerator{KeyType: certmagic.P256}.GenerateKey()
+	if err := l.cfg.CacheUnmanagedTLSCertificate(testCert(t, l.hostname, otherKey), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.promoteNextKey(); err != nil {
+		t.Fatal(err)
+	}
+	current, next, err := l.TLSARecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherData, _ := TLSAData(publicKey(otherKey))
+	if current != otherData || next != data1 {
+		t.Fatal("Wrong records:", current, next)
+	}
+
+	// Certificate using the next key, new next key should be generated.
+	l.cache.Stop()
+	l.cache = certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return l.cfg, nil
+		},
+	})
+	l.cfg = certmagic.New(l.cache, certmagic.Config{Storage: l.store, KeySource: l})
+	if err := l.cfg.CacheUnmanagedTLSCertificate(testCert(t, l.hostname, next1), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.promoteNextKey(); err != nil {
+		t.Fatal(err)
+	}
+	current, next, err = l.TLSARecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != data1 {
+		t.Fatal("Wrong current record:", current)
+	}
+	if next == data1 || next == otherData {
+		t.Fatal("Next key was not replaced")
+	}
+}
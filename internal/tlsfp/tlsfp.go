@@ -0,0 +1,298 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tlsfp implements JA3 and JA4 fingerprinting of TLS clients.
+//
+// Fingerprints are computed from the ClientHello message and can be used to
+// identify TLS stacks used by clients regardless of the claimed identity
+// (e.g. spam bots using the same TLS library).
+package tlsfp
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	extServerName          = 0x0000
+	extSupportedVersions   = 0x002b
+	extALPN                = 0x0010
+	extSignatureAlgorithms = 0x000d
+)
+
+// Fingerprint contains fingerprints of the single TLS client.
+type Fingerprint struct {
+	// JA3 is the MD5 hash of the JA3 string, as commonly used in blocklists.
+	JA3 string
+	// JA4 is the JA4 (TLS client) fingerprint.
+	JA4 string
+}
+
+// isGREASE checks whether the value is one of reserved GREASE values
+// (RFC 8701), they are randomly used by clients and are excluded from
+// fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func joinDec(vals []uint16) string {
+	parts := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if isGREASE(v) {
+			continue
+		}
+		parts = append(parts, strconv.Itoa(int(v)))
+	}
+	return strings.Join(parts, "-")
+}
+
+func hexList(vals []uint16) []string {
+	parts := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if isGREASE(v) {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%04x", v))
+	}
+	return parts
+}
+
+func hasExt(hello *tls.ClientHelloInfo, ext uint16) bool {
+	for _, e := range hello.Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyVersion returns the ClientHello legacy_version value.
+//
+// crypto/tls does not expose it, but it is always TLS 1.2 if
+// supported_versions extension is used, otherwise the maximum version
+// announced by the client is extrapolated from it.
+func legacyVersion(hello *tls.ClientHelloInfo) uint16 {
+	if hasExt(hello, extSupportedVersions) || len(hello.SupportedVersions) == 0 {
+		return tls.VersionTLS12
+	}
+	return hello.SupportedVersions[0]
+}
+
+// JA3String returns the JA3 fingerprint string for the ClientHello:
+//
+//	SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+func JA3String(hello *tls.ClientHelloInfo) string {
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, c := range hello.SupportedCurves {
+		curves = append(curves, uint16(c))
+	}
+	points := make([]uint16, 0, len(hello.SupportedPoints))
+	for _, p := range hello.SupportedPoints {
+		points = append(points, uint16(p))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(legacyVersion(hello))),
+		joinDec(hello.CipherSuites),
+		joinDec(hello.Extensions),
+		joinDec(curves),
+		joinDec(points),
+	}, ",")
+}
+
+// JA3 returns the MD5 hash of JA3String as a hex string.
+func JA3(hello *tls.ClientHelloInfo) string {
+	sum := md5.Sum([]byte(JA3String(hello)))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func ja4Version(hello *tls.ClientHelloInfo) string {
+	var max uint16
+	if hasExt(hello, extSupportedVersions) {
+		for _, v := range hello.SupportedVersions {
+			if !isGREASE(v) && v > max {
+				max = v
+			}
+		}
+	} else {
+		max = legacyVersion(hello)
+	}
+
+	switch max {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+func ja4Count(n int) string {
+	if n > 99 {
+		n = 99
+	}
+	return fmt.Sprintf("%02d", n)
+}
+
+// JA4 returns the JA4 fingerprint for the ClientHello received over TCP.
+func JA4(hello *tls.ClientHelloInfo) string {
+	sni := "i"
+	if hasExt(hello, extServerName) {
+		sni = "d"
+	}
+
+	alpn := "00"
+	if len(hello.SupportedProtos) != 0 && hello.SupportedProtos[0] != "" {
+		first := hello.SupportedProtos[0]
+		alpn = string(first[0]) + string(first[len(first)-1])
+	}
+
+	ciphers := hexList(hello.CipherSuites)
+	exts := hexList(hello.Extensions)
+
+	a := "t" + ja4Version(hello) + sni + ja4Count(len(ciphers)) + ja4Count(len(exts)) + alpn
+
+	sort.Strings(ciphers)
+	b := truncHash(strings.Join(ciphers, ","))
+
+	hashedExts := make([]uint16, 0, len(hello.Extensions))
+	for _, e := range hello.Extensions {
+		if e == extServerName || e == extALPN {
+			continue
+		}
+		hashedExts = append(hashedExts, e)
+	}
+	sortedExts := hexList(hashedExts)
+	sort.Strings(sortedExts)
+	cInput := strings.Join(sortedExts, ",")
+	if hasExt(hello, extSignatureAlgorithms) && len(hello.SignatureSchemes) != 0 {
+		schemes := make([]uint16, 0, len(hello.SignatureSchemes))
+		for _, s := range hello.SignatureSchemes {
+			schemes = append(schemes, uint16(s))
+		}
+		cInput += "_" + strings.Join(hexList(schemes), ",")
+	}
+	c := truncHash(cInput)
+	if len(sortedExts) == 0 {
+		c = "000000000000"
+	}
+
+	return a + "_" + b + "_" + c
+}
+
+// Compute returns fingerprints for the ClientHello.
+func Compute(hello *tls.ClientHelloInfo) Fingerprint {
+	return Fingerprint{
+		JA3: JA3(hello),
+		JA4: JA4(hello),
+	}
+}
+
+type entry struct {
+	fp    Fingerprint
+	stamp time.Time
+}
+
+// Recorder keeps fingerprints of recent TLS handshakes so they can be
+// retrieved by the protocol implementation that has access only to the
+// client address.
+//
+// Entries are kept for the limited time since the handshake, so they should
+// be retrieved shortly after it (e.g. at the session start).
+type Recorder struct {
+	ttl time.Duration
+
+	lock      sync.Mutex
+	entries   map[string]entry
+	lastPrune time.Time
+}
+
+func NewRecorder(ttl time.Duration) *Recorder {
+	return &Recorder{
+		ttl:     ttl,
+		entries: make(map[string]entry),
+	}
+}
+
+// Wrap returns the copy of the server TLS configuration that records
+// fingerprints of all clients.
+func (r *Recorder) Wrap(cfg *tls.Config) *tls.Config {
+	wrapped := cfg.Clone()
+	wrapped.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hello.Conn != nil {
+			r.put(hello.Conn.RemoteAddr().String(), Compute(hello))
+		}
+		if cfg.GetConfigForClient != nil {
+			return cfg.GetConfigForClient(hello)
+		}
+		return nil, nil
+	}
+	return wrapped
+}
+
+func (r *Recorder) put(addr string, fp Fingerprint) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastPrune) > r.ttl {
+		for k, e := range r.entries {
+			if now.Sub(e.stamp) > r.ttl {
+				delete(r.entries, k)
+			}
+		}
+		r.lastPrune = now
+	}
+
+	r.entries[addr] = entry{fp: fp, stamp: now}
+}
+
+// Get returns the fingerprint of the last TLS handshake made by the client
+// with the specified address.
+func (r *Recorder) Get(addr string) (Fingerprint, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e, ok := r.entries[addr]
+	if !ok || time.Since(e.stamp) > r.ttl {
+		return Fingerprint{}, false
+	}
+	return e.fp, true
+}
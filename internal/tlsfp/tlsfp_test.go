@@ -0,0 +1,88 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsfp
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func testHello() *tls.ClientHelloInfo {
+	return &tls.ClientHelloInfo{
+		CipherSuites: []uint16{
+			0x1a1a, // GREASE
+			0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9,
+			0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035,
+		},
+		Extensions: []uint16{
+			0x2a2a, // GREASE
+			0x0000, 0x0017, 0xff01, 0x000a, 0x000b, 0x0023, 0x0010, 0x0005,
+			0x000d, 0x0012, 0x0033, 0x002d, 0x002b, 0x001b, 0x4469, 0x0015,
+		},
+		SupportedCurves:   []tls.CurveID{0x3a3a, tls.X25519, tls.CurveP256, tls.CurveP384},
+		SupportedPoints:   []uint8{0},
+		SupportedVersions: []uint16{0x4a4a, tls.VersionTLS13, tls.VersionTLS12},
+		SupportedProtos:   []string{"h2", "http/1.1"},
+		SignatureSchemes: []tls.SignatureScheme{
+			0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601,
+		},
+	}
+}
+
+func TestJA3(t *testing.T) {
+	want := "771,4865-4866-4867-49195-49199-49196-49200-52393-52392-49171-49172-156-157-47-53," +
+		"0-23-65281-10-11-35-16-5-13-18-51-45-43-27-17513-21,29-23-24,0"
+	if got := JA3String(testHello()); got != want {
+		t.Errorf("wrong JA3 string:\nwant %s\ngot  %s", want, got)
+	}
+	if got := JA3(testHello()); len(got) != 32 {
+		t.Error("wrong JA3 hash:", got)
+	}
+}
+
+func TestJA4(t *testing.T) {
+	// Cipher and extension hashes match the example from the JA4 specification.
+	want := "t13d1516h2_8daaf6152771_e5627efa2ab1"
+	if got := JA4(testHello()); got != want {
+		t.Errorf("wrong JA4:\nwant %s\ngot  %s", want, got)
+	}
+
+	hello := testHello()
+	hello.Extensions = []uint16{0x000a, 0x000b}
+	hello.SupportedVersions = []uint16{tls.VersionTLS12, tls.VersionTLS11}
+	hello.SupportedProtos = nil
+	if got := JA4(hello)[:10]; got != "t12i150200" {
+		t.Error("wrong JA4_a for TLS 1.2 client:", got)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	r := NewRecorder(time.Minute)
+	fp := Compute(testHello())
+	r.put("127.0.0.1:1234", fp)
+
+	got, ok := r.Get("127.0.0.1:1234")
+	if !ok || got != fp {
+		t.Fatal("recorded fingerprint is not returned:", got, ok)
+	}
+	if _, ok := r.Get("127.0.0.1:1235"); ok {
+		t.Fatal("fingerprint returned for unknown address")
+	}
+}
@@ -29,45 +29,85 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/caddyserver/certmagic"
 	parser "github.com/foxcpp/maddy/framework/cfgparser"
 	"github.com/foxcpp/maddy/framework/config"
 	"github.com/foxcpp/maddy/framework/config/tls"
+	"github.com/foxcpp/maddy/framework/dns"
 	"github.com/foxcpp/maddy/framework/hooks"
 	"github.com/foxcpp/maddy/framework/log"
 	"github.com/foxcpp/maddy/framework/module"
 
 	// Import packages for side-effect of module registration.
+	_ "github.com/foxcpp/maddy/internal/auth/app_passwords"
 	_ "github.com/foxcpp/maddy/internal/auth/dovecot_sasl"
 	_ "github.com/foxcpp/maddy/internal/auth/external"
 	_ "github.com/foxcpp/maddy/internal/auth/ldap"
+	_ "github.com/foxcpp/maddy/internal/auth/oidc"
 	_ "github.com/foxcpp/maddy/internal/auth/pam"
 	_ "github.com/foxcpp/maddy/internal/auth/pass_table"
 	_ "github.com/foxcpp/maddy/internal/auth/plain_separate"
 	_ "github.com/foxcpp/maddy/internal/auth/shadow"
+	_ "github.com/foxcpp/maddy/internal/auth/totp"
+	_ "github.com/foxcpp/maddy/internal/check/arc"
+	_ "github.com/foxcpp/maddy/internal/check/asn"
+	_ "github.com/foxcpp/maddy/internal/check/attachment"
 	_ "github.com/foxcpp/maddy/internal/check/authorize_sender"
+	_ "github.com/foxcpp/maddy/internal/check/batv"
+	_ "github.com/foxcpp/maddy/internal/check/clamav"
 	_ "github.com/foxcpp/maddy/internal/check/command"
 	_ "github.com/foxcpp/maddy/internal/check/dkim"
 	_ "github.com/foxcpp/maddy/internal/check/dns"
 	_ "github.com/foxcpp/maddy/internal/check/dnsbl"
+	_ "github.com/foxcpp/maddy/internal/check/ehlo"
+	_ "github.com/foxcpp/maddy/internal/check/geoip"
+	_ "github.com/foxcpp/maddy/internal/check/greylist"
+	_ "github.com/foxcpp/maddy/internal/check/headers"
+	_ "github.com/foxcpp/maddy/internal/check/hop_count"
+	_ "github.com/foxcpp/maddy/internal/check/loadshed"
 	_ "github.com/foxcpp/maddy/internal/check/milter"
 	_ "github.com/foxcpp/maddy/internal/check/requiretls"
 	_ "github.com/foxcpp/maddy/internal/check/rspamd"
+	_ "github.com/foxcpp/maddy/internal/check/send_quota"
+	_ "github.com/foxcpp/maddy/internal/check/sender_lists"
+	_ "github.com/foxcpp/maddy/internal/check/spamc"
+	_ "github.com/foxcpp/maddy/internal/check/spamtrap"
 	_ "github.com/foxcpp/maddy/internal/check/spf"
+	_ "github.com/foxcpp/maddy/internal/check/tls_fingerprint"
+	_ "github.com/foxcpp/maddy/internal/check/verify_rcpt"
+	_ "github.com/foxcpp/maddy/internal/check/verify_sender"
+	_ "github.com/foxcpp/maddy/internal/dmarc/report"
+	_ "github.com/foxcpp/maddy/internal/endpoint/batch"
 	_ "github.com/foxcpp/maddy/internal/endpoint/dovecot_sasld"
 	_ "github.com/foxcpp/maddy/internal/endpoint/imap"
+	_ "github.com/foxcpp/maddy/internal/endpoint/mtasts"
 	_ "github.com/foxcpp/maddy/internal/endpoint/openmetrics"
 	_ "github.com/foxcpp/maddy/internal/endpoint/smtp"
 	_ "github.com/foxcpp/maddy/internal/imap_filter"
+	_ "github.com/foxcpp/maddy/internal/imap_filter/calendar"
 	_ "github.com/foxcpp/maddy/internal/imap_filter/command"
 	_ "github.com/foxcpp/maddy/internal/libdns"
 	_ "github.com/foxcpp/maddy/internal/modify"
+	_ "github.com/foxcpp/maddy/internal/modify/arc"
+	_ "github.com/foxcpp/maddy/internal/modify/batv"
 	_ "github.com/foxcpp/maddy/internal/modify/dkim"
+	_ "github.com/foxcpp/maddy/internal/modify/footer"
+	_ "github.com/foxcpp/maddy/internal/modify/headers"
+	_ "github.com/foxcpp/maddy/internal/modify/srs"
+	_ "github.com/foxcpp/maddy/internal/modify/strip_attachments"
+	_ "github.com/foxcpp/maddy/internal/modify/tag_subject"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/fs"
 	_ "github.com/foxcpp/maddy/internal/storage/blob/s3"
 	_ "github.com/foxcpp/maddy/internal/storage/imapsql"
+	_ "github.com/foxcpp/maddy/internal/summary"
 	_ "github.com/foxcpp/maddy/internal/table"
+	_ "github.com/foxcpp/maddy/internal/target/aliases"
+	_ "github.com/foxcpp/maddy/internal/target/batch"
+	_ "github.com/foxcpp/maddy/internal/target/httpapi"
+	_ "github.com/foxcpp/maddy/internal/target/journal"
+	_ "github.com/foxcpp/maddy/internal/target/list"
 	_ "github.com/foxcpp/maddy/internal/target/queue"
 	_ "github.com/foxcpp/maddy/internal/target/remote"
 	_ "github.com/foxcpp/maddy/internal/target/smtp"
@@ -245,7 +285,27 @@ func ensureDirectoryWritable(path string) error {
 }
 
 func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, error) {
+	var (
+		dnsCacheSize int
+		dnsCacheTTL  time.Duration
+	)
+
 	globals := config.NewMap(nil, config.Node{Children: cfg})
+	registerGlobals(globals, &dnsCacheSize, &dnsCacheTTL)
+	unknown, err := globals.Process()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dnsCacheSize > 0 {
+		if err := dns.EnableCache(dnsCacheSize, dnsCacheTTL); err != nil {
+			return nil, nil, fmt.Errorf("dns_cache_size: %w", err)
+		}
+	}
+	return globals.Values, unknown, nil
+}
+
+func registerGlobals(globals *config.Map, dnsCacheSize *int, dnsCacheTTL *time.Duration) {
 	globals.String("state_dir", false, false, DefaultStateDirectory, &config.StateDirectory)
 	globals.String("runtime_dir", false, false, DefaultRuntimeDirectory, &config.RuntimeDirectory)
 	globals.String("hostname", false, false, "", nil)
@@ -256,32 +316,14 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.StringList("auth_domains", false, false, nil, nil)
 	globals.Custom("log", false, false, defaultLogOutput, logOutput, &log.DefaultLogger.Out)
 	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
+	globals.Int("dns_cache_size", false, false, 0, dnsCacheSize)
+	globals.Duration("dns_cache_max_ttl", false, false, time.Hour, dnsCacheTTL)
 	globals.AllowUnknown()
-	unknown, err := globals.Process()
-	return globals.Values, unknown, err
 }
 
 func moduleMain(cfg []config.Node) error {
-	globals, modBlocks, err := ReadGlobals(cfg)
-	if err != nil {
-		return err
-	}
-
-	if err := InitDirs(); err != nil {
-		return err
-	}
-
-	defer log.DefaultLogger.Out.Close()
-
-	hooks.AddHook(hooks.EventLogRotate, reinitLogging)
-
-	endpoints, mods, err := RegisterModules(globals, modBlocks)
-	if err != nil {
-		return err
-	}
-
-	err = initModules(globals, endpoints, mods)
-	if err != nil {
+	srv := NewServer(cfg, Options{ControlSocket: true})
+	if err := srv.Start(); err != nil {
 		return err
 	}
 
@@ -291,7 +333,7 @@ func moduleMain(cfg []config.Node) error {
 
 	systemdStatus(SDStopping, "Waiting for running transactions to complete...")
 
-	hooks.RunHooks(hooks.EventShutdown)
+	srv.Stop()
 
 	return nil
 }
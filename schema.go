@@ -0,0 +1,117 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/module"
+)
+
+// ModuleSchema describes configuration directives of the module.
+type ModuleSchema struct {
+	Name     string `json:"name"`
+	Endpoint bool   `json:"endpoint,omitempty"`
+	// Directives registered by the module in the configuration block.
+	// Nested blocks with module-specific syntax (e.g. pipeline rules) are
+	// described as a single directive of the "custom" type.
+	Directives []config.DirectiveSchema `json:"directives"`
+	// Error is set if directives could not be collected.
+	Error string `json:"error,omitempty"`
+}
+
+// ConfigSchema describes global directives and all modules in the registry.
+type ConfigSchema struct {
+	Globals []config.DirectiveSchema `json:"globals"`
+	Modules []ModuleSchema           `json:"modules"`
+}
+
+// Schema collects the description of configuration directives from all
+// registered modules.
+//
+// Each module is created and initialized using the Map created with
+// config.NewSchemaMap, so directives are obtained from the same registrations
+// that are used to read the configuration. module.NoRun should be set so
+// modules do not start any background work.
+func Schema() ConfigSchema {
+	var (
+		schema       ConfigSchema
+		dnsCacheSize int
+		dnsCacheTTL  time.Duration
+	)
+
+	globals := config.NewSchemaMap(nil)
+	registerGlobals(globals, &dnsCacheSize, &dnsCacheTTL)
+	_, _ = globals.Process()
+	schema.Globals, _ = globals.Schema()
+
+	for _, name := range module.RegisteredEndpoints() {
+		modSchema := ModuleSchema{Name: name, Endpoint: true}
+		inst, err := module.GetEndpoint(name)(name, nil)
+		if err != nil {
+			modSchema.Error = err.Error()
+		} else {
+			modSchema.Directives, err = moduleSchema(inst)
+			if err != nil {
+				modSchema.Error = err.Error()
+			}
+		}
+		schema.Modules = append(schema.Modules, modSchema)
+	}
+
+	for _, name := range module.RegisteredModules() {
+		modSchema := ModuleSchema{Name: name}
+		inst, err := module.Get(name)(name, "", nil, nil)
+		if err != nil {
+			modSchema.Error = err.Error()
+		} else {
+			modSchema.Directives, err = moduleSchema(inst)
+			if err != nil {
+				modSchema.Error = err.Error()
+			}
+		}
+		schema.Modules = append(schema.Modules, modSchema)
+	}
+
+	return schema
+}
+
+func moduleSchema(inst module.Module) (directives []config.DirectiveSchema, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic during initialization: %v", r)
+		}
+	}()
+
+	cfg := config.NewSchemaMap(nil)
+	initErr := inst.Init(cfg)
+	directives, ok := cfg.Schema()
+	if !ok {
+		if initErr != nil {
+			return nil, initErr
+		}
+		return nil, fmt.Errorf("module does not use the configuration block")
+	}
+	if directives == nil {
+		directives = []config.DirectiveSchema{}
+	}
+	return directives, nil
+}
@@ -0,0 +1,306 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	parser "github.com/foxcpp/maddy/framework/cfgparser"
+	"github.com/foxcpp/maddy/framework/config"
+	"github.com/foxcpp/maddy/framework/hooks"
+	"github.com/foxcpp/maddy/framework/log"
+	"github.com/foxcpp/maddy/framework/module"
+	"github.com/foxcpp/maddy/internal/control"
+	"github.com/foxcpp/maddy/internal/maintenance"
+)
+
+// Options controls the environment of the Server. Zero value is usable and
+// results in the same behavior as for the maddy executable without
+// command line flags, except that the control socket is not created.
+type Options struct {
+	// StateDirectory, RuntimeDirectory and LibexecDirectory override
+	// corresponding global directives (state_dir, runtime_dir) and the
+	// -libexec flag if not empty.
+	StateDirectory   string
+	RuntimeDirectory string
+	LibexecDirectory string
+
+	// Log is the default log output. It is still overridden by the 'log'
+	// global directive. The Server does not close it.
+	Log log.Output
+	// Debug enables debug logging, same as the 'debug' global directive.
+	Debug bool
+
+	// ControlSocket enables the socket used by maddyctl to manage accounts
+	// through the running server.
+	ControlSocket bool
+}
+
+var (
+	// Module instances, hooks and some settings are stored in global
+	// variables so only one Server can run in the process at a time.
+	runningLock sync.Mutex
+	running     bool
+)
+
+// Server is the maddy instance created from the configuration.
+//
+// Server uses global state (module instances registry, hooks, directories in
+// the config package, log.DefaultLogger) so only one Server can be started in
+// the process at a time. Once Stop is called, another Server can be started.
+//
+// Note that similarly to the maddy executable, Start changes the working
+// directory of the process to the state directory so relative paths in the
+// configuration are interpreted relative to it. The original working
+// directory is restored by Stop.
+type Server struct {
+	cfg  []config.Node
+	opts Options
+
+	endpoints []ModInfo
+	mods      []ModInfo
+
+	prevWd  string
+	prevLog log.Output
+	prevDbg bool
+	// cfgLog is set if log output is created by the 'log' directive and
+	// should be closed on shutdown.
+	cfgLog bool
+
+	started bool
+	stopped bool
+}
+
+// NewServer creates the Server using the parsed configuration.
+//
+// Configuration can be read using cfgparser.Read or constructed directly
+// as a tree of config.Node values.
+func NewServer(cfg []config.Node, opts Options) *Server {
+	return &Server{
+		cfg:  cfg,
+		opts: opts,
+	}
+}
+
+// NewServerFromString creates the Server using the configuration text in the
+// maddy.conf format.
+//
+// Relative paths in import directives are interpreted relative to the
+// current working directory.
+func NewServerFromString(cfg string, opts Options) (*Server, error) {
+	nodes, err := parser.Read(strings.NewReader(cfg), "maddy.conf")
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(nodes, opts), nil
+}
+
+// Start initializes all modules, after Start returns the server is accepting
+// connections.
+//
+// If Start fails, modules that were already initialized are closed.
+func (s *Server) Start() error {
+	if s.started {
+		return errors.New("maddy: server is already started")
+	}
+
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	if running {
+		return errors.New("maddy: another server is running in this process")
+	}
+
+	s.prevLog = log.DefaultLogger.Out
+	s.prevDbg = log.DefaultLogger.Debug
+	if s.opts.Log != nil {
+		log.DefaultLogger.Out = s.opts.Log
+	}
+	if s.opts.Debug {
+		log.DefaultLogger.Debug = true
+	}
+
+	var err error
+	s.prevWd, err = os.Getwd()
+	if err != nil {
+		s.restoreEnv()
+		return err
+	}
+
+	if err := s.start(); err != nil {
+		s.shutdown()
+		return err
+	}
+
+	s.started = true
+	running = true
+	return nil
+}
+
+func (s *Server) start() error {
+	globals, modBlocks, err := ReadGlobals(s.cfg)
+	if err != nil {
+		return err
+	}
+	for _, node := range s.cfg {
+		if node.Name == "log" {
+			s.cfgLog = true
+		}
+	}
+
+	if s.opts.StateDirectory != "" {
+		config.StateDirectory = s.opts.StateDirectory
+	}
+	if s.opts.RuntimeDirectory != "" {
+		config.RuntimeDirectory = s.opts.RuntimeDirectory
+	}
+	if s.opts.LibexecDirectory != "" {
+		config.LibexecDirectory = s.opts.LibexecDirectory
+	}
+
+	if err := InitDirs(); err != nil {
+		return err
+	}
+
+	hooks.AddHook(hooks.EventLogRotate, reinitLogging)
+
+	if err := maintenance.Load(); err != nil {
+		return err
+	}
+	hooks.AddHook(hooks.EventReload, func() {
+		if err := maintenance.Load(); err != nil {
+			log.Println("failed to read maintenance mode status:", err)
+		}
+	})
+
+	s.endpoints, s.mods, err = RegisterModules(globals, modBlocks)
+	if err != nil {
+		return err
+	}
+
+	if err := initModules(globals, s.endpoints, s.mods); err != nil {
+		return err
+	}
+
+	if s.opts.ControlSocket {
+		// Let maddyctl manage accounts through the server instead of opening the
+		// database concurrently.
+		ctlServer, err := control.Listen(control.SocketPath(), log.Logger{Name: "control", Debug: log.DefaultLogger.Debug})
+		if err != nil {
+			log.Println("failed to create control socket, maddyctl will access databases directly:", err)
+		} else {
+			hooks.AddHook(hooks.EventShutdown, func() {
+				if err := ctlServer.Close(); err != nil {
+					log.Println("failed to close control socket:", err)
+				}
+			})
+		}
+	}
+
+	return nil
+}
+
+// Stop closes all modules, waiting for running transactions to complete.
+//
+// Stop does nothing if the server is not running.
+func (s *Server) Stop() {
+	if !s.started || s.stopped {
+		return
+	}
+
+	runningLock.Lock()
+	defer runningLock.Unlock()
+
+	s.shutdown()
+	s.stopped = true
+	running = false
+}
+
+func (s *Server) shutdown() {
+	hooks.RunHooks(hooks.EventShutdown)
+	hooks.Clear()
+	module.ResetInstances()
+
+	if s.prevWd != "" {
+		if err := os.Chdir(s.prevWd); err != nil {
+			log.Println("failed to restore working directory:", err)
+		}
+	}
+
+	if s.cfgLog {
+		log.DefaultLogger.Out.Close()
+	}
+	s.restoreEnv()
+}
+
+func (s *Server) restoreEnv() {
+	log.DefaultLogger.Out = s.prevLog
+	log.DefaultLogger.Debug = s.prevDbg
+}
+
+// Reload requests modules to reload secondary files such as aliases mapping
+// and TLS certificates. It is the same as sending SIGUSR2 to the maddy
+// process.
+func (s *Server) Reload() {
+	if !s.started || s.stopped {
+		return
+	}
+	hooks.RunHooks(hooks.EventReload)
+}
+
+// Module returns the initialized module instance with the specified name
+// or alias.
+//
+// Endpoints are not included.
+func (s *Server) Module(name string) (module.Module, error) {
+	if !s.started || s.stopped {
+		return nil, errors.New("maddy: server is not running")
+	}
+
+	mod, ok := module.GetInitializedInstance(name)
+	if !ok {
+		return nil, fmt.Errorf("maddy: unknown config block: %s", name)
+	}
+	return mod, nil
+}
+
+// Modules returns the sorted list of names of all module instances used by
+// the server.
+func (s *Server) Modules() []string {
+	if !s.started || s.stopped {
+		return nil
+	}
+	return module.InstanceNames()
+}
+
+// Endpoints returns all endpoint module instances.
+func (s *Server) Endpoints() []module.Module {
+	if !s.started || s.stopped {
+		return nil
+	}
+
+	endps := make([]module.Module, 0, len(s.endpoints))
+	for _, endp := range s.endpoints {
+		endps = append(endps, endp.Instance)
+	}
+	return endps
+}
@@ -0,0 +1,143 @@
+/*
+Maddy Mail Server - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, Maddy Mail Server contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package maddy
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/foxcpp/maddy/framework/log"
+)
+
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func testServer(t *testing.T, addr string) *Server {
+	t.Helper()
+
+	srv, err := NewServerFromString(`
+		hostname mx.example.org
+		tls off
+
+		dummy test_target
+
+		smtp tcp://`+addr+` {
+			deliver_to &test_target
+		}`, Options{
+		StateDirectory:   t.TempDir(),
+		RuntimeDirectory: t.TempDir(),
+		Log:              log.NopOutput{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestServer(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := freePort(t)
+	srv := testServer(t, addr)
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Error("Server does not accept connections:", err)
+	} else {
+		conn.Close()
+	}
+
+	if _, err := srv.Module("test_target"); err != nil {
+		t.Error("Module lookup failed:", err)
+	}
+	if _, err := srv.Module("nonexistent"); err == nil {
+		t.Error("No error for unknown module")
+	}
+	if mods := srv.Modules(); len(mods) != 1 || mods[0] != "test_target" {
+		t.Error("Wrong modules list:", mods)
+	}
+	if len(srv.Endpoints()) != 1 {
+		t.Error("Wrong endpoints count:", len(srv.Endpoints()))
+	}
+
+	if err := testServer(t, freePort(t)).Start(); err == nil {
+		t.Error("Second server started concurrently")
+	}
+
+	srv.Stop()
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("Server accepts connections after Stop")
+	}
+	if newWd, _ := os.Getwd(); newWd != wd {
+		t.Error("Working directory is not restored:", newWd)
+	}
+
+	// Instance names are not occupied by the stopped server.
+	srv = testServer(t, addr)
+	if err := srv.Start(); err != nil {
+		t.Fatal("Restart failed:", err)
+	}
+	srv.Stop()
+}
+
+func TestServer_StartFail(t *testing.T) {
+	srv, err := NewServerFromString(`
+		hostname mx.example.org
+		tls off
+
+		dummy unused_target
+
+		smtp tcp://`+freePort(t)+` {
+			deliver_to dummy
+		}`, Options{
+		StateDirectory:   t.TempDir(),
+		RuntimeDirectory: t.TempDir(),
+		Log:              log.NopOutput{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err == nil {
+		srv.Stop()
+		t.Fatal("No error for unused configuration block")
+	}
+
+	// Failed Start should release the global state.
+	srv = testServer(t, freePort(t))
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Stop()
+}
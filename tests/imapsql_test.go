@@ -21,6 +21,9 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package tests_test
 
 import (
+	"path"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -71,6 +74,7 @@ func TestImapsqlDelivery(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* OK \[MAILBOXID *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
@@ -157,6 +161,7 @@ func TestImapsqlDeliveryMap(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* OK \[MAILBOXID *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
@@ -228,6 +233,7 @@ func TestImapsqlAuthMap(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* OK \[MAILBOXID *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
@@ -253,3 +259,227 @@ func TestImapsqlAuthMap(tt *testing.T) {
 	imapConn.ExpectPattern(`\* 1 EXISTS`)
 	imapConn.ExpectPattern(". OK *")
 }
+
+func TestImapsqlMultiAppend(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+			appendlimit 64B
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth dummy
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK *`)
+	imapConn.Writeln(". LOGIN testusr@maddy.test 1234")
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". CAPABILITY")
+	imapConn.ExpectPattern(`\* CAPABILITY *MULTIAPPEND*`)
+	imapConn.ExpectPattern(". OK *")
+
+	msg1 := "Subject: 1\r\n\r\nHi!\r\n"
+	msg2 := "Subject: 2\r\n\r\nHi!\r\n"
+	imapConn.Write(". APPEND INBOX (\\Seen) {" + strconv.Itoa(len(msg1)) + "+}\r\n" + msg1 +
+		" {" + strconv.Itoa(len(msg2)) + "+}\r\n" + msg2 + "\r\n")
+	imapConn.ExpectPattern(". OK *")
+
+	imapConn.Writeln(". STATUS INBOX (MESSAGES)")
+	imapConn.Expect(`* STATUS INBOX (MESSAGES 2)`)
+	imapConn.ExpectPattern(". OK *")
+
+	// Second message exceeds appendlimit, neither of messages should be
+	// added.
+	big := "Subject: 3\r\n\r\n" + strings.Repeat("A", 100) + "\r\n"
+	imapConn.Write(". APPEND INBOX {" + strconv.Itoa(len(msg1)) + "+}\r\n" + msg1 +
+		" {" + strconv.Itoa(len(big)) + "+}\r\n" + big + "\r\n")
+	imapConn.ExpectPattern(". NO *")
+
+	imapConn.Writeln(". STATUS INBOX (MESSAGES)")
+	imapConn.Expect(`* STATUS INBOX (MESSAGES 2)`)
+	imapConn.ExpectPattern(". OK *")
+}
+
+func TestImapsqlUIDPlus(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth dummy
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK *`)
+	imapConn.Writeln(". LOGIN testusr@maddy.test 1234")
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". CAPABILITY")
+	imapConn.ExpectPattern(`\* CAPABILITY *UIDPLUS*`)
+	imapConn.ExpectPattern(". OK *")
+
+	// Updates are sent asynchronously and may arrive after the tagged
+	// response of the command that caused them, so untagged responses are
+	// collected until the tagged response for the command with the unique
+	// tag is received.
+	cmdNum := 0
+	cmd := func(cmd string) (untagged []string, tagged string) {
+		cmdNum++
+		tag := "a" + strconv.Itoa(cmdNum)
+		imapConn.Write(tag + " " + cmd + "\r\n")
+		for {
+			line := imapConn.ExpectPattern(`*`)
+			if strings.HasPrefix(line, tag+" ") {
+				if !strings.HasPrefix(line, tag+" OK") {
+					t.Fatal("Command failed:", line)
+				}
+				return untagged, strings.TrimPrefix(line, tag+" ")
+			}
+			untagged = append(untagged, line)
+		}
+	}
+
+	cmd("CREATE Target")
+
+	msg := "Subject: 1\r\n\r\nHi!\r\n"
+	for i := 1; i <= 2; i++ {
+		_, resp := cmd("APPEND INBOX {" + strconv.Itoa(len(msg)) + "+}\r\n" + msg)
+		if match, _ := path.Match(`OK \[APPENDUID * `+strconv.Itoa(i)+`\] *`, resp); !match {
+			t.Fatal("Unexpected APPEND response:", resp)
+		}
+	}
+
+	cmd("SELECT INBOX")
+
+	_, resp := cmd("UID COPY 1:2 Target")
+	if match, _ := path.Match(`OK \[COPYUID * 1:2 1:2\] *`, resp); !match {
+		t.Fatal("Unexpected UID COPY response:", resp)
+	}
+
+	untagged, _ := cmd("UID MOVE 2 Target")
+	copyUID := false
+	for _, line := range untagged {
+		if match, _ := path.Match(`\* OK \[COPYUID * 2 3\] *`, line); match {
+			copyUID = true
+		}
+	}
+	if !copyUID {
+		t.Fatal("COPYUID is not sent for UID MOVE")
+	}
+
+	cmd("SELECT Target")
+	cmd("UID STORE 1:2 +FLAGS.SILENT (\\Deleted)")
+	cmd("UID EXPUNGE 1")
+
+	untagged, _ = cmd("STATUS Target (MESSAGES)")
+	if !strings.Contains(strings.Join(untagged, "\n"), `* STATUS "Target" (MESSAGES 2)`) {
+		t.Fatal("Unexpected STATUS response:", untagged)
+	}
+}
+
+func TestImapsqlObjectID(tt *testing.T) {
+	tt.Parallel()
+	t := tests.NewT(tt)
+
+	t.DNS(nil)
+	t.Port("imap")
+	t.Config(`
+		storage.imapsql test_store {
+			driver sqlite3
+			dsn imapsql.db
+		}
+
+		imap tcp://127.0.0.1:{env:TEST_PORT_imap} {
+			tls off
+
+			auth dummy
+			storage &test_store
+		}
+	`)
+	t.Run(1)
+	defer t.Close()
+
+	imapConn := t.Conn("imap")
+	defer imapConn.Close()
+	imapConn.ExpectPattern(`\* OK *`)
+	imapConn.Writeln(". LOGIN testusr@maddy.test 1234")
+	imapConn.ExpectPattern(". OK *")
+	imapConn.Writeln(". CAPABILITY")
+	imapConn.ExpectPattern(`\* CAPABILITY *OBJECTID*`)
+	imapConn.ExpectPattern(". OK *")
+
+	cmdNum := 0
+	cmd := func(cmd string) (untagged []string, tagged string) {
+		cmdNum++
+		tag := "a" + strconv.Itoa(cmdNum)
+		imapConn.Write(tag + " " + cmd + "\r\n")
+		for {
+			line := imapConn.ExpectPattern(`*`)
+			if strings.HasPrefix(line, tag+" ") {
+				if !strings.HasPrefix(line, tag+" OK") {
+					t.Fatal("Command failed:", line)
+				}
+				return untagged, strings.TrimPrefix(line, tag+" ")
+			}
+			untagged = append(untagged, line)
+		}
+	}
+
+	_, resp := cmd("CREATE Target")
+	if match, _ := path.Match(`OK \[MAILBOXID (M*)\] *`, resp); !match {
+		t.Fatal("Unexpected CREATE response:", resp)
+	}
+	mboxID := resp[len("OK [MAILBOXID ("):strings.IndexByte(resp, ')')]
+
+	msg := "Subject: 1\r\n\r\nHi!\r\n"
+	cmd("APPEND Target {" + strconv.Itoa(len(msg)) + "+}\r\n" + msg)
+
+	untagged, _ := cmd("STATUS Target (MAILBOXID SIZE)")
+	expected := `* STATUS "Target" (MAILBOXID (` + mboxID + `) SIZE ` + strconv.Itoa(len(msg)) + `)`
+	if !strings.Contains(strings.Join(untagged, "\n"), expected) {
+		t.Fatal("Unexpected STATUS response:", untagged)
+	}
+
+	untagged, _ = cmd("SELECT Target")
+	if !strings.Contains(strings.Join(untagged, "\n"), `* OK [MAILBOXID (`+mboxID+`)]`) {
+		t.Fatal("MAILBOXID is not sent for SELECT:", untagged)
+	}
+
+	untagged, _ = cmd("FETCH 1 (EMAILID THREADID)")
+	fetched := false
+	for _, line := range untagged {
+		if match, _ := path.Match(`\* 1 FETCH (EMAILID (E*) THREADID NIL)`, line); match {
+			fetched = true
+		}
+	}
+	if !fetched {
+		t.Fatal("Unexpected FETCH response:", untagged)
+	}
+}
@@ -84,6 +84,76 @@ capsloop:
 	c.ExpectPattern("221 *")
 }
 
+func TestLMTPServer_RcptBlockReject(tt *testing.T) {
+	tt.Parallel()
+
+	t := tests.NewT(tt)
+	t.DNS(nil)
+	t.Port("lmtp")
+	t.Config(`
+		lmtp tcp://127.0.0.1:{env:TEST_PORT_lmtp} {
+			hostname mx.maddy.test
+			tls off
+
+			destination rejected.maddy.test {
+				check {
+					dkim {
+						no_sig_action reject
+					}
+				}
+				deliver_to dummy
+			}
+			default_destination {
+				deliver_to dummy
+			}
+		}`)
+	t.Run(1)
+	defer t.Close()
+
+	c := t.Conn("lmtp")
+	defer c.Close()
+
+	c.Writeln("LHLO client.maddy.test")
+	c.ExpectPattern("220 *")
+capsloop:
+	for {
+		line, err := c.Readln()
+		if err != nil {
+			t.Fatal("I/O error:", err)
+		}
+		switch {
+		case strings.HasPrefix(line, "250-"):
+		case strings.HasPrefix(line, "250 "):
+			break capsloop
+		default:
+			t.Fatal("Unexpected reply:", line)
+		}
+	}
+
+	c.Writeln("MAIL FROM:<from@maddy.test>")
+	c.ExpectPattern("250 *")
+	c.Writeln("RCPT TO:<to1@maddy.test>")
+	c.ExpectPattern("250 *")
+	c.Writeln("RCPT TO:<to2@rejected.maddy.test>")
+	c.ExpectPattern("250 *")
+	c.Writeln("RCPT TO:<to3@maddy.test>")
+	c.ExpectPattern("250 *")
+	c.Writeln("DATA")
+	c.ExpectPattern("354 *")
+	c.Writeln("From: <from@maddy.test>")
+	c.Writeln("To: <to@maddy.test>")
+	c.Writeln("Subject: Hello!")
+	c.Writeln("")
+	c.Writeln("Hello!")
+	c.Writeln(".")
+	// Only the recipient of the block that rejected the message fails.
+	c.ExpectPattern("250 2.0.0 <to1@maddy.test> OK: queued")
+	c.ExpectPattern("550 5.7.20 *")
+	c.ExpectPattern("250 2.0.0 <to3@maddy.test> OK: queued")
+	c.Writeln("QUIT")
+	c.ExpectPattern("221 *")
+}
+
 func TestLMTPClient_Is_Actually_LMTP(tt *testing.T) {
 	t := tests.NewT(tt)
 	t.DNS(nil)
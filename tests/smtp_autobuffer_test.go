@@ -73,6 +73,7 @@ func TestSMTPEndpoint_LargeMessage(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* OK \[MAILBOXID *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
@@ -162,6 +163,7 @@ func TestSMTPEndpoint_FileBuffer(tt *testing.T) {
 		imapConn.ExpectPattern(`\* *`)
 		imapConn.ExpectPattern(`\* *`)
 		imapConn.ExpectPattern(`\* *`)
+		imapConn.ExpectPattern(`\* OK \[MAILBOXID *`)
 		imapConn.ExpectPattern(`. OK *`)
 
 		smtpConn := t.Conn("smtp")
@@ -250,6 +252,7 @@ func TestSMTPEndpoint_Autobuffer(tt *testing.T) {
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
 	imapConn.ExpectPattern(`\* *`)
+	imapConn.ExpectPattern(`\* OK \[MAILBOXID *`)
 	imapConn.ExpectPattern(`. OK *`)
 
 	smtpConn := t.Conn("smtp")
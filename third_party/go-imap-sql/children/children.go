@@ -0,0 +1,6 @@
+package children
+
+const Capability = "CHILDREN"
+
+const HasChildrenAttr = "\\HasChildren"
+const HasNoChildrenAttr = "\\HasNoChildren"